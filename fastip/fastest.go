@@ -4,9 +4,11 @@
 package fastip
 
 import (
+	"context"
 	"log/slog"
 	"net"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +28,9 @@ const LogPrefix = "fastip"
 // operations to finish.
 const DefaultPingWaitTimeout = 1 * time.Second
 
+// DefaultPingPorts are the default TCP ports to ping the addresses on.
+var DefaultPingPorts = []uint{80, 443}
+
 // FastestAddr provides methods to determine the fastest network addresses.
 type FastestAddr struct {
 	// logger is used for logging during the process.  It is never nil.
@@ -43,6 +48,10 @@ type FastestAddr struct {
 	// pingPorts are the ports to ping on.
 	pingPorts []uint
 
+	// pingICMP is true if the addresses are also pinged with ICMP echo
+	// requests.
+	pingICMP bool
+
 	// pingWaitTimeout is the timeout for waiting all the resolved addresses to
 	// be pinged.  Any ping results received after that moment are cached, but
 	// won't be used.
@@ -59,6 +68,17 @@ type Config struct {
 	// be pinged.  Any ping results received after that moment are cached, but
 	// won't be used.  If zero, [DefaultPingWaitTimeout] is used.
 	PingWaitTimeout time.Duration
+
+	// PingPorts are the TCP ports to ping the addresses on.  If empty,
+	// [DefaultPingPorts] are used.
+	PingPorts []uint
+
+	// PingICMP makes the addresses also pinged with ICMP echo requests, which
+	// is useful for the hosts not listening on any of PingPorts.  It requires
+	// the permission to open unprivileged ICMP sockets, e.g. the
+	// net.ipv4.ping_group_range sysctl on Linux, otherwise only the TCP pings
+	// are used.
+	PingICMP bool
 }
 
 // New initializes a new instance of *FastestAddr.
@@ -69,10 +89,15 @@ func New(c *Config) (f *FastestAddr) {
 			MaxSize:   64 * 1024,
 			EnableLRU: true,
 		}),
-		pingPorts: []uint{80, 443},
+		pingPorts: DefaultPingPorts,
+		pingICMP:  c.PingICMP,
 		pinger:    &net.Dialer{Timeout: pingTCPTimeout},
 	}
 
+	if len(c.PingPorts) > 0 {
+		f.pingPorts = slices.Clone(c.PingPorts)
+	}
+
 	if c.PingWaitTimeout > 0 {
 		f.pingWaitTimeout = c.PingWaitTimeout
 	} else {
@@ -91,11 +116,13 @@ func New(c *Config) (f *FastestAddr) {
 // ExchangeFastest queries each specified upstream and returns the response with
 // the fastest IP address.  The fastest IP address is considered to be the first
 // one successfully dialed and other addresses are removed from the answer.
+// The exchanges are canceled once ctx is done.
 func (f *FastestAddr) ExchangeFastest(
+	ctx context.Context,
 	req *dns.Msg,
 	ups []upstream.Upstream,
 ) (resp *dns.Msg, u upstream.Upstream, err error) {
-	replies, err := upstream.ExchangeAll(ups, req)
+	replies, err := upstream.ExchangeAll(ctx, ups, req)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1,6 +1,7 @@
 package fastip
 
 import (
+	"context"
 	"net/netip"
 	"testing"
 
@@ -27,7 +28,7 @@ func TestFastestAddr_ExchangeFastest(t *testing.T) {
 			PingWaitTimeout: DefaultPingWaitTimeout,
 		})
 
-		resp, up, err := f.ExchangeFastest(newTestReq(t), []upstream.Upstream{u})
+		resp, up, err := f.ExchangeFastest(context.Background(), newTestReq(t), []upstream.Upstream{u})
 		require.Error(t, err)
 
 		assert.ErrorIs(t, err, errDesired)
@@ -56,7 +57,7 @@ func TestFastestAddr_ExchangeFastest(t *testing.T) {
 			recs: []*dns.A{newTestRec(t, netip.MustParseAddr("192.0.2.1"))},
 		}
 
-		rep, ups, err := f.ExchangeFastest(newTestReq(t), []upstream.Upstream{dead, alive})
+		rep, ups, err := f.ExchangeFastest(context.Background(), newTestReq(t), []upstream.Upstream{dead, alive})
 		require.NoError(t, err)
 
 		assert.Equal(t, ups, alive)
@@ -84,7 +85,7 @@ func TestFastestAddr_ExchangeFastest(t *testing.T) {
 			},
 		}
 
-		resp, _, err := f.ExchangeFastest(newTestReq(t), []upstream.Upstream{ups})
+		resp, _, err := f.ExchangeFastest(context.Background(), newTestReq(t), []upstream.Upstream{ups})
 		require.NoError(t, err)
 
 		require.NotNil(t, resp)
@@ -107,7 +108,7 @@ func (u *errUpstream) Address() string {
 }
 
 // Exchange implements the [upstream.Upstream] interface for *errUpstream.
-func (u *errUpstream) Exchange(_ *dns.Msg) (*dns.Msg, error) {
+func (u *errUpstream) Exchange(_ context.Context, _ *dns.Msg) (*dns.Msg, error) {
 	return nil, u.err
 }
 
@@ -125,7 +126,7 @@ type testAUpstream struct {
 var _ upstream.Upstream = (*testAUpstream)(nil)
 
 // Exchange implements the [upstream.Upstream] interface for *testAUpstream.
-func (u *testAUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+func (u *testAUpstream) Exchange(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 	resp = &dns.Msg{}
 	resp.SetReply(m)
 
@@ -0,0 +1,129 @@
+package fastip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ICMP protocol numbers, see https://www.iana.org/assignments/protocol-numbers.
+const (
+	protoICMP   = 1
+	protoICMPv6 = 58
+)
+
+// icmpEchoSeq is the sequence number of the echo requests.  Each request is
+// sent from its own socket, so there is no need to distinguish them.
+const icmpEchoSeq = 1
+
+// pingDoICMP sends the result of pinging addr with an ICMP echo request into
+// resCh.  The request is sent from an unprivileged datagram socket, which
+// requires the corresponding permission, e.g. the net.ipv4.ping_group_range
+// sysctl on Linux.
+func (f *FastestAddr) pingDoICMP(host string, addr netip.Addr, resCh chan *pingResult) {
+	l := f.logger.With("host", host, "addr", addr)
+	l.Debug("sending icmp echo request")
+
+	start := time.Now()
+	err := exchangeICMPEcho(addr, start.Add(pingTCPTimeout))
+	elapsed := time.Since(start)
+
+	latency := uint(elapsed.Milliseconds())
+	success := err == nil
+
+	resCh <- &pingResult{
+		addrPort: netip.AddrPortFrom(addr, 0),
+		latency:  latency,
+		success:  success,
+	}
+
+	if success {
+		l.Debug("icmp ping success", "elapsed", elapsed)
+		f.cacheAddSuccessful(addr, latency)
+	} else {
+		// Don't cache the failure, since the address may still respond to
+		// the TCP pings, or ICMP may be not permitted at all.
+		l.Debug("icmp ping failed", "elapsed", elapsed, slogutil.KeyError, err)
+	}
+}
+
+// exchangeICMPEcho sends an ICMP echo request to addr and waits for the reply
+// until deadline.
+func exchangeICMPEcho(addr netip.Addr, deadline time.Time) (err error) {
+	network, laddr, proto := "udp4", "0.0.0.0", protoICMP
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if addr = addr.Unmap(); addr.Is6() {
+		network, laddr, proto = "udp6", "::", protoICMPv6
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		return fmt.Errorf("opening icmp socket: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	// The kernel replaces the identifier with the local port of the socket.
+	req := &icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{
+			Seq:  icmpEchoSeq,
+			Data: []byte(LogPrefix),
+		},
+	}
+
+	b, err := req.Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("marshaling echo request: %w", err)
+	}
+
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	dst := &net.UDPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}
+	_, err = conn.WriteTo(b, dst)
+	if err != nil {
+		return fmt.Errorf("sending echo request: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		var n int
+		var from net.Addr
+		n, from, err = conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("reading echo reply: %w", err)
+		}
+
+		if isEchoReply(buf[:n], proto, replyType, from, addr) {
+			return nil
+		}
+	}
+}
+
+// isEchoReply returns true if data received from the from address is the echo
+// reply from addr.
+func isEchoReply(data []byte, proto int, replyType icmp.Type, from net.Addr, addr netip.Addr) (ok bool) {
+	udpFrom, ok := from.(*net.UDPAddr)
+	if !ok || udpFrom.AddrPort().Addr().Unmap().WithZone("") != addr.WithZone("") {
+		return false
+	}
+
+	msg, err := icmp.ParseMessage(proto, data)
+	if err != nil || msg.Type != replyType {
+		return false
+	}
+
+	echo, ok := msg.Body.(*icmp.Echo)
+
+	return ok && echo.Seq == icmpEchoSeq
+}
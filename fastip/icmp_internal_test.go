@@ -0,0 +1,117 @@
+package fastip
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestIsEchoReply(t *testing.T) {
+	ip := netutil.IPv4Localhost()
+	from := &net.UDPAddr{IP: ip.AsSlice()}
+
+	newMsg := func(t *testing.T, typ icmp.Type, seq int) (b []byte) {
+		t.Helper()
+
+		b, err := (&icmp.Message{
+			Type: typ,
+			Body: &icmp.Echo{Seq: seq, Data: []byte(LogPrefix)},
+		}).Marshal(nil)
+		require.NoError(t, err)
+
+		return b
+	}
+
+	testCases := []struct {
+		from net.Addr
+		name string
+		data []byte
+		want assert.BoolAssertionFunc
+	}{{
+		from: from,
+		name: "reply",
+		data: newMsg(t, ipv4.ICMPTypeEchoReply, icmpEchoSeq),
+		want: assert.True,
+	}, {
+		from: &net.UDPAddr{IP: netip.MustParseAddr("::ffff:127.0.0.1").AsSlice()},
+		name: "mapped",
+		data: newMsg(t, ipv4.ICMPTypeEchoReply, icmpEchoSeq),
+		want: assert.True,
+	}, {
+		from: from,
+		name: "request",
+		data: newMsg(t, ipv4.ICMPTypeEcho, icmpEchoSeq),
+		want: assert.False,
+	}, {
+		from: from,
+		name: "other_seq",
+		data: newMsg(t, ipv4.ICMPTypeEchoReply, icmpEchoSeq+1),
+		want: assert.False,
+	}, {
+		from: &net.UDPAddr{IP: net.IP{127, 0, 0, 2}},
+		name: "other_addr",
+		data: newMsg(t, ipv4.ICMPTypeEchoReply, icmpEchoSeq),
+		want: assert.False,
+	}, {
+		from: from,
+		name: "garbage",
+		data: []byte{1, 2, 3},
+		want: assert.False,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.want(t, isEchoReply(tc.data, protoICMP, ipv4.ICMPTypeEchoReply, tc.from, ip))
+		})
+	}
+}
+
+func TestFastestAddr_PingAll_icmp(t *testing.T) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		t.Skipf("unprivileged icmp sockets aren't permitted: %s", err)
+	}
+	require.NoError(t, conn.Close())
+
+	ip := netutil.IPv4Localhost()
+
+	f := New(&Config{
+		Logger:    slogutil.NewDiscardLogger(),
+		PingPorts: []uint{getFreePort(t)},
+		PingICMP:  true,
+	})
+
+	res := f.pingAll("", []netip.Addr{ip, ip})
+	require.NotNil(t, res)
+
+	assert.True(t, res.success)
+	assert.Equal(t, ip, res.addrPort.Addr())
+	// ICMP results have no port.
+	assert.Zero(t, res.addrPort.Port())
+
+	assertCaching(t, f, ip, 0)
+}
+
+func TestNew_pingPorts(t *testing.T) {
+	f := New(&Config{Logger: slogutil.NewDiscardLogger()})
+	assert.Equal(t, DefaultPingPorts, f.pingPorts)
+	assert.Equal(t, 2, f.pingsPerAddr())
+
+	ports := []uint{853}
+	f = New(&Config{
+		Logger:    slogutil.NewDiscardLogger(),
+		PingPorts: ports,
+		PingICMP:  true,
+	})
+	ports[0] = 0
+
+	assert.Equal(t, []uint{853}, f.pingPorts)
+	assert.Equal(t, 2, f.pingsPerAddr())
+}
@@ -41,6 +41,10 @@ func (f *FastestAddr) schedulePings(
 				go f.pingDoTCP(host, netip.AddrPortFrom(ip, uint16(port)), resCh)
 			}
 
+			if f.pingICMP {
+				go f.pingDoICMP(host, ip, resCh)
+			}
+
 			continue
 		}
 
@@ -56,6 +60,16 @@ func (f *FastestAddr) schedulePings(
 	return pr, scheduled
 }
 
+// pingsPerAddr returns the number of pings sent to each address.
+func (f *FastestAddr) pingsPerAddr() (n int) {
+	n = len(f.pingPorts)
+	if f.pingICMP {
+		n++
+	}
+
+	return n
+}
+
 // pingAll pings all ips concurrently and returns as soon as the fastest one is
 // found or the timeout is exceeded.
 func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
@@ -70,7 +84,7 @@ func (f *FastestAddr) pingAll(host string, ips []netip.Addr) (pr *pingResult) {
 		}
 	}
 
-	resCh := make(chan *pingResult, ipN*len(f.pingPorts))
+	resCh := make(chan *pingResult, ipN*f.pingsPerAddr())
 	pr, scheduled := f.schedulePings(resCh, ips, host)
 	if !scheduled {
 		if pr != nil {
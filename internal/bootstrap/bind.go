@@ -0,0 +1,93 @@
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// BindAddr is the local side of the connections to the upstream servers.  A nil
+// *BindAddr is valid and leaves choosing it to the system.
+type BindAddr struct {
+	// Interface is the name of the network interface, e.g. a VRF device, to
+	// bind the sockets to.  It's only supported on Linux.  If empty, the
+	// sockets aren't bound to any interface.
+	Interface string
+
+	// IPv4 is the source address of the connections to the IPv4 addresses.  If
+	// it's not valid, the system chooses it.
+	IPv4 netip.Addr
+
+	// IPv6 is the source address of the connections to the IPv6 addresses.  If
+	// it's not valid, the system chooses it.
+	IPv6 netip.Addr
+}
+
+// localAddr returns the source address of the connections to raddr.  It's not
+// valid if the system should choose it.
+func (b *BindAddr) localAddr(raddr netip.Addr) (laddr netip.Addr) {
+	switch {
+	case b == nil, !raddr.IsValid():
+		return netip.Addr{}
+	case raddr.Unmap().Is4():
+		return b.IPv4
+	default:
+		return b.IPv6
+	}
+}
+
+// control returns the function binding the sockets to the interface or nil if
+// there is no interface to bind to.
+func (b *BindAddr) control() (f func(network, address string, c syscall.RawConn) (err error)) {
+	if b == nil || b.Interface == "" {
+		return nil
+	}
+
+	return func(_, _ string, c syscall.RawConn) (err error) {
+		return bindToDevice(c, b.Interface)
+	}
+}
+
+// newDialer returns a dialer for the connections over network to addr.  addr
+// should be a valid IP address with port.
+func (b *BindAddr) newDialer(network Network, addr string, timeout time.Duration) (d *net.Dialer) {
+	d = &net.Dialer{
+		Timeout: timeout,
+		Control: b.control(),
+	}
+
+	// The error is handled by the dialer itself.
+	raddr, _ := netip.ParseAddrPort(addr)
+	laddr := b.localAddr(raddr.Addr())
+	if !laddr.IsValid() {
+		return d
+	}
+
+	if network == NetworkTCP {
+		d.LocalAddr = &net.TCPAddr{IP: laddr.AsSlice()}
+	} else {
+		d.LocalAddr = &net.UDPAddr{IP: laddr.AsSlice()}
+	}
+
+	return d
+}
+
+// ListenPacket returns a new UDP socket for sending the packets to raddr bound
+// in accordance with b.
+func (b *BindAddr) ListenPacket(
+	ctx context.Context,
+	raddr netip.AddrPort,
+) (conn net.PacketConn, err error) {
+	lc := &net.ListenConfig{
+		Control: b.control(),
+	}
+
+	laddr := ":0"
+	if ip := b.localAddr(raddr.Addr()); ip.IsValid() {
+		laddr = netip.AddrPortFrom(ip, 0).String()
+	}
+
+	return lc.ListenPacket(ctx, NetworkUDP, laddr)
+}
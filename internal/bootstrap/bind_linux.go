@@ -0,0 +1,27 @@
+//go:build linux
+
+package bootstrap
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice binds the socket c to the network interface with the given
+// name using SO_BINDTODEVICE.
+func bindToDevice(c syscall.RawConn, iface string) (err error) {
+	var opErr error
+	err = c.Control(func(fd uintptr) {
+		opErr = unix.BindToDevice(int(fd), iface)
+	})
+
+	err = errors.WithDeferred(opErr, err)
+	if err != nil {
+		return fmt.Errorf("binding to interface %q: %w", iface, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package bootstrap
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// bindToDevice returns [errors.ErrUnsupported], since binding the sockets to
+// the network interfaces is only supported on Linux.
+func bindToDevice(_ syscall.RawConn, iface string) (err error) {
+	return fmt.Errorf("binding to interface %q: %w", iface, errors.ErrUnsupported)
+}
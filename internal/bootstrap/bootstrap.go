@@ -44,12 +44,17 @@ const (
 type DialHandler func(ctx context.Context, network Network, addr string) (conn net.Conn, err error)
 
 // ResolveDialContext returns a DialHandler that uses addresses resolved from u
-// using resolver.  l and u must not be nil.
+// using resolver.  The addresses of both families are dialed in accordance
+// with happyEyeballsDelay, see [NewHappyEyeballsDialContext].  The connections
+// are bound in accordance with bind, which may be nil.  l and u must not be
+// nil.
 func ResolveDialContext(
 	u *url.URL,
 	timeout time.Duration,
+	happyEyeballsDelay time.Duration,
 	r Resolver,
 	preferV6 bool,
+	bind *BindAddr,
 	l *slog.Logger,
 ) (h DialHandler, err error) {
 	defer func() { err = errors.Annotate(err, "dialing %q: %w", u.Host) }()
@@ -89,13 +94,19 @@ func ResolveDialContext(
 		addrs = append(addrs, netip.AddrPortFrom(ip, port).String())
 	}
 
-	return NewDialContext(timeout, l, addrs...), nil
+	return NewHappyEyeballsDialContext(timeout, happyEyeballsDelay, bind, l, addrs...), nil
 }
 
 // NewDialContext returns a DialHandler that dials addrs and returns the first
-// successful connection.  At least a single addr should be specified.  l must
-// not be nil.
-func NewDialContext(timeout time.Duration, l *slog.Logger, addrs ...string) (h DialHandler) {
+// successful connection.  At least a single addr should be specified.  The
+// connections are bound in accordance with bind, which may be nil.  l must not
+// be nil.
+func NewDialContext(
+	timeout time.Duration,
+	bind *BindAddr,
+	l *slog.Logger,
+	addrs ...string,
+) (h DialHandler) {
 	addrLen := len(addrs)
 	if addrLen == 0 {
 		l.Debug("no addresses to dial")
@@ -105,10 +116,6 @@ func NewDialContext(timeout time.Duration, l *slog.Logger, addrs ...string) (h D
 		}
 	}
 
-	dialer := &net.Dialer{
-		Timeout: timeout,
-	}
-
 	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
 		var errs []error
 
@@ -119,7 +126,7 @@ func NewDialContext(timeout time.Duration, l *slog.Logger, addrs ...string) (h D
 			a.DebugContext(ctx, "dialing", "idx", i+1, "total", addrLen)
 
 			start := time.Now()
-			conn, err = dialer.DialContext(ctx, network, addr)
+			conn, err = bind.newDialer(network, addr, timeout).DialContext(ctx, network, addr)
 			elapsed := time.Since(start)
 			if err != nil {
 				a.DebugContext(ctx, "connection failed", "elapsed", elapsed, slogutil.KeyError, err)
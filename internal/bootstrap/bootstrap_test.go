@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/netip"
 	"net/url"
+	"runtime"
 	"testing"
 	"time"
 
@@ -101,8 +102,10 @@ func TestResolveDialContext(t *testing.T) {
 			dialContext, err := bootstrap.ResolveDialContext(
 				&url.URL{Host: netutil.JoinHostPort(hostname, port)},
 				testTimeout,
+				0,
 				bootstrap.ParallelResolver{r},
 				tc.preferIPv6,
+				nil,
 				l,
 			)
 			require.NoError(t, err)
@@ -134,8 +137,10 @@ func TestResolveDialContext(t *testing.T) {
 		dialContext, err := bootstrap.ResolveDialContext(
 			&url.URL{Host: netutil.JoinHostPort(hostname, port)},
 			testTimeout,
+			0,
 			bootstrap.ParallelResolver{r},
 			false,
+			nil,
 			l,
 		)
 		require.NoError(t, err)
@@ -151,8 +156,10 @@ func TestResolveDialContext(t *testing.T) {
 		dialContext, err := bootstrap.ResolveDialContext(
 			&url.URL{Host: "bad hostname"},
 			testTimeout,
+			0,
 			nil,
 			false,
+			nil,
 			l,
 		)
 		testutil.AssertErrorMsg(t, errMsg, err)
@@ -164,11 +171,91 @@ func TestResolveDialContext(t *testing.T) {
 		dialContext, err := bootstrap.ResolveDialContext(
 			&url.URL{Host: netutil.JoinHostPort(hostname, port)},
 			testTimeout,
+			0,
 			nil,
 			false,
+			nil,
 			l,
 		)
 		assert.ErrorIs(t, err, bootstrap.ErrNoResolvers)
 		assert.Nil(t, dialContext)
 	})
 }
+
+func TestNewDialContext_bind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		// TODO(e.burkov):  Add the addresses to the loopback interfaces of the
+		// CI on the other platforms.
+		t.Skip("only linux has the whole 127.0.0.0/8 on the loopback interface")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	remoteCh := make(chan net.Addr, 1)
+	go func() {
+		pt := testutil.PanicT{}
+
+		c, lerr := l.Accept()
+		require.NoError(pt, lerr)
+
+		testutil.RequireSend(pt, remoteCh, c.RemoteAddr(), testTimeout)
+
+		require.NoError(pt, c.Close())
+	}()
+
+	bind := &bootstrap.BindAddr{
+		IPv4: netip.MustParseAddr("127.0.0.2"),
+	}
+
+	dialContext := bootstrap.NewDialContext(
+		testTimeout,
+		bind,
+		slogutil.NewDiscardLogger(),
+		l.Addr().String(),
+	)
+
+	conn, err := dialContext(context.Background(), bootstrap.NetworkTCP, "")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	remote, ok := testutil.RequireReceive(t, remoteCh, testTimeout)
+	require.True(t, ok)
+
+	tcpAddr := testutil.RequireTypeAssert[*net.TCPAddr](t, remote)
+	assert.Equal(t, bind.IPv4, tcpAddr.AddrPort().Addr())
+}
+
+func TestNewHappyEyeballsDialContext(t *testing.T) {
+	sig := make(chan net.Addr, 1)
+
+	ipp := newListener(t, "tcp", sig)
+
+	// The discard-only address either black-holes the connection or fails
+	// right away if IPv6 isn't available.
+	blackHole := netip.AddrPortFrom(netip.MustParseAddr("100::1"), ipp.Port()).String()
+
+	const delay = 50 * time.Millisecond
+
+	dialContext := bootstrap.NewHappyEyeballsDialContext(
+		testTimeout,
+		delay,
+		nil,
+		slogutil.NewDiscardLogger(),
+		blackHole,
+		ipp.String(),
+	)
+
+	start := time.Now()
+	conn, err := dialContext(context.Background(), bootstrap.NetworkTCP, "")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	assert.Less(t, time.Since(start), testTimeout)
+
+	expected, ok := testutil.RequireReceive(t, sig, testTimeout)
+	require.True(t, ok)
+
+	assert.Equal(t, expected.String(), conn.RemoteAddr().String())
+}
@@ -0,0 +1,165 @@
+package bootstrap
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// DefaultHappyEyeballsDelay is the default delay before dialing the addresses
+// of the other family, see [NewHappyEyeballsDialContext].  It's the same as
+// the default of [net.Dialer.FallbackDelay].
+const DefaultHappyEyeballsDelay = 300 * time.Millisecond
+
+// NewHappyEyeballsDialContext returns a DialHandler that dials addrs in the
+// Happy Eyeballs manner, see RFC 8305.  The TCP connections to the addresses of
+// the family of the first one are dialed first, and if none succeeds within
+// delay, the addresses of the other family are dialed in parallel.  The first
+// established connection is returned and the other one is closed.  The UDP
+// connections don't require a handshake, so their addresses are dialed one
+// after another.  If delay is zero, [DefaultHappyEyeballsDelay] is used.  If
+// it's negative or addrs only contain the addresses of a single family, the
+// addresses are dialed one after another as with [NewDialContext].  l must not
+// be nil.
+func NewHappyEyeballsDialContext(
+	timeout time.Duration,
+	delay time.Duration,
+	bind *BindAddr,
+	l *slog.Logger,
+	addrs ...string,
+) (h DialHandler) {
+	seq := NewDialContext(timeout, bind, l, addrs...)
+
+	primaries, fallbacks := splitByFamily(addrs)
+	if delay < 0 || len(primaries) == 0 || len(fallbacks) == 0 {
+		return seq
+	}
+
+	if delay == 0 {
+		delay = DefaultHappyEyeballsDelay
+	}
+
+	primary := NewDialContext(timeout, bind, l, primaries...)
+	fallback := NewDialContext(timeout, bind, l, fallbacks...)
+
+	return func(ctx context.Context, network Network, addr string) (conn net.Conn, err error) {
+		if network != NetworkTCP {
+			return seq(ctx, network, addr)
+		}
+
+		return dialRace(ctx, network, addr, primary, fallback, delay, l)
+	}
+}
+
+// splitByFamily splits addrs into the ones of the same family as the first one
+// and the rest, keeping the order.  The invalid addresses are considered to be
+// of the first family.
+func splitByFamily(addrs []string) (primaries, fallbacks []string) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	is4 := func(addr string) (ok bool) {
+		ipp, err := netip.ParseAddrPort(addr)
+
+		return err != nil || ipp.Addr().Unmap().Is4()
+	}
+
+	first4 := is4(addrs[0])
+	for _, addr := range addrs {
+		if is4(addr) == first4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	return slices.Clip(primaries), slices.Clip(fallbacks)
+}
+
+// dialRace dials with primary and, if it doesn't succeed within delay or
+// fails, with fallback, and returns the first established connection.  The
+// other connection, if established, is closed.  l must not be nil.
+func dialRace(
+	ctx context.Context,
+	network Network,
+	addr string,
+	primary DialHandler,
+	fallback DialHandler,
+	delay time.Duration,
+	l *slog.Logger,
+) (conn net.Conn, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Make the channel buffered, so that the losing dial doesn't block.
+	resCh := make(chan any, 2)
+	dial := func(h DialHandler) {
+		defer recoverAndLog(ctx, resCh)
+
+		c, dialErr := h(ctx, network, addr)
+		if dialErr != nil {
+			resCh <- dialErr
+		} else {
+			resCh <- c
+		}
+	}
+
+	go dial(primary)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	timerCh := timer.C
+	startFallback := func() {
+		if timerCh == nil {
+			return
+		}
+
+		timer.Stop()
+		timerCh = nil
+		pending++
+
+		l.DebugContext(ctx, "dialing other address family")
+
+		go dial(fallback)
+	}
+
+	var errs []error
+	for received := 0; received < pending; {
+		select {
+		case <-timerCh:
+			startFallback()
+		case res := <-resCh:
+			received++
+
+			switch res := res.(type) {
+			case net.Conn:
+				if received < pending {
+					go closeLate(resCh)
+				}
+
+				return res, nil
+			case error:
+				errs = append(errs, res)
+				startFallback()
+			}
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// closeLate waits for the result of the losing dial and closes the connection,
+// if it has been established.
+func closeLate(resCh <-chan any) {
+	if c, ok := (<-resCh).(net.Conn); ok {
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/net/proxy"
+)
+
+// Schemes of the proxy URLs.
+const (
+	ProxySchemeHTTP    = "http"
+	ProxySchemeSOCKS5  = "socks5"
+	ProxySchemeSOCKS5H = "socks5h"
+)
+
+// ValidateProxyURL returns an error if u isn't a valid URL of a SOCKS5 or HTTP
+// CONNECT proxy.
+func ValidateProxyURL(u *url.URL) (err error) {
+	if u == nil {
+		return errors.ErrNoValue
+	}
+
+	switch u.Scheme {
+	case ProxySchemeHTTP, ProxySchemeSOCKS5, ProxySchemeSOCKS5H:
+		// Go on.
+	default:
+		return fmt.Errorf("proxy scheme: %w: %q", errors.ErrBadEnumValue, u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("proxy host: %w", errors.ErrEmptyValue)
+	}
+
+	return nil
+}
+
+// NewProxyDialContext returns a DialHandler that establishes the TCP
+// connections to addr through the SOCKS5 or HTTP CONNECT proxy at proxyURL.
+// The hostname within addr is resolved by the proxy.  The connections to the
+// proxy are bound in accordance with bind, which may be nil.  The returned
+// handler fails to dial the other networks with [errors.ErrUnsupported].
+// proxyURL and l must not be nil.
+func NewProxyDialContext(
+	proxyURL *url.URL,
+	timeout time.Duration,
+	bind *BindAddr,
+	l *slog.Logger,
+	addr string,
+) (h DialHandler, err error) {
+	err = ValidateProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyURL = withDefaultProxyPort(proxyURL)
+	forward := bind.newDialer(NetworkTCP, proxyURL.Host, timeout)
+
+	var dial func(ctx context.Context, network, addr string) (conn net.Conn, err error)
+	if proxyURL.Scheme == ProxySchemeHTTP {
+		dial = func(ctx context.Context, _, addr string) (conn net.Conn, err error) {
+			return dialHTTPConnect(ctx, forward, proxyURL, addr)
+		}
+	} else {
+		var d proxy.Dialer
+		d, err = proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, fmt.Errorf("creating socks5 dialer: %w", err)
+		}
+
+		// The SOCKS5 dialer created from the URL always supports the contexts.
+		dial = d.(proxy.ContextDialer).DialContext
+	}
+
+	l = l.With("addr", addr, "proxy", proxyURL.Redacted())
+
+	return func(ctx context.Context, network Network, _ string) (conn net.Conn, err error) {
+		if network != NetworkTCP {
+			return nil, fmt.Errorf("dialing %s through proxy: %w", network, errors.ErrUnsupported)
+		}
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		conn, err = dial(ctx, NetworkTCP, addr)
+		elapsed := time.Since(start)
+		if err != nil {
+			l.DebugContext(ctx, "proxy connection failed", "elapsed", elapsed, slogutil.KeyError, err)
+
+			return nil, fmt.Errorf("dialing %q through proxy: %w", addr, err)
+		}
+
+		l.DebugContext(ctx, "proxy connection succeeded", "elapsed", elapsed)
+
+		return conn, nil
+	}, nil
+}
+
+// withDefaultProxyPort returns a copy of u with the default port of the scheme
+// set, if u has no port.
+func withDefaultProxyPort(u *url.URL) (res *url.URL) {
+	if u.Port() != "" {
+		return u
+	}
+
+	port := "1080"
+	if u.Scheme == ProxySchemeHTTP {
+		port = "80"
+	}
+
+	res = &url.URL{}
+	*res = *u
+	res.Host = net.JoinHostPort(u.Hostname(), port)
+
+	return res
+}
+
+// dialHTTPConnect establishes a tunnel to addr through the HTTP proxy at
+// proxyURL using the CONNECT method, see RFC 9110, Section 9.3.6.
+func dialHTTPConnect(
+	ctx context.Context,
+	forward *net.Dialer,
+	proxyURL *url.URL,
+	addr string,
+) (conn net.Conn, err error) {
+	conn, err = forward.DialContext(ctx, NetworkTCP, proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, conn.Close())
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, fmt.Errorf("setting deadline: %w", err)
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		return nil, fmt.Errorf("writing connect request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading connect response: %w", err)
+	}
+
+	// The body of a successful response to CONNECT is the tunnel itself, so
+	// don't close it.
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+
+		return nil, fmt.Errorf("connect response: unexpected status %q", resp.Status)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("resetting deadline: %w", err)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection with the data already read from it into the
+// buffer.
+type bufferedConn struct {
+	net.Conn
+
+	// r reads the buffered data first.
+	r *bufio.Reader
+}
+
+// type check
+var _ net.Conn = (*bufferedConn)(nil)
+
+// Read implements the [net.Conn] interface for *bufferedConn.
+func (c *bufferedConn) Read(b []byte) (n int, err error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,213 @@
+package bootstrap_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTarget is the address of the upstream dialed through the proxies.
+const testTarget = "dns.example:853"
+
+// testGreeting is the data sent by the fake proxies through the tunnel.
+const testGreeting = "hello"
+
+// newFakeProxy starts a fake proxy on localhost serving a single connection with
+// handshake and returns its address.  handshake should return the requested
+// target address.  The target is sent to targets.
+func newFakeProxy(
+	tb testing.TB,
+	handshake func(c net.Conn) (target string, err error),
+	targets chan string,
+) (addr string) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	testutil.CleanupAndRequireSuccess(tb, l.Close)
+
+	go func() {
+		pt := testutil.PanicT{}
+
+		c, aerr := l.Accept()
+		if errors.Is(aerr, net.ErrClosed) {
+			return
+		}
+		require.NoError(pt, aerr)
+
+		defer func() { _ = c.Close() }()
+
+		target, herr := handshake(c)
+		require.NoError(pt, herr)
+
+		testutil.RequireSend(pt, targets, target, testTimeout)
+
+		_, werr := io.WriteString(c, testGreeting)
+		require.NoError(pt, werr)
+	}()
+
+	return l.Addr().String()
+}
+
+// handshakeHTTP handles the HTTP CONNECT request.
+func handshakeHTTP(c net.Conn) (target string, err error) {
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		return "", err
+	}
+
+	if req.Method != http.MethodConnect {
+		return "", errors.Error("not a connect request")
+	}
+
+	if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		_, err = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+
+		return "", errors.WithDeferred(errors.Error("unauthorized"), err)
+	}
+
+	_, err = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	return req.Host, err
+}
+
+// handshakeSOCKS5 handles the SOCKS5 handshake without authentication for a
+// request with a domain name, see RFC 1928.
+func handshakeSOCKS5(c net.Conn) (target string, err error) {
+	// Read the version and the methods.
+	hdr := make([]byte, 2)
+	_, err = io.ReadFull(c, hdr)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.ReadFull(c, make([]byte, hdr[1]))
+	if err != nil {
+		return "", err
+	}
+
+	// Choose no authentication.
+	_, err = c.Write([]byte{5, 0})
+	if err != nil {
+		return "", err
+	}
+
+	// Read the version, the command, the reserved byte, the address type, and
+	// the length of the domain name.
+	req := make([]byte, 5)
+	_, err = io.ReadFull(c, req)
+	if err != nil {
+		return "", err
+	}
+
+	hostPort := make([]byte, int(req[4])+2)
+	_, err = io.ReadFull(c, hostPort)
+	if err != nil {
+		return "", err
+	}
+
+	host := string(hostPort[:req[4]])
+	port := binary.BigEndian.Uint16(hostPort[req[4]:])
+
+	// Reply with success and the zero IPv4 address.
+	_, err = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), err
+}
+
+func TestNewProxyDialContext(t *testing.T) {
+	testCases := []struct {
+		handshake func(c net.Conn) (target string, err error)
+		name      string
+		scheme    string
+		user      *url.Userinfo
+	}{{
+		handshake: handshakeHTTP,
+		name:      "http",
+		scheme:    bootstrap.ProxySchemeHTTP,
+		user:      url.UserPassword("user", "pass"),
+	}, {
+		handshake: handshakeSOCKS5,
+		name:      "socks5",
+		scheme:    bootstrap.ProxySchemeSOCKS5,
+		user:      nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targets := make(chan string, 1)
+			proxyURL := &url.URL{
+				Scheme: tc.scheme,
+				User:   tc.user,
+				Host:   newFakeProxy(t, tc.handshake, targets),
+			}
+
+			dial, err := bootstrap.NewProxyDialContext(
+				proxyURL,
+				testTimeout,
+				nil,
+				slogutil.NewDiscardLogger(),
+				testTarget,
+			)
+			require.NoError(t, err)
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			conn, err := dial(ctx, bootstrap.NetworkTCP, "")
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			target, _ := testutil.RequireReceive(t, targets, testTimeout)
+			assert.Equal(t, testTarget, target)
+
+			data, err := io.ReadAll(conn)
+			require.NoError(t, err)
+
+			assert.Equal(t, testGreeting, string(data))
+
+			_, err = dial(ctx, bootstrap.NetworkUDP, "")
+			assert.ErrorIs(t, err, errors.ErrUnsupported)
+		})
+	}
+}
+
+func TestValidateProxyURL(t *testing.T) {
+	testCases := []struct {
+		proxyURL   *url.URL
+		name       string
+		wantErrMsg string
+	}{{
+		proxyURL:   &url.URL{Scheme: "socks5h", Host: "192.0.2.1"},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		proxyURL:   nil,
+		name:       "nil",
+		wantErrMsg: "no value",
+	}, {
+		proxyURL:   &url.URL{Scheme: "https", Host: "proxy.example"},
+		name:       "bad_scheme",
+		wantErrMsg: `proxy scheme: bad enum value: "https"`,
+	}, {
+		proxyURL:   &url.URL{Scheme: "http"},
+		name:       "no_host",
+		wantErrMsg: "proxy host: empty value",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, bootstrap.ValidateProxyURL(tc.proxyURL))
+		})
+	}
+}
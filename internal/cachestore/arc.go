@@ -0,0 +1,184 @@
+package cachestore
+
+import (
+	"container/list"
+	"math"
+)
+
+// ghost is the key of an entry recently evicted by [arcPolicy].
+type ghost struct {
+	key string
+
+	// frequent is true if the entry has been evicted from the list of the
+	// frequently used entries.
+	frequent bool
+}
+
+// arcPolicy is the [PolicyARC] implementation of [policy].  Since the cache is
+// bounded by the size in bytes rather than by the number of entries, the target
+// share of the recently used entries is a fraction of the stored ones.
+type arcPolicy struct {
+	// recent stores the entries used once since they got into the cache, with
+	// the most recently used one at the front.
+	recent *list.List
+
+	// frequent stores the entries used more than once, with the most recently
+	// used one at the front.
+	frequent *list.List
+
+	// recentGhosts stores the *ghost keys evicted from recent, with the most
+	// recently evicted one at the front.
+	recentGhosts *list.List
+
+	// frequentGhosts stores the *ghost keys evicted from frequent, with the
+	// most recently evicted one at the front.
+	frequentGhosts *list.List
+
+	// ghosts maps the keys to the elements of recentGhosts and frequentGhosts.
+	ghosts map[string]*list.Element
+
+	// target is the target share of recent in the stored entries, from 0 to
+	// 1.  It grows when the entries evicted from recent are requested again,
+	// and shrinks for the ones evicted from frequent.
+	target float64
+
+	// admittedFrequentGhost is true if the entry being admitted has been
+	// evicted from frequent recently.
+	admittedFrequentGhost bool
+}
+
+// newARCPolicy returns a new properly initialized *arcPolicy.
+func newARCPolicy() (p *arcPolicy) {
+	return &arcPolicy{
+		recent:         list.New(),
+		frequent:       list.New(),
+		recentGhosts:   list.New(),
+		frequentGhosts: list.New(),
+		ghosts:         map[string]*list.Element{},
+	}
+}
+
+// type check
+var _ policy = (*arcPolicy)(nil)
+
+// admit implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) admit(e *entry) {
+	el, ok := p.ghosts[e.key]
+	if !ok {
+		e.frequent = false
+
+		return
+	}
+
+	g := el.Value.(*ghost)
+	stored := float64(max(p.recent.Len()+p.frequent.Len(), 1))
+	recentGhosts, frequentGhosts := float64(p.recentGhosts.Len()), float64(p.frequentGhosts.Len())
+	if g.frequent {
+		delta := max(1, recentGhosts/frequentGhosts)
+		p.target = math.Max(0, p.target-delta/stored)
+		p.admittedFrequentGhost = true
+		p.frequentGhosts.Remove(el)
+	} else {
+		delta := max(1, frequentGhosts/recentGhosts)
+		p.target = math.Min(1, p.target+delta/stored)
+		p.recentGhosts.Remove(el)
+	}
+
+	delete(p.ghosts, e.key)
+
+	// The entry has been used before its eviction, so it's used again now.
+	e.frequent = true
+}
+
+// add implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) add(e *entry) {
+	p.admittedFrequentGhost = false
+
+	if e.frequent {
+		e.el = p.frequent.PushFront(e)
+	} else {
+		e.el = p.recent.PushFront(e)
+	}
+}
+
+// use implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) use(e *entry) {
+	if e.frequent {
+		p.frequent.MoveToFront(e.el)
+
+		return
+	}
+
+	p.recent.Remove(e.el)
+	e.frequent = true
+	e.el = p.frequent.PushFront(e)
+}
+
+// remove implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) remove(e *entry) {
+	if e.frequent {
+		p.frequent.Remove(e.el)
+	} else {
+		p.recent.Remove(e.el)
+	}
+}
+
+// evict implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) evict() (e *entry) {
+	recentLen, frequentLen := p.recent.Len(), p.frequent.Len()
+	targetLen := int(math.Round(p.target * float64(recentLen+frequentLen)))
+
+	var from, ghosts *list.List
+	switch {
+	case recentLen > 0 && (recentLen > targetLen ||
+		(p.admittedFrequentGhost && recentLen == targetLen) ||
+		frequentLen == 0):
+		from, ghosts = p.recent, p.recentGhosts
+	case frequentLen > 0:
+		from, ghosts = p.frequent, p.frequentGhosts
+	default:
+		return nil
+	}
+
+	e = from.Remove(from.Back()).(*entry)
+	p.ghosts[e.key] = ghosts.PushFront(&ghost{
+		key:      e.key,
+		frequent: e.frequent,
+	})
+	p.trimGhosts()
+
+	return e
+}
+
+// trimGhosts removes the oldest ghost keys, so that there are no more of them
+// than the stored entries.
+func (p *arcPolicy) trimGhosts() {
+	limit := max(p.recent.Len()+p.frequent.Len(), 1)
+	for p.recentGhosts.Len()+p.frequentGhosts.Len() > limit {
+		ghosts := p.recentGhosts
+		if p.frequentGhosts.Len() > ghosts.Len() {
+			ghosts = p.frequentGhosts
+		}
+
+		g := ghosts.Remove(ghosts.Back()).(*ghost)
+		delete(p.ghosts, g.key)
+	}
+}
+
+// rangeEntries implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) rangeEntries(f func(e *entry) (cont bool)) {
+	if rangeList(p.recent, f) {
+		rangeList(p.frequent, f)
+	}
+}
+
+// clear implements the [policy] interface for *arcPolicy.
+func (p *arcPolicy) clear() {
+	p.recent.Init()
+	p.frequent.Init()
+	p.recentGhosts.Init()
+	p.frequentGhosts.Init()
+	clear(p.ghosts)
+	p.target = 0
+	p.admittedFrequentGhost = false
+}
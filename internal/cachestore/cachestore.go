@@ -0,0 +1,249 @@
+// Package cachestore implements the in-memory key-value storage used by the
+// DNS cache.  Unlike the general-purpose cache from golibs, it allows iterating
+// over the stored entries, which is required for persisting the cache.
+package cachestore
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+)
+
+// Config is the configuration structure for [Cache].
+type Config struct {
+	// OnDelete is called with the key and the value of each entry removed to
+	// free space for a new one.  It's called with the lock held, so it must
+	// not call the methods of the cache.  It may be nil.
+	OnDelete func(key, val []byte)
+
+	// MaxSize is the maximum total size of keys and values in bytes.  Zero
+	// means no limit.
+	MaxSize uint
+
+	// MaxCount is the maximum number of entries.  Zero means no limit.
+	MaxCount uint
+
+	// Policy is the eviction policy.  The zero value is [PolicyLRU].
+	Policy Policy
+}
+
+// entry is a single key-value pair stored within the cache.
+type entry struct {
+	// el is the element of the list of the policy containing the entry.
+	el *list.Element
+
+	key string
+	val []byte
+
+	// freq is the number of uses of the entry, it's only used by [PolicyLFU].
+	freq uint
+
+	// frequent is true if the entry has been used more than once since it got
+	// into the cache, it's only used by [PolicyARC].
+	frequent bool
+}
+
+// mapSlotSize is the approximate number of bytes used by a single slot of the
+// map of entries: the string header of the key, the pointer to the entry, and
+// the control byte.
+const mapSlotSize = unsafe.Sizeof("") + unsafe.Sizeof(&entry{}) + 1
+
+// EntryOverhead is the approximate number of bytes used by the storage for each
+// entry in addition to its key and value, which aren't accounted for the limits
+// of the storage.
+const EntryOverhead = uint(unsafe.Sizeof(entry{}) + unsafe.Sizeof(list.Element{}) + mapSlotSize)
+
+// size returns the number of bytes accounted for e.
+func (e *entry) size() (n uint) {
+	return uint(len(e.key) + len(e.val))
+}
+
+// Cache is a cache bounded by the total size of its keys and values and,
+// optionally, by the number of entries.  The entries are evicted according to
+// the configured [Policy].  It's safe for concurrent use.
+type Cache struct {
+	// mu protects all the fields below.
+	mu *sync.Mutex
+
+	// onDelete is called for each evicted entry.  It may be nil.
+	onDelete func(key, val []byte)
+
+	// items maps keys to the entries.
+	items map[string]*entry
+
+	// policy decides which entries to evict.
+	policy policy
+
+	// maxSize is the maximum total size in bytes, zero means no limit.
+	maxSize uint
+
+	// maxCount is the maximum number of entries, zero means no limit.
+	maxCount uint
+
+	// size is the current total size in bytes.
+	size uint
+
+	// hits is the number of successful lookups.
+	hits int
+
+	// misses is the number of unsuccessful lookups.
+	misses int
+}
+
+// New returns a new properly initialized *Cache.  conf must not be nil.
+func New(conf *Config) (c *Cache) {
+	return &Cache{
+		mu:       &sync.Mutex{},
+		onDelete: conf.OnDelete,
+		items:    map[string]*entry{},
+		policy:   newPolicy(conf.Policy),
+		maxSize:  conf.MaxSize,
+		maxCount: conf.MaxCount,
+	}
+}
+
+// type check
+var _ glcache.Cache = (*Cache)(nil)
+
+// Set implements the [glcache.Cache] interface for *Cache.  The entries that
+// are larger than the maximum size are not stored.  Replacing the value counts
+// as a use of the entry.
+func (c *Cache) Set(key, val []byte) (replaced bool) {
+	e := &entry{
+		key: string(key),
+		val: val,
+	}
+
+	if c.maxSize > 0 && e.size() > c.maxSize {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if prev, ok := c.items[e.key]; ok {
+		c.size = c.size - prev.size() + e.size()
+		prev.val = val
+		c.policy.use(prev)
+		c.evict(0, 0)
+
+		return true
+	}
+
+	// Make room before adding, so that the new entry itself isn't evicted.
+	c.policy.admit(e)
+	c.evict(e.size(), 1)
+
+	c.items[e.key] = e
+	c.size += e.size()
+	c.policy.add(e)
+
+	return false
+}
+
+// evict removes the entries chosen by the policy until the limits are
+// respected with extraSize bytes and extraCount entries more.  c.mu is expected
+// to be locked.
+func (c *Cache) evict(extraSize, extraCount uint) {
+	for c.overflows(extraSize, extraCount) {
+		e := c.policy.evict()
+		if e == nil {
+			return
+		}
+
+		delete(c.items, e.key)
+		c.size -= e.size()
+
+		if c.onDelete != nil {
+			c.onDelete([]byte(e.key), e.val)
+		}
+	}
+}
+
+// overflows returns true if c exceeds any of its limits with extraSize bytes
+// and extraCount entries more.  c.mu is expected to be locked.
+func (c *Cache) overflows(extraSize, extraCount uint) (ok bool) {
+	return (c.maxSize > 0 && c.size+extraSize > c.maxSize) ||
+		(c.maxCount > 0 && uint(len(c.items))+extraCount > c.maxCount)
+}
+
+// SetMaxSize sets the maximum total size of keys and values in bytes and evicts
+// the entries exceeding it, if any.  Zero means no limit.
+func (c *Cache) SetMaxSize(size uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSize = size
+	c.evict(0, 0)
+}
+
+// Get implements the [glcache.Cache] interface for *Cache.
+func (c *Cache) Get(key []byte) (val []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[string(key)]
+	if !ok {
+		c.misses++
+
+		return nil
+	}
+
+	c.hits++
+	c.policy.use(e)
+
+	return e.val
+}
+
+// Del implements the [glcache.Cache] interface for *Cache.
+func (c *Cache) Del(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[string(key)]; ok {
+		c.policy.remove(e)
+		delete(c.items, e.key)
+		c.size -= e.size()
+	}
+}
+
+// Clear implements the [glcache.Cache] interface for *Cache.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = map[string]*entry{}
+	c.policy.clear()
+	c.size = 0
+	c.hits = 0
+	c.misses = 0
+}
+
+// Stats implements the [glcache.Cache] interface for *Cache.
+func (c *Cache) Stats() (s glcache.Stats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return glcache.Stats{
+		Count: len(c.items),
+		Size:  int(c.size),
+		Hit:   c.hits,
+		Miss:  c.misses,
+	}
+}
+
+// Range calls f for each entry starting from the one to be evicted first, so
+// that setting the entries into another cache in the same order preserves the
+// recency.  The use frequencies aren't preserved this way.  It stops if f
+// returns false.  f must not call the methods of c and must not modify key or
+// val.
+func (c *Cache) Range(f func(key, val []byte) (cont bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.policy.rangeEntries(func(e *entry) (cont bool) {
+		return f([]byte(e.key), e.val)
+	})
+}
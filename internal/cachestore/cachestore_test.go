@@ -0,0 +1,254 @@
+package cachestore_test
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/cachestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectKeys returns the keys of c in the iteration order.
+func collectKeys(c *cachestore.Cache) (keys []string) {
+	c.Range(func(key, _ []byte) (cont bool) {
+		keys = append(keys, string(key))
+
+		return true
+	})
+
+	return keys
+}
+
+func TestCache(t *testing.T) {
+	var evicted []string
+	c := cachestore.New(&cachestore.Config{
+		OnDelete: func(key, _ []byte) { evicted = append(evicted, string(key)) },
+		MaxSize:  6,
+	})
+
+	assert.False(t, c.Set([]byte("a"), []byte("1")))
+	assert.False(t, c.Set([]byte("b"), []byte("2")))
+	assert.True(t, c.Set([]byte("a"), []byte("3")))
+
+	assert.Equal(t, []byte("3"), c.Get([]byte("a")))
+	assert.Nil(t, c.Get([]byte("c")))
+	assert.Equal(t, []string{"b", "a"}, collectKeys(c))
+
+	// Exceed the size, so that the least recently used entry goes away.
+	c.Set([]byte("c"), []byte("4"))
+	c.Set([]byte("d"), []byte("5"))
+
+	assert.Equal(t, []string{"b"}, evicted)
+	assert.Equal(t, []string{"a", "c", "d"}, collectKeys(c))
+
+	s := c.Stats()
+	assert.Equal(t, 3, s.Count)
+	assert.Equal(t, 6, s.Size)
+	assert.Equal(t, 1, s.Hit)
+	assert.Equal(t, 1, s.Miss)
+
+	// Too large entries are not stored at all.
+	assert.False(t, c.Set([]byte("large"), []byte("value")))
+	assert.Nil(t, c.Get([]byte("large")))
+
+	c.Del([]byte("a"))
+	assert.Equal(t, []string{"c", "d"}, collectKeys(c))
+
+	c.Clear()
+	assert.Empty(t, collectKeys(c))
+	assert.Zero(t, c.Stats())
+}
+
+func TestCache_maxCount(t *testing.T) {
+	c := cachestore.New(&cachestore.Config{
+		MaxCount: 2,
+	})
+
+	c.Set([]byte("a"), []byte("1"))
+	c.Set([]byte("b"), []byte("2"))
+	require.NotNil(t, c.Get([]byte("a")))
+
+	c.Set([]byte("c"), []byte("3"))
+
+	assert.Equal(t, []string{"a", "c"}, collectKeys(c))
+}
+
+func TestCache_SetMaxSize(t *testing.T) {
+	c := cachestore.New(&cachestore.Config{
+		MaxSize: 6,
+	})
+
+	c.Set([]byte("a"), []byte("1"))
+	c.Set([]byte("b"), []byte("2"))
+	c.Set([]byte("c"), []byte("3"))
+
+	c.SetMaxSize(4)
+	assert.Equal(t, []string{"b", "c"}, collectKeys(c))
+
+	c.SetMaxSize(6)
+	c.Set([]byte("d"), []byte("4"))
+	assert.Equal(t, []string{"b", "c", "d"}, collectKeys(c))
+}
+
+func TestCache_policies(t *testing.T) {
+	testCases := []struct {
+		name     string
+		wantKeys []string
+		policy   cachestore.Policy
+	}{{
+		name:     "lru",
+		wantKeys: []string{"d", "e", "f"},
+		policy:   cachestore.PolicyLRU,
+	}, {
+		name:     "lfu",
+		wantKeys: []string{"e", "f", "a"},
+		policy:   cachestore.PolicyLFU,
+	}, {
+		name:     "arc",
+		wantKeys: []string{"e", "f", "a"},
+		policy:   cachestore.PolicyARC,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := cachestore.New(&cachestore.Config{
+				MaxCount: 3,
+				Policy:   tc.policy,
+			})
+
+			c.Set([]byte("a"), []byte("1"))
+			c.Set([]byte("b"), []byte("2"))
+			c.Set([]byte("c"), []byte("3"))
+			require.NotNil(t, c.Get([]byte("a")))
+
+			// Scan over the entries used once.
+			for _, k := range []string{"d", "e", "f"} {
+				c.Set([]byte(k), []byte(k))
+			}
+
+			assert.Equal(t, tc.wantKeys, collectKeys(c))
+			assert.Equal(t, 3, c.Stats().Count)
+		})
+	}
+}
+
+func TestCache_arcGhost(t *testing.T) {
+	c := cachestore.New(&cachestore.Config{
+		MaxCount: 3,
+		Policy:   cachestore.PolicyARC,
+	})
+
+	for _, k := range []string{"a", "b", "c"} {
+		c.Set([]byte(k), []byte(k))
+	}
+
+	require.NotNil(t, c.Get([]byte("a")))
+
+	for _, k := range []string{"d", "e", "f"} {
+		c.Set([]byte(k), []byte(k))
+	}
+
+	// The recently evicted entry is considered frequently used when it's set
+	// again.
+	c.Set([]byte("c"), []byte("c"))
+
+	assert.Equal(t, []string{"f", "a", "c"}, collectKeys(c))
+}
+
+func TestSharded(t *testing.T) {
+	const (
+		shardsNum = 4
+		keysNum   = 100
+	)
+
+	s := cachestore.NewSharded(&cachestore.Config{
+		MaxCount: keysNum,
+	}, shardsNum)
+
+	for i := range keysNum {
+		k := []byte{byte(i)}
+		assert.False(t, s.Set(k, k))
+	}
+
+	var got int
+	s.Range(func(key, val []byte) (cont bool) {
+		assert.Equal(t, key, val)
+		got++
+
+		return true
+	})
+
+	// Each shard keeps its part of the entries, so some of the unevenly
+	// distributed keys may be evicted.
+	st := s.Stats()
+	assert.Equal(t, got, st.Count)
+	assert.LessOrEqual(t, st.Count, keysNum)
+	assert.Positive(t, st.Count)
+
+	var key []byte
+	s.Range(func(k, _ []byte) (cont bool) {
+		key = k
+
+		return false
+	})
+
+	assert.True(t, s.Set(key, []byte("new")))
+	assert.Equal(t, []byte("new"), s.Get(key))
+
+	s.Del(key)
+
+	assert.Equal(t, got-1, s.Stats().Count)
+
+	s.SetMaxSize(shardsNum)
+	assert.LessOrEqual(t, s.Stats().Size, shardsNum)
+
+	s.Clear()
+	assert.Zero(t, s.Stats())
+}
+
+func TestSharded_limits(t *testing.T) {
+	testCases := []struct {
+		name     string
+		maxCount uint
+		shards   uint
+	}{{
+		name:     "even",
+		maxCount: 8,
+		shards:   4,
+	}, {
+		name:     "remainder",
+		maxCount: 10,
+		shards:   4,
+	}, {
+		name:     "less_than_shards",
+		maxCount: 3,
+		shards:   16,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := cachestore.NewSharded(&cachestore.Config{
+				MaxCount: tc.maxCount,
+			}, tc.shards)
+
+			for i := range 1000 {
+				k := []byte{byte(i), byte(i >> 8)}
+				s.Set(k, k)
+			}
+
+			// Since the keys are many times more than the limit, each shard is
+			// full.
+			assert.Equal(t, int(tc.maxCount), s.Stats().Count)
+		})
+	}
+
+	s := cachestore.NewSharded(&cachestore.Config{}, 4)
+	for i := range 100 {
+		k := []byte{byte(i)}
+		s.Set(k, k)
+	}
+
+	const maxSize = 2*7 + 1
+	s.SetMaxSize(maxSize)
+	assert.LessOrEqual(t, s.Stats().Size, maxSize)
+}
@@ -0,0 +1,109 @@
+package cachestore
+
+import (
+	"container/list"
+	"maps"
+	"slices"
+)
+
+// lfuPolicy is the [PolicyLFU] implementation of [policy].
+type lfuPolicy struct {
+	// buckets maps the use frequency to the list of entries used that many
+	// times, with the most recently used one at the front.  It never contains
+	// empty lists.
+	buckets map[uint]*list.List
+
+	// minFreq is the lowest frequency within buckets.  It's only valid when
+	// buckets isn't empty.
+	minFreq uint
+}
+
+// newLFUPolicy returns a new properly initialized *lfuPolicy.
+func newLFUPolicy() (p *lfuPolicy) {
+	return &lfuPolicy{
+		buckets: map[uint]*list.List{},
+	}
+}
+
+// type check
+var _ policy = (*lfuPolicy)(nil)
+
+// admit implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) admit(_ *entry) {}
+
+// add implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) add(e *entry) {
+	e.freq = 1
+	p.push(e)
+	p.minFreq = 1
+}
+
+// push puts e to the front of the bucket of its frequency.
+func (p *lfuPolicy) push(e *entry) {
+	b, ok := p.buckets[e.freq]
+	if !ok {
+		b = list.New()
+		p.buckets[e.freq] = b
+	}
+
+	e.el = b.PushFront(e)
+}
+
+// use implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) use(e *entry) {
+	emptied := p.unlink(e)
+	if emptied && e.freq == p.minFreq {
+		p.minFreq++
+	}
+
+	e.freq++
+	p.push(e)
+}
+
+// unlink removes e from its bucket and removes the bucket if it gets empty.
+// emptied is true if the bucket is removed.
+func (p *lfuPolicy) unlink(e *entry) (emptied bool) {
+	b := p.buckets[e.freq]
+	b.Remove(e.el)
+	if b.Len() > 0 {
+		return false
+	}
+
+	delete(p.buckets, e.freq)
+
+	return true
+}
+
+// remove implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) remove(e *entry) {
+	if p.unlink(e) && e.freq == p.minFreq && len(p.buckets) > 0 {
+		p.minFreq = slices.Min(slices.Collect(maps.Keys(p.buckets)))
+	}
+}
+
+// evict implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) evict() (e *entry) {
+	b, ok := p.buckets[p.minFreq]
+	if !ok {
+		return nil
+	}
+
+	e = b.Back().Value.(*entry)
+	p.remove(e)
+
+	return e
+}
+
+// rangeEntries implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) rangeEntries(f func(e *entry) (cont bool)) {
+	for _, freq := range slices.Sorted(maps.Keys(p.buckets)) {
+		if !rangeList(p.buckets[freq], f) {
+			return
+		}
+	}
+}
+
+// clear implements the [policy] interface for *lfuPolicy.
+func (p *lfuPolicy) clear() {
+	clear(p.buckets)
+}
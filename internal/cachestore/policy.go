@@ -0,0 +1,126 @@
+package cachestore
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// Policy is the eviction policy of [Cache].
+type Policy uint8
+
+// Eviction policies.
+const (
+	// PolicyLRU evicts the least recently used entries first.
+	PolicyLRU Policy = iota
+
+	// PolicyLFU evicts the least frequently used entries first, and the least
+	// recently used ones among the entries used equally often.
+	PolicyLFU
+
+	// PolicyARC is the adaptive replacement cache policy, which balances
+	// between the recently and the frequently used entries depending on the
+	// workload, so that a scan over many entries used once doesn't evict the
+	// popular ones.
+	PolicyARC
+)
+
+// policy decides which entries of [Cache] to evict.  Its methods are called
+// with the lock of the cache held.
+type policy interface {
+	// admit is called before evicting the entries to make room for e, which
+	// isn't stored yet.
+	admit(e *entry)
+
+	// add starts tracking e, which is stored now.
+	add(e *entry)
+
+	// use records the use of the tracked e.
+	use(e *entry)
+
+	// remove stops tracking e, which is deleted from the cache.
+	remove(e *entry)
+
+	// evict stops tracking the entry to evict next and returns it.  It
+	// returns nil if there are no entries.
+	evict() (e *entry)
+
+	// rangeEntries calls f for each tracked entry in the order of eviction,
+	// until f returns false.
+	rangeEntries(f func(e *entry) (cont bool))
+
+	// clear stops tracking all the entries.
+	clear()
+}
+
+// newPolicy returns a new policy of the kind p.  It panics if p is unknown.
+func newPolicy(p Policy) (pol policy) {
+	switch p {
+	case PolicyLRU:
+		return &lruPolicy{list: list.New()}
+	case PolicyLFU:
+		return newLFUPolicy()
+	case PolicyARC:
+		return newARCPolicy()
+	default:
+		panic(fmt.Errorf("cachestore: bad policy %d", p))
+	}
+}
+
+// rangeList calls f for each entry of l starting from the back, until f
+// returns false.  cont is false if f has returned false.
+func rangeList(l *list.List, f func(e *entry) (cont bool)) (cont bool) {
+	for el := l.Back(); el != nil; el = el.Prev() {
+		if !f(el.Value.(*entry)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lruPolicy is the [PolicyLRU] implementation of [policy].
+type lruPolicy struct {
+	// list stores the entries with the most recently used one at the front.
+	list *list.List
+}
+
+// type check
+var _ policy = (*lruPolicy)(nil)
+
+// admit implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) admit(_ *entry) {}
+
+// add implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) add(e *entry) {
+	e.el = p.list.PushFront(e)
+}
+
+// use implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) use(e *entry) {
+	p.list.MoveToFront(e.el)
+}
+
+// remove implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) remove(e *entry) {
+	p.list.Remove(e.el)
+}
+
+// evict implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) evict() (e *entry) {
+	el := p.list.Back()
+	if el == nil {
+		return nil
+	}
+
+	return p.list.Remove(el).(*entry)
+}
+
+// rangeEntries implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) rangeEntries(f func(e *entry) (cont bool)) {
+	rangeList(p.list, f)
+}
+
+// clear implements the [policy] interface for *lruPolicy.
+func (p *lruPolicy) clear() {
+	p.list.Init()
+}
@@ -0,0 +1,141 @@
+package cachestore
+
+import (
+	"hash/maphash"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+)
+
+// Sharded is a cache split into several independently locked [Cache] shards,
+// so that the concurrent uses of different keys don't contend for a single
+// lock.  The limits of the configuration are divided between the shards so that
+// they sum up to the configured ones exactly, and each shard evicts its own
+// entries according to the policy.  It's safe for concurrent use.
+type Sharded struct {
+	// seed is used to choose the shard for a key.
+	seed maphash.Seed
+
+	// shards are the independent parts of the cache.
+	shards []*Cache
+}
+
+// NewSharded returns a new properly initialized *Sharded with n shards.  If n
+// is zero, a single shard is used.  The number of shards is also limited by the
+// non-zero limits of conf, so that each shard gets a non-zero part of them.
+// conf must not be nil.
+func NewSharded(conf *Config, n uint) (s *Sharded) {
+	n = max(n, 1)
+	if conf.MaxSize > 0 {
+		n = min(n, conf.MaxSize)
+	}
+
+	if conf.MaxCount > 0 {
+		n = min(n, conf.MaxCount)
+	}
+
+	s = &Sharded{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*Cache, n),
+	}
+
+	for i := range s.shards {
+		s.shards[i] = New(&Config{
+			OnDelete: conf.OnDelete,
+			MaxSize:  shardLimit(conf.MaxSize, n, uint(i)),
+			MaxCount: shardLimit(conf.MaxCount, n, uint(i)),
+			Policy:   conf.Policy,
+		})
+	}
+
+	return s
+}
+
+// shardLimit returns the part of limit for the shard with index i out of n, so
+// that the parts of all the shards sum up to limit.  If limit is positive but
+// less than n, the parts are rounded up to one, since zero means no limit.  n
+// must not be zero.
+func shardLimit(limit, n, i uint) (part uint) {
+	if limit == 0 {
+		return 0
+	}
+
+	part = limit / n
+	if i < limit%n {
+		part++
+	}
+
+	return max(part, 1)
+}
+
+// shard returns the shard for key.
+func (s *Sharded) shard(key []byte) (c *Cache) {
+	return s.shards[maphash.Bytes(s.seed, key)%uint64(len(s.shards))]
+}
+
+// type check
+var _ glcache.Cache = (*Sharded)(nil)
+
+// Set implements the [glcache.Cache] interface for *Sharded.
+func (s *Sharded) Set(key, val []byte) (replaced bool) {
+	return s.shard(key).Set(key, val)
+}
+
+// Get implements the [glcache.Cache] interface for *Sharded.
+func (s *Sharded) Get(key []byte) (val []byte) {
+	return s.shard(key).Get(key)
+}
+
+// Del implements the [glcache.Cache] interface for *Sharded.
+func (s *Sharded) Del(key []byte) {
+	s.shard(key).Del(key)
+}
+
+// Clear implements the [glcache.Cache] interface for *Sharded.
+func (s *Sharded) Clear() {
+	for _, c := range s.shards {
+		c.Clear()
+	}
+}
+
+// Stats implements the [glcache.Cache] interface for *Sharded.  The statistics
+// of the shards are summed up, but they aren't taken atomically.
+func (s *Sharded) Stats() (st glcache.Stats) {
+	for _, c := range s.shards {
+		cst := c.Stats()
+		st.Count += cst.Count
+		st.Size += cst.Size
+		st.Hit += cst.Hit
+		st.Miss += cst.Miss
+	}
+
+	return st
+}
+
+// SetMaxSize sets the maximum total size of keys and values in bytes, divided
+// between the shards, and evicts the entries exceeding it, if any.  Zero means
+// no limit.  The total size is exceeded only if size is less than the number
+// of shards, since each shard keeps at least one byte of the limit.
+func (s *Sharded) SetMaxSize(size uint) {
+	n := uint(len(s.shards))
+	for i, c := range s.shards {
+		c.SetMaxSize(shardLimit(size, n, uint(i)))
+	}
+}
+
+// Range calls f for each entry of each shard in turn, see [Cache.Range].  The
+// order is only preserved within a shard.  It stops if f returns false.  f must
+// not call the methods of s and must not modify key or val.
+func (s *Sharded) Range(f func(key, val []byte) (cont bool)) {
+	for _, c := range s.shards {
+		cont := true
+		c.Range(func(key, val []byte) (ok bool) {
+			cont = f(key, val)
+
+			return cont
+		})
+
+		if !cont {
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultACMEHTTPAddr is the default address of the server answering the
+// HTTP-01 challenges of the ACME CA.
+const defaultACMEHTTPAddr = ":80"
+
+// startACME starts obtaining and renewing the certificates for
+// conf.TLSACMEDomains from the ACME CA, if configured, and returns the TLS
+// configuration using them and the function shutting down the HTTP-01
+// challenge server.  tlsConf is nil if ACME is disabled.  l must not be nil.
+func (conf *configuration) startACME(
+	ctx context.Context,
+	l *slog.Logger,
+) (tlsConf *tls.Config, stop func(ctx context.Context) (err error), err error) {
+	if len(conf.TLSACMEDomains) == 0 {
+		return nil, func(_ context.Context) (err error) { return nil }, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.TLSACMEDomains...),
+		Email:      conf.TLSACMEEmail,
+	}
+
+	if conf.TLSACMECacheDir != "" {
+		m.Cache = autocert.DirCache(conf.TLSACMECacheDir)
+	}
+
+	minVer, maxVer := conf.tlsVersions()
+
+	// #nosec G402 -- TLS MinVersion is configured by user.
+	tlsConf = &tls.Config{
+		GetCertificate: newACMEGetCertificate(m, conf.TLSACMEDomains[0]),
+		MinVersion:     minVer,
+		MaxVersion:     maxVer,
+	}
+
+	err = conf.setClientCAs(tlsConf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading client CAs: %w", err)
+	}
+
+	addr := cmp.Or(conf.TLSACMEHTTPAddr, defaultACMEHTTPAddr)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+
+	l.InfoContext(ctx, "starting acme challenge server", "addr", ln.Addr())
+
+	go func() {
+		defer slogutil.RecoverAndLog(ctx, l)
+
+		serveErr := srv.Serve(ln)
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			l.ErrorContext(ctx, "acme challenge server failed", "addr", addr, slogutil.KeyError, serveErr)
+		}
+	}()
+
+	return tlsConf, srv.Shutdown, nil
+}
+
+// newACMEGetCertificate returns the [tls.Config.GetCertificate] callback
+// providing the certificates from m.  The clients which don't send the server
+// name, e.g. the DNS-over-TLS ones connecting by the IP address, get the
+// certificate for defaultName.
+func newACMEGetCertificate(
+	m *autocert.Manager,
+	defaultName string,
+) (f func(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error)) {
+	return func(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+		if hello.ServerName == "" {
+			withName := *hello
+			withName.ServerName = defaultName
+			hello = &withName
+		}
+
+		return m.GetCertificate(hello)
+	}
+}
+
+// setACMETLSConfig sets acmeTLSConf as the TLS configuration of proxyConf, if
+// it's not nil, since the certificates from the ACME CA take precedence over
+// the ones from the files.  proxyConf must not be nil.
+func setACMETLSConfig(proxyConf *proxy.Config, acmeTLSConf *tls.Config) {
+	if acmeTLSConf != nil {
+		proxyConf.TLSConfig = acmeTLSConf
+	}
+}
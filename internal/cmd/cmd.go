@@ -3,15 +3,16 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
-	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/netwatch"
 	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/errors"
@@ -60,10 +61,6 @@ func Main() {
 
 	ctx := context.Background()
 
-	if conf.Pprof {
-		runPprof(ctx, l)
-	}
-
 	err = runProxy(ctx, l, conf)
 	if err != nil {
 		l.ErrorContext(ctx, "running dnsproxy", slogutil.KeyError, err)
@@ -105,6 +102,43 @@ func runProxy(ctx context.Context, l *slog.Logger, conf *configuration) (err err
 		return fmt.Errorf("configuring proxy: %w", err)
 	}
 
+	// Open the mirror file here, since the mirroring isn't reloaded.
+	mirrorConf, closeMirror, err := conf.openMirror()
+	if err != nil {
+		return fmt.Errorf("configuring mirror: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, closeMirror()) }()
+
+	proxyConf.Mirror = mirrorConf
+
+	// Start the exporter here, since the firewall sets aren't reloaded.
+	respHdlr, stopIPSet, err := conf.startIPSet(ctx, l)
+	if err != nil {
+		return fmt.Errorf("configuring ipset: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stopIPSet(ctx)) }()
+
+	proxyConf.ResponseHandler = respHdlr
+
+	// Start the tracing here, since the exporter isn't reloaded.
+	tracerProvider, stopTracing, err := conf.startTracing(ctx)
+	if err != nil {
+		return fmt.Errorf("configuring tracing: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stopTracing(ctx)) }()
+
+	proxyConf.TracerProvider = tracerProvider
+
+	// Start obtaining the certificates here, since the ACME settings aren't
+	// reloaded.
+	acmeTLSConf, stopACME, err := conf.startACME(ctx, l)
+	if err != nil {
+		return fmt.Errorf("configuring acme: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stopACME(ctx)) }()
+
+	setACMETLSConfig(proxyConf, acmeTLSConf)
+
 	dnsProxy, err := proxy.New(proxyConf)
 	if err != nil {
 		return fmt.Errorf("creating proxy: %w", err)
@@ -116,10 +150,54 @@ func runProxy(ctx context.Context, l *slog.Logger, conf *configuration) (err err
 		return fmt.Errorf("starting dnsproxy: %w", err)
 	}
 
+	stopDebug, err := conf.startDebugServer(ctx, l, dnsProxy)
+	if err != nil {
+		return fmt.Errorf("starting debug server: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stopDebug(ctx)) }()
+
+	// current is the latest successfully applied configuration, since the
+	// network changes are handled concurrently with the reloads.
+	current := &atomic.Pointer[configuration]{}
+	current.Store(conf)
+
+	var watcher *netwatch.Watcher
+	if conf.NetworkWatch {
+		watcher = netwatch.New(&netwatch.Config{
+			Logger: l.With(slogutil.KeyPrefix, "netwatch"),
+			OnChange: func(ctx context.Context) {
+				handleNetworkChange(ctx, l, dnsProxy, current.Load(), acmeTLSConf)
+			},
+			PollInterval: networkPollInterval,
+			SettleDelay:  networkSettleDelay,
+		})
+
+		err = watcher.Start(ctx)
+		if err != nil {
+			return fmt.Errorf("starting network watcher: %w", err)
+		}
+	}
+
 	// TODO(e.burkov):  Use [service.SignalHandler].
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChannel {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		if reloaded := reloadProxy(ctx, l, dnsProxy, acmeTLSConf); reloaded != nil {
+			current.Store(reloaded)
+		}
+	}
+
+	// Stop handling the network changes before stopping the proxy.
+	if watcher != nil {
+		err = watcher.Shutdown(ctx)
+		if err != nil {
+			l.DebugContext(ctx, "stopping network watcher", slogutil.KeyError, err)
+		}
+	}
 
 	// Stopping the proxy.
 	err = dnsProxy.Shutdown(ctx)
@@ -130,37 +208,114 @@ func runProxy(ctx context.Context, l *slog.Logger, conf *configuration) (err err
 	return nil
 }
 
-// runPprof runs pprof server on localhost:6060.
-//
-// TODO(e.burkov):  Add debugsvc.
-func runPprof(ctx context.Context, l *slog.Logger) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	mux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
-	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
-	mux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
-	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
-
-	go func() {
-		// TODO(d.kolyshev): Consider making configurable.
-		const pprofAddr = "localhost:6060"
-		l.InfoContext(ctx, "starting pprof", "addr", pprofAddr)
+// reloadProxy parses the configuration again and applies it to the running
+// dnsProxy, see [proxy.Proxy.Reload].  The errors are logged, since the proxy
+// keeps running with the previous configuration.  reloaded is the applied
+// configuration, or nil if it wasn't applied.  acmeTLSConf is the TLS
+// configuration returned by [configuration.startACME].  l must not be nil.
+func reloadProxy(
+	ctx context.Context,
+	l *slog.Logger,
+	dnsProxy *proxy.Proxy,
+	acmeTLSConf *tls.Config,
+) (reloaded *configuration) {
+	l.InfoContext(ctx, "reloading configuration")
 
-		srv := &http.Server{
-			Addr:        pprofAddr,
-			ReadTimeout: 60 * time.Second,
-			Handler:     mux,
+	conf, _, err := parseConfig()
+	if err != nil {
+		l.ErrorContext(ctx, "parsing configuration", slogutil.KeyError, err)
+
+		return nil
+	}
+
+	proxyConf, err := createProxyConfig(ctx, l, conf)
+	if err != nil {
+		l.ErrorContext(ctx, "configuring proxy", slogutil.KeyError, err)
+
+		return nil
+	}
+
+	setACMETLSConfig(proxyConf, acmeTLSConf)
+
+	err = dnsProxy.Reload(ctx, proxyConf)
+	if err != nil {
+		l.ErrorContext(ctx, "reloading proxy", slogutil.KeyError, err)
+	}
+
+	closeUnused(ctx, l, proxyConf, err == nil)
+	if err != nil {
+		return nil
+	}
+
+	return conf
+}
+
+const (
+	// networkPollInterval is the interval of checking the host network in
+	// addition to the notifications from the OS.
+	networkPollInterval = 30 * time.Second
+
+	// networkSettleDelay is the period of time the host network should stay
+	// the same to be considered changed.
+	networkSettleDelay = 2 * time.Second
+)
+
+// handleNetworkChange recreates the upstreams from conf and passes them to the
+// running dnsProxy, see [proxy.Proxy.HandleNetworkChange].  The errors are
+// logged, since the proxy keeps running with the previous upstreams.
+// acmeTLSConf is the TLS configuration returned by [configuration.startACME].
+// l and conf must not be nil.
+func handleNetworkChange(
+	ctx context.Context,
+	l *slog.Logger,
+	dnsProxy *proxy.Proxy,
+	conf *configuration,
+	acmeTLSConf *tls.Config,
+) {
+	proxyConf, err := createProxyConfig(ctx, l, conf)
+	if err != nil {
+		l.ErrorContext(ctx, "configuring proxy", slogutil.KeyError, err)
+
+		return
+	}
+
+	setACMETLSConfig(proxyConf, acmeTLSConf)
+
+	err = dnsProxy.HandleNetworkChange(ctx, proxyConf)
+	if err != nil {
+		l.ErrorContext(ctx, "handling network change", slogutil.KeyError, err)
+	}
+
+	closeUnused(ctx, l, proxyConf, err == nil)
+}
+
+// closeUnused closes the upstreams of proxyConf which aren't used by the proxy.
+// applied tells whether proxyConf has been applied to the proxy.  l must not be
+// nil.
+func closeUnused(ctx context.Context, l *slog.Logger, proxyConf *proxy.Config, applied bool) {
+	// The proactive refresh upstreams aren't reloaded, so the new ones are
+	// closed anyway.
+	//
+	// TODO(e.burkov):  Don't create them at all.
+	unused := []*proxy.UpstreamConfig{proxyConf.CacheProactiveRefreshUpstreams}
+
+	if !applied {
+		unused = append(
+			unused,
+			proxyConf.UpstreamConfig,
+			proxyConf.PrivateRDNSUpstreamConfig,
+			proxyConf.Fallbacks,
+		)
+	}
+
+	for _, u := range unused {
+		if u == nil {
+			continue
 		}
 
-		err := srv.ListenAndServe()
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			l.ErrorContext(ctx, "pprof failed to listen", "addr", pprofAddr, slogutil.KeyError, err)
+		err := u.Close()
+		if err != nil {
+			l.DebugContext(ctx, "closing unused upstreams", slogutil.KeyError, err)
 		}
-	}()
+	}
 }
@@ -3,11 +3,14 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/osutil"
 	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v3"
 )
 
@@ -19,12 +22,33 @@ type configuration struct {
 	// LogOutput is the path to the log file.
 	LogOutput string `yaml:"output"`
 
+	// LogSubsystemLevels are the levels of the logs of the proxy subsystems in
+	// the "subsystem=level" format.
+	LogSubsystemLevels []string `yaml:"log-subsystem-level"`
+
 	// TLSCertPath is the path to the .crt with the certificate chain.
 	TLSCertPath string `yaml:"tls-crt"`
 
 	// TLSKeyPath is the path to the file with the private key.
 	TLSKeyPath string `yaml:"tls-key"`
 
+	// TLSACMECacheDir is the path to the directory to store the certificates
+	// obtained from the ACME CA in.  If empty, the certificates are obtained
+	// again after each restart.
+	TLSACMECacheDir string `yaml:"tls-acme-cache-dir"`
+
+	// TLSACMEEmail is the contact email address of the ACME account.
+	TLSACMEEmail string `yaml:"tls-acme-email"`
+
+	// TLSACMEHTTPAddr is the address to answer the HTTP-01 challenges of the
+	// ACME CA on.  If empty, ":80" is used.
+	TLSACMEHTTPAddr string `yaml:"tls-acme-http-addr"`
+
+	// TLSACMEDomains are the domain names to obtain the certificate for from
+	// the ACME CA.  If set, the certificate takes precedence over TLSCertPath
+	// and TLSKeyPath.
+	TLSACMEDomains []string `yaml:"tls-acme-domain"`
+
 	// HTTPSServerName sets Server header for the HTTPS server.
 	HTTPSServerName string `yaml:"https-server-name"`
 
@@ -43,9 +67,56 @@ type configuration struct {
 	// If not specified the [proxy.UpstreamModeLoadBalance] is used.
 	UpstreamMode string `yaml:"upstream-mode"`
 
+	// RaceQtypes are the types of the queries to race the upstreams for in the
+	// [proxy.UpstreamModeRace] mode, e.g. A.
+	RaceQtypes []string `yaml:"race-qtypes"`
+
+	// FastestPingPorts are the TCP ports to ping the resolved addresses on in
+	// the [proxy.UpstreamModeFastestAddr] mode.
+	FastestPingPorts []int `yaml:"fastest-ping-ports"`
+
+	// FastestPingICMP makes the resolved addresses also pinged with ICMP echo
+	// requests in the [proxy.UpstreamModeFastestAddr] mode.
+	FastestPingICMP bool `yaml:"fastest-ping-icmp"`
+
+	// UpstreamRetryRcodes are the response codes to retry the responses with,
+	// e.g. SERVFAIL.
+	UpstreamRetryRcodes []string `yaml:"upstream-retry-rcodes"`
+
+	// UpstreamTryTimeout is the maximum duration of a single try of the
+	// upstream retry policy.
+	UpstreamTryTimeout timeutil.Duration `yaml:"upstream-try-timeout"`
+
+	// UpstreamMaxRetries is the maximum number of retries of a query to the
+	// upstreams.
+	UpstreamMaxRetries uint `yaml:"upstream-max-retries"`
+
+	// UpstreamRetryOnTimeout makes the queries timed out retried.
+	UpstreamRetryOnTimeout bool `yaml:"upstream-retry-on-timeout"`
+
+	// UpstreamRetryOnError makes the queries failed with an error other than a
+	// timeout retried.
+	UpstreamRetryOnError bool `yaml:"upstream-retry-on-error"`
+
+	// UpstreamRetrySwitch makes each retry sent to the next upstream.
+	UpstreamRetrySwitch bool `yaml:"upstream-retry-switch"`
+
+	// UpstreamRefusal is the action on the REFUSED and NOTIMP responses of the
+	// upstreams, see [proxy.UpstreamRefusalAction].
+	UpstreamRefusal string `yaml:"upstream-refusal"`
+
+	// AnswerOrder is the order of the records in the responses, see
+	// [proxy.AnswerOrder].
+	AnswerOrder string `yaml:"answer-order"`
+
 	// ListenAddrs is the list of server's listen addresses.
 	ListenAddrs []string `yaml:"listen-addrs"`
 
+	// Listeners are the listeners with their own settings in the
+	// proto://ip:port format with the optional cert, key, and client-policy
+	// query parameters.
+	Listeners []string `yaml:"listener"`
+
 	// ListenPorts are the ports server listens on.
 	ListenPorts []int `yaml:"listen-ports"`
 
@@ -70,11 +141,53 @@ type configuration struct {
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback"`
 
+	// ClientUpstreams are the upstreams for the requests from the specific
+	// client networks, each is prefixed with the comma-separated list of the
+	// networks in square brackets, e.g. "[10.0.0.0/8]tls://dns.corp.example".
+	ClientUpstreams []string `yaml:"client-upstream"`
+
+	// ClientAuth are the identities of the authenticated clients in the
+	// [subnet,...]cert:name and [subnet,...]token:value formats, which map the
+	// clients with the certificate of the name or the DoH token of the value to
+	// the policy of ClientUpstreams with the same networks.
+	ClientAuth []string `yaml:"client-auth"`
+
+	// ClientAnswerOrders are the orders of the records in the responses to the
+	// clients in the [subnet,...]order format, which override AnswerOrder for
+	// the policy of ClientUpstreams with the same networks.
+	ClientAnswerOrders []string `yaml:"client-answer-order"`
+
+	// TLSClientCAPath is the path to the file with the certificates of the CAs
+	// verifying the client certificates.  If empty, the client certificates
+	// aren't requested.
+	TLSClientCAPath string `yaml:"tls-client-ca"`
+
 	// PrivateRDNSUpstreams are upstreams to use for reverse DNS lookups of
 	// private addresses, including the requests for authority records, such as
 	// SOA and NS.
 	PrivateRDNSUpstreams []string `yaml:"private-rdns-upstream"`
 
+	// PrivateRDNSHosts are the hostnames to answer the reverse DNS lookups of
+	// private addresses with locally, each in the "ip=host" format.
+	PrivateRDNSHosts []string `yaml:"private-rdns-host"`
+
+	// PrivateRDNSZone is the local zone to synthesize the hostnames for the
+	// reverse DNS lookups of private addresses within.
+	PrivateRDNSZone string `yaml:"private-rdns-zone"`
+
+	// MDNSTimeout is the time to wait for the multicast DNS responses.
+	MDNSTimeout timeutil.Duration `yaml:"mdns-timeout"`
+
+	// MDNS makes the names within the "local." domain resolved with the
+	// multicast DNS queries on the LAN.
+	MDNS bool `yaml:"mdns"`
+
+	// CacheRefreshUpstreams are upstreams to use for the proactive cache
+	// refresh.  Those are separate instances even if the same addresses are
+	// also used as Upstreams, so that the background traffic doesn't share the
+	// connections with the user queries.
+	CacheRefreshUpstreams []string `yaml:"cache-refresh-upstream"`
+
 	// DNS64Prefix defines the DNS64 prefixes that dnsproxy should use when it
 	// acts as a DNS64 server.  If not specified, dnsproxy uses the default
 	// Well-Known Prefix.  This option can be specified multiple times.
@@ -91,6 +204,10 @@ type configuration struct {
 	// go-flags doesn't support text unmarshalers.
 	BogusNXDomain []string `yaml:"bogus-nxdomain"`
 
+	// RebindAllowedDomains are the domain names allowed to be resolved into
+	// private addresses when RebindProtection is enabled.
+	RebindAllowedDomains []string `yaml:"rebind-allowed-domains"`
+
 	// HostsFiles is the list of paths to the hosts files to resolve from.
 	HostsFiles []string `yaml:"hosts-files"`
 
@@ -98,6 +215,74 @@ type configuration struct {
 	// human-readable form.  Default is 10s.
 	Timeout timeutil.Duration `yaml:"timeout"`
 
+	// UpstreamTimeouts are the timeouts of the exchanges with the particular
+	// upstreams overriding Timeout, each in the "upstream=duration" format.
+	UpstreamTimeouts []string `yaml:"upstream-timeout"`
+
+	// QTypeTimeouts are the timeouts of the exchanges of the queries of the
+	// particular types overriding Timeout and UpstreamTimeouts, each in the
+	// "type=duration" format.
+	QTypeTimeouts []string `yaml:"qtype-timeout"`
+
+	// UpstreamKeepAlive is the period of probing the idle connections to the
+	// encrypted upstream servers in a human-readable form.
+	UpstreamKeepAlive timeutil.Duration `yaml:"upstream-keepalive"`
+
+	// DoTIdleTimeout is the maximum time a pooled connection to a DoT upstream
+	// stays unused in a human-readable form.
+	DoTIdleTimeout timeutil.Duration `yaml:"dot-idle-timeout"`
+
+	// DoTPoolSize is the maximum number of the idle connections kept per DoT
+	// upstream.
+	DoTPoolSize uint `yaml:"dot-pool-size"`
+
+	// HappyEyeballsDelay is the delay before the connections to the addresses
+	// of the other family of the upstreams having both IPv4 and IPv6
+	// addresses are dialed in parallel in a human-readable form.  A negative
+	// value disables the parallel dialing.
+	HappyEyeballsDelay timeutil.Duration `yaml:"happy-eyeballs-delay"`
+
+	// UpstreamPadding is the policy of padding the queries to the encrypted
+	// upstreams, see [upstream.PaddingPolicy].
+	UpstreamPadding string `yaml:"upstream-padding"`
+
+	// UpstreamPaddingBlockSize is the block size of the padding of the queries
+	// to the encrypted upstreams.
+	UpstreamPaddingBlockSize uint `yaml:"upstream-padding-block-size"`
+
+	// UpstreamRandomizeQueries makes the UDP queries to the plain DNS upstreams
+	// randomized and verified, see [upstream.Options.RandomizeQueries].
+	UpstreamRandomizeQueries bool `yaml:"upstream-randomize-queries"`
+
+	// UpstreamUDPSize is the EDNS UDP buffer size advertised in the UDP
+	// queries to the plain DNS upstreams, see [upstream.Options.UDPSize].
+	UpstreamUDPSize uint `yaml:"upstream-udp-size"`
+
+	// BootstrapRefreshTime is the period of time before the bootstrapped
+	// addresses expire during which the upstream hostnames are resolved again
+	// in the background.
+	BootstrapRefreshTime timeutil.Duration `yaml:"bootstrap-refresh-time"`
+
+	// BootstrapMaxStale is the period of time after the bootstrapped addresses
+	// expire during which they're still used if the bootstrap DNS fails.
+	BootstrapMaxStale timeutil.Duration `yaml:"bootstrap-max-stale"`
+
+	// UpstreamBindIPv4 is the source IPv4 address of the connections to the
+	// upstream servers.
+	UpstreamBindIPv4 string `yaml:"upstream-bind-ipv4"`
+
+	// UpstreamBindIPv6 is the source IPv6 address of the connections to the
+	// upstream servers.
+	UpstreamBindIPv6 string `yaml:"upstream-bind-ipv6"`
+
+	// UpstreamBindInterface is the name of the network interface to bind the
+	// connections to the upstream servers to.
+	UpstreamBindInterface string `yaml:"upstream-bind-interface"`
+
+	// UpstreamProxy is the URL of the SOCKS5 or HTTP CONNECT proxy for the TCP
+	// connections to the upstream servers.
+	UpstreamProxy string `yaml:"upstream-proxy"`
+
 	// CacheMinTTL is the minimum TTL value for caching DNS entries, in seconds.
 	// It overrides the TTL value from the upstream server, if the one is less.
 	CacheMinTTL uint32 `yaml:"cache-min-ttl"`
@@ -115,9 +300,98 @@ type configuration struct {
 	// when cache is optimistic.
 	OptimisticMaxAge timeutil.Duration `yaml:"optimistic-max-age"`
 
+	// CacheStaleIfError is the period of time the expired cache entries are
+	// kept to answer with them when resolving fails.
+	CacheStaleIfError timeutil.Duration `yaml:"cache-stale-if-error"`
+
+	// CacheStaleIfErrorTTL is the TTL of the answers served due to
+	// CacheStaleIfError.
+	CacheStaleIfErrorTTL timeutil.Duration `yaml:"cache-stale-if-error-ttl"`
+
 	// CacheSizeBytes is the cache size in bytes.  Default is 64k.
 	CacheSizeBytes int `yaml:"cache-size"`
 
+	// CacheMaxEntries is the maximum number of the cached responses.  Zero
+	// means no limit.
+	CacheMaxEntries int `yaml:"cache-max-entries"`
+
+	// CacheEvictionPolicy is the policy of evicting the entries from the full
+	// cache.
+	CacheEvictionPolicy string `yaml:"cache-eviction-policy"`
+
+	// CacheFilePath is the path to the file to persist the cache in.
+	CacheFilePath string `yaml:"cache-file"`
+
+	// CacheFileFlushInterval is the interval of writing the cache changes to
+	// the journal next to the cache file.  Zero means the cache is only saved
+	// on shutdown.
+	CacheFileFlushInterval timeutil.Duration `yaml:"cache-file-flush-interval"`
+
+	// CacheReplicaListen is the address to listen for the cache snapshots
+	// pushed by the primary on.  If set, the server never queries the
+	// upstreams and answers exclusively from the cache.
+	CacheReplicaListen string `yaml:"cache-replica-listen"`
+
+	// CacheReplicateTo are the URLs of the replicas to push the cache
+	// snapshots to.
+	CacheReplicateTo []string `yaml:"cache-replicate-to"`
+
+	// CacheReplicationInterval is the interval of pushing the cache snapshots
+	// to the replicas.
+	CacheReplicationInterval timeutil.Duration `yaml:"cache-replication-interval"`
+
+	// CacheReplicationToken is the bearer token sent with the cache snapshots
+	// by the primary and required from it by the replica.
+	CacheReplicationToken string `yaml:"cache-replication-token"`
+
+	// CacheProactiveWarmupPeriod is the period after the start to limit the
+	// proactive refresh queries to each upstream.
+	CacheProactiveWarmupPeriod timeutil.Duration `yaml:"cache-proactive-warmup-period"`
+
+	// CacheProactiveRefreshTime is the time in milliseconds before the TTL
+	// expiration to refresh the optimistic cache entries proactively.
+	CacheProactiveRefreshTime int `yaml:"cache-proactive-refresh-time"`
+
+	// CacheProactiveCooldownPeriod is the time window in seconds to count the
+	// requests of the cache entries in.
+	CacheProactiveCooldownPeriod int `yaml:"cache-proactive-cooldown-period"`
+
+	// CacheProactiveCooldownThreshold is the minimum number of requests within
+	// the cooldown period to refresh the cache entry proactively.
+	CacheProactiveCooldownThreshold int `yaml:"cache-proactive-cooldown-threshold"`
+
+	// CacheProactiveStatsMaxEntries is the maximum number of cache entries to
+	// count the requests of.
+	CacheProactiveStatsMaxEntries int `yaml:"cache-proactive-stats-max-entries"`
+
+	// CacheProactiveRefreshMaxConcurrent is the maximum number of proactive
+	// refreshes performed at the same time.
+	CacheProactiveRefreshMaxConcurrent int `yaml:"cache-proactive-max-concurrent"`
+
+	// CacheProactiveMaxRefreshQPS is the maximum number of proactive refreshes
+	// performed per second.
+	CacheProactiveMaxRefreshQPS int `yaml:"cache-proactive-max-qps"`
+
+	// CacheProactiveWarmupRate is the maximum number of proactive refresh
+	// queries per second to each upstream during the warm-up period.
+	CacheProactiveWarmupRate int `yaml:"cache-proactive-warmup-rate"`
+
+	// CacheProactiveRefreshGuard makes the proactive refresh results
+	// drastically worse than the cached responses rejected.
+	CacheProactiveRefreshGuard bool `yaml:"cache-proactive-refresh-guard"`
+
+	// CacheProactiveRefreshMinAnswers is the minimum number of the answer
+	// records of a proactive refresh result for CacheProactiveRefreshGuard.
+	CacheProactiveRefreshMinAnswers uint `yaml:"cache-proactive-refresh-min-answers"`
+
+	// CacheProactivePinnedZones are the domain name patterns always refreshed
+	// proactively regardless of the request frequency.
+	CacheProactivePinnedZones []string `yaml:"cache-proactive-pinned-zones"`
+
+	// CacheProactiveExcludedZones are the domain name patterns never refreshed
+	// proactively.
+	CacheProactiveExcludedZones []string `yaml:"cache-proactive-excluded-zones"`
+
 	// Ratelimit is the maximum number of requests per second.
 	Ratelimit int `yaml:"ratelimit"`
 
@@ -129,10 +403,32 @@ type configuration struct {
 	// rate limiting requests.
 	RatelimitSubnetLenIPv6 int `yaml:"ratelimit-subnet-len-ipv6"`
 
+	// RatelimitPolicy is the action performed on ratelimited requests.
+	RatelimitPolicy string `yaml:"ratelimit-policy"`
+
+	// RatelimitWhitelist is the list of IP addresses and CIDR subnets excluded
+	// from rate limiting.
+	RatelimitWhitelist []string `yaml:"ratelimit-whitelist"`
+
 	// UDPBufferSize is the size of the UDP buffer in bytes.  A value <= 0 will
 	// use the system default.
 	UDPBufferSize int `yaml:"udp-buf-size"`
 
+	// UDPSockets is the number of UDP sockets for each listen address.
+	// Negative value means one socket per CPU.
+	UDPSockets int `yaml:"udp-sockets"`
+
+	// IPSet are the rules in the "DOMAIN[,DOMAIN].../SET[,SET]..." format for
+	// adding the resolved addresses into the firewall sets.
+	IPSet []string `yaml:"ipset"`
+
+	// IPSetBackend is the kind of the firewall sets: "ipset" or "nftables".
+	IPSetBackend string `yaml:"ipset-backend"`
+
+	// OTLPTracesEndpoint is the URL of the OTLP/HTTP endpoint to export the
+	// spans of the queries to.  If empty, the queries aren't traced.
+	OTLPTracesEndpoint string `yaml:"otlp-traces-endpoint"`
+
 	// MaxGoRoutines is the maximum number of goroutines.
 	MaxGoRoutines uint `yaml:"max-go-routines"`
 
@@ -154,10 +450,15 @@ type configuration struct {
 	// not.
 	HostsFileEnabled bool `yaml:"hosts-file-enabled"`
 
-	// Pprof defines whether the pprof information needs to be exposed via
-	// localhost:6060 or not.
+	// Pprof defines whether the debug endpoints need to be exposed via
+	// localhost:6060 or not.  DebugAddr takes precedence.
 	Pprof bool `yaml:"pprof"`
 
+	// DebugAddr is the address to serve the debug endpoints on: pprof, the
+	// goroutine dumps, and the state of the proactive cache refresh.  If empty,
+	// they aren't served unless Pprof is true.
+	DebugAddr string `yaml:"debug-addr"`
+
 	// Version, if true, prints the program version, and exits.
 	Version bool `yaml:"version"`
 
@@ -174,6 +475,10 @@ type configuration struct {
 	// It enables HTTP/3 support for both the DoH upstreams and the DoH server.
 	HTTP3 bool `yaml:"http3"`
 
+	// HTTP3Fallback makes the h3:// upstreams fall back to HTTP/2 when QUIC is
+	// unavailable, e.g. when UDP is blocked.
+	HTTP3Fallback bool `yaml:"http3-fallback"`
+
 	// CacheOptimistic, if set to true, enables the optimistic DNS cache. That
 	// means that cached results will be served even if their cache TTL has
 	// already expired.
@@ -185,6 +490,192 @@ type configuration struct {
 	// RefuseAny makes the server to refuse requests of type ANY.
 	RefuseAny bool `yaml:"refuse-any"`
 
+	// RequireClientAuth makes the server reject the DoT, DoH, and DoQ requests
+	// from the clients not authenticated with ClientAuth.
+	RequireClientAuth bool `yaml:"require-client-auth"`
+
+	// ANYHINFOExempt are the client subnets the requests of type ANY from
+	// which are forwarded despite ANYHINFO.
+	ANYHINFOExempt []string `yaml:"any-hinfo-exempt"`
+
+	// ANYHINFO makes the server answer the requests of type ANY with the
+	// minimal HINFO responses, see RFC 8482.
+	ANYHINFO bool `yaml:"any-hinfo"`
+
+	// TruncateAny makes the server respond to UDP requests of type ANY with
+	// truncated responses.
+	TruncateAny bool `yaml:"truncate-any"`
+
+	// EDNSBadVersion makes the server respond to requests with unsupported
+	// EDNS versions with BADVERS.
+	EDNSBadVersion bool `yaml:"edns-badvers"`
+
+	// EDNSClearUnknownFlags makes the server clear the unknown EDNS flags of
+	// requests before resolving them.
+	EDNSClearUnknownFlags bool `yaml:"edns-clear-unknown-flags"`
+
+	// EDNSAllowedOptions are the codes of the only EDNS(0) options forwarded
+	// between the clients and the upstreams, if not empty.
+	EDNSAllowedOptions []int `yaml:"edns-allow-option"`
+
+	// EDNSDeniedOptions are the codes of the EDNS(0) options stripped from the
+	// requests and the responses.
+	EDNSDeniedOptions []int `yaml:"edns-deny-option"`
+
+	// ClientStats makes the server gather the statistics of requests per
+	// client network.
+	ClientStats bool `yaml:"client-stats"`
+
+	// ClientStatsFilePath is the path to the file to persist the per-client
+	// statistics to.  If empty, the statistics aren't persisted.
+	ClientStatsFilePath string `yaml:"client-stats-file"`
+
+	// ClientStatsSubnetLenIPv4 is the length of the IPv4 prefixes to aggregate
+	// the per-client statistics by.
+	ClientStatsSubnetLenIPv4 int `yaml:"client-stats-subnet-len-ipv4"`
+
+	// ClientStatsSubnetLenIPv6 is the length of the IPv6 prefixes to aggregate
+	// the per-client statistics by.
+	ClientStatsSubnetLenIPv6 int `yaml:"client-stats-subnet-len-ipv6"`
+
+	// MirrorFile is the path to the file to write the sampled queries with
+	// their responses to.  If empty, the queries aren't mirrored.
+	MirrorFile string `yaml:"mirror-file"`
+
+	// MirrorFormat is the format of the mirror file, either "pcap" or
+	// "dnstap".  If empty, "pcap" is used.
+	MirrorFormat string `yaml:"mirror-format"`
+
+	// MirrorRate is the share of the queries to mirror, from 0 to 1.
+	MirrorRate float32 `yaml:"mirror-rate"`
+
+	// MirrorZones are the domains to mirror all queries for regardless of
+	// MirrorRate.
+	MirrorZones []string `yaml:"mirror-zones"`
+
+	// AnomalyCaptureFile is the path to the PCAP file to capture the malformed
+	// and anomalous traffic to.  If empty, nothing is captured.
+	AnomalyCaptureFile string `yaml:"anomaly-capture-file"`
+
+	// AnomalyCaptureMaxSize is the maximum size of the anomaly capture file in
+	// bytes.
+	AnomalyCaptureMaxSize uint `yaml:"anomaly-capture-max-size"`
+
+	// AnomalyCaptureMaxBackups is the number of the rotated anomaly capture
+	// files to keep.
+	AnomalyCaptureMaxBackups uint `yaml:"anomaly-capture-max-backups"`
+
+	// AnomalyCaptureSnapLen is the maximum number of bytes of each captured DNS
+	// message.
+	AnomalyCaptureSnapLen uint `yaml:"anomaly-capture-snaplen"`
+
+	// AnomalyCaptureRedactClients makes the client addresses redacted in the
+	// anomaly capture.
+	AnomalyCaptureRedactClients bool `yaml:"anomaly-capture-redact-clients"`
+
+	// MaxUDPSize is the maximum size of UDP responses.  Zero means no limit
+	// besides the client's buffer size.
+	MaxUDPSize uint `yaml:"max-udp-size"`
+
+	// ResponseUDPSize is the EDNS UDP buffer size advertised to the clients in
+	// the responses.  Zero keeps the size from the upstream response.
+	ResponseUDPSize uint `yaml:"response-udp-size"`
+
+	// DNSSEC makes the server validate DNSSEC signatures of the upstream
+	// responses.
+	DNSSEC bool `yaml:"dnssec"`
+
+	// AnnotateSource makes the server add the response source EDNS option to
+	// the responses.
+	AnnotateSource bool `yaml:"annotate-source"`
+
+	// NormalizeRequests makes the server send the requests differing only in
+	// the RD flag and the question name case to the upstreams as the same one.
+	NormalizeRequests bool `yaml:"normalize-requests"`
+
+	// StripECH makes the server remove the ECH configurations from the SVCB
+	// and HTTPS records of the upstream responses.
+	StripECH bool `yaml:"strip-ech"`
+
+	// SanitizeResponses makes the server remove the records unrelated to the
+	// question from the upstream responses.
+	SanitizeResponses bool `yaml:"sanitize-responses"`
+
+	// RebindProtection makes the server replace the upstream responses
+	// resolving the names into private addresses with NXDOMAIN ones.
+	RebindProtection bool `yaml:"rebind-protection"`
+
+	// CacheProactiveAdaptive makes the frequently requested cache entries
+	// refreshed closer to their expiration.
+	CacheProactiveAdaptive bool `yaml:"cache-proactive-adaptive"`
+
+	// CacheFileRevalidate makes the entries loaded from the cache file served
+	// as stale until they are resolved again.
+	CacheFileRevalidate bool `yaml:"cache-file-revalidate"`
+
+	// CachePrefetchDualStack makes the server resolve and cache the addresses
+	// of the other family in the background on cache misses of A and AAAA
+	// requests.
+	CachePrefetchDualStack bool `yaml:"cache-prefetch-dual-stack"`
+
+	// CachePerClient makes the server cache the responses to the clients of
+	// each of ClientUpstreams separately.
+	CachePerClient bool `yaml:"cache-per-client"`
+
+	// CacheOutageTTLMultiplier is the factor the lifetime of the cached entries
+	// expiring during an upstream outage is multiplied by.  The outage handling
+	// is disabled unless it's greater than 1.
+	CacheOutageTTLMultiplier float32 `yaml:"cache-outage-ttl-multiplier"`
+
+	// CacheOutageThreshold is the number of consecutive failed upstream
+	// exchanges to detect an upstream outage.
+	CacheOutageThreshold uint `yaml:"cache-outage-threshold"`
+
+	// CacheOutageWindow is the period of time since the latest failed upstream
+	// exchange after which the upstream outage is considered over.
+	CacheOutageWindow timeutil.Duration `yaml:"cache-outage-window"`
+
+	// CacheMemoryPressure makes the server degrade the cache while the memory
+	// used nears the limit.
+	CacheMemoryPressure bool `yaml:"cache-memory-pressure"`
+
+	// CacheMemoryLimit is the memory limit in bytes to detect the memory
+	// pressure with.  If zero, the limit is detected automatically.
+	CacheMemoryLimit uint `yaml:"cache-memory-limit"`
+
+	// NetworkWatch makes the server watch the host network and recreate the
+	// upstreams once it changes.
+	NetworkWatch bool `yaml:"network-watch"`
+
+	// NetworkChangeRefreshPause is the period of time after a network change
+	// during which the proactive cache refreshes are postponed.
+	NetworkChangeRefreshPause timeutil.Duration `yaml:"network-change-refresh-pause"`
+
+	// NetworkChangeFlushECS makes the server remove the entries cached for
+	// specific client subnets on a network change.
+	NetworkChangeFlushECS bool `yaml:"network-change-flush-ecs"`
+
+	// StartupProbe is the mode of verifying the upstreams with a probe query
+	// on startup: "strict" or "resilient".  The upstreams aren't probed if
+	// it's empty.
+	StartupProbe string `yaml:"startup-probe"`
+
+	// StartupProbeDomain is the domain name to query during the startup probe.
+	StartupProbeDomain string `yaml:"startup-probe-domain"`
+
+	// CriticalNames are the domain names, the upstream answers for which are
+	// checked to detect hijacking.  Each one may be followed by the
+	// comma-separated subnets the answered addresses must belong to.
+	CriticalNames []string `yaml:"critical-names"`
+
+	// CriticalNameRequireDNSSEC makes the answers for the critical names
+	// required to be validated with DNSSEC.
+	CriticalNameRequireDNSSEC bool `yaml:"critical-name-require-dnssec"`
+
+	// CriticalNameBlock makes the server replace the answers for the critical
+	// names violating the constraints with SERVFAIL responses.
+	CriticalNameBlock bool `yaml:"critical-name-block"`
+
 	// EnableEDNSSubnet uses EDNS Client Subnet extension.
 	EnableEDNSSubnet bool `yaml:"edns"`
 
@@ -206,16 +697,19 @@ type configuration struct {
 // no options have been parsed, it returns a suitable exit code and an error.
 func parseConfig() (conf *configuration, exitCode int, err error) {
 	conf = &configuration{
-		HTTPSServerName:        "dnsproxy",
-		UpstreamMode:           string(proxy.UpstreamModeLoadBalance),
-		CacheSizeBytes:         64 * 1024,
-		Timeout:                timeutil.Duration(10 * time.Second),
-		OptimisticAnswerTTL:    timeutil.Duration(proxy.DefaultOptimisticAnswerTTL),
-		OptimisticMaxAge:       timeutil.Duration(proxy.DefaultOptimisticMaxAge),
-		RatelimitSubnetLenIPv4: 24,
-		RatelimitSubnetLenIPv6: 56,
-		HostsFileEnabled:       true,
-		PendingRequestsEnabled: true,
+		HTTPSServerName:          "dnsproxy",
+		UpstreamMode:             string(proxy.UpstreamModeLoadBalance),
+		CacheSizeBytes:           64 * 1024,
+		Timeout:                  timeutil.Duration(10 * time.Second),
+		OptimisticAnswerTTL:      timeutil.Duration(proxy.DefaultOptimisticAnswerTTL),
+		OptimisticMaxAge:         timeutil.Duration(proxy.DefaultOptimisticMaxAge),
+		RatelimitSubnetLenIPv4:   24,
+		RatelimitSubnetLenIPv6:   56,
+		RatelimitPolicy:          string(proxy.RatelimitPolicyDrop),
+		ClientStatsSubnetLenIPv4: 32,
+		ClientStatsSubnetLenIPv6: 64,
+		HostsFileEnabled:         true,
+		PendingRequestsEnabled:   true,
 	}
 
 	err = parseCmdLineOptions(conf)
@@ -252,7 +746,8 @@ func parseConfig() (conf *configuration, exitCode int, err error) {
 }
 
 // parseConfigFile fills options with the settings from file read by the given
-// path.
+// path.  The file is parsed as TOML if it has the .toml extension, and as YAML
+// otherwise.
 func parseConfigFile(conf *configuration, confPath string) (err error) {
 	// #nosec G304 -- Trust the file path that is given in the args.
 	b, err := os.ReadFile(confPath)
@@ -260,6 +755,13 @@ func parseConfigFile(conf *configuration, confPath string) (err error) {
 		return fmt.Errorf("reading file: %w", err)
 	}
 
+	if strings.EqualFold(filepath.Ext(confPath), ".toml") {
+		b, err = tomlToYAML(b)
+		if err != nil {
+			return fmt.Errorf("converting toml: %w", err)
+		}
+	}
+
 	err = yaml.Unmarshal(b, conf)
 	if err != nil {
 		return fmt.Errorf("unmarshalling file: %w", err)
@@ -267,3 +769,16 @@ func parseConfigFile(conf *configuration, confPath string) (err error) {
 
 	return nil
 }
+
+// tomlToYAML converts the TOML document b into the YAML one, so that the same
+// keys are used in both formats.
+func tomlToYAML(b []byte) (yamlData []byte, err error) {
+	var doc map[string]any
+	err = toml.Unmarshal(b, &doc)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	return yaml.Marshal(doc)
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseConfigFile_toml(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		want       *configuration
+		name       string
+		data       string
+		wantErrMsg string
+	}{{
+		want: &configuration{
+			Upstreams:   []string{"1.1.1.1", "tls://dns.example"},
+			ListenAddrs: []string{"127.0.0.1", "::1"},
+			ListenPorts: []int{53, 5353},
+		},
+		name: "arrays",
+		data: `upstream = ["1.1.1.1", "tls://dns.example"]
+listen-addrs = ["127.0.0.1", "::1"]
+listen-ports = [53, 5353]
+`,
+		wantErrMsg: "",
+	}, {
+		want: &configuration{
+			Timeout:                timeutil.Duration(5 * time.Second),
+			CacheFileFlushInterval: timeutil.Duration(90 * time.Minute),
+		},
+		name: "durations",
+		data: `timeout = "5s"
+cache-file-flush-interval = "1h30m"
+`,
+		wantErrMsg: "",
+	}, {
+		want: &configuration{
+			Cache:                     true,
+			CacheSizeBytes:            1024,
+			CacheProactiveRefreshTime: 30000,
+			TLSMinVersion:             1.2,
+		},
+		name: "scalars",
+		data: `cache = true
+cache-size = 1024
+cache-proactive-refresh-time = 30000
+tls-min-version = 1.2
+`,
+		wantErrMsg: "",
+	}, {
+		want: &configuration{
+			Upstreams: []string{"1.1.1.1"},
+		},
+		name: "unknown_nested_table",
+		data: `upstream = ["1.1.1.1"]
+
+[unknown]
+key = "value"
+
+[unknown.nested]
+list = [1, 2]
+`,
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "bad_duration",
+		data:       `timeout = "5 parsecs"`,
+		wantErrMsg: `unmarshalling file: time: unknown unit " parsecs" in duration "5 parsecs"`,
+	}, {
+		want: nil,
+		name: "bad_toml",
+		data: `upstream = [`,
+		wantErrMsg: `converting toml: toml: line 1 (last key "upstream"): ` +
+			`unexpected EOF; expected value`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			confPath := filepath.Join(t.TempDir(), "config.toml")
+			err := os.WriteFile(confPath, []byte(tc.data), 0o600)
+			require.NoError(t, err)
+
+			conf := &configuration{}
+			err = parseConfigFile(conf, confPath)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.want != nil {
+				assert.Equal(t, tc.want, conf)
+			}
+		})
+	}
+}
+
+func TestTOMLToYAML(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		want map[string]any
+		name string
+		data string
+	}{{
+		want: map[string]any{
+			"outer": map[string]any{
+				"key": "value",
+				"inner": map[string]any{
+					"number": 1,
+				},
+			},
+		},
+		name: "nested_tables",
+		data: `[outer]
+key = "value"
+
+[outer.inner]
+number = 1
+`,
+	}, {
+		want: map[string]any{
+			"servers": []any{
+				map[string]any{"addr": "1.1.1.1", "ports": []any{53, 853}},
+				map[string]any{"addr": "8.8.8.8", "ports": []any{53}},
+			},
+		},
+		name: "array_of_tables",
+		data: `[[servers]]
+addr = "1.1.1.1"
+ports = [53, 853]
+
+[[servers]]
+addr = "8.8.8.8"
+ports = [53]
+`,
+	}, {
+		want: map[string]any{
+			"a": map[string]any{
+				"b": map[string]any{"c": "dotted"},
+			},
+		},
+		name: "dotted_keys",
+		data: `a.b.c = "dotted"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			yamlData, err := tomlToYAML([]byte(tc.data))
+			require.NoError(t, err)
+
+			var got map[string]any
+			err = yaml.Unmarshal(yamlData, &got)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
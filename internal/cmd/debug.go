@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rtpprof "runtime/pprof"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// defaultDebugAddr is the address of the debug server enabled with --pprof.
+const defaultDebugAddr = "localhost:6060"
+
+// debugAddr returns the address of the debug server, or an empty string if it's
+// disabled.
+func (conf *configuration) debugAddr() (addr string) {
+	if conf.DebugAddr != "" {
+		return conf.DebugAddr
+	}
+
+	if conf.Pprof {
+		return defaultDebugAddr
+	}
+
+	return ""
+}
+
+// startDebugServer starts the server of the debug endpoints of p, if
+// configured, and returns the function shutting it down.  l must not be nil.
+func (conf *configuration) startDebugServer(
+	ctx context.Context,
+	l *slog.Logger,
+	p *proxy.Proxy,
+) (stop func(ctx context.Context) (err error), err error) {
+	addr := conf.debugAddr()
+	if addr == "" {
+		return func(_ context.Context) (err error) { return nil }, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           newDebugHandler(l, p),
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+
+	l.InfoContext(ctx, "starting debug server", "addr", ln.Addr())
+
+	go func() {
+		defer slogutil.RecoverAndLog(ctx, l)
+
+		serveErr := srv.Serve(ln)
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			l.ErrorContext(ctx, "debug server failed", "addr", addr, slogutil.KeyError, serveErr)
+		}
+	}()
+
+	return srv.Shutdown, nil
+}
+
+// newDebugHandler returns the handler of the debug endpoints:
+//   - /debug/pprof/ with the profiles of the process;
+//   - /debug/goroutines with the stacks of all the goroutines;
+//   - /debug/refresher with the state of the proactive cache refresh of p;
+//   - /metrics with the statistics of the upstreams of p.
+//
+// TODO(e.burkov):  Add debugsvc.
+func newDebugHandler(l *slog.Logger, p *proxy.Proxy) (h http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
+	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
+	mux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
+	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
+	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+
+	mux.HandleFunc("GET /debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "goroutines: %d\n\n", runtime.NumGoroutine())
+
+		// Use the same format as an unrecovered panic does.
+		err := rtpprof.Lookup("goroutine").WriteTo(w, 2)
+		if err != nil {
+			l.DebugContext(r.Context(), "writing goroutines", slogutil.KeyError, err)
+		}
+	})
+
+	mux.HandleFunc("GET /debug/refresher", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(&refresherDump{
+			State:    p.RefresherState(),
+			Schedule: p.RefreshSchedule(),
+		})
+		if err != nil {
+			l.DebugContext(r.Context(), "writing refresher state", slogutil.KeyError, err)
+		}
+	})
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+
+		err := writeUpstreamMetrics(w, p.UpstreamStats())
+		if err != nil {
+			l.DebugContext(r.Context(), "writing metrics", slogutil.KeyError, err)
+		}
+	})
+
+	return mux
+}
+
+// refresherDump is the response of the /debug/refresher endpoint.
+type refresherDump struct {
+	// State is the overall state of the proactive cache refresh.  It's nil if
+	// the cache is disabled.
+	State *proxy.RefresherState `json:"state"`
+
+	// Schedule is the state of the particular cache entries.
+	Schedule []*proxy.RefreshScheduleEntry `json:"schedule"`
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// metricsContentType is the content type of the Prometheus text exposition
+// format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// upstreamCounter is a counter metric of the upstreams.
+type upstreamCounter struct {
+	// value returns the value of the metric for s.
+	value func(s *proxy.UpstreamStats) (v uint64)
+
+	// name is the name of the metric.
+	name string
+
+	// help is the description of the metric.
+	help string
+}
+
+// upstreamCounters are the counter metrics of the upstreams.
+var upstreamCounters = []*upstreamCounter{{
+	value: func(s *proxy.UpstreamStats) (v uint64) { return s.Queries },
+	name:  "dnsproxy_upstream_queries_total",
+	help:  "Number of queries sent to the upstream.",
+}, {
+	value: func(s *proxy.UpstreamStats) (v uint64) { return s.Errors },
+	name:  "dnsproxy_upstream_errors_total",
+	help:  "Number of failed exchanges with the upstream, including the timed out ones.",
+}, {
+	value: func(s *proxy.UpstreamStats) (v uint64) { return s.Timeouts },
+	name:  "dnsproxy_upstream_timeouts_total",
+	help:  "Number of timed out exchanges with the upstream.",
+}}
+
+// metricLabelReplacer escapes the values of the labels.
+var metricLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeUpstreamMetrics writes the metrics of the upstreams from stats into w in
+// the Prometheus text exposition format.
+func writeUpstreamMetrics(w io.Writer, stats []*proxy.UpstreamStats) (err error) {
+	bw := bufio.NewWriter(w)
+
+	// The errors of the writes are sticky, so only check the one of the flush.
+	for _, c := range upstreamCounters {
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, s := range stats {
+			_, _ = fmt.Fprintf(bw, "%s{%s} %d\n", c.name, upstreamLabels(s), c.value(s))
+		}
+	}
+
+	const latencyName = "dnsproxy_upstream_latency_seconds"
+
+	_, _ = fmt.Fprintf(
+		bw,
+		"# HELP %s Duration of the successful exchanges with the upstream.\n# TYPE %s summary\n",
+		latencyName,
+		latencyName,
+	)
+	for _, s := range stats {
+		labels := upstreamLabels(s)
+		for _, q := range []struct {
+			value    time.Duration
+			quantile string
+		}{
+			{value: s.LatencyP50, quantile: "0.5"},
+			{value: s.LatencyP90, quantile: "0.9"},
+			{value: s.LatencyP99, quantile: "0.99"},
+		} {
+			_, _ = fmt.Fprintf(
+				bw,
+				"%s{%s,quantile=%q} %g\n",
+				latencyName,
+				labels,
+				q.quantile,
+				q.value.Seconds(),
+			)
+		}
+
+		sum := s.AverageLatency * time.Duration(s.Responses)
+		_, _ = fmt.Fprintf(bw, "%s_sum{%s} %g\n", latencyName, labels, sum.Seconds())
+		_, _ = fmt.Fprintf(bw, "%s_count{%s} %d\n", latencyName, labels, s.Responses)
+	}
+
+	return bw.Flush()
+}
+
+// upstreamLabels returns the labels of the metrics of the upstream with
+// statistics s.
+func upstreamLabels(s *proxy.UpstreamStats) (labels string) {
+	return fmt.Sprintf(
+		`upstream="%s",protocol="%s"`,
+		metricLabelReplacer.Replace(s.Address),
+		metricLabelReplacer.Replace(s.Protocol),
+	)
+}
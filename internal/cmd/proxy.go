@@ -5,16 +5,21 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
 	"net/netip"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/dnsproxy/internal/dnsmsg"
 	"github.com/AdguardTeam/dnsproxy/internal/handler"
+	"github.com/AdguardTeam/dnsproxy/internal/ipset"
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
@@ -22,6 +27,12 @@ import (
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/osutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v3"
 )
 
@@ -61,13 +72,43 @@ func createProxyConfig(
 		Ratelimit:                conf.Ratelimit,
 		CacheEnabled:             conf.Cache,
 		CacheSizeBytes:           conf.CacheSizeBytes,
+		CacheMaxEntries:          conf.CacheMaxEntries,
+		CacheFilePath:            conf.CacheFilePath,
+		CacheFileFlushInterval:   time.Duration(conf.CacheFileFlushInterval),
+		CacheFileRevalidate:      conf.CacheFileRevalidate,
+		CachePrefetchDualStack:   conf.CachePrefetchDualStack,
+		CachePerClient:           conf.CachePerClient,
 		CacheMinTTL:              conf.CacheMinTTL,
 		CacheMaxTTL:              conf.CacheMaxTTL,
 		CacheOptimisticAnswerTTL: time.Duration(conf.OptimisticAnswerTTL),
 		CacheOptimisticMaxAge:    time.Duration(conf.OptimisticMaxAge),
 		CacheOptimistic:          conf.CacheOptimistic,
-		RefuseAny:                conf.RefuseAny,
-		HTTP3:                    conf.HTTP3,
+
+		CacheStaleIfErrorMaxAge:    time.Duration(conf.CacheStaleIfError),
+		CacheStaleIfErrorAnswerTTL: time.Duration(conf.CacheStaleIfErrorTTL),
+
+		CacheProactiveRefreshTime:          conf.CacheProactiveRefreshTime,
+		CacheProactiveCooldownPeriod:       conf.CacheProactiveCooldownPeriod,
+		CacheProactiveCooldownThreshold:    conf.CacheProactiveCooldownThreshold,
+		CacheProactiveAdaptive:             conf.CacheProactiveAdaptive,
+		CacheProactivePinnedZones:          conf.CacheProactivePinnedZones,
+		CacheProactiveExcludedZones:        conf.CacheProactiveExcludedZones,
+		CacheProactiveStatsMaxEntries:      conf.CacheProactiveStatsMaxEntries,
+		CacheProactiveRefreshMaxConcurrent: conf.CacheProactiveRefreshMaxConcurrent,
+		CacheProactiveMaxRefreshQPS:        conf.CacheProactiveMaxRefreshQPS,
+		CacheProactiveWarmupPeriod:         time.Duration(conf.CacheProactiveWarmupPeriod),
+		CacheProactiveWarmupRate:           conf.CacheProactiveWarmupRate,
+		CacheProactiveRefreshGuard:         conf.CacheProactiveRefreshGuard,
+		CacheProactiveRefreshMinAnswers:    conf.CacheProactiveRefreshMinAnswers,
+
+		RefuseAny:                 conf.RefuseAny,
+		RequireClientAuth:         conf.RequireClientAuth,
+		EnableDNSSECValidation:    conf.DNSSEC,
+		AnnotateResponseSource:    conf.AnnotateSource,
+		NormalizeUpstreamRequests: conf.NormalizeRequests,
+		SanitizeResponses:         conf.SanitizeResponses,
+		StripECH:                  conf.StripECH,
+		HTTP3:                     conf.HTTP3,
 		// TODO(e.burkov):  The following CIDRs are aimed to match any address.
 		// This is not quite proper approach to be used by default so think
 		// about configuring it.
@@ -77,6 +118,7 @@ func createProxyConfig(
 		},
 		EnableEDNSClientSubnet: conf.EnableEDNSSubnet,
 		UDPBufferSize:          conf.UDPBufferSize,
+		UDPSocketsPerAddr:      conf.UDPSockets,
 		HTTPSServerName:        conf.HTTPSServerName,
 		MaxGoroutines:          conf.MaxGoRoutines,
 		UsePrivateRDNS:         conf.UsePrivateRDNS,
@@ -85,6 +127,14 @@ func createProxyConfig(
 		PendingRequests: &proxy.PendingRequestsConfig{
 			Enabled: conf.PendingRequestsEnabled,
 		},
+		RebindProtection: &proxy.RebindProtectionConfig{
+			AllowedDomains: conf.RebindAllowedDomains,
+			Enabled:        conf.RebindProtection,
+		},
+		EDNSCompliance: &proxy.EDNSComplianceConfig{
+			RespondBadVersion: conf.EDNSBadVersion,
+			ClearUnknownFlags: conf.EDNSClearUnknownFlags,
+		},
 	}
 
 	if uiStr := conf.HTTPSUserinfo; uiStr != "" {
@@ -97,14 +147,35 @@ func createProxyConfig(
 	}
 
 	conf.initBogusNXDomain(ctx, l, proxyConf)
+	conf.initClientStats(proxyConf)
+	conf.initCacheOutage(proxyConf)
+	conf.initMemoryPressure(proxyConf)
+	conf.initNetworkChange(proxyConf)
+	conf.initAnomalyCapture(proxyConf)
+	conf.initMDNS(proxyConf)
 
 	var errs []error
+	errs = append(errs, conf.initCacheEvictionPolicy(proxyConf))
+	errs = append(errs, conf.initStartupProbe(proxyConf))
+	errs = append(errs, conf.initCriticalNames(proxyConf))
+	errs = append(errs, conf.initRatelimit(proxyConf))
+	errs = append(errs, conf.initTruncation(proxyConf))
+	errs = append(errs, conf.initANYQuery(proxyConf))
+	errs = append(errs, conf.initUpstreamRetry(proxyConf))
+	errs = append(errs, conf.initUpstreamTimeouts(proxyConf))
+	errs = append(errs, conf.initUpstreamRefusal(proxyConf))
+	errs = append(errs, conf.initAnswerOrder(proxyConf))
+	errs = append(errs, conf.initLogLevels(proxyConf))
 	errs = append(errs, conf.initUpstreams(ctx, l, proxyConf))
+	errs = append(errs, conf.initCacheReplication(proxyConf))
 	errs = append(errs, conf.initEDNS(ctx, l, proxyConf))
-	errs = append(errs, conf.initTLSConfig(proxyConf))
+	errs = append(errs, conf.initEDNSOptions(proxyConf))
+	errs = append(errs, conf.initTLSConfig(l, proxyConf))
+	errs = append(errs, conf.initListeners(l, proxyConf))
 	errs = append(errs, conf.initDNSCryptConfig(proxyConf))
 	errs = append(errs, conf.initListenAddrs(proxyConf))
 	errs = append(errs, conf.initSubnets(proxyConf))
+	errs = append(errs, conf.initPrivateRDNS(proxyConf))
 
 	return proxyConf, errors.Join(errs...)
 }
@@ -140,24 +211,64 @@ func (conf *configuration) initUpstreams(
 		}
 	}
 
+	bindAddr, err := conf.newBindAddr()
+	if err != nil {
+		return fmt.Errorf("parsing upstream bind address: %w", err)
+	}
+
+	proxyURL, err := conf.newUpstreamProxyURL()
+	if err != nil {
+		return fmt.Errorf("parsing upstream proxy: %w", err)
+	}
+
+	upsLogger := proxy.SubsystemLogger(l, proxy.LogSubsystemUpstream, config.LogLevels)
+
 	timeout := time.Duration(conf.Timeout)
 	bootOpts := &upstream.Options{
-		Logger:             l,
+		Logger:             upsLogger,
 		HTTPVersions:       httpVersions,
 		InsecureSkipVerify: conf.Insecure,
 		Timeout:            timeout,
+		HappyEyeballsDelay: time.Duration(conf.HappyEyeballsDelay),
+		BindAddr:           bindAddr,
+		ProxyURL:           proxyURL,
+	}
+	bootCache := &upstream.CachingResolverConfig{
+		Logger:        l.With(slogutil.KeyPrefix, "bootstrap"),
+		RefreshBefore: time.Duration(conf.BootstrapRefreshTime),
+		MaxStale:      time.Duration(conf.BootstrapMaxStale),
 	}
-	boot, err := initBootstrap(ctx, l, conf.BootstrapDNS, bootOpts)
+	boot, err := initBootstrap(ctx, l, conf.BootstrapDNS, bootOpts, bootCache)
 	if err != nil {
 		return fmt.Errorf("initializing bootstrap: %w", err)
 	}
 
+	if conf.UpstreamUDPSize > math.MaxUint16 {
+		return fmt.Errorf(
+			"upstream udp size: %d is greater than %d",
+			conf.UpstreamUDPSize,
+			math.MaxUint16,
+		)
+	}
+
 	upsOpts := &upstream.Options{
-		Logger:             l,
+		Logger:             upsLogger,
 		HTTPVersions:       httpVersions,
 		InsecureSkipVerify: conf.Insecure,
 		Bootstrap:          boot,
-		Timeout:            timeout,
+		Timeout:            longestTimeout(timeout, config.UpstreamTimeouts),
+		KeepAlivePeriod:    time.Duration(conf.UpstreamKeepAlive),
+		DoTIdleTimeout:     time.Duration(conf.DoTIdleTimeout),
+		DoTPoolSize:        conf.DoTPoolSize,
+		HappyEyeballsDelay: time.Duration(conf.HappyEyeballsDelay),
+		PaddingPolicy:      upstream.PaddingPolicy(conf.UpstreamPadding),
+		PaddingBlockSize:   conf.UpstreamPaddingBlockSize,
+		HTTP3Fallback:      conf.HTTP3Fallback,
+		DisableRetry:       config.UpstreamRetry != nil,
+		RandomizeQueries:   conf.UpstreamRandomizeQueries,
+		UDPSize:            uint16(conf.UpstreamUDPSize),
+		BindAddr:           bindAddr,
+		ProxyURL:           proxyURL,
 	}
 	upstreams := loadServersList(conf.Upstreams)
 
@@ -167,7 +278,7 @@ func (conf *configuration) initUpstreams(
 	}
 
 	privateUpsOpts := &upstream.Options{
-		Logger:       l,
+		Logger:       upsLogger,
 		HTTPVersions: httpVersions,
 		Bootstrap:    boot,
 		Timeout:      min(defaultLocalTimeout, timeout),
@@ -193,6 +304,39 @@ func (conf *configuration) initUpstreams(
 		config.Fallbacks = fallbacks
 	}
 
+	config.ClientPolicies, err = conf.newClientPolicies(upsOpts)
+	if err != nil {
+		return fmt.Errorf("parsing client upstreams: %w", err)
+	}
+
+	refreshUpstreams := loadServersList(conf.CacheRefreshUpstreams)
+	refresh, err := proxy.ParseUpstreamsConfig(refreshUpstreams, upsOpts)
+	if err != nil {
+		return fmt.Errorf("parsing cache refresh upstreams configuration: %w", err)
+	}
+
+	if !isEmpty(refresh) {
+		config.CacheProactiveRefreshUpstreams = refresh
+	}
+
+	config.FastestPingICMP = conf.FastestPingICMP
+	for _, port := range conf.FastestPingPorts {
+		if port < 0 {
+			return fmt.Errorf("fastest ping port %d: %w", port, errors.ErrNegative)
+		}
+
+		config.FastestPingPorts = append(config.FastestPingPorts, uint(port))
+	}
+
+	for i, s := range conf.RaceQtypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			return fmt.Errorf("race qtype at index %d: %w: %q", i, errors.ErrBadEnumValue, s)
+		}
+
+		config.RaceQueryTypes = append(config.RaceQueryTypes, qtype)
+	}
+
 	if conf.UpstreamMode != "" {
 		err = config.UpstreamMode.UnmarshalText([]byte(conf.UpstreamMode))
 		if err != nil {
@@ -207,14 +351,198 @@ func (conf *configuration) initUpstreams(
 	return nil
 }
 
+// newClientPolicies returns the client policies from the client upstreams.  The
+// upstreams with the same list of networks make up a single policy named after
+// it.  The list of networks may be empty for the policies only applied to the
+// authenticated clients, see [configuration.ClientAuth].
+func (conf *configuration) newClientPolicies(
+	opts *upstream.Options,
+) (policies []*proxy.ClientPolicy, err error) {
+	var nets []string
+	lines := map[string][]string{}
+	for i, s := range conf.ClientUpstreams {
+		netsStr, ups, ok := strings.Cut(strings.TrimPrefix(s, "["), "]")
+		if !ok || !strings.HasPrefix(s, "[") || ups == "" {
+			return nil, fmt.Errorf("at index %d: bad format %q, want [subnet,...]upstream", i, s)
+		}
+
+		if _, ok = lines[netsStr]; !ok {
+			nets = append(nets, netsStr)
+		}
+
+		lines[netsStr] = append(lines[netsStr], ups)
+	}
+
+	for _, netsStr := range nets {
+		pol := &proxy.ClientPolicy{
+			Name: netsStr,
+		}
+
+		for _, n := range strings.Split(netsStr, ",") {
+			if netsStr == "" {
+				break
+			}
+
+			var pref netip.Prefix
+			pref, err = netip.ParsePrefix(strings.TrimSpace(n))
+			if err != nil {
+				return nil, fmt.Errorf("networks %q: %w", netsStr, err)
+			}
+
+			pol.Networks = append(pol.Networks, pref)
+		}
+
+		pol.Upstreams, err = proxy.ParseUpstreamsConfig(lines[netsStr], opts)
+		if err != nil {
+			return nil, fmt.Errorf("networks %q: %w", netsStr, err)
+		}
+
+		policies = append(policies, pol)
+	}
+
+	err = conf.addClientAuth(policies)
+	if err != nil {
+		return nil, fmt.Errorf("client auth: %w", err)
+	}
+
+	err = conf.setClientAnswerOrders(policies)
+	if err != nil {
+		return nil, fmt.Errorf("client answer orders: %w", err)
+	}
+
+	return policies, nil
+}
+
+// addClientAuth adds the client identities of conf.ClientAuth in the
+// [subnet,...]cert:name and [subnet,...]token:value formats to the policies
+// named after the networks.
+func (conf *configuration) addClientAuth(policies []*proxy.ClientPolicy) (err error) {
+	for i, s := range conf.ClientAuth {
+		pol, ident, polErr := cutClientPolicy(policies, s)
+		if polErr != nil {
+			return fmt.Errorf("at index %d: %w", i, polErr)
+		}
+
+		kind, val, _ := strings.Cut(ident, ":")
+		switch {
+		case val == "":
+			return fmt.Errorf("at index %d: empty identity in %q", i, s)
+		case kind == "cert":
+			pol.CertNames = append(pol.CertNames, val)
+		case kind == "token":
+			pol.Tokens = append(pol.Tokens, val)
+		default:
+			return fmt.Errorf("at index %d: kind: %w: %q", i, errors.ErrBadEnumValue, kind)
+		}
+	}
+
+	return nil
+}
+
+// setClientAnswerOrders sets the answer orders of conf.ClientAnswerOrders in
+// the [subnet,...]order format to the policies named after the networks.
+func (conf *configuration) setClientAnswerOrders(policies []*proxy.ClientPolicy) (err error) {
+	for i, s := range conf.ClientAnswerOrders {
+		pol, ord, polErr := cutClientPolicy(policies, s)
+		if polErr != nil {
+			return fmt.Errorf("at index %d: %w", i, polErr)
+		}
+
+		err = pol.AnswerOrder.UnmarshalText([]byte(ord))
+		if err != nil {
+			return fmt.Errorf("at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// cutClientPolicy returns the policy from policies named after the networks in
+// square brackets at the beginning of s and the rest of s.
+func cutClientPolicy(
+	policies []*proxy.ClientPolicy,
+	s string,
+) (pol *proxy.ClientPolicy, rest string, err error) {
+	netsStr, rest, ok := strings.Cut(strings.TrimPrefix(s, "["), "]")
+	if !ok || !strings.HasPrefix(s, "[") {
+		return nil, "", fmt.Errorf("bad format %q, want [subnet,...] followed by value", s)
+	}
+
+	idx := slices.IndexFunc(policies, func(p *proxy.ClientPolicy) (found bool) {
+		return p.Name == netsStr
+	})
+	if idx < 0 {
+		return nil, "", fmt.Errorf("no client upstreams for networks %q", netsStr)
+	}
+
+	return policies[idx], rest, nil
+}
+
+// newBindAddr returns the local side of the connections to the upstreams.  It
+// returns nil if none of the corresponding options is set.
+func (conf *configuration) newBindAddr() (b *upstream.BindAddr, err error) {
+	if conf.UpstreamBindIPv4 == "" && conf.UpstreamBindIPv6 == "" && conf.UpstreamBindInterface == "" {
+		return nil, nil
+	}
+
+	b = &upstream.BindAddr{
+		Interface: conf.UpstreamBindInterface,
+	}
+
+	if conf.UpstreamBindIPv4 != "" {
+		b.IPv4, err = netip.ParseAddr(conf.UpstreamBindIPv4)
+		if err != nil {
+			return nil, fmt.Errorf("ipv4: %w", err)
+		} else if !b.IPv4.Is4() {
+			return nil, fmt.Errorf("ipv4: %s is not an ipv4 address", b.IPv4)
+		}
+	}
+
+	if conf.UpstreamBindIPv6 != "" {
+		b.IPv6, err = netip.ParseAddr(conf.UpstreamBindIPv6)
+		if err != nil {
+			return nil, fmt.Errorf("ipv6: %w", err)
+		} else if !b.IPv6.Is6() || b.IPv6.Is4In6() {
+			return nil, fmt.Errorf("ipv6: %s is not an ipv6 address", b.IPv6)
+		}
+	}
+
+	return b, nil
+}
+
+// newUpstreamProxyURL returns the URL of the proxy for the connections to the
+// upstreams.  It returns nil if the corresponding option isn't set.
+func (conf *configuration) newUpstreamProxyURL() (u *url.URL, err error) {
+	if conf.UpstreamProxy == "" {
+		return nil, nil
+	}
+
+	u, err = url.Parse(conf.UpstreamProxy)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	err = bootstrap.ValidateProxyURL(u)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return u, nil
+}
+
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
 // servers.  It returns the default resolver if no bootstraps were specified.
-// The returned resolver will also use system hosts files first.
+// The returned resolver will also use system hosts files first.  The results
+// of the specified bootstraps are cached in accordance with cacheConf, which
+// must not be nil.
 func initBootstrap(
 	ctx context.Context,
 	l *slog.Logger,
 	bootstraps []string,
 	opts *upstream.Options,
+	cacheConf *upstream.CachingResolverConfig,
 ) (r upstream.Resolver, err error) {
 	var resolvers []upstream.Resolver
 
@@ -225,7 +553,9 @@ func initBootstrap(
 			return nil, fmt.Errorf("creating bootstrap resolver at index %d: %w", i, err)
 		}
 
-		resolvers = append(resolvers, upstream.NewCachingResolver(ur))
+		c := *cacheConf
+		c.Resolver = ur
+		resolvers = append(resolvers, upstream.NewCachingResolverWithConfig(&c))
 	}
 
 	switch len(resolvers) {
@@ -269,6 +599,35 @@ func (conf *configuration) initEDNS(
 	return nil
 }
 
+// initEDNSOptions inits the codes of the forwarded EDNS(0) options of
+// [proxy.Config.EDNSCompliance], which must not be nil.
+func (conf *configuration) initEDNSOptions(config *proxy.Config) (err error) {
+	config.EDNSCompliance.AllowedOptions, err = parseEDNSOptionCodes(conf.EDNSAllowedOptions)
+	if err != nil {
+		return fmt.Errorf("parsing edns-allow-option: %w", err)
+	}
+
+	config.EDNSCompliance.DeniedOptions, err = parseEDNSOptionCodes(conf.EDNSDeniedOptions)
+	if err != nil {
+		return fmt.Errorf("parsing edns-deny-option: %w", err)
+	}
+
+	return nil
+}
+
+// parseEDNSOptionCodes converts the EDNS(0) option codes.
+func parseEDNSOptionCodes(codes []int) (res []uint16, err error) {
+	for _, c := range codes {
+		if c < 0 || c > math.MaxUint16 {
+			return nil, fmt.Errorf("option code %d: %w", c, errors.ErrOutOfRange)
+		}
+
+		res = append(res, uint16(c))
+	}
+
+	return res, nil
+}
+
 // initBogusNXDomain inits BogusNXDomain structure.
 func (conf *configuration) initBogusNXDomain(
 	ctx context.Context,
@@ -290,11 +649,580 @@ func (conf *configuration) initBogusNXDomain(
 	}
 }
 
-// initTLSConfig inits the TLS config.
-func (conf *configuration) initTLSConfig(config *proxy.Config) (err error) {
+// initCacheEvictionPolicy inits the cache eviction policy.
+func (conf *configuration) initCacheEvictionPolicy(config *proxy.Config) (err error) {
+	if conf.CacheEvictionPolicy == "" {
+		return nil
+	}
+
+	err = config.CacheEvictionPolicy.UnmarshalText([]byte(conf.CacheEvictionPolicy))
+	if err != nil {
+		return fmt.Errorf("parsing cache eviction policy: %w", err)
+	}
+
+	return nil
+}
+
+// initStartupProbe inits the configuration of probing the upstreams on
+// startup, if enabled.
+func (conf *configuration) initStartupProbe(config *proxy.Config) (err error) {
+	if conf.StartupProbe == "" {
+		return nil
+	}
+
+	probe := &proxy.StartupProbeConfig{
+		Domain: conf.StartupProbeDomain,
+	}
+
+	err = probe.Mode.UnmarshalText([]byte(conf.StartupProbe))
+	if err != nil {
+		return fmt.Errorf("parsing startup probe mode: %w", err)
+	}
+
+	config.StartupProbe = probe
+
+	return nil
+}
+
+// initUpstreamRetry inits the policy of retrying the exchanges with the
+// upstreams, if any of its options is set.
+func (conf *configuration) initUpstreamRetry(config *proxy.Config) (err error) {
+	if conf.UpstreamMaxRetries == 0 &&
+		conf.UpstreamTryTimeout == 0 &&
+		len(conf.UpstreamRetryRcodes) == 0 &&
+		!conf.UpstreamRetryOnTimeout &&
+		!conf.UpstreamRetryOnError &&
+		!conf.UpstreamRetrySwitch {
+		return nil
+	}
+
+	rcodes := make([]int, 0, len(conf.UpstreamRetryRcodes))
+	for i, s := range conf.UpstreamRetryRcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			return fmt.Errorf("upstream retry rcode at index %d: %w: %q", i, errors.ErrBadEnumValue, s)
+		}
+
+		rcodes = append(rcodes, rcode)
+	}
+
+	config.UpstreamRetry = &proxy.UpstreamRetryConfig{
+		Rcodes:         rcodes,
+		MaxRetries:     conf.UpstreamMaxRetries,
+		TryTimeout:     time.Duration(conf.UpstreamTryTimeout),
+		RetryOnTimeout: conf.UpstreamRetryOnTimeout,
+		RetryOnError:   conf.UpstreamRetryOnError,
+		SwitchUpstream: conf.UpstreamRetrySwitch,
+	}
+
+	return nil
+}
+
+// initUpstreamTimeouts inits the timeouts of the exchanges with the particular
+// upstreams and of the queries of the particular types, if any.
+func (conf *configuration) initUpstreamTimeouts(config *proxy.Config) (err error) {
+	if len(conf.UpstreamTimeouts) == 0 && len(conf.QTypeTimeouts) == 0 {
+		return nil
+	}
+
+	c := &proxy.UpstreamTimeoutConfig{
+		Upstreams: make(map[string]time.Duration, len(conf.UpstreamTimeouts)),
+		QTypes:    make(map[uint16]time.Duration, len(conf.QTypeTimeouts)),
+		Default:   time.Duration(conf.Timeout),
+	}
+
+	for i, s := range conf.UpstreamTimeouts {
+		var addr string
+		var timeout time.Duration
+		addr, timeout, err = parseUpstreamTimeout(s)
+		if err != nil {
+			return fmt.Errorf("upstream timeout at index %d: %w", i, err)
+		}
+
+		c.Upstreams[addr] = timeout
+	}
+
+	for i, s := range conf.QTypeTimeouts {
+		typStr, durStr, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("qtype timeout at index %d: bad format %q, want type=duration", i, s)
+		}
+
+		qtype, ok := dns.StringToType[strings.ToUpper(typStr)]
+		if !ok {
+			return fmt.Errorf("qtype timeout at index %d: %w: %q", i, errors.ErrBadEnumValue, typStr)
+		}
+
+		c.QTypes[qtype], err = time.ParseDuration(durStr)
+		if err != nil {
+			return fmt.Errorf("qtype timeout at index %d: %w", i, err)
+		}
+	}
+
+	config.UpstreamTimeouts = c
+
+	return nil
+}
+
+// parseUpstreamTimeout parses s in the "upstream=duration" format.  addr is the
+// address of the upstream as returned by its Address method, so that it matches
+// the one used by the proxy.
+func parseUpstreamTimeout(s string) (addr string, timeout time.Duration, err error) {
+	// The address may contain "=" within the query, but the duration may not.
+	i := strings.LastIndexByte(s, '=')
+	if i < 0 {
+		return "", 0, fmt.Errorf("bad format %q, want upstream=duration", s)
+	}
+
+	timeout, err = time.ParseDuration(s[i+1:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Creating an upstream doesn't connect to it, so it's cheap.
+	u, err := upstream.AddressToUpstream(s[:i], &upstream.Options{})
+	if err != nil {
+		return "", 0, err
+	}
+
+	addr = u.Address()
+
+	return addr, timeout, u.Close()
+}
+
+// longestTimeout returns the longest of timeout and the ones of c, so that the
+// upstreams don't time out before the deadlines set by the proxy.  If timeout
+// is zero, it's returned as is, since the upstreams aren't limited anyway.  c
+// may be nil.
+func longestTimeout(timeout time.Duration, c *proxy.UpstreamTimeoutConfig) (longest time.Duration) {
+	if timeout == 0 || c == nil {
+		return timeout
+	}
+
+	longest = timeout
+	for _, t := range c.Upstreams {
+		longest = max(longest, t)
+	}
+
+	for _, t := range c.QTypes {
+		longest = max(longest, t)
+	}
+
+	return longest
+}
+
+// initUpstreamRefusal inits the action on the refusals of the upstreams, if
+// set.
+func (conf *configuration) initUpstreamRefusal(config *proxy.Config) (err error) {
+	if conf.UpstreamRefusal == "" {
+		return nil
+	}
+
+	err = config.UpstreamRefusal.UnmarshalText([]byte(conf.UpstreamRefusal))
+	if err != nil {
+		return fmt.Errorf("parsing upstream refusal action: %w", err)
+	}
+
+	return nil
+}
+
+// initAnswerOrder inits the order of the address records in the responses, if
+// set.
+func (conf *configuration) initAnswerOrder(config *proxy.Config) (err error) {
+	if conf.AnswerOrder == "" {
+		return nil
+	}
+
+	err = config.AnswerOrder.UnmarshalText([]byte(conf.AnswerOrder))
+	if err != nil {
+		return fmt.Errorf("parsing answer order: %w", err)
+	}
+
+	return nil
+}
+
+// initCriticalNames inits the configuration of checking the answers for the
+// critical domain names, if any.
+func (conf *configuration) initCriticalNames(config *proxy.Config) (err error) {
+	if len(conf.CriticalNames) == 0 {
+		return nil
+	}
+
+	c := &proxy.CriticalNamesConfig{
+		Names: make([]*proxy.CriticalName, 0, len(conf.CriticalNames)),
+		Block: conf.CriticalNameBlock,
+	}
+
+	for i, s := range conf.CriticalNames {
+		domain, subnets, _ := strings.Cut(s, ",")
+		n := &proxy.CriticalName{
+			Domain:        domain,
+			RequireDNSSEC: conf.CriticalNameRequireDNSSEC,
+		}
+
+		for subnet := range strings.SplitSeq(subnets, ",") {
+			if subnet == "" {
+				continue
+			}
+
+			var p netip.Prefix
+			p, err = proxynetutil.ParseSubnet(subnet)
+			if err != nil {
+				return fmt.Errorf("parsing critical name at index %d: %w", i, err)
+			}
+
+			n.AllowedSubnets = append(n.AllowedSubnets, p)
+		}
+
+		c.Names = append(c.Names, n)
+	}
+
+	config.CriticalNames = c
+
+	return nil
+}
+
+// initRatelimit inits the ratelimit policy and whitelist.
+func (conf *configuration) initRatelimit(config *proxy.Config) (err error) {
+	if conf.RatelimitPolicy != "" {
+		err = config.RatelimitPolicy.UnmarshalText([]byte(conf.RatelimitPolicy))
+		if err != nil {
+			return fmt.Errorf("parsing ratelimit policy: %w", err)
+		}
+	}
+
+	for i, s := range conf.RatelimitWhitelist {
+		var p netip.Prefix
+		p, err = proxynetutil.ParseSubnet(s)
+		if err != nil {
+			return fmt.Errorf("parsing ratelimit whitelist at index %d: %w", i, err)
+		}
+
+		config.RatelimitWhitelistSubnets = append(config.RatelimitWhitelistSubnets, p)
+	}
+
+	return nil
+}
+
+// initANYQuery inits the handling of the requests of type ANY, if enabled.
+func (conf *configuration) initANYQuery(config *proxy.Config) (err error) {
+	if !conf.ANYHINFO {
+		return nil
+	}
+
+	c := &proxy.ANYQueryConfig{}
+	for i, s := range conf.ANYHINFOExempt {
+		var pref netip.Prefix
+		pref, err = netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("parsing any hinfo exempt subnet at index %d: %w", i, err)
+		}
+
+		c.ExemptSubnets = append(c.ExemptSubnets, pref)
+	}
+
+	config.ANYQuery = c
+
+	return nil
+}
+
+// initTruncation inits the truncation policy.
+func (conf *configuration) initTruncation(config *proxy.Config) (err error) {
+	if conf.MaxUDPSize > math.MaxUint16 {
+		return fmt.Errorf("max udp size: %d is greater than %d", conf.MaxUDPSize, math.MaxUint16)
+	}
+
+	if conf.ResponseUDPSize > math.MaxUint16 {
+		return fmt.Errorf(
+			"response udp size: %d is greater than %d",
+			conf.ResponseUDPSize,
+			math.MaxUint16,
+		)
+	}
+
+	config.Truncation = &proxy.TruncationConfig{
+		MaxUDPSize:      uint16(conf.MaxUDPSize),
+		ResponseUDPSize: uint16(conf.ResponseUDPSize),
+		TruncateANY:     conf.TruncateAny,
+	}
+
+	return nil
+}
+
+// initLogLevels inits the levels of the logs of the proxy subsystems.
+func (conf *configuration) initLogLevels(config *proxy.Config) (err error) {
+	if len(conf.LogSubsystemLevels) == 0 {
+		return nil
+	}
+
+	config.LogLevels = make(map[proxy.LogSubsystem]slog.Level, len(conf.LogSubsystemLevels))
+	for i, s := range conf.LogSubsystemLevels {
+		sub, lvl, parseErr := proxy.ParseLogSubsystemLevel(s)
+		if parseErr != nil {
+			return fmt.Errorf("log subsystem level at index %d: %w", i, parseErr)
+		}
+
+		config.LogLevels[sub] = lvl
+	}
+
+	return nil
+}
+
+// initClientStats inits the per-client statistics configuration, if enabled.
+func (conf *configuration) initClientStats(config *proxy.Config) {
+	if !conf.ClientStats {
+		return
+	}
+
+	config.ClientStats = &proxy.ClientStatisticsConfig{
+		FilePath:      conf.ClientStatsFilePath,
+		SubnetLenIPv4: conf.ClientStatsSubnetLenIPv4,
+		SubnetLenIPv6: conf.ClientStatsSubnetLenIPv6,
+	}
+}
+
+// initCacheOutage inits the configuration of the cache behavior during upstream
+// outages, if enabled.
+func (conf *configuration) initCacheOutage(config *proxy.Config) {
+	if conf.CacheOutageTTLMultiplier <= 1 {
+		return
+	}
+
+	config.CacheOutage = &proxy.CacheOutageConfig{
+		TTLMultiplier:    float64(conf.CacheOutageTTLMultiplier),
+		FailureThreshold: conf.CacheOutageThreshold,
+		Window:           time.Duration(conf.CacheOutageWindow),
+	}
+}
+
+// initMemoryPressure inits the configuration of the cache degradation under the
+// memory pressure, if enabled.
+func (conf *configuration) initMemoryPressure(config *proxy.Config) {
+	if !conf.CacheMemoryPressure && conf.CacheMemoryLimit == 0 {
+		return
+	}
+
+	config.MemoryPressure = &proxy.MemoryPressureConfig{
+		Limit: uint64(conf.CacheMemoryLimit),
+	}
+}
+
+// defaultNetworkChangeRefreshPause is the default period of time of postponing
+// the proactive cache refreshes after a network change.
+const defaultNetworkChangeRefreshPause = 10 * time.Second
+
+// initNetworkChange inits the configuration of handling the host network
+// changes, if enabled.
+func (conf *configuration) initNetworkChange(config *proxy.Config) {
+	if !conf.NetworkWatch {
+		return
+	}
+
+	pause := time.Duration(conf.NetworkChangeRefreshPause)
+	if pause == 0 {
+		pause = defaultNetworkChangeRefreshPause
+	}
+
+	config.NetworkChange = &proxy.NetworkChangeConfig{
+		RefreshPause:     pause,
+		FlushSubnetCache: conf.NetworkChangeFlushECS,
+	}
+}
+
+// defaultCacheReplicationInterval is the default interval of pushing the cache
+// snapshots to the replicas.
+const defaultCacheReplicationInterval = time.Minute
+
+// initCacheReplication inits the configuration of the cache replication, if
+// enabled.  It must be called after the upstreams are initialized.
+func (conf *configuration) initCacheReplication(config *proxy.Config) (err error) {
+	if conf.CacheReplicaListen != "" {
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(conf.CacheReplicaListen)
+		if err != nil {
+			return fmt.Errorf("parsing cache replica listen address: %w", err)
+		}
+
+		config.CacheReplica = &proxy.CacheReplicaConfig{
+			Token:      conf.CacheReplicationToken,
+			ListenAddr: addr,
+		}
+
+		// The upstreams aren't required in the replica mode.
+		if uc := config.UpstreamConfig; uc != nil && isEmpty(uc) {
+			config.UpstreamConfig = nil
+		}
+	}
+
+	if len(conf.CacheReplicateTo) == 0 {
+		return nil
+	}
+
+	c := &proxy.CacheReplicationConfig{
+		Token:    conf.CacheReplicationToken,
+		Interval: time.Duration(conf.CacheReplicationInterval),
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultCacheReplicationInterval
+	}
+
+	for i, s := range conf.CacheReplicateTo {
+		var u *url.URL
+		u, err = url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("parsing cache replica url at index %d: %w", i, err)
+		}
+
+		c.Replicas = append(c.Replicas, u)
+	}
+
+	config.CacheReplication = c
+
+	return nil
+}
+
+// initAnomalyCapture inits the configuration of capturing the anomalous
+// traffic, if enabled.
+func (conf *configuration) initAnomalyCapture(config *proxy.Config) {
+	if conf.AnomalyCaptureFile == "" {
+		return
+	}
+
+	config.AnomalyCapture = &proxy.AnomalyCaptureConfig{
+		FilePath:      conf.AnomalyCaptureFile,
+		MaxFileSize:   uint64(conf.AnomalyCaptureMaxSize),
+		MaxBackups:    conf.AnomalyCaptureMaxBackups,
+		SnapLen:       conf.AnomalyCaptureSnapLen,
+		RedactClients: conf.AnomalyCaptureRedactClients,
+	}
+}
+
+// Formats of the mirror file.
+const (
+	mirrorFormatPCAP   = "pcap"
+	mirrorFormatDnstap = "dnstap"
+)
+
+// openMirror opens the mirror file and returns the configuration of mirroring
+// the sampled queries into it, if enabled.  closeMirror finalizes and closes
+// the file, it's never nil if err is nil.
+func (conf *configuration) openMirror() (
+	mc *proxy.MirrorConfig,
+	closeMirror func() (err error),
+	err error,
+) {
+	if conf.MirrorFile == "" {
+		return nil, func() (err error) { return nil }, nil
+	}
+
+	format := conf.MirrorFormat
+	if format == "" {
+		format = mirrorFormatPCAP
+	} else if format != mirrorFormatPCAP && format != mirrorFormatDnstap {
+		return nil, nil, fmt.Errorf("mirror format: %w: %q", errors.ErrBadEnumValue, format)
+	}
+
+	// #nosec G302 G304 -- Trust the file path that is given in the
+	// configuration.
+	f, err := os.OpenFile(conf.MirrorFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening mirror file: %w", err)
+	}
+
+	var sink proxy.MirrorSink
+	closeMirror = f.Close
+	if format == mirrorFormatPCAP {
+		sink, err = proxy.NewPCAPMirrorSink(f)
+	} else {
+		var ds *proxy.DnstapMirrorSink
+		ds, err = proxy.NewDnstapMirrorSink(f, "", version.Version())
+		sink = ds
+		closeMirror = func() (err error) {
+			return errors.Join(ds.Close(), f.Close())
+		}
+	}
+
+	if err != nil {
+		return nil, nil, errors.WithDeferred(err, f.Close())
+	}
+
+	return &proxy.MirrorConfig{
+		Sink:  sink,
+		Zones: conf.MirrorZones,
+		Rate:  float64(conf.MirrorRate),
+	}, closeMirror, nil
+}
+
+// startIPSet starts the exporter of the resolved addresses into the firewall
+// sets and returns the handler of the responses to feed it, if enabled.  stop
+// shuts the exporter down, it's never nil if err is nil.  l must not be nil.
+func (conf *configuration) startIPSet(
+	ctx context.Context,
+	l *slog.Logger,
+) (rh proxy.ResponseHandler, stop func(ctx context.Context) (err error), err error) {
+	if len(conf.IPSet) == 0 {
+		return nil, func(_ context.Context) (err error) { return nil }, nil
+	}
+
+	e, err := ipset.New(&ipset.Config{
+		Logger:  l.With(slogutil.KeyPrefix, "ipset"),
+		Backend: ipset.Backend(conf.IPSetBackend),
+		Rules:   conf.IPSet,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating exporter: %w", err)
+	}
+
+	err = e.Start(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("starting exporter: %w", err)
+	}
+
+	rh = func(dctx *proxy.DNSContext, _ error) {
+		e.Export(dctx.Res)
+	}
+
+	return rh, e.Shutdown, nil
+}
+
+// startTracing starts the exporter of the spans of the queries, if configured,
+// and returns the provider of the tracer for the proxy and the function which
+// flushes the remaining spans and stops the exporter.
+func (conf *configuration) startTracing(
+	ctx context.Context,
+) (tp trace.TracerProvider, stop func(ctx context.Context) (err error), err error) {
+	if conf.OTLPTracesEndpoint == "" {
+		return nil, func(_ context.Context) (err error) { return nil }, nil
+	}
+
+	u, err := url.Parse(conf.OTLPTracesEndpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing endpoint: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, nil, fmt.Errorf("endpoint scheme: %w: %q", errors.ErrBadEnumValue, u.Scheme)
+	}
+
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating exporter: %w", err)
+	}
+
+	sdkTP := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "dnsproxy"),
+			attribute.String("service.version", version.Version()),
+		)),
+	)
+
+	return sdkTP, sdkTP.Shutdown, nil
+}
+
+// initTLSConfig inits the TLS config.  l must not be nil.
+func (conf *configuration) initTLSConfig(l *slog.Logger, config *proxy.Config) (err error) {
 	if conf.TLSCertPath != "" && conf.TLSKeyPath != "" {
 		var tlsConfig *tls.Config
-		tlsConfig, err = newTLSConfig(conf)
+		tlsConfig, err = newTLSConfig(l, conf, conf.TLSCertPath, conf.TLSKeyPath)
 		if err != nil {
 			return fmt.Errorf("loading TLS config: %w", err)
 		}
@@ -305,6 +1233,58 @@ func (conf *configuration) initTLSConfig(config *proxy.Config) (err error) {
 	return nil
 }
 
+// initListeners inits the listeners with their own settings.  l must not be
+// nil.
+func (conf *configuration) initListeners(l *slog.Logger, config *proxy.Config) (err error) {
+	for i, s := range conf.Listeners {
+		var lc *proxy.ListenerConfig
+		lc, err = conf.newListenerConfig(l, s)
+		if err != nil {
+			return fmt.Errorf("listener at index %d: %w", i, err)
+		}
+
+		config.Listeners = append(config.Listeners, lc)
+	}
+
+	return nil
+}
+
+// newListenerConfig parses the listener from s in the
+// proto://ip:port[?cert=path&key=path&client-policy=networks] format.  l must
+// not be nil.
+func (conf *configuration) newListenerConfig(
+	l *slog.Logger,
+	s string,
+) (lc *proxy.ListenerConfig, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	addr, err := netip.ParseAddrPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	q := u.Query()
+	lc = &proxy.ListenerConfig{
+		ClientPolicy: q.Get("client-policy"),
+		Addr:         addr,
+		Proto:        proxy.Proto(u.Scheme),
+	}
+
+	certPath, keyPath := q.Get("cert"), q.Get("key")
+	if certPath != "" || keyPath != "" {
+		lc.TLSConfig, err = newTLSConfig(l, conf, certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS config: %w", err)
+		}
+	}
+
+	return lc, nil
+}
+
 // initDNSCryptConfig inits the DNSCrypt config.
 func (conf *configuration) initDNSCryptConfig(config *proxy.Config) (err error) {
 	if conf.DNSCryptConfigPath == "" {
@@ -457,6 +1437,49 @@ func (conf *configuration) initSubnets(proxyConf *proxy.Config) (err error) {
 	return conf.initPrivateSubnets(proxyConf)
 }
 
+// initMDNS inits the multicast DNS configuration, if enabled.
+func (conf *configuration) initMDNS(proxyConf *proxy.Config) {
+	if !conf.MDNS {
+		return
+	}
+
+	proxyConf.MDNS = &proxy.MDNSConfig{
+		Timeout: time.Duration(conf.MDNSTimeout),
+	}
+}
+
+// initPrivateRDNS inits the local private reverse DNS configuration, if any of
+// the corresponding options is set.
+func (conf *configuration) initPrivateRDNS(proxyConf *proxy.Config) (err error) {
+	if len(conf.PrivateRDNSHosts) == 0 && conf.PrivateRDNSZone == "" {
+		return nil
+	}
+
+	c := &proxy.PrivateRDNSConfig{
+		Hosts: make(map[netip.Addr]string, len(conf.PrivateRDNSHosts)),
+		Zone:  conf.PrivateRDNSZone,
+	}
+
+	for i, s := range conf.PrivateRDNSHosts {
+		addrStr, host, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("private rdns host at index %d: bad format %q, want ip=host", i, s)
+		}
+
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(addrStr)
+		if err != nil {
+			return fmt.Errorf("private rdns host at index %d: %w", i, err)
+		}
+
+		c.Hosts[addr.Unmap()] = host
+	}
+
+	proxyConf.PrivateRDNS = c
+
+	return nil
+}
+
 // initSubnets sets the private subnets configuration into conf.
 func (conf *configuration) initPrivateSubnets(proxyConf *proxy.Config) (err error) {
 	private := make([]netip.Prefix, 0, len(conf.PrivateSubnets))
@@ -2,47 +2,235 @@ package cmd
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"log/slog"
 	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 )
 
-// NewTLSConfig returns the TLS config that includes a certificate.  Use it for
-// server TLS configuration or for a client certificate.  If caPath is empty,
-// system CAs will be used.
-func newTLSConfig(conf *configuration) (c *tls.Config, err error) {
+// NewTLSConfig returns the TLS config that includes the certificate from
+// certPath and keyPath.  Use it for server TLS configuration or for a client
+// certificate.  If caPath is empty, system CAs will be used.  The certificate
+// is reloaded once the files change, see [certReloader].  l must not be nil.
+func newTLSConfig(
+	l *slog.Logger,
+	conf *configuration,
+	certPath string,
+	keyPath string,
+) (c *tls.Config, err error) {
+	r, err := newCertReloader(l, certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS cert: %s", err)
+	}
+
+	minVer, maxVer := conf.tlsVersions()
+
+	// #nosec G402 -- TLS MinVersion is configured by user.
+	c = &tls.Config{
+		GetCertificate: r.getCertificate,
+		MinVersion:     minVer,
+		MaxVersion:     maxVer,
+	}
+
+	err = conf.setClientCAs(c)
+	if err != nil {
+		return nil, fmt.Errorf("loading client CAs: %w", err)
+	}
+
+	return c, nil
+}
+
+// setClientCAs makes c verify the client certificates, if presented, against
+// the CAs from conf.TLSClientCAPath, if set.  c must not be nil.
+func (conf *configuration) setClientCAs(c *tls.Config) (err error) {
+	if conf.TLSClientCAPath == "" {
+		return nil
+	}
+
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	pemData, err := os.ReadFile(conf.TLSClientCAPath)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return fmt.Errorf("no certificates in %q", conf.TLSClientCAPath)
+	}
+
+	c.ClientCAs = pool
+
+	// Don't require the certificates, since the DoH clients may authenticate
+	// with the tokens instead.
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return nil
+}
+
+// tlsVersions returns the minimum and the maximum allowed versions of TLS.
+func (conf *configuration) tlsVersions() (minVer, maxVer uint16) {
 	// Set default TLS min/max versions
-	tlsMinVersion := tls.VersionTLS10
-	tlsMaxVersion := tls.VersionTLS13
+	minVer = tls.VersionTLS10
+	maxVer = tls.VersionTLS13
 
 	switch conf.TLSMinVersion {
 	case 1.1:
-		tlsMinVersion = tls.VersionTLS11
+		minVer = tls.VersionTLS11
 	case 1.2:
-		tlsMinVersion = tls.VersionTLS12
+		minVer = tls.VersionTLS12
 	case 1.3:
-		tlsMinVersion = tls.VersionTLS13
+		minVer = tls.VersionTLS13
 	}
 
 	switch conf.TLSMaxVersion {
 	case 1.0:
-		tlsMaxVersion = tls.VersionTLS10
+		maxVer = tls.VersionTLS10
 	case 1.1:
-		tlsMaxVersion = tls.VersionTLS11
+		maxVer = tls.VersionTLS11
 	case 1.2:
-		tlsMaxVersion = tls.VersionTLS12
+		maxVer = tls.VersionTLS12
+	}
+
+	return minVer, maxVer
+}
+
+// certCheckInterval is the minimum interval between the checks of the
+// certificate files for changes.
+const certCheckInterval = 1 * time.Minute
+
+// certReloader provides the certificate from a pair of files and reloads it
+// once the files change, so that the renewed certificate is used without a
+// restart.  The files are checked during the TLS handshakes, at most once per
+// [certCheckInterval].
+type certReloader struct {
+	// logger is used to log the reloads.
+	logger *slog.Logger
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// cert is the last successfully loaded certificate.
+	cert *tls.Certificate
+
+	// certPath is the path to the file with the certificate chain.
+	certPath string
+
+	// keyPath is the path to the file with the private key.
+	keyPath string
+
+	// certMod is the modification time of the certificate file at the last
+	// load.
+	certMod time.Time
+
+	// keyMod is the modification time of the private key file at the last
+	// load.
+	keyMod time.Time
+
+	// lastCheck is the time of the last check of the files.
+	lastCheck time.Time
+}
+
+// newCertReloader returns a new properly initialized *certReloader with the
+// certificate loaded from certPath and keyPath.  l must not be nil.
+func newCertReloader(l *slog.Logger, certPath, keyPath string) (r *certReloader, err error) {
+	r = &certReloader{
+		logger:    l,
+		mu:        &sync.Mutex{},
+		certPath:  certPath,
+		keyPath:   keyPath,
+		lastCheck: time.Now(),
 	}
 
-	cert, err := loadX509KeyPair(conf.TLSCertPath, conf.TLSKeyPath)
+	certMod, keyMod, err := r.modTimes()
 	if err != nil {
-		return nil, fmt.Errorf("loading TLS cert: %s", err)
+		return nil, err
 	}
 
-	// #nosec G402 -- TLS MinVersion is configured by user.
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   uint16(tlsMinVersion),
-		MaxVersion:   uint16(tlsMaxVersion),
-	}, nil
+	err = r.load(certMod, keyMod)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// getCertificate implements the [tls.Config.GetCertificate] callback for
+// *certReloader.
+func (r *certReloader) getCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.lastCheck) >= certCheckInterval {
+		r.lastCheck = now
+		r.reloadIfChanged(hello)
+	}
+
+	return r.cert, nil
+}
+
+// reloadIfChanged reloads the certificate if any of the files has been
+// modified since the last load.  The errors are logged, since the previous
+// certificate is kept.  r.mu must be locked.
+func (r *certReloader) reloadIfChanged(hello *tls.ClientHelloInfo) {
+	ctx := hello.Context()
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		r.logger.ErrorContext(ctx, "checking tls certificate", slogutil.KeyError, err)
+
+		return
+	}
+
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return
+	}
+
+	err = r.load(certMod, keyMod)
+	if err != nil {
+		// The files may be in the middle of being replaced, so try again
+		// during the next check.
+		r.logger.ErrorContext(ctx, "reloading tls certificate", slogutil.KeyError, err)
+
+		return
+	}
+
+	r.logger.InfoContext(ctx, "reloaded tls certificate", "path", r.certPath)
+}
+
+// load loads the certificate and sets the modification times of the files.
+func (r *certReloader) load(certMod, keyMod time.Time) (err error) {
+	cert, err := loadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+
+	return nil
+}
+
+// modTimes returns the modification times of the certificate and the private
+// key files.
+func (r *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(r.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	certMod = fi.ModTime()
+
+	fi, err = os.Stat(r.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certMod, fi.ModTime(), nil
 }
 
 // loadX509KeyPair reads and parses a public/private key pair from a pair of
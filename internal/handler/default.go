@@ -53,11 +53,11 @@ func NewDefault(conf *DefaultConfig) (d *Default) {
 // HandleRequest resolves the DNS request within proxyCtx.  It only calls
 // [proxy.Proxy.Resolve] if the request isn't handled by any of the internal
 // handlers.
-func (h *Default) HandleRequest(p *proxy.Proxy, proxyCtx *proxy.DNSContext) (err error) {
-	// TODO(e.burkov):  Use the [*context.Context] instead of
-	// [*proxy.DNSContext] when the interface-based handler is implemented.
-	ctx := context.TODO()
-
+func (h *Default) HandleRequest(
+	ctx context.Context,
+	p *proxy.Proxy,
+	proxyCtx *proxy.DNSContext,
+) (err error) {
 	h.logger.DebugContext(ctx, "handling request", "req", &proxyCtx.Req.Question[0])
 
 	if proxyCtx.Res = h.haltAAAA(ctx, proxyCtx.Req); proxyCtx.Res != nil {
@@ -68,5 +68,5 @@ func (h *Default) HandleRequest(p *proxy.Proxy, proxyCtx *proxy.DNSContext) (err
 		return nil
 	}
 
-	return p.Resolve(proxyCtx)
+	return p.Resolve(ctx, proxyCtx)
 }
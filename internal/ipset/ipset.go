@@ -0,0 +1,416 @@
+// Package ipset adds the addresses resolved for the configured domain names into
+// the firewall sets of the host, e.g. to route the traffic of particular
+// services differently.
+package ipset
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/service"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+// Backend is the kind of the firewall sets the addresses are added into.
+type Backend string
+
+// Valid [Backend] values.
+const (
+	// BackendIPSet adds the addresses into the sets managed with the ipset
+	// utility.  The sets must be created with the timeout support.
+	BackendIPSet Backend = "ipset"
+
+	// BackendNFTables adds the addresses into the nftables sets.  The sets are
+	// referred to as "family#table#set", e.g. "inet#fw4#vpn4", and must have
+	// the timeout flag.
+	BackendNFTables Backend = "nftables"
+)
+
+const (
+	// queueSize is the number of the batches of entries waiting to be added.
+	queueSize = 256
+
+	// knownCacheSize is the maximum number of the remembered entries, which
+	// aren't added again until they expire.
+	knownCacheSize = 10_000
+
+	// addTimeout is the timeout for adding a batch of entries.
+	addTimeout = 5 * time.Second
+)
+
+// Config is the configuration of an [Exporter].
+type Config struct {
+	// Logger is used to log the failures.  It must not be nil.
+	Logger *slog.Logger
+
+	// Backend is the kind of the sets.  If empty, [BackendIPSet] is used.
+	Backend Backend
+
+	// Rules are the rules in the "DOMAIN[,DOMAIN].../SET[,SET]..." format.
+	// The addresses resolved for each of the domains or their subdomains are
+	// added into each of the sets of the corresponding family.  The most
+	// specific domain takes precedence.
+	Rules []string
+}
+
+// family is the address family of a set.
+type family uint8
+
+// Valid family values.
+const (
+	familyIPv4 family = iota + 1
+	familyIPv6
+)
+
+// String implements the [fmt.Stringer] interface for family.
+func (f family) String() (s string) {
+	switch f {
+	case familyIPv4:
+		return "ipv4"
+	case familyIPv6:
+		return "ipv6"
+	default:
+		return fmt.Sprintf("!bad_family_%d", f)
+	}
+}
+
+// entry is a single address to add into a set.
+type entry struct {
+	// set is the name of the set as configured.
+	set string
+
+	// addr is the address to add.
+	addr netip.Addr
+
+	// ttl is the timeout of the address within the set.  It's at least a
+	// second, since zero means no timeout for the sets.
+	ttl time.Duration
+}
+
+// entryKey is the key of an entry in the cache of the known ones.
+type entryKey struct {
+	set  string
+	addr netip.Addr
+}
+
+// backend adds the entries into the sets.
+type backend interface {
+	// family returns the address family of the set.
+	family(ctx context.Context, set string) (f family, err error)
+
+	// add adds entries into their sets, refreshing the timeouts of the
+	// existing ones.
+	add(ctx context.Context, entries []*entry) (err error)
+}
+
+// set is a configured set with its address family.
+type set struct {
+	name   string
+	family family
+}
+
+// Exporter adds the addresses from the responses into the sets.  The addresses
+// are added asynchronously, so that the responses aren't delayed.
+type Exporter struct {
+	logger  *slog.Logger
+	backend backend
+
+	// now returns the current time, it's [time.Now] unless replaced in tests.
+	now func() (t time.Time)
+
+	// domains maps the lowercased domain names without the trailing dot to
+	// the names of their sets.
+	domains map[string][]string
+
+	// sets maps the names of the sets to the sets with the known families.
+	// It's filled on start.
+	sets map[string]*set
+
+	// known contains the expiration times of the entries by [entryKey], so
+	// that the repeated responses don't cause adding them again.
+	known gcache.Cache
+
+	// queue contains the batches of entries to add.
+	queue chan []*entry
+
+	// done is closed when the exporter is shut down.
+	done chan struct{}
+
+	// wg waits for the adding goroutine.
+	wg *sync.WaitGroup
+}
+
+// New returns a new *Exporter.  c must not be nil.  It returns
+// [errors.ErrUnsupported] if the sets aren't supported on this platform.
+func New(c *Config) (e *Exporter, err error) {
+	domains, err := parseRules(c.Rules)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	b, err := newBackend(c.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", c.Backend, err)
+	}
+
+	return &Exporter{
+		logger:  c.Logger,
+		backend: b,
+		now:     time.Now,
+		domains: domains,
+		known:   gcache.New(knownCacheSize).LRU().Build(),
+		queue:   make(chan []*entry, queueSize),
+		done:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+	}, nil
+}
+
+// parseRules parses rules into the map of domain names to the names of their
+// sets.
+func parseRules(rules []string) (domains map[string][]string, err error) {
+	domains = map[string][]string{}
+
+	var errs []error
+	for i, r := range rules {
+		err = parseRule(domains, r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule at index %d: %w", i, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return domains, nil
+}
+
+// parseRule parses r and adds its domain names into domains.
+func parseRule(domains map[string][]string, r string) (err error) {
+	domainsStr, setsStr, ok := strings.Cut(r, "/")
+	if !ok {
+		return fmt.Errorf("bad format %q: no sets", r)
+	}
+
+	var sets []string
+	for s := range strings.SplitSeq(setsStr, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return fmt.Errorf("bad format %q: empty set name", r)
+		}
+
+		sets = append(sets, s)
+	}
+
+	for d := range strings.SplitSeq(domainsStr, ",") {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		if d == "" {
+			return fmt.Errorf("bad format %q: empty domain", r)
+		}
+
+		domains[d] = append(domains[d], sets...)
+	}
+
+	return nil
+}
+
+// type check
+var _ service.Interface = (*Exporter)(nil)
+
+// Start implements the [service.Interface] for *Exporter.  It returns an error
+// if the family of any of the sets can't be determined, e.g. since it doesn't
+// exist.
+func (e *Exporter) Start(ctx context.Context) (err error) {
+	e.sets = map[string]*set{}
+
+	var errs []error
+	for _, names := range e.domains {
+		for _, name := range names {
+			if _, ok := e.sets[name]; ok {
+				continue
+			}
+
+			var f family
+			f, err = e.backend.family(ctx, name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("set %q: %w", name, err))
+			}
+
+			e.sets[name] = &set{name: name, family: f}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	e.wg.Go(e.addLoop)
+
+	return nil
+}
+
+// Shutdown implements the [service.Interface] for *Exporter.  The entries not
+// added yet are dropped.
+func (e *Exporter) Shutdown(_ context.Context) (err error) {
+	close(e.done)
+	e.wg.Wait()
+
+	return nil
+}
+
+// Export schedules adding the addresses from the answer of resp into the sets
+// configured for the requested domain name.  resp may be nil.  It's safe for
+// concurrent use.
+func (e *Exporter) Export(resp *dns.Msg) {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Question) == 0 {
+		return
+	}
+
+	names := e.match(resp.Question[0].Name)
+	if len(names) == 0 {
+		return
+	}
+
+	entries := e.newEntries(names, resp.Answer)
+	if len(entries) == 0 {
+		return
+	}
+
+	select {
+	case e.queue <- entries:
+	default:
+		e.logger.Debug("dropping entries; queue is full", "num", len(entries))
+		e.forget(entries)
+	}
+}
+
+// match returns the names of the sets for the most specific configured domain
+// name containing name.
+func (e *Exporter) match(name string) (sets []string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		if sets, ok := e.domains[name]; ok {
+			return sets
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return nil
+		}
+
+		name = name[i+1:]
+	}
+}
+
+// newEntries returns the entries for the addresses from answer to add into the
+// sets of the corresponding family.  The entries already added with the same
+// or a later expiration time are skipped.
+func (e *Exporter) newEntries(names []string, answer []dns.RR) (entries []*entry) {
+	now := e.now()
+	for _, rr := range answer {
+		addr := proxyutil.IPFromRR(rr).Unmap()
+		if !addr.IsValid() {
+			continue
+		}
+
+		f := familyIPv4
+		if addr.Is6() {
+			f = familyIPv6
+		}
+
+		ttl := time.Duration(max(rr.Header().Ttl, 1)) * time.Second
+		for _, name := range names {
+			if e.sets[name].family != f {
+				continue
+			}
+
+			ent := &entry{set: name, addr: addr, ttl: ttl}
+			if e.remember(ent, now) {
+				entries = append(entries, ent)
+			}
+		}
+	}
+
+	return entries
+}
+
+// remember returns true if ent should be added, i.e. it's not known to be
+// within the set for at least as long as its TTL, and stores its expiration
+// time.
+func (e *Exporter) remember(ent *entry, now time.Time) (ok bool) {
+	key := entryKey{set: ent.set, addr: ent.addr}
+	expires := now.Add(ent.ttl)
+
+	v, err := e.known.Get(key)
+	if err == nil && !v.(time.Time).Before(expires) {
+		return false
+	}
+
+	// Don't check the error, since the cache has no loader.
+	_ = e.known.SetWithExpire(key, expires, ent.ttl)
+
+	return true
+}
+
+// forget removes entries from the known ones, so that they're added on the
+// next response.
+func (e *Exporter) forget(entries []*entry) {
+	for _, ent := range entries {
+		e.known.Remove(entryKey{set: ent.set, addr: ent.addr})
+	}
+}
+
+// addLoop adds the scheduled entries until the exporter is shut down.  The
+// batches scheduled in the meantime are added together.
+func (e *Exporter) addLoop() {
+	ctx := context.Background()
+	defer slogutil.RecoverAndLog(ctx, e.logger)
+
+	for {
+		var entries []*entry
+		select {
+		case <-e.done:
+			return
+		case entries = <-e.queue:
+			// Go on.
+		}
+
+		entries = e.drainQueue(entries)
+
+		e.add(ctx, entries)
+	}
+}
+
+// drainQueue appends the batches currently in the queue to entries.
+func (e *Exporter) drainQueue(entries []*entry) (all []*entry) {
+	for {
+		select {
+		case more := <-e.queue:
+			entries = append(entries, more...)
+		default:
+			return entries
+		}
+	}
+}
+
+// add adds entries into their sets and logs the failure, if any.
+func (e *Exporter) add(ctx context.Context, entries []*entry) {
+	ctx, cancel := context.WithTimeout(ctx, addTimeout)
+	defer cancel()
+
+	err := e.backend.add(ctx, entries)
+	if err != nil {
+		e.logger.ErrorContext(ctx, "adding to sets", "num", len(entries), slogutil.KeyError, err)
+		e.forget(entries)
+	}
+}
@@ -0,0 +1,167 @@
+package ipset
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// testBackend is the [backend] for tests.
+type testBackend struct {
+	onFamily func(ctx context.Context, set string) (f family, err error)
+	onAdd    func(ctx context.Context, entries []*entry) (err error)
+}
+
+// type check
+var _ backend = (*testBackend)(nil)
+
+// family implements the [backend] interface for *testBackend.
+func (b *testBackend) family(ctx context.Context, set string) (f family, err error) {
+	return b.onFamily(ctx, set)
+}
+
+// add implements the [backend] interface for *testBackend.
+func (b *testBackend) add(ctx context.Context, entries []*entry) (err error) {
+	return b.onAdd(ctx, entries)
+}
+
+func TestParseRules(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		want       map[string][]string
+		name       string
+		wantErrMsg string
+		rules      []string
+	}{{
+		want: map[string][]string{
+			"example.org": {"vpn4", "vpn6"},
+			"example.com": {"vpn4", "vpn6", "other"},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+		rules:      []string{"Example.org.,example.com/vpn4,vpn6", "example.com/other"},
+	}, {
+		want:       nil,
+		name:       "no_sets",
+		wantErrMsg: `rule at index 0: bad format "example.org": no sets`,
+		rules:      []string{"example.org"},
+	}, {
+		want:       nil,
+		name:       "empty_set",
+		wantErrMsg: `rule at index 0: bad format "example.org/vpn4,": empty set name`,
+		rules:      []string{"example.org/vpn4,"},
+	}, {
+		want:       nil,
+		name:       "empty_domain",
+		wantErrMsg: `rule at index 0: bad format ",example.org/vpn4": empty domain`,
+		rules:      []string{",example.org/vpn4"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			domains, err := parseRules(tc.rules)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, domains)
+		})
+	}
+}
+
+func TestExporter(t *testing.T) {
+	domains, err := parseRules([]string{
+		"example.org/vpn4,vpn6",
+		"direct.example.org/direct4",
+	})
+	require.NoError(t, err)
+
+	added := make(chan []*entry, 10)
+	now := time.Now()
+	e := &Exporter{
+		logger: slogutil.NewDiscardLogger(),
+		backend: &testBackend{
+			onFamily: func(_ context.Context, set string) (f family, err error) {
+				if set == "vpn6" {
+					return familyIPv6, nil
+				}
+
+				return familyIPv4, nil
+			},
+			onAdd: func(_ context.Context, entries []*entry) (err error) {
+				added <- entries
+
+				return nil
+			},
+		},
+		now:     func() (t time.Time) { return now },
+		domains: domains,
+		known:   gcache.New(knownCacheSize).LRU().Build(),
+		queue:   make(chan []*entry, queueSize),
+		done:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+	}
+
+	require.NoError(t, e.Start(testutil.ContextWithTimeout(t, testTimeout)))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return e.Shutdown(context.Background())
+	})
+
+	newResp := func(name string, ttl uint32) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+		resp.Response = true
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+
+		a, aaaa := hdr, hdr
+		a.Rrtype, aaaa.Rrtype = dns.TypeA, dns.TypeAAAA
+		resp.Answer = []dns.RR{
+			&dns.A{Hdr: a, A: net.IP{192, 0, 2, 1}},
+			&dns.AAAA{Hdr: aaaa, AAAA: net.ParseIP("2001:db8::1")},
+		}
+
+		return resp
+	}
+
+	ip4 := netip.MustParseAddr("192.0.2.1")
+	ip6 := netip.MustParseAddr("2001:db8::1")
+
+	e.Export(newResp("www.Example.org.", 60))
+	entries, _ := testutil.RequireReceive(t, added, testTimeout)
+	assert.Equal(t, []*entry{
+		{set: "vpn4", addr: ip4, ttl: time.Minute},
+		{set: "vpn6", addr: ip6, ttl: time.Minute},
+	}, entries)
+
+	// The entries which are already added for longer aren't added again, and
+	// the most specific domain takes precedence.
+	e.Export(newResp("example.org.", 30))
+	e.Export(newResp("direct.example.org.", 0))
+	e.Export(nil)
+
+	entries, _ = testutil.RequireReceive(t, added, testTimeout)
+	assert.Equal(t, []*entry{{set: "direct4", addr: ip4, ttl: time.Second}}, entries)
+
+	e.Export(newResp("other.example.", 60))
+	e.Export(newResp("example.org.", 120))
+
+	entries, _ = testutil.RequireReceive(t, added, testTimeout)
+	assert.Equal(t, []*entry{
+		{set: "vpn4", addr: ip4, ttl: 2 * time.Minute},
+		{set: "vpn6", addr: ip6, ttl: 2 * time.Minute},
+	}, entries)
+
+	assert.Empty(t, added)
+}
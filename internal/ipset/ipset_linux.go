@@ -0,0 +1,175 @@
+//go:build linux
+
+package ipset
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// newBackend returns the backend of kind b.
+//
+// TODO(e.burkov):  Use the netlink sockets directly instead of running the
+// utilities.
+func newBackend(b Backend) (be backend, err error) {
+	switch b {
+	case "", BackendIPSet:
+		return ipsetBackend{}, nil
+	case BackendNFTables:
+		return nftBackend{}, nil
+	default:
+		return nil, errors.ErrBadEnumValue
+	}
+}
+
+// runCommand runs the command with stdin and returns its output.  The output
+// is included into the error, if any.
+func runCommand(ctx context.Context, stdin, name string, args ...string) (out []byte, err error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w: %s", name, err, bytes.TrimSpace(out))
+	}
+
+	return out, nil
+}
+
+// ipsetBackend is the backend running the ipset utility.
+type ipsetBackend struct{}
+
+// type check
+var _ backend = ipsetBackend{}
+
+// family implements the [backend] interface for ipsetBackend.
+func (ipsetBackend) family(ctx context.Context, set string) (f family, err error) {
+	out, err := runCommand(ctx, "", "ipset", "list", "-t", set)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	return ipsetFamily(out)
+}
+
+// ipsetFamily returns the family from the header of a set listed by the ipset
+// utility, e.g. "Header: family inet hashsize 1024 maxelem 65536 timeout 300".
+func ipsetFamily(out []byte) (f family, err error) {
+	for line := range strings.Lines(string(out)) {
+		header, ok := strings.CutPrefix(line, "Header:")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(header)
+		for i, field := range fields {
+			if field != "family" || i+1 == len(fields) {
+				continue
+			}
+
+			switch fields[i+1] {
+			case "inet":
+				return familyIPv4, nil
+			case "inet6":
+				return familyIPv6, nil
+			default:
+				return 0, fmt.Errorf("family %q: %w", fields[i+1], errors.ErrBadEnumValue)
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("family: %w", errors.ErrNoValue)
+}
+
+// add implements the [backend] interface for ipsetBackend.
+func (ipsetBackend) add(ctx context.Context, entries []*entry) (err error) {
+	b := &strings.Builder{}
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(b, "add %s %s timeout %d\n", e.set, e.addr, int(e.ttl.Seconds()))
+	}
+
+	_, err = runCommand(ctx, b.String(), "ipset", "restore", "-exist")
+
+	return err
+}
+
+// nftBackend is the backend running the nft utility.
+type nftBackend struct{}
+
+// type check
+var _ backend = nftBackend{}
+
+// nftSetRef returns the space-separated family, table, and name of the set
+// referred to as "family#table#set".
+func nftSetRef(set string) (ref string, err error) {
+	parts := strings.Split(set, "#")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", fmt.Errorf("bad format %q: want family#table#set", set)
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// family implements the [backend] interface for nftBackend.
+func (nftBackend) family(ctx context.Context, set string) (f family, err error) {
+	ref, err := nftSetRef(set)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	out, err := runCommand(ctx, "", "nft", append([]string{"list", "set"}, strings.Fields(ref)...)...)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	return nftFamily(out)
+}
+
+// nftFamily returns the family from the type of a set listed by the nft
+// utility, e.g. "type ipv4_addr".
+func nftFamily(out []byte) (f family, err error) {
+	for line := range strings.Lines(string(out)) {
+		typ, ok := strings.CutPrefix(strings.TrimSpace(line), "type ")
+		if !ok {
+			continue
+		}
+
+		switch typ = strings.TrimSpace(typ); typ {
+		case "ipv4_addr":
+			return familyIPv4, nil
+		case "ipv6_addr":
+			return familyIPv6, nil
+		default:
+			return 0, fmt.Errorf("type %q: %w", typ, errors.ErrBadEnumValue)
+		}
+	}
+
+	return 0, fmt.Errorf("type: %w", errors.ErrNoValue)
+}
+
+// add implements the [backend] interface for nftBackend.
+//
+// TODO(e.burkov):  Refresh the timeouts of the existing elements, which the
+// add command keeps as is.
+func (nftBackend) add(ctx context.Context, entries []*entry) (err error) {
+	b := &strings.Builder{}
+	for _, e := range entries {
+		// The reference of the set has been validated on start.
+		ref, _ := nftSetRef(e.set)
+		_, _ = fmt.Fprintf(b, "add element %s { %s timeout %ds }\n", ref, e.addr, int(e.ttl.Seconds()))
+	}
+
+	_, err = runCommand(ctx, b.String(), "nft", "-f", "-")
+
+	return err
+}
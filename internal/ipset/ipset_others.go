@@ -0,0 +1,11 @@
+//go:build !linux
+
+package ipset
+
+import "github.com/AdguardTeam/golibs/errors"
+
+// newBackend returns [errors.ErrUnsupported], since the firewall sets are only
+// supported on Linux.
+func newBackend(_ Backend) (be backend, err error) {
+	return nil, errors.ErrUnsupported
+}
@@ -11,6 +11,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// ReusePortSupported is true if the sockets created with [ListenConfig] may
+// share the same address.
+const ReusePortSupported = true
+
 // defaultListenControl is used as a [net.ListenConfig.Control] function to set
 // the SO_REUSEADDR and SO_REUSEPORT socket options on all sockets used by the
 // DNS servers in this module.
@@ -4,6 +4,10 @@ package netutil
 
 import "syscall"
 
+// ReusePortSupported is true if the sockets created with [ListenConfig] may
+// share the same address.
+const ReusePortSupported = false
+
 // defaultListenControl is nil on Windows, because it doesn't support
 // SO_REUSEPORT.
 func (listenControl) defaultListenControl(_, _ string, _ syscall.RawConn) (err error) {
@@ -0,0 +1,203 @@
+// Package netwatch detects the changes of the host network, such as network
+// interfaces going up or down, their addresses changing, or the default route
+// changing.
+package netwatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/service"
+)
+
+// Config is the configuration of a [Watcher].
+type Config struct {
+	// Logger is used to log the detected changes.  It must not be nil.
+	Logger *slog.Logger
+
+	// OnChange is called in a separate goroutine once the network has changed
+	// and settled.  The calls never overlap.  It must not be nil.
+	OnChange func(ctx context.Context)
+
+	// PollInterval is the interval of checking the state of the network.  The
+	// state is also checked on the notifications from the OS, where they're
+	// supported, i.e. the netlink route messages on Linux.  It must be
+	// positive.
+	PollInterval time.Duration
+
+	// SettleDelay is the period of time the state of the network should stay
+	// the same for OnChange to be called, so that a burst of changes, e.g. an
+	// interface going down and then up again, is handled once.
+	SettleDelay time.Duration
+}
+
+// Watcher watches the state of the host network and reports its changes.
+type Watcher struct {
+	logger   *slog.Logger
+	onChange func(ctx context.Context)
+
+	// state returns the textual representation of the current state of the
+	// network.
+	state func() (s string, err error)
+
+	// subscribe returns the channel receiving the notifications about the
+	// network changes from the OS and the closer stopping them.
+	subscribe func() (events <-chan struct{}, c io.Closer, err error)
+
+	// done is closed when the watcher is shut down.
+	done chan struct{}
+
+	// events stops the notifications from the OS, if any.
+	events io.Closer
+
+	// wg waits for the watching goroutine.
+	wg *sync.WaitGroup
+
+	pollInterval time.Duration
+	settleDelay  time.Duration
+}
+
+// New returns a new properly initialized *Watcher.  c must not be nil and must
+// be valid.
+func New(c *Config) (w *Watcher) {
+	return &Watcher{
+		logger:       c.Logger,
+		onChange:     c.OnChange,
+		state:        networkState,
+		subscribe:    subscribe,
+		done:         make(chan struct{}),
+		wg:           &sync.WaitGroup{},
+		pollInterval: c.PollInterval,
+		settleDelay:  c.SettleDelay,
+	}
+}
+
+// type check
+var _ service.Interface = (*Watcher)(nil)
+
+// Start implements the [service.Interface] for *Watcher.  The notifications
+// from the OS are optional, so failing to subscribe to them is only logged.
+func (w *Watcher) Start(ctx context.Context) (err error) {
+	state, err := w.state()
+	if err != nil {
+		return fmt.Errorf("getting network state: %w", err)
+	}
+
+	events, closer, err := w.subscribe()
+	if err != nil {
+		w.logger.DebugContext(
+			ctx,
+			"subscribing to network notifications; polling only",
+			slogutil.KeyError, err,
+		)
+	}
+
+	w.events = closer
+	w.wg.Go(func() { w.watch(events, state) })
+
+	return nil
+}
+
+// Shutdown implements the [service.Interface] for *Watcher.
+func (w *Watcher) Shutdown(_ context.Context) (err error) {
+	close(w.done)
+
+	if w.events != nil {
+		err = w.events.Close()
+	}
+
+	w.wg.Wait()
+
+	if err != nil {
+		return fmt.Errorf("closing network notifications: %w", err)
+	}
+
+	return nil
+}
+
+// watch checks the state of the network on each of events and periodically,
+// and calls the handler once the changed state settles.  reported is the
+// initial state of the network.
+func (w *Watcher) watch(events <-chan struct{}, reported string) {
+	// TODO(e.burkov):  Use the context passed to [Watcher.Start] with its
+	// deadline removed.
+	ctx := context.Background()
+	defer slogutil.RecoverAndLog(ctx, w.logger)
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	last := reported
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case _, ok := <-events:
+			if !ok {
+				// The notifications have stopped, so keep polling.
+				events = nil
+			}
+		case <-ticker.C:
+			// Go on.
+		case <-settled:
+			settled = nil
+			if last != reported {
+				reported = last
+				w.logger.InfoContext(ctx, "network changed")
+				w.onChange(ctx)
+			}
+
+			continue
+		}
+
+		state, err := w.state()
+		if err != nil {
+			w.logger.DebugContext(ctx, "getting network state", slogutil.KeyError, err)
+		} else if state != last {
+			last = state
+			settled = time.After(w.settleDelay)
+		}
+	}
+}
+
+// networkState returns the textual representation of the current state of the
+// host network: the network interfaces being up with their addresses and the
+// default routes, where supported.
+func networkState() (s string, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("getting interfaces: %w", err)
+	}
+
+	b := &strings.Builder{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		var addrs []net.Addr
+		addrs, err = iface.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("getting addresses of %q: %w", iface.Name, err)
+		}
+
+		_, _ = fmt.Fprintf(b, "%s %v\n", iface.Name, addrs)
+	}
+
+	routes, err := defaultRoutes()
+	if err != nil {
+		return "", fmt.Errorf("getting default routes: %w", err)
+	}
+
+	b.WriteString(routes)
+
+	return b.String(), nil
+}
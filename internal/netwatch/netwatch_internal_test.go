@@ -0,0 +1,132 @@
+package netwatch
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// testSettleDelay is the settle delay for tests.
+const testSettleDelay = 50 * time.Millisecond
+
+// newTestWatcher returns a started watcher with the state and the OS
+// notifications replaced with the returned ones.  Each call of the handler is
+// sent to the returned channel.
+func newTestWatcher(t *testing.T) (setState func(s string), changes <-chan struct{}) {
+	t.Helper()
+
+	changesCh := make(chan struct{}, 10)
+	w := New(&Config{
+		Logger: slogutil.NewDiscardLogger(),
+		OnChange: func(_ context.Context) {
+			changesCh <- struct{}{}
+		},
+		PollInterval: time.Hour,
+		SettleDelay:  testSettleDelay,
+	})
+
+	var mu sync.Mutex
+	state := "initial"
+	w.state = func() (s string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return state, nil
+	}
+
+	events := make(chan struct{}, 10)
+	w.subscribe = func() (e <-chan struct{}, c io.Closer, err error) {
+		return events, nil, nil
+	}
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	require.NoError(t, w.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		return w.Shutdown(context.Background())
+	})
+
+	setState = func(s string) {
+		mu.Lock()
+		state = s
+		mu.Unlock()
+
+		events <- struct{}{}
+	}
+
+	return setState, changesCh
+}
+
+func TestWatcher(t *testing.T) {
+	t.Parallel()
+
+	t.Run("burst", func(t *testing.T) {
+		t.Parallel()
+
+		setState, changes := newTestWatcher(t)
+
+		setState("down")
+		setState("up")
+		setState("changed")
+
+		testutil.RequireReceive(t, changes, testTimeout)
+
+		time.Sleep(2 * testSettleDelay)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("flap", func(t *testing.T) {
+		t.Parallel()
+
+		setState, changes := newTestWatcher(t)
+
+		setState("down")
+		setState("initial")
+
+		time.Sleep(2 * testSettleDelay)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("no_change", func(t *testing.T) {
+		t.Parallel()
+
+		setState, changes := newTestWatcher(t)
+
+		setState("initial")
+
+		time.Sleep(2 * testSettleDelay)
+		assert.Empty(t, changes)
+	})
+}
+
+func TestNetworkState(t *testing.T) {
+	t.Parallel()
+
+	_, err := networkState()
+	require.NoError(t, err)
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	events, c, err := subscribe()
+	if err != nil {
+		t.Skipf("subscribing: %s", err)
+	}
+
+	require.NoError(t, c.Close())
+
+	_, ok := testutil.RequireReceive(t, events, testTimeout)
+	for ok {
+		_, ok = testutil.RequireReceive(t, events, testTimeout)
+	}
+}
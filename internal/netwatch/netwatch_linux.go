@@ -0,0 +1,136 @@
+//go:build linux
+
+package netwatch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkGroups are the netlink multicast groups notifying about the changes
+// of links, addresses, and routes.
+const netlinkGroups = unix.RTMGRP_LINK |
+	unix.RTMGRP_IPV4_IFADDR |
+	unix.RTMGRP_IPV6_IFADDR |
+	unix.RTMGRP_IPV4_ROUTE |
+	unix.RTMGRP_IPV6_ROUTE
+
+// subscribe opens a netlink socket receiving the route messages.  The contents
+// of the messages are ignored, since the state is checked after each of them
+// anyway.
+func subscribe() (events <-chan struct{}, c io.Closer, err error) {
+	fd, err := unix.Socket(
+		unix.AF_NETLINK,
+		unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK,
+		unix.NETLINK_ROUTE,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating netlink socket: %w", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: netlinkGroups,
+	})
+	if err != nil {
+		err = fmt.Errorf("binding netlink socket: %w", err)
+
+		return nil, nil, errors.WithDeferred(err, unix.Close(fd))
+	}
+
+	// Wrap the descriptor in a file to use the runtime poller, so that closing
+	// it unblocks the reading.
+	f := os.NewFile(uintptr(fd), "netlink")
+	ch := make(chan struct{}, 1)
+	go readNetlink(f, ch)
+
+	return ch, f, nil
+}
+
+// readNetlink reads the messages from f and sends a notification to ch for
+// each of them, unless one is already pending.  It closes ch once f is closed.
+func readNetlink(f *os.File, ch chan<- struct{}) {
+	defer close(ch)
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		_, err := f.Read(buf)
+		if err != nil && !errors.Is(err, unix.ENOBUFS) {
+			// Most probably, the file is closed.
+			return
+		}
+
+		// ENOBUFS means that some messages are lost, which is still a change.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// defaultRoutes returns the textual representation of the IPv4 and IPv6
+// default routes from the procfs.
+func defaultRoutes() (s string, err error) {
+	b := &strings.Builder{}
+
+	// The columns are: Iface, Destination, Gateway, Flags, RefCnt, Use,
+	// Metric, Mask, and so on.
+	err = readRoutes(b, "/proc/net/route", func(fields []string) (ok bool) {
+		return len(fields) > 7 && fields[1] == "00000000" && fields[7] == "00000000"
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The columns are: destination, its prefix length, source, its prefix
+	// length, next hop, metric, reference counter, use counter, flags, and the
+	// interface name.
+	err = readRoutes(b, "/proc/net/ipv6_route", func(fields []string) (ok bool) {
+		return len(fields) > 9 &&
+			fields[1] == "00" &&
+			strings.Trim(fields[0], "0") == "" &&
+			fields[9] != "lo"
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// readRoutes writes the lines of the routing table file at path which fields
+// are accepted by isDefault to b.  A missing file is ignored, since the
+// protocol may be disabled.
+func readRoutes(b *strings.Builder, path string, isDefault func(fields []string) (ok bool)) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("opening routes: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if isDefault(strings.Fields(line)) {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+
+	err = s.Err()
+	if err != nil {
+		return fmt.Errorf("reading routes from %q: %w", path, err)
+	}
+
+	return nil
+}
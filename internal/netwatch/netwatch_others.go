@@ -0,0 +1,25 @@
+//go:build !linux
+
+package netwatch
+
+import (
+	"io"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// subscribe returns [errors.ErrUnsupported], since the OS notifications about
+// the network changes aren't supported yet on this platform, so the state is
+// only polled.
+//
+// TODO(e.burkov):  Use the routing sockets on BSD and NotifyIpInterfaceChange
+// on Windows.
+func subscribe() (events <-chan struct{}, c io.Closer, err error) {
+	return nil, nil, errors.ErrUnsupported
+}
+
+// defaultRoutes returns an empty string, since the routing table isn't
+// inspected on this platform.
+func defaultRoutes() (s string, err error) {
+	return "", nil
+}
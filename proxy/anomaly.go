@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultAnomalyCaptureMaxFileSize is the default value for
+	// [AnomalyCaptureConfig.MaxFileSize].
+	DefaultAnomalyCaptureMaxFileSize uint64 = 10 << 20
+
+	// minAnomalyCaptureFileSize is the minimum value for
+	// [AnomalyCaptureConfig.MaxFileSize], which is enough for any single
+	// packet.
+	minAnomalyCaptureFileSize uint64 = 128 << 10
+)
+
+// AnomalyCaptureConfig is the configuration of capturing the malformed and
+// anomalous traffic into a libpcap file for the forensic analysis.  The
+// captured packets are:
+//
+//   - the requests which fail parsing, received over UDP or TCP;
+//   - the requests dropped or refused by the ratelimit;
+//   - the upstream responses whose ID or question name, compared
+//     case-sensitively in accordance with the 0x20 encoding, don't match the
+//     request;
+//   - the upstream responses blocked by the DNS rebinding protection;
+//   - the upstream responses violating the constraints of the critical domain
+//     names, see [CriticalNamesConfig].
+//
+// All the packets are written as plain DNS over UDP, the responses are written
+// as sent from the unspecified address.
+type AnomalyCaptureConfig struct {
+	// FilePath is the path to the capture file.  Once the file is full or on
+	// creating the proxy, the previous file is renamed to have the ".1"
+	// suffix, the one with ".1" suffix to have ".2", and so on.  It must not
+	// be empty.
+	FilePath string
+
+	// MaxFileSize is the maximum size of a capture file in bytes.  Zero means
+	// [DefaultAnomalyCaptureMaxFileSize].  It must not be less than 128 KiB.
+	MaxFileSize uint64
+
+	// MaxBackups is the number of the previous capture files to keep.  Zero
+	// means the file is overwritten instead.
+	MaxBackups uint
+
+	// SnapLen is the maximum number of bytes of each DNS message to capture,
+	// e.g. 12 to only keep the headers.  Zero means the messages are captured
+	// entirely.
+	SnapLen uint
+
+	// RedactClients makes the client addresses replaced with the unspecified
+	// ones of the same family.  The ports are kept to tell the clients apart
+	// within the capture.
+	RedactClients bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *AnomalyCaptureConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	errs := []error{
+		validate.NotEmpty("FilePath", c.FilePath),
+	}
+
+	if c.MaxFileSize != 0 {
+		errs = append(errs, validate.NoLessThan("MaxFileSize", c.MaxFileSize, minAnomalyCaptureFileSize))
+	}
+
+	return errors.Join(errs...)
+}
+
+// anomalyKind is the kind of the anomaly a captured packet is related to.
+type anomalyKind string
+
+// anomalyKind values.
+const (
+	anomalyMalformed    anomalyKind = "malformed"
+	anomalyRatelimited  anomalyKind = "ratelimited"
+	anomalyMismatch     anomalyKind = "mismatch"
+	anomalyRebinding    anomalyKind = "rebinding"
+	anomalyCriticalName anomalyKind = "critical_name"
+)
+
+// anomalyCapture writes the anomalous packets into the rotated libpcap files.
+// A nil *anomalyCapture is valid and captures nothing.
+type anomalyCapture struct {
+	// mu protects file and size.
+	mu *sync.Mutex
+
+	// file is the current capture file.  It's nil after closing.
+	file *os.File
+
+	// clock is used to get the time of the packets.
+	clock timeutil.Clock
+
+	// logger is used to log the captured packets and the errors.
+	logger *slog.Logger
+
+	// path is the path to the current capture file.
+	path string
+
+	// size is the current size of the file.
+	size uint64
+
+	// maxSize is the maximum size of the file.
+	maxSize uint64
+
+	// maxBackups is the number of the previous files to keep.
+	maxBackups uint
+
+	// snapLen is the maximum number of bytes of each message to capture.
+	snapLen int
+
+	// redactClients is true if the client addresses should be redacted.
+	redactClients bool
+}
+
+// newAnomalyCapture returns a new *anomalyCapture configured with conf, rotating
+// the previous capture file, if any.  It returns nil if conf is nil.
+func newAnomalyCapture(
+	conf *AnomalyCaptureConfig,
+	clock timeutil.Clock,
+	logger *slog.Logger,
+) (c *anomalyCapture, err error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	c = &anomalyCapture{
+		mu:            &sync.Mutex{},
+		clock:         clock,
+		logger:        logger,
+		path:          conf.FilePath,
+		maxSize:       cmp.Or(conf.MaxFileSize, DefaultAnomalyCaptureMaxFileSize),
+		maxBackups:    conf.MaxBackups,
+		snapLen:       int(conf.SnapLen),
+		redactClients: conf.RedactClients,
+	}
+
+	fi, err := os.Stat(c.path)
+	if err == nil && fi.Size() > 0 {
+		err = c.rotateBackups()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("rotating previous capture: %w", err)
+	}
+
+	err = c.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// open creates the new capture file and writes the libpcap header.  c.mu must
+// be locked unless c isn't used concurrently yet.
+func (c *anomalyCapture) open() (err error) {
+	// #nosec G302 G304 -- Trust the file path that is given in the
+	// configuration.
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening capture file: %w", err)
+	}
+
+	hdr := appendPCAPHeader(nil)
+	_, err = f.Write(hdr)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing capture header: %w", err), f.Close())
+	}
+
+	c.file, c.size = f, uint64(len(hdr))
+
+	return nil
+}
+
+// rotateBackups shifts the previous capture files and moves the current one to
+// the first backup, or removes it if no backups are kept.
+func (c *anomalyCapture) rotateBackups() (err error) {
+	if c.maxBackups == 0 {
+		return os.Remove(c.path)
+	}
+
+	for i := c.maxBackups - 1; i > 0; i-- {
+		err = os.Rename(c.backupPath(i), c.backupPath(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(c.path, c.backupPath(1))
+}
+
+// backupPath returns the path to the n-th previous capture file.
+func (c *anomalyCapture) backupPath(n uint) (p string) {
+	return fmt.Sprintf("%s.%d", c.path, n)
+}
+
+// captureRequest writes the request data received from client on local, which
+// may be invalid.
+func (c *anomalyCapture) captureRequest(
+	kind anomalyKind,
+	client netip.AddrPort,
+	local netip.Addr,
+	data []byte,
+) {
+	if c == nil {
+		return
+	}
+
+	client, server := pcapEndpoints(c.redact(client), local)
+	c.write(kind, client, server, data)
+}
+
+// captureMsg packs and writes the request req received from client on local,
+// which may be invalid.
+func (c *anomalyCapture) captureMsg(
+	kind anomalyKind,
+	client netip.AddrPort,
+	local netip.Addr,
+	req *dns.Msg,
+) {
+	if c == nil {
+		return
+	}
+
+	data, err := req.Pack()
+	if err != nil {
+		c.logger.Debug("capturing anomalous request", "kind", kind, slogutil.KeyError, err)
+
+		return
+	}
+
+	c.captureRequest(kind, client, local, data)
+}
+
+// captureResponse packs and writes the response resp received from u.
+func (c *anomalyCapture) captureResponse(kind anomalyKind, u upstream.Upstream, resp *dns.Msg) {
+	if c == nil || u == nil {
+		return
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		c.logger.Debug("capturing anomalous response", "kind", kind, slogutil.KeyError, err)
+
+		return
+	}
+
+	// The address is only parsed for the plain upstreams, the others are
+	// written as the unspecified one.
+	ups, err := netip.ParseAddrPort(u.Address())
+	if err != nil {
+		ups = netip.AddrPortFrom(netip.IPv4Unspecified(), pcapServerPort)
+	}
+
+	src, dst := pcapEndpoints(ups, netip.Addr{})
+	c.write(kind, src, dst, data)
+}
+
+// redact returns the redacted client address, if configured.
+func (c *anomalyCapture) redact(client netip.AddrPort) (res netip.AddrPort) {
+	if !c.redactClients {
+		return client
+	}
+
+	if client.Addr().Unmap().Is6() {
+		return netip.AddrPortFrom(netip.IPv6Unspecified(), client.Port())
+	}
+
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), client.Port())
+}
+
+// write writes the packet from src to dst containing data, rotating the file if
+// it's full.
+func (c *anomalyCapture) write(kind anomalyKind, src, dst netip.AddrPort, data []byte) {
+	rec, err := appendPCAPRecord(nil, c.clock.Now(), src, dst, data, c.snapLen)
+	if err != nil {
+		c.logger.Debug("capturing anomalous packet", "kind", kind, slogutil.KeyError, err)
+
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		// The capture is closed.
+		return
+	}
+
+	if c.size+uint64(len(rec)) > c.maxSize {
+		err = c.rotate()
+		if err != nil {
+			c.logger.Error("rotating anomaly capture", slogutil.KeyError, err)
+
+			return
+		}
+	}
+
+	n, err := c.file.Write(rec)
+	c.size += uint64(n)
+	if err != nil {
+		c.logger.Error("writing anomaly capture", slogutil.KeyError, err)
+
+		return
+	}
+
+	c.logger.Debug("captured anomalous packet", "kind", kind, "src", src)
+}
+
+// rotate closes the full capture file and opens the new one.  c.mu must be
+// locked.
+func (c *anomalyCapture) rotate() (err error) {
+	err = c.file.Close()
+	c.file = nil
+	if err != nil {
+		return fmt.Errorf("closing capture file: %w", err)
+	}
+
+	err = c.rotateBackups()
+	if err != nil {
+		return fmt.Errorf("rotating capture files: %w", err)
+	}
+
+	return c.open()
+}
+
+// close closes the current capture file.
+func (c *anomalyCapture) close() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	err = c.file.Close()
+	c.file = nil
+	if err != nil {
+		return fmt.Errorf("closing anomaly capture: %w", err)
+	}
+
+	return nil
+}
+
+// isMismatched returns true if the ID or the question name of resp don't match
+// the ones of req exactly.  The names are compared case-sensitively, since the
+// upstreams are expected to preserve the case of the question, see
+// https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00.
+func isMismatched(req, resp *dns.Msg) (ok bool) {
+	if resp == nil {
+		return false
+	} else if resp.Id != req.Id {
+		return true
+	}
+
+	return len(req.Question) > 0 &&
+		len(resp.Question) > 0 &&
+		resp.Question[0].Name != req.Question[0].Name
+}
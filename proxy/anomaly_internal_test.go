@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAnomalyCapture returns a new *anomalyCapture configured with conf and
+// closed on cleanup.
+func newTestAnomalyCapture(t *testing.T, conf *AnomalyCaptureConfig) (c *anomalyCapture) {
+	t.Helper()
+
+	clock := &faketime.Clock{
+		OnNow: func() (n time.Time) { return time.Unix(1_700_000_000, 0) },
+	}
+
+	c, err := newAnomalyCapture(conf, clock, slogutil.NewDiscardLogger())
+	require.NoError(t, err)
+
+	t.Cleanup(func() { require.NoError(t, c.close()) })
+
+	return c
+}
+
+func TestAnomalyCapture_redact(t *testing.T) {
+	// headerLen is the length of the DNS message header.
+	const headerLen = 12
+
+	path := filepath.Join(t.TempDir(), "anomalies.pcap")
+	c := newTestAnomalyCapture(t, &AnomalyCaptureConfig{
+		FilePath:      path,
+		SnapLen:       headerLen,
+		RedactClients: true,
+	})
+
+	packet := make([]byte, 100)
+	c.captureRequest(
+		anomalyMalformed,
+		netip.MustParseAddrPort("192.0.2.2:12345"),
+		netip.MustParseAddr("192.0.2.1"),
+		packet,
+	)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Greater(t, len(data), pcapHeaderLen+16)
+
+	rec := data[pcapHeaderLen:]
+	wantInclLen := ipv4HeaderLen + udpHeaderLen + headerLen
+
+	assert.Equal(t, uint32(wantInclLen), binary.LittleEndian.Uint32(rec[8:]))
+	assert.Equal(t, uint32(ipv4HeaderLen+udpHeaderLen+len(packet)), binary.LittleEndian.Uint32(rec[12:]))
+
+	pkt := rec[16:]
+	require.Len(t, pkt, wantInclLen)
+
+	// The source address is redacted, but the port is kept.
+	assert.Equal(t, []byte{0, 0, 0, 0}, pkt[12:16])
+	assert.Equal(t, []byte{192, 0, 2, 1}, pkt[16:20])
+	assert.Equal(t, uint16(12345), binary.BigEndian.Uint16(pkt[ipv4HeaderLen:]))
+}
+
+func TestAnomalyCapture_rotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "anomalies.pcap")
+
+	// Make sure the previous capture is kept.
+	err := os.WriteFile(path, []byte("previous"), 0o600)
+	require.NoError(t, err)
+
+	c := newTestAnomalyCapture(t, &AnomalyCaptureConfig{
+		FilePath:    path,
+		MaxFileSize: minAnomalyCaptureFileSize,
+		MaxBackups:  2,
+	})
+
+	prev, err := os.ReadFile(c.backupPath(1))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("previous"), prev)
+
+	client := netip.MustParseAddrPort("192.0.2.2:12345")
+	packet := make([]byte, 60_000)
+
+	// Each file only fits two packets, so the third one rotates the file.
+	for range 3 {
+		c.captureRequest(anomalyMalformed, client, netip.Addr{}, packet)
+	}
+
+	for _, p := range []string{path, c.backupPath(1), c.backupPath(2)} {
+		var fi os.FileInfo
+		fi, err = os.Stat(p)
+		require.NoError(t, err)
+
+		assert.LessOrEqual(t, uint64(fi.Size()), minAnomalyCaptureFileSize)
+	}
+
+	prev, err = os.ReadFile(c.backupPath(2))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("previous"), prev)
+
+	// The oldest backup is overwritten.
+	c.captureRequest(anomalyMalformed, client, netip.Addr{}, packet)
+	c.captureRequest(anomalyMalformed, client, netip.Addr{}, packet)
+
+	prev, err = os.ReadFile(c.backupPath(2))
+	require.NoError(t, err)
+
+	assert.NotEqual(t, []byte("previous"), prev)
+
+	_, err = os.Stat(c.backupPath(3))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestIsMismatched(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("ExAmPle.org.", dns.TypeA)
+
+	idMismatch := (&dns.Msg{}).SetReply(req)
+	idMismatch.Id++
+
+	caseMismatch := (&dns.Msg{}).SetReply(req)
+	caseMismatch.Question[0].Name = "example.org."
+
+	noQuestion := (&dns.Msg{}).SetReply(req)
+	noQuestion.Question = nil
+
+	testCases := []struct {
+		resp *dns.Msg
+		name string
+		want bool
+	}{{
+		resp: (&dns.Msg{}).SetReply(req),
+		name: "match",
+		want: false,
+	}, {
+		resp: nil,
+		name: "no_response",
+		want: false,
+	}, {
+		resp: noQuestion,
+		name: "no_question",
+		want: false,
+	}, {
+		resp: idMismatch,
+		name: "id",
+		want: true,
+	}, {
+		resp: caseMismatch,
+		name: "case",
+		want: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isMismatched(req, tc.resp))
+		})
+	}
+}
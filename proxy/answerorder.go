@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// AnswerOrder is the order of the records in the responses, see
+// [Config.AnswerOrder].
+type AnswerOrder string
+
+const (
+	// AnswerOrderKeep makes the address records returned in the order they
+	// have been received from the upstream.  It's the default.
+	AnswerOrderKeep AnswerOrder = "keep"
+
+	// AnswerOrderRotate makes the address records rotated by one position with
+	// each response for the same question, so that the clients using the
+	// first record spread the load over all of them.
+	AnswerOrderRotate AnswerOrder = "rotate"
+
+	// AnswerOrderRandom makes the address records shuffled in each response.
+	AnswerOrderRandom AnswerOrder = "random"
+
+	// AnswerOrderSorted makes the records of the requested type, not only the
+	// address ones, returned in the canonical sorted order, so that the
+	// responses with the same records are always the same.  The addresses are
+	// sorted numerically and the other records by their data.
+	AnswerOrderSorted AnswerOrder = "sorted"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*AnswerOrder)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *AnswerOrder.
+func (o *AnswerOrder) UnmarshalText(b []byte) (err error) {
+	switch ord := AnswerOrder(b); ord {
+	case
+		AnswerOrderKeep,
+		AnswerOrderRotate,
+		AnswerOrderRandom,
+		AnswerOrderSorted:
+		*o = ord
+	default:
+		return fmt.Errorf(
+			"invalid answer order %q, supported: %q, %q, %q, %q",
+			b,
+			AnswerOrderKeep,
+			AnswerOrderRotate,
+			AnswerOrderRandom,
+			AnswerOrderSorted,
+		)
+	}
+
+	return nil
+}
+
+// validate returns an error if o is invalid.  The empty order is valid.
+func (o AnswerOrder) validate() (err error) {
+	switch o {
+	case
+		"",
+		AnswerOrderKeep,
+		AnswerOrderRotate,
+		AnswerOrderRandom,
+		AnswerOrderSorted:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errors.ErrBadEnumValue, o)
+	}
+}
+
+// answerRotationSlots is the number of the rotation counters, see
+// [answerRotator].
+const answerRotationSlots = 256
+
+// answerRotator counts the responses to rotate the address records in.  The
+// questions are spread over a fixed number of counters by their hashes, so
+// that the memory used doesn't depend on the number of the names and the
+// rotation of a name isn't affected by the responses for the other ones,
+// unless they share the counter.
+type answerRotator struct {
+	// counters are the numbers of the responses per slot.
+	counters [answerRotationSlots]atomic.Uint32
+}
+
+// next returns the rotation offset for the next response to q.
+func (r *answerRotator) next(q dns.Question) (off uint32) {
+	h := fnv.New32a()
+	// Don't mind the case of the name, since the clients may randomize it.
+	_, _ = h.Write([]byte(dns.CanonicalName(q.Name)))
+	_, _ = h.Write([]byte{byte(q.Qtype >> 8), byte(q.Qtype)})
+
+	return r.counters[h.Sum32()%answerRotationSlots].Add(1) - 1
+}
+
+// answerOrder returns the order of the records in the response of d, which is
+// [ClientPolicy.AnswerOrder] of the client's policy, if set, and
+// [Config.AnswerOrder] otherwise.
+func (p *Proxy) answerOrder(d *DNSContext) (ord AnswerOrder) {
+	if pol := p.clientPolicy(d); pol != nil && pol.AnswerOrder != "" {
+		return pol.AnswerOrder
+	}
+
+	return p.AnswerOrder
+}
+
+// orderAnswers reorders the records of the response of d according to
+// [Proxy.answerOrder].  Only the records of the requested type are reordered
+// within the positions they occupy, so that the CNAME chains stay in front of
+// them.  The response must not be shared, e.g. with the cache, since it's
+// modified in place.
+func (p *Proxy) orderAnswers(d *DNSContext) {
+	if d.Res == nil || len(d.Req.Question) != 1 {
+		return
+	}
+
+	q := d.Req.Question[0]
+	isAddr := q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA
+
+	ord := p.answerOrder(d)
+	switch ord {
+	case AnswerOrderRotate, AnswerOrderRandom:
+		if !isAddr {
+			return
+		}
+	case AnswerOrderSorted:
+		// Go on.
+	default:
+		return
+	}
+
+	var idxs []int
+	for i, rr := range d.Res.Answer {
+		if rr.Header().Rrtype == q.Qtype {
+			idxs = append(idxs, i)
+		}
+	}
+
+	n := len(idxs)
+	if n < 2 {
+		return
+	}
+
+	recs := make([]dns.RR, n)
+	for i, idx := range idxs {
+		recs[i] = d.Res.Answer[idx]
+	}
+
+	switch ord {
+	case AnswerOrderRotate:
+		off := int(p.answerRotator.next(q) % uint32(n))
+		recs = slices.Concat(recs[off:], recs[:off])
+	case AnswerOrderRandom:
+		rand.Shuffle(n, func(i, j int) {
+			recs[i], recs[j] = recs[j], recs[i]
+		})
+	case AnswerOrderSorted:
+		slices.SortStableFunc(recs, compareRRData)
+	}
+
+	for i, idx := range idxs {
+		d.Res.Answer[idx] = recs[i]
+	}
+}
+
+// compareRRData compares the data of the records of the same type for
+// [AnswerOrderSorted].  The addresses are compared numerically.
+func compareRRData(a, b dns.RR) (res int) {
+	switch a := a.(type) {
+	case *dns.A:
+		return compareIPs(a.A, b.(*dns.A).A)
+	case *dns.AAAA:
+		return compareIPs(a.AAAA, b.(*dns.AAAA).AAAA)
+	default:
+		return strings.Compare(rrData(a), rrData(b))
+	}
+}
+
+// compareIPs compares the IP addresses numerically.
+func compareIPs(a, b net.IP) (res int) {
+	addrA, _ := netip.AddrFromSlice(a)
+	addrB, _ := netip.AddrFromSlice(b)
+
+	return addrA.Unmap().Compare(addrB.Unmap())
+}
+
+// rrData returns the presentation format of the data of rr without the header.
+func rrData(rr dns.RR) (data string) {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAnswerOrderProxy returns a started proxy with the cache and ord, which
+// upstream responds with a CNAME record followed by the A records of ips.  pol
+// is the only client policy, if not nil, and its upstreams are set to the same
+// upstream.
+func newAnswerOrderProxy(
+	tb testing.TB,
+	ord AnswerOrder,
+	ips []net.IP,
+	pol *ClientPolicy,
+) (p *Proxy) {
+	tb.Helper()
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			name := req.Question[0].Name
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(tb, name, dns.TypeCNAME, 60, "target.example.")}
+			for _, ip := range ips {
+				resp.Answer = append(resp.Answer, newRR(tb, "target.example.", dns.TypeA, 60, ip))
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "192.0.2.53:53" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	var policies []*ClientPolicy
+	if pol != nil {
+		pol.Upstreams = &UpstreamConfig{Upstreams: []upstream.Upstream{ups}}
+		policies = append(policies, pol)
+	}
+
+	p = mustNew(tb, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		AnswerOrder:            ord,
+		ClientPolicies:         policies,
+	})
+	servicetest.RequireRun(tb, p, testTimeout)
+
+	return p
+}
+
+// resolveOrdered resolves the A records of host with p, orders the answers as
+// if the response is written to the client, and returns the addresses in the
+// order of the answer section.  The first record must be a CNAME.
+func resolveOrdered(tb testing.TB, p *Proxy, host string) (ips []net.IP) {
+	tb.Helper()
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	d := p.newDNSContext(ProtoUDP, req, netip.MustParseAddrPort("192.0.2.1:53"))
+	require.NoError(tb, p.Resolve(context.Background(), d))
+	require.NotNil(tb, d.Res)
+
+	p.orderAnswers(d)
+
+	require.NotEmpty(tb, d.Res.Answer)
+	testutil.RequireTypeAssert[*dns.CNAME](tb, d.Res.Answer[0])
+
+	for _, rr := range d.Res.Answer[1:] {
+		a := testutil.RequireTypeAssert[*dns.A](tb, rr)
+		ips = append(ips, a.A.To4())
+	}
+
+	return ips
+}
+
+func TestProxy_orderAnswers(t *testing.T) {
+	ip1 := net.IP{192, 0, 2, 1}
+	ip2 := net.IP{192, 0, 2, 2}
+	ip3 := net.IP{192, 0, 2, 3}
+	ips := []net.IP{ip1, ip2, ip3}
+
+	t.Run("keep", func(t *testing.T) {
+		p := newAnswerOrderProxy(t, AnswerOrderKeep, ips, nil)
+
+		for range 3 {
+			assert.Equal(t, ips, resolveOrdered(t, p, "keep.example."))
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		p := newAnswerOrderProxy(t, AnswerOrderRotate, ips, nil)
+
+		want := [][]net.IP{
+			{ip1, ip2, ip3},
+			{ip2, ip3, ip1},
+			{ip3, ip1, ip2},
+			{ip1, ip2, ip3},
+		}
+		for _, w := range want {
+			assert.Equal(t, w, resolveOrdered(t, p, "rotate.example."))
+		}
+
+		// The cached response must keep the original order.
+		cached := p.cache.peek((&dns.Msg{}).SetQuestion("rotate.example.", dns.TypeA))
+		require.NotNil(t, cached)
+		require.Len(t, cached.Answer, 4)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, cached.Answer[1])
+		assert.Equal(t, ip1, a.A.To4())
+	})
+
+	t.Run("random", func(t *testing.T) {
+		p := newAnswerOrderProxy(t, AnswerOrderRandom, ips, nil)
+
+		for range 3 {
+			assert.ElementsMatch(t, ips, resolveOrdered(t, p, "random.example."))
+		}
+	})
+
+	ip10 := net.IP{192, 0, 2, 10}
+	unsorted := []net.IP{ip10, ip3, ip1, ip2}
+	sorted := []net.IP{ip1, ip2, ip3, ip10}
+
+	t.Run("sorted", func(t *testing.T) {
+		p := newAnswerOrderProxy(t, AnswerOrderSorted, unsorted, nil)
+
+		for range 2 {
+			assert.Equal(t, sorted, resolveOrdered(t, p, "sorted.example."))
+		}
+	})
+
+	t.Run("client_policy", func(t *testing.T) {
+		p := newAnswerOrderProxy(t, AnswerOrderRotate, unsorted, &ClientPolicy{
+			Name:        "monitoring",
+			Networks:    []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			AnswerOrder: AnswerOrderSorted,
+		})
+
+		for range 2 {
+			assert.Equal(t, sorted, resolveOrdered(t, p, "policy.example."))
+		}
+	})
+}
+
+func TestCompareRRData(t *testing.T) {
+	t.Parallel()
+
+	mx := func(pref uint16, host string) (rr dns.RR) {
+		return &dns.MX{
+			Hdr:        dns.RR_Header{Name: "example.", Rrtype: dns.TypeMX, Class: dns.ClassINET},
+			Preference: pref,
+			Mx:         host,
+		}
+	}
+
+	recs := []dns.RR{mx(20, "b.example."), mx(10, "b.example."), mx(10, "a.example.")}
+	slices.SortStableFunc(recs, compareRRData)
+
+	assert.Equal(t, []dns.RR{mx(10, "a.example."), mx(10, "b.example."), mx(20, "b.example.")}, recs)
+
+	v6 := []dns.RR{
+		newRR(t, "example.", dns.TypeAAAA, 60, net.ParseIP("2001:db8::10")),
+		newRR(t, "example.", dns.TypeAAAA, 60, net.ParseIP("2001:db8::9")),
+	}
+	slices.SortStableFunc(v6, compareRRData)
+
+	a := testutil.RequireTypeAssert[*dns.AAAA](t, v6[0])
+	assert.Equal(t, net.ParseIP("2001:db8::9"), a.AAAA)
+}
+
+func TestAnswerOrder_UnmarshalText(t *testing.T) {
+	t.Parallel()
+
+	var ord AnswerOrder
+	require.NoError(t, ord.UnmarshalText([]byte("rotate")))
+	assert.Equal(t, AnswerOrderRotate, ord)
+
+	testutil.AssertErrorMsg(
+		t,
+		`invalid answer order "sort", supported: "keep", "rotate", "random", "sorted"`,
+		ord.UnmarshalText([]byte("sort")),
+	)
+}
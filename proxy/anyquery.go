@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// defaultANYHINFOTTL is the default TTL of the HINFO responses to the requests
+// of type ANY in seconds.
+const defaultANYHINFOTTL = 3600
+
+// hinfoCPU is the CPU field of the synthesized HINFO record, see RFC 8482
+// Section 4.2.
+const hinfoCPU = "RFC8482"
+
+// ANYQueryConfig is the configuration of answering the requests of type ANY
+// locally with a minimal HINFO response instead of forwarding them, see RFC
+// 8482.  It blocks a common amplification vector, since such responses are
+// small regardless of the requested name.
+type ANYQueryConfig struct {
+	// ExemptSubnets are the networks of the clients the requests of type ANY
+	// from which are handled as usual.
+	ExemptSubnets []netip.Prefix
+
+	// TTL is the TTL of the HINFO record in seconds.  If zero, the default of
+	// 3600 seconds is used.
+	TTL uint32
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ANYQueryConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	var errs []error
+	for i, n := range c.ExemptSubnets {
+		if !n.IsValid() {
+			errs = append(errs, fmt.Errorf("ExemptSubnets: at index %d: %w", i, errors.ErrNoValue))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isExempt returns true if the requests of type ANY from addr are handled as
+// usual.
+func (c *ANYQueryConfig) isExempt(addr netip.Addr) (ok bool) {
+	addr = addr.Unmap()
+	for _, n := range c.ExemptSubnets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shouldAnswerANY returns true if d is a request of type ANY which should be
+// answered with HINFO according to [Config.ANYQuery].  d.Req must have a
+// question.
+func (p *Proxy) shouldAnswerANY(d *DNSContext) (ok bool) {
+	c := p.ANYQuery
+
+	return c != nil && d.Req.Question[0].Qtype == dns.TypeANY && !c.isExempt(d.Addr.Addr())
+}
+
+// newMsgHINFO returns the minimal response for req of type ANY, see RFC 8482
+// Section 4.2.
+func (p *Proxy) newMsgHINFO(req *dns.Msg) (resp *dns.Msg) {
+	ttl := p.ANYQuery.TTL
+	if ttl == 0 {
+		ttl = defaultANYHINFOTTL
+	}
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Cpu: hinfoCPU,
+		Os:  "",
+	}}
+
+	return resp
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_validateRequest_anyHINFO(t *testing.T) {
+	t.Parallel()
+
+	p := &Proxy{
+		Config: Config{
+			ANYQuery: &ANYQueryConfig{
+				ExemptSubnets: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+			},
+			Truncation: &TruncationConfig{TruncateANY: true},
+		},
+		logger: slogutil.NewDiscardLogger(),
+	}
+	p.initLoggers()
+
+	const host = "example.org."
+
+	d := &DNSContext{
+		Proto: ProtoTCP,
+		Req:   (&dns.Msg{}).SetQuestion(host, dns.TypeANY),
+		Addr:  netip.MustParseAddrPort("192.0.2.1:53"),
+	}
+
+	resp := p.validateRequest(d)
+	require.NotNil(t, resp)
+	require.Len(t, resp.Answer, 1)
+
+	hinfo := testutil.RequireTypeAssert[*dns.HINFO](t, resp.Answer[0])
+	assert.Equal(t, host, hinfo.Hdr.Name)
+	assert.Equal(t, hinfoCPU, hinfo.Cpu)
+	assert.Empty(t, hinfo.Os)
+	assert.Equal(t, uint32(defaultANYHINFOTTL), hinfo.Hdr.Ttl)
+
+	// The exempt clients are truncated as usual.
+	d.Proto = ProtoUDP
+	d.Addr = netip.MustParseAddrPort("[::ffff:192.168.1.1]:53")
+
+	resp = p.validateRequest(d)
+	require.NotNil(t, resp)
+
+	assert.True(t, resp.Truncated)
+	assert.Empty(t, resp.Answer)
+
+	d.Req = (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	d.Addr = netip.MustParseAddrPort("192.0.2.1:53")
+	assert.False(t, p.shouldAnswerANY(d))
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// batchResult is the result of resolving a group of identical requests of a
+// batch.
+type batchResult struct {
+	// dctx is the resolved copy of the first request of the group.
+	dctx *DNSContext
+
+	// err is the error of resolving dctx.
+	err error
+
+	// group is the index of the group within the batch.
+	group int
+}
+
+// ResolveBatch resolves each of dctxs like [Proxy.Resolve] does, but
+// concurrently.  The identical requests within the batch are resolved once and
+// the rest of them get the copies of the response.  errs has the same length as
+// dctxs, errs[i] is the error of resolving dctxs[i].
+//
+// If ctx is canceled before dctxs[i] is resolved, errs[i] is the error of ctx
+// and dctxs[i] is left unchanged, but the resolving itself isn't interrupted.
+// The number of simultaneous resolvings is limited by [Config.MaxGoroutines].
+// dctxs must not contain nil or repeated elements.
+func (p *Proxy) ResolveBatch(ctx context.Context, dctxs []*DNSContext) (errs []error) {
+	errs = make([]error, len(dctxs))
+
+	groups := p.groupBatch(dctxs)
+	resCh := make(chan *batchResult, len(groups))
+	for i, g := range groups {
+		go p.resolveBatchGroup(ctx, dctxs[g[0]], i, resCh)
+	}
+
+	resolved := make([]bool, len(groups))
+	for range groups {
+		select {
+		case res := <-resCh:
+			resolved[res.group] = true
+			setBatchResult(dctxs, groups[res.group], res, errs)
+		case <-ctx.Done():
+			err := fmt.Errorf("resolving batch: %w", context.Cause(ctx))
+			for i, g := range groups {
+				if !resolved[i] {
+					setBatchError(g, err, errs)
+				}
+			}
+
+			return errs
+		}
+	}
+
+	return errs
+}
+
+// groupBatch returns the indexes of dctxs grouped by identical requests, in the
+// order of their first occurrence.
+func (p *Proxy) groupBatch(dctxs []*DNSContext) (groups [][]int) {
+	groupIdx := map[string]int{}
+	for i, d := range dctxs {
+		key, ok := p.batchKey(d)
+		if !ok {
+			groups = append(groups, []int{i})
+
+			continue
+		}
+
+		if gi, has := groupIdx[key]; has {
+			groups[gi] = append(groups[gi], i)
+
+			continue
+		}
+
+		groupIdx[key] = len(groups)
+		groups = append(groups, []int{i})
+	}
+
+	return groups
+}
+
+// batchKey returns the key identifying the requests within the batch, which can
+// be answered with the same response.  ok is false if d shouldn't be coalesced
+// with any other request.
+func (p *Proxy) batchKey(d *DNSContext) (key string, ok bool) {
+	req := d.Req
+	if req == nil || len(req.Question) != 1 || d.CustomUpstreamConfig != nil {
+		return "", false
+	}
+
+	var doBit bool
+	var udpSize uint16
+	if opt := req.IsEdns0(); opt != nil {
+		doBit, udpSize = opt.Do(), opt.UDPSize()
+	}
+
+	key = fmt.Sprintf(
+		"%x|%s|%t|%t|%d",
+		msgToKey(req),
+		d.Proto,
+		req.CheckingDisabled,
+		doBit,
+		udpSize,
+	)
+	if p.EnableEDNSClientSubnet {
+		// The ECS option may be derived from the client's address.
+		key += "|" + d.Addr.Addr().String()
+	}
+
+	return key, true
+}
+
+// resolveBatchGroup resolves the copy of d and sends the result to resCh.  It
+// is intended to be used as a goroutine.
+func (p *Proxy) resolveBatchGroup(
+	ctx context.Context,
+	d *DNSContext,
+	group int,
+	resCh chan<- *batchResult,
+) {
+	defer slogutil.RecoverAndLog(ctx, p.logger)
+
+	// Resolve the copy, since the original one must be left unchanged if ctx
+	// is canceled earlier.
+	dctx := *d
+	dctx.Req = d.Req.Copy()
+
+	res := &batchResult{
+		dctx:  &dctx,
+		group: group,
+	}
+
+	err := p.requestsSema.Acquire(ctx)
+	if err != nil {
+		res.err = fmt.Errorf("acquiring semaphore: %w", err)
+	} else {
+		defer p.requestsSema.Release()
+
+		res.err = p.Resolve(ctx, &dctx)
+	}
+
+	// Never blocks, since the channel is buffered for all the groups.
+	resCh <- res
+}
+
+// setBatchResult sets the result of the group of requests of dctxs specified by
+// the indexes.
+func setBatchResult(dctxs []*DNSContext, indexes []int, res *batchResult, errs []error) {
+	*dctxs[indexes[0]] = *res.dctx
+	errs[indexes[0]] = res.err
+
+	for _, i := range indexes[1:] {
+		d := dctxs[i]
+		d.Upstream = res.dctx.Upstream
+		d.queryStatistics = res.dctx.queryStatistics
+		d.source = res.dctx.source
+		if res.dctx.Res != nil {
+			rcode := res.dctx.Res.Rcode
+
+			// Restore the response code, since [dns.Msg.SetReply] resets it.
+			d.Res = res.dctx.Res.Copy().SetReply(d.Req)
+			d.Res.Rcode = rcode
+		}
+
+		errs[i] = res.err
+	}
+}
+
+// setBatchError sets err for each of the requests specified by the indexes.
+func setBatchError(indexes []int, err error, errs []error) {
+	for _, i := range indexes {
+		errs[i] = err
+	}
+}
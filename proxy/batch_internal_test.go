@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ResolveBatch(t *testing.T) {
+	var exchanges atomic.Int32
+	unblock := make(chan struct{})
+	blockedCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			name := req.Question[0].Name
+			if name == "blocked.example." {
+				// Cancel the batch while the request is being resolved.
+				cancel()
+				<-unblock
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, name, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	cliAddr := netip.MustParseAddrPort("192.0.2.1:53")
+	newDCtx := func(name string) (d *DNSContext) {
+		return p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion(name, dns.TypeA), cliAddr)
+	}
+
+	t.Run("coalesced", func(t *testing.T) {
+		exchanges.Store(0)
+
+		dctxs := []*DNSContext{
+			newDCtx("first.example."),
+			newDCtx("second.example."),
+			newDCtx("FIRST.example."),
+		}
+
+		errs := p.ResolveBatch(context.Background(), dctxs)
+		require.Len(t, errs, len(dctxs))
+
+		for i, d := range dctxs {
+			require.NoError(t, errs[i])
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, d.Req.Id, d.Res.Id)
+			assert.Equal(t, d.Req.Question, d.Res.Question)
+			assert.Len(t, d.Res.Answer, 1)
+		}
+
+		assert.Equal(t, int32(2), exchanges.Load())
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Cleanup(func() { close(unblock) })
+
+		dctxs := []*DNSContext{
+			newDCtx("blocked.example."),
+			newDCtx("second.example."),
+		}
+
+		errs := p.ResolveBatch(blockedCtx, dctxs)
+		require.Len(t, errs, len(dctxs))
+
+		assert.ErrorIs(t, errs[0], context.Canceled)
+		assert.Nil(t, dctxs[0].Res)
+	})
+}
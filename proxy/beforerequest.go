@@ -68,16 +68,21 @@ func (noopRequestHandler) HandleBefore(_ *Proxy, _ *DNSContext) (err error) {
 func (p *Proxy) handleBefore(d *DNSContext) (cont bool) {
 	err := p.beforeRequestHandler.HandleBefore(p, d)
 	if err == nil {
+		d.addTrace(StageBeforeRequest, "passed")
+
 		return true
 	}
 
 	p.logger.Debug("handling before request", slogutil.KeyError, err)
 
 	if befReqErr := (&BeforeRequestError{}); errors.As(err, &befReqErr) {
+		d.addTracef(StageBeforeRequest, "responded: %s", err)
 		d.Res = befReqErr.Response
 
 		p.logDNSMessage(d.Res)
 		p.respond(d)
+	} else {
+		d.addTracef(StageBeforeRequest, "dropped: %s", err)
 	}
 
 	return false
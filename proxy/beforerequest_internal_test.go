@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -57,7 +58,7 @@ func TestProxy_HandleDNSRequest_beforeRequestHandler(t *testing.T) {
 		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
 		UpstreamConfig: &UpstreamConfig{
 			Upstreams: []upstream.Upstream{&dnsproxytest.Upstream{
-				OnExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+				OnExchange: func(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 					return allowedResponse.Copy(), nil
 				},
 				OnAddress: func() (addr string) { return "general" },
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"testing"
@@ -92,7 +93,7 @@ func TestProxy_IsBogusNXDomain(t *testing.T) {
 		u.ans = tc.ans
 
 		t.Run(tc.name, func(t *testing.T) {
-			err := prx.Resolve(d)
+			err := prx.Resolve(context.Background(), d)
 			require.NoError(t, err)
 			require.NotNil(t, d.Res)
 
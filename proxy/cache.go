@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
 	"log/slog"
 	"math"
@@ -10,31 +9,38 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/internal/cachestore"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // defaultCacheSize is the size of cache in bytes by default.
 const defaultCacheSize = 64 * 1024
 
+// defaultProactiveRefreshTimeMs is the default value of
+// [Config.CacheProactiveRefreshTime].
+const defaultProactiveRefreshTimeMs = 30_000
+
 // cache is used to cache requests and used upstreams.
-//
-// TODO(a.garipov):  Add [timeutil.Clock] and make tests less flaky.
 type cache struct {
-	// itemsLock protects requests cache.
-	itemsLock *sync.RWMutex
-
 	// itemsWithSubnetLock protects requests cache.
 	itemsWithSubnetLock *sync.RWMutex
 
-	// items is the requests cache.
+	// items is the requests cache.  It's split into shards, each locked by
+	// the storage itself, so the cache doesn't lock it on its own.
 	items glcache.Cache
 
+	// shards is the number of shards of items.
+	shards uint
+
 	// itemsWithSubnet is the requests cache.
 	itemsWithSubnet glcache.Cache
 
@@ -49,43 +55,142 @@ type cache struct {
 	// cache is optimistic.
 	optimisticMaxAge time.Duration
 
-	// proactiveRefreshTime is the time before TTL expiration when entries
-	// should be proactively refreshed.
-	proactiveRefreshTime time.Duration
-
-	// cooldownPeriod is the time window to track request frequency.
-	cooldownPeriod time.Duration
+	// staleMaxAge is the maximum time the expired entries are kept to be
+	// served when resolving fails.  Zero means the expired entries aren't kept
+	// for that.
+	staleMaxAge time.Duration
 
-	// cooldownThreshold is the minimum number of requests for proactive refresh.
-	cooldownThreshold int
+	// staleTTL is the TTL of the entries served due to staleMaxAge.
+	staleTTL time.Duration
 
 	// refreshTimers stores timers for proactive cache refresh.
 	refreshTimers *sync.Map
 
 	// requestStats tracks request counts for cooldown mechanism.
-	requestStats *sync.Map
+	requestStats *requestStatsStore
+
+	// refreshFailures stores the *refreshBackoff for the keys which last
+	// proactive refresh has failed.
+	refreshFailures *sync.Map
+
+	// prefetched stores the keys of the entries last stored by the proactive
+	// refresh.
+	prefetched *sync.Map
+
+	// refreshStopped is true if the proactive refresh is stopped, so that no
+	// refreshes should be scheduled or performed.
+	refreshStopped *atomic.Bool
+
+	// refreshPausedUntil is the Unix time in nanoseconds until which the
+	// proactive refreshes are postponed, see [cache.pauseRefresh].
+	refreshPausedUntil *atomic.Int64
+
+	// journal is the write-behind log of the insertions into the cache.  It
+	// contains nil if the insertions aren't journaled.
+	journal *atomic.Pointer[cacheJournal]
+
+	// settings contains the settings which may be changed while the cache is
+	// used, see [cache.setSettings].  It never contains nil.
+	settings *atomic.Pointer[cacheSettings]
+
+	// refreshSema limits the number of proactive refreshes performed at the
+	// same time.
+	refreshSema syncutil.Semaphore
+
+	// refreshesRunning is the number of the proactive refreshes started and not
+	// yet finished, including the ones waiting for refreshSema.
+	refreshesRunning *atomic.Int64
+
+	// refreshesInFlight is the number of the proactive refreshes holding
+	// refreshSema.
+	refreshesInFlight *atomic.Int64
+
+	// refreshMu is read-locked by the proactive refreshes being performed, so
+	// that [cache.stopProactiveRefresh] could wait for them to finish.
+	refreshMu *sync.RWMutex
+
+	// refreshLimiter limits the rate of the proactive refreshes.  It's nil if
+	// the rate isn't limited.
+	refreshLimiter *refreshRateLimiter
+
+	// refreshReserved stores the time.Time reserved by refreshLimiter for the
+	// deferred proactive refreshes of the keys.
+	refreshReserved *sync.Map
 
-	// stopRefresh is used to signal the refresh goroutine to stop.
-	stopRefresh chan struct{}
+	// deferredRefreshes is the number of the proactive refreshes deferred due
+	// to refreshLimiter.
+	deferredRefreshes *atomic.Uint64
 
 	// cr is the caching resolver used for proactive refresh.
 	cr cachingResolver
 
+	// tracer creates the spans of the proactive refreshes.  It may be nil.
+	tracer trace.Tracer
+
+	// onRefresh, if not nil, is called after each proactive refresh, see
+	// [Config.OnCacheRefresh].
+	onRefresh CacheRefreshHandler
+
+	// events distributes the changes of the cache to the subscriptions, see
+	// [Proxy.SubscribeCacheEvents].
+	events *cacheEventHub
+
+	// rejectedRefreshes is the number of the refresh results rejected due to
+	// refreshGuard.
+	rejectedRefreshes *atomic.Uint64
+
+	// oversized is the number of the responses not cached since they exceed
+	// maxEntryBytes.
+	oversized *atomic.Uint64
+
+	// outage detects the upstream outages to stretch the lifetime of the
+	// expiring entries and to suppress the proactive refreshes.  It's nil if
+	// it's disabled.
+	outage *outageDetector
+
+	// memPressure detects the memory pressure to suppress the proactive
+	// refreshes.  It's nil if it's disabled.
+	memPressure *memoryPressure
+
+	// stale are the keys of the entries loaded from the cache file which
+	// should be revalidated, see [cache.startRevalidation].  It's only
+	// accessed on creation and start of the proxy.
+	stale []string
+
 	// logger is used for logging refresh operations.
 	logger *slog.Logger
 
-	// cacheMinTTL is the minimum TTL for cached DNS responses in seconds.
-	cacheMinTTL uint32
+	// clock is used to get the current time and to schedule the proactive
+	// refreshes.
+	clock cacheClock
 
-	// cacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
-	cacheMaxTTL uint32
+	// revalidateLoaded defines if the entries loaded from the cache file are
+	// served as stale until revalidated.
+	revalidateLoaded bool
+
+	// refreshGuard defines if the refresh results drastically worse than the
+	// cached responses are rejected, see [Config.CacheProactiveRefreshGuard].
+	refreshGuard bool
+
+	// refreshMinAnswers is the minimum number of answer records of a refresh
+	// result for refreshGuard.
+	refreshMinAnswers uint
+
+	// maxEntryBytes is the maximum size of a single entry in bytes.  Zero
+	// means no limit.
+	maxEntryBytes int
 }
 
 // requestStat tracks request statistics for a cache key.
 type requestStat struct {
 	// timestamps stores the request timestamps within the cooldown period.
 	timestamps []time.Time
-	// mu protects timestamps.
+	// interval is the exponentially weighted moving average of the intervals
+	// between the requests.  It's only tracked in the adaptive mode.
+	interval time.Duration
+	// hits is the number of the cache hits of the entry.
+	hits uint64
+	// mu protects timestamps, interval, and hits.
 	mu sync.Mutex
 }
 
@@ -100,13 +205,16 @@ type cacheItem struct {
 // respToItem converts the pair of the response and upstream resolved the one
 // into item for storing it in cache.  l must not be nil.
 func (c *cache) respToItem(m *dns.Msg, u upstream.Upstream, l *slog.Logger) (item *cacheItem) {
+	conf := c.settings.Load()
+
 	ttl := cacheTTL(m, l)
 	if ttl == 0 {
 		return nil
 	}
 
 	// Apply TTL overrides for cache storage.
-	ttl = respectTTLOverrides(ttl, c.cacheMinTTL, c.cacheMaxTTL)
+	minTTL, maxTTL := conf.ttlOverrides(m)
+	ttl = respectTTLOverrides(ttl, minTTL, maxTTL)
 
 	upsAddr := ""
 	if u != nil {
@@ -132,14 +240,38 @@ const (
 	minPackedLen = expTimeSz + packedMsgLenSz
 )
 
-// pack converts the ci into bytes slice.
-func (ci *cacheItem) pack() (packed []byte) {
-	pm, _ := ci.m.Pack()
+// packBufPool is the pool of the buffers to pack the cached messages into
+// before copying them into the cache items.
+var packBufPool = syncutil.NewSlicePool[byte](dns.MaxMsgSize)
+
+// msgPool is the pool of the DNS messages to unpack the cached data into.  Only
+// the messages which never leave the unpacking function are taken from it,
+// since the ones passed to the handlers and upstreams may be retained there.
+var msgPool = syncutil.NewPool(func() (m *dns.Msg) {
+	return &dns.Msg{}
+})
+
+// putMsg resets m and returns it to [msgPool].
+func putMsg(m *dns.Msg) {
+	*m = dns.Msg{
+		Question: m.Question[:0],
+	}
+
+	msgPool.Put(m)
+}
+
+// pack converts the ci into bytes slice with the expiration time counted from
+// now.
+func (ci *cacheItem) pack(now time.Time) (packed []byte) {
+	bufPtr := packBufPool.Get()
+	defer packBufPool.Put(bufPtr)
+
+	pm, _ := ci.m.PackBuffer(*bufPtr)
 	pmLen := len(pm)
 	packed = make([]byte, minPackedLen, minPackedLen+pmLen+len(ci.u))
 
 	// Put expiration time.
-	binary.BigEndian.PutUint32(packed, uint32(time.Now().Unix())+ci.ttl)
+	binary.BigEndian.PutUint32(packed, uint32(now.Unix())+ci.ttl)
 
 	// Put the length of the packed message.
 	binary.BigEndian.PutUint16(packed[expTimeSz:], uint16(pmLen))
@@ -155,38 +287,66 @@ func (ci *cacheItem) pack() (packed []byte) {
 
 // unpackItem converts the data into cacheItem using req as a request message.
 // expired is true if the item exists but expired.  The expired cached items are
-// only returned if c is optimistic and optimistic max age is not exceeded.  req
-// must not be nil.
+// only returned if c is optimistic and optimistic max age is not exceeded, or if
+// their lifetime is stretched due to an upstream outage.  req must not be nil.
 func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bool) {
 	if len(data) < minPackedLen {
 		return nil, false
 	}
 
-	b := bytes.NewBuffer(data)
-	expire := time.Unix(int64(binary.BigEndian.Uint32(b.Next(expTimeSz))), 0)
-	now := time.Now()
-	var ttl uint32
-	if expired = now.After(expire); expired {
-		optimisticExpire := expire.Add(c.optimisticMaxAge)
-		if !c.optimistic || now.After(optimisticExpire) {
-			return nil, expired
-		}
+	expire := packedExpire(data)
+	now := c.clock.Now()
+	if expired = now.After(expire); expired && !c.optimistic && !c.outage.isActive() {
+		return nil, expired
+	}
 
-		ttl = uint32(c.optimisticTTL.Seconds())
-	} else {
-		ttl = uint32(expire.Unix() - now.Unix())
+	m, u := unpackMsg(data)
+	if m == nil {
+		return nil, expired
+	}
+
+	// The records of m are moved into the resulting item, but m itself isn't
+	// retained.
+	defer putMsg(m)
+
+	ttl, expired, ok := c.itemTTL(m, expire, now)
+	if !ok {
+		return nil, expired
 	}
 
+	return newCacheItem(req, m, u, ttl), expired
+}
+
+// packedExpire returns the expiration time of the packed item data.  data must
+// be at least minPackedLen bytes long.
+func packedExpire(data []byte) (expire time.Time) {
+	return time.Unix(int64(binary.BigEndian.Uint32(data[:expTimeSz])), 0)
+}
+
+// unpackMsg returns the message and the upstream address from the packed item
+// data.  m is nil if data is malformed.  data must be at least minPackedLen
+// bytes long.  m is taken from [msgPool] and should be returned there with
+// [putMsg] once it's no longer used.
+func unpackMsg(data []byte) (m *dns.Msg, u string) {
+	b := bytes.NewBuffer(data[expTimeSz:])
 	l := int(binary.BigEndian.Uint16(b.Next(packedMsgLenSz)))
 	if l == 0 {
-		return nil, expired
+		return nil, ""
 	}
 
-	m := &dns.Msg{}
+	m = msgPool.Get()
 	if m.Unpack(b.Next(l)) != nil {
-		return nil, expired
+		putMsg(m)
+
+		return nil, ""
 	}
 
+	return m, string(b.Next(b.Len()))
+}
+
+// newCacheItem returns the cache item for req with the cached message m
+// received from the upstream with address u, served with ttl.
+func newCacheItem(req, m *dns.Msg, u string, ttl uint32) (ci *cacheItem) {
 	res := (&dns.Msg{}).SetRcode(req, m.Rcode)
 	res.AuthenticatedData = m.AuthenticatedData
 	res.RecursionAvailable = m.RecursionAvailable
@@ -200,11 +360,48 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	// If the request has DO bit set we only remove all the OPT RRs, and also
 	// all DNSSEC RRs otherwise.
 	filterMsg(res, m, req.AuthenticatedData, doBit, ttl)
+	restoreOwnerCase(res.Answer, req.Question[0].Name)
 
 	return &cacheItem{
 		m: res,
-		u: string(b.Next(b.Len())),
-	}, expired
+		u: u,
+	}
+}
+
+// restoreOwnerCase sets the owner names of rrs equal to qname regardless of the
+// case to qname, since the cached entry may have been received for the
+// question in another case, and some clients use it to mitigate the spoofing,
+// see https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00.
+func restoreOwnerCase(rrs []dns.RR, qname string) {
+	for _, rr := range rrs {
+		if hdr := rr.Header(); strings.EqualFold(hdr.Name, qname) {
+			hdr.Name = qname
+		}
+	}
+}
+
+// itemTTL returns the TTL of the response for the cached message m expiring at
+// expire.  expired is true if the entry should be served as stale.  ok is false
+// if the entry shouldn't be served at all.
+func (c *cache) itemTTL(m *dns.Msg, expire, now time.Time) (ttl uint32, expired, ok bool) {
+	if !now.After(expire) {
+		return uint32(expire.Unix() - now.Unix()), false, true
+	}
+
+	if c.outage.isActive() {
+		conf := c.settings.Load()
+		minTTL, maxTTL := conf.ttlOverrides(m)
+		ttl = respectTTLOverrides(calculateTTL(m), minTTL, maxTTL)
+		if stretched := c.outage.stretch(expire, ttl); now.Before(stretched) {
+			return uint32(stretched.Unix() - now.Unix()), false, true
+		}
+	}
+
+	if !c.optimistic || now.After(expire.Add(c.optimisticMaxAge)) {
+		return 0, true, false
+	}
+
+	return uint32(c.optimisticTTL.Seconds()), true, true
 }
 
 // initCache initializes cache if it's enabled.
@@ -215,65 +412,128 @@ func (p *Proxy) initCache() {
 		return
 	}
 
-	size := p.CacheSizeBytes
-	
+	conf := p.newCacheConfig()
+
+	p.logger.Info("cache enabled",
+		"size", conf.size,
+		"proactive_refresh_ms", conf.proactiveRefreshTime.Milliseconds(),
+		"cooldown_period_sec", int(conf.cooldownPeriod.Seconds()),
+		"cooldown_threshold", conf.cooldownThreshold,
+		"refresh_concurrency", conf.refreshConcurrency,
+	)
+
+	conf.clock = newCacheClock(p.time)
+	p.cache = newCache(conf)
+	p.cache.outage = newOutageDetector(p.CacheOutage, p.time, p.logger)
+	p.memPressure = newMemoryPressure(p.MemoryPressure, p.CacheSizeBytes, p.logger)
+	p.cache.memPressure = p.memPressure
+	p.shortFlighter = newOptimisticResolver(p)
+
+	// Set up proactive refresh if optimistic cache is enabled.  It's still
+	// disabled with a non-positive refresh time, but may be enabled by
+	// [Proxy.Reload].
+	if p.CacheOptimistic && p.CacheReplica == nil {
+		p.cache.cr = p
+		p.cache.tracer = p.tracer
+		p.cache.onRefresh = p.OnCacheRefresh
+		p.cache.logger = p.refreshLogger
+	}
+}
+
+// newCacheConfig returns the configuration of the cache from the corresponding
+// fields of c with the defaults applied.
+func (c *Config) newCacheConfig() (conf *cacheConfig) {
 	// Convert milliseconds to duration, default 30 seconds.
-	proactiveRefreshTimeMs := p.CacheProactiveRefreshTime
+	proactiveRefreshTimeMs := c.CacheProactiveRefreshTime
 	if proactiveRefreshTimeMs == 0 {
-		proactiveRefreshTimeMs = 30000
+		proactiveRefreshTimeMs = defaultProactiveRefreshTimeMs
 	}
-	proactiveRefreshTime := time.Duration(proactiveRefreshTimeMs) * time.Millisecond
 
 	// Convert cooldown period from seconds, default 30 minutes.
-	cooldownPeriodSec := p.CacheProactiveCooldownPeriod
+	cooldownPeriodSec := c.CacheProactiveCooldownPeriod
 	if cooldownPeriodSec == 0 {
 		cooldownPeriodSec = 1800
 	}
-	cooldownPeriod := time.Duration(cooldownPeriodSec) * time.Second
 
 	// Set cooldown threshold.
 	// If not set (0), use default 3.
 	// If set to negative, disable cooldown (treat as 0).
-	cooldownThreshold := p.CacheProactiveCooldownThreshold
+	cooldownThreshold := c.CacheProactiveCooldownThreshold
 	if cooldownThreshold == 0 {
 		cooldownThreshold = 3
 	} else if cooldownThreshold < 0 {
 		cooldownThreshold = 0
 	}
 
-	p.logger.Info("cache enabled",
-		"size", size,
-		"proactive_refresh_ms", proactiveRefreshTimeMs,
-		"cooldown_period_sec", cooldownPeriodSec,
-		"cooldown_threshold", cooldownThreshold,
-	)
+	staleTTL := c.CacheStaleIfErrorAnswerTTL
+	if staleTTL == 0 {
+		staleTTL = defaultStaleAnswerTTL
+	}
 
-	p.cache = newCache(&cacheConfig{
-		size:                 size,
-		optimisticTTL:        p.CacheOptimisticAnswerTTL,
-		optimisticMaxAge:     p.CacheOptimisticMaxAge,
-		proactiveRefreshTime: proactiveRefreshTime,
-		cooldownPeriod:       cooldownPeriod,
-		cooldownThreshold:    cooldownThreshold,
-		withECS:              p.EnableEDNSClientSubnet,
-		optimistic:           p.CacheOptimistic,
-		cacheMinTTL:          p.CacheMinTTL,
-		cacheMaxTTL:          p.CacheMaxTTL,
-	})
-	p.shortFlighter = newOptimisticResolver(p)
+	refreshMinAnswers := c.CacheProactiveRefreshMinAnswers
+	if refreshMinAnswers == 0 {
+		refreshMinAnswers = defaultRefreshMinAnswers
+	}
 
-	// Set up proactive refresh if optimistic cache is enabled.
-	if p.CacheOptimistic && proactiveRefreshTime > 0 {
-		p.cache.cr = p
-		p.cache.logger = p.logger
+	// Set the refresh concurrency limit.
+	// If not set (0), use default 4.
+	// If set to negative, don't limit it.
+	refreshConcurrency := c.CacheProactiveRefreshMaxConcurrent
+	if refreshConcurrency == 0 {
+		refreshConcurrency = 4
+	}
+
+	return &cacheConfig{
+		evictionPolicy:       c.CacheEvictionPolicy,
+		size:                 c.CacheSizeBytes,
+		maxEntries:           c.CacheMaxEntries,
+		shards:               cacheShardsNum(c.CacheSizeBytes, c.CacheMaxEntries, c.CacheShards),
+		maxEntryBytes:        c.CacheMaxEntryBytes,
+		optimisticTTL:        c.CacheOptimisticAnswerTTL,
+		optimisticMaxAge:     c.CacheOptimisticMaxAge,
+		staleMaxAge:          c.CacheStaleIfErrorMaxAge,
+		staleTTL:             staleTTL,
+		proactiveRefreshTime: time.Duration(proactiveRefreshTimeMs) * time.Millisecond,
+		cooldownPeriod:       time.Duration(cooldownPeriodSec) * time.Second,
+		cooldownThreshold:    cooldownThreshold,
+		adaptive:             c.CacheProactiveAdaptive,
+		refreshConcurrency:   refreshConcurrency,
+		maxRefreshQPS:        c.CacheProactiveMaxRefreshQPS,
+		domainPolicies:       c.DomainPolicies,
+		pinnedZones:          c.CacheProactivePinnedZones,
+		excludedZones:        c.CacheProactiveExcludedZones,
+		statsMaxEntries:      c.CacheProactiveStatsMaxEntries,
+		withECS:              c.EnableEDNSClientSubnet,
+		optimistic:           c.CacheOptimistic,
+		revalidateLoaded:     c.CacheOptimistic && c.CacheFileRevalidate,
+		refreshGuard:         c.CacheProactiveRefreshGuard,
+		refreshMinAnswers:    refreshMinAnswers,
+		cacheMinTTL:          c.CacheMinTTL,
+		cacheMaxTTL:          c.CacheMaxTTL,
 	}
 }
 
 // cacheConfig is the configuration structure for [cache].
 type cacheConfig struct {
+	// evictionPolicy defines which entries are evicted from the full cache
+	// first.  Empty value means [CacheEvictionPolicyLRU].
+	evictionPolicy CacheEvictionPolicy
+
 	// size is the cache size in bytes.
 	size int
 
+	// maxEntries is the maximum number of entries in each of the storages.
+	// Zero means no limit.
+	maxEntries int
+
+	// shards is the number of shards of the general cache.  Zero means a
+	// single shard.
+	shards uint
+
+	// maxEntryBytes is the maximum size of a single entry in bytes.  Zero
+	// means no limit.
+	maxEntryBytes int
+
 	// optimisticTTL is the default TTL for expired cached responses when
 	// optimistic is enabled.
 	optimisticTTL time.Duration
@@ -282,6 +542,14 @@ type cacheConfig struct {
 	// cache is optimistic.
 	optimisticMaxAge time.Duration
 
+	// staleMaxAge is the maximum time the expired entries are kept to be
+	// served when resolving fails, see [Config.CacheStaleIfErrorMaxAge].
+	// Zero means the expired entries aren't kept for that.
+	staleMaxAge time.Duration
+
+	// staleTTL is the TTL of the entries served due to staleMaxAge.
+	staleTTL time.Duration
+
 	// proactiveRefreshTime is the time before TTL expiration when entries
 	// should be proactively refreshed.
 	proactiveRefreshTime time.Duration
@@ -292,6 +560,34 @@ type cacheConfig struct {
 	// cooldownThreshold is the minimum number of requests for proactive refresh.
 	cooldownThreshold int
 
+	// adaptive defines if the cooldown threshold and the refresh lead time are
+	// tuned per entry from the request arrival rate.
+	adaptive bool
+
+	// refreshConcurrency is the maximum number of proactive refreshes performed
+	// at the same time.  Zero or negative value means no limit.
+	refreshConcurrency int
+
+	// maxRefreshQPS is the maximum number of proactive refreshes performed per
+	// second.  Zero or negative value means no limit.
+	maxRefreshQPS int
+
+	// domainPolicies are the policies for the domain names, see
+	// [Config.DomainPolicies].
+	domainPolicies []*DomainPolicy
+
+	// pinnedZones are the patterns of the domain names which are always
+	// refreshed regardless of the cooldown, see [newZonePatterns].
+	pinnedZones []string
+
+	// statsMaxEntries is the maximum number of the request statistics entries.
+	// If not positive, [defaultRequestStatsMaxEntries] is used.
+	statsMaxEntries int
+
+	// excludedZones are the patterns of the domain names which are never
+	// refreshed, see [newZonePatterns].
+	excludedZones []string
+
 	// withECS enables EDNS Client Subnet support for cache.
 	withECS bool
 
@@ -299,65 +595,173 @@ type cacheConfig struct {
 	// those again.
 	optimistic bool
 
+	// revalidateLoaded defines if the entries loaded from the cache file are
+	// marked as expired and revalidated in the background.  It requires
+	// optimistic.
+	revalidateLoaded bool
+
+	// refreshGuard defines if the refresh results drastically worse than the
+	// cached responses are rejected, see [Config.CacheProactiveRefreshGuard].
+	refreshGuard bool
+
+	// refreshMinAnswers is the minimum number of answer records of a refresh
+	// result for refreshGuard.
+	refreshMinAnswers uint
+
 	// cacheMinTTL is the minimum TTL for cached DNS responses.
 	cacheMinTTL uint32
 
 	// cacheMaxTTL is the maximum TTL for cached DNS responses.
 	cacheMaxTTL uint32
+
+	// clock is used to get the current time and to schedule the proactive
+	// refreshes.  If nil, the system clock is used.
+	clock cacheClock
 }
 
 // newCache returns a properly initialized cache.  logger must not be nil.
 func newCache(conf *cacheConfig) (c *cache) {
 	c = &cache{
-		itemsLock:            &sync.RWMutex{},
-		itemsWithSubnetLock:  &sync.RWMutex{},
-		items:                createCache(conf.size),
-		optimistic:           conf.optimistic,
-		optimisticTTL:        conf.optimisticTTL,
-		optimisticMaxAge:     conf.optimisticMaxAge,
-		proactiveRefreshTime: conf.proactiveRefreshTime,
-		cooldownPeriod:       conf.cooldownPeriod,
-		cooldownThreshold:    conf.cooldownThreshold,
-		refreshTimers:        &sync.Map{},
-		requestStats:         &sync.Map{},
-		stopRefresh:          make(chan struct{}),
-		cacheMinTTL:          conf.cacheMinTTL,
-		cacheMaxTTL:          conf.cacheMaxTTL,
-	}
+		shards:              max(conf.shards, 1),
+		itemsWithSubnetLock: &sync.RWMutex{},
+		events:              newCacheEventHub(),
+		optimistic:          conf.optimistic,
+		revalidateLoaded:    conf.revalidateLoaded,
+		refreshGuard:        conf.refreshGuard,
+		refreshMinAnswers:   conf.refreshMinAnswers,
+		rejectedRefreshes:   &atomic.Uint64{},
+		oversized:           &atomic.Uint64{},
+		maxEntryBytes:       conf.maxEntryBytes,
+		optimisticTTL:       conf.optimisticTTL,
+		optimisticMaxAge:    conf.optimisticMaxAge,
+		staleMaxAge:         conf.staleMaxAge,
+		staleTTL:            conf.staleTTL,
+		refreshTimers:       &sync.Map{},
+		requestStats:        newRequestStatsStore(conf.statsMaxEntries),
+		refreshFailures:     &sync.Map{},
+		prefetched:          &sync.Map{},
+		refreshStopped:      &atomic.Bool{},
+		refreshPausedUntil:  &atomic.Int64{},
+		refreshesRunning:    &atomic.Int64{},
+		refreshesInFlight:   &atomic.Int64{},
+		refreshMu:           &sync.RWMutex{},
+		refreshReserved:     &sync.Map{},
+		deferredRefreshes:   &atomic.Uint64{},
+		journal:             &atomic.Pointer[cacheJournal]{},
+		settings:            &atomic.Pointer[cacheSettings]{},
+		clock:               conf.clock,
+	}
+
+	if c.clock == nil {
+		c.clock = newCacheClock(nil)
+	}
+
+	c.refreshLimiter = newRefreshRateLimiter(c.clock, conf.maxRefreshQPS)
+
+	c.items = createCache(
+		conf.size,
+		conf.maxEntries,
+		conf.evictionPolicy,
+		conf.shards,
+		c.onEvicted(false),
+	)
+
+	c.setSettings(conf)
 
 	if conf.withECS {
-		c.itemsWithSubnet = createCache(conf.size)
+		// The subnet cache isn't sharded, since a single lookup in it goes
+		// through the keys of several subnets, which must be consistent with
+		// each other, so it's protected by itemsWithSubnetLock as a whole.
+		c.itemsWithSubnet = createCache(
+			conf.size,
+			conf.maxEntries,
+			conf.evictionPolicy,
+			1,
+			c.onEvicted(true),
+		)
+	}
+
+	if conf.refreshConcurrency > 0 {
+		c.refreshSema = syncutil.NewChanSemaphore(uint(conf.refreshConcurrency))
+	} else {
+		c.refreshSema = syncutil.EmptySemaphore{}
 	}
 
 	return c
 }
 
+// cacheSettings are the settings of [cache] which may be changed while it's
+// used.  See the corresponding fields of [cacheConfig].
+type cacheSettings struct {
+	// policies are the policies for the domain names including the pinned and
+	// the excluded zones.  It's nil if there are none.
+	policies *domainPolicyTable
+
+	// proactiveRefreshTime is the time before TTL expiration when entries
+	// should be proactively refreshed.
+	proactiveRefreshTime time.Duration
+
+	// cooldownPeriod is the time window to track request frequency.
+	cooldownPeriod time.Duration
+
+	// cooldownThreshold is the minimum number of requests for proactive refresh.
+	cooldownThreshold int
+
+	// cacheMinTTL is the minimum TTL for cached DNS responses in seconds.
+	cacheMinTTL uint32
+
+	// cacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
+	cacheMaxTTL uint32
+
+	// adaptive defines if the cooldown threshold and the refresh lead time are
+	// tuned per entry from the request arrival rate.
+	adaptive bool
+}
+
+// setSettings replaces the settings of c with the ones from conf, the rest of
+// conf is ignored.  It's safe for concurrent use.  The already scheduled
+// refreshes aren't rescheduled.
+func (c *cache) setSettings(conf *cacheConfig) {
+	c.settings.Store(&cacheSettings{
+		policies:             newDomainPolicyTable(conf.domainPolicies, conf.excludedZones, conf.pinnedZones),
+		proactiveRefreshTime: conf.proactiveRefreshTime,
+		cooldownPeriod:       conf.cooldownPeriod,
+		cooldownThreshold:    conf.cooldownThreshold,
+		cacheMinTTL:          conf.cacheMinTTL,
+		cacheMaxTTL:          conf.cacheMaxTTL,
+		adaptive:             conf.adaptive,
+	})
+}
+
 // get returns cached item for the req if it's found.  expired is true if the
 // item's TTL is expired.  key is the resulting key for req.  It's returned to
 // avoid recalculating it afterwards.
 func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
-	c.itemsLock.RLock()
-	defer c.itemsLock.RUnlock()
+	conf := c.settings.Load()
 
 	if !canLookUpInCache(c.items, req) {
 		return nil, false, nil
 	}
 
 	key = msgToKey(req)
+
 	data := c.items.Get(key)
 	if data == nil {
 		return nil, false, key
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
+	if ci, expired = c.unpackItem(data, req); ci == nil && !c.keepsStale(data) {
+		// The response stored for key concurrently may be removed as well,
+		// which only causes another upstream request for it.
 		c.items.Del(key)
+		c.emitRemoved(CacheEventExpiry, data, false)
 	} else {
 		// Record request for cooldown mechanism.
-		justReachedThreshold := c.recordRequest(key)
+		justReachedThreshold := c.recordRequest(key, true)
 
 		// If we just reached the threshold and haven't scheduled refresh yet,
 		// try to schedule it now (for dynamic threshold activation).
-		if justReachedThreshold && c.optimistic && c.proactiveRefreshTime > 0 && c.cr != nil {
+		if justReachedThreshold && c.optimistic && conf.proactiveRefreshTime > 0 && c.cr != nil {
 			c.tryScheduleRefresh(key, req)
 		}
 	}
@@ -372,6 +776,8 @@ func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
 // Note that a slow longest-prefix-match algorithm is used, so cache searches
 // are performed up to mask+1 times.
 func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expired bool, k []byte) {
+	conf := c.settings.Load()
+
 	c.itemsWithSubnetLock.RLock()
 	defer c.itemsWithSubnetLock.RUnlock()
 
@@ -420,13 +826,14 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 
 	if ci, expired = c.unpackItem(data, req); ci == nil {
 		c.itemsWithSubnet.Del(k)
+		c.emitRemoved(CacheEventExpiry, data, true)
 	} else {
 		// Record request for cooldown mechanism.
-		justReachedThreshold := c.recordRequest(k)
+		justReachedThreshold := c.recordRequest(k, true)
 
 		// If we just reached the threshold and haven't scheduled refresh yet,
 		// try to schedule it now (for dynamic threshold activation).
-		if justReachedThreshold && c.optimistic && c.proactiveRefreshTime > 0 && c.cr != nil {
+		if justReachedThreshold && c.optimistic && conf.proactiveRefreshTime > 0 && c.cr != nil {
 			c.tryScheduleRefresh(k, req)
 		}
 	}
@@ -440,56 +847,103 @@ func canLookUpInCache(cache glcache.Cache, req *dns.Msg) (ok bool) {
 	return cache != nil && req != nil && len(req.Question) == 1
 }
 
-// createCache returns new Cache with the given cacheSize.
-func createCache(cacheSize int) (glc glcache.Cache) {
-	conf := glcache.Config{
-		MaxSize:   defaultCacheSize,
-		EnableLRU: true,
+// createCache returns new Cache with the given cacheSize, maximum number of
+// entries, eviction policy, and number of shards.
+func createCache(
+	cacheSize int,
+	maxEntries int,
+	pol CacheEvictionPolicy,
+	shards uint,
+	onDelete func(key, val []byte),
+) (glc glcache.Cache) {
+	conf := &cachestore.Config{
+		OnDelete: onDelete,
+		MaxSize:  defaultCacheSize,
+		Policy:   pol.storePolicy(),
 	}
 
 	if cacheSize > 0 {
 		conf.MaxSize = uint(cacheSize)
 	}
 
-	return glcache.New(conf)
+	if maxEntries > 0 {
+		conf.MaxCount = uint(maxEntries)
+	}
+
+	if shards > 1 {
+		return cachestore.NewSharded(conf, shards)
+	}
+
+	return cachestore.New(conf)
+}
+
+// sizeLimitedCache is a cache which maximum size could be changed.
+type sizeLimitedCache interface {
+	SetMaxSize(size uint)
+}
+
+// setMaxSize sets the maximum size of the storages of c in bytes and evicts the
+// entries exceeding it.
+func (c *cache) setMaxSize(size uint) {
+	for _, items := range []glcache.Cache{c.items, c.itemsWithSubnet} {
+		// The storages are always created with [createCache].
+		if s, ok := items.(sizeLimitedCache); ok {
+			s.SetMaxSize(size)
+		}
+	}
 }
 
 // set stores response and upstream in the cache.  l must not be nil.
 func (c *cache) set(m *dns.Msg, u upstream.Upstream, l *slog.Logger) {
+	conf := c.settings.Load()
+
 	item := c.respToItem(m, u, l)
 	if item == nil {
 		return
 	}
 
 	key := msgToKey(m)
-	packed := item.pack()
-
-	c.itemsLock.Lock()
-	defer c.itemsLock.Unlock()
+	packed := item.pack(c.clock.Now())
+	if c.isOversized(key, packed, l) {
+		return
+	}
 
-	c.items.Set(key, packed)
+	replaced := c.items.Set(key, packed)
+	c.journalItem(cacheRecordItem, key, packed)
+	c.emitStored(m, replaced, false)
+	c.prefetched.Delete(string(key))
+	c.refreshFailures.Delete(string(key))
 
 	// Record this as a request for cooldown mechanism.
-	justReachedThreshold := c.recordRequest(key)
+	justReachedThreshold := c.recordRequest(key, false)
 
 	// Schedule proactive refresh if enabled.
-	if c.optimistic && item.ttl > 0 && c.proactiveRefreshTime > 0 && c.cr != nil {
+	if c.optimistic && item.ttl > 0 && conf.proactiveRefreshTime > 0 && c.cr != nil {
 		// First try normal scheduling (checks cooldown)
 		c.scheduleRefresh(key, item.ttl, m)
-		
+
 		// If we just reached threshold but scheduling was skipped earlier,
 		// the scheduleRefresh above will now succeed because shouldProactiveRefresh
 		// will return true. No need for additional logic here.
-	} else if justReachedThreshold && c.optimistic && c.proactiveRefreshTime > 0 && c.cr != nil {
+	} else if justReachedThreshold && c.optimistic && conf.proactiveRefreshTime > 0 && c.cr != nil {
 		// Edge case: if we just reached threshold but TTL is 0,
 		// we still won't schedule (which is correct behavior)
 	}
 }
 
+// journalItem appends the stored item to the journal, if any.
+func (c *cache) journalItem(kind cacheRecordKind, key, packed []byte) {
+	if j := c.journal.Load(); j != nil {
+		j.append(kind, key, packed)
+	}
+}
+
 // setWithSubnet stores response and upstream with subnet in the cache.  The
 // given subnet mask and IP address are used to calculate the cache key.  l must
 // not be nil.
 func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, subnet *net.IPNet, l *slog.Logger) {
+	conf := c.settings.Load()
+
 	item := c.respToItem(m, u, l)
 	if item == nil {
 		return
@@ -497,27 +951,31 @@ func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, subnet *net.IPNet
 
 	pref, _ := subnet.Mask.Size()
 	key := msgToKeyWithSubnet(m, subnet.IP.Mask(subnet.Mask), pref)
-	packed := item.pack()
+	packed := item.pack(c.clock.Now())
+	if c.isOversized(key, packed, l) {
+		return
+	}
 
 	c.itemsWithSubnetLock.Lock()
 	defer c.itemsWithSubnetLock.Unlock()
 
-	c.itemsWithSubnet.Set(key, packed)
+	replaced := c.itemsWithSubnet.Set(key, packed)
+	c.journalItem(cacheRecordItemWithSubnet, key, packed)
+	c.emitStored(m, replaced, true)
+	c.prefetched.Delete(string(key))
+	c.refreshFailures.Delete(string(key))
 
 	// Record this as a request for cooldown mechanism.
-	c.recordRequest(key)
+	c.recordRequest(key, false)
 
 	// Schedule proactive refresh if enabled.
-	if c.optimistic && item.ttl > 0 && c.proactiveRefreshTime > 0 && c.cr != nil {
+	if c.optimistic && item.ttl > 0 && conf.proactiveRefreshTime > 0 && c.cr != nil {
 		c.scheduleRefresh(key, item.ttl, m)
 	}
 }
 
 // clearItems empties the simple cache.
 func (c *cache) clearItems() {
-	c.itemsLock.Lock()
-	defer c.itemsLock.Unlock()
-
 	c.items.Clear()
 	c.cancelAllTimers()
 }
@@ -597,11 +1055,18 @@ func hasIPAns(m *dns.Msg) (ok bool) {
 }
 
 // isCacheableSucceded returns true if m contains useful data to be cached
-// treating it as a successful response.
+// treating it as a successful response.  The responses to SVCB and HTTPS
+// requests are only cached if they contain the records of the requested type,
+// just like the ones to A and AAAA requests.
 func isCacheableSucceded(m *dns.Msg) (ok bool) {
-	qType := m.Question[0].Qtype
-
-	return (qType != dns.TypeA && qType != dns.TypeAAAA) || hasIPAns(m) || isCacheableNegative(m)
+	switch qType := m.Question[0].Qtype; {
+	case qType == dns.TypeA, qType == dns.TypeAAAA:
+		return hasIPAns(m) || isCacheableNegative(m)
+	case isSVCBType(qType):
+		return hasAnsOfType(m, qType) || isCacheableNegative(m)
+	default:
+		return true
+	}
 }
 
 // isCacheableNegative returns true if m's header has at least a single SOA RR
@@ -686,19 +1151,27 @@ func respectTTLOverrides(ttl, cacheMinTTL, cacheMaxTTL uint32) uint32 {
 }
 
 // msgToKey constructs the cache key from type, class and question's name of m.
+// The name is canonicalized, see [cacheKeyName].
 func msgToKey(m *dns.Msg) (b []byte) {
 	q := m.Question[0]
-	name := q.Name
+	name := cacheKeyName(q.Name)
 	b = make([]byte, packedMsgLenSz+packedMsgLenSz+len(name))
 
 	// Put QTYPE, QCLASS, and QNAME.
 	binary.BigEndian.PutUint16(b, q.Qtype)
 	binary.BigEndian.PutUint16(b[packedMsgLenSz:], q.Qclass)
-	copy(b[2*packedMsgLenSz:], strings.ToLower(name))
+	copy(b[2*packedMsgLenSz:], name)
 
 	return b
 }
 
+// cacheKeyName returns the canonical form of the question name for the cache
+// keys, so that the names differing only in the case, e.g. due to DNS 0x20,
+// and the trailing dot share the same entry and the same proactive refresh.
+func cacheKeyName(name string) (canon string) {
+	return dns.CanonicalName(name)
+}
+
 const (
 	// keyMaskIndex is the index of the byte with mask ones value.
 	keyMaskIndex = 1 + 2*packedMsgLenSz
@@ -708,11 +1181,12 @@ const (
 )
 
 // msgToKeyWithSubnet constructs the cache key from DO bit, type, class, subnet
-// mask, client's IP address and question's name of m.  ecsIP is expected to be
-// masked already.
+// mask, client's IP address and question's name of m.  The name is
+// canonicalized, see [cacheKeyName].  ecsIP is expected to be masked already.
 func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
 	q := m.Question[0]
-	keyLen := keyIPIndex + len(q.Name)
+	name := cacheKeyName(q.Name)
+	keyLen := keyIPIndex + len(name)
 	masked := mask != 0
 	if masked {
 		keyLen += len(ecsIP)
@@ -740,7 +1214,7 @@ func msgToKeyWithSubnet(m *dns.Msg, ecsIP net.IP, mask int) (key []byte) {
 		k += copy(key[keyIPIndex:], ecsIP)
 	}
 
-	copy(key[k:], strings.ToLower(q.Name))
+	copy(key[k:], name)
 
 	return key
 }
@@ -807,27 +1281,40 @@ func filterMsg(dst, m *dns.Msg, ad, do bool, ttl uint32) {
 	dst.Extra = filterRRSlice(m.Extra, do, ttl, dns.TypeNone)
 }
 
-// recordRequest records a cache hit for cooldown mechanism.
-// Returns true if the request count just reached the threshold.
-func (c *cache) recordRequest(key []byte) (justReachedThreshold bool) {
-	if c.cooldownThreshold <= 0 {
+// recordRequest records a request for cooldown mechanism.  hit is true if the
+// request has been answered from the cache.  Returns true if the request count
+// just reached the threshold.
+func (c *cache) recordRequest(key []byte, hit bool) (justReachedThreshold bool) {
+	conf := c.settings.Load()
+
+	if conf.cooldownThreshold <= 0 {
 		return false
 	}
 
 	keyStr := string(key)
-	now := time.Now()
+	now := c.clock.Now()
 
 	// Get or create request stat.
-	val, _ := c.requestStats.LoadOrStore(keyStr, &requestStat{
-		timestamps: make([]time.Time, 0, c.cooldownThreshold),
+	stat := c.requestStats.loadOrStore(keyStr, func() (s *requestStat) {
+		return &requestStat{
+			timestamps: make([]time.Time, 0, conf.cooldownThreshold),
+		}
 	})
 
-	stat := val.(*requestStat)
 	stat.mu.Lock()
 	defer stat.mu.Unlock()
 
+	if hit {
+		stat.hits++
+	}
+
+	wasHot := c.isHot(stat, now)
+	if n := len(stat.timestamps); conf.adaptive && n > 0 {
+		stat.interval = nextInterval(stat.interval, now.Sub(stat.timestamps[n-1]))
+	}
+
 	// Count valid timestamps before adding new one.
-	cutoff := now.Add(-c.cooldownPeriod)
+	cutoff := now.Add(-conf.cooldownPeriod)
 	validCount := 0
 	for _, ts := range stat.timestamps {
 		if ts.After(cutoff) {
@@ -835,7 +1322,7 @@ func (c *cache) recordRequest(key []byte) (justReachedThreshold bool) {
 		}
 	}
 
-	wasUnderThreshold := validCount < c.cooldownThreshold
+	wasUnderThreshold := validCount < conf.cooldownThreshold
 
 	// Remove timestamps outside the cooldown period.
 	validTimestamps := make([]time.Time, 0, len(stat.timestamps))
@@ -845,13 +1332,21 @@ func (c *cache) recordRequest(key []byte) (justReachedThreshold bool) {
 		}
 	}
 
-	// Add current timestamp.
+	// Add current timestamp.  Only the latest timestamps up to the threshold
+	// matter, so don't keep more to bound the memory used by the hot entries.
 	validTimestamps = append(validTimestamps, now)
+	if extra := len(validTimestamps) - conf.cooldownThreshold; extra > 0 {
+		validTimestamps = validTimestamps[extra:]
+	}
 	stat.timestamps = validTimestamps
 
+	if conf.adaptive {
+		return !wasHot && c.isHot(stat, now)
+	}
+
 	// Check if we just reached the threshold.
 	newValidCount := len(validTimestamps)
-	justReachedThreshold = wasUnderThreshold && newValidCount >= c.cooldownThreshold
+	justReachedThreshold = wasUnderThreshold && newValidCount >= conf.cooldownThreshold
 
 	return justReachedThreshold
 }
@@ -859,39 +1354,157 @@ func (c *cache) recordRequest(key []byte) (justReachedThreshold bool) {
 // shouldProactiveRefresh checks if a cache entry should be proactively refreshed
 // based on the cooldown mechanism.
 func (c *cache) shouldProactiveRefresh(key []byte) bool {
-	if c.cooldownThreshold <= 0 {
+	conf := c.settings.Load()
+
+	if conf.cooldownThreshold <= 0 {
 		// Cooldown disabled, always refresh.
 		return true
 	}
 
-	keyStr := string(key)
-	val, ok := c.requestStats.Load(keyStr)
+	if conf.adaptive {
+		return c.isHotKey(string(key))
+	}
+
+	validCount, ok := c.requestCount(string(key))
 	if !ok {
 		// No request history, don't refresh.
 		return false
 	}
 
-	stat := val.(*requestStat)
+	// Check if request count meets threshold.
+	return validCount >= conf.cooldownThreshold
+}
+
+// requestCount returns the number of requests for the entry with keyStr within
+// the cooldown period.  ok is false if there is no request history for it.
+func (c *cache) requestCount(keyStr string) (n int, ok bool) {
+	conf := c.settings.Load()
+
+	stat, ok := c.requestStats.load(keyStr)
+	if !ok {
+		return 0, false
+	}
+
 	stat.mu.Lock()
 	defer stat.mu.Unlock()
 
-	// Clean up old timestamps.
-	now := time.Now()
-	cutoff := now.Add(-c.cooldownPeriod)
-	validCount := 0
+	cutoff := c.clock.Now().Add(-conf.cooldownPeriod)
 	for _, ts := range stat.timestamps {
 		if ts.After(cutoff) {
-			validCount++
+			n++
 		}
 	}
 
-	// Check if request count meets threshold.
-	return validCount >= c.cooldownThreshold
+	return n, true
+}
+
+const (
+	// minRefreshBackoff is the delay before retrying the first failed
+	// proactive refresh of an entry.
+	minRefreshBackoff = 5 * time.Second
+
+	// maxRefreshBackoff is the maximum delay between retries of failed
+	// proactive refreshes of an entry.
+	maxRefreshBackoff = 30 * time.Minute
+)
+
+// refreshBackoff tracks the failed proactive refreshes of a cache entry.
+type refreshBackoff struct {
+	// next is the time before which the entry shouldn't be resolved again.
+	next time.Time
+
+	// failures is the number of consecutive failed refreshes.
+	failures uint
+
+	// mu protects next and failures.
+	mu sync.Mutex
+}
+
+// refreshBackoffDelay returns the delay before the next refresh after the
+// given number of consecutive failures, which must be positive.  The delay is
+// doubled on each failure and is capped by [maxRefreshBackoff].
+func refreshBackoffDelay(failures uint) (d time.Duration) {
+	d = minRefreshBackoff
+	for range failures - 1 {
+		if d >= maxRefreshBackoff/2 {
+			return maxRefreshBackoff
+		}
+
+		d *= 2
+	}
+
+	return d
+}
+
+// recordRefreshFailure registers the failed refresh of the entry with keyStr
+// and returns the delay before the next attempt.
+func (c *cache) recordRefreshFailure(keyStr string) (delay time.Duration) {
+	val, _ := c.refreshFailures.LoadOrStore(keyStr, &refreshBackoff{})
+	b := val.(*refreshBackoff)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	delay = refreshBackoffDelay(b.failures)
+	b.next = c.clock.Now().Add(delay)
+
+	return delay
+}
+
+// isBackingOff returns true if the last refresh of the entry for key has
+// failed and its backoff delay hasn't passed yet.
+func (c *cache) isBackingOff(key []byte) (ok bool) {
+	val, ok := c.refreshFailures.Load(string(key))
+	if !ok {
+		return false
+	}
+
+	b := val.(*refreshBackoff)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return c.clock.Now().Before(b.next)
+}
+
+// hasEntry returns true if either general or subnet cache contains the entry
+// for key.
+func (c *cache) hasEntry(key []byte) (ok bool) {
+	ok = c.items.Get(key) != nil
+
+	if ok || c.itemsWithSubnet == nil {
+		return ok
+	}
+
+	c.itemsWithSubnetLock.RLock()
+	defer c.itemsWithSubnetLock.RUnlock()
+
+	return c.itemsWithSubnet.Get(key) != nil
+}
+
+// scheduleRetry schedules the retry of the failed proactive refresh of the
+// entry with keyStr after delay.
+func (c *cache) scheduleRetry(keyStr string, m *dns.Msg, delay time.Duration) {
+	if c.refreshStopped.Load() {
+		return
+	}
+
+	timer := c.clock.AfterFunc(delay, func() {
+		c.executeRefresh(keyStr, m)
+	})
+
+	c.refreshTimers.Store(keyStr, &refreshTimerEntry{
+		at:    c.clock.Now().Add(delay),
+		timer: timer,
+		msg:   m,
+	})
 }
 
 // refreshTimerEntry stores the timer and DNS message for a cache entry.
 type refreshTimerEntry struct {
-	timer *time.Timer
+	// at is the time the refresh is scheduled at.
+	at    time.Time
+	timer cacheTimer
 	msg   *dns.Msg
 }
 
@@ -899,6 +1512,12 @@ type refreshTimerEntry struct {
 // when the request threshold is dynamically reached. It retrieves the cached item
 // to get the TTL and then schedules the refresh.
 func (c *cache) tryScheduleRefresh(key []byte, req *dns.Msg) {
+	conf := c.settings.Load()
+
+	if c.refreshStopped.Load() || conf.refreshPolicy(req) == DomainRefreshExcluded {
+		return
+	}
+
 	// Check if already scheduled.
 	keyStr := string(key)
 	if _, exists := c.refreshTimers.Load(keyStr); exists {
@@ -907,9 +1526,7 @@ func (c *cache) tryScheduleRefresh(key []byte, req *dns.Msg) {
 	}
 
 	// Get the cached item to extract TTL.
-	c.itemsLock.RLock()
 	data := c.items.Get(key)
-	c.itemsLock.RUnlock()
 
 	if data == nil {
 		return
@@ -921,8 +1538,8 @@ func (c *cache) tryScheduleRefresh(key []byte, req *dns.Msg) {
 	}
 
 	expire := time.Unix(int64(binary.BigEndian.Uint32(data[:expTimeSz])), 0)
-	now := time.Now()
-	
+	now := c.clock.Now()
+
 	// Calculate remaining TTL.
 	if now.After(expire) {
 		// Already expired, no point in scheduling.
@@ -930,7 +1547,7 @@ func (c *cache) tryScheduleRefresh(key []byte, req *dns.Msg) {
 	}
 
 	remainingTTL := expire.Sub(now)
-	refreshDelay := remainingTTL - c.proactiveRefreshTime
+	refreshDelay := remainingTTL - c.refreshLead(keyStr)
 
 	if refreshDelay <= 0 {
 		// Too late to schedule, would refresh immediately or in the past.
@@ -941,12 +1558,13 @@ func (c *cache) tryScheduleRefresh(key []byte, req *dns.Msg) {
 	msgCopy := req.Copy()
 
 	// Create timer that will trigger the refresh.
-	timer := time.AfterFunc(refreshDelay, func() {
+	timer := c.clock.AfterFunc(refreshDelay, func() {
 		c.executeRefresh(keyStr, msgCopy)
 	})
 
 	// Store the timer entry.
 	c.refreshTimers.Store(keyStr, &refreshTimerEntry{
+		at:    c.clock.Now().Add(refreshDelay),
 		timer: timer,
 		msg:   msgCopy,
 	})
@@ -961,8 +1579,19 @@ func (c *cache) tryScheduleRefresh(key []byte, req *dns.Msg) {
 // scheduleRefresh schedules a proactive refresh for a cache entry.
 // key is the cache key, ttl is the TTL in seconds, m is the DNS message.
 func (c *cache) scheduleRefresh(key []byte, ttl uint32, m *dns.Msg) {
+	conf := c.settings.Load()
+
+	if c.refreshStopped.Load() {
+		return
+	}
+
+	rp := conf.refreshPolicy(m)
+	if rp == DomainRefreshExcluded {
+		return
+	}
+
 	// Check cooldown mechanism first.
-	if !c.shouldProactiveRefresh(key) {
+	if rp != DomainRefreshPinned && !c.shouldProactiveRefresh(key) {
 		if c.logger != nil && len(m.Question) > 0 {
 			c.logger.Debug("skipping proactive refresh due to low request frequency",
 				"domain", m.Question[0].Name)
@@ -978,9 +1607,9 @@ func (c *cache) scheduleRefresh(key []byte, ttl uint32, m *dns.Msg) {
 		}
 	}
 
-	// Calculate when to refresh (TTL - proactiveRefreshTime).
+	// Calculate when to refresh (TTL - refresh lead time).
 	ttlDuration := time.Duration(ttl) * time.Second
-	refreshDelay := ttlDuration - c.proactiveRefreshTime
+	refreshDelay := ttlDuration - c.refreshLead(keyStr)
 	if refreshDelay <= 0 {
 		// TTL is too short, don't schedule refresh.
 		return
@@ -990,58 +1619,283 @@ func (c *cache) scheduleRefresh(key []byte, ttl uint32, m *dns.Msg) {
 	msgCopy := m.Copy()
 
 	// Create timer that will trigger the refresh.
-	timer := time.AfterFunc(refreshDelay, func() {
+	timer := c.clock.AfterFunc(refreshDelay, func() {
 		c.executeRefresh(keyStr, msgCopy)
 	})
 
 	// Store the timer entry.
 	c.refreshTimers.Store(keyStr, &refreshTimerEntry{
+		at:    c.clock.Now().Add(refreshDelay),
 		timer: timer,
 		msg:   msgCopy,
 	})
 }
 
-// executeRefresh executes the proactive refresh for a cache entry.
+// executeRefresh executes the proactive refresh for a cache entry.  It's
+// called by the timers, which already run it in a separate goroutine, see
+// [cacheClock.AfterFunc].  The refreshes and the retries scheduled before the
+// domain name has been excluded from refreshing are dropped.
 func (c *cache) executeRefresh(keyStr string, m *dns.Msg) {
 	// Remove the timer entry.
 	_, ok := c.refreshTimers.LoadAndDelete(keyStr)
-	if !ok {
+	if !ok || c.refreshStopped.Load() {
+		return
+	}
+
+	if c.settings.Load().refreshPolicy(m) == DomainRefreshExcluded {
+		c.refreshFailures.Delete(keyStr)
+		c.refreshReserved.Delete(keyStr)
+
 		return
 	}
 
-	go c.refreshEntry(m)
+	c.refreshEntry(keyStr, m)
 }
 
-// refreshEntry attempts to refresh a single cache entry by resolving it again.
-func (c *cache) refreshEntry(m *dns.Msg) {
-	defer slogutil.RecoverAndLog(context.TODO(), c.logger)
+// refreshEntry attempts to refresh a single cache entry with the given key by
+// resolving it again.
+func (c *cache) refreshEntry(keyStr string, m *dns.Msg) {
+	ctx := c.cr.runContext()
+	defer slogutil.RecoverAndLog(ctx, c.logger)
 
 	if m == nil || len(m.Question) == 0 {
 		return
 	}
 
+	c.refreshMu.RLock()
+	defer c.refreshMu.RUnlock()
+
+	c.refreshesRunning.Add(1)
+	defer c.refreshesRunning.Add(-1)
+
+	err := c.refreshSema.Acquire(ctx)
+	if err != nil {
+		// The context is canceled on shutdown.
+		return
+	}
+	defer c.refreshSema.Release()
+
+	c.refreshesInFlight.Add(1)
+	defer c.refreshesInFlight.Add(-1)
+
+	if c.refreshStopped.Load() {
+		return
+	}
+
+	if c.outage.isActive() {
+		c.suppressRefresh(keyStr, m, "upstream outage", c.outage.window)
+
+		return
+	}
+
+	if c.memPressure.isActive() {
+		c.suppressRefresh(keyStr, m, "memory pressure", c.memPressure.interval)
+
+		return
+	}
+
+	if until := time.Unix(0, c.refreshPausedUntil.Load()); c.clock.Now().Before(until) {
+		c.postponeRefresh(keyStr, m, until)
+
+		return
+	}
+
+	if !c.takeRefreshToken(keyStr, m) {
+		return
+	}
+
 	dctx := &DNSContext{
-		Req: m.Copy(),
+		Req:       m.Copy(),
+		isRefresh: true,
 	}
 
-	ok, err := c.cr.replyFromUpstream(dctx)
-	if err != nil {
-		c.logger.Debug("proactive cache refresh failed", slogutil.KeyError, err)
+	var old *dns.Msg
+	if c.onRefresh != nil || c.refreshGuard {
+		old = c.peek(dctx.Req)
+	}
+
+	ctx, span := c.startRefreshSpan(ctx, dctx.Req)
+
+	defer func() { endSpan(span, dctx.Res, err) }()
+
+	ok, err := c.cr.replyFromUpstream(ctx, dctx)
+	if err == nil && ok && c.isWorseRefresh(old, dctx.Res) {
+		c.rejectedRefreshes.Add(1)
+		err = errRefreshRejected
+	}
+
+	if err != nil || !ok {
+		c.handleRefreshFailure(keyStr, m, err)
+		if err == nil {
+			err = errNotCacheable
+		}
+
+		c.notifyRefresh(m, old, nil, err)
+
+		return
+	}
+
+	c.refreshFailures.Delete(keyStr)
+	c.cr.cacheResp(dctx)
+	c.prefetched.Store(keyStr, struct{}{})
+	c.logger.Debug("proactively refreshed cache entry", "domain", m.Question[0].Name)
+	c.notifyRefresh(m, old, dctx.Res, nil)
+}
+
+// peek returns the response cached for req without affecting the request
+// statistics, or nil if there is none.  req must not be nil.
+func (c *cache) peek(req *dns.Msg) (resp *dns.Msg) {
+	if !canLookUpInCache(c.items, req) {
+		return nil
+	}
+
+	key := msgToKey(req)
+
+	data := c.items.Get(key)
+	if data == nil {
+		return nil
+	}
+
+	ci, _ := c.unpackItem(data, req)
+	if ci == nil {
+		return nil
+	}
+
+	return ci.m
+}
+
+// notifyRefresh calls [cache.onRefresh], if any, for the proactive refresh of
+// the entry for m.
+func (c *cache) notifyRefresh(m, oldResp, newResp *dns.Msg, err error) {
+	if c.onRefresh == nil {
+		return
+	}
+
+	q := m.Question[0]
+	c.onRefresh(q.Name, q.Qtype, oldResp, newResp, err)
+}
+
+// handleRefreshFailure backs off the proactive refresh of the entry with keyStr
+// after an unsuccessful attempt.  The existing entry is kept in the cache, so
+// that optimistic cache continues serving it.  The retries stop once the entry
+// leaves the cache.
+func (c *cache) handleRefreshFailure(keyStr string, m *dns.Msg, err error) {
+	if !c.hasEntry([]byte(keyStr)) {
+		c.refreshFailures.Delete(keyStr)
+		c.logger.Debug("proactive cache refresh failed; entry evicted", slogutil.KeyError, err)
+
 		return
 	}
 
-	if ok {
-		c.cr.cacheResp(dctx)
-		c.logger.Debug("proactively refreshed cache entry", "domain", m.Question[0].Name)
+	delay := c.recordRefreshFailure(keyStr)
+	c.logger.Debug(
+		"proactive cache refresh failed",
+		"domain", m.Question[0].Name,
+		"retry_in", delay,
+		slogutil.KeyError, err,
+	)
+
+	c.scheduleRetry(keyStr, m, delay)
+}
+
+// suppressRefresh postpones the proactive refresh of the entry with keyStr by
+// delay without resolving it, e.g. during an upstream outage.  reason is
+// logged.  The retries stop once the entry leaves the cache.
+func (c *cache) suppressRefresh(keyStr string, m *dns.Msg, reason string, delay time.Duration) {
+	if !c.hasEntry([]byte(keyStr)) {
+		c.refreshFailures.Delete(keyStr)
+
+		return
+	}
+
+	c.logger.Debug(
+		"proactive cache refresh suppressed",
+		"reason", reason,
+		"domain", m.Question[0].Name,
+		"retry_in", delay,
+	)
+
+	c.scheduleRetry(keyStr, m, delay)
+}
+
+// pauseRefresh postpones the proactive refreshes due within d until d elapses
+// without resolving them.
+func (c *cache) pauseRefresh(d time.Duration) {
+	c.refreshPausedUntil.Store(c.clock.Now().Add(d).UnixNano())
+}
+
+// postponeRefresh postpones the proactive refresh of the entry with keyStr
+// paused by [cache.pauseRefresh] until the pause ends.  The retries stop once
+// the entry leaves the cache.
+func (c *cache) postponeRefresh(keyStr string, m *dns.Msg, until time.Time) {
+	if !c.hasEntry([]byte(keyStr)) {
+		c.refreshFailures.Delete(keyStr)
+
+		return
 	}
+
+	delay := until.Sub(c.clock.Now())
+	c.logger.Debug("proactive cache refresh paused", "domain", m.Question[0].Name, "retry_in", delay)
+
+	c.scheduleRetry(keyStr, m, delay)
 }
 
-// stopProactiveRefresh stops all proactive refresh timers.
+// takeRefreshToken returns true if the proactive refresh of the entry with
+// keyStr may be performed now in accordance with refreshLimiter.  Otherwise the
+// refresh is deferred until the time reserved for it.  The retries stop once
+// the entry leaves the cache.
+func (c *cache) takeRefreshToken(keyStr string, m *dns.Msg) (ok bool) {
+	var at time.Time
+	if v, reserved := c.refreshReserved.LoadAndDelete(keyStr); reserved {
+		at = v.(time.Time)
+	} else {
+		at = c.refreshLimiter.reserve()
+	}
+
+	now := c.clock.Now()
+	if !at.After(now) {
+		return true
+	}
+
+	if !c.hasEntry([]byte(keyStr)) {
+		c.refreshFailures.Delete(keyStr)
+
+		return false
+	}
+
+	c.refreshReserved.Store(keyStr, at)
+	c.deferredRefreshes.Add(1)
+
+	delay := at.Sub(now)
+	c.logger.Debug("proactive cache refresh deferred", "domain", m.Question[0].Name, "retry_in", delay)
+
+	c.scheduleRetry(keyStr, m, delay)
+
+	return false
+}
+
+// stopProactiveRefresh stops all proactive refresh timers and prevents
+// scheduling the new ones until [cache.resumeProactiveRefresh] is called.  It
+// also waits for the refreshes in progress to finish, so their context should
+// be canceled beforehand.  It's safe to call it multiple times.
 func (c *cache) stopProactiveRefresh() {
+	c.refreshStopped.Store(true)
+	c.requestStats.stopGC()
+
+	// Wait for the refreshes in progress before canceling the timers, since
+	// those may schedule the retries.
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
 	c.cancelAllTimers()
-	if c.stopRefresh != nil {
-		close(c.stopRefresh)
-	}
+}
+
+// resumeProactiveRefresh allows scheduling the proactive refreshes again.
+func (c *cache) resumeProactiveRefresh() {
+	conf := c.settings.Load()
+
+	c.refreshStopped.Store(false)
+	c.requestStats.startGC(conf.cooldownPeriod)
 }
 
 // cancelAllTimers cancels all active refresh timers and clears request stats.
@@ -1055,8 +1909,17 @@ func (c *cache) cancelAllTimers() {
 	})
 
 	// Clear request statistics.
-	c.requestStats.Range(func(key, value interface{}) bool {
-		c.requestStats.Delete(key)
-		return true
-	})
+	c.requestStats.clear()
+
+	c.refreshFailures.Clear()
+	c.refreshReserved.Clear()
+	c.prefetched.Clear()
+}
+
+// isPrefetched returns true if the entry for key has been stored by the
+// proactive refresh.
+func (c *cache) isPrefetched(key []byte) (ok bool) {
+	_, ok = c.prefetched.Load(string(key))
+
+	return ok
 }
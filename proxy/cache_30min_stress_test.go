@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -76,6 +77,7 @@ func Test30MinStress(t *testing.T) {
 		CacheProactiveRefreshTime:       10000, // 10 seconds before expiry
 		CacheProactiveCooldownThreshold: 3,     // Need 3 requests
 	})
+	mustStartLocal(t, prx)
 
 	// Test multiple domains
 	domains := []string{
@@ -151,7 +153,7 @@ func Test30MinStress(t *testing.T) {
 					// Make request
 					reqStart := time.Now()
 					dctx := &DNSContext{Req: req.Copy()}
-					err := prx.Resolve(dctx)
+					err := prx.Resolve(context.Background(), dctx)
 					responseTime := time.Since(reqStart)
 
 					atomic.AddInt64(&totalRequests, 1)
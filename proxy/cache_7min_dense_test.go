@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
 	"testing"
@@ -49,6 +50,7 @@ func Test7MinDenseSimulation(t *testing.T) {
 		CacheProactiveRefreshTime:       1000, // 1 second before expiry (VERY AGGRESSIVE)
 		CacheProactiveCooldownThreshold: 3,    // Need 3 requests
 	})
+	mustStartLocal(t, prx)
 
 	// Test domain
 	domain := "google.com."
@@ -103,7 +105,7 @@ func Test7MinDenseSimulation(t *testing.T) {
 		// Make request
 		reqStart := time.Now()
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		responseTime := time.Since(reqStart)
 		
 		require.NoError(t, err)
@@ -289,10 +291,10 @@ type loggingUpstreamWrapper struct {
 	t        *testing.T
 }
 
-func (u *loggingUpstreamWrapper) Exchange(m *dns.Msg) (*dns.Msg, error) {
+func (u *loggingUpstreamWrapper) Exchange(_ context.Context, m *dns.Msg) (*dns.Msg, error) {
 	count := atomic.AddInt32(u.counter, 1)
 	u.t.Logf("    → Upstream request #%d to %s", count, u.upstream.Address())
-	resp, err := u.upstream.Exchange(m)
+	resp, err := u.upstream.Exchange(context.Background(), m)
 	if err == nil && resp != nil {
 		for _, ans := range resp.Answer {
 			if a, ok := ans.(*dns.A); ok {
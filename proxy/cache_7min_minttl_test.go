@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
 	"testing"
@@ -49,6 +50,7 @@ func Test7MinWithMinTTL(t *testing.T) {
 		CacheProactiveRefreshTime:       1000, // 1 second before expiry
 		CacheProactiveCooldownThreshold: 3,
 	})
+	mustStartLocal(t, prx)
 
 	// Test domain
 	domain := "google.com."
@@ -102,7 +104,7 @@ func Test7MinWithMinTTL(t *testing.T) {
 		// Make request
 		reqStart := time.Now()
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		responseTime := time.Since(reqStart)
 		
 		require.NoError(t, err)
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
 	"testing"
@@ -48,6 +49,7 @@ func Test7MinSimulation(t *testing.T) {
 		CacheProactiveRefreshTime:       30000, // 30 seconds before expiry
 		CacheProactiveCooldownThreshold: 3,     // Need 3 requests to trigger
 	})
+	mustStartLocal(t, prx)
 
 	// Test domain
 	domain := "google.com."
@@ -99,7 +101,7 @@ func Test7MinSimulation(t *testing.T) {
 		// Make request
 		reqStart := time.Now()
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		responseTime := time.Since(reqStart)
 		
 		require.NoError(t, err)
@@ -321,9 +323,9 @@ type countingUpstreamWrapper struct {
 	counter  *int32
 }
 
-func (u *countingUpstreamWrapper) Exchange(m *dns.Msg) (*dns.Msg, error) {
+func (u *countingUpstreamWrapper) Exchange(_ context.Context, m *dns.Msg) (*dns.Msg, error) {
 	atomic.AddInt32(u.counter, 1)
-	return u.upstream.Exchange(m)
+	return u.upstream.Exchange(context.Background(), m)
 }
 
 func (u *countingUpstreamWrapper) Address() string {
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -36,6 +37,7 @@ func TestGoogleCache_LoopFix(t *testing.T) {
 		CacheProactiveRefreshTime:       1000, // 1 second before expiry
 		CacheProactiveCooldownThreshold: 2,
 	})
+	mustStartLocal(t, prx)
 
 	req := &dns.Msg{}
 	req.SetQuestion("test.example.", dns.TypeA)
@@ -48,7 +50,7 @@ func TestGoogleCache_LoopFix(t *testing.T) {
 		requestCount++
 
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		// Wait 3 seconds before next request (unless we're close to the end)
@@ -57,7 +57,7 @@ func TestGoogleCache_10MinSimulation(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("╔════════════════════════════════════════════════════════════════╗")
 	t.Log("║  Ubuntu Connectivity Check - 10 Minutes Simulation Test       ║")
@@ -106,7 +106,7 @@ func TestGoogleCache_10MinSimulation(t *testing.T) {
 		// Measure response time
 		reqStart := time.Now()
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		responseTime := time.Since(reqStart)
 
 		require.NoError(t, err)
@@ -244,11 +244,11 @@ type requestCountingUpstream struct {
 	onRequest func()
 }
 
-func (u *requestCountingUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+func (u *requestCountingUpstream) Exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
 	if u.onRequest != nil {
 		u.onRequest()
 	}
-	return u.upstream.Exchange(req)
+	return u.upstream.Exchange(context.Background(), req)
 }
 
 func (u *requestCountingUpstream) Address() string {
@@ -96,7 +96,7 @@ func TestGoogleCache_ExactUserConfig(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("╔════════════════════════════════════════════════════════════════╗")
 	t.Log("║  Google Cache Test - User's Exact Configuration               ║")
@@ -127,7 +127,7 @@ func TestGoogleCache_ExactUserConfig(t *testing.T) {
 
 	startTime := time.Now()
 	dctx1 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx1)
+	err = prx.Resolve(context.Background(), dctx1)
 	require.NoError(t, err)
 	require.NotNil(t, dctx1.Res)
 	require.Len(t, dctx1.Res.Answer, 1)
@@ -191,7 +191,7 @@ func TestGoogleCache_ExactUserConfig(t *testing.T) {
 	t.Log("")
 
 	dctx2 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx2)
+	err = prx.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 	require.NotNil(t, dctx2.Res)
 	require.Len(t, dctx2.Res.Answer, 1)
@@ -230,7 +230,7 @@ func TestGoogleCache_ExactUserConfig(t *testing.T) {
 		time.Sleep(1 * time.Second)
 
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		count := atomic.LoadInt32(&upstreamRequestCount)
@@ -268,7 +268,7 @@ func TestGoogleCache_ExactUserConfig(t *testing.T) {
 
 	// Final request to verify cache is still working
 	dctx3 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx3)
+	err = prx.Resolve(context.Background(), dctx3)
 	require.NoError(t, err)
 
 	count5 := atomic.LoadInt32(&upstreamRequestCount)
@@ -319,7 +319,7 @@ type dynamicUpstream struct {
 	onExchange func(*dns.Msg) (*dns.Msg, error)
 }
 
-func (u *dynamicUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+func (u *dynamicUpstream) Exchange(_ context.Context, m *dns.Msg) (*dns.Msg, error) {
 	return u.onExchange(m)
 }
 
@@ -58,7 +58,7 @@ func TestGoogleCache_LongRunWithProactiveRefresh(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("=== Long-Run Test Start ===")
 	t.Log("Configuration:")
@@ -73,7 +73,7 @@ func TestGoogleCache_LongRunWithProactiveRefresh(t *testing.T) {
 	// Phase 1: Initial request
 	t.Log("=== Phase 1: Initial Request ===")
 	dctx := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx)
+	err = prx.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 	require.NotNil(t, dctx.Res)
 	require.Len(t, dctx.Res.Answer, 1)
@@ -104,7 +104,7 @@ func TestGoogleCache_LongRunWithProactiveRefresh(t *testing.T) {
 	t.Log("")
 	t.Log("=== Phase 3: User Request After Refresh ===")
 	dctx2 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx2)
+	err = prx.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 	require.NotNil(t, dctx2.Res)
 	require.Len(t, dctx2.Res.Answer, 1)
@@ -126,7 +126,7 @@ func TestGoogleCache_LongRunWithProactiveRefresh(t *testing.T) {
 		time.Sleep(2 * time.Second)
 
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		count := atomic.LoadInt32(&upstreamRequestCount)
@@ -185,7 +185,7 @@ func TestGoogleCache_LongRunWithMinTTL(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("=== Long-Run Test With CacheMinTTL ===")
 	t.Log("Configuration:")
@@ -200,7 +200,7 @@ func TestGoogleCache_LongRunWithMinTTL(t *testing.T) {
 	// Initial request
 	t.Log("=== Phase 1: Initial Request ===")
 	dctx := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx)
+	err = prx.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 
 	count1 := atomic.LoadInt32(&upstreamRequestCount)
@@ -218,7 +218,7 @@ func TestGoogleCache_LongRunWithMinTTL(t *testing.T) {
 	time.Sleep(15 * time.Second)
 
 	dctx2 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx2)
+	err = prx.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 
 	count2 := atomic.LoadInt32(&upstreamRequestCount)
@@ -250,7 +250,7 @@ func TestGoogleCache_LongRunWithMinTTL(t *testing.T) {
 	t.Log("")
 	t.Log("=== Phase 4: Final Request ===")
 	dctx3 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx3)
+	err = prx.Resolve(context.Background(), dctx3)
 	require.NoError(t, err)
 
 	count4 := atomic.LoadInt32(&upstreamRequestCount)
@@ -281,9 +281,9 @@ type countingUpstream struct {
 	counter  *int32
 }
 
-func (u *countingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+func (u *countingUpstream) Exchange(_ context.Context, m *dns.Msg) (*dns.Msg, error) {
 	atomic.AddInt32(u.counter, 1)
-	return u.upstream.Exchange(m)
+	return u.upstream.Exchange(context.Background(), m)
 }
 
 func (u *countingUpstream) Address() string {
@@ -94,7 +94,7 @@ func TestGoogleCache_RealTTL(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("╔════════════════════════════════════════════════════════════════╗")
 	t.Log("║  Google Cache Test - Real TTL (237 seconds)                   ║")
@@ -125,7 +125,7 @@ func TestGoogleCache_RealTTL(t *testing.T) {
 
 	startTime := time.Now()
 	dctx1 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx1)
+	err = prx.Resolve(context.Background(), dctx1)
 	require.NoError(t, err)
 	require.NotNil(t, dctx1.Res)
 	require.Len(t, dctx1.Res.Answer, 1)
@@ -164,7 +164,7 @@ func TestGoogleCache_RealTTL(t *testing.T) {
 		}
 
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		count := atomic.LoadInt32(&upstreamRequestCount)
@@ -229,7 +229,7 @@ func TestGoogleCache_RealTTL(t *testing.T) {
 	t.Log("")
 
 	dctx2 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx2)
+	err = prx.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 	require.NotNil(t, dctx2.Res)
 	require.Len(t, dctx2.Res.Answer, 1)
@@ -269,7 +269,7 @@ func TestGoogleCache_RealTTL(t *testing.T) {
 		time.Sleep(5 * time.Second)
 
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		count := atomic.LoadInt32(&upstreamRequestCount)
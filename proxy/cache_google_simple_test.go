@@ -45,7 +45,7 @@ func TestGoogleCache_UserConfig(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("Configuration: CacheMinTTL=0, ProactiveRefresh=2000ms, CooldownThreshold=-1")
 
@@ -54,7 +54,7 @@ func TestGoogleCache_UserConfig(t *testing.T) {
 	req.SetQuestion("www.google.com.", dns.TypeA)
 
 	dctx := &DNSContext{Req: req}
-	err = prx.Resolve(dctx)
+	err = prx.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 	require.NotNil(t, dctx.Res)
 	require.Len(t, dctx.Res.Answer, 1)
@@ -67,7 +67,7 @@ func TestGoogleCache_UserConfig(t *testing.T) {
 
 	// Second request
 	dctx2 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx2)
+	err = prx.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 	require.NotNil(t, dctx2.Res)
 	require.Len(t, dctx2.Res.Answer, 1)
@@ -109,7 +109,7 @@ func TestGoogleCache_WithMinTTL(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("Configuration: CacheMinTTL=600 (overrides Google's 237s)")
 
@@ -118,7 +118,7 @@ func TestGoogleCache_WithMinTTL(t *testing.T) {
 	req.SetQuestion("www.google.com.", dns.TypeA)
 
 	dctx := &DNSContext{Req: req}
-	err = prx.Resolve(dctx)
+	err = prx.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 
 	ttl1 := dctx.Res.Answer[0].Header().Ttl
@@ -130,7 +130,7 @@ func TestGoogleCache_WithMinTTL(t *testing.T) {
 
 	// Second request
 	dctx2 := &DNSContext{Req: req.Copy()}
-	err = prx.Resolve(dctx2)
+	err = prx.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 
 	ttl2 := dctx2.Res.Answer[0].Header().Ttl
@@ -171,7 +171,7 @@ func TestGoogleCache_MultipleRequests(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
-	t.Cleanup(func() { _ = prx.Shutdown(context.Background()) })
+	mustStartLocal(t, prx)
 
 	t.Log("Testing multiple requests with 2-second intervals")
 
@@ -181,7 +181,7 @@ func TestGoogleCache_MultipleRequests(t *testing.T) {
 	// Make 5 requests, 2 seconds apart
 	for i := 0; i < 5; i++ {
 		dctx := &DNSContext{Req: req.Copy()}
-		err := prx.Resolve(dctx)
+		err := prx.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		ttl := dctx.Res.Answer[0].Header().Ttl
@@ -2,15 +2,19 @@ package proxy
 
 import (
 	"cmp"
+	"context"
+	"fmt"
 	"net"
 	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
@@ -30,7 +34,7 @@ const testUpsAddr = "https://upstream.address"
 // upstreamWithAddr is a [dnsproxytest.Upstream] that is only expected to be
 // used to get its address.
 var upstreamWithAddr = &dnsproxytest.Upstream{
-	OnExchange: func(m *dns.Msg) (_ *dns.Msg, _ error) { panic(testutil.UnexpectedCall(m)) },
+	OnExchange: func(_ context.Context, m *dns.Msg) (_ *dns.Msg, _ error) { panic(testutil.UnexpectedCall(m)) },
 	OnClose:    func() (_ error) { panic(testutil.UnexpectedCall()) },
 	OnAddress:  func() (addr string) { return testUpsAddr },
 }
@@ -166,7 +170,7 @@ func TestCache_expired(t *testing.T) {
 				m:   reply,
 				u:   testUpsAddr,
 				ttl: tc.ttl,
-			}).pack()
+			}).pack(time.Now())
 			testCache.items.Set(key, data)
 			t.Cleanup(testCache.items.Clear)
 
@@ -229,6 +233,162 @@ func TestCacheDO(t *testing.T) {
 	})
 }
 
+func TestProxy_Resolve_cacheDNSSECViews(t *testing.T) {
+	const host = "signed.example."
+
+	a := newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	rrsig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   host,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		TypeCovered: dns.TypeA,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      2,
+		SignerName:  host,
+		Signature:   "c29tZSBycnNpZyByZWxhdGVkIHN0dWZm",
+	}
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   host,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		NextDomain: "\000." + host,
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+
+	var calls atomic.Uint32
+	u := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			calls.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.AuthenticatedData = true
+			resp.Answer = []dns.RR{a}
+
+			o := req.IsEdns0()
+			require.NotNil(testutil.PanicT{}, o)
+
+			if o.Do() {
+				resp.Answer = append(resp.Answer, rrsig)
+				resp.Ns = []dns.RR{nsec}
+			}
+
+			resp.SetEdns0(defaultUDPBufSize, o.Do())
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         defaultCacheSize,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	// The test cases are sequential, the first one fills the cache with the
+	// signed response and the rest are rendered from the same entry.
+	testCases := []struct {
+		name    string
+		wantAns []dns.RR
+		wantNs  []dns.RR
+		edns    bool
+		do      bool
+		ad      bool
+		wantAD  bool
+	}{{
+		name:    "miss_no_do",
+		wantAns: []dns.RR{a},
+		wantNs:  nil,
+		edns:    true,
+		do:      false,
+		ad:      false,
+		wantAD:  false,
+	}, {
+		name:    "hit_do",
+		wantAns: []dns.RR{a, rrsig},
+		wantNs:  []dns.RR{nsec},
+		edns:    true,
+		do:      true,
+		ad:      false,
+		wantAD:  true,
+	}, {
+		name:    "hit_no_do_ad",
+		wantAns: []dns.RR{a},
+		wantNs:  nil,
+		edns:    true,
+		do:      false,
+		ad:      true,
+		wantAD:  true,
+	}, {
+		name:    "hit_no_edns",
+		wantAns: []dns.RR{a},
+		wantNs:  nil,
+		edns:    false,
+		do:      false,
+		ad:      false,
+		wantAD:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newReq(host, dns.TypeA, dns.ClassINET)
+			req.AuthenticatedData = tc.ad
+			if tc.edns {
+				req.SetEdns0(defaultUDPBufSize, tc.do)
+			}
+
+			dctx := &DNSContext{
+				Req:   req,
+				Proto: ProtoUDP,
+			}
+
+			err := p.Resolve(context.Background(), dctx)
+			require.NoError(t, err)
+
+			res := dctx.Res
+			require.NotNil(t, res)
+
+			assert.Equal(t, uint32(1), calls.Load())
+			assert.Equal(t, tc.wantAD, res.AuthenticatedData)
+
+			require.Len(t, res.Answer, len(tc.wantAns))
+			for i, rr := range tc.wantAns {
+				assert.Equal(t, rr.Header().Rrtype, res.Answer[i].Header().Rrtype)
+			}
+
+			require.Len(t, res.Ns, len(tc.wantNs))
+			for i, rr := range tc.wantNs {
+				assert.Equal(t, rr.Header().Rrtype, res.Ns[i].Header().Rrtype)
+			}
+
+			o := res.IsEdns0()
+			if !tc.edns {
+				assert.Nil(t, o)
+
+				return
+			}
+
+			require.NotNil(t, o)
+
+			assert.Equal(t, tc.do, o.Do())
+		})
+	}
+}
+
 func TestCacheCNAME(t *testing.T) {
 	l := slogutil.NewDiscardLogger()
 
@@ -284,6 +444,73 @@ func TestCache_uncacheable(t *testing.T) {
 	assert.False(t, expired)
 }
 
+func TestProxy_Resolve_cacheAdmission(t *testing.T) {
+	const (
+		admittedHost = "admitted.example."
+		rejectedHost = "rejected.example."
+	)
+
+	var exchanges atomic.Int32
+	u := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				newRR(t, req.Question[0].Name, dns.TypeA, defaultTestTTL, net.IP{192, 0, 2, 1}),
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return testUpsAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheAdmissionHandler: func(resp *dns.Msg, dctx *DNSContext) (ok bool) {
+			require.NotNil(t, dctx.Upstream)
+			assert.Equal(t, testUpsAddr, dctx.Upstream.Address())
+
+			return resp.Question[0].Name != rejectedHost
+		},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T, host string) {
+		t.Helper()
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		d := p.newDNSContext(ProtoUDP, req, netip.MustParseAddrPort("192.0.2.2:53"))
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+	}
+
+	t.Run("admitted", func(t *testing.T) {
+		exchanges.Store(0)
+
+		resolve(t, admittedHost)
+		resolve(t, admittedHost)
+
+		assert.Equal(t, int32(1), exchanges.Load())
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		exchanges.Store(0)
+
+		resolve(t, rejectedHost)
+		resolve(t, rejectedHost)
+
+		assert.Equal(t, int32(2), exchanges.Load())
+	})
+}
+
 func TestCache_concurrent(t *testing.T) {
 	testCache := newTestCache(t, nil)
 
@@ -306,6 +533,104 @@ func TestCache_concurrent(t *testing.T) {
 	g.Wait()
 }
 
+func TestCache_get_pooledMsg(t *testing.T) {
+	c := newCache(&cacheConfig{size: testCacheSize})
+
+	req := (&dns.Msg{}).SetQuestion("pooled.example.", dns.TypeA)
+	c.set(newShardsTestReply(req), upstreamWithAddr, slogutil.NewDiscardLogger())
+
+	first, _, _ := c.get(req)
+	require.NotNil(t, first)
+	require.Len(t, first.m.Answer, 1)
+
+	second, _, _ := c.get(req)
+	require.NotNil(t, second)
+	require.Len(t, second.m.Answer, 1)
+
+	// The items unpacked with the same pooled message must not share records.
+	first.m.Answer[0].Header().Name = "changed.example."
+	assert.Equal(t, "pooled.example.", second.m.Answer[0].Header().Name)
+}
+
+func TestCache_get_nameVariants(t *testing.T) {
+	c := newCache(&cacheConfig{size: testCacheSize})
+
+	req := (&dns.Msg{}).SetQuestion("MiXeD.example.", dns.TypeA)
+	c.set(newShardsTestReply(req), upstreamWithAddr, slogutil.NewDiscardLogger())
+
+	wantKey := msgToKey(req)
+
+	for _, name := range []string{"mixed.example.", "MIXED.EXAMPLE.", "Mixed.Example"} {
+		t.Run(name, func(t *testing.T) {
+			variant := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+			assert.Equal(t, wantKey, msgToKey(variant))
+
+			ci, _, _ := c.get(variant)
+			require.NotNil(t, ci)
+			require.Len(t, ci.m.Answer, 1)
+
+			// The case of the question is kept in the owner names.
+			assert.Equal(t, name, ci.m.Question[0].Name)
+			if dns.IsFqdn(name) {
+				assert.Equal(t, name, ci.m.Answer[0].Header().Name)
+			}
+		})
+	}
+}
+
+func TestRestoreOwnerCase(t *testing.T) {
+	t.Parallel()
+
+	const (
+		cached = "mixed.example."
+		target = "Target.Example."
+	)
+
+	testCases := []struct {
+		name      string
+		qname     string
+		wantOwner string
+	}{{
+		name:      "same_case",
+		qname:     cached,
+		wantOwner: cached,
+	}, {
+		name:      "upper_case",
+		qname:     "MIXED.EXAMPLE.",
+		wantOwner: "MIXED.EXAMPLE.",
+	}, {
+		name:      "mixed_case",
+		qname:     "MiXeD.eXaMpLe.",
+		wantOwner: "MiXeD.eXaMpLe.",
+	}, {
+		name:      "other_name",
+		qname:     "other.example.",
+		wantOwner: cached,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rrs := []dns.RR{
+				&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: cached, Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+					Target: target,
+				},
+				newRR(t, target, dns.TypeA, 60, net.IP{192, 0, 2, 1}),
+			}
+
+			restoreOwnerCase(rrs, tc.qname)
+
+			assert.Equal(t, tc.wantOwner, rrs[0].Header().Name)
+			assert.Equal(t, target, rrs[0].(*dns.CNAME).Target)
+
+			// The owner names different from the question are kept as is.
+			assert.Equal(t, target, rrs[1].Header().Name)
+		})
+	}
+}
+
 const (
 	// cacheTick is a cache check period.
 	cacheTick = 100 * time.Millisecond
@@ -406,7 +731,7 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 			A: net.IP{4, 3, 2, 1},
 		}}
 
-		err := dnsProxy.Resolve(d)
+		err := dnsProxy.Resolve(context.Background(), d)
 		require.NoError(t, err)
 
 		ci, expired, key := dnsProxy.cache.get(d.Req)
@@ -430,7 +755,7 @@ func TestCacheExpirationWithTTLOverride(t *testing.T) {
 			A: net.IP{4, 3, 2, 1},
 		}}
 
-		err := dnsProxy.Resolve(d)
+		err := dnsProxy.Resolve(context.Background(), d)
 		assert.Nil(t, err)
 
 		ci, expired, key := dnsProxy.cache.get(d.Req)
@@ -491,7 +816,7 @@ func TestCache(t *testing.T) {
 			cases: []testCase{{
 				ok: require.True,
 				q:  "gOOgle.com.",
-				a:  []dns.RR{newRR(t, "google.com.", dns.TypeA, 3600, net.IP{8, 8, 8, 8})},
+				a:  []dns.RR{newRR(t, "gOOgle.com.", dns.TypeA, 3600, net.IP{8, 8, 8, 8})},
 				t:  dns.TypeA,
 			}, {
 				ok: require.True,
@@ -501,7 +826,7 @@ func TestCache(t *testing.T) {
 			}, {
 				ok: require.True,
 				q:  "GOOGLE.COM.",
-				a:  []dns.RR{newRR(t, "google.com.", dns.TypeA, 3600, net.IP{8, 8, 8, 8})},
+				a:  []dns.RR{newRR(t, "GOOGLE.COM.", dns.TypeA, 3600, net.IP{8, 8, 8, 8})},
 				t:  dns.TypeA,
 			}, {
 				q:  "gOOgle.com.",
@@ -998,3 +1323,356 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 		})
 	}
 }
+
+func TestCache_stopProactiveRefresh(t *testing.T) {
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		proactiveRefreshTime: time.Second,
+	})
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	key := msgToKey(req)
+
+	c.scheduleRefresh(key, 3600, req)
+	_, ok := c.refreshTimers.Load(string(key))
+	require.True(t, ok)
+
+	// Stopping twice must not panic.
+	c.stopProactiveRefresh()
+	c.stopProactiveRefresh()
+
+	_, ok = c.refreshTimers.Load(string(key))
+	require.False(t, ok)
+
+	c.scheduleRefresh(key, 3600, req)
+	_, ok = c.refreshTimers.Load(string(key))
+	assert.False(t, ok)
+
+	c.resumeProactiveRefresh()
+	t.Cleanup(c.stopProactiveRefresh)
+
+	c.scheduleRefresh(key, 3600, req)
+	_, ok = c.refreshTimers.Load(string(key))
+	assert.True(t, ok)
+}
+
+func TestRefreshBackoffDelay(t *testing.T) {
+	testCases := []struct {
+		want     time.Duration
+		name     string
+		failures uint
+	}{{
+		want:     minRefreshBackoff,
+		name:     "first",
+		failures: 1,
+	}, {
+		want:     4 * minRefreshBackoff,
+		name:     "third",
+		failures: 3,
+	}, {
+		want:     maxRefreshBackoff,
+		name:     "capped",
+		failures: 100,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, refreshBackoffDelay(tc.failures))
+		})
+	}
+}
+
+func TestCache_refreshEntry_backoff(t *testing.T) {
+	var resolved atomic.Int32
+	upsErr := errors.Error("upstream unreachable")
+
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+			resolved.Add(1)
+
+			return false, upsErr
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	reply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, "example.com.", dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+	}).SetQuestion("example.com.", dns.TypeA)
+	c.set(reply, upstreamWithAddr, slogutil.NewDiscardLogger())
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	key := msgToKey(req)
+	keyStr := string(key)
+
+	c.refreshEntry(keyStr, req)
+	require.EqualValues(t, 1, resolved.Load())
+	assert.True(t, c.isBackingOff(key))
+
+	// The retry is scheduled instead of the immediate resolving.
+	_, ok := c.refreshTimers.Load(keyStr)
+	assert.True(t, ok)
+
+	// The existing entry is still served.
+	ci, _, _ := c.get(req)
+	assert.NotNil(t, ci)
+
+	c.refreshEntry(keyStr, req)
+	val, ok := c.refreshFailures.Load(keyStr)
+	require.True(t, ok)
+
+	b := val.(*refreshBackoff)
+	assert.Equal(t, uint(2), b.failures)
+
+	// Successful storing of the response resets the backoff.
+	c.set(reply, upstreamWithAddr, slogutil.NewDiscardLogger())
+	assert.False(t, c.isBackingOff(key))
+
+	t.Run("evicted", func(t *testing.T) {
+		c.clearItems()
+		c.refreshEntry(keyStr, req)
+
+		_, ok = c.refreshFailures.Load(keyStr)
+		assert.False(t, ok)
+	})
+}
+
+func TestCache_refreshEntry_onRefresh(t *testing.T) {
+	const host = "example.com."
+
+	upsErr := errors.Error("upstream unreachable")
+
+	var resolveErr error
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(dctx *DNSContext) (ok bool, err error) {
+			if resolveErr != nil {
+				return false, resolveErr
+			}
+
+			dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+			dctx.Res.Answer = []dns.RR{newRR(t, host, dns.TypeA, 3600, net.IP{5, 6, 7, 8})}
+
+			return true, nil
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	type refresh struct {
+		oldResp *dns.Msg
+		newResp *dns.Msg
+		err     error
+	}
+
+	var got []*refresh
+	c.onRefresh = func(name string, qtype uint16, oldResp, newResp *dns.Msg, err error) {
+		assert.Equal(t, host, name)
+		assert.Equal(t, dns.TypeA, qtype)
+
+		got = append(got, &refresh{oldResp: oldResp, newResp: newResp, err: err})
+	}
+
+	reply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, host, dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+	}).SetQuestion(host, dns.TypeA)
+	c.set(reply, upstreamWithAddr, slogutil.NewDiscardLogger())
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	keyStr := string(msgToKey(req))
+
+	c.refreshEntry(keyStr, req)
+
+	resolveErr = upsErr
+	c.refreshEntry(keyStr, req)
+
+	require.Len(t, got, 2)
+
+	require.NotNil(t, got[0].oldResp)
+	require.Len(t, got[0].oldResp.Answer, 1)
+	require.NotNil(t, got[0].newResp)
+	require.Len(t, got[0].newResp.Answer, 1)
+	require.NoError(t, got[0].err)
+
+	oldA := testutil.RequireTypeAssert[*dns.A](t, got[0].oldResp.Answer[0])
+	newA := testutil.RequireTypeAssert[*dns.A](t, got[0].newResp.Answer[0])
+	assert.Equal(t, net.IP{1, 2, 3, 4}, oldA.A.To4())
+	assert.Equal(t, net.IP{5, 6, 7, 8}, newA.A.To4())
+
+	assert.NotNil(t, got[1].oldResp)
+	assert.Nil(t, got[1].newResp)
+	assert.ErrorIs(t, got[1].err, upsErr)
+}
+
+func TestCache_refreshEntry_guard(t *testing.T) {
+	const (
+		host      = "example.com."
+		guardHost = "guarded.example.com."
+	)
+
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+		refreshGuard:         true,
+		refreshMinAnswers:    defaultRefreshMinAnswers,
+		domainPolicies: []*DomainPolicy{{
+			Patterns:          []string{guardHost},
+			RefreshMinAnswers: 2,
+		}},
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	t.Cleanup(c.stopProactiveRefresh)
+
+	newAnswer := func(host string, n int) (ans []dns.RR) {
+		for i := range n {
+			ans = append(ans, newRR(t, host, dns.TypeA, 3600, net.IP{192, 0, 2, byte(i)}))
+		}
+
+		return ans
+	}
+
+	var rcode, answers, cached int
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(dctx *DNSContext) (ok bool, err error) {
+			dctx.Res = (&dns.Msg{}).SetRcode(dctx.Req, rcode)
+			dctx.Res.Answer = newAnswer(dctx.Req.Question[0].Name, answers)
+
+			return true, nil
+		},
+		onCacheResp: func(_ *DNSContext) { cached++ },
+	}
+
+	for _, h := range []string{host, guardHost} {
+		reply := (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: newAnswer(h, 3),
+		}).SetQuestion(h, dns.TypeA)
+		c.set(reply, upstreamWithAddr, slogutil.NewDiscardLogger())
+	}
+
+	testCases := []struct {
+		name         string
+		host         string
+		rcode        int
+		answers      int
+		wantRejected bool
+	}{{
+		name:         "servfail",
+		host:         host,
+		rcode:        dns.RcodeServerFailure,
+		answers:      0,
+		wantRejected: true,
+	}, {
+		name:         "empty",
+		host:         host,
+		rcode:        dns.RcodeSuccess,
+		answers:      0,
+		wantRejected: true,
+	}, {
+		name:         "fewer",
+		host:         host,
+		rcode:        dns.RcodeSuccess,
+		answers:      1,
+		wantRejected: false,
+	}, {
+		name:         "policy_fewer",
+		host:         guardHost,
+		rcode:        dns.RcodeSuccess,
+		answers:      1,
+		wantRejected: true,
+	}, {
+		name:         "policy_enough",
+		host:         guardHost,
+		rcode:        dns.RcodeSuccess,
+		answers:      2,
+		wantRejected: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rcode, answers = tc.rcode, tc.answers
+			rejected, cachedBefore := c.rejectedRefreshes.Load(), cached
+
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			c.refreshEntry(string(msgToKey(req)), req)
+
+			if tc.wantRejected {
+				assert.Equal(t, rejected+1, c.rejectedRefreshes.Load())
+				assert.Equal(t, cachedBefore, cached)
+			} else {
+				assert.Equal(t, rejected, c.rejectedRefreshes.Load())
+				assert.Equal(t, cachedBefore+1, cached)
+			}
+		})
+	}
+}
+
+func TestCache_refreshEntry_concurrency(t *testing.T) {
+	const refreshNum = 3
+
+	var inFlight, maxInFlight atomic.Int32
+	release := make(chan struct{})
+
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+		refreshConcurrency:   1,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			for cur := maxInFlight.Load(); n > cur; cur = maxInFlight.Load() {
+				if maxInFlight.CompareAndSwap(cur, n) {
+					break
+				}
+			}
+
+			<-release
+
+			return true, nil
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := range refreshNum {
+		req := (&dns.Msg{}).SetQuestion(fmt.Sprintf("host%d.example.", i), dns.TypeA)
+
+		wg.Go(func() {
+			c.refreshEntry(string(msgToKey(req)), req)
+		})
+	}
+
+	require.Eventually(t, func() (ok bool) {
+		return inFlight.Load() == 1
+	}, testTimeout, testTimeout/100)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxInFlight.Load())
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net/netip"
 	"testing"
 	"time"
@@ -25,13 +26,14 @@ func TestProactiveRefresh_ContinuousRefresh(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	// Initial request
 	dctx := &DNSContext{
 		Req:  createTestMsg("hot-domain.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx)
+	err = proxy.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 
 	initial := ups.requestCount.Load()
@@ -73,6 +75,7 @@ func TestProactiveRefresh_StopsWhenCold(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	// Make 2 requests to trigger refresh
 	for i := 0; i < 2; i++ {
@@ -80,7 +83,7 @@ func TestProactiveRefresh_StopsWhenCold(t *testing.T) {
 			Req:  createTestMsg("cooling-domain.example."),
 			Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 		}
-		err = proxy.Resolve(dctx)
+		err = proxy.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 		time.Sleep(100 * time.Millisecond)
 	}
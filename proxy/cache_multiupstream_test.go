@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"sync/atomic"
@@ -32,6 +33,7 @@ func TestProactiveRefresh_MultiUpstream(t *testing.T) {
 		UpstreamMode: UpstreamModeLoadBalance,
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	domain := "connectivity-check.ubuntu.com."
 
@@ -40,7 +42,7 @@ func TestProactiveRefresh_MultiUpstream(t *testing.T) {
 		Req:  createTestMsg(domain),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx)
+	err = proxy.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 
 	// Get initial counts
@@ -104,6 +106,7 @@ func TestProactiveRefresh_UpstreamFailover(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	domain := "connectivity-check.ubuntu.com."
 
@@ -112,7 +115,7 @@ func TestProactiveRefresh_UpstreamFailover(t *testing.T) {
 		Req:  createTestMsg(domain),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx)
+	err = proxy.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 
 	initial := goodUps.requestCount.Load()
@@ -138,7 +141,7 @@ type failingTestUpstream struct {
 	requestCount atomic.Int32
 }
 
-func (u *failingTestUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+func (u *failingTestUpstream) Exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
 	u.requestCount.Add(1)
 	return nil, &net.OpError{Op: "read", Err: &timeoutError{}}
 }
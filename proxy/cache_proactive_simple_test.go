@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/netip"
@@ -20,7 +21,7 @@ type simpleTestUpstream struct {
 	ttl          uint32
 }
 
-func (u *simpleTestUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+func (u *simpleTestUpstream) Exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
 	u.requestCount.Add(1)
 
 	resp := &dns.Msg{}
@@ -64,13 +65,14 @@ func TestProactiveRefresh_Basic(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	// Initial request
 	dctx := &DNSContext{
 		Req:  createTestMsg("test.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx)
+	err = proxy.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 	require.NotNil(t, dctx.Res)
 
@@ -82,7 +84,7 @@ func TestProactiveRefresh_Basic(t *testing.T) {
 		Req:  createTestMsg("test.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx2)
+	err = proxy.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 
 	cacheCount := ups.requestCount.Load()
@@ -115,13 +117,14 @@ func TestProactiveRefresh_Cooldown(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
+		mustStartLocal(t, proxy)
 
 		// Only 1 request
 		dctx := &DNSContext{
 			Req:  createTestMsg("low-freq.example."),
 			Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 		}
-		err = proxy.Resolve(dctx)
+		err = proxy.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		initial := ups.requestCount.Load()
@@ -148,13 +151,14 @@ func TestProactiveRefresh_Cooldown(t *testing.T) {
 			},
 		})
 		require.NoError(t, err)
+		mustStartLocal(t, proxy)
 
 		// Single request
 		dctx := &DNSContext{
 			Req:  createTestMsg("any-freq.example."),
 			Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 		}
-		err = proxy.Resolve(dctx)
+		err = proxy.Resolve(context.Background(), dctx)
 		require.NoError(t, err)
 
 		initial := ups.requestCount.Load()
@@ -194,13 +198,14 @@ func TestProactiveRefresh_MultiDomain(t *testing.T) {
 				},
 			})
 			require.NoError(t, err)
+			mustStartLocal(t, proxy)
 
 			// Initial request
 			dctx := &DNSContext{
 				Req:  createTestMsg(tc.name),
 				Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 			}
-			err = proxy.Resolve(dctx)
+			err = proxy.Resolve(context.Background(), dctx)
 			require.NoError(t, err)
 
 			initial := ups.requestCount.Load()
@@ -233,12 +238,13 @@ func TestProactiveRefresh_VeryShortTTL(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	dctx := &DNSContext{
 		Req:  createTestMsg("very-short.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx)
+	err = proxy.Resolve(context.Background(), dctx)
 	require.NoError(t, err)
 
 	initial := ups.requestCount.Load()
@@ -276,13 +282,14 @@ func TestProactiveRefresh_DynamicThreshold(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	// First request - creates cache, only 1 request recorded
 	dctx1 := &DNSContext{
 		Req:  createTestMsg("dynamic.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx1)
+	err = proxy.Resolve(context.Background(), dctx1)
 	require.NoError(t, err)
 
 	// Second request - cache hit, 2 requests total
@@ -290,7 +297,7 @@ func TestProactiveRefresh_DynamicThreshold(t *testing.T) {
 		Req:  createTestMsg("dynamic.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx2)
+	err = proxy.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 
 	// Third request - cache hit, 3 requests total, SHOULD trigger dynamic scheduling
@@ -298,7 +305,7 @@ func TestProactiveRefresh_DynamicThreshold(t *testing.T) {
 		Req:  createTestMsg("dynamic.example."),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx3)
+	err = proxy.Resolve(context.Background(), dctx3)
 	require.NoError(t, err)
 
 	initial := ups.requestCount.Load()
@@ -328,6 +335,7 @@ func TestProactiveRefresh_CrossCacheCycle(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+	mustStartLocal(t, proxy)
 
 	domain := "cross-cycle.example."
 
@@ -336,7 +344,7 @@ func TestProactiveRefresh_CrossCacheCycle(t *testing.T) {
 		Req:  createTestMsg(domain),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx1)
+	err = proxy.Resolve(context.Background(), dctx1)
 	require.NoError(t, err)
 	t.Log("T0: First request, stats = 1")
 
@@ -349,7 +357,7 @@ func TestProactiveRefresh_CrossCacheCycle(t *testing.T) {
 		Req:  createTestMsg(domain),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx2)
+	err = proxy.Resolve(context.Background(), dctx2)
 	require.NoError(t, err)
 	t.Log("T1: Second request (cache miss), stats = 2")
 
@@ -358,7 +366,7 @@ func TestProactiveRefresh_CrossCacheCycle(t *testing.T) {
 		Req:  createTestMsg(domain),
 		Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 	}
-	err = proxy.Resolve(dctx3)
+	err = proxy.Resolve(context.Background(), dctx3)
 	require.NoError(t, err)
 	t.Log("T2: Third request (cache hit), stats = 3, should trigger dynamic scheduling")
 
@@ -391,6 +399,7 @@ func BenchmarkProactiveRefresh(b *testing.B) {
 		},
 	})
 	require.NoError(b, err)
+	mustStartLocal(b, proxy)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -398,6 +407,6 @@ func BenchmarkProactiveRefresh(b *testing.B) {
 			Req:  createTestMsg(fmt.Sprintf("bench%d.example.", i%100)),
 			Addr: netip.MustParseAddrPort("127.0.0.1:12345"),
 		}
-		_ = proxy.Resolve(dctx)
+		_ = proxy.Resolve(context.Background(), dctx)
 	}
 }
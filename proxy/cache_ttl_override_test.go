@@ -12,10 +12,10 @@ import (
 
 // TestCache_RespToItem_MinTTL verifies that CacheMinTTL is applied when storing items in cache.
 func TestCache_RespToItem_MinTTL(t *testing.T) {
-	c := &cache{
+	c := newCache(&cacheConfig{
 		cacheMinTTL: 600, // 10 minutes
 		cacheMaxTTL: 0,
-	}
+	})
 
 	// Create response with TTL=100 seconds
 	m := &dns.Msg{
@@ -50,10 +50,10 @@ func TestCache_RespToItem_MinTTL(t *testing.T) {
 
 // TestCache_RespToItem_MaxTTL verifies that CacheMaxTTL is applied when storing items in cache.
 func TestCache_RespToItem_MaxTTL(t *testing.T) {
-	c := &cache{
+	c := newCache(&cacheConfig{
 		cacheMinTTL: 0,
 		cacheMaxTTL: 3600, // 1 hour
-	}
+	})
 
 	// Create response with TTL=7200 seconds (2 hours)
 	m := &dns.Msg{
@@ -88,10 +88,10 @@ func TestCache_RespToItem_MaxTTL(t *testing.T) {
 
 // TestCache_RespToItem_TTLInRange verifies that TTL is not changed when it's within the range.
 func TestCache_RespToItem_TTLInRange(t *testing.T) {
-	c := &cache{
+	c := newCache(&cacheConfig{
 		cacheMinTTL: 300,  // 5 minutes
 		cacheMaxTTL: 3600, // 1 hour
-	}
+	})
 
 	// Create response with TTL=600 seconds (10 minutes, within range)
 	m := &dns.Msg{
@@ -126,10 +126,10 @@ func TestCache_RespToItem_TTLInRange(t *testing.T) {
 
 // TestCache_RespToItem_NoOverride verifies that TTL is not changed when overrides are not set.
 func TestCache_RespToItem_NoOverride(t *testing.T) {
-	c := &cache{
+	c := newCache(&cacheConfig{
 		cacheMinTTL: 0,
 		cacheMaxTTL: 0,
-	}
+	})
 
 	// Create response with TTL=237 seconds (typical Google response)
 	m := &dns.Msg{
@@ -172,8 +172,8 @@ func TestNewCache_WithTTLOverrides(t *testing.T) {
 
 	c := newCache(conf)
 
-	assert.Equal(t, uint32(300), c.cacheMinTTL, "cacheMinTTL should be set")
-	assert.Equal(t, uint32(3600), c.cacheMaxTTL, "cacheMaxTTL should be set")
+	assert.Equal(t, uint32(300), c.settings.Load().cacheMinTTL, "cacheMinTTL should be set")
+	assert.Equal(t, uint32(3600), c.settings.Load().cacheMaxTTL, "cacheMaxTTL should be set")
 }
 
 // TestNewCache_WithoutTTLOverrides verifies that newCache works without TTL overrides.
@@ -184,6 +184,6 @@ func TestNewCache_WithoutTTLOverrides(t *testing.T) {
 
 	c := newCache(conf)
 
-	assert.Equal(t, uint32(0), c.cacheMinTTL, "cacheMinTTL should be 0 by default")
-	assert.Equal(t, uint32(0), c.cacheMaxTTL, "cacheMaxTTL should be 0 by default")
+	assert.Equal(t, uint32(0), c.settings.Load().cacheMinTTL, "cacheMinTTL should be 0 by default")
+	assert.Equal(t, uint32(0), c.settings.Load().cacheMaxTTL, "cacheMaxTTL should be 0 by default")
 }
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"time"
+)
+
+const (
+	// intervalWeight is the weight of the latest interval between requests
+	// in the moving average, expressed as the divisor.
+	intervalWeight = 4
+
+	// minAdaptiveRefreshLead is the minimum time before expiration the entries
+	// are refreshed at in the adaptive mode.
+	minAdaptiveRefreshLead = time.Second
+)
+
+// nextInterval returns the moving average of the intervals between requests
+// after the latest interval d.
+func nextInterval(avg, d time.Duration) (next time.Duration) {
+	if avg == 0 {
+		return d
+	}
+
+	return avg + (d-avg)/intervalWeight
+}
+
+// maxHotInterval returns the maximum average interval between requests for
+// an entry to be refreshed in the adaptive mode.
+func (c *cache) maxHotInterval() (d time.Duration) {
+	conf := c.settings.Load()
+
+	return conf.cooldownPeriod / time.Duration(conf.cooldownThreshold)
+}
+
+// isHot returns true if the entry with stat is requested often enough to be
+// refreshed in the adaptive mode.  stat.mu must be locked.
+func (c *cache) isHot(stat *requestStat, now time.Time) (ok bool) {
+	conf := c.settings.Load()
+
+	if !conf.adaptive || stat.interval == 0 || len(stat.timestamps) == 0 {
+		return false
+	}
+
+	last := stat.timestamps[len(stat.timestamps)-1]
+
+	return stat.interval <= c.maxHotInterval() && now.Sub(last) <= conf.cooldownPeriod
+}
+
+// isHotKey is like [cache.isHot] but for the entry with keyStr.
+func (c *cache) isHotKey(keyStr string) (ok bool) {
+	stat, ok := c.requestStats.load(keyStr)
+	if !ok {
+		return false
+	}
+
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+
+	return c.isHot(stat, c.clock.Now())
+}
+
+// refreshLead returns how long before expiration the entry with keyStr should
+// be refreshed.  In the adaptive mode, it's the average interval between the
+// requests for the entry, bounded by [minAdaptiveRefreshLead] and
+// [cache.proactiveRefreshTime].
+func (c *cache) refreshLead(keyStr string) (lead time.Duration) {
+	conf := c.settings.Load()
+
+	if !conf.adaptive {
+		return conf.proactiveRefreshTime
+	}
+
+	stat, ok := c.requestStats.load(keyStr)
+	if !ok {
+		return conf.proactiveRefreshTime
+	}
+
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+
+	if stat.interval == 0 {
+		return conf.proactiveRefreshTime
+	}
+
+	return min(max(stat.interval, minAdaptiveRefreshLead), conf.proactiveRefreshTime)
+}
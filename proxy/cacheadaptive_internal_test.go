@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextInterval(t *testing.T) {
+	assert.Equal(t, 8*time.Second, nextInterval(0, 8*time.Second))
+	assert.Equal(t, 10*time.Second, nextInterval(8*time.Second, 16*time.Second))
+	assert.Equal(t, 6*time.Second, nextInterval(8*time.Second, 0))
+}
+
+func TestCache_adaptive(t *testing.T) {
+	const refreshTime = 30 * time.Second
+
+	newAdaptiveCache := func() (c *cache) {
+		return newCache(&cacheConfig{
+			size:                 testCacheSize,
+			proactiveRefreshTime: refreshTime,
+			cooldownPeriod:       time.Minute,
+			cooldownThreshold:    3,
+			adaptive:             true,
+		})
+	}
+
+	testCases := []struct {
+		name     string
+		since    time.Duration
+		wantLead time.Duration
+		wantHot  bool
+	}{{
+		name:     "hot",
+		since:    10 * time.Second,
+		wantLead: 10 * time.Second,
+		wantHot:  true,
+	}, {
+		name:     "very_hot",
+		since:    time.Millisecond,
+		wantLead: minAdaptiveRefreshLead,
+		wantHot:  true,
+	}, {
+		name:     "cold",
+		since:    50 * time.Second,
+		wantLead: refreshTime,
+		wantHot:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newAdaptiveCache()
+			key := msgToKey((&dns.Msg{}).SetQuestion("example.com.", dns.TypeA))
+
+			c.requestStats.store(string(key), &requestStat{
+				timestamps: []time.Time{time.Now().Add(-tc.since)},
+			})
+
+			// A single previous request isn't enough for the static threshold,
+			// but the rate is what matters in the adaptive mode.
+			assert.Equal(t, tc.wantHot, c.recordRequest(key, false))
+			assert.Equal(t, tc.wantHot, c.shouldProactiveRefresh(key))
+			assert.InDelta(t, tc.wantLead, c.refreshLead(string(key)), float64(time.Second))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		c := newAdaptiveCache()
+
+		assert.False(t, c.shouldProactiveRefresh([]byte("unknown")))
+		assert.Equal(t, refreshTime, c.refreshLead("unknown"))
+	})
+}
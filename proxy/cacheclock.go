@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// cacheClock is the clock used by the cache to get the current time and to
+// schedule the proactive refreshes.
+type cacheClock interface {
+	timeutil.Clock
+
+	// AfterFunc calls f after d has elapsed.  f is never called synchronously
+	// within AfterFunc, so it may acquire the locks held by the caller.
+	AfterFunc(d time.Duration, f func()) (t cacheTimer)
+}
+
+// cacheTimer is a call scheduled with [cacheClock.AfterFunc].
+type cacheTimer interface {
+	// Stop prevents the call from happening.  ok is false if the call has
+	// already happened or been stopped.
+	Stop() (ok bool)
+}
+
+// systemCacheClock is the [cacheClock] scheduling the calls with
+// [time.AfterFunc].
+type systemCacheClock struct {
+	timeutil.Clock
+}
+
+// type check
+var _ cacheClock = systemCacheClock{}
+
+// AfterFunc implements the [cacheClock] interface for systemCacheClock.
+func (systemCacheClock) AfterFunc(d time.Duration, f func()) (t cacheTimer) {
+	return time.AfterFunc(d, f)
+}
+
+// newCacheClock returns clock as a [cacheClock], if it's one, or wraps it into
+// [systemCacheClock] otherwise.  If clock is nil, [timeutil.SystemClock] is
+// used.
+func newCacheClock(clock timeutil.Clock) (c cacheClock) {
+	switch clock := clock.(type) {
+	case nil:
+		return systemCacheClock{Clock: timeutil.SystemClock{}}
+	case cacheClock:
+		return clock
+	default:
+		return systemCacheClock{Clock: clock}
+	}
+}
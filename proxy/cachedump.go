@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheRefreshStatus is the state of the proactive refresh of a cached entry,
+// see [CacheDumpEntry].
+type CacheRefreshStatus string
+
+const (
+	// CacheRefreshStatusNone means that the refresh of the entry isn't
+	// scheduled, e.g. since it hasn't been requested often enough.
+	CacheRefreshStatusNone CacheRefreshStatus = "none"
+
+	// CacheRefreshStatusScheduled means that the refresh of the entry is
+	// scheduled.
+	CacheRefreshStatusScheduled CacheRefreshStatus = "scheduled"
+
+	// CacheRefreshStatusFailing means that the last refresh of the entry has
+	// failed and it's retried with a backoff.
+	CacheRefreshStatusFailing CacheRefreshStatus = "failing"
+
+	// CacheRefreshStatusExcluded means that the entry is never refreshed due to
+	// its domain policy, e.g. [Config.CacheProactiveExcludedZones].
+	CacheRefreshStatusExcluded CacheRefreshStatus = "excluded"
+)
+
+// CacheDumpEntry is a single cached response within [Proxy.CacheDump].  It's
+// intended for the administration interfaces and debugging.
+type CacheDumpEntry struct {
+	// Domain is the requested domain name in the canonical form.
+	Domain string
+
+	// Upstream is the address of the upstream the response has been received
+	// from.
+	Upstream string
+
+	// Refresh is the state of the proactive refresh of the entry.
+	Refresh CacheRefreshStatus
+
+	// Answer contains the types and the data of the answer records, e.g.
+	// "A 192.0.2.1".
+	Answer []string
+
+	// TTL is the remaining lifetime of the entry.  It's not positive if the
+	// entry is expired and is only kept to be served stale.
+	TTL time.Duration
+
+	// Hits is the number of the cache hits of the entry.  It's only counted
+	// while the request statistics of the entry are kept, see
+	// [Config.CacheProactiveStatsMaxEntries], and is zero if
+	// [Config.CacheProactiveCooldownThreshold] is negative.
+	Hits uint64
+
+	// Rcode is the response code of the response.
+	Rcode int
+
+	// QType is the requested type.
+	QType uint16
+
+	// Prefetched is true if the entry has been stored by the proactive
+	// refresh.
+	Prefetched bool
+}
+
+// CacheDump returns the entries of the general cache sorted by the domain name
+// and type, skipping offset first ones and returning at most limit ones.  If
+// limit is not positive, all the entries following offset are returned.  total
+// is the number of all the entries, so that the callers could paginate through
+// them.  The entries cached for the client subnets and for the custom upstream
+// configurations aren't included.  It returns [ErrCacheDisabled] if the cache is
+// disabled.
+func (p *Proxy) CacheDump(offset, limit int) (entries []*CacheDumpEntry, total int, err error) {
+	if p.cache == nil {
+		return nil, 0, ErrCacheDisabled
+	}
+
+	entries, total = p.cache.dump(offset, limit)
+
+	return entries, total, nil
+}
+
+// dumpRecord is a raw entry of the general cache collected by [cache.dump].
+type dumpRecord struct {
+	// key is the cache key of the entry.
+	key string
+
+	// data is the packed cache item.  It must not be modified.
+	data []byte
+}
+
+// name returns the canonical question name within the key of r.
+func (r *dumpRecord) name() (name string) {
+	return r.key[2*packedMsgLenSz:]
+}
+
+// qtype returns the question type within the key of r.
+func (r *dumpRecord) qtype() (qt uint16) {
+	return uint16(r.key[0])<<8 | uint16(r.key[1])
+}
+
+// dump returns the page of the entries of the general cache of c, see
+// [Proxy.CacheDump].  Only the entries within the page are unpacked.
+func (c *cache) dump(offset, limit int) (entries []*CacheDumpEntry, total int) {
+	recs := c.sortedRecords()
+
+	total = len(recs)
+	start := min(max(offset, 0), total)
+	end := total
+	if limit > 0 {
+		end = min(start+limit, total)
+	}
+
+	conf := c.settings.Load()
+	now := c.clock.Now()
+	for _, r := range recs[start:end] {
+		entries = append(entries, c.dumpEntry(conf, r, now))
+	}
+
+	return entries, total
+}
+
+// sortedRecords returns the raw entries of the general cache of c sorted by the
+// question name and type.
+func (c *cache) sortedRecords() (recs []*dumpRecord) {
+	rc, ok := c.items.(rangeCache)
+	if !ok {
+		return nil
+	}
+
+	rc.Range(func(key, val []byte) (cont bool) {
+		if len(key) > 2*packedMsgLenSz && len(val) >= minPackedLen {
+			recs = append(recs, &dumpRecord{
+				key:  string(key),
+				data: val,
+			})
+		}
+
+		return true
+	})
+
+	slices.SortFunc(recs, func(a, b *dumpRecord) (res int) {
+		return cmp.Or(strings.Compare(a.name(), b.name()), cmp.Compare(a.qtype(), b.qtype()))
+	})
+
+	return recs
+}
+
+// dumpEntry returns the entry of [Proxy.CacheDump] for r.  conf must not be
+// nil.
+func (c *cache) dumpEntry(conf *cacheSettings, r *dumpRecord, now time.Time) (e *CacheDumpEntry) {
+	e = &CacheDumpEntry{
+		Domain:     r.name(),
+		Refresh:    c.refreshStatus(conf, r.key, r.name()),
+		TTL:        packedExpire(r.data).Sub(now),
+		QType:      r.qtype(),
+		Prefetched: c.isPrefetched([]byte(r.key)),
+	}
+
+	if stat, ok := c.requestStats.load(r.key); ok {
+		stat.mu.Lock()
+		e.Hits = stat.hits
+		stat.mu.Unlock()
+	}
+
+	m, u := unpackMsg(r.data)
+	if m == nil {
+		return e
+	}
+	defer putMsg(m)
+
+	e.Upstream = u
+	e.Rcode = m.Rcode
+	for _, rr := range m.Answer {
+		e.Answer = append(e.Answer, rrSummary(rr))
+	}
+
+	return e
+}
+
+// refreshStatus returns the state of the proactive refresh of the entry with
+// keyStr for domain.  conf must not be nil.
+func (c *cache) refreshStatus(
+	conf *cacheSettings,
+	keyStr string,
+	domain string,
+) (s CacheRefreshStatus) {
+	if conf.policies.match(domain).refreshPolicy() == DomainRefreshExcluded {
+		return CacheRefreshStatusExcluded
+	}
+
+	if _, ok := c.refreshFailures.Load(keyStr); ok {
+		return CacheRefreshStatusFailing
+	}
+
+	if _, ok := c.refreshTimers.Load(keyStr); ok {
+		return CacheRefreshStatusScheduled
+	}
+
+	return CacheRefreshStatusNone
+}
+
+// rrSummary returns the type and the data of rr without the rest of its
+// header, e.g. "A 192.0.2.1".
+func rrSummary(rr dns.RR) (s string) {
+	hdr := rr.Header()
+
+	return dns.Type(hdr.Rrtype).String() + " " + strings.TrimPrefix(rr.String(), hdr.String())
+}
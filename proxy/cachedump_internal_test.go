@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_CacheDump(t *testing.T) {
+	c := newCache(&cacheConfig{
+		size:              testCacheSize,
+		cooldownPeriod:    time.Hour,
+		cooldownThreshold: 10,
+	})
+	p := &Proxy{cache: c}
+
+	l := slogutil.NewDiscardLogger()
+	for _, host := range []string{"c.example.", "a.example.", "b.example."} {
+		reply := (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, 60, net.IP{192, 0, 2, 1})},
+		}).SetQuestion(host, dns.TypeA)
+		c.set(reply, upstreamWithAddr, l)
+	}
+
+	for range 2 {
+		ci, _, _ := c.get((&dns.Msg{}).SetQuestion("B.example.", dns.TypeA))
+		require.NotNil(t, ci)
+	}
+
+	entries, total, err := p.CacheDump(0, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, 3, total)
+
+	b := entries[1]
+	assert.Equal(t, "b.example.", b.Domain)
+	assert.Equal(t, dns.TypeA, b.QType)
+	assert.Equal(t, []string{"A 192.0.2.1"}, b.Answer)
+	assert.Equal(t, upstreamWithAddr.Address(), b.Upstream)
+	assert.Equal(t, dns.RcodeSuccess, b.Rcode)
+	assert.Equal(t, uint64(2), b.Hits)
+	assert.Equal(t, CacheRefreshStatusNone, b.Refresh)
+	assert.InDelta(t, time.Minute, b.TTL, float64(2*time.Second))
+	assert.False(t, b.Prefetched)
+
+	assert.Zero(t, entries[0].Hits)
+
+	testCases := []struct {
+		name        string
+		wantDomains []string
+		offset      int
+		limit       int
+	}{{
+		name:        "first_page",
+		wantDomains: []string{"a.example.", "b.example."},
+		offset:      0,
+		limit:       2,
+	}, {
+		name:        "last_page",
+		wantDomains: []string{"c.example."},
+		offset:      2,
+		limit:       2,
+	}, {
+		name:        "beyond",
+		wantDomains: nil,
+		offset:      5,
+		limit:       2,
+	}, {
+		name:        "no_limit",
+		wantDomains: []string{"b.example.", "c.example."},
+		offset:      1,
+		limit:       0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			page, pageTotal, pageErr := p.CacheDump(tc.offset, tc.limit)
+			require.NoError(t, pageErr)
+
+			assert.Equal(t, total, pageTotal)
+
+			var domains []string
+			for _, e := range page {
+				domains = append(domains, e.Domain)
+			}
+
+			assert.Equal(t, tc.wantDomains, domains)
+		})
+	}
+
+	_, _, err = (&Proxy{}).CacheDump(0, 0)
+	assert.ErrorIs(t, err, ErrCacheDisabled)
+}
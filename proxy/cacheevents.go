@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheEventsBufSize is the number of the events buffered for each
+// [CacheSubscription].
+const cacheEventsBufSize = 256
+
+// CacheEventType is the type of a [CacheEvent].
+type CacheEventType uint8
+
+// Valid [CacheEventType] values.
+const (
+	// CacheEventInsert means that a response is stored for a name which had no
+	// cached response.
+	CacheEventInsert CacheEventType = iota + 1
+
+	// CacheEventRefresh means that the cached response is replaced with a
+	// newer one, e.g. by the proactive refresh.
+	CacheEventRefresh
+
+	// CacheEventExpiry means that the expired cached response is removed.  The
+	// expired responses are removed lazily, once they're requested again.
+	CacheEventExpiry
+
+	// CacheEventEviction means that the cached response is removed to free up
+	// space for another one.
+	CacheEventEviction
+)
+
+// String implements the [fmt.Stringer] interface for CacheEventType.
+func (t CacheEventType) String() (s string) {
+	switch t {
+	case CacheEventInsert:
+		return "insert"
+	case CacheEventRefresh:
+		return "refresh"
+	case CacheEventExpiry:
+		return "expiry"
+	case CacheEventEviction:
+		return "eviction"
+	default:
+		return fmt.Sprintf("!bad_cache_event_type_%d", t)
+	}
+}
+
+// CacheEvent is a single change of the contents of the cache, see
+// [Proxy.SubscribeCacheEvents].
+type CacheEvent struct {
+	// Time is the time of the change.
+	Time time.Time
+
+	// Response is the stored response.  It's only set for
+	// [CacheEventInsert] and [CacheEventRefresh], and must not be modified.
+	Response *dns.Msg
+
+	// Name is the requested domain name.  It may be empty for the removed
+	// entries which couldn't be decoded.
+	Name string
+
+	// QType is the requested type.
+	QType uint16
+
+	// Type is the type of the change.
+	Type CacheEventType
+
+	// WithSubnet is true if the entry is stored for a particular client subnet,
+	// see [Config.EnableEDNSClientSubnet].
+	WithSubnet bool
+}
+
+// CacheSubscription receives the events of the cache, see
+// [Proxy.SubscribeCacheEvents].  It must be closed once not needed anymore.
+type CacheSubscription struct {
+	// hub is the hub the subscription is registered within.
+	hub *cacheEventHub
+
+	// events receives the events.  It's closed on unsubscribing.
+	events chan *CacheEvent
+
+	// dropped is the number of the events dropped due to the full buffer.
+	dropped *atomic.Uint64
+
+	// closeOnce makes sure the subscription is only closed once.
+	closeOnce *sync.Once
+}
+
+// Events returns the channel receiving the events.  The events are dropped
+// instead of blocking the cache when the channel isn't read fast enough, see
+// [CacheSubscription.Dropped].  The channel is closed once s is closed.
+func (s *CacheSubscription) Events() (events <-chan *CacheEvent) {
+	return s.events
+}
+
+// Dropped returns the number of the events dropped since s has been created
+// because the channel returned by [CacheSubscription.Events] was full.
+func (s *CacheSubscription) Dropped() (n uint64) {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes s from the events of the cache and closes the channel.  It
+// always returns nil and is safe for concurrent and repeated use.
+func (s *CacheSubscription) Close() (err error) {
+	s.closeOnce.Do(func() {
+		s.hub.unsubscribe(s)
+		close(s.events)
+	})
+
+	return nil
+}
+
+// cacheEventHub distributes the events of a cache to the subscriptions.  All
+// its methods are safe for concurrent use.
+type cacheEventHub struct {
+	// mu protects subs.  It's held for reading while sending the events, so
+	// that the channels aren't closed in the meantime.
+	mu *sync.RWMutex
+
+	// subs is the set of the active subscriptions.
+	subs map[*CacheSubscription]unit
+
+	// num is the number of the active subscriptions, it's used to avoid
+	// building the events nobody receives.
+	num *atomic.Int32
+}
+
+// newCacheEventHub returns a new properly initialized *cacheEventHub.
+func newCacheEventHub() (h *cacheEventHub) {
+	return &cacheEventHub{
+		mu:   &sync.RWMutex{},
+		subs: map[*CacheSubscription]unit{},
+		num:  &atomic.Int32{},
+	}
+}
+
+// subscribe returns a new subscription to the events of h.
+func (h *cacheEventHub) subscribe() (s *CacheSubscription) {
+	s = &CacheSubscription{
+		hub:       h,
+		events:    make(chan *CacheEvent, cacheEventsBufSize),
+		dropped:   &atomic.Uint64{},
+		closeOnce: &sync.Once{},
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subs[s] = unit{}
+	h.num.Add(1)
+
+	return s
+}
+
+// unsubscribe removes s from h.
+func (h *cacheEventHub) unsubscribe(s *CacheSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs, s)
+	h.num.Add(-1)
+}
+
+// active returns true if h has any subscriptions.
+func (h *cacheEventHub) active() (ok bool) {
+	return h.num.Load() > 0
+}
+
+// emit sends e to all the subscriptions of h without blocking.
+func (h *cacheEventHub) emit(e *CacheEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.subs {
+		select {
+		case s.events <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// SubscribeCacheEvents returns a new subscription to the changes of the general
+// cache, e.g. to mirror it or to build dashboards.  The entries removed on
+// clearing the cache aren't reported, nor are the changes of the caches of the
+// custom upstream configurations.  It returns [ErrCacheDisabled] if the cache
+// is disabled.
+func (p *Proxy) SubscribeCacheEvents() (s *CacheSubscription, err error) {
+	if p.cache == nil {
+		return nil, ErrCacheDisabled
+	}
+
+	return p.cache.events.subscribe(), nil
+}
+
+// emitStored reports storing resp into the cache.  replaced is true if the
+// previous response has been replaced.
+func (c *cache) emitStored(resp *dns.Msg, replaced, withSubnet bool) {
+	if !c.events.active() {
+		return
+	}
+
+	typ := CacheEventInsert
+	if replaced {
+		typ = CacheEventRefresh
+	}
+
+	q := resp.Question[0]
+	c.events.emit(&CacheEvent{
+		Time:       c.clock.Now(),
+		Response:   resp.Copy(),
+		Name:       q.Name,
+		QType:      q.Qtype,
+		Type:       typ,
+		WithSubnet: withSubnet,
+	})
+}
+
+// emitRemoved reports removing the packed item data from the cache.
+func (c *cache) emitRemoved(typ CacheEventType, data []byte, withSubnet bool) {
+	if !c.events.active() {
+		return
+	}
+
+	name, qtype := packedQuestion(data)
+	c.events.emit(&CacheEvent{
+		Time:       c.clock.Now(),
+		Name:       name,
+		QType:      qtype,
+		Type:       typ,
+		WithSubnet: withSubnet,
+	})
+}
+
+// onEvicted returns the function reporting the eviction of the entries from the
+// storage of c with or without the subnet.
+func (c *cache) onEvicted(withSubnet bool) (onDelete func(key, val []byte)) {
+	return func(_, val []byte) {
+		c.emitRemoved(CacheEventEviction, val, withSubnet)
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_events(t *testing.T) {
+	const (
+		expiredHost = "expired.example."
+		evictedHost = "evicted.example."
+	)
+
+	now := time.Now()
+	c := newCache(&cacheConfig{
+		size: testCacheSize,
+		clock: newCacheClock(&faketime.Clock{
+			OnNow: func() (n time.Time) { return now },
+		}),
+	})
+
+	sub := c.events.subscribe()
+	testutil.CleanupAndRequireSuccess(t, sub.Close)
+
+	newReply := func(host string) (reply *dns.Msg) {
+		return (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, 60, net.IP{192, 0, 2, 1})},
+		}).SetQuestion(host, dns.TypeA)
+	}
+
+	l := slogutil.NewDiscardLogger()
+	c.set(newReply(expiredHost), upstreamWithAddr, l)
+	c.set(newReply(expiredHost), upstreamWithAddr, l)
+
+	now = now.Add(time.Minute + time.Second)
+	ci, _, _ := c.get((&dns.Msg{}).SetQuestion(expiredHost, dns.TypeA))
+	require.Nil(t, ci)
+
+	c.set(newReply(evictedHost), upstreamWithAddr, l)
+	c.setMaxSize(1)
+
+	wantEvents := []struct {
+		name string
+		typ  CacheEventType
+	}{{
+		name: expiredHost,
+		typ:  CacheEventInsert,
+	}, {
+		name: expiredHost,
+		typ:  CacheEventRefresh,
+	}, {
+		name: expiredHost,
+		typ:  CacheEventExpiry,
+	}, {
+		name: evictedHost,
+		typ:  CacheEventInsert,
+	}, {
+		name: evictedHost,
+		typ:  CacheEventEviction,
+	}}
+
+	for _, want := range wantEvents {
+		e, _ := testutil.RequireReceive(t, sub.Events(), testTimeout)
+		assert.Equal(t, want.typ, e.Type, "event %s of %s", e.Type, e.Name)
+		assert.Equal(t, want.name, e.Name)
+		assert.Equal(t, dns.TypeA, e.QType)
+		assert.False(t, e.Time.IsZero())
+		assert.False(t, e.WithSubnet)
+
+		switch e.Type {
+		case CacheEventInsert, CacheEventRefresh:
+			require.NotNil(t, e.Response)
+			assert.Len(t, e.Response.Answer, 1)
+		default:
+			assert.Nil(t, e.Response)
+		}
+	}
+
+	assert.Empty(t, sub.Events())
+	assert.Zero(t, sub.Dropped())
+
+	require.NoError(t, sub.Close())
+	_, ok := <-sub.Events()
+	assert.False(t, ok)
+
+	// The closed subscription receives nothing.
+	c.set(newReply(expiredHost), upstreamWithAddr, l)
+}
+
+func TestProxy_SubscribeCacheEvents(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	sub, err := p.SubscribeCacheEvents()
+	assert.Nil(t, sub)
+	assert.ErrorIs(t, err, ErrCacheDisabled)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+
+	"github.com/AdguardTeam/dnsproxy/internal/cachestore"
+)
+
+// CacheEvictionPolicy defines which entries are removed from the full cache
+// first.
+type CacheEvictionPolicy string
+
+const (
+	// CacheEvictionPolicyLRU makes the cache evict the least recently used
+	// entries first.  It's the default policy.
+	CacheEvictionPolicyLRU CacheEvictionPolicy = "lru"
+
+	// CacheEvictionPolicyLFU makes the cache evict the least frequently used
+	// entries first.
+	CacheEvictionPolicyLFU CacheEvictionPolicy = "lfu"
+
+	// CacheEvictionPolicyARC makes the cache balance between the recently and
+	// the frequently used entries, so that the popular entries aren't evicted
+	// by the long tail of the ones requested once.
+	CacheEvictionPolicyARC CacheEvictionPolicy = "arc"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*CacheEvictionPolicy)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *CacheEvictionPolicy.
+func (p *CacheEvictionPolicy) UnmarshalText(b []byte) (err error) {
+	switch pol := CacheEvictionPolicy(b); pol {
+	case
+		CacheEvictionPolicyLRU,
+		CacheEvictionPolicyLFU,
+		CacheEvictionPolicyARC:
+		*p = pol
+	default:
+		return fmt.Errorf(
+			"invalid cache eviction policy %q, supported: %q, %q, %q",
+			b,
+			CacheEvictionPolicyLRU,
+			CacheEvictionPolicyLFU,
+			CacheEvictionPolicyARC,
+		)
+	}
+
+	return nil
+}
+
+// type check
+var _ encoding.TextMarshaler = CacheEvictionPolicy("")
+
+// MarshalText implements [encoding.TextMarshaler] interface for
+// CacheEvictionPolicy.
+func (p CacheEvictionPolicy) MarshalText() (text []byte, err error) {
+	return []byte(p), nil
+}
+
+// storePolicy returns the policy of the cache storage corresponding to p.  The
+// empty and unknown policies are treated as [CacheEvictionPolicyLRU].
+func (p CacheEvictionPolicy) storePolicy() (pol cachestore.Policy) {
+	switch p {
+	case CacheEvictionPolicyLFU:
+		return cachestore.PolicyLFU
+	case CacheEvictionPolicyARC:
+		return cachestore.PolicyARC
+	default:
+		return cachestore.PolicyLRU
+	}
+}
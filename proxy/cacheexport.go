@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// CacheExportFormat is the format of the cache entries written by
+// [Proxy.ExportCache] and read by [Proxy.ImportCache].
+type CacheExportFormat string
+
+const (
+	// CacheExportFormatJSON is the JSON object with the entries array, each
+	// entry containing the question, the response code, the expiration time,
+	// the upstream address, and the records of the response in the
+	// presentation format.
+	CacheExportFormatJSON CacheExportFormat = "json"
+
+	// CacheExportFormatZone is the RFC 1035 master file format with a single
+	// record per line.  Each entry starts with the ";; QUESTION" comment and
+	// its metadata and sections are specified by the comments following it,
+	// similar to the output of dig, e.g.:
+	//
+	//	;; QUESTION example.org. IN A
+	//	;; RCODE NOERROR
+	//	;; EXPIRES 2024-01-01T00:00:00Z
+	//	;; UPSTREAM 8.8.8.8:53
+	//	;; ANSWER
+	//	example.org.	300	IN	A	192.0.2.1
+	CacheExportFormatZone CacheExportFormat = "zone"
+)
+
+// The directives of [CacheExportFormatZone].
+const (
+	zoneDirectiveQuestion   = "QUESTION"
+	zoneDirectiveRcode      = "RCODE"
+	zoneDirectiveExpires    = "EXPIRES"
+	zoneDirectiveUpstream   = "UPSTREAM"
+	zoneDirectiveAnswer     = "ANSWER"
+	zoneDirectiveAuthority  = "AUTHORITY"
+	zoneDirectiveAdditional = "ADDITIONAL"
+)
+
+// cacheExport is the document of [CacheExportFormatJSON].
+type cacheExport struct {
+	Entries []*cacheExportEntry `json:"entries"`
+}
+
+// cacheExportEntry is a single exported cache entry.
+type cacheExportEntry struct {
+	// Expires is the time the entry expires at.
+	Expires time.Time `json:"expires"`
+
+	// Name is the question name.
+	Name string `json:"name"`
+
+	// Type is the question type, e.g. "A".
+	Type string `json:"type"`
+
+	// Class is the question class, e.g. "IN".
+	Class string `json:"class"`
+
+	// Rcode is the response code, e.g. "NOERROR".
+	Rcode string `json:"rcode"`
+
+	// Upstream is the address of the upstream the response has been received
+	// from.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Answer are the records of the answer section in the presentation
+	// format.
+	Answer []string `json:"answer,omitempty"`
+
+	// Authority are the records of the authority section in the presentation
+	// format.
+	Authority []string `json:"authority,omitempty"`
+
+	// Additional are the records of the additional section in the presentation
+	// format, except for the OPT one.
+	Additional []string `json:"additional,omitempty"`
+}
+
+// ExportCache writes the entries of the general cache into w in format, so
+// that they could be loaded into another proxy with [Proxy.ImportCache], e.g.
+// to reproduce an issue.  The entries cached for the client subnets and for the
+// custom upstream configurations aren't included.  It returns
+// [ErrCacheDisabled] if the cache is disabled.
+func (p *Proxy) ExportCache(w io.Writer, format CacheExportFormat) (err error) {
+	if p.cache == nil {
+		return ErrCacheDisabled
+	}
+
+	entries := p.cache.exportEntries()
+
+	switch format {
+	case CacheExportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(&cacheExport{Entries: entries})
+	case CacheExportFormatZone:
+		return writeZoneEntries(w, entries)
+	default:
+		return fmt.Errorf("format: %w: %q", errors.ErrBadEnumValue, format)
+	}
+}
+
+// ImportCache stores the cache entries read from r in format into the general
+// cache, replacing the entries for the same questions.  The entries keep their
+// expiration time, so the expired ones are only served if the cache is
+// optimistic.  The entries without the expiration time expire after the lowest
+// TTL of their records.  n is the number of entries stored before an error, if
+// any.  It returns [ErrCacheDisabled] if the cache is disabled.
+func (p *Proxy) ImportCache(r io.Reader, format CacheExportFormat) (n int, err error) {
+	if p.cache == nil {
+		return 0, ErrCacheDisabled
+	}
+
+	var entries []*cacheExportEntry
+	switch format {
+	case CacheExportFormatJSON:
+		doc := &cacheExport{}
+		err = json.NewDecoder(r).Decode(doc)
+		entries = doc.Entries
+	case CacheExportFormatZone:
+		entries, err = readZoneEntries(r)
+	default:
+		return 0, fmt.Errorf("format: %w: %q", errors.ErrBadEnumValue, format)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("reading entries: %w", err)
+	}
+
+	for i, e := range entries {
+		err = p.cache.importEntry(e, p.cacheLogger)
+		if err != nil {
+			return n, fmt.Errorf("entry at index %d: %w", i, err)
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// exportEntries returns the entries of the general cache of c sorted by the
+// question name and type.
+func (c *cache) exportEntries() (entries []*cacheExportEntry) {
+	for _, r := range c.sortedRecords() {
+		if e := newCacheExportEntry(r.data); e != nil {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// newCacheExportEntry returns the exported entry for the packed cache item
+// data.  It returns nil if data is malformed.
+func newCacheExportEntry(data []byte) (e *cacheExportEntry) {
+	m, u := unpackMsg(data)
+	if m == nil {
+		return nil
+	}
+	defer putMsg(m)
+
+	if len(m.Question) == 0 {
+		return nil
+	}
+
+	q := m.Question[0]
+
+	return &cacheExportEntry{
+		Expires:    packedExpire(data).UTC(),
+		Name:       q.Name,
+		Type:       dns.Type(q.Qtype).String(),
+		Class:      dns.Class(q.Qclass).String(),
+		Rcode:      dns.RcodeToString[m.Rcode],
+		Upstream:   u,
+		Answer:     rrStrings(m.Answer),
+		Authority:  rrStrings(m.Ns),
+		Additional: rrStrings(m.Extra),
+	}
+}
+
+// rrStrings returns the presentation format of rrs, except for the OPT ones.
+func rrStrings(rrs []dns.RR) (strs []string) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			strs = append(strs, rr.String())
+		}
+	}
+
+	return strs
+}
+
+// importEntry stores the entry e into the general cache of c.  l must not be
+// nil.
+func (c *cache) importEntry(e *cacheExportEntry, l *slog.Logger) (err error) {
+	m, err := e.toMsg()
+	if err != nil {
+		return err
+	}
+
+	now := c.clock.Now()
+	ttl := calculateTTL(m)
+	if !e.Expires.IsZero() {
+		ttl = uint32(max(e.Expires.Sub(now), 0) / time.Second)
+	}
+
+	item := &cacheItem{
+		m:   m,
+		u:   e.Upstream,
+		ttl: ttl,
+	}
+
+	key := msgToKey(m)
+	packed := item.pack(now)
+	if c.isOversized(key, packed, l) {
+		return nil
+	}
+
+	c.items.Set(key, packed)
+	c.journalItem(cacheRecordItem, key, packed)
+	c.prefetched.Delete(string(key))
+
+	return nil
+}
+
+// toMsg returns the response message of e.
+func (e *cacheExportEntry) toMsg() (m *dns.Msg, err error) {
+	qtype, ok := dns.StringToType[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("type: %w: %q", errors.ErrBadEnumValue, e.Type)
+	}
+
+	qclass, ok := dns.StringToClass[e.Class]
+	if !ok {
+		return nil, fmt.Errorf("class: %w: %q", errors.ErrBadEnumValue, e.Class)
+	}
+
+	rcode, ok := dns.StringToRcode[e.Rcode]
+	if !ok {
+		return nil, fmt.Errorf("rcode: %w: %q", errors.ErrBadEnumValue, e.Rcode)
+	}
+
+	if _, ok = dns.IsDomainName(e.Name); !ok {
+		return nil, fmt.Errorf("name: bad domain name %q", e.Name)
+	}
+
+	m = (&dns.Msg{}).SetQuestion(dns.Fqdn(e.Name), qtype)
+	m.Question[0].Qclass = qclass
+	m.Response = true
+	m.Rcode = rcode
+
+	m.Answer, err = parseRRs(e.Answer)
+	if err != nil {
+		return nil, fmt.Errorf("answer: %w", err)
+	}
+
+	m.Ns, err = parseRRs(e.Authority)
+	if err != nil {
+		return nil, fmt.Errorf("authority: %w", err)
+	}
+
+	m.Extra, err = parseRRs(e.Additional)
+	if err != nil {
+		return nil, fmt.Errorf("additional: %w", err)
+	}
+
+	return m, nil
+}
+
+// parseRRs parses the records in the presentation format.
+func parseRRs(strs []string) (rrs []dns.RR, err error) {
+	for i, s := range strs {
+		var rr dns.RR
+		rr, err = dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("record at index %d: %w", i, err)
+		} else if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return rrs, nil
+}
+
+// writeZoneEntries writes entries into w in [CacheExportFormatZone].
+func writeZoneEntries(w io.Writer, entries []*cacheExportEntry) (err error) {
+	bw := bufio.NewWriter(w)
+
+	// The errors of the writes are sticky, so only check the one of the flush.
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(bw, ";; %s %s %s %s\n", zoneDirectiveQuestion, e.Name, e.Class, e.Type)
+		_, _ = fmt.Fprintf(bw, ";; %s %s\n", zoneDirectiveRcode, e.Rcode)
+		_, _ = fmt.Fprintf(bw, ";; %s %s\n", zoneDirectiveExpires, e.Expires.Format(time.RFC3339))
+		if e.Upstream != "" {
+			_, _ = fmt.Fprintf(bw, ";; %s %s\n", zoneDirectiveUpstream, e.Upstream)
+		}
+
+		writeZoneSection(bw, zoneDirectiveAnswer, e.Answer)
+		writeZoneSection(bw, zoneDirectiveAuthority, e.Authority)
+		writeZoneSection(bw, zoneDirectiveAdditional, e.Additional)
+
+		_, _ = bw.WriteString("\n")
+	}
+
+	return bw.Flush()
+}
+
+// writeZoneSection writes the section of records rrs named name into w, if
+// there are any.
+func writeZoneSection(w *bufio.Writer, name string, rrs []string) {
+	if len(rrs) == 0 {
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, ";; %s\n", name)
+	for _, rr := range rrs {
+		_, _ = w.WriteString(rr + "\n")
+	}
+}
+
+// readZoneEntries reads the entries in [CacheExportFormatZone] from r.
+func readZoneEntries(r io.Reader) (entries []*cacheExportEntry, err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, dns.MaxMsgSize), dns.MaxMsgSize)
+
+	var e *cacheExportEntry
+	var section *[]string
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+
+		switch {
+		case line == "":
+			// Go on.
+		case strings.HasPrefix(line, ";;"):
+			var next *cacheExportEntry
+			next, section, err = parseZoneDirective(strings.Fields(line[2:]), e, section)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+			if next != e {
+				entries = append(entries, next)
+				e = next
+			}
+		case strings.HasPrefix(line, ";"):
+			// Skip the comments.
+		case section == nil:
+			return nil, fmt.Errorf("line %d: record outside of section", lineNum)
+		default:
+			*section = append(*section, line)
+		}
+	}
+
+	return entries, s.Err()
+}
+
+// parseZoneDirective applies the directive consisting of fields to the current
+// entry e and section.  It returns the new entry for the question directive.
+func parseZoneDirective(
+	fields []string,
+	e *cacheExportEntry,
+	section *[]string,
+) (newEntry *cacheExportEntry, newSection *[]string, err error) {
+	if len(fields) == 0 {
+		// Not a directive, but a comment.
+		return e, section, nil
+	}
+
+	dir, args := fields[0], fields[1:]
+	if dir == zoneDirectiveQuestion {
+		if len(args) != 3 {
+			return nil, nil, fmt.Errorf("%s: want 3 fields, got %d", dir, len(args))
+		}
+
+		return &cacheExportEntry{
+			Name:  args[0],
+			Class: args[1],
+			Type:  args[2],
+		}, nil, nil
+	} else if e == nil {
+		return nil, nil, fmt.Errorf("%s: no preceding %s", dir, zoneDirectiveQuestion)
+	}
+
+	switch dir {
+	case zoneDirectiveRcode:
+		e.Rcode = strings.Join(args, "")
+	case zoneDirectiveExpires:
+		e.Expires, err = time.Parse(time.RFC3339, strings.Join(args, ""))
+	case zoneDirectiveUpstream:
+		e.Upstream = strings.Join(args, " ")
+	case zoneDirectiveAnswer:
+		section = &e.Answer
+	case zoneDirectiveAuthority:
+		section = &e.Authority
+	case zoneDirectiveAdditional:
+		section = &e.Additional
+	default:
+		// Skip the unknown directives and comments.
+	}
+
+	return e, section, err
+}
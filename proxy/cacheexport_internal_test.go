@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ExportCache(t *testing.T) {
+	const (
+		host   = "example.org."
+		nxHost = "nx.example.org."
+	)
+
+	newProxy := func() (p *Proxy) {
+		return &Proxy{
+			cache:       newCache(&cacheConfig{size: testCacheSize}),
+			cacheLogger: slogutil.NewDiscardLogger(),
+		}
+	}
+
+	src := newProxy()
+
+	l := slogutil.NewDiscardLogger()
+	reply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{
+			newRR(t, host, dns.TypeA, 300, net.IP{192, 0, 2, 1}),
+			newRR(t, host, dns.TypeA, 300, net.IP{192, 0, 2, 2}),
+		},
+	}).SetQuestion(host, dns.TypeA)
+	src.cache.set(reply, upstreamWithAddr, l)
+
+	nxReply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+			Rcode:    dns.RcodeNameError,
+		},
+		Ns: []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "example.org.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Ns:      "ns.example.org.",
+			Mbox:    "hostmaster.example.org.",
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}},
+	}).SetQuestion(nxHost, dns.TypeAAAA)
+	src.cache.set(nxReply, upstreamWithAddr, l)
+
+	for _, format := range []CacheExportFormat{CacheExportFormatJSON, CacheExportFormatZone} {
+		t.Run(string(format), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, src.ExportCache(buf, format))
+
+			dst := newProxy()
+			n, err := dst.ImportCache(buf, format)
+			require.NoError(t, err)
+
+			assert.Equal(t, 2, n)
+
+			ci, expired, _ := dst.cache.get((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+			require.NotNil(t, ci)
+			require.Len(t, ci.m.Answer, 2)
+
+			assert.False(t, expired)
+			assert.Equal(t, upstreamWithAddr.Address(), ci.u)
+			assert.Equal(t, dns.RcodeSuccess, ci.m.Rcode)
+
+			ci, _, _ = dst.cache.get((&dns.Msg{}).SetQuestion(nxHost, dns.TypeAAAA))
+			require.NotNil(t, ci)
+			require.Len(t, ci.m.Ns, 1)
+
+			assert.Equal(t, dns.RcodeNameError, ci.m.Rcode)
+			assert.Equal(t, dns.TypeSOA, ci.m.Ns[0].Header().Rrtype)
+		})
+	}
+
+	t.Run("zone_without_expiration", func(t *testing.T) {
+		const zone = `; hand-written entry
+;; QUESTION example.net. IN A
+;; RCODE NOERROR
+;; ANSWER
+example.net.	60	IN	A	192.0.2.3
+`
+
+		dst := newProxy()
+		n, err := dst.ImportCache(strings.NewReader(zone), CacheExportFormatZone)
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, n)
+
+		ci, expired, _ := dst.cache.get((&dns.Msg{}).SetQuestion("example.net.", dns.TypeA))
+		require.NotNil(t, ci)
+
+		assert.False(t, expired)
+		assert.Empty(t, ci.u)
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		testCases := []struct {
+			name       string
+			in         string
+			format     CacheExportFormat
+			wantErrMsg string
+		}{{
+			name:       "record_outside_entry",
+			in:         "example.net. 60 IN A 192.0.2.3\n",
+			format:     CacheExportFormatZone,
+			wantErrMsg: "reading entries: line 1: record outside of section",
+		}, {
+			name:       "bad_type",
+			in:         `{"entries":[{"name":"example.net.","type":"BAD","class":"IN","rcode":"NOERROR"}]}`,
+			format:     CacheExportFormatJSON,
+			wantErrMsg: `entry at index 0: type: bad enum value: "BAD"`,
+		}, {
+			name:       "bad_format",
+			in:         "",
+			format:     "bad",
+			wantErrMsg: `format: bad enum value: "bad"`,
+		}}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := newProxy().ImportCache(strings.NewReader(tc.in), tc.format)
+				assert.EqualError(t, err, tc.wantErrMsg)
+			})
+		}
+	})
+
+	err := (&Proxy{}).ExportCache(&bytes.Buffer{}, CacheExportFormatJSON)
+	assert.ErrorIs(t, err, ErrCacheDisabled)
+
+	_, err = (&Proxy{}).ImportCache(strings.NewReader(""), CacheExportFormatJSON)
+	assert.ErrorIs(t, err, ErrCacheDisabled)
+
+	assert.ErrorIs(t, src.ExportCache(&bytes.Buffer{}, "bad"), errors.ErrBadEnumValue)
+}
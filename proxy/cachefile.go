@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// The persistent cache file format.
+//
+// The file has the header and the records described in [fileFormat] with the
+// magic [cacheFileMagic].  Item records store the cache keys and the packed
+// items exactly as they're kept in memory, i.e. the expiration time, the
+// message length, the packed message, and the upstream address.  Request
+// statistics records store the request timestamps of the proactive refreshes
+// as big-endian Unix times in nanoseconds, so they're versioned together with
+// the items.
+const (
+	// cacheFileMagic identifies the persistent cache files.
+	cacheFileMagic = "DPXC"
+
+	// cacheFileVersion is the current version of the persistent cache file
+	// format.
+	cacheFileVersion uint16 = 1
+)
+
+// cacheRecordKind is the kind of a persistent cache file record.
+type cacheRecordKind uint8
+
+// Persistent cache file record kinds.
+const (
+	cacheRecordItem           cacheRecordKind = 1
+	cacheRecordItemWithSubnet cacheRecordKind = 2
+	cacheRecordRequestStat    cacheRecordKind = 3
+)
+
+// cacheFileFormat is the format of the persistent cache file and the cache
+// journal.  There are no migrations yet, since version 1 is the first one.
+var cacheFileFormat = &fileFormat{
+	migrations: map[uint16]fileMigration{},
+	magic:      cacheFileMagic,
+	version:    cacheFileVersion,
+}
+
+// errCacheFileFormat is returned when the persistent cache file is malformed.
+const errCacheFileFormat errors.Error = "bad cache file format"
+
+// rangeCache is a cache which entries could be iterated over.
+type rangeCache interface {
+	Range(f func(key, val []byte) (cont bool))
+}
+
+// loadCacheFile loads the cache entries from the file at path.  Missing file
+// is not an error.  Files of unsupported versions and malformed files are
+// moved aside, so that they aren't lost on the next save.
+func (p *Proxy) loadCacheFile(path string) (err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading cache file: %w", err)
+	}
+
+	body, err := cacheFileFormat.migrate(data)
+	if err == nil {
+		var n int
+		n, err = p.cache.decodeRecords(body)
+		p.cacheLogger.Info("loaded cache file", "path", path, "records", n)
+	}
+
+	if err != nil {
+		// Keep the entries decoded so far, but don't lose the rest.
+		bakPath := cacheFileFormat.backupPath(path, data)
+		p.cacheLogger.Warn("moving cache file aside", "path", bakPath, "err", err)
+
+		err = os.Rename(path, bakPath)
+		if err != nil {
+			return fmt.Errorf("moving cache file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// decodeRecords stores the records from body into c.  n is the number of
+// records decoded.
+func (c *cache) decodeRecords(body []byte) (n int, err error) {
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		var kind cacheRecordKind
+		var key, val []byte
+		kind, key, val, err = readCacheRecord(r)
+		if err != nil {
+			return n, err
+		}
+
+		switch kind {
+		case cacheRecordItem:
+			c.addStale(key, val, false)
+			c.items.Set(key, val)
+		case cacheRecordItemWithSubnet:
+			if c.itemsWithSubnet != nil {
+				c.addStale(key, val, true)
+				c.itemsWithSubnet.Set(key, val)
+			}
+		case cacheRecordRequestStat:
+			c.decodeRequestStat(key, val)
+		default:
+			// Skip the records of the newer kinds.
+			continue
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// readCacheRecord reads a single record from r.
+func readCacheRecord(r *bytes.Reader) (kind cacheRecordKind, key, val []byte, err error) {
+	var hdr struct {
+		Kind   cacheRecordKind
+		KeyLen uint16
+	}
+
+	err = binary.Read(r, binary.BigEndian, &hdr)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("%w: reading record: %w", errCacheFileFormat, err)
+	}
+
+	key = make([]byte, hdr.KeyLen)
+	_, err = io.ReadFull(r, key)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("%w: reading key: %w", errCacheFileFormat, err)
+	}
+
+	var valLen uint32
+	err = binary.Read(r, binary.BigEndian, &valLen)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("%w: reading value length: %w", errCacheFileFormat, err)
+	} else if int64(valLen) > int64(r.Len()) {
+		return 0, nil, nil, fmt.Errorf("%w: value length %d is too large", errCacheFileFormat, valLen)
+	}
+
+	val = make([]byte, valLen)
+	_, _ = io.ReadFull(r, val)
+
+	return hdr.Kind, key, val, nil
+}
+
+// decodeRequestStat stores the request timestamps from val for key.
+func (c *cache) decodeRequestStat(key, val []byte) {
+	stat := &requestStat{
+		timestamps: make([]time.Time, 0, len(val)/8),
+	}
+	for ; len(val) >= 8; val = val[8:] {
+		nsec := int64(binary.BigEndian.Uint64(val))
+		stat.timestamps = append(stat.timestamps, time.Unix(0, nsec))
+	}
+
+	c.requestStats.store(string(key), stat)
+}
+
+// saveCacheFile writes the cache entries into the file at path.  The file is
+// replaced atomically.  The file of an unsupported newer version is moved aside
+// first.
+func (p *Proxy) saveCacheFile(path string) (err error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating cache file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = p.cache.encode(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		return fmt.Errorf("writing cache file: %w", errors.WithDeferred(err, os.Remove(tmpPath)))
+	}
+
+	err = cacheFileFormat.backupNewer(path)
+	if err != nil {
+		return fmt.Errorf("backing up cache file: %w", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// encode writes the header and all the records of c into w.
+func (c *cache) encode(w io.Writer) (err error) {
+	_, err = w.Write(cacheFileFormat.header())
+	if err != nil {
+		return err
+	}
+
+	err = encodeItems(w, cacheRecordItem, c.items)
+	if err != nil {
+		return err
+	}
+
+	err = encodeItems(w, cacheRecordItemWithSubnet, c.itemsWithSubnet)
+	if err != nil {
+		return err
+	}
+
+	c.requestStats.rangeStats(func(k string, stat *requestStat) (cont bool) {
+		stat.mu.Lock()
+		val := make([]byte, 0, len(stat.timestamps)*8)
+		for _, ts := range stat.timestamps {
+			val = binary.BigEndian.AppendUint64(val, uint64(ts.UnixNano()))
+		}
+		stat.mu.Unlock()
+
+		err = writeCacheRecord(w, cacheRecordRequestStat, []byte(k), val)
+
+		return err == nil
+	})
+
+	return err
+}
+
+// encodeItems writes the entries of items into w as records of kind.  items
+// may be nil.  It does nothing if items doesn't support iteration.
+func encodeItems(w io.Writer, kind cacheRecordKind, items any) (err error) {
+	rc, ok := items.(rangeCache)
+	if !ok {
+		return nil
+	}
+
+	rc.Range(func(key, val []byte) (cont bool) {
+		err = writeCacheRecord(w, kind, key, val)
+
+		return err == nil
+	})
+
+	return err
+}
+
+// writeCacheRecord writes a single record into w.
+func writeCacheRecord(w io.Writer, kind cacheRecordKind, key, val []byte) (err error) {
+	buf := make([]byte, 0, 1+2+len(key)+4+len(val))
+	buf = append(buf, byte(kind))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+	buf = append(buf, key...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(val)))
+	buf = append(buf, val...)
+
+	_, err = w.Write(buf)
+
+	return err
+}
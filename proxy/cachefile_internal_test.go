@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCacheFileProxy returns a *Proxy with only the fields required for
+// persisting the cache set.
+func newTestCacheFileProxy(tb testing.TB) (p *Proxy) {
+	tb.Helper()
+
+	p = &Proxy{
+		cache:  newTestCache(tb, &cacheConfig{withECS: true}),
+		logger: slogutil.NewDiscardLogger(),
+	}
+	p.initLoggers()
+
+	return p
+}
+
+func TestProxy_cacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+
+	reply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, "example.com.", dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+	}).SetQuestion("example.com.", dns.TypeA)
+
+	_, subnet, err := net.ParseCIDR("1.2.3.0/24")
+	require.NoError(t, err)
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	key := msgToKey(req)
+	ts := time.Now().Truncate(time.Second)
+
+	saved := newTestCacheFileProxy(t)
+	saved.cache.set(reply, upstreamWithAddr, saved.logger)
+	saved.cache.setWithSubnet(reply, upstreamWithAddr, subnet, saved.logger)
+	saved.cache.requestStats.store(string(key), &requestStat{
+		timestamps: []time.Time{ts},
+	})
+
+	require.NoError(t, saved.saveCacheFile(path))
+
+	loaded := newTestCacheFileProxy(t)
+	require.NoError(t, loaded.loadCacheFile(path))
+
+	ci, expired, _ := loaded.cache.get(req)
+	require.NotNil(t, ci)
+
+	assert.False(t, expired)
+	assert.Equal(t, testUpsAddr, ci.u)
+	require.Len(t, ci.m.Answer, 1)
+	assert.Equal(t, reply.Answer[0].(*dns.A).A, ci.m.Answer[0].(*dns.A).A)
+
+	ci, _, _ = loaded.cache.getWithSubnet(req, subnet)
+	assert.NotNil(t, ci)
+
+	stat, ok := loaded.cache.requestStats.load(string(key))
+	require.True(t, ok)
+
+	require.Len(t, stat.timestamps, 1)
+	assert.True(t, ts.Equal(stat.timestamps[0]))
+}
+
+func TestProxy_cacheFile_versions(t *testing.T) {
+	newFile := func(t *testing.T, ver uint16, body []byte) (path string) {
+		t.Helper()
+
+		path = filepath.Join(t.TempDir(), "cache.bin")
+		data := binary.BigEndian.AppendUint16([]byte(cacheFileMagic), ver)
+		require.NoError(t, os.WriteFile(path, append(data, body...), 0o600))
+
+		return path
+	}
+
+	t.Run("newer", func(t *testing.T) {
+		path := newFile(t, cacheFileVersion+1, []byte("future data"))
+		p := newTestCacheFileProxy(t)
+
+		require.NoError(t, p.loadCacheFile(path))
+		require.NoError(t, p.saveCacheFile(path))
+
+		bakPath := fmt.Sprintf("%s.v%d.bak", path, cacheFileVersion+1)
+		data, err := os.ReadFile(bakPath)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(data), "future data")
+	})
+
+	t.Run("unknown_record", func(t *testing.T) {
+		var body []byte
+		body = append(body, 0xFF)
+		body = binary.BigEndian.AppendUint16(body, 1)
+		body = append(body, 'k')
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = append(body, 'v')
+
+		path := newFile(t, cacheFileVersion, body)
+		p := newTestCacheFileProxy(t)
+
+		require.NoError(t, p.loadCacheFile(path))
+
+		// The file is valid, so it's kept in place.
+		assert.FileExists(t, path)
+		assert.NoFileExists(t, path+".bak")
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		path := newFile(t, cacheFileVersion, []byte{byte(cacheRecordItem), 0xFF})
+		p := newTestCacheFileProxy(t)
+
+		require.NoError(t, p.loadCacheFile(path))
+
+		assert.NoFileExists(t, path)
+		assert.FileExists(t, fmt.Sprintf("%s.v%d.bak", path, cacheFileVersion))
+	})
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// The cache journal is an append-only file next to the persistent cache file
+// with the suffix [cacheJournalSuffix].  It has the same format as the cache
+// file itself, see [cacheFileMagic], and contains the item records stored
+// since the last compaction.  The journal is replayed over the cache file on
+// loading, so that the later records override the earlier ones.
+//
+// On compaction the journal is renamed to the one with the suffix
+// [cacheJournalPrevSuffix] and a new one is started, after that the cache file
+// is rewritten with all the current entries, and the previous journal is
+// removed.  The records stored during the compaction get into the new journal,
+// so a crash at any step loses only the records not yet flushed.
+const (
+	// cacheJournalSuffix is the suffix of the current cache journal path.
+	cacheJournalSuffix = ".journal"
+
+	// cacheJournalPrevSuffix is the suffix of the cache journal path being
+	// compacted.
+	cacheJournalPrevSuffix = ".journal.prev"
+
+	// defaultCacheFileCompactionInterval is the default interval between the
+	// compactions of the cache journal.
+	defaultCacheFileCompactionInterval = time.Hour
+)
+
+// cacheJournal is the write-behind log of the cache insertions.  It must be
+// created with [openCacheJournal].
+type cacheJournal struct {
+	// mu protects buf.
+	mu *sync.Mutex
+
+	// buf contains the records not yet written to file.
+	buf *bytes.Buffer
+
+	// fileMu protects file.  It's always locked before mu.
+	fileMu *sync.Mutex
+
+	// file is the journal file being appended.
+	file *os.File
+
+	// done is closed to stop the background flushing.
+	done chan struct{}
+
+	// stopped is closed when the background flushing is stopped.
+	stopped chan struct{}
+
+	// path is the path to the journal file.
+	path string
+}
+
+// openCacheJournal creates a new empty journal file at path, replacing the
+// existing one.
+func openCacheJournal(path string) (j *cacheJournal, err error) {
+	f, err := createCacheJournalFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheJournal{
+		mu:      &sync.Mutex{},
+		buf:     &bytes.Buffer{},
+		fileMu:  &sync.Mutex{},
+		file:    f,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		path:    path,
+	}, nil
+}
+
+// createCacheJournalFile creates a new journal file at path containing only
+// the header.
+func createCacheJournalFile(path string) (f *os.File, err error) {
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache journal: %w", err)
+	}
+
+	_, err = f.Write(cacheFileFormat.header())
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("writing cache journal header: %w", errors.WithDeferred(err, f.Close()))
+	}
+
+	return f, nil
+}
+
+// append adds the record to the journal.  It's written to the file on the next
+// flush.
+func (j *cacheJournal) append(kind cacheRecordKind, key, val []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Writing to a [bytes.Buffer] never fails.
+	_ = writeCacheRecord(j.buf, kind, key, val)
+}
+
+// flush writes the appended records to the file and syncs it.
+func (j *cacheJournal) flush() (err error) {
+	j.fileMu.Lock()
+	defer j.fileMu.Unlock()
+
+	return j.flushLocked()
+}
+
+// flushLocked is like [cacheJournal.flush] but j.fileMu must be locked.
+func (j *cacheJournal) flushLocked() (err error) {
+	j.mu.Lock()
+	pending := j.buf
+	j.buf = &bytes.Buffer{}
+	j.mu.Unlock()
+
+	if pending.Len() == 0 {
+		return nil
+	}
+
+	_, err = j.file.Write(pending.Bytes())
+	if err != nil {
+		return fmt.Errorf("writing cache journal: %w", err)
+	}
+
+	return j.file.Sync()
+}
+
+// rotate flushes the journal, moves it to prevPath, and starts a new one.
+func (j *cacheJournal) rotate(prevPath string) (err error) {
+	j.fileMu.Lock()
+	defer j.fileMu.Unlock()
+
+	err = j.flushLocked()
+	err = errors.WithDeferred(err, j.file.Close())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(j.path, prevPath)
+	if err != nil {
+		return fmt.Errorf("moving cache journal: %w", err)
+	}
+
+	j.file, err = createCacheJournalFile(j.path)
+
+	return err
+}
+
+// close flushes the journal and closes the file.
+func (j *cacheJournal) close() (err error) {
+	j.fileMu.Lock()
+	defer j.fileMu.Unlock()
+
+	err = j.flushLocked()
+
+	return errors.WithDeferred(err, j.file.Close())
+}
+
+// loadCacheJournals replays the journals of the cache file at path over the
+// loaded cache.  The records following a malformed one are ignored, since
+// it's most probably a partially written tail left after a crash.
+func (p *Proxy) loadCacheJournals(path string) {
+	for _, jPath := range []string{path + cacheJournalPrevSuffix, path + cacheJournalSuffix} {
+		data, err := os.ReadFile(jPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			p.cacheLogger.Warn("reading cache journal", "path", jPath, slogutil.KeyError, err)
+
+			continue
+		}
+
+		body, err := cacheFileFormat.migrate(data)
+		if err != nil {
+			p.cacheLogger.Warn("skipping cache journal", "path", jPath, slogutil.KeyError, err)
+
+			continue
+		}
+
+		n, err := p.cache.decodeRecords(body)
+		p.cacheLogger.Info("replayed cache journal", "path", jPath, "records", n)
+		if err != nil {
+			p.cacheLogger.Debug("truncated cache journal", "path", jPath, slogutil.KeyError, err)
+		}
+	}
+}
+
+// startCacheJournal writes the cache file with all the current entries and
+// starts journaling the cache insertions into the new journal.  It does
+// nothing if the journal isn't configured.
+func (p *Proxy) startCacheJournal() (err error) {
+	if p.cache == nil || p.CacheFilePath == "" || p.CacheFileFlushInterval <= 0 {
+		return nil
+	}
+
+	err = p.saveCacheFile(p.CacheFilePath)
+	if err != nil {
+		return fmt.Errorf("saving cache: %w", err)
+	}
+
+	err = os.Remove(p.CacheFilePath + cacheJournalPrevSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing previous cache journal: %w", err)
+	}
+
+	j, err := openCacheJournal(p.CacheFilePath + cacheJournalSuffix)
+	if err != nil {
+		return err
+	}
+
+	p.cache.journal.Store(j)
+
+	go p.cacheJournalLoop(j)
+
+	return nil
+}
+
+// cacheJournalLoop flushes j and compacts it periodically until j.done is
+// closed.
+func (p *Proxy) cacheJournalLoop(j *cacheJournal) {
+	defer close(j.stopped)
+
+	compactIvl := p.CacheFileCompactionInterval
+	if compactIvl <= 0 {
+		compactIvl = defaultCacheFileCompactionInterval
+	}
+
+	flushTicker := time.NewTicker(p.CacheFileFlushInterval)
+	defer flushTicker.Stop()
+
+	compactTicker := time.NewTicker(compactIvl)
+	defer compactTicker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-j.done:
+			return
+		case <-flushTicker.C:
+			err = j.flush()
+		case <-compactTicker.C:
+			err = p.compactCacheFile(j)
+		}
+
+		if err != nil {
+			p.cacheLogger.Error("persisting cache", slogutil.KeyError, err)
+		}
+	}
+}
+
+// compactCacheFile rewrites the cache file with all the current entries and
+// removes the records of j stored before that.
+func (p *Proxy) compactCacheFile(j *cacheJournal) (err error) {
+	prevPath := p.CacheFilePath + cacheJournalPrevSuffix
+
+	err = j.rotate(prevPath)
+	if err != nil {
+		return fmt.Errorf("rotating cache journal: %w", err)
+	}
+
+	err = p.saveCacheFile(p.CacheFilePath)
+	if err != nil {
+		return fmt.Errorf("saving cache: %w", err)
+	}
+
+	return os.Remove(prevPath)
+}
+
+// stopCacheJournal stops journaling the cache insertions.  The cache file
+// should be saved right after that.  It does nothing if the journal isn't
+// started.
+func (p *Proxy) stopCacheJournal() (err error) {
+	j := p.cache.journal.Swap(nil)
+	if j == nil {
+		return nil
+	}
+
+	close(j.done)
+	<-j.stopped
+
+	err = j.close()
+	if err != nil {
+		return fmt.Errorf("closing cache journal: %w", err)
+	}
+
+	return nil
+}
+
+// persistCache stops the cache journal, if any, and saves the cache file.  The
+// journals are removed after that, since all of their records are saved.
+func (p *Proxy) persistCache() (err error) {
+	err = p.stopCacheJournal()
+	if err != nil {
+		// Keep the journals, since the cache file may be left unchanged.
+		p.cacheLogger.Error("stopping cache journal", slogutil.KeyError, err)
+	}
+
+	err = p.saveCacheFile(p.CacheFilePath)
+	if err != nil {
+		return fmt.Errorf("saving cache: %w", err)
+	}
+
+	return removeCacheJournals(p.CacheFilePath)
+}
+
+// removeCacheJournals removes the journals of the cache file at path.
+func removeCacheJournals(path string) (err error) {
+	var errs []error
+	for _, jPath := range []string{path + cacheJournalPrevSuffix, path + cacheJournalSuffix} {
+		err = os.Remove(jPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
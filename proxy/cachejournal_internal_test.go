@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestJournalReply returns a cacheable response for host.
+func newTestJournalReply(tb testing.TB, host string) (reply *dns.Msg) {
+	tb.Helper()
+
+	return (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(tb, host, dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+	}).SetQuestion(host, dns.TypeA)
+}
+
+// requireCached fails the test if p has no cached response for host.
+func requireCached(tb testing.TB, p *Proxy, host string) {
+	tb.Helper()
+
+	ci, _, _ := p.cache.get((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+	require.NotNil(tb, ci, host)
+}
+
+func TestProxy_cacheJournal(t *testing.T) {
+	const (
+		snapshotHost = "snapshot.example."
+		journalHost  = "journal.example."
+		compactHost  = "compact.example."
+	)
+
+	path := filepath.Join(t.TempDir(), "cache.bin")
+
+	p := newTestCacheFileProxy(t)
+	p.CacheFilePath = path
+	p.CacheFileFlushInterval = time.Hour
+
+	p.cache.set(newTestJournalReply(t, snapshotHost), upstreamWithAddr, p.logger)
+
+	require.NoError(t, p.startCacheJournal())
+
+	j := p.cache.journal.Load()
+	require.NotNil(t, j)
+
+	p.cache.set(newTestJournalReply(t, journalHost), upstreamWithAddr, p.logger)
+	require.NoError(t, j.flush())
+
+	// Emulate a crash by loading the files without stopping the journal.
+	crashed := newTestCacheFileProxy(t)
+	require.NoError(t, crashed.loadCacheFile(path))
+	crashed.loadCacheJournals(path)
+
+	requireCached(t, crashed, snapshotHost)
+	requireCached(t, crashed, journalHost)
+
+	// Emulate a crash in the middle of the compaction, after rotating the
+	// journal.
+	require.NoError(t, j.rotate(path+cacheJournalPrevSuffix))
+	p.cache.set(newTestJournalReply(t, compactHost), upstreamWithAddr, p.logger)
+	require.NoError(t, j.flush())
+
+	crashed = newTestCacheFileProxy(t)
+	require.NoError(t, crashed.loadCacheFile(path))
+	crashed.loadCacheJournals(path)
+
+	requireCached(t, crashed, journalHost)
+	requireCached(t, crashed, compactHost)
+
+	require.NoError(t, p.persistCache())
+	assert.Nil(t, p.cache.journal.Load())
+
+	for _, suffix := range []string{cacheJournalSuffix, cacheJournalPrevSuffix} {
+		_, err := os.Stat(path + suffix)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	loaded := newTestCacheFileProxy(t)
+	require.NoError(t, loaded.loadCacheFile(path))
+
+	requireCached(t, loaded, snapshotHost)
+	requireCached(t, loaded, journalHost)
+	requireCached(t, loaded, compactHost)
+}
+
+func TestProxy_loadCacheJournals_truncated(t *testing.T) {
+	const host = "example.org."
+
+	path := filepath.Join(t.TempDir(), "cache.bin")
+
+	j, err := openCacheJournal(path + cacheJournalSuffix)
+	require.NoError(t, err)
+
+	saved := newTestCacheFileProxy(t)
+	saved.cache.journal.Store(j)
+	saved.cache.set(newTestJournalReply(t, host), upstreamWithAddr, saved.logger)
+	saved.cache.set(newTestJournalReply(t, "other."+host), upstreamWithAddr, saved.logger)
+	require.NoError(t, j.close())
+
+	// Cut the last record in the middle.
+	fi, err := os.Stat(j.path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(j.path, fi.Size()-10))
+
+	loaded := newTestCacheFileProxy(t)
+	loaded.loadCacheJournals(path)
+
+	requireCached(t, loaded, host)
+
+	ci, _, _ := loaded.cache.get((&dns.Msg{}).SetQuestion("other."+host, dns.TypeA))
+	assert.Nil(t, ci)
+}
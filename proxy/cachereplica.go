@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+// The cache replication pushes the snapshots of the cache of a primary proxy to
+// the replicas over HTTP.  A snapshot has the format of the persistent cache
+// file, see [cacheFileMagic], and is sent as the body of a POST request.  The
+// replica stores the items of each snapshot, replacing the entries with the
+// same keys, and answers exclusively from its cache.  The entries keep the
+// expiration times set by the primary, so the clocks of the hosts should be
+// synchronized.
+const (
+	// cacheSnapshotContentType is the content type of the pushed snapshots.
+	cacheSnapshotContentType = "application/octet-stream"
+
+	// maxCacheSnapshotSize is the maximum size of a snapshot accepted by
+	// replica.
+	maxCacheSnapshotSize = 256 << 20
+
+	// defaultCacheReplicationTimeout is the default timeout of pushing a
+	// snapshot to a single replica.
+	defaultCacheReplicationTimeout = 30 * time.Second
+)
+
+// errCacheReplicaMiss is returned when the proxy in the cache replica mode has
+// no cached response for a request.
+const errCacheReplicaMiss errors.Error = "cache miss in replica mode"
+
+// CacheReplicationConfig is the configuration of pushing the cache snapshots of
+// a primary proxy to the replicas, see [CacheReplicaConfig].
+type CacheReplicationConfig struct {
+	// HTTPClient is used to push the snapshots.  If nil, a client with the
+	// timeout of 30 seconds is used.
+	HTTPClient *http.Client
+
+	// Replicas are the URLs to push the snapshots to.  Each must have either
+	// the http or the https scheme.  It must not be empty.
+	Replicas []*url.URL
+
+	// Token, if not empty, is sent as a bearer token within the Authorization
+	// header.
+	Token string
+
+	// Interval is the interval between the pushes.  It must be positive.
+	Interval time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *CacheReplicationConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	errs := []error{
+		validate.NotEmptySlice("Replicas", c.Replicas),
+		validate.Positive("Interval", c.Interval),
+	}
+
+	for i, u := range c.Replicas {
+		switch {
+		case u == nil:
+			errs = append(errs, fmt.Errorf("Replicas: at index %d: %w", i, errors.ErrNoValue))
+		case u.Scheme != "http" && u.Scheme != "https":
+			errs = append(errs, fmt.Errorf(
+				"Replicas: at index %d: scheme: %w: %q",
+				i,
+				errors.ErrBadEnumValue,
+				u.Scheme,
+			))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CacheReplicaConfig is the configuration of the cache replica mode, in which
+// the proxy never sends queries to the upstreams and answers exclusively from
+// the cache entries pushed by a primary proxy, see [CacheReplicationConfig].
+// The requests missing the cache are responded with SERVFAIL.
+//
+// TODO(e.burkov):  Support TLS.
+type CacheReplicaConfig struct {
+	// Token, if not empty, is the bearer token required from the primary
+	// within the Authorization header.
+	Token string
+
+	// ListenAddr is the address to listen for the pushed snapshots on with
+	// plain HTTP.  It must be valid.
+	ListenAddr netip.AddrPort
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *CacheReplicaConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	if !c.ListenAddr.IsValid() {
+		return fmt.Errorf("ListenAddr: %w", errors.ErrNoValue)
+	}
+
+	return nil
+}
+
+// cacheReplication is the state of pushing the cache snapshots to the
+// replicas.
+type cacheReplication struct {
+	// cancel stops pushing, including the push in progress.
+	cancel context.CancelFunc
+
+	// stopped is closed when pushing is stopped.
+	stopped chan struct{}
+}
+
+// startCacheReplication starts pushing the cache snapshots to the replicas.  It
+// does nothing if the replication isn't configured.
+func (p *Proxy) startCacheReplication() {
+	if p.cache == nil || p.CacheReplication == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &cacheReplication{
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	p.replication = r
+
+	go p.cacheReplicationLoop(ctx, r)
+}
+
+// cacheReplicationLoop pushes the snapshots periodically until ctx is
+// canceled.
+func (p *Proxy) cacheReplicationLoop(ctx context.Context, r *cacheReplication) {
+	defer close(r.stopped)
+	defer slogutil.RecoverAndLog(ctx, p.cacheLogger)
+
+	c := p.CacheReplication
+	cli := cmp.Or(c.HTTPClient, &http.Client{Timeout: defaultCacheReplicationTimeout})
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.pushCacheSnapshot(ctx, cli, c)
+		}
+	}
+}
+
+// pushCacheSnapshot pushes the current snapshot of the cache to each of the
+// replicas from c using cli.
+func (p *Proxy) pushCacheSnapshot(ctx context.Context, cli *http.Client, c *CacheReplicationConfig) {
+	buf := &bytes.Buffer{}
+	err := p.WriteCacheSnapshot(buf)
+	if err != nil {
+		p.cacheLogger.ErrorContext(ctx, "writing cache snapshot", slogutil.KeyError, err)
+
+		return
+	}
+
+	for _, u := range c.Replicas {
+		err = pushSnapshot(ctx, cli, u, c.Token, buf.Bytes())
+		if err != nil {
+			p.cacheLogger.WarnContext(ctx, "pushing cache snapshot", "replica", u, slogutil.KeyError, err)
+		} else {
+			p.cacheLogger.DebugContext(ctx, "pushed cache snapshot", "replica", u, "bytes", buf.Len())
+		}
+	}
+}
+
+// pushSnapshot sends snapshot to the replica at u using cli.
+func pushSnapshot(
+	ctx context.Context,
+	cli *http.Client,
+	u *url.URL,
+	token string,
+	snapshot []byte,
+) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(snapshot))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", cacheSnapshotContentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	return nil
+}
+
+// stopCacheReplication stops pushing the cache snapshots.  It does nothing if
+// the replication isn't started.
+func (p *Proxy) stopCacheReplication() {
+	r := p.replication
+	if r == nil {
+		return
+	}
+
+	p.replication = nil
+
+	r.cancel()
+	<-r.stopped
+}
+
+// startCacheReplica starts listening for the snapshots pushed by the primary.
+// It does nothing if the cache replica mode isn't configured.
+func (p *Proxy) startCacheReplica(ctx context.Context) (err error) {
+	if p.cache == nil || p.CacheReplica == nil {
+		return nil
+	}
+
+	addr := p.CacheReplica.ListenAddr
+	ln, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return fmt.Errorf("listening for cache snapshots: %w", err)
+	}
+
+	p.cacheLogger.InfoContext(ctx, "listening for cache snapshots", "addr", ln.Addr())
+
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(p.serveCacheSnapshot),
+		ReadHeaderTimeout: defaultTimeout,
+	}
+	p.replicaServer = srv
+
+	go func() { _ = srv.Serve(ln) }()
+
+	return nil
+}
+
+// stopCacheReplica stops listening for the snapshots.  It does nothing if the
+// listening isn't started.
+func (p *Proxy) stopCacheReplica() (err error) {
+	srv := p.replicaServer
+	if srv == nil {
+		return nil
+	}
+
+	p.replicaServer = nil
+
+	return srv.Close()
+}
+
+// serveCacheSnapshot applies the snapshot pushed within r.
+func (p *Proxy) serveCacheSnapshot(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if token := p.CacheReplica.Token; token != "" {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			p.cacheLogger.WarnContext(ctx, "unauthorized cache snapshot", "remote_addr", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+	}
+
+	n, err := p.ApplyCacheSnapshot(http.MaxBytesReader(w, r.Body, maxCacheSnapshotSize))
+	if err != nil {
+		p.cacheLogger.WarnContext(ctx, "applying cache snapshot", "records", n, slogutil.KeyError, err)
+		http.Error(w, "bad snapshot", http.StatusBadRequest)
+
+		return
+	}
+
+	p.cacheLogger.DebugContext(ctx, "applied cache snapshot", "records", n)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WriteCacheSnapshot writes all the current cache entries into w in the format
+// of the persistent cache file, so that they could be applied to another proxy
+// with [Proxy.ApplyCacheSnapshot].
+func (p *Proxy) WriteCacheSnapshot(w io.Writer) (err error) {
+	if p.cache == nil {
+		return errors.Error("cache is disabled")
+	}
+
+	return p.cache.encode(w)
+}
+
+// ApplyCacheSnapshot stores the cache entries from the snapshot read from r,
+// replacing the entries with the same keys.  n is the number of entries stored
+// before an error, if any.  The snapshot must be written by
+// [Proxy.WriteCacheSnapshot].
+func (p *Proxy) ApplyCacheSnapshot(r io.Reader) (n int, err error) {
+	if p.cache == nil {
+		return 0, errors.Error("cache is disabled")
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	body, err := cacheFileFormat.migrate(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.cache.applySnapshot(body)
+}
+
+// applySnapshot stores the item records from body into c, replacing the
+// existing entries with the same keys.  n is the number of the entries stored.
+func (c *cache) applySnapshot(body []byte) (n int, err error) {
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		var kind cacheRecordKind
+		var key, val []byte
+		kind, key, val, err = readCacheRecord(r)
+		if err != nil {
+			return n, err
+		}
+
+		items := c.items
+		switch kind {
+		case cacheRecordItem:
+			// Go on.
+		case cacheRecordItemWithSubnet:
+			items = c.itemsWithSubnet
+		default:
+			// Skip the request statistics and the records of the newer
+			// kinds.
+			continue
+		}
+
+		if items == nil {
+			continue
+		}
+
+		if kind == cacheRecordItemWithSubnet {
+			c.itemsWithSubnetLock.Lock()
+			items.Set(key, val)
+			c.itemsWithSubnetLock.Unlock()
+		} else {
+			items.Set(key, val)
+		}
+
+		c.journalItem(kind, key, val)
+
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_cacheReplication(t *testing.T) {
+	t.Parallel()
+
+	const (
+		token = "secret"
+
+		replicatedHost = "replicated.example."
+		missingHost    = "missing.example."
+	)
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, q.Name, dns.TypeA, defaultTestTTL, net.IP{192, 0, 2, 1})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	replica := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheReplica: &CacheReplicaConfig{
+			Token:      token,
+			ListenAddr: localhostAnyPort,
+		},
+	})
+	servicetest.RequireRun(t, replica, testTimeout)
+
+	srv := httptest.NewServer(http.HandlerFunc(replica.serveCacheSnapshot))
+	t.Cleanup(srv.Close)
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	primary := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheReplication: &CacheReplicationConfig{
+			Replicas: []*url.URL{srvURL},
+			Token:    token,
+			Interval: 10 * time.Millisecond,
+		},
+	})
+	servicetest.RequireRun(t, primary, testTimeout)
+
+	require.NoError(t, primary.Resolve(context.Background(), &DNSContext{
+		Req: (&dns.Msg{}).SetQuestion(replicatedHost, dns.TypeA),
+	}))
+
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(replicatedHost, dns.TypeA)}
+		require.NoError(ct, replica.Resolve(context.Background(), d))
+		require.NotNil(ct, d.Res)
+
+		assert.Equal(ct, dns.RcodeSuccess, d.Res.Rcode)
+		assert.Len(ct, d.Res.Answer, 1)
+	}, testTimeout, 10*time.Millisecond)
+
+	d := &DNSContext{Req: (&dns.Msg{}).SetQuestion(missingHost, dns.TypeA)}
+	err = replica.Resolve(context.Background(), d)
+	assert.ErrorIs(t, err, errCacheReplicaMiss)
+	require.NotNil(t, d.Res)
+
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		ctx := testutil.ContextWithTimeout(t, testTimeout)
+		err = pushSnapshot(ctx, srv.Client(), srvURL, "wrong", nil)
+		testutil.AssertErrorMsg(t, `unexpected status "401 Unauthorized"`, err)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		ctx := testutil.ContextWithTimeout(t, testTimeout)
+		err = pushSnapshot(ctx, srv.Client(), srvURL, token, []byte("bad snapshot"))
+		testutil.AssertErrorMsg(t, `unexpected status "400 Bad Request"`, err)
+	})
+}
+
+func TestConfig_validateCacheReplication(t *testing.T) {
+	t.Parallel()
+
+	replicaURL := &url.URL{Scheme: "http", Host: "192.0.2.1:8053"}
+
+	testCases := []struct {
+		conf       *Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &Config{},
+		name:       "disabled",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			CacheEnabled: true,
+			CacheReplication: &CacheReplicationConfig{
+				Replicas: []*url.URL{replicaURL},
+				Interval: time.Minute,
+			},
+			CacheReplica: &CacheReplicaConfig{
+				ListenAddr: netip.MustParseAddrPort("127.0.0.1:8053"),
+			},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: &Config{
+			CacheReplication: &CacheReplicationConfig{
+				Replicas: []*url.URL{replicaURL},
+				Interval: time.Minute,
+			},
+			CacheReplica: &CacheReplicaConfig{
+				ListenAddr: netip.MustParseAddrPort("127.0.0.1:8053"),
+			},
+		},
+		name: "no_cache",
+		wantErrMsg: "CacheReplication: requires CacheEnabled\n" +
+			"CacheReplica: requires CacheEnabled",
+	}, {
+		conf: &Config{
+			CacheEnabled: true,
+			CacheReplication: &CacheReplicationConfig{
+				Replicas: []*url.URL{nil, {Scheme: "ftp"}},
+			},
+			CacheReplica: &CacheReplicaConfig{},
+		},
+		name: "invalid",
+		wantErrMsg: "CacheReplication: Interval: not positive: 0s\n" +
+			"Replicas: at index 0: no value\n" +
+			"Replicas: at index 1: scheme: bad enum value: \"ftp\"\n" +
+			"CacheReplica: ListenAddr: no value",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			errs := tc.conf.validateCacheReplication()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, errors.Join(errs...))
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// markStale makes the packed cache item val expire now unless it has already
+// expired, so that the optimistic cache serves it as stale until it's
+// revalidated.  val must be at least [expTimeSz] bytes long.
+func markStale(val []byte, now time.Time) {
+	nowSec := uint32(now.Unix()) - 1
+	if binary.BigEndian.Uint32(val) > nowSec {
+		binary.BigEndian.PutUint32(val, nowSec)
+	}
+}
+
+// addStale marks the item val loaded for key as stale, if the loaded entries
+// should be revalidated, see [cacheConfig.revalidateLoaded].  withSubnet is
+// true if the item belongs to the subnet cache, the revalidation of those isn't
+// scheduled, since it requires the client's subnet.
+func (c *cache) addStale(key, val []byte, withSubnet bool) {
+	if !c.revalidateLoaded || len(val) < minPackedLen {
+		return
+	}
+
+	markStale(val, c.clock.Now())
+
+	if !withSubnet {
+		c.stale = append(c.stale, string(key))
+	}
+}
+
+// startRevalidation starts revalidating the stale entries loaded from the
+// cache file one by one in the background.  It must only be called after
+// [cache.resumeProactiveRefresh].
+func (c *cache) startRevalidation() {
+	keys := c.stale
+	c.stale = nil
+	if len(keys) == 0 || c.cr == nil {
+		return
+	}
+
+	c.logger.Debug("revalidating loaded cache entries", "count", len(keys))
+
+	go c.revalidate(keys)
+}
+
+// revalidate refreshes the entries with keys which are still stale.  The
+// entries are refreshed sequentially, so that the revalidation doesn't take
+// over the concurrency limit of the proactive refresh.  It's intended to be
+// used as a goroutine.
+func (c *cache) revalidate(keys []string) {
+	defer slogutil.RecoverAndLog(context.TODO(), c.logger)
+
+	for _, keyStr := range keys {
+		if c.refreshStopped.Load() {
+			return
+		}
+
+		req := revalidationRequest([]byte(keyStr))
+		if req == nil || c.settings.Load().refreshPolicy(req) == DomainRefreshExcluded {
+			continue
+		}
+
+		// The entry may have already been resolved again on the client's
+		// request, or evicted.
+		if c.isStale([]byte(keyStr)) {
+			c.refreshEntry(keyStr, req)
+		}
+	}
+}
+
+// isStale returns true if the entry for key is in the cache and has expired.
+func (c *cache) isStale(key []byte) (ok bool) {
+	data := c.items.Get(key)
+
+	if len(data) < expTimeSz {
+		return false
+	}
+
+	expire := time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+
+	return c.clock.Now().After(expire)
+}
+
+// revalidationRequest returns the request for the general cache key, see
+// [msgToKey].  It returns nil if key is malformed.
+func revalidationRequest(key []byte) (req *dns.Msg) {
+	if len(key) <= 2*packedMsgLenSz {
+		return nil
+	}
+
+	name := string(key[2*packedMsgLenSz:])
+	if _, ok := dns.IsDomainName(name); !ok || !strings.HasSuffix(name, ".") {
+		return nil
+	}
+
+	req = (&dns.Msg{}).SetQuestion(name, binary.BigEndian.Uint16(key))
+	req.Question[0].Qclass = binary.BigEndian.Uint16(key[packedMsgLenSz:])
+	addDO(req)
+
+	return req
+}
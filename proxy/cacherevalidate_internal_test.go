@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_CacheFileRevalidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	key := msgToKey(req)
+
+	persisted := (&dns.Msg{}).SetReply(req)
+	persisted.Answer = []dns.RR{newRR(t, "example.com.", dns.TypeA, 3600, net.IP{1, 2, 3, 4})}
+
+	saved := newTestCacheFileProxy(t)
+	saved.cache.set(persisted, nil, saved.logger)
+	require.NoError(t, saved.saveCacheFile(path))
+
+	var queries atomic.Uint32
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, r *dns.Msg) (resp *dns.Msg, err error) {
+			queries.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(r)
+			resp.Answer = []dns.RR{
+				newRR(t, r.Question[0].Name, dns.TypeA, 3600, net.IP{5, 6, 7, 8}),
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                   slogutil.NewDiscardLogger(),
+		UDPListenAddr:            []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:           &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:           defaultTrustedProxies,
+		RatelimitSubnetLenIPv4:   24,
+		RatelimitSubnetLenIPv6:   64,
+		CacheEnabled:             true,
+		CacheSizeBytes:           testCacheSize,
+		CacheOptimistic:          true,
+		CacheOptimisticAnswerTTL: DefaultOptimisticAnswerTTL,
+		CacheOptimisticMaxAge:    DefaultOptimisticMaxAge,
+		CacheFilePath:            path,
+		CacheFileRevalidate:      true,
+	})
+
+	// The loaded entry is served as stale before the revalidation.
+	ci, expired, _ := p.cache.get(req)
+	require.NotNil(t, ci)
+
+	assert.True(t, expired)
+	assert.Equal(t, []string{string(key)}, p.cache.stale)
+
+	servicetest.RequireRun(t, p, testTimeout)
+
+	require.Eventually(t, func() (ok bool) {
+		return !p.cache.isStale(key)
+	}, testTimeout, testTimeout/100)
+
+	ci, expired, _ = p.cache.get(req)
+	require.NotNil(t, ci)
+	require.Len(t, ci.m.Answer, 1)
+
+	assert.False(t, expired)
+	assert.Equal(t, net.IP{5, 6, 7, 8}, ci.m.Answer[0].(*dns.A).A.To4())
+	assert.Equal(t, uint32(1), queries.Load())
+	assert.Empty(t, p.cache.stale)
+}
+
+func TestRevalidationRequest(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeAAAA)
+
+	got := revalidationRequest(msgToKey(req))
+	require.NotNil(t, got)
+	require.Len(t, got.Question, 1)
+
+	assert.Equal(t, req.Question[0], got.Question[0])
+	assert.NotNil(t, got.IsEdns0())
+
+	assert.Nil(t, revalidationRequest([]byte{0, 1}))
+}
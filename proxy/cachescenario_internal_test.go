@@ -0,0 +1,507 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// cacheScenario is a sequence of the requests to the caching proxy performed at
+// the virtual moments of time along with the expected results.
+type cacheScenario struct {
+	// Config is the configuration of the cache.
+	Config cacheScenarioConfig `yaml:"config"`
+
+	// Upstream is the initial behavior of the upstream.
+	Upstream scenarioUpstreamConfig `yaml:"upstream"`
+
+	// Steps are the steps of the scenario in the order of their time.
+	Steps []*cacheScenarioStep `yaml:"steps"`
+}
+
+// cacheScenarioConfig is the configuration of the cache within a scenario.  See
+// the corresponding fields of [Config].
+type cacheScenarioConfig struct {
+	OptimisticAnswerTTL timeutil.Duration `yaml:"optimistic_answer_ttl"`
+	OptimisticMaxAge    timeutil.Duration `yaml:"optimistic_max_age"`
+	RefreshTime         timeutil.Duration `yaml:"proactive_refresh_time"`
+	CooldownPeriod      timeutil.Duration `yaml:"cooldown_period"`
+	PinnedZones         []string          `yaml:"pinned_zones"`
+	ExcludedZones       []string          `yaml:"excluded_zones"`
+	CooldownThreshold   int               `yaml:"cooldown_threshold"`
+	MinTTL              uint32            `yaml:"min_ttl"`
+	MaxTTL              uint32            `yaml:"max_ttl"`
+	Optimistic          bool              `yaml:"optimistic"`
+	Adaptive            bool              `yaml:"adaptive"`
+}
+
+// proxyConfig returns the proxy configuration resolving with ups.
+func (c *cacheScenarioConfig) proxyConfig(ups upstream.Upstream) (conf *Config) {
+	return &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		// Annotate the responses to check their sources.
+		AnnotateResponseSource:          true,
+		CacheEnabled:                    true,
+		CacheMinTTL:                     c.MinTTL,
+		CacheMaxTTL:                     c.MaxTTL,
+		CacheOptimistic:                 c.Optimistic,
+		CacheOptimisticAnswerTTL:        time.Duration(c.OptimisticAnswerTTL),
+		CacheOptimisticMaxAge:           time.Duration(c.OptimisticMaxAge),
+		CacheProactiveRefreshTime:       int(time.Duration(c.RefreshTime).Milliseconds()),
+		CacheProactiveCooldownPeriod:    int(time.Duration(c.CooldownPeriod).Seconds()),
+		CacheProactiveCooldownThreshold: c.CooldownThreshold,
+		CacheProactiveAdaptive:          c.Adaptive,
+		CacheProactivePinnedZones:       c.PinnedZones,
+		CacheProactiveExcludedZones:     c.ExcludedZones,
+	}
+}
+
+// cacheScenarioStep is a single step of a scenario.  Once the virtual clock
+// reaches At and the refreshes due by then are performed, the upstream
+// behavior is changed, if Upstream is set, and Query is resolved, if set.
+// Then the expectations are checked.
+type cacheScenarioStep struct {
+	// Upstream, if not nil, replaces the behavior of the upstream.
+	Upstream *scenarioUpstreamConfig `yaml:"upstream"`
+
+	// Want are the expected results of the step.
+	Want cacheScenarioWant `yaml:"want"`
+
+	// Query is the domain name to resolve on this step, if any.
+	Query string `yaml:"query"`
+
+	// Check is the domain name to check the cache state of without resolving
+	// it.  It's only used if Query is empty.
+	Check string `yaml:"check"`
+
+	// QType is the type of the question for Query or Check.  Empty means A.
+	QType string `yaml:"qtype"`
+
+	// At is the time of the step since the start of the scenario.
+	At timeutil.Duration `yaml:"at"`
+}
+
+// question returns the question of the step.  ok is false if the step has
+// neither a query nor a check.
+func (s *cacheScenarioStep) question(t *testing.T) (q dns.Question, ok bool) {
+	t.Helper()
+
+	name := s.Query
+	if name == "" {
+		name = s.Check
+	}
+
+	if name == "" {
+		return dns.Question{}, false
+	}
+
+	qtype := dns.TypeA
+	if s.QType != "" {
+		qtype, ok = dns.StringToType[s.QType]
+		require.Truef(t, ok, "bad qtype %q", s.QType)
+	}
+
+	return dns.Question{
+		Name:   dns.Fqdn(name),
+		Qtype:  qtype,
+		Qclass: dns.ClassINET,
+	}, true
+}
+
+// cacheScenarioWant are the expected results of a step.  The nil fields aren't
+// checked.
+type cacheScenarioWant struct {
+	// Source is the expected source of the response.
+	Source ResponseSource `yaml:"source"`
+
+	// TTL is the expected TTL of the answer.
+	TTL *uint32 `yaml:"ttl"`
+
+	// UpstreamCalls is the expected total number of the upstream exchanges
+	// since the start of the scenario.
+	UpstreamCalls *uint `yaml:"upstream_calls"`
+
+	// Cached is true if the entry for the question is expected to be in the
+	// cache.
+	Cached *bool `yaml:"cached"`
+
+	// RefreshScheduled is true if the proactive refresh of the entry for the
+	// question is expected to be scheduled.
+	RefreshScheduled *bool `yaml:"refresh_scheduled"`
+
+	// Error is true if resolving the query is expected to fail.
+	Error bool `yaml:"error"`
+}
+
+// scenarioUpstreamConfig is the behavior of the scenario upstream.
+type scenarioUpstreamConfig struct {
+	// TTL is the TTL of the answers.
+	TTL uint32 `yaml:"ttl"`
+
+	// Fail makes the upstream fail all the exchanges.
+	Fail bool `yaml:"fail"`
+}
+
+// errScenarioUpstream is returned by the failing [scenarioUpstream].
+const errScenarioUpstream errors.Error = "scenario upstream failure"
+
+// scenarioUpstream is the upstream answering with a single A record in
+// accordance with its configuration.
+type scenarioUpstream struct {
+	// mu protects conf and calls.
+	mu *sync.Mutex
+
+	// conf is the current behavior of the upstream.
+	conf scenarioUpstreamConfig
+
+	// calls is the number of exchanges performed.
+	calls uint
+}
+
+// type check
+var _ upstream.Upstream = (*scenarioUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *scenarioUpstream.
+func (u *scenarioUpstream) Exchange(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.calls++
+	if u.conf.Fail {
+		return nil, errScenarioUpstream
+	}
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.RecursionAvailable = true
+	if req.Question[0].Qtype == dns.TypeA {
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    u.conf.TTL,
+			},
+			A: net.IP{192, 0, 2, 1},
+		}}
+	}
+
+	return resp, nil
+}
+
+// Address implements the [upstream.Upstream] interface for *scenarioUpstream.
+func (u *scenarioUpstream) Address() (addr string) { return "scenario" }
+
+// Close implements the [upstream.Upstream] interface for *scenarioUpstream.
+func (u *scenarioUpstream) Close() (err error) { return nil }
+
+// set replaces the behavior of u.
+func (u *scenarioUpstream) set(conf scenarioUpstreamConfig) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.conf = conf
+}
+
+// numCalls returns the number of exchanges performed by u.
+func (u *scenarioUpstream) numCalls() (n uint) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.calls
+}
+
+// scenarioClock is the virtual [cacheClock] which only moves forward on
+// [scenarioClock.advance], running the calls scheduled by then in the calling
+// goroutine.
+type scenarioClock struct {
+	// mu protects now and timers.
+	mu *sync.Mutex
+
+	// now is the current virtual time.
+	now time.Time
+
+	// timers are the scheduled calls in the order of scheduling.
+	timers []*scenarioTimer
+}
+
+// type check
+var _ cacheClock = (*scenarioClock)(nil)
+
+// Now implements the [cacheClock] interface for *scenarioClock.
+func (c *scenarioClock) Now() (now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// AfterFunc implements the [cacheClock] interface for *scenarioClock.
+func (c *scenarioClock) AfterFunc(d time.Duration, f func()) (t cacheTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := &scenarioTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		f:     f,
+	}
+	c.timers = append(c.timers, st)
+
+	return st
+}
+
+// advance moves the clock to till running the scheduled calls, including the
+// ones scheduled by the calls themselves, at their virtual time.
+func (c *scenarioClock) advance(till time.Time) {
+	for {
+		t := c.nextDue(till)
+		if t == nil {
+			break
+		}
+
+		t.f()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = till
+}
+
+// nextDue removes the earliest call scheduled not later than till and moves
+// the clock to its time.  It returns nil if there is none.
+func (c *scenarioClock) nextDue(till time.Time) (t *scenarioTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := -1
+	for j, st := range c.timers {
+		if !st.at.After(till) && (i < 0 || st.at.Before(c.timers[i].at)) {
+			i = j
+		}
+	}
+
+	if i < 0 {
+		return nil
+	}
+
+	t = c.timers[i]
+	c.timers = slices.Delete(c.timers, i, i+1)
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+
+	return t
+}
+
+// scenarioTimer is a call scheduled with [scenarioClock.AfterFunc].
+type scenarioTimer struct {
+	clock *scenarioClock
+	at    time.Time
+	f     func()
+}
+
+// type check
+var _ cacheTimer = (*scenarioTimer)(nil)
+
+// Stop implements the [cacheTimer] interface for *scenarioTimer.
+func (t *scenarioTimer) Stop() (ok bool) {
+	c := t.clock
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := slices.Index(c.timers, t)
+	if i < 0 {
+		return false
+	}
+
+	c.timers = slices.Delete(c.timers, i, i+1)
+
+	return true
+}
+
+// scenarioResolver is the [cachingResolver] reporting the finished background
+// resolutions of the expired entries.
+type scenarioResolver struct {
+	cachingResolver
+
+	// done receives a value once a resolution is finished.
+	done chan unit
+}
+
+// replyFromUpstream implements the [cachingResolver] interface for
+// *scenarioResolver.
+func (r *scenarioResolver) replyFromUpstream(
+	ctx context.Context,
+	dctx *DNSContext,
+) (ok bool, err error) {
+	ok, err = r.cachingResolver.replyFromUpstream(ctx, dctx)
+	if !ok {
+		// The response isn't cached, so the resolution is finished.
+		r.done <- unit{}
+	}
+
+	return ok, err
+}
+
+// cacheResp implements the [cachingResolver] interface for *scenarioResolver.
+func (r *scenarioResolver) cacheResp(dctx *DNSContext) {
+	r.cachingResolver.cacheResp(dctx)
+	r.done <- unit{}
+}
+
+// scenarioStart is the virtual time of the start of each scenario.
+var scenarioStart = time.Unix(1_700_000_000, 0)
+
+// runCacheScenario performs the steps of sc against a new proxy using the
+// virtual clock.
+func runCacheScenario(t *testing.T, sc *cacheScenario) {
+	t.Helper()
+
+	ups := &scenarioUpstream{
+		mu:   &sync.Mutex{},
+		conf: sc.Upstream,
+	}
+	clock := &scenarioClock{
+		mu:  &sync.Mutex{},
+		now: scenarioStart,
+	}
+
+	p, err := New(sc.Config.proxyConfig(ups))
+	require.NoError(t, err)
+
+	// Recreate the cache to make it use the virtual clock.
+	p.time = clock
+	p.initCache()
+
+	res := &scenarioResolver{
+		cachingResolver: p,
+		done:            make(chan unit, 1),
+	}
+	p.shortFlighter.cr = res
+
+	// Emulate the started proxy, since it has no listeners.
+	p.state.Store(uint32(stateRunning))
+
+	var prev time.Duration
+	for i, step := range sc.Steps {
+		at := time.Duration(step.At)
+		require.GreaterOrEqualf(t, at, prev, "step %d is out of order", i)
+
+		prev = at
+		clock.advance(scenarioStart.Add(at))
+
+		if step.Upstream != nil {
+			ups.set(*step.Upstream)
+		}
+
+		t.Run(step.At.String(), func(t *testing.T) {
+			checkScenarioStep(t, p, ups, res, step)
+		})
+	}
+}
+
+// checkScenarioStep resolves the query of step, if any, and checks the
+// expectations.
+func checkScenarioStep(
+	t *testing.T,
+	p *Proxy,
+	ups *scenarioUpstream,
+	res *scenarioResolver,
+	step *cacheScenarioStep,
+) {
+	q, hasQuestion := step.question(t)
+	want := step.Want
+
+	if step.Query != "" {
+		req := &dns.Msg{Question: []dns.Question{q}}
+		req.Id = dns.Id()
+		req.RecursionDesired = true
+
+		dctx := &DNSContext{Req: req}
+		err := p.Resolve(context.Background(), dctx)
+		if want.Error {
+			require.Error(t, err)
+		} else {
+			require.NoError(t, err)
+			require.NotNil(t, dctx.Res)
+		}
+
+		if want.Source != "" {
+			assert.Equal(t, want.Source, dctx.source)
+		}
+
+		if want.TTL != nil {
+			require.NotEmpty(t, dctx.Res.Answer)
+			assert.Equal(t, *want.TTL, dctx.Res.Answer[0].Header().Ttl)
+		}
+
+		// Wait for the expired entry to be resolved again in the background.
+		if dctx.source == ResponseSourceOptimistic && !p.cache.isBackingOff(msgToKey(req)) {
+			testutil.RequireReceive(t, res.done, testTimeout)
+		}
+	}
+
+	if want.UpstreamCalls != nil {
+		assert.Equal(t, *want.UpstreamCalls, ups.numCalls(), "upstream calls")
+	}
+
+	if !hasQuestion {
+		require.Nil(t, want.Cached, "cached requires a query or a check")
+		require.Nil(t, want.RefreshScheduled, "refresh_scheduled requires a query or a check")
+
+		return
+	}
+
+	key := msgToKey(&dns.Msg{Question: []dns.Question{q}})
+
+	if want.Cached != nil {
+		assert.Equal(t, *want.Cached, p.cache.hasEntry(key), "cached")
+	}
+
+	if want.RefreshScheduled != nil {
+		_, scheduled := p.cache.refreshTimers.Load(string(key))
+		assert.Equal(t, *want.RefreshScheduled, scheduled, "refresh scheduled")
+	}
+}
+
+func TestCache_scenarios(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", t.Name(), "*.yaml"))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, rerr := os.ReadFile(path)
+			require.NoError(t, rerr)
+
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+
+			sc := &cacheScenario{}
+			require.NoError(t, dec.Decode(sc))
+
+			runCacheScenario(t, sc)
+		})
+	}
+}
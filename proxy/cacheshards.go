@@ -0,0 +1,36 @@
+package proxy
+
+import "github.com/miekg/dns"
+
+const (
+	// defaultCacheShards is the default number of shards of the general cache,
+	// see [Config.CacheShards].
+	defaultCacheShards = 16
+
+	// minCacheShardSize is the minimum size of a single shard of the general
+	// cache in bytes, so that each shard is still able to hold a response of
+	// the maximum size.
+	minCacheShardSize = dns.MaxMsgSize
+)
+
+// cacheShardsNum returns the number of shards for the general cache of size
+// bytes and maxEntries entries.  shards is the configured number of shards, if
+// not positive, [defaultCacheShards] is used.  The result is limited so that
+// each shard is at least [minCacheShardSize] bytes and, if maxEntries is
+// positive, holds at least a single entry.
+func cacheShardsNum(size, maxEntries, shards int) (n uint) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	if shards <= 0 {
+		shards = defaultCacheShards
+	}
+
+	shards = min(shards, size/minCacheShardSize)
+	if maxEntries > 0 {
+		shards = min(shards, maxEntries)
+	}
+
+	return uint(max(1, shards))
+}
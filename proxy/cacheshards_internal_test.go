@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheShardsNum(t *testing.T) {
+	testCases := []struct {
+		name       string
+		size       int
+		maxEntries int
+		shards     int
+		want       uint
+	}{{
+		name:       "default_size",
+		size:       0,
+		maxEntries: 0,
+		shards:     0,
+		want:       1,
+	}, {
+		name:       "default_shards",
+		size:       64 * 1024 * 1024,
+		maxEntries: 0,
+		shards:     0,
+		want:       defaultCacheShards,
+	}, {
+		name:       "configured",
+		size:       64 * 1024 * 1024,
+		maxEntries: 0,
+		shards:     64,
+		want:       64,
+	}, {
+		name:       "limited",
+		size:       4 * minCacheShardSize,
+		maxEntries: 0,
+		shards:     64,
+		want:       4,
+	}, {
+		name:       "limited_entries",
+		size:       64 * 1024 * 1024,
+		maxEntries: 10,
+		shards:     64,
+		want:       10,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cacheShardsNum(tc.size, tc.maxEntries, tc.shards))
+		})
+	}
+}
+
+func TestCache_shards(t *testing.T) {
+	const (
+		goroutines = 8
+		hostsNum   = 64
+	)
+
+	c := newCache(&cacheConfig{
+		size:   defaultCacheShards * minCacheShardSize,
+		shards: defaultCacheShards,
+	})
+
+	l := slogutil.NewDiscardLogger()
+	wg := &sync.WaitGroup{}
+	for g := range goroutines {
+		wg.Go(func() {
+			for i := range hostsNum {
+				host := fmt.Sprintf("host-%d-%d.example.", g, i)
+				req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+				c.set(newShardsTestReply(req), upstreamWithAddr, l)
+
+				ci, _, _ := c.get(req)
+				assert.NotNil(t, ci)
+			}
+		})
+	}
+
+	wg.Wait()
+
+	require.Equal(t, goroutines*hostsNum, c.items.Stats().Count)
+
+	c.clearItems()
+	assert.Zero(t, c.items.Stats().Count)
+}
+
+// newShardsTestReply returns a cacheable reply for req with a single address.
+func newShardsTestReply(req *dns.Msg) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{192, 0, 2, 1},
+	}}
+
+	return resp
+}
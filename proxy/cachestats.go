@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"log/slog"
+
+	"github.com/AdguardTeam/dnsproxy/internal/cachestore"
+	glcache "github.com/AdguardTeam/golibs/cache"
+)
+
+// CacheStatistics is the memory usage of the general cache, see
+// [Proxy.CacheStatistics].  The sizes of the storage overhead are approximate.
+type CacheStatistics struct {
+	// Entries is the number of the cached responses, including the ones cached
+	// for the client subnets.
+	Entries uint64
+
+	// DataBytes is the total size of the keys and the packed responses.
+	DataBytes uint64
+
+	// OverheadBytes is the total size of the metadata of the storage for the
+	// entries.
+	OverheadBytes uint64
+
+	// RequestStatsBytes is the total size of the request statistics of the
+	// entries used by the proactive refresh.
+	RequestStatsBytes uint64
+
+	// Oversized is the number of the responses not cached since they exceed
+	// [Config.CacheMaxEntryBytes].
+	Oversized uint64
+}
+
+// TotalBytes returns the total memory usage of the cache.  s must not be nil.
+func (s *CacheStatistics) TotalBytes() (n uint64) {
+	return s.DataBytes + s.OverheadBytes + s.RequestStatsBytes
+}
+
+// CacheStatistics returns the current memory usage of the general cache.  The
+// caches of the custom upstream configurations aren't included.  It returns
+// [ErrCacheDisabled] if the cache is disabled.
+func (p *Proxy) CacheStatistics() (s *CacheStatistics, err error) {
+	if p.cache == nil {
+		return nil, ErrCacheDisabled
+	}
+
+	return p.cache.statistics(), nil
+}
+
+// statistics returns the current memory usage of c.
+func (c *cache) statistics() (s *CacheStatistics) {
+	s = &CacheStatistics{
+		RequestStatsBytes: c.requestStats.memoryUsage(),
+		Oversized:         c.oversized.Load(),
+	}
+
+	c.addStorageStats(s, c.items)
+	c.addStorageStats(s, c.itemsWithSubnet)
+
+	return s
+}
+
+// addStorageStats adds the memory usage of items to s.  items may be nil.
+func (c *cache) addStorageStats(s *CacheStatistics, items glcache.Cache) {
+	if items == nil {
+		return
+	}
+
+	st := items.Stats()
+	s.Entries += uint64(st.Count)
+	s.DataBytes += uint64(st.Size)
+	s.OverheadBytes += uint64(st.Count) * uint64(cachestore.EntryOverhead)
+}
+
+// isOversized returns true if the entry with key and packed value exceeds the
+// maximum entry size of c, counting it.
+func (c *cache) isOversized(key, packed []byte, l *slog.Logger) (ok bool) {
+	if c.maxEntryBytes <= 0 {
+		return false
+	}
+
+	size := len(key) + len(packed) + int(cachestore.EntryOverhead)
+	if size <= c.maxEntryBytes {
+		return false
+	}
+
+	c.oversized.Add(1)
+	l.Debug("not caching response; too large", "size", size, "max", c.maxEntryBytes)
+
+	return true
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/cachestore"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_statistics(t *testing.T) {
+	const (
+		smallHost = "small.example."
+		largeHost = "large.example."
+
+		maxEntryBytes = 512
+	)
+
+	c := newCache(&cacheConfig{
+		size:          testCacheSize,
+		maxEntryBytes: maxEntryBytes,
+	})
+
+	newReply := func(host string, txt ...string) (reply *dns.Msg) {
+		return (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   host,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				Txt: txt,
+			}},
+		}).SetQuestion(host, dns.TypeTXT)
+	}
+
+	l := slogutil.NewDiscardLogger()
+	c.set(newReply(smallHost, "small"), upstreamWithAddr, l)
+	c.set(newReply(largeHost, strings.Repeat("a", 100)), upstreamWithAddr, l)
+	// A single TXT string can't be longer than 255 bytes.
+	long := strings.Repeat("b", 255)
+	c.set(newReply(largeHost, long, long, long), upstreamWithAddr, l)
+
+	ci, _, _ := c.get((&dns.Msg{}).SetQuestion(smallHost, dns.TypeTXT))
+	require.NotNil(t, ci)
+
+	ci, _, _ = c.get((&dns.Msg{}).SetQuestion(largeHost, dns.TypeTXT))
+	require.NotNil(t, ci)
+
+	s := c.statistics()
+	assert.Equal(t, uint64(2), s.Entries)
+	assert.Equal(t, uint64(1), s.Oversized)
+	assert.Equal(t, 2*uint64(cachestore.EntryOverhead), s.OverheadBytes)
+	assert.Equal(t, uint64(c.items.Stats().Size), s.DataBytes)
+	assert.Equal(t, s.DataBytes+s.OverheadBytes+s.RequestStatsBytes, s.TotalBytes())
+}
+
+func TestCache_maxEntries(t *testing.T) {
+	const maxEntries = 2
+
+	c := newCache(&cacheConfig{
+		size:       testCacheSize,
+		maxEntries: maxEntries,
+	})
+
+	l := slogutil.NewDiscardLogger()
+	for _, host := range []string{"a.example.", "b.example.", "c.example."} {
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		c.set(newShardsTestReply(req), upstreamWithAddr, l)
+	}
+
+	assert.Equal(t, uint64(maxEntries), c.statistics().Entries)
+
+	// The least recently used entry is evicted.
+	ci, _, _ := c.get((&dns.Msg{}).SetQuestion("a.example.", dns.TypeA))
+	assert.Nil(t, ci)
+
+	ci, _, _ = c.get((&dns.Msg{}).SetQuestion("c.example.", dns.TypeA))
+	assert.NotNil(t, ci)
+}
+
+func TestProxy_CacheStatistics(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	s, err := p.CacheStatistics()
+	assert.Nil(t, s)
+	assert.ErrorIs(t, err, ErrCacheDisabled)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+)
+
+// dohTokenPathPrefix is the prefix of the DoH request path followed by the
+// client token, see [ClientPolicy.Tokens].
+const dohTokenPathPrefix = "/dns-query/"
+
+// clientToken returns the token the DoH client has authenticated with, either
+// in the request path after [dohTokenPathPrefix] or in the bearer
+// authorization header.  It returns an empty string if there is none.  r must
+// not be nil.
+func clientToken(r *http.Request) (token string) {
+	if token, ok := strings.CutPrefix(r.URL.Path, dohTokenPathPrefix); ok && token != "" {
+		return token
+	}
+
+	auth := r.Header.Get(httphdr.Authorization)
+	if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
+
+// verifiedClientCert returns the leaf of the first verified chain of the
+// client certificate in cs.  It returns nil if cs is nil or the client hasn't
+// presented a certificate verified against [tls.Config.ClientCAs].
+func verifiedClientCert(cs *tls.ConnectionState) (cert *x509.Certificate) {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return cs.VerifiedChains[0][0]
+}
+
+// connectionState returns the state of the TLS connection the request of d has
+// been received over.  It returns nil if the request hasn't been received over
+// TLS.
+func connectionState(d *DNSContext) (cs *tls.ConnectionState) {
+	switch {
+	case d.HTTPRequest != nil:
+		return d.HTTPRequest.TLS
+	case d.QUICConnection != nil:
+		state := d.QUICConnection.ConnectionState().TLS
+
+		return &state
+	case d.Conn != nil:
+		tlsConn, ok := d.Conn.(*tls.Conn)
+		if !ok {
+			return nil
+		}
+
+		state := tlsConn.ConnectionState()
+
+		return &state
+	default:
+		return nil
+	}
+}
+
+// matchesCert returns true if the common name or any of the DNS names of cert
+// is one of pol.CertNames.  cert must not be nil.
+func (pol *ClientPolicy) matchesCert(cert *x509.Certificate) (ok bool) {
+	return slices.ContainsFunc(pol.CertNames, func(name string) (found bool) {
+		return name == cert.Subject.CommonName || slices.Contains(cert.DNSNames, name)
+	})
+}
+
+// matchesToken returns true if token is one of pol.Tokens.  The tokens are
+// compared in constant time.
+func (pol *ClientPolicy) matchesToken(token string) (ok bool) {
+	return slices.ContainsFunc(pol.Tokens, func(t string) (found bool) {
+		return subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1
+	})
+}
+
+// matchAuthClientPolicy returns the first policy from policies which
+// identities contain either the name of cert or token.  cert and token may be
+// nil and empty respectively.  It returns nil if there is none.
+func matchAuthClientPolicy(
+	policies []*ClientPolicy,
+	cert *x509.Certificate,
+	token string,
+) (pol *ClientPolicy) {
+	if cert == nil && token == "" {
+		return nil
+	}
+
+	for _, pol = range policies {
+		if cert != nil && pol.matchesCert(cert) {
+			return pol
+		} else if token != "" && pol.matchesToken(token) {
+			return pol
+		}
+	}
+
+	return nil
+}
+
+// authClientPolicy returns the policy of the client of d authenticated with a
+// client certificate or a DoH token, if any.
+func (p *Proxy) authClientPolicy(d *DNSContext) (pol *ClientPolicy) {
+	live := p.live.Load()
+	if live == nil {
+		// See the comment in [Proxy.domainPolicy].
+		return nil
+	}
+
+	var token string
+	if d.HTTPRequest != nil {
+		token = clientToken(d.HTTPRequest)
+	}
+
+	return matchAuthClientPolicy(live.clients, verifiedClientCert(connectionState(d)), token)
+}
+
+// isUnauthenticated returns true if the client authentication is required and
+// the client of d, which has sent the request over an encrypted protocol,
+// hasn't authenticated as any of the client policies.
+func (p *Proxy) isUnauthenticated(d *DNSContext) (ok bool) {
+	if !p.RequireClientAuth {
+		return false
+	}
+
+	switch d.Proto {
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		return p.authClientPolicy(d) == nil
+	default:
+		return false
+	}
+}
+
+// checkClientAuth checks that the DoH client has authenticated as any of the
+// client policies, if required, and if it hasn't, it writes an error.
+// shouldHandle is false if the request has been denied.
+func (p *Proxy) checkClientAuth(w http.ResponseWriter, r *http.Request) (shouldHandle bool) {
+	if !p.RequireClientAuth {
+		return true
+	}
+
+	live := p.live.Load()
+	if live != nil && matchAuthClientPolicy(live.clients, verifiedClientCert(r.TLS), clientToken(r)) != nil {
+		return true
+	}
+
+	p.serverLogger.Debug("client auth failed", "raddr", r.RemoteAddr)
+
+	w.Header().Set(httphdr.WWWAuthenticate, `Bearer realm="DNS"`)
+	http.Error(w, "Authorization required", http.StatusUnauthorized)
+
+	return false
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientToken(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		path string
+		auth string
+		want string
+	}{{
+		name: "none",
+		path: "/dns-query",
+		auth: "",
+		want: "",
+	}, {
+		name: "path",
+		path: "/dns-query/secret",
+		auth: "",
+		want: "secret",
+	}, {
+		name: "bearer",
+		path: "/dns-query",
+		auth: "Bearer secret",
+		want: "secret",
+	}, {
+		name: "path_first",
+		path: "/dns-query/secret",
+		auth: "Bearer other",
+		want: "secret",
+	}, {
+		name: "basic",
+		path: "/dns-query/",
+		auth: "Basic dXNlcjpwYXNz",
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.auth != "" {
+				r.Header.Set(httphdr.Authorization, tc.auth)
+			}
+
+			assert.Equal(t, tc.want, clientToken(r))
+		})
+	}
+}
+
+func TestMatchAuthClientPolicy(t *testing.T) {
+	t.Parallel()
+
+	certPolicy := &ClientPolicy{
+		Name:      "cert",
+		CertNames: []string{"alice", "bob.example"},
+	}
+	tokenPolicy := &ClientPolicy{
+		Name:   "token",
+		Tokens: []string{"secret"},
+	}
+	policies := []*ClientPolicy{certPolicy, tokenPolicy}
+
+	testCases := []struct {
+		cert  *x509.Certificate
+		want  *ClientPolicy
+		name  string
+		token string
+	}{{
+		cert:  nil,
+		want:  nil,
+		name:  "none",
+		token: "",
+	}, {
+		cert:  &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}},
+		want:  certPolicy,
+		name:  "common_name",
+		token: "",
+	}, {
+		cert:  &x509.Certificate{DNSNames: []string{"bob.example"}},
+		want:  certPolicy,
+		name:  "dns_name",
+		token: "",
+	}, {
+		cert:  &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}},
+		want:  nil,
+		name:  "unknown_cert",
+		token: "",
+	}, {
+		cert:  nil,
+		want:  tokenPolicy,
+		name:  "token",
+		token: "secret",
+	}, {
+		cert:  nil,
+		want:  nil,
+		name:  "unknown_token",
+		token: "secre",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Same(t, tc.want, matchAuthClientPolicy(policies, tc.cert, tc.token))
+		})
+	}
+}
+
+func TestProxy_ServeHTTP_clientAuth(t *testing.T) {
+	generalIP := net.IP{192, 0, 2, 1}
+	tokenIP := net.IP{192, 0, 2, 2}
+
+	var generalQueries, tokenQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", generalIP, &generalQueries)
+	tokenUps := newAddrUpstream(t, "192.0.2.54:53", tokenIP, &tokenQueries)
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{general}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		RequireClientAuth:      true,
+		ClientPolicies: []*ClientPolicy{{
+			Upstreams: &UpstreamConfig{Upstreams: []upstream.Upstream{tokenUps}},
+			Name:      "token",
+			Tokens:    []string{"secret"},
+		}},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	packed, err := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA).Pack()
+	require.NoError(t, err)
+
+	query := "?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+
+	testCases := []struct {
+		name       string
+		path       string
+		auth       string
+		wantIP     net.IP
+		wantStatus int
+	}{{
+		name:       "no_token",
+		path:       "/dns-query",
+		auth:       "",
+		wantIP:     nil,
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name:       "bad_token",
+		path:       "/dns-query/wrong",
+		auth:       "",
+		wantIP:     nil,
+		wantStatus: http.StatusUnauthorized,
+	}, {
+		name:       "path_token",
+		path:       "/dns-query/secret",
+		auth:       "",
+		wantIP:     tokenIP,
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "bearer_token",
+		path:       "/dns-query",
+		auth:       "Bearer secret",
+		wantIP:     tokenIP,
+		wantStatus: http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path+query, nil)
+			r.Header.Set(httphdr.Accept, "application/dns-message")
+			if tc.auth != "" {
+				r.Header.Set(httphdr.Authorization, tc.auth)
+			}
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+
+			res := w.Result()
+			require.Equal(t, tc.wantStatus, res.StatusCode)
+
+			if tc.wantIP == nil {
+				return
+			}
+
+			body, readErr := io.ReadAll(res.Body)
+			require.NoError(t, readErr)
+
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(body))
+			require.Len(t, resp.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, tc.wantIP, a.A.To4())
+		})
+	}
+
+	assert.Zero(t, generalQueries.Load())
+}
+
+func TestProxy_validateRequest_clientAuth(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		RequireClientAuth:      true,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	addr := netip.MustParseAddrPort("192.0.2.1:53")
+
+	t.Run("tls", func(t *testing.T) {
+		resp := p.validateRequest(p.newDNSContext(ProtoTLS, req, addr))
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		assert.Nil(t, p.validateRequest(p.newDNSContext(ProtoUDP, req, addr)))
+	})
+}
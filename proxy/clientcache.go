@@ -0,0 +1,74 @@
+package proxy
+
+// initClientCaches sets the caches of the client policies of next, see
+// [Config.CachePerClient].  The caches share the size of the cache, so each of
+// them gets an equal part of it.  The caches of the policies of prev, which may
+// be nil, are kept for the policies of next with the same names and resized to
+// their new part.  c must not be nil.
+func (p *Proxy) initClientCaches(c *Config, next, prev *liveSettings) {
+	if p.cache == nil || !p.CachePerClient || len(next.clients) == 0 {
+		return
+	}
+
+	size := clientCacheSize(c.CacheSizeBytes, len(next.clients))
+
+	next.clientCaches = make(map[string]*cache, len(next.clients))
+	for _, pol := range next.clients {
+		conf := c.newCacheConfig()
+		conf.size = size
+		conf.shards = cacheShardsNum(size, conf.maxEntries, c.CacheShards)
+		if prevCache := prev.clientCache(pol.Name); prevCache != nil {
+			prevCache.setSettings(conf)
+			prevCache.setMaxSize(uint(size))
+			next.clientCaches[pol.Name] = prevCache
+
+			continue
+		}
+
+		conf.optimistic = false
+		conf.clock = newCacheClock(p.time)
+
+		pc := newCache(conf)
+		pc.outage = p.cache.outage
+		pc.refreshLimiter = p.cache.refreshLimiter
+		pc.memPressure = p.memPressure
+		next.clientCaches[pol.Name] = pc
+	}
+}
+
+// clientCacheSize returns the size in bytes of each of n client caches sharing
+// size bytes.  If size isn't positive, [defaultCacheSize] is shared.  n must be
+// positive.
+func clientCacheSize(size, n int) (part int) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	return max(size/n, 1)
+}
+
+// clientCache returns the cache of the policy with the name, if any.  s may be
+// nil.
+func (s *liveSettings) clientCache(name string) (c *cache) {
+	if s == nil {
+		return nil
+	}
+
+	return s.clientCaches[name]
+}
+
+// clientCache returns the cache of the client policy of d, if the responses to
+// its clients are cached separately, see [Config.CachePerClient].
+func (p *Proxy) clientCache(d *DNSContext) (c *cache) {
+	live := p.live.Load()
+	if live == nil || live.clientCaches == nil {
+		return nil
+	}
+
+	pol := p.clientPolicy(d)
+	if pol == nil {
+		return nil
+	}
+
+	return live.clientCaches[pol.Name]
+}
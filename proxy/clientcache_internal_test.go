@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_cachePerClient(t *testing.T) {
+	generalIP := net.IP{192, 0, 2, 1}
+	filteredIP := net.IP{192, 0, 2, 2}
+
+	var generalQueries, filteredQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", generalIP, &generalQueries)
+	filtered := newAddrUpstream(t, "192.0.2.54:53", filteredIP, &filteredQueries)
+
+	filteredPolicy := &ClientPolicy{
+		Upstreams: &UpstreamConfig{Upstreams: []upstream.Upstream{filtered}},
+		Name:      "filtered",
+		Networks:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+
+	conf := &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{general}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		CachePerClient:         true,
+		ClientPolicies:         []*ClientPolicy{filteredPolicy},
+	}
+	p := mustNew(t, conf)
+	servicetest.RequireRun(t, p, testTimeout)
+
+	generalClient := netip.MustParseAddrPort("192.0.2.100:53")
+	filteredClient := netip.MustParseAddrPort("10.1.2.3:53")
+
+	resolve := func(t *testing.T, client netip.AddrPort) (ip net.IP) {
+		t.Helper()
+
+		d := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("shared.example.", dns.TypeA),
+			Addr: client,
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+
+		return a.A.To4()
+	}
+
+	for range 2 {
+		assert.Equal(t, generalIP, resolve(t, generalClient))
+		assert.Equal(t, filteredIP, resolve(t, filteredClient))
+	}
+
+	assert.Equal(t, uint32(1), generalQueries.Load())
+	assert.Equal(t, uint32(1), filteredQueries.Load())
+
+	t.Run("reload", func(t *testing.T) {
+		nextConf := *conf
+		nextPolicy := *filteredPolicy
+		nextConf.ClientPolicies = []*ClientPolicy{&nextPolicy, {
+			Upstreams: filteredPolicy.Upstreams,
+			Name:      "other",
+			Networks:  []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")},
+		}}
+		require.NoError(t, p.Reload(context.Background(), &nextConf))
+
+		// The cache of the policy with the same name is kept.
+		assert.Equal(t, filteredIP, resolve(t, filteredClient))
+		assert.Equal(t, uint32(1), filteredQueries.Load())
+
+		// The caches share the size.
+		live := p.live.Load()
+		require.Len(t, live.clientCaches, 2)
+
+		wantSize := clientCacheSize(testCacheSize, 2)
+		for name, c := range live.clientCaches {
+			for i := range 2 * testCacheSize / 64 {
+				m := newShardsTestReply((&dns.Msg{}).SetQuestion(
+					fmt.Sprintf("host-%d.example.", i),
+					dns.TypeA,
+				))
+				c.set(m, upstreamWithAddr, slogutil.NewDiscardLogger())
+			}
+
+			assert.LessOrEqualf(t, c.items.Stats().Size, wantSize, "policy %q", name)
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		p.ClearCache()
+
+		assert.Equal(t, filteredIP, resolve(t, filteredClient))
+		assert.Equal(t, uint32(2), filteredQueries.Load())
+	})
+}
+
+func TestConfig_validateClientPolicies_cachePerClient(t *testing.T) {
+	t.Parallel()
+
+	newPolicy := func(name string) (pol *ClientPolicy) {
+		return &ClientPolicy{
+			Upstreams: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{&dnsproxytest.Upstream{}},
+			},
+			Name:     name,
+			Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		policies   []*ClientPolicy
+	}{{
+		name:       "unique",
+		wantErrMsg: "",
+		policies:   []*ClientPolicy{newPolicy("a"), newPolicy("b")},
+	}, {
+		name:       "empty",
+		wantErrMsg: "at index 0: Name: empty value",
+		policies:   []*ClientPolicy{newPolicy("")},
+	}, {
+		name:       "duplicated",
+		wantErrMsg: `at index 1: Name: duplicated value: "a"`,
+		policies:   []*ClientPolicy{newPolicy("a"), newPolicy("a")},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Config{
+				CachePerClient: true,
+				ClientPolicies: tc.policies,
+			}
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, c.validateClientPolicies())
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+// ClientPolicy is the set of settings for the requests from the clients within
+// its networks.
+type ClientPolicy struct {
+	// Upstreams are used to resolve the requests from the matching clients
+	// instead of [Config.UpstreamConfig].  The domain-specific upstreams of it
+	// make the forwarding conditional on both the client network and the
+	// requested domain name, the requests without any matching upstreams are
+	// resolved as usual.  The responses of these upstreams are only cached if
+	// [Config.CachePerClient] is set, so that they're never shared with the
+	// other clients.  It must not be nil.  The proxy closes it on shutdown.
+	Upstreams *UpstreamConfig
+
+	// Name is the name of the policy used in the logs and the traces.  It's
+	// optional, unless [Config.CachePerClient] is set, since the cache of the
+	// policy is kept across [Proxy.Reload] by its name.
+	Name string
+
+	// Networks are the networks of the client addresses the policy applies
+	// to.  It must not be empty unless CertNames or Tokens are set.
+	Networks []netip.Prefix
+
+	// CertNames are the common names and the DNS names of the client
+	// certificates the policy applies to.  Only the certificates verified
+	// against [tls.Config.ClientCAs] of the listener are considered, so the
+	// TLS configuration should have [tls.Config.ClientAuth] set to
+	// [tls.VerifyClientCertIfGiven] or stricter.
+	CertNames []string
+
+	// Tokens are the tokens of the DNS-over-HTTPS clients the policy applies
+	// to.  The client passes the token either in the request path, e.g.
+	// "/dns-query/token", or in the bearer authorization header.
+	Tokens []string
+
+	// AnswerOrder is the order of the records in the responses to the
+	// matching clients.  If empty, [Config.AnswerOrder] is used.
+	AnswerOrder AnswerOrder
+}
+
+// validate returns an error if pol is invalid.  pol must not be nil.
+func (pol *ClientPolicy) validate() (err error) {
+	var errs []error
+	if len(pol.CertNames) == 0 && len(pol.Tokens) == 0 {
+		errs = append(errs, validate.NotEmptySlice("Networks", pol.Networks))
+	}
+
+	for i, t := range pol.Tokens {
+		if t == "" {
+			errs = append(errs, fmt.Errorf("Tokens: at index %d: %w", i, errors.ErrEmptyValue))
+		}
+	}
+
+	for i, n := range pol.Networks {
+		if !n.IsValid() {
+			errs = append(errs, fmt.Errorf("Networks: at index %d: %w", i, errors.ErrNoValue))
+		}
+	}
+
+	err = pol.AnswerOrder.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("AnswerOrder: %w", err))
+	}
+
+	switch uc := pol.Upstreams; {
+	case uc == nil:
+		errs = append(errs, fmt.Errorf("Upstreams: %w", errors.ErrNoValue))
+	case len(uc.Upstreams) == 0 && len(uc.DomainReservedUpstreams) == 0:
+		// Unlike the general upstreams, the domain-specific ones are enough.
+		errs = append(errs, fmt.Errorf("Upstreams: %w", upstream.ErrNoUpstreams))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateClientPolicies returns an error if any of c.ClientPolicies is
+// invalid.  The caches of the policies are identified by their names, so the
+// names must be unique if [Config.CachePerClient] is set.
+func (c *Config) validateClientPolicies() (err error) {
+	var errs []error
+	names := make([]string, 0, len(c.ClientPolicies))
+	for i, pol := range c.ClientPolicies {
+		if pol == nil {
+			errs = append(errs, fmt.Errorf("at index %d: %w", i, errors.ErrNoValue))
+
+			continue
+		}
+
+		err = pol.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("at index %d: %w", i, err))
+		}
+
+		if !c.CachePerClient {
+			continue
+		}
+
+		switch {
+		case pol.Name == "":
+			errs = append(errs, fmt.Errorf("at index %d: Name: %w", i, errors.ErrEmptyValue))
+		case slices.Contains(names, pol.Name):
+			errs = append(errs, fmt.Errorf("at index %d: Name: %w: %q", i, errors.ErrDuplicated, pol.Name))
+		default:
+			names = append(names, pol.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// matchClientPolicy returns the first policy from policies with a network
+// containing addr.  It returns nil if there is none.
+func matchClientPolicy(policies []*ClientPolicy, addr netip.Addr) (pol *ClientPolicy) {
+	addr = addr.Unmap()
+	for _, pol = range policies {
+		for _, n := range pol.Networks {
+			if n.Contains(addr) {
+				return pol
+			}
+		}
+	}
+
+	return nil
+}
+
+// clientPolicyConfigs returns the upstream configurations of policies.
+func clientPolicyConfigs(policies []*ClientPolicy) (confs []*UpstreamConfig) {
+	for _, pol := range policies {
+		confs = append(confs, pol.Upstreams)
+	}
+
+	return confs
+}
+
+// MatchClientPolicy returns the first policy from [Config.ClientPolicies] with
+// a network containing addr, which is applied to the requests from it.  It
+// returns nil if there is none.
+func (p *Proxy) MatchClientPolicy(addr netip.Addr) (pol *ClientPolicy) {
+	return matchClientPolicy(p.live.Load().clients, addr)
+}
+
+// clientPolicy returns the policy for the client of d, if any.  The policy the
+// client has authenticated as takes precedence, then the one of the listener
+// which has received the request, see [ListenerConfig.ClientPolicy].
+func (p *Proxy) clientPolicy(d *DNSContext) (pol *ClientPolicy) {
+	live := p.live.Load()
+	if live == nil {
+		// See the comment in [Proxy.domainPolicy].
+		return nil
+	}
+
+	if pol = p.authClientPolicy(d); pol != nil {
+		return pol
+	}
+
+	if lc := p.listenerConfig(d); lc != nil && lc.ClientPolicy != "" {
+		i := slices.IndexFunc(live.clients, func(c *ClientPolicy) (ok bool) {
+			return c.Name == lc.ClientPolicy
+		})
+		if i >= 0 {
+			return live.clients[i]
+		}
+
+		// The policy may have been removed by a reload, so fall back to the
+		// address.
+	}
+
+	return matchClientPolicy(live.clients, d.Addr.Addr())
+}
+
+// routesByClientPolicy returns true if the request of d is resolved with the
+// upstreams of its client policy, see [Proxy.routeRequest].
+func (p *Proxy) routesByClientPolicy(d *DNSContext) (ok bool) {
+	if len(d.Req.Question) == 0 {
+		return false
+	}
+
+	pol := p.clientPolicy(d)
+	if pol == nil {
+		return false
+	}
+
+	q := d.Req.Question[0]
+	getUpstreams := (*UpstreamConfig).getUpstreamsForDomain
+	if q.Qtype == dns.TypeDS {
+		getUpstreams = (*UpstreamConfig).getUpstreamsForDS
+	}
+
+	return len(getUpstreams(pol.Upstreams, q.Name)) > 0
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_clientPolicies(t *testing.T) {
+	generalIP := net.IP{192, 0, 2, 1}
+	corpIP := net.IP{192, 0, 2, 2}
+	zoneIP := net.IP{192, 0, 2, 3}
+
+	var generalQueries, corpQueries, zoneQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", generalIP, &generalQueries)
+	corp := newAddrUpstream(t, "tls://dns.corp.example", corpIP, &corpQueries)
+	zone := newAddrUpstream(t, "192.0.2.54:53", zoneIP, &zoneQueries)
+
+	corpPolicy := &ClientPolicy{
+		Upstreams: &UpstreamConfig{Upstreams: []upstream.Upstream{corp}},
+		Name:      "corp",
+		Networks:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	zonePolicy := &ClientPolicy{
+		Upstreams: &UpstreamConfig{
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"zone.example.": {zone},
+			},
+		},
+		Name: "zone",
+		Networks: []netip.Prefix{
+			netip.MustParsePrefix("10.1.0.0/16"),
+			netip.MustParsePrefix("192.168.0.0/16"),
+		},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{general}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		ClientPolicies:         []*ClientPolicy{corpPolicy, zonePolicy},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	testCases := []struct {
+		wantIP  net.IP
+		client  netip.Addr
+		name    string
+		host    string
+		wantPol *ClientPolicy
+	}{{
+		wantIP:  corpIP,
+		client:  netip.MustParseAddr("10.1.2.3"),
+		name:    "first_match",
+		host:    "zone.example.",
+		wantPol: corpPolicy,
+	}, {
+		wantIP:  zoneIP,
+		client:  netip.MustParseAddr("::ffff:192.168.1.1"),
+		name:    "domain_specific",
+		host:    "www.zone.example.",
+		wantPol: zonePolicy,
+	}, {
+		wantIP:  generalIP,
+		client:  netip.MustParseAddr("192.168.1.1"),
+		name:    "domain_mismatch",
+		host:    "other.example.",
+		wantPol: zonePolicy,
+	}, {
+		wantIP:  generalIP,
+		client:  netip.MustParseAddr("192.0.2.100"),
+		name:    "no_policy",
+		host:    "zone.example.",
+		wantPol: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Same(t, tc.wantPol, p.MatchClientPolicy(tc.client))
+
+			d := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+				Addr: netip.AddrPortFrom(tc.client, 53),
+			}
+			require.NoError(t, p.Resolve(context.Background(), d))
+			require.NotNil(t, d.Res)
+			require.Len(t, d.Res.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+			assert.Equal(t, tc.wantIP, a.A.To4())
+		})
+	}
+}
+
+func TestProxy_Resolve_clientPolicyCache(t *testing.T) {
+	generalIP := net.IP{192, 0, 2, 1}
+	filteredIP := net.IP{192, 0, 2, 2}
+
+	var generalQueries, filteredQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", generalIP, &generalQueries)
+	filtered := newAddrUpstream(t, "192.0.2.54:53", filteredIP, &filteredQueries)
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{general}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		ClientPolicies: []*ClientPolicy{{
+			Upstreams: &UpstreamConfig{Upstreams: []upstream.Upstream{filtered}},
+			Name:      "filtered",
+			Networks:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		}},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T, client string) (ip net.IP) {
+		t.Helper()
+
+		d := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("shared.example.", dns.TypeA),
+			Addr: netip.MustParseAddrPort(client),
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+
+		return a.A.To4()
+	}
+
+	for range 2 {
+		assert.Equal(t, generalIP, resolve(t, "192.0.2.100:53"))
+		assert.Equal(t, filteredIP, resolve(t, "10.1.2.3:53"))
+	}
+
+	// The responses of the policy upstreams are neither stored in the shared
+	// cache nor taken from it.
+	assert.Equal(t, uint32(1), generalQueries.Load())
+	assert.Equal(t, uint32(2), filteredQueries.Load())
+}
+
+func TestClientPolicy_validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		pol        *ClientPolicy
+		name       string
+		wantErrMsg string
+	}{{
+		pol: &ClientPolicy{
+			Upstreams: &UpstreamConfig{
+				DomainReservedUpstreams: map[string][]upstream.Upstream{
+					"example.": {&dnsproxytest.Upstream{}},
+				},
+			},
+			Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		name:       "domain_specific",
+		wantErrMsg: "",
+	}, {
+		pol:  &ClientPolicy{},
+		name: "empty",
+		wantErrMsg: "Networks: no value\n" +
+			"Upstreams: no value",
+	}, {
+		pol: &ClientPolicy{
+			Upstreams: &UpstreamConfig{},
+			Networks:  []netip.Prefix{{}},
+		},
+		name: "bad",
+		wantErrMsg: "Networks: at index 0: no value\n" +
+			"Upstreams: no upstream specified",
+	}, {
+		pol: &ClientPolicy{
+			Upstreams: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{&dnsproxytest.Upstream{}},
+			},
+			CertNames: []string{"client.example"},
+		},
+		name:       "cert_only",
+		wantErrMsg: "",
+	}, {
+		pol: &ClientPolicy{
+			Upstreams: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{&dnsproxytest.Upstream{}},
+			},
+			Tokens: []string{""},
+		},
+		name:       "empty_token",
+		wantErrMsg: "Tokens: at index 0: empty value",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.pol.validate())
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+// DefaultClientStatisticsMaxClients is the default value for
+// [ClientStatisticsConfig.MaxClients].
+const DefaultClientStatisticsMaxClients = 10_000
+
+// ClientStatisticsConfig is the configuration of the statistics of the
+// requests aggregated by the networks of the clients, see
+// [Proxy.ClientStatistics].
+type ClientStatisticsConfig struct {
+	// FilePath is the path to the file the statistics are saved to on shutdown
+	// and loaded from on creating the proxy.  If empty, the statistics aren't
+	// persisted.
+	FilePath string
+
+	// SubnetLenIPv4 is the length of the prefixes the IPv4 client addresses are
+	// aggregated by, e.g. 32 to count each address separately or 24 to count
+	// the clients behind a CGNAT together.  It must be from 0 to 32.
+	SubnetLenIPv4 int
+
+	// SubnetLenIPv6 is the length of the prefixes the IPv6 client addresses are
+	// aggregated by, e.g. 64 or 56 to count the clients using the privacy
+	// addresses as a single household.  It must be from 0 to 128.
+	SubnetLenIPv6 int
+
+	// MaxClients is the maximum number of the tracked prefixes.  The requests
+	// from the new prefixes aren't counted once it's reached.  Zero means
+	// [DefaultClientStatisticsMaxClients].
+	MaxClients int
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *ClientStatisticsConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	return errors.Join(
+		validate.InRange("SubnetLenIPv4", c.SubnetLenIPv4, 0, netutil.IPv4BitLen),
+		validate.InRange("SubnetLenIPv6", c.SubnetLenIPv6, 0, netutil.IPv6BitLen),
+		validate.NotNegative("MaxClients", c.MaxClients),
+	)
+}
+
+// ClientStatistics contains the numbers of the requests from the clients
+// within a single network.
+type ClientStatistics struct {
+	// LastSeen is the time of the latest request from the network.
+	LastSeen time.Time
+
+	// Prefix is the network of the clients, masked according to
+	// [ClientStatisticsConfig].
+	Prefix netip.Prefix
+
+	// Requests is the total number of requests.
+	Requests uint64
+
+	// CacheHits is the number of requests responded from cache.
+	CacheHits uint64
+
+	// Failures is the number of requests which haven't been resolved or have
+	// been responded with SERVFAIL.
+	Failures uint64
+}
+
+// ClientStatistics returns the statistics of the requests from the clients
+// aggregated by their networks, sorted by the number of requests in descending
+// order.  Only the requests received by the listeners and not dropped before
+// handling, e.g. due to ratelimiting, are counted.  It returns nil if
+// [Config.ClientStats] is nil.
+func (p *Proxy) ClientStatistics() (stats []*ClientStatistics) {
+	return p.clientStats.statistics()
+}
+
+// clientStats is the concurrency-safe storage of [ClientStatistics].  A nil
+// *clientStats is a valid storage which doesn't count anything.
+type clientStats struct {
+	// clock is used to get the time of the requests.
+	clock timeutil.Clock
+
+	// mu protects clients.
+	mu *sync.Mutex
+
+	// clients maps the masked prefixes to their statistics.
+	clients map[netip.Prefix]*ClientStatistics
+
+	// subnetLenIPv4 is the length of the IPv4 prefixes.
+	subnetLenIPv4 int
+
+	// subnetLenIPv6 is the length of the IPv6 prefixes.
+	subnetLenIPv6 int
+
+	// maxClients is the maximum number of entries in clients.
+	maxClients int
+}
+
+// newClientStats returns a new *clientStats configured with conf.  It returns
+// nil if conf is nil.
+func newClientStats(conf *ClientStatisticsConfig, clock timeutil.Clock) (s *clientStats) {
+	if conf == nil {
+		return nil
+	}
+
+	return &clientStats{
+		clock:         clock,
+		mu:            &sync.Mutex{},
+		clients:       map[netip.Prefix]*ClientStatistics{},
+		subnetLenIPv4: conf.SubnetLenIPv4,
+		subnetLenIPv6: conf.SubnetLenIPv6,
+		maxClients:    cmp.Or(conf.MaxClients, DefaultClientStatisticsMaxClients),
+	}
+}
+
+// prefix returns the network of addr to aggregate its requests by.
+func (s *clientStats) prefix(addr netip.Addr) (pref netip.Prefix) {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		pref = netip.PrefixFrom(addr, s.subnetLenIPv4)
+	} else {
+		pref = netip.PrefixFrom(addr.WithZone(""), s.subnetLenIPv6)
+	}
+
+	return pref.Masked()
+}
+
+// record counts the request from d handled with err.
+func (s *clientStats) record(d *DNSContext, err error) {
+	if s == nil || !d.Addr.Addr().IsValid() {
+		return
+	}
+
+	pref := s.prefix(d.Addr.Addr())
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := s.clients[pref]
+	if cs == nil {
+		if len(s.clients) >= s.maxClients {
+			return
+		}
+
+		cs = &ClientStatistics{
+			Prefix: pref,
+		}
+		s.clients[pref] = cs
+	}
+
+	cs.Requests++
+	cs.LastSeen = now
+
+	switch {
+	case err != nil, d.Res == nil, d.Res.Rcode == dns.RcodeServerFailure:
+		cs.Failures++
+	case d.cacheHit:
+		cs.CacheHits++
+	default:
+		// Go on.
+	}
+}
+
+// statistics returns the copies of the statistics sorted by the number of
+// requests in descending order.
+func (s *clientStats) statistics() (stats []*ClientStatistics) {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	stats = make([]*ClientStatistics, 0, len(s.clients))
+	for _, cs := range s.clients {
+		csCopy := *cs
+		stats = append(stats, &csCopy)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(stats, func(a, b *ClientStatistics) (res int) {
+		if res = cmp.Compare(b.Requests, a.Requests); res != 0 {
+			return res
+		}
+
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+
+	return stats
+}
+
+// The persistent client statistics file format.
+//
+// The file has the header and the records described in [fileFormat] with the
+// magic [clientStatsFileMagic].  The keys of the records are the binary forms
+// of the prefixes, and the values are:
+//
+//	requests   uint64  big-endian
+//	cacheHits  uint64  big-endian
+//	failures   uint64  big-endian
+//	lastSeen   int64   big-endian Unix time in nanoseconds
+const (
+	// clientStatsFileMagic identifies the persistent client statistics files.
+	clientStatsFileMagic = "DPXS"
+
+	// clientStatsFileVersion is the current version of the persistent client
+	// statistics file format.
+	clientStatsFileVersion uint16 = 1
+
+	// clientStatsRecord is the kind of the records of the client statistics.
+	clientStatsRecord cacheRecordKind = 1
+
+	// clientStatsValLen is the length of the values of the records.
+	clientStatsValLen = 4 * 8
+)
+
+// clientStatsFileFormat is the format of the persistent client statistics
+// file.  There are no migrations yet, since version 1 is the first one.
+var clientStatsFileFormat = &fileFormat{
+	migrations: map[uint16]fileMigration{},
+	magic:      clientStatsFileMagic,
+	version:    clientStatsFileVersion,
+}
+
+// load restores the statistics from the file at path.  Missing file is not an
+// error.  Malformed files and files of unsupported versions are moved aside.
+func (s *clientStats) load(path string) (err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading client statistics file: %w", err)
+	}
+
+	body, err := clientStatsFileFormat.migrate(data)
+	if err == nil {
+		err = s.decode(body)
+	}
+
+	if err != nil {
+		bakPath := clientStatsFileFormat.backupPath(path, data)
+		err = errors.WithDeferred(err, os.Rename(path, bakPath))
+
+		return fmt.Errorf("decoding client statistics file: %w", err)
+	}
+
+	return nil
+}
+
+// decode stores the statistics from the records of body into s.
+func (s *clientStats) decode(body []byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := bytes.NewReader(body)
+	for r.Len() > 0 && len(s.clients) < s.maxClients {
+		var kind cacheRecordKind
+		var key, val []byte
+		kind, key, val, err = readCacheRecord(r)
+		if err != nil {
+			return err
+		} else if kind != clientStatsRecord || len(val) < clientStatsValLen {
+			continue
+		}
+
+		cs := &ClientStatistics{}
+		err = cs.Prefix.UnmarshalBinary(key)
+		if err != nil {
+			return fmt.Errorf("%w: prefix: %w", errCacheFileFormat, err)
+		}
+
+		cs.Requests = binary.BigEndian.Uint64(val)
+		cs.CacheHits = binary.BigEndian.Uint64(val[8:])
+		cs.Failures = binary.BigEndian.Uint64(val[16:])
+		cs.LastSeen = time.Unix(0, int64(binary.BigEndian.Uint64(val[24:])))
+
+		// Keep the statistics gathered with the different prefix lengths
+		// separately, since those can't be merged.
+		s.clients[cs.Prefix] = cs
+	}
+
+	return nil
+}
+
+// save writes the statistics into the file at path.  The file is replaced
+// atomically.  The file of an unsupported newer version is moved aside first.
+func (s *clientStats) save(path string) (err error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating client statistics file: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = s.encode(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		err = errors.WithDeferred(err, os.Remove(tmpPath))
+
+		return fmt.Errorf("writing client statistics file: %w", err)
+	}
+
+	err = clientStatsFileFormat.backupNewer(path)
+	if err != nil {
+		return fmt.Errorf("backing up client statistics file: %w", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// encode writes the header and all the records of s into w.
+func (s *clientStats) encode(w io.Writer) (err error) {
+	_, err = w.Write(clientStatsFileFormat.header())
+	if err != nil {
+		return err
+	}
+
+	for _, cs := range s.statistics() {
+		// The error is always nil for the valid prefixes.
+		key, _ := cs.Prefix.MarshalBinary()
+
+		val := make([]byte, 0, clientStatsValLen)
+		val = binary.BigEndian.AppendUint64(val, cs.Requests)
+		val = binary.BigEndian.AppendUint64(val, cs.CacheHits)
+		val = binary.BigEndian.AppendUint64(val, cs.Failures)
+		val = binary.BigEndian.AppendUint64(val, uint64(cs.LastSeen.UnixNano()))
+
+		err = writeCacheRecord(w, clientStatsRecord, key, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClientStatsContext returns a new *DNSContext for a request from addr
+// responded with rcode.
+func newClientStatsContext(addr string, rcode int) (d *DNSContext) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	return &DNSContext{
+		Req:  req,
+		Res:  (&dns.Msg{}).SetRcode(req, rcode),
+		Addr: netip.AddrPortFrom(netip.MustParseAddr(addr), 53),
+	}
+}
+
+func TestClientStats_record(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &faketime.Clock{
+		OnNow: func() (n time.Time) { return now },
+	}
+
+	s := newClientStats(&ClientStatisticsConfig{
+		SubnetLenIPv4: 24,
+		SubnetLenIPv6: 56,
+		MaxClients:    2,
+	}, clock)
+
+	s.record(newClientStatsContext("192.0.2.1", dns.RcodeSuccess), nil)
+
+	hit := newClientStatsContext("::ffff:192.0.2.200", dns.RcodeSuccess)
+	hit.cacheHit = true
+	s.record(hit, nil)
+
+	s.record(newClientStatsContext("192.0.2.2", dns.RcodeServerFailure), nil)
+	s.record(newClientStatsContext("2001:db8:0:ff::1", dns.RcodeSuccess), nil)
+
+	// The limit of the tracked prefixes is reached.
+	s.record(newClientStatsContext("198.51.100.1", dns.RcodeSuccess), nil)
+
+	assert.Equal(t, []*ClientStatistics{{
+		LastSeen:  now,
+		Prefix:    netip.MustParsePrefix("192.0.2.0/24"),
+		Requests:  3,
+		CacheHits: 1,
+		Failures:  1,
+	}, {
+		LastSeen: now,
+		Prefix:   netip.MustParsePrefix("2001:db8::/56"),
+		Requests: 1,
+	}}, s.statistics())
+
+	var nilStats *clientStats
+	nilStats.record(newClientStatsContext("192.0.2.1", dns.RcodeSuccess), nil)
+
+	assert.Nil(t, nilStats.statistics())
+}
+
+func TestClientStats_persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.bin")
+	conf := &ClientStatisticsConfig{
+		FilePath:      path,
+		SubnetLenIPv4: 32,
+		SubnetLenIPv6: 64,
+	}
+
+	// Drop the monotonic clock reading to compare the loaded times.
+	now := time.Now().Round(0)
+	clock := &faketime.Clock{
+		OnNow: func() (n time.Time) { return now },
+	}
+
+	saved := newClientStats(conf, clock)
+	saved.record(newClientStatsContext("192.0.2.1", dns.RcodeSuccess), nil)
+	saved.record(newClientStatsContext("2001:db8::1", dns.RcodeSuccess), nil)
+	saved.record(newClientStatsContext("2001:db8::2", dns.RcodeSuccess), nil)
+	require.NoError(t, saved.save(path))
+
+	loaded := newClientStats(conf, clock)
+	require.NoError(t, loaded.load(path))
+
+	assert.Equal(t, saved.statistics(), loaded.statistics())
+
+	t.Run("malformed", func(t *testing.T) {
+		badPath := filepath.Join(t.TempDir(), "bad.bin")
+		require.NoError(t, os.WriteFile(badPath, []byte("DPXC\x00\x01"), 0o600))
+
+		s := newClientStats(conf, clock)
+		require.Error(t, s.load(badPath))
+
+		assert.Empty(t, s.statistics())
+		assert.FileExists(t, badPath+".bak")
+		assert.NoFileExists(t, badPath)
+	})
+
+	t.Run("newer", func(t *testing.T) {
+		newerPath := filepath.Join(t.TempDir(), "newer.bin")
+		data := binary.BigEndian.AppendUint16([]byte(clientStatsFileMagic), clientStatsFileVersion+1)
+		require.NoError(t, os.WriteFile(newerPath, data, 0o600))
+
+		s := newClientStats(conf, clock)
+		require.Error(t, s.load(newerPath))
+		require.NoError(t, s.save(newerPath))
+
+		// The file of the newer version is kept aside, not overwritten.
+		bakPath := fmt.Sprintf("%s.v%d.bak", newerPath, clientStatsFileVersion+1)
+		bakData, err := os.ReadFile(bakPath)
+		require.NoError(t, err)
+
+		assert.Equal(t, data, bakData)
+		assert.FileExists(t, newerPath)
+	})
+}
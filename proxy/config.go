@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log/slog"
@@ -9,10 +10,11 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // LogPrefix is a prefix for logging.
@@ -31,11 +33,13 @@ const (
 // RequestHandler is an optional custom handler for DNS requests.  It's used
 // instead of [Proxy.Resolve] if set.  The resulting error doesn't affect the
 // request processing.  The custom handler is responsible for calling
-// [ResponseHandler], if it doesn't call [Proxy.Resolve].
+// [ResponseHandler], if it doesn't call [Proxy.Resolve].  ctx is canceled once
+// the client is gone or p is shut down, and should be passed to
+// [Proxy.Resolve].
 //
 // TODO(e.burkov):  Use the same interface-based approach as
 // [BeforeRequestHandler].
-type RequestHandler func(p *Proxy, dctx *DNSContext) (err error)
+type RequestHandler func(ctx context.Context, p *Proxy, dctx *DNSContext) (err error)
 
 // ResponseHandler is an optional custom handler called when DNS query has been
 // processed.  When called from [Proxy.Resolve], dctx will contain the response
@@ -46,6 +50,23 @@ type RequestHandler func(p *Proxy, dctx *DNSContext) (err error)
 // [BeforeRequestHandler].
 type ResponseHandler func(dctx *DNSContext, err error)
 
+// CacheAdmissionHandler is an optional custom handler deciding whether resp
+// received for the request from dctx is stored in the cache.  It's called for
+// each response about to be cached, including the ones received for the
+// proactive cache refreshes, and ok must be false to prevent caching.  The
+// accepted responses are still subject to the usual cacheability checks.
+// dctx.Upstream is the upstream resp is received from.  It must not modify resp
+// and must be safe for concurrent use.
+type CacheAdmissionHandler func(resp *dns.Msg, dctx *DNSContext) (ok bool)
+
+// CacheRefreshHandler is an optional custom handler called after each
+// proactive refresh of the cache entry for name of type qtype.  oldResp is the
+// response cached before the refresh, if any, and newResp is the one received
+// for the refresh, which is only nil if err isn't.  It's called in the
+// goroutine performing the refresh, so it must not block for long, and must be
+// safe for concurrent use.  Neither of the responses should be modified.
+type CacheRefreshHandler func(name string, qtype uint16, oldResp, newResp *dns.Msg, err error)
+
 // Config contains all the fields necessary for proxy configuration.
 //
 // TODO(a.garipov): Consider extracting conf blocks for better fieldalignment.
@@ -54,6 +75,18 @@ type Config struct {
 	// [slog.Default] with [LogPrefix] is used.
 	Logger *slog.Logger
 
+	// LogLevels are the minimum levels of the logs of the particular
+	// subsystems, which may be either lower or higher than the level of
+	// Logger.  The logs of the subsystems are tagged with [KeySubsystem]
+	// regardless.
+	LogLevels map[LogSubsystem]slog.Level
+
+	// TracerProvider provides the OpenTelemetry tracer for the spans of
+	// [Proxy.Resolve], the cache lookups, the upstream exchanges, and the
+	// proactive cache refreshes, see [TracerName].  If nil, no spans are
+	// created.
+	TracerProvider trace.TracerProvider
+
 	// TrustedProxies is the trusted list of CIDR networks to detect proxy
 	// servers addresses from where the DoH requests should be handled.  The
 	// value of nil makes Proxy not trust any address.
@@ -70,7 +103,9 @@ type Config struct {
 
 	// PendingRequests is used to mitigate the cache poisoning attacks by
 	// tracking identical requests and returning the same response for them,
-	// performing a single lookup.  If nil, it will be enabled by default.
+	// performing a single lookup.  Only the cache misses are tracked, and the
+	// requests are identical if they have the same question and ECS subnet.
+	// If nil, the requests aren't tracked.
 	PendingRequests *PendingRequestsConfig
 
 	// BeforeRequestHandler is an optional custom handler called before each DNS
@@ -86,6 +121,16 @@ type Config struct {
 	// been processed.  See [ResponseHandler].
 	ResponseHandler ResponseHandler
 
+	// CacheAdmissionHandler is an optional custom handler deciding whether a
+	// response is cached.  If nil, all the cacheable responses are cached.  See
+	// [CacheAdmissionHandler].  It requires CacheEnabled.
+	CacheAdmissionHandler CacheAdmissionHandler
+
+	// OnCacheRefresh is an optional custom handler called after each proactive
+	// refresh of a cache entry, e.g. to detect the changes of the addresses.
+	// See [CacheRefreshHandler].  It requires CacheOptimistic.
+	OnCacheRefresh CacheRefreshHandler
+
 	// UpstreamConfig is a general set of DNS servers to forward requests to.
 	UpstreamConfig *UpstreamConfig
 
@@ -102,6 +147,12 @@ type Config struct {
 	// TODO(e.burkov):  Add explicit boolean for disabling fallbacks.
 	Fallbacks *UpstreamConfig
 
+	// CacheProactiveRefreshUpstreams is the set of upstream DNS servers used
+	// for proactive cache refreshes instead of [Config.UpstreamConfig].  It
+	// isn't allowed to be empty, but can be nil, which means to refresh the
+	// cache using the general upstreams.
+	CacheProactiveRefreshUpstreams *UpstreamConfig
+
 	// Userinfo is the sole permitted userinfo for the DoH basic authentication.
 	// If Userinfo is set, all DoH queries are required to have this basic
 	// authentication information.
@@ -131,6 +182,33 @@ type Config struct {
 	// If not specified the [proxy.UpstreamModeLoadBalance] is used.
 	UpstreamMode UpstreamMode
 
+	// UpstreamRetry configures retrying the exchanges with the upstreams.  If
+	// nil, each of the upstreams is tried once in turn until one responds.  It
+	// has no effect with [UpstreamModeParallel] and for the A and AAAA
+	// requests with [UpstreamModeFastestAddr], as well as for the raced
+	// requests with [UpstreamModeRace].
+	UpstreamRetry *UpstreamRetryConfig
+
+	// UpstreamTimeouts configures the timeouts of the exchanges with the
+	// upstreams per upstream and per query type.  If nil, only the timeouts of
+	// the upstreams themselves are used.
+	UpstreamTimeouts *UpstreamTimeoutConfig
+
+	// UpstreamRefusal is the action taken when an upstream responds with
+	// REFUSED or NOTIMP.  If empty, [UpstreamRefusalActionPass] is used.  The
+	// refusals are counted regardless, see [Proxy.UpstreamQueryStatistics].
+	UpstreamRefusal UpstreamRefusalAction
+
+	// AnswerOrder is the order of the A and AAAA records in the responses to
+	// the clients.  The cached responses aren't affected, so the proactive
+	// refreshes keep the full set of records in the original order.  If empty,
+	// [AnswerOrderKeep] is used.
+	AnswerOrder AnswerOrder
+
+	// RaceQueryTypes are the types of the requests resolved by racing the
+	// upstreams with [UpstreamModeRace].  If empty, all requests are raced.
+	RaceQueryTypes []uint16
+
 	// UDPListenAddr is the set of UDP addresses to listen for plain
 	// DNS-over-UDP requests.
 	UDPListenAddr []*net.UDPAddr
@@ -159,6 +237,10 @@ type Config struct {
 	// requests.
 	DNSCryptTCPListenAddr []*net.TCPAddr
 
+	// Listeners are the listeners with their own settings, in addition to the
+	// ones configured with the addresses of the particular protocols above.
+	Listeners []*ListenerConfig
+
 	// BogusNXDomain is the set of networks used to transform responses into
 	// NXDOMAIN ones if they contain at least a single IP address within these
 	// networks.  It's similar to dnsmasq's "bogus-nxdomain".
@@ -172,6 +254,10 @@ type Config struct {
 	// RatelimitWhitelist is a list of IP addresses excluded from rate limiting.
 	RatelimitWhitelist []netip.Addr
 
+	// RatelimitWhitelistSubnets is a list of networks excluded from rate
+	// limiting.  It's checked in addition to RatelimitWhitelist.
+	RatelimitWhitelistSubnets []netip.Prefix
+
 	// EDNSAddr is the ECS IP used in request.
 	EDNSAddr net.IP
 
@@ -189,9 +275,40 @@ type Config struct {
 	// to disable).
 	Ratelimit int
 
+	// RatelimitPolicy defines the action performed on the ratelimited
+	// requests.  If not specified the [RatelimitPolicyDrop] is used.
+	RatelimitPolicy RatelimitPolicy
+
 	// CacheSizeBytes is the maximum cache size in bytes.
 	CacheSizeBytes int
 
+	// CacheMaxEntries is the maximum number of the cached responses.  Unlike
+	// [Config.CacheSizeBytes], it bounds the number of the entries refreshed
+	// proactively, which depends on the number of entries rather than on their
+	// size.  The limit is divided between [Config.CacheShards] so that it's
+	// never exceeded, and the number of shards is limited by it.  If zero, the
+	// number of entries is only limited by [Config.CacheSizeBytes].
+	CacheMaxEntries int
+
+	// CacheShards is the number of independently locked shards of the cache,
+	// so that the concurrent requests for different questions don't contend
+	// for a single lock.  [Config.CacheSizeBytes] is divided evenly between the
+	// shards, so the number is limited to keep each shard large enough for a
+	// response of the maximum size.  If not positive, the default of 16 is
+	// used.
+	CacheShards int
+
+	// CacheMaxEntryBytes is the maximum size of a single cache entry in bytes,
+	// including its key and the storage overhead.  The larger responses aren't
+	// cached, so that a pathologically large one doesn't evict lots of the
+	// normal ones.  If zero, the entries are only limited by
+	// [Config.CacheSizeBytes].  See [Proxy.CacheStatistics].
+	CacheMaxEntryBytes int
+
+	// CacheEvictionPolicy defines which entries are evicted from the full
+	// cache first.  If not specified the [CacheEvictionPolicyLRU] is used.
+	CacheEvictionPolicy CacheEvictionPolicy
+
 	// CacheMinTTL is the minimum TTL for cached DNS responses in seconds.
 	CacheMinTTL uint32
 
@@ -206,6 +323,18 @@ type Config struct {
 	// when cache is optimistic.  Default value is [DefaultOptimisticMaxAge].
 	CacheOptimisticMaxAge time.Duration
 
+	// CacheStaleIfErrorMaxAge, if positive, makes the expired cached responses
+	// kept for this long after their expiration to serve them instead of the
+	// SERVFAIL responses when resolving the requests missing the cache fails,
+	// see RFC 8767.  It doesn't depend on [Config.CacheOptimistic].  The stale
+	// responses are annotated with the Stale Answer extended DNS error.
+	CacheStaleIfErrorMaxAge time.Duration
+
+	// CacheStaleIfErrorAnswerTTL is the TTL of the responses served due to
+	// [Config.CacheStaleIfErrorMaxAge].  If zero, the default of 30 seconds is
+	// used.
+	CacheStaleIfErrorAnswerTTL time.Duration
+
 	// CacheProactiveRefreshTime is the time in milliseconds before TTL expiration
 	// when cache entries should be proactively refreshed.  If zero or negative,
 	// proactive refresh is disabled.  Default is 30000 (30 seconds).
@@ -220,6 +349,127 @@ type Config struct {
 	// Default is 3.
 	CacheProactiveCooldownThreshold int
 
+	// CacheProactiveAdaptive enables the adaptive mode of the proactive
+	// refresh.  In this mode, an entry is refreshed when the moving average of
+	// the intervals between its requests doesn't exceed the cooldown period
+	// divided by [Config.CacheProactiveCooldownThreshold], and the entries
+	// requested more often are refreshed later, but no earlier than
+	// [Config.CacheProactiveRefreshTime] before expiration.  The cooldown
+	// mechanism must be enabled for this mode to take effect.
+	CacheProactiveAdaptive bool
+
+	// CacheProactivePinnedZones are the patterns of domain names which are
+	// always proactively refreshed regardless of the cooldown mechanism.  A
+	// pattern like "googleapis.com" matches the domain name itself and all its
+	// subdomains, while "*.googleapis.com" only matches the subdomains.  The
+	// domain names are usually registered domains, see [Proxy.ZoneStatistics].
+	CacheProactivePinnedZones []string
+
+	// CacheProactiveExcludedZones are the patterns of domain names which are
+	// never proactively refreshed.  It takes precedence over
+	// [Config.CacheProactivePinnedZones] and uses the same pattern syntax.
+	CacheProactiveExcludedZones []string
+
+	// DomainPolicies is the ordered table of the policies for the domain
+	// names.  The first policy matching the requested domain name applies, see
+	// [Proxy.MatchDomainPolicy].  [Config.CacheProactiveExcludedZones] and
+	// [Config.CacheProactivePinnedZones] are matched as the policies following
+	// these ones.
+	DomainPolicies []*DomainPolicy
+
+	// ClientPolicies is the ordered table of the policies for the clients.
+	// The first policy the client has authenticated as applies, otherwise the
+	// first policy with a network containing the address of the client, see
+	// [Proxy.MatchClientPolicy].  The routing of a client policy takes
+	// precedence over the one of [Config.DomainPolicies].
+	ClientPolicies []*ClientPolicy
+
+	// CacheProactiveStatsMaxEntries is the maximum number of cache entries to
+	// track the request statistics for the cooldown mechanism.  The least
+	// recently requested entries are forgotten first.  If not positive, the
+	// default of 100000 is used.
+	CacheProactiveStatsMaxEntries int
+
+	// CacheProactiveRefreshMaxConcurrent is the maximum number of proactive
+	// refreshes performed at the same time, so that the bursts of background
+	// traffic don't congest the connections shared with the user queries.  If
+	// not set (0), the default of 4 is used.  Negative value means no limit.
+	CacheProactiveRefreshMaxConcurrent int
+
+	// CacheProactiveMaxRefreshQPS is the maximum number of proactive refreshes
+	// performed per second in total, so that the background traffic to the
+	// metered upstreams is bounded.  The refreshes exceeding it are deferred
+	// rather than dropped, so the cached entries may expire before they're
+	// refreshed.  If zero, the rate isn't limited.
+	CacheProactiveMaxRefreshQPS int
+
+	// CacheProactiveWarmupPeriod is the period after the start of the proxy
+	// during which the proactive refresh queries to each upstream are limited
+	// by [Config.CacheProactiveWarmupRate], so that the entries loaded from
+	// [Config.CacheFilePath] aren't revalidated all at once.  If not positive,
+	// the refresh queries aren't limited.
+	CacheProactiveWarmupPeriod time.Duration
+
+	// CacheProactiveWarmupRate is the maximum number of proactive refresh
+	// queries per second sent to each upstream during
+	// [Config.CacheProactiveWarmupPeriod].  If not positive, the default of 10
+	// is used.
+	CacheProactiveWarmupRate int
+
+	// CacheProactiveRefreshGuard makes the proactive refreshes keep the cached
+	// response instead of replacing it with a drastically worse one: an
+	// unsuccessful one replacing a successful one, or the one with fewer answer
+	// records than [Config.CacheProactiveRefreshMinAnswers] replacing the one
+	// with at least as many.  The rejected refreshes are retried like the
+	// failed ones, see [Proxy.RejectedRefreshes].
+	CacheProactiveRefreshGuard bool
+
+	// CacheProactiveRefreshMinAnswers is the minimum number of answer records
+	// of a refresh result for [Config.CacheProactiveRefreshGuard].  It may be
+	// overridden with [DomainPolicy.RefreshMinAnswers].  If zero, the default
+	// of 1 is used.
+	CacheProactiveRefreshMinAnswers uint
+
+	// CacheFilePath is the path to the file the cache is loaded from on
+	// creation and saved to on shutdown.  If empty, the cache isn't
+	// persisted.
+	CacheFilePath string
+
+	// CacheFileFlushInterval is the interval of writing the cache insertions
+	// to the journal next to CacheFilePath, so that a crash only loses the
+	// ones made within it.  If not positive, the cache is only saved on
+	// shutdown.
+	CacheFileFlushInterval time.Duration
+
+	// CacheFileCompactionInterval is the interval of rewriting the file at
+	// CacheFilePath with all the cache entries and discarding the journal.  If
+	// not positive, the default of 1 hour is used.
+	CacheFileCompactionInterval time.Duration
+
+	// CacheFileRevalidate makes the entries loaded from CacheFilePath expire
+	// right away, so that the optimistic cache serves them as stale until they
+	// are resolved again.  The entries are revalidated one by one in the
+	// background after the start, so that the persisted responses aren't
+	// served indefinitely.  It requires CacheOptimistic.
+	CacheFileRevalidate bool
+
+	// CachePerClient makes proxy cache the responses to the clients of each of
+	// [Config.ClientPolicies] separately from the ones to the other clients.
+	// Otherwise, the responses of the upstreams of the policies aren't cached
+	// at all, so that the policies with different upstreams, e.g. the
+	// filtering ones, never share the answers.  The caches of the policies
+	// share CacheSizeBytes equally, and their entries aren't refreshed
+	// proactively nor served optimistically.  The caches are identified by the
+	// names of the policies, which must be unique, so [Proxy.Reload] keeps the
+	// caches of the policies with the same names and drops the other ones.
+	CachePerClient bool
+
+	// CachePrefetchDualStack makes proxy resolve and cache the AAAA records in
+	// the background when the A records of the name miss the cache, and vice
+	// versa, so that the follow-up requests of dual-stack clients are
+	// responded from cache.
+	CachePrefetchDualStack bool
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
 	// requests.  Important for mobile users.
 	//
@@ -231,14 +481,81 @@ type Config struct {
 	// buffers can handle larger bursts of requests before packets get dropped.
 	UDPBufferSize int
 
+	// UDPSocketsPerAddr is the number of UDP sockets opened for each of
+	// UDPListenAddr with SO_REUSEPORT, each served by a separate read loop, so
+	// that the kernel distributes the incoming packets between them.  Zero and
+	// one mean a single socket, negative value means one socket per CPU.  More
+	// than one socket is only supported on Unix-like systems.
+	UDPSocketsPerAddr int
+
 	// FastestPingTimeout is the timeout for waiting the first successful
 	// dialing when the UpstreamMode is set to [UpstreamModeFastestAddr].
 	// Non-positive value will be replaced with the default one.
 	FastestPingTimeout time.Duration
 
+	// FastestPingPorts are the TCP ports to ping the resolved addresses on when
+	// the UpstreamMode is set to [UpstreamModeFastestAddr].  If empty,
+	// [fastip.DefaultPingPorts] are used.
+	FastestPingPorts []uint
+
+	// FastestPingICMP makes the resolved addresses also pinged with ICMP echo
+	// requests when the UpstreamMode is set to [UpstreamModeFastestAddr].  See
+	// [fastip.Config.PingICMP].
+	FastestPingICMP bool
+
+	// CacheOutage configures serving the cached entries longer while the
+	// upstreams are unavailable.  If nil, the entries expire as usual.  It
+	// requires CacheEnabled.
+	CacheOutage *CacheOutageConfig
+
+	// MemoryPressure configures degrading the cache gracefully while the
+	// memory used by the process nears the limit.  If nil, the memory usage
+	// isn't checked.  It requires CacheEnabled.
+	MemoryPressure *MemoryPressureConfig
+
+	// NetworkChange configures reacting to the changes of the host network,
+	// see [Proxy.HandleNetworkChange].  If nil, only the upstreams are
+	// replaced.
+	NetworkChange *NetworkChangeConfig
+
+	// StartupProbe configures verifying the upstreams with a probe query on
+	// [Proxy.Start].  If nil, the upstreams aren't probed.
+	StartupProbe *StartupProbeConfig
+
+	// CacheReplication configures pushing the cache snapshots to the replicas.
+	// If nil, the snapshots aren't pushed.  It requires CacheEnabled.
+	CacheReplication *CacheReplicationConfig
+
+	// CacheReplica configures the cache replica mode, in which the proxy
+	// answers exclusively from the cache entries pushed by a primary proxy.
+	// UpstreamConfig may be nil in this mode.  If nil, the upstreams are used
+	// as usual.  It requires CacheEnabled.
+	CacheReplica *CacheReplicaConfig
+
+	// CriticalNames configures checking the upstream answers for the critical
+	// domain names to detect hijacking.  If nil, the answers aren't checked.
+	CriticalNames *CriticalNamesConfig
+
 	// RefuseAny makes proxy refuse the requests of type ANY.
 	RefuseAny bool
 
+	// RequireClientAuth makes proxy reject the DNS-over-TLS, DNS-over-HTTPS,
+	// and DNS-over-QUIC requests from the clients which haven't authenticated
+	// as any of [Config.ClientPolicies], see [ClientPolicy.CertNames] and
+	// [ClientPolicy.Tokens].  The DoH requests are rejected with the 401 status
+	// and the others are refused.
+	RequireClientAuth bool
+
+	// ANYQuery configures answering the requests of type ANY with the minimal
+	// HINFO responses.  It has no effect if RefuseAny is true.  If nil, those
+	// requests are forwarded as usual.
+	ANYQuery *ANYQueryConfig
+
+	// Truncation configures when the UDP responses to clients are truncated
+	// and the EDNS UDP buffer size advertised in them.  If nil, only the
+	// responses exceeding the client's buffer are truncated.
+	Truncation *TruncationConfig
+
 	// HTTP3 enables HTTP/3 support for HTTPS server.
 	HTTP3 bool
 
@@ -270,6 +587,57 @@ type Config struct {
 	// CacheOptimistic defines if the optimistic cache mechanism should be used.
 	CacheOptimistic bool
 
+	// EnableDNSSECValidation makes proxy validate the DNSSEC signatures of the
+	// upstream responses against the root trust anchors.  Bogus responses are
+	// replaced with SERVFAIL ones containing an extended DNS error.
+	EnableDNSSECValidation bool
+
+	// AnnotateResponseSource makes proxy add the EDNS0 option with the code
+	// [EDNSCodeResponseSource] to the responses for the requests with EDNS0.
+	// The option contains the [ResponseSource] of the response, which is
+	// useful for debugging the cache.
+	AnnotateResponseSource bool
+
+	// NormalizeUpstreamRequests makes proxy send the requests differing only in
+	// the RD flag and the case of the question name to the upstreams as the
+	// same canonical request.  The client still receives its own question and
+	// RD flag in the response.
+	NormalizeUpstreamRequests bool
+
+	// SanitizeResponses makes proxy remove the records unrelated to the
+	// question from the upstream responses before caching them, so that a
+	// misbehaving upstream can't poison the cache.  This includes the answers
+	// for other names or types, the out-of-bailiwick authority records, and the
+	// additional records not referred to by the kept ones.
+	SanitizeResponses bool
+
+	// StripECH makes proxy remove the ECH configurations from the SVCB and
+	// HTTPS records of the upstream responses before caching them, so that
+	// clients don't use Encrypted Client Hello.  Note that it invalidates the
+	// DNSSEC signatures of such records, so it's applied after the validation.
+	StripECH bool
+
+	// RebindProtection configures the DNS rebinding protection.  If nil, the
+	// protection is disabled.
+	RebindProtection *RebindProtectionConfig
+
+	// EDNSCompliance configures the handling of the EDNS versions, flags, and
+	// options of the requests.  If nil, the OPT records are forwarded as is.
+	EDNSCompliance *EDNSComplianceConfig
+
+	// ClientStats configures the statistics of the requests aggregated by the
+	// networks of the clients, see [Proxy.ClientStatistics].  If nil, the
+	// statistics aren't gathered.
+	ClientStats *ClientStatisticsConfig
+
+	// Mirror configures mirroring the sampled requests along with their
+	// responses to an analysis sink.  If nil, nothing is mirrored.
+	Mirror *MirrorConfig
+
+	// AnomalyCapture configures capturing the malformed and anomalous traffic
+	// into a libpcap file.  If nil, nothing is captured.
+	AnomalyCapture *AnomalyCaptureConfig
+
 	// UseDNS64 enables DNS64 handling.  If true, proxy will translate IPv4
 	// answers into IPv6 answers using first of DNS64Prefs.  Note also that PTR
 	// requests for addresses within the specified networks are considered
@@ -283,6 +651,16 @@ type Config struct {
 	// server.
 	UsePrivateRDNS bool
 
+	// PrivateRDNS configures answering the PTR requests for the private
+	// addresses locally.  If nil, those are only resolved as UsePrivateRDNS
+	// specifies.
+	PrivateRDNS *PrivateRDNSConfig
+
+	// MDNS configures resolving the names within the "local." domain with the
+	// multicast DNS on the LAN.  If nil, those are resolved as any other
+	// names.
+	MDNS *MDNSConfig
+
 	// PreferIPv6 tells the proxy to prefer IPv6 addresses when bootstrapping
 	// upstreams that use hostnames.
 	PreferIPv6 bool
@@ -294,109 +672,76 @@ type PendingRequestsConfig struct {
 	Enabled bool
 }
 
-// validateConfig verifies that the supplied configuration is valid and returns
-// an error if it's not.
-//
-// TODO(s.chzhen):  Use [validate.Interface] from golibs.
-func (p *Proxy) validateConfig() (err error) {
-	err = p.UpstreamConfig.validate()
-	if err != nil {
-		return fmt.Errorf("general upstreams: %w", err)
+// logConfigInfo logs proxy configuration information.
+func (p *Proxy) logConfigInfo() {
+	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
+		p.logger.Info("cache ttl override is enabled", "min", p.CacheMinTTL, "max", p.CacheMaxTTL)
 	}
 
-	err = ValidatePrivateConfig(p.PrivateRDNSUpstreamConfig, p.privateNets)
-	if err != nil {
-		if p.UsePrivateRDNS || errors.Is(err, upstream.ErrNoUpstreams) {
-			return fmt.Errorf("private rdns upstreams: %w", err)
-		}
+	if p.Ratelimit > 0 {
+		p.logger.Info(
+			"ratelimit is enabled",
+			"rps",
+			p.Ratelimit,
+			"ipv4_subnet_mask_len",
+			p.RatelimitSubnetLenIPv4,
+			"ipv6_subnet_mask_len",
+			p.RatelimitSubnetLenIPv6,
+			"policy",
+			p.RatelimitPolicy,
+			"whitelisted_subnets",
+			len(p.RatelimitWhitelistSubnets),
+		)
 	}
 
-	err = p.Fallbacks.validate()
-	// Allow [Proxy.Fallbacks] to be nil, but not empty.  nil means not to use
-	// fallbacks at all.
-	if errors.Is(err, upstream.ErrNoUpstreams) {
-		return fmt.Errorf("fallbacks: %w", err)
+	if p.RefuseAny {
+		p.logger.Info("server will refuse requests of type any")
+	} else if c := p.ANYQuery; c != nil {
+		p.logger.Info("requests of type any are answered with hinfo", "exempt", len(c.ExemptSubnets))
 	}
 
-	err = p.validateRatelimit()
-	if err != nil {
-		return fmt.Errorf("ratelimit: %w", err)
+	if p.EnableDNSSECValidation {
+		p.logger.Info("dnssec validation is enabled")
 	}
 
-	switch p.UpstreamMode {
-	case
-		"",
-		UpstreamModeFastestAddr,
-		UpstreamModeLoadBalance,
-		UpstreamModeParallel:
-		// Go on.
-	default:
-		return fmt.Errorf("upstream mode: %w: %q", errors.ErrBadEnumValue, p.UpstreamMode)
+	if co := p.CacheOutage; co != nil && p.CacheEnabled {
+		p.logger.Info("cache ttl stretching during upstream outages is enabled", "multiplier", co.TTLMultiplier)
 	}
 
-	err = p.validateBasicAuth()
-	if err != nil {
-		return fmt.Errorf("basic auth: %w", err)
+	if mp := p.MemoryPressure; mp != nil && p.CacheEnabled {
+		p.logger.Info("cache degradation under memory pressure is enabled", "limit", mp.Limit)
 	}
 
-	p.logConfigInfo()
-
-	return nil
-}
-
-// validateRatelimit validates ratelimit configuration and returns an error if
-// it's invalid.
-func (p *Proxy) validateRatelimit() (err error) {
-	if p.Ratelimit == 0 {
-		return nil
+	if ac := p.AnomalyCapture; ac != nil {
+		p.logger.Info("anomalous traffic capture is enabled", "file", ac.FilePath)
 	}
 
-	err = checkInclusion(p.RatelimitSubnetLenIPv4, 0, netutil.IPv4BitLen)
-	if err != nil {
-		return fmt.Errorf("ratelimit subnet len ipv4 is invalid: %w", err)
+	if m := p.Mirror; m != nil {
+		p.logger.Info("query mirroring is enabled", "rate", m.Rate, "zones", len(m.Zones))
 	}
 
-	err = checkInclusion(p.RatelimitSubnetLenIPv6, 0, netutil.IPv6BitLen)
-	if err != nil {
-		return fmt.Errorf("ratelimit subnet len ipv6 is invalid: %w", err)
+	if len(p.DomainPolicies) > 0 {
+		p.logger.Info("domain policies are set", "count", len(p.DomainPolicies))
 	}
 
-	return nil
-}
-
-// checkInclusion returns an error if a n is not in the inclusive range between
-// minN and maxN.
-func checkInclusion(n, minN, maxN int) (err error) {
-	switch {
-	case n < minN:
-		return fmt.Errorf("value %d less than min %d", n, minN)
-	case n > maxN:
-		return fmt.Errorf("value %d greater than max %d", n, maxN)
+	if c := p.PrivateRDNS; c != nil {
+		p.logger.Info("private rdns is answered locally", "hosts", len(c.Hosts), "zone", c.Zone)
 	}
 
-	return nil
-}
+	if p.MDNS != nil {
+		p.logger.Info("local names are resolved with mdns")
+	}
 
-// logConfigInfo logs proxy configuration information.
-func (p *Proxy) logConfigInfo() {
-	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
-		p.logger.Info("cache ttl override is enabled", "min", p.CacheMinTTL, "max", p.CacheMaxTTL)
+	if len(p.ClientPolicies) > 0 {
+		p.logger.Info("client policies are set", "count", len(p.ClientPolicies))
 	}
 
-	if p.Ratelimit > 0 {
-		p.logger.Info(
-			"ratelimit is enabled",
-			"rps",
-			p.Ratelimit,
-			"ipv4_subnet_mask_len",
-			p.RatelimitSubnetLenIPv4,
-			"ipv6_subnet_mask_len",
-			p.RatelimitSubnetLenIPv6,
-		)
+	if p.SanitizeResponses {
+		p.logger.Info("unrelated records will be removed from responses")
 	}
 
-	if p.RefuseAny {
-		p.logger.Info("server will refuse requests of type any")
+	if p.StripECH {
+		p.logger.Info("ech configurations will be stripped from responses")
 	}
 
 	if len(p.BogusNXDomain) > 0 {
@@ -465,5 +810,6 @@ func (p *Proxy) hasListenAddrs() bool {
 		p.HTTPSListenAddr != nil ||
 		p.QUICListenAddr != nil ||
 		p.DNSCryptUDPListenAddr != nil ||
-		p.DNSCryptTCPListenAddr != nil
+		p.DNSCryptTCPListenAddr != nil ||
+		len(p.Listeners) > 0
 }
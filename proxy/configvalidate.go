@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+
+	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+// errNoEffect is returned by [Config.Warnings] for the fields set to the values
+// ignored due to the other fields.
+const errNoEffect errors.Error = "has no effect"
+
+// type check
+var _ validate.Interface = (*Config)(nil)
+
+// Validate implements the [validate.Interface] interface for *Config.  It
+// returns all the found problems joined, each prefixed with the name of the
+// invalid field.  The suspicious but acceptable combinations of fields are
+// reported by [Config.Warnings] instead.  c must not be nil.
+func (c *Config) Validate() (err error) {
+	var errs []error
+
+	// The upstreams are never used in the cache replica mode.
+	if c.CacheReplica == nil || c.UpstreamConfig != nil {
+		err = c.UpstreamConfig.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("UpstreamConfig: %w", err))
+		}
+	}
+
+	err = ValidatePrivateConfig(c.PrivateRDNSUpstreamConfig, c.privateSubnets())
+	if err != nil && (c.UsePrivateRDNS || errors.Is(err, upstream.ErrNoUpstreams)) {
+		errs = append(errs, fmt.Errorf("PrivateRDNSUpstreamConfig: %w", err))
+	}
+
+	err = c.PrivateRDNS.validate(c.privateSubnets())
+	if err != nil {
+		errs = append(errs, fmt.Errorf("PrivateRDNS: %w", err))
+	}
+
+	err = c.MDNS.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("MDNS: %w", err))
+	}
+
+	// Allow [Config.Fallbacks] to be nil, but not empty.  nil means not to use
+	// fallbacks at all.
+	err = c.Fallbacks.validate()
+	if errors.Is(err, upstream.ErrNoUpstreams) {
+		errs = append(errs, fmt.Errorf("Fallbacks: %w", err))
+	}
+
+	err = c.CacheProactiveRefreshUpstreams.validate()
+	if errors.Is(err, upstream.ErrNoUpstreams) {
+		errs = append(errs, fmt.Errorf("CacheProactiveRefreshUpstreams: %w", err))
+	}
+
+	if c.udpSocketsNum() > 1 && !proxynetutil.ReusePortSupported {
+		errs = append(errs, fmt.Errorf("UDPSocketsPerAddr: %w", errors.ErrUnsupported))
+	}
+
+	err = c.ANYQuery.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("ANYQuery: %w", err))
+	}
+
+	err = c.Truncation.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Truncation: %w", err))
+	}
+
+	err = c.CacheOutage.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("CacheOutage: %w", err))
+	}
+
+	err = c.MemoryPressure.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("MemoryPressure: %w", err))
+	}
+
+	err = c.NetworkChange.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("NetworkChange: %w", err))
+	}
+
+	err = c.UpstreamRetry.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("UpstreamRetry: %w", err))
+	}
+
+	err = c.UpstreamTimeouts.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("UpstreamTimeouts: %w", err))
+	}
+
+	err = c.UpstreamRefusal.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("UpstreamRefusal: %w", err))
+	}
+
+	err = c.AnswerOrder.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("AnswerOrder: %w", err))
+	}
+
+	err = c.StartupProbe.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("StartupProbe: %w", err))
+	}
+
+	err = validateLogLevels(c.LogLevels)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("LogLevels: %w", err))
+	}
+
+	errs = append(errs, c.validateCacheReplication()...)
+
+	err = c.validateDomainPolicies()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("DomainPolicies: %w", err))
+	}
+
+	err = c.validateClientPolicies()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("ClientPolicies: %w", err))
+	}
+
+	err = c.validateListeners()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Listeners: %w", err))
+	}
+
+	err = c.CriticalNames.validate(c.EnableDNSSECValidation)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("CriticalNames: %w", err))
+	}
+
+	err = c.ClientStats.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("ClientStats: %w", err))
+	}
+
+	err = c.Mirror.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Mirror: %w", err))
+	}
+
+	err = c.AnomalyCapture.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("AnomalyCapture: %w", err))
+	}
+
+	errs = append(errs, c.validateCache()...)
+	errs = append(errs, c.validateRatelimit()...)
+
+	switch c.UpstreamMode {
+	case
+		"",
+		UpstreamModeFastest,
+		UpstreamModeFastestAddr,
+		UpstreamModeLoadBalance,
+		UpstreamModeParallel,
+		UpstreamModeRace:
+		// Go on.
+	default:
+		errs = append(errs, fmt.Errorf(
+			"UpstreamMode: %w: %q",
+			errors.ErrBadEnumValue,
+			c.UpstreamMode,
+		))
+	}
+
+	for i, port := range c.FastestPingPorts {
+		errs = append(errs, validate.InRange(
+			fmt.Sprintf("FastestPingPorts[%d]", i),
+			port,
+			1,
+			math.MaxUint16,
+		))
+	}
+
+	if c.Userinfo != nil {
+		errs = append(errs, validate.NotEmptySlice("HTTPSListenAddr", c.HTTPSListenAddr))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateCacheReplication returns the errors of the cache replication
+// configuration.
+func (c *Config) validateCacheReplication() (errs []error) {
+	err := c.CacheReplication.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("CacheReplication: %w", err))
+	} else if c.CacheReplication != nil && !c.CacheEnabled {
+		errs = append(errs, errors.Error("CacheReplication: requires CacheEnabled"))
+	}
+
+	err = c.CacheReplica.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("CacheReplica: %w", err))
+	} else if c.CacheReplica != nil && !c.CacheEnabled {
+		errs = append(errs, errors.Error("CacheReplica: requires CacheEnabled"))
+	}
+
+	return errs
+}
+
+// validateCache returns the errors of the cache configuration.  The proactive
+// refresh fields are only validated when it's enabled.
+func (c *Config) validateCache() (errs []error) {
+	if !c.CacheEnabled {
+		return nil
+	}
+
+	errs = append(errs, validate.NotNegative("CacheSizeBytes", c.CacheSizeBytes))
+	errs = append(errs, validate.NotNegative("CacheMaxEntries", c.CacheMaxEntries))
+	errs = append(errs, validate.NotNegative("CacheProactiveMaxRefreshQPS", c.CacheProactiveMaxRefreshQPS))
+	errs = append(errs, validate.NotNegative("CacheMaxEntryBytes", c.CacheMaxEntryBytes))
+	errs = append(errs, validate.NotNegative("CacheStaleIfErrorMaxAge", c.CacheStaleIfErrorMaxAge))
+	errs = append(errs, validate.NotNegative("CacheStaleIfErrorAnswerTTL", c.CacheStaleIfErrorAnswerTTL))
+
+	switch c.CacheEvictionPolicy {
+	case
+		"",
+		CacheEvictionPolicyLRU,
+		CacheEvictionPolicyLFU,
+		CacheEvictionPolicyARC:
+		// Go on.
+	default:
+		errs = append(errs, fmt.Errorf(
+			"CacheEvictionPolicy: %w: %q",
+			errors.ErrBadEnumValue,
+			c.CacheEvictionPolicy,
+		))
+	}
+
+	if c.CacheMinTTL > 0 && c.CacheMaxTTL > 0 {
+		errs = append(errs, validate.NoGreaterThan("CacheMinTTL", c.CacheMinTTL, c.CacheMaxTTL))
+	}
+
+	if !c.CacheOptimistic || c.CacheProactiveRefreshTime < 0 {
+		return errs
+	}
+
+	if c.CacheProactiveCooldownThreshold > 0 && c.CacheProactiveCooldownPeriod < 0 {
+		errs = append(errs, fmt.Errorf(
+			"CacheProactiveCooldownPeriod: %w: must not be negative with "+
+				"CacheProactiveCooldownThreshold set, got %d",
+			errors.ErrOutOfRange,
+			c.CacheProactiveCooldownPeriod,
+		))
+	}
+
+	return errs
+}
+
+// validateRatelimit returns the errors of the ratelimit configuration.
+func (c *Config) validateRatelimit() (errs []error) {
+	if c.Ratelimit == 0 {
+		return nil
+	}
+
+	errs = append(
+		errs,
+		validate.InRange("RatelimitSubnetLenIPv4", c.RatelimitSubnetLenIPv4, 0, netutil.IPv4BitLen),
+		validate.InRange("RatelimitSubnetLenIPv6", c.RatelimitSubnetLenIPv6, 0, netutil.IPv6BitLen),
+	)
+
+	switch c.RatelimitPolicy {
+	case
+		"",
+		RatelimitPolicyDrop,
+		RatelimitPolicyServFail:
+		// Go on.
+	default:
+		errs = append(errs, fmt.Errorf(
+			"RatelimitPolicy: %w: %q",
+			errors.ErrBadEnumValue,
+			c.RatelimitPolicy,
+		))
+	}
+
+	return errs
+}
+
+// Warnings returns the problems of the valid c, which don't prevent the proxy
+// from working, but most probably make it behave not as intended, e.g. the
+// fields ignored due to the values of the other ones.  Each warning is prefixed
+// with the name of the field.  c must not be nil.
+func (c *Config) Warnings() (warns []error) {
+	warns = c.cacheWarnings()
+
+	if c.Ratelimit == 0 && (len(c.RatelimitWhitelist) > 0 || len(c.RatelimitWhitelistSubnets) > 0) {
+		warns = append(warns, fmt.Errorf("RatelimitWhitelist: %w without Ratelimit", errNoEffect))
+	}
+
+	if c.UpstreamMode != UpstreamModeFastestAddr && (len(c.FastestPingPorts) > 0 || c.FastestPingICMP) {
+		warns = append(warns, fmt.Errorf(
+			"fastest address settings: %w without UpstreamModeFastestAddr",
+			errNoEffect,
+		))
+	}
+
+	if c.UpstreamMode == UpstreamModeParallel && c.UpstreamRetry != nil {
+		warns = append(warns, fmt.Errorf("UpstreamRetry: %w with UpstreamModeParallel", errNoEffect))
+	}
+
+	if c.UpstreamMode != UpstreamModeRace && len(c.RaceQueryTypes) > 0 {
+		warns = append(warns, fmt.Errorf("RaceQueryTypes: %w without UpstreamModeRace", errNoEffect))
+	}
+
+	if c.RefuseAny && c.ANYQuery != nil {
+		warns = append(warns, fmt.Errorf("ANYQuery: %w with RefuseAny", errNoEffect))
+	}
+
+	if c.RefuseAny && c.Truncation != nil && c.Truncation.TruncateANY {
+		warns = append(warns, fmt.Errorf("Truncation.TruncateANY: %w with RefuseAny", errNoEffect))
+	}
+
+	if rp := c.RebindProtection; rp != nil && !rp.Enabled && len(rp.AllowedDomains) > 0 {
+		warns = append(warns, fmt.Errorf(
+			"RebindProtection.AllowedDomains: %w without RebindProtection.Enabled",
+			errNoEffect,
+		))
+	}
+
+	return warns
+}
+
+// cacheWarnings returns the warnings about the cache configuration.
+func (c *Config) cacheWarnings() (warns []error) {
+	if !c.CacheEnabled {
+		if c.CacheOptimistic ||
+			c.CacheFilePath != "" ||
+			c.CachePrefetchDualStack ||
+			c.CachePerClient ||
+			c.CacheOutage != nil ||
+			c.MemoryPressure != nil ||
+			c.CacheStaleIfErrorMaxAge > 0 ||
+			c.CacheAdmissionHandler != nil {
+			warns = append(warns, fmt.Errorf("cache settings: %w without CacheEnabled", errNoEffect))
+		}
+
+		return warns
+	}
+
+	if c.CacheFilePath == "" && c.CacheFileFlushInterval > 0 {
+		warns = append(warns, fmt.Errorf("CacheFileFlushInterval: %w without CacheFilePath", errNoEffect))
+	}
+
+	compactIvl := cmp.Or(c.CacheFileCompactionInterval, defaultCacheFileCompactionInterval)
+	if c.CacheFileFlushInterval > compactIvl {
+		warns = append(warns, fmt.Errorf(
+			"CacheFileFlushInterval: %s is greater than compaction interval %s",
+			c.CacheFileFlushInterval,
+			compactIvl,
+		))
+	}
+
+	if c.CacheFileRevalidate && (c.CacheFilePath == "" || !c.CacheOptimistic) {
+		warns = append(warns, fmt.Errorf(
+			"CacheFileRevalidate: %w without CacheFilePath and CacheOptimistic",
+			errNoEffect,
+		))
+	}
+
+	if !c.CacheOptimistic {
+		if c.CacheProactiveRefreshTime > 0 ||
+			len(c.CacheProactivePinnedZones) > 0 ||
+			c.CacheProactiveWarmupPeriod > 0 ||
+			c.CacheProactiveRefreshGuard ||
+			c.OnCacheRefresh != nil {
+			warns = append(warns, fmt.Errorf(
+				"proactive refresh settings: %w without CacheOptimistic",
+				errNoEffect,
+			))
+		}
+
+		return warns
+	}
+
+	// The entries with TTL not exceeding the refresh time are never refreshed,
+	// see [cache.scheduleRefresh].
+	refreshTime := cmp.Or(c.CacheProactiveRefreshTime, defaultProactiveRefreshTimeMs)
+	if c.CacheMinTTL > 0 && refreshTime > 0 && refreshTime >= int(c.CacheMinTTL)*1000 {
+		warns = append(warns, fmt.Errorf(
+			"CacheProactiveRefreshTime: %dms is not less than CacheMinTTL of %ds",
+			refreshTime,
+			c.CacheMinTTL,
+		))
+	}
+
+	if c.CacheProactiveAdaptive && c.CacheProactiveCooldownThreshold < 0 {
+		warns = append(warns, fmt.Errorf(
+			"CacheProactiveAdaptive: %w with the cooldown disabled",
+			errNoEffect,
+		))
+	}
+
+	return warns
+}
+
+// privateSubnets returns the configured private subnets or the default ones.
+func (c *Config) privateSubnets() (s netutil.SubnetSet) {
+	return cmp.Or[netutil.SubnetSet](
+		c.PrivateSubnets,
+		netutil.SubnetSetFunc(netutil.IsLocallyServed),
+	)
+}
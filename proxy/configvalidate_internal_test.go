@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newValidTestConfig returns a new minimal valid *Config.
+func newValidTestConfig() (c *Config) {
+	ups := &testUpstream{}
+
+	return &Config{
+		UpstreamConfig:            &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		PrivateRDNSUpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		modify     func(c *Config)
+		wantErr    error
+		name       string
+		wantErrMsg string
+	}{{
+		modify:     func(_ *Config) {},
+		wantErr:    nil,
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		modify: func(c *Config) {
+			c.UpstreamConfig = nil
+		},
+		wantErr:    errors.ErrNoValue,
+		name:       "no_upstreams",
+		wantErrMsg: "UpstreamConfig: no value",
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheMinTTL = 600
+			c.CacheMaxTTL = 60
+		},
+		wantErr:    errors.ErrOutOfRange,
+		name:       "min_ttl_greater",
+		wantErrMsg: "CacheMinTTL: out of range: must be no greater than 60, got 600",
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheEvictionPolicy = "fifo"
+		},
+		wantErr:    errors.ErrBadEnumValue,
+		name:       "bad_eviction_policy",
+		wantErrMsg: "CacheEvictionPolicy: bad enum value: \"fifo\"",
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheOptimistic = true
+			c.CacheProactiveCooldownThreshold = 3
+			c.CacheProactiveCooldownPeriod = -1
+		},
+		wantErr: errors.ErrOutOfRange,
+		name:    "threshold_without_period",
+		wantErrMsg: "CacheProactiveCooldownPeriod: out of range: must not be negative " +
+			"with CacheProactiveCooldownThreshold set, got -1",
+	}, {
+		modify: func(c *Config) {
+			c.Ratelimit = 10
+			c.RatelimitSubnetLenIPv4 = 33
+			c.RatelimitPolicy = "block"
+		},
+		wantErr: errors.ErrBadEnumValue,
+		name:    "several",
+		wantErrMsg: "RatelimitSubnetLenIPv4: out of range: must be no greater than 32, got 33\n" +
+			"RatelimitPolicy: bad enum value: \"block\"",
+	}, {
+		modify: func(c *Config) {
+			c.ClientStats = &ClientStatisticsConfig{
+				SubnetLenIPv4: 24,
+				SubnetLenIPv6: 129,
+			}
+		},
+		wantErr:    errors.ErrOutOfRange,
+		name:       "client_stats_subnet_len",
+		wantErrMsg: "ClientStats: SubnetLenIPv6: out of range: must be no greater than 128, got 129",
+	}, {
+		modify: func(c *Config) {
+			c.Mirror = &MirrorConfig{
+				Sink: MirrorSinkFunc(func(_ *MirroredQuery) (err error) { return nil }),
+				Rate: 1.5,
+			}
+		},
+		wantErr:    errors.ErrOutOfRange,
+		name:       "mirror_rate",
+		wantErrMsg: "Mirror: Rate: out of range: must be no greater than 1, got 1.5",
+	}, {
+		modify: func(c *Config) {
+			c.AnomalyCapture = &AnomalyCaptureConfig{
+				FilePath:    "anomalies.pcap",
+				MaxFileSize: 1024,
+			}
+		},
+		wantErr:    errors.ErrOutOfRange,
+		name:       "anomaly_capture_max_file_size",
+		wantErrMsg: "AnomalyCapture: MaxFileSize: out of range: must be no less than 131072, got 1024",
+	}, {
+		modify: func(c *Config) {
+			c.FastestPingPorts = []uint{443, 0}
+		},
+		wantErr:    errors.ErrOutOfRange,
+		name:       "fastest_ping_port",
+		wantErrMsg: "FastestPingPorts[1]: out of range: must be no less than 1, got 0",
+	}, {
+		modify: func(c *Config) {
+			c.CacheOutage = &CacheOutageConfig{TTLMultiplier: 0.5}
+		},
+		wantErr:    errors.ErrOutOfRange,
+		name:       "cache_outage_multiplier",
+		wantErrMsg: "CacheOutage: TTLMultiplier: out of range: must be no less than 1, got 0.5",
+	}, {
+		modify: func(c *Config) {
+			c.UpstreamRetry = &UpstreamRetryConfig{
+				Rcodes:     []int{dns.RcodeServerFailure, 4096},
+				TryTimeout: -time.Second,
+			}
+		},
+		wantErr: errors.ErrBadEnumValue,
+		name:    "upstream_retry",
+		wantErrMsg: "UpstreamRetry: TryTimeout: negative value: -1s\n" +
+			"Rcodes: at index 1: bad enum value: 4096",
+	}, {
+		modify: func(c *Config) {
+			c.UpstreamTimeouts = &UpstreamTimeoutConfig{
+				Upstreams: map[string]time.Duration{"1.1.1.1:53": -time.Second},
+				QTypes:    map[uint16]time.Duration{dns.TypeDNSKEY: time.Second, 0xff00: time.Second},
+			}
+		},
+		wantErr: errors.ErrBadEnumValue,
+		name:    "upstream_timeouts",
+		wantErrMsg: "UpstreamTimeouts: Upstreams[\"1.1.1.1:53\"]: negative value: -1s\n" +
+			"QTypes: bad enum value: 65280",
+	}, {
+		modify: func(c *Config) {
+			c.DomainPolicies = []*DomainPolicy{{
+				Patterns: []string{"example.org"},
+			}, {
+				Action:      "drop",
+				Patterns:    []string{"*."},
+				CacheMinTTL: 600,
+				CacheMaxTTL: 60,
+			}}
+		},
+		wantErr: errors.ErrBadEnumValue,
+		name:    "domain_policies",
+		wantErrMsg: "DomainPolicies: at index 1: Patterns: at index 0: empty value\n" +
+			"CacheMaxTTL: out of range: must be no less than 600, got 60\n" +
+			"Action: bad enum value: \"drop\"",
+	}, {
+		modify: func(c *Config) {
+			c.PrivateRDNS = &PrivateRDNSConfig{
+				Hosts: map[netip.Addr]string{
+					netip.MustParseAddr("8.8.8.8"):     "dns.example",
+					netip.MustParseAddr("192.168.1.1"): "-bad",
+				},
+			}
+		},
+		wantErr: errNotPrivate,
+		name:    "private_rdns",
+		wantErrMsg: "PrivateRDNS: Hosts: address 8.8.8.8: not private\n" +
+			`Hosts: address 192.168.1.1: bad hostname "-bad": ` +
+			`bad top-level domain name label "-bad": bad top-level domain name label rune '-'`,
+	}, {
+		modify: func(c *Config) {
+			c.Userinfo = url.User("user")
+		},
+		wantErr:    errors.ErrNoValue,
+		name:       "userinfo_without_https",
+		wantErrMsg: "HTTPSListenAddr: no value",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newValidTestConfig()
+			tc.modify(c)
+
+			err := c.Validate()
+			if tc.wantErrMsg == "" {
+				require.NoError(t, err)
+
+				return
+			}
+
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.EqualError(t, err, tc.wantErrMsg)
+		})
+	}
+}
+
+func TestConfig_Warnings(t *testing.T) {
+	testCases := []struct {
+		modify   func(c *Config)
+		name     string
+		wantMsgs []string
+	}{{
+		modify:   func(_ *Config) {},
+		name:     "none",
+		wantMsgs: nil,
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheOptimistic = true
+			c.CacheMinTTL = 10
+			c.CacheProactiveRefreshTime = 20_000
+		},
+		name: "refresh_time_greater",
+		wantMsgs: []string{
+			"CacheProactiveRefreshTime: 20000ms is not less than CacheMinTTL of 10s",
+		},
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheOptimistic = true
+			c.CacheMinTTL = 10
+		},
+		name: "default_refresh_time",
+		wantMsgs: []string{
+			"CacheProactiveRefreshTime: 30000ms is not less than CacheMinTTL of 10s",
+		},
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheProactiveRefreshTime = 1000
+			c.CacheFileFlushInterval = time.Second
+		},
+		name: "cache",
+		wantMsgs: []string{
+			"CacheFileFlushInterval: has no effect without CacheFilePath",
+			"proactive refresh settings: has no effect without CacheOptimistic",
+		},
+	}, {
+		modify: func(c *Config) {
+			c.CacheEnabled = true
+			c.CacheFilePath = "cache.bin"
+			c.CacheFileRevalidate = true
+		},
+		name: "revalidate_without_optimistic",
+		wantMsgs: []string{
+			"CacheFileRevalidate: has no effect without CacheFilePath and CacheOptimistic",
+		},
+	}, {
+		modify: func(c *Config) {
+			c.RatelimitWhitelist = []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+			c.FastestPingICMP = true
+			c.UpstreamMode = UpstreamModeParallel
+			c.UpstreamRetry = &UpstreamRetryConfig{MaxRetries: 1}
+			c.RaceQueryTypes = []uint16{dns.TypeA}
+			c.RefuseAny = true
+			c.ANYQuery = &ANYQueryConfig{}
+			c.Truncation = &TruncationConfig{TruncateANY: true}
+			c.RebindProtection = &RebindProtectionConfig{
+				AllowedDomains: []string{"corp.example"},
+			}
+		},
+		name: "ignored",
+		wantMsgs: []string{
+			"RatelimitWhitelist: has no effect without Ratelimit",
+			"fastest address settings: has no effect without UpstreamModeFastestAddr",
+			"UpstreamRetry: has no effect with UpstreamModeParallel",
+			"RaceQueryTypes: has no effect without UpstreamModeRace",
+			"ANYQuery: has no effect with RefuseAny",
+			"Truncation.TruncateANY: has no effect with RefuseAny",
+			"RebindProtection.AllowedDomains: has no effect without RebindProtection.Enabled",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newValidTestConfig()
+			tc.modify(c)
+			require.NoError(t, c.Validate())
+
+			var msgs []string
+			for _, w := range c.Warnings() {
+				msgs = append(msgs, w.Error())
+			}
+
+			assert.Equal(t, tc.wantMsgs, msgs)
+		})
+	}
+}
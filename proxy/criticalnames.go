@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// CriticalName is a domain name, the upstream answers for which are checked
+// against the expected constraints to detect hijacking.
+type CriticalName struct {
+	// Domain is the domain name to check the answers for.  Only the name itself
+	// matches, case-insensitively.  It must be a valid domain name.
+	Domain string
+
+	// AllowedSubnets are the subnets the addresses from the A and AAAA records
+	// of the answers must belong to.  If empty, the addresses aren't checked.
+	AllowedSubnets []netip.Prefix
+
+	// RequireDNSSEC makes the NOERROR and NXDOMAIN answers, as well as the
+	// bogus ones, required to be validated with DNSSEC.  The requests with the
+	// CD bit set aren't checked.  It requires [Config.EnableDNSSECValidation].
+	RequireDNSSEC bool
+}
+
+// CriticalNamesConfig is the configuration of checking the upstream answers
+// for the critical domain names, including the ones for the proactive cache
+// refreshes.  The violations are logged, counted, see
+// [Proxy.CriticalNameStatistics], and captured, if [Config.AnomalyCapture] is
+// set.
+type CriticalNamesConfig struct {
+	// OnViolation, if not nil, is called with each violation.  It must be safe
+	// for concurrent use.
+	OnViolation func(ctx context.Context, v *CriticalNameViolation)
+
+	// Names are the critical domain names with their constraints.  The
+	// domains must be unique.
+	Names []*CriticalName
+
+	// Block makes the answers violating the constraints replaced with SERVFAIL
+	// responses with the Forged Answer extended DNS error.
+	Block bool
+}
+
+// validate returns an error if c is invalid.  dnssec tells if the DNSSEC
+// validation is enabled.  c may be nil.
+func (c *CriticalNamesConfig) validate(dnssec bool) (err error) {
+	if c == nil {
+		return nil
+	}
+
+	var errs []error
+	domains := make([]string, 0, len(c.Names))
+	for i, n := range c.Names {
+		if n == nil {
+			errs = append(errs, fmt.Errorf("Names: at index %d: %w", i, errors.ErrNoValue))
+
+			continue
+		}
+
+		domain := normalizeCriticalName(n.Domain)
+		if slices.Contains(domains, domain) {
+			errs = append(errs, fmt.Errorf("Names: at index %d: %w: %q", i, errors.ErrDuplicated, n.Domain))
+		}
+
+		domains = append(domains, domain)
+
+		err = n.validate(dnssec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Names: at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate returns an error if n is invalid.  dnssec tells if the DNSSEC
+// validation is enabled.  n must not be nil.
+func (n *CriticalName) validate(dnssec bool) (err error) {
+	var errs []error
+
+	err = netutil.ValidateDomainName(strings.TrimSuffix(n.Domain, "."))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Domain: %w", err))
+	}
+
+	for i, pref := range n.AllowedSubnets {
+		if !pref.IsValid() {
+			errs = append(errs, fmt.Errorf("AllowedSubnets: at index %d: %w", i, errors.ErrNoValue))
+		}
+	}
+
+	if n.RequireDNSSEC && !dnssec {
+		errs = append(errs, errors.Error("RequireDNSSEC: requires EnableDNSSECValidation"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// CriticalNameViolation describes an upstream answer for a critical domain
+// name violating its constraints.
+type CriticalNameViolation struct {
+	// Domain is the critical domain name as configured.
+	Domain string
+
+	// Upstream is the address of the upstream which has sent the answer.
+	Upstream string
+
+	// Addresses are the addresses from the answer outside of
+	// [CriticalName.AllowedSubnets], if any.
+	Addresses []netip.Addr
+
+	// Qtype is the type of the question.
+	Qtype uint16
+
+	// Unvalidated is true if the answer hasn't been validated with DNSSEC
+	// while [CriticalName.RequireDNSSEC] is set.
+	Unvalidated bool
+
+	// Refresh is true if the answer has been received for a proactive cache
+	// refresh.
+	Refresh bool
+
+	// Blocked is true if the answer has been replaced, see
+	// [CriticalNamesConfig.Block].
+	Blocked bool
+}
+
+// CriticalNameStatistics contains the numbers of the upstream answers for a
+// critical domain name violating its constraints.
+type CriticalNameStatistics struct {
+	// Domain is the critical domain name as configured.
+	Domain string
+
+	// Violations is the number of the answers violating the constraints.
+	Violations uint64
+
+	// Blocked is the number of the violating answers replaced.
+	Blocked uint64
+}
+
+// criticalNames checks the answers for the critical domain names.  A nil
+// *criticalNames is valid and checks nothing.
+type criticalNames struct {
+	// onViolation is called with each violation, if not nil.
+	onViolation func(ctx context.Context, v *CriticalNameViolation)
+
+	// byName are the critical domain names in a lower-case FQDN form mapped to
+	// their constraints.
+	byName map[string]*criticalName
+
+	// names are the constraints in the order of configuration.
+	names []*criticalName
+
+	// block makes the violating answers replaced.
+	block bool
+}
+
+// criticalName is the constraints of a critical domain name with the
+// violation counters.
+type criticalName struct {
+	// domain is the domain name as configured.
+	domain string
+
+	// allowed are the subnets the addresses of the answers must belong to.
+	allowed netutil.SliceSubnetSet
+
+	// violations is the number of the answers violating the constraints.
+	violations atomic.Uint64
+
+	// blocked is the number of the violating answers replaced.
+	blocked atomic.Uint64
+
+	// requireDNSSEC makes the answers required to be validated with DNSSEC.
+	requireDNSSEC bool
+}
+
+// newCriticalNames returns the checker of the answers in accordance with c.  It
+// returns nil if c is nil or has no names.  c must be valid.
+func newCriticalNames(c *CriticalNamesConfig) (cn *criticalNames) {
+	if c == nil || len(c.Names) == 0 {
+		return nil
+	}
+
+	cn = &criticalNames{
+		onViolation: c.OnViolation,
+		byName:      make(map[string]*criticalName, len(c.Names)),
+		names:       make([]*criticalName, 0, len(c.Names)),
+		block:       c.Block,
+	}
+
+	for _, n := range c.Names {
+		name := &criticalName{
+			domain:        n.Domain,
+			allowed:       slices.Clone(n.AllowedSubnets),
+			requireDNSSEC: n.RequireDNSSEC,
+		}
+
+		cn.byName[normalizeCriticalName(n.Domain)] = name
+		cn.names = append(cn.names, name)
+	}
+
+	return cn
+}
+
+// normalizeCriticalName returns domain in a lower-case FQDN form.
+func normalizeCriticalName(domain string) (norm string) {
+	return dns.Fqdn(strings.ToLower(domain))
+}
+
+// violation returns the violation of the constraints by the upstream response
+// orig for the request from d, or nil if there is none.  resp is orig after the
+// DNSSEC validation, if any.  d.Req must have a question and both orig and resp
+// must not be nil.
+func (n *criticalName) violation(d *DNSContext, orig, resp *dns.Msg) (v *CriticalNameViolation) {
+	var addrs []netip.Addr
+	if len(n.allowed) > 0 {
+		for _, rr := range orig.Answer {
+			ip := proxyutil.IPFromRR(rr).Unmap()
+			if ip.IsValid() && !n.allowed.Contains(ip) {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+
+	unvalidated := false
+	if n.requireDNSSEC && !d.Req.CheckingDisabled && !resp.AuthenticatedData {
+		switch orig.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			unvalidated = true
+		default:
+			// The bogus responses are replaced.
+			unvalidated = resp != orig
+		}
+	}
+
+	if len(addrs) == 0 && !unvalidated {
+		return nil
+	}
+
+	return &CriticalNameViolation{
+		Domain:      n.domain,
+		Addresses:   addrs,
+		Qtype:       d.Req.Question[0].Qtype,
+		Unvalidated: unvalidated,
+		Refresh:     d.isRefresh,
+	}
+}
+
+// checkCriticalName checks the response orig received from u for the request
+// from d against the constraints of the critical domain name, if the request is
+// for one, and returns the response to use instead of resp.  resp is orig after
+// the DNSSEC validation, if any.  Both orig and resp must not be nil.
+func (p *Proxy) checkCriticalName(
+	ctx context.Context,
+	d *DNSContext,
+	u upstream.Upstream,
+	orig *dns.Msg,
+	resp *dns.Msg,
+) (checked *dns.Msg) {
+	cn := p.criticalNames
+	if cn == nil || len(d.Req.Question) == 0 {
+		return resp
+	}
+
+	n := cn.byName[normalizeCriticalName(d.Req.Question[0].Name)]
+	if n == nil {
+		return resp
+	}
+
+	v := n.violation(d, orig, resp)
+	if v == nil {
+		return resp
+	}
+
+	if u != nil {
+		v.Upstream = u.Address()
+	}
+
+	v.Blocked = cn.block
+
+	n.violations.Add(1)
+	p.anomalies.captureResponse(anomalyCriticalName, u, orig)
+
+	p.logger.WarnContext(
+		ctx,
+		"critical name answer violates constraints",
+		"domain", v.Domain,
+		"qtype", dns.Type(v.Qtype),
+		"upstream", v.Upstream,
+		"addrs", v.Addresses,
+		"unvalidated", v.Unvalidated,
+		"refresh", v.Refresh,
+		"blocked", v.Blocked,
+	)
+
+	if cn.onViolation != nil {
+		cn.onViolation(ctx, v)
+	}
+
+	if !v.Blocked {
+		d.addTrace(StageResponse, "critical name violation")
+
+		return resp
+	}
+
+	n.blocked.Add(1)
+	d.addTrace(StageResponse, "critical name blocked")
+	if resp == orig {
+		// Keep the error of the DNSSEC validation, if any.
+		d.ede = &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeForgedAnswer,
+			ExtraText: "answer violates critical name constraints",
+		}
+	}
+
+	return p.messages.NewMsgSERVFAIL(d.Req)
+}
+
+// CriticalNameStatistics returns the numbers of the upstream answers violating
+// the constraints of each of the critical domain names, in the order of
+// [CriticalNamesConfig.Names], since p has been created.
+func (p *Proxy) CriticalNameStatistics() (stats []*CriticalNameStatistics) {
+	if p.criticalNames == nil {
+		return nil
+	}
+
+	stats = make([]*CriticalNameStatistics, 0, len(p.criticalNames.names))
+	for _, n := range p.criticalNames.names {
+		stats = append(stats, &CriticalNameStatistics{
+			Domain:     n.domain,
+			Violations: n.violations.Load(),
+			Blocked:    n.blocked.Load(),
+		})
+	}
+
+	return stats
+}
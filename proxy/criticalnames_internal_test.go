@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ReplyFromUpstream_criticalNames(t *testing.T) {
+	t.Parallel()
+
+	const upsAddr = "upstream"
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+
+			ip := net.IP{192, 0, 2, 1}
+			if strings.EqualFold(q.Name, "forged.example.") {
+				ip = net.IP{203, 0, 113, 1}
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, q.Name, dns.TypeA, defaultTestTTL, ip)}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return upsAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	allowed := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	newProxy := func(t *testing.T, block bool) (p *Proxy, violations *[]*CriticalNameViolation) {
+		t.Helper()
+
+		mu := &sync.Mutex{}
+		violations = &[]*CriticalNameViolation{}
+
+		p = mustNew(t, &Config{
+			Logger:                 slogutil.NewDiscardLogger(),
+			UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			CriticalNames: &CriticalNamesConfig{
+				OnViolation: func(_ context.Context, v *CriticalNameViolation) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					*violations = append(*violations, v)
+				},
+				Names: []*CriticalName{{
+					Domain:         "Good.Example",
+					AllowedSubnets: allowed,
+				}, {
+					Domain:         "forged.example",
+					AllowedSubnets: allowed,
+				}},
+				Block: block,
+			},
+		})
+
+		return p, violations
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		block     bool
+		refresh   bool
+		wantRcode int
+		wantEDE   bool
+		wantViol  bool
+	}{{
+		name:      "not_critical",
+		host:      "other.example.",
+		block:     true,
+		wantRcode: dns.RcodeSuccess,
+		wantEDE:   false,
+		wantViol:  false,
+	}, {
+		name:      "allowed",
+		host:      "good.example.",
+		block:     true,
+		wantRcode: dns.RcodeSuccess,
+		wantEDE:   false,
+		wantViol:  false,
+	}, {
+		name:      "forged_reported",
+		host:      "forged.example.",
+		block:     false,
+		wantRcode: dns.RcodeSuccess,
+		wantEDE:   false,
+		wantViol:  true,
+	}, {
+		name:      "forged_blocked",
+		host:      "forged.example.",
+		block:     true,
+		wantRcode: dns.RcodeServerFailure,
+		wantEDE:   true,
+		wantViol:  true,
+	}, {
+		name:      "forged_refresh",
+		host:      "FORGED.example.",
+		block:     true,
+		refresh:   true,
+		wantRcode: dns.RcodeServerFailure,
+		wantEDE:   true,
+		wantViol:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, violations := newProxy(t, tc.block)
+
+			d := &DNSContext{
+				Req:       (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+				isRefresh: tc.refresh,
+			}
+
+			_, err := p.replyFromUpstream(context.Background(), d)
+			require.NoError(t, err)
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			if tc.wantEDE {
+				require.NotNil(t, d.ede)
+				assert.Equal(t, dns.ExtendedErrorCodeForgedAnswer, d.ede.InfoCode)
+			} else {
+				assert.Nil(t, d.ede)
+			}
+
+			stats := p.CriticalNameStatistics()
+			require.Len(t, stats, 2)
+
+			if !tc.wantViol {
+				assert.Empty(t, *violations)
+				assert.Zero(t, stats[1].Violations)
+
+				return
+			}
+
+			require.Len(t, *violations, 1)
+			assert.Equal(t, &CriticalNameViolation{
+				Domain:    "forged.example",
+				Upstream:  upsAddr,
+				Addresses: []netip.Addr{netip.MustParseAddr("203.0.113.1")},
+				Qtype:     dns.TypeA,
+				Refresh:   tc.refresh,
+				Blocked:   tc.block,
+			}, (*violations)[0])
+
+			wantBlocked := uint64(0)
+			if tc.block {
+				wantBlocked = 1
+			}
+
+			assert.Equal(t, &CriticalNameStatistics{
+				Domain:     "forged.example",
+				Violations: 1,
+				Blocked:    wantBlocked,
+			}, stats[1])
+		})
+	}
+}
+
+func TestCriticalName_violation_dnssec(t *testing.T) {
+	t.Parallel()
+
+	n := &criticalName{
+		domain:        "secure.example",
+		requireDNSSEC: true,
+	}
+
+	newResp := func(req *dns.Msg, rcode int, ad bool) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode(req, rcode)
+		resp.AuthenticatedData = ad
+
+		return resp
+	}
+
+	testCases := []struct {
+		name     string
+		rcode    int
+		ad       bool
+		cd       bool
+		bogus    bool
+		wantViol bool
+	}{{
+		name:     "validated",
+		rcode:    dns.RcodeSuccess,
+		ad:       true,
+		wantViol: false,
+	}, {
+		name:     "unvalidated",
+		rcode:    dns.RcodeSuccess,
+		wantViol: true,
+	}, {
+		name:     "unvalidated_nxdomain",
+		rcode:    dns.RcodeNameError,
+		wantViol: true,
+	}, {
+		name:     "checking_disabled",
+		rcode:    dns.RcodeSuccess,
+		cd:       true,
+		wantViol: false,
+	}, {
+		name:     "servfail",
+		rcode:    dns.RcodeServerFailure,
+		wantViol: false,
+	}, {
+		name:     "bogus",
+		rcode:    dns.RcodeServerFailure,
+		bogus:    true,
+		wantViol: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := (&dns.Msg{}).SetQuestion("secure.example.", dns.TypeA)
+			req.CheckingDisabled = tc.cd
+
+			orig := newResp(req, tc.rcode, tc.ad)
+			resp := orig
+			if tc.bogus {
+				resp = newResp(req, dns.RcodeServerFailure, false)
+			}
+
+			v := n.violation(&DNSContext{Req: req}, orig, resp)
+			if !tc.wantViol {
+				assert.Nil(t, v)
+
+				return
+			}
+
+			require.NotNil(t, v)
+
+			assert.True(t, v.Unvalidated)
+			assert.Empty(t, v.Addresses)
+		})
+	}
+}
+
+func TestCriticalNamesConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		conf       *CriticalNamesConfig
+		name       string
+		wantErrMsg string
+		dnssec     bool
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf: &CriticalNamesConfig{
+			Names: []*CriticalName{{
+				Domain:        "bank.example.",
+				RequireDNSSEC: true,
+			}},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+		dnssec:     true,
+	}, {
+		conf: &CriticalNamesConfig{
+			Names: []*CriticalName{nil},
+		},
+		name:       "nil_name",
+		wantErrMsg: "Names: at index 0: no value",
+	}, {
+		conf: &CriticalNamesConfig{
+			Names: []*CriticalName{{
+				Domain: "bank.example",
+			}, {
+				Domain: "BANK.example.",
+			}},
+		},
+		name:       "duplicated",
+		wantErrMsg: `Names: at index 1: duplicated value: "BANK.example."`,
+	}, {
+		conf: &CriticalNamesConfig{
+			Names: []*CriticalName{{
+				Domain:         "bank.example",
+				AllowedSubnets: []netip.Prefix{{}},
+				RequireDNSSEC:  true,
+			}},
+		},
+		name: "bad_name",
+		wantErrMsg: "Names: at index 0: AllowedSubnets: at index 0: no value\n" +
+			"RequireDNSSEC: requires EnableDNSSECValidation",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate(tc.dnssec))
+		})
+	}
+}
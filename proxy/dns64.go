@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/netip"
@@ -281,8 +282,10 @@ func (p *Proxy) synthRR(rr dns.RR, soaTTL uint32) (result dns.RR) {
 }
 
 // performDNS64 returns the upstream that was used to perform DNS64 request, or
-// nil, if the request was not performed.
+// nil, if the request was not performed.  The response to the DNS64 request is
+// validated with DNSSEC, if enabled, and the bogus ones aren't used.
 func (p *Proxy) performDNS64(
+	ctx context.Context,
 	origReq *dns.Msg,
 	origResp *dns.Msg,
 	upstreams []upstream.Upstream,
@@ -299,16 +302,36 @@ func (p *Proxy) performDNS64(
 	host := origReq.Question[0].Name
 	p.logger.Debug("received an empty aaaa response, checking dns64", "host", host)
 
-	dns64Resp, u, err := p.exchangeUpstreams(dns64Req, upstreams)
+	dns64Resp, u, err := p.exchangeUpstreams(ctx, dns64Req, upstreams)
 	if err != nil {
 		p.logger.Error("dns64 request failed", slogutil.KeyError, err)
 
 		return nil
 	}
 
-	if dns64Resp != nil && p.synthDNS64(origReq, origResp, dns64Resp) {
+	if dns64Resp == nil {
+		return nil
+	}
+
+	st := dnssecInsecure
+	if p.dnssec != nil && !origReq.CheckingDisabled {
+		st, err = p.dnssec.validate(ctx, dns64Resp)
+		if st == dnssecBogus {
+			p.logger.Debug("dns64 dnssec validation failed", slogutil.KeyError, err)
+
+			return nil
+		}
+	}
+
+	if p.synthDNS64(origReq, origResp, dns64Resp) {
 		p.logger.Debug("synthesized aaaa response", "host", host)
 
+		if p.dnssec != nil {
+			// The synthesized records are only as secure as the A records
+			// they're made of.
+			origResp.AuthenticatedData = origResp.AuthenticatedData && st == dnssecSecure
+		}
+
 		return u
 	}
 
@@ -56,6 +56,17 @@ type DNSContext struct {
 	// Res is the response message.
 	Res *dns.Msg
 
+	// ede is the extended DNS error to add to the response, if any.
+	ede *dns.EDNS0_EDE
+
+	// trace accumulates the decisions made for the request.  It's nil unless
+	// the request is made by [Proxy.Trace], in which case the response isn't
+	// sent anywhere.
+	trace *requestTrace
+
+	// source is the source of the response to annotate it with, if any.
+	source ResponseSource
+
 	// Proto is the DNS protocol of the query.
 	Proto Proto
 
@@ -96,6 +107,17 @@ type DNSContext struct {
 
 	// doBit is the DNSSEC OK flag from request's EDNS0 RR if presented.
 	doBit bool
+
+	// clientCache is the cache of the client policy of the request, see
+	// [Config.CachePerClient].  It's nil if the response is cached for all the
+	// clients.
+	clientCache *cache
+
+	// isRefresh is true if the request is made by the proactive cache refresh.
+	isRefresh bool
+
+	// cacheHit is true if the response has been taken from cache.
+	cacheHit bool
 }
 
 // newDNSContext returns a new properly initialized *DNSContext.
@@ -157,8 +179,8 @@ func (dctx *DNSContext) calcFlagsAndSize() {
 	}
 }
 
-// scrub prepares the d.Res to be written.  Truncation is applied as well if
-// necessary.
+// scrub prepares the d.Res to be written.  The truncation and compression are
+// applied separately, see [Proxy.truncate].
 func (dctx *DNSContext) scrub() {
 	if dctx.Res == nil || dctx.Req == nil {
 		return
@@ -171,13 +193,23 @@ func (dctx *DNSContext) scrub() {
 	// mustn't contain an EDNS0 RR if the request doesn't include it.
 	//
 	// See https://github.com/AdguardTeam/dnsproxy/issues/132.
-	if dctx.hasEDNS0 && dctx.Res.IsEdns0() == nil {
+	if !dctx.hasEDNS0 {
+		return
+	}
+
+	o := dctx.Res.IsEdns0()
+	if o == nil {
 		dctx.Res.SetEdns0(dctx.udpSize, dctx.doBit)
+		o = dctx.Res.IsEdns0()
 	}
 
-	dctx.Res.Truncate(int(dnsSize(dctx.Proto == ProtoUDP, dctx.Req)))
-	// Some devices require DNS message compression.
-	dctx.Res.Compress = true
+	if dctx.ede != nil {
+		o.Option = append(o.Option, dctx.ede)
+	}
+
+	if dctx.source != "" {
+		o.Option = append(o.Option, newSourceOption(dctx.source))
+	}
 }
 
 // dnsSize returns the buffer size advertised in the requests OPT record.  When
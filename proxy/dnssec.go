@@ -0,0 +1,849 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// dnssecStatus is the result of the DNSSEC validation of a response.
+type dnssecStatus uint8
+
+// Valid dnssecStatus values.
+const (
+	// dnssecInsecure means that the response isn't signed or belongs to an
+	// insecure delegation.
+	dnssecInsecure dnssecStatus = iota
+
+	// dnssecSecure means that the response is signed and the chain of trust
+	// is built up to the trust anchors.
+	dnssecSecure
+
+	// dnssecBogus means that the signatures of the response failed the
+	// validation.
+	dnssecBogus
+)
+
+// errInsecure is returned when the zone is proven to be not signed.
+const errInsecure errors.Error = "insecure delegation"
+
+// dnssecError is a DNSSEC validation failure along with the extended DNS error
+// code describing it.
+type dnssecError struct {
+	// err is the underlying error.
+	err error
+
+	// code is the extended DNS error code, see RFC 8914.
+	code uint16
+}
+
+// type check
+var _ errors.Wrapper = (*dnssecError)(nil)
+
+// Error implements the error interface for *dnssecError.
+func (err *dnssecError) Error() (msg string) {
+	return fmt.Sprintf("dnssec: %s: %s", dns.ExtendedErrorCodeToString[err.code], err.err)
+}
+
+// Unwrap implements the [errors.Wrapper] interface for *dnssecError.
+func (err *dnssecError) Unwrap() (unwrapped error) {
+	return err.err
+}
+
+// newDNSSECError returns a new *dnssecError with the given code and the
+// formatted error message.
+func newDNSSECError(code uint16, format string, args ...any) (err *dnssecError) {
+	return &dnssecError{
+		err:  fmt.Errorf(format, args...),
+		code: code,
+	}
+}
+
+// rootTrustAnchors are the DS records of the root zone KSKs.
+//
+// See https://data.iana.org/root-anchors/root-anchors.xml.
+var rootTrustAnchors = []*dns.DS{{
+	Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+	KeyTag:     20326,
+	Algorithm:  dns.RSASHA256,
+	DigestType: dns.SHA256,
+	Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+}, {
+	Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+	KeyTag:     38696,
+	Algorithm:  dns.RSASHA256,
+	DigestType: dns.SHA256,
+	Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}}
+
+const (
+	// dnssecKeysMaxTTL is the maximum time the validated keys of a zone are
+	// kept.
+	dnssecKeysMaxTTL = 1 * time.Hour
+
+	// dnssecInsecureTTL is the time the insecure status of a zone is kept.
+	dnssecInsecureTTL = 5 * time.Minute
+
+	// dnssecMaxZones is the maximum number of names to keep the state of the
+	// chain of trust for.
+	dnssecMaxZones = 10_000
+)
+
+// zoneKeys is the cached state of the chain of trust at a domain name.
+type zoneKeys struct {
+	// expire is the time the state should be dropped after.
+	expire time.Time
+
+	// zone is the apex of the closest signed zone enclosing the name.  It's
+	// empty for the names within insecure zones.
+	zone string
+
+	// keys are the validated keys of zone.  It's nil for the names within
+	// insecure zones.
+	keys []*dns.DNSKEY
+
+	// leaf is true if there are no names below the name in zone, so that
+	// there are no zone cuts below it either.
+	leaf bool
+}
+
+// dnssecValidator validates the DNSSEC signatures of responses building the
+// chain of trust from the trust anchors.  Whether a name belongs to a signed
+// zone is decided by the chain of trust only, so the missing signatures of the
+// records from the signed zones make the responses bogus, and the insecure
+// delegations require a validated denial of existence of the DS records.  It
+// caches the state of the chain of trust by name.
+type dnssecValidator struct {
+	// exchange sends the request for DNSSEC records to the upstreams.
+	exchange func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error)
+
+	// now returns the current time.
+	now func() (now time.Time)
+
+	// mu protects zones.
+	mu *sync.Mutex
+
+	// zones maps the canonical domain names to the state of the chain of trust
+	// at them.
+	zones map[string]*zoneKeys
+
+	// anchors are the DS records of the root zone.
+	anchors []*dns.DS
+}
+
+// newDNSSECValidator returns a new properly initialized *dnssecValidator.
+// exchange must not be nil.
+func newDNSSECValidator(
+	exchange func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error),
+) (v *dnssecValidator) {
+	return &dnssecValidator{
+		exchange: exchange,
+		now:      time.Now,
+		mu:       &sync.Mutex{},
+		zones:    map[string]*zoneKeys{},
+		anchors:  rootTrustAnchors,
+	}
+}
+
+// validate checks the signatures of the answer section of resp and, if it
+// doesn't contain the requested records, the denial of existence in the
+// authority section.  err is a *dnssecError if st is [dnssecBogus].
+func (v *dnssecValidator) validate(
+	ctx context.Context,
+	resp *dns.Msg,
+) (st dnssecStatus, err error) {
+	if len(resp.Question) == 0 ||
+		(resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return dnssecInsecure, nil
+	}
+
+	q := resp.Question[0]
+	sets, sigs := splitRRsets(resp.Answer)
+
+	st = dnssecSecure
+	for _, set := range sets {
+		var setSt dnssecStatus
+		setSt, err = v.validateRRset(ctx, resp, set, sigsForRRset(sigs, set))
+		if err != nil {
+			return dnssecBogus, err
+		}
+
+		if setSt == dnssecInsecure {
+			st = dnssecInsecure
+		}
+	}
+
+	target, answered := answerTarget(sets, q)
+	if answered && resp.Rcode == dns.RcodeSuccess {
+		return st, nil
+	}
+
+	denialSt, err := v.validateDenial(ctx, resp, target, q.Qtype)
+	if err != nil {
+		return dnssecBogus, err
+	} else if denialSt == dnssecInsecure {
+		st = dnssecInsecure
+	}
+
+	return st, nil
+}
+
+// validateRRset checks the signatures of set from resp.  sigs are the
+// signatures covering set.
+func (v *dnssecValidator) validateRRset(
+	ctx context.Context,
+	resp *dns.Msg,
+	set []dns.RR,
+	sigs []*dns.RRSIG,
+) (st dnssecStatus, err error) {
+	hdr := set[0].Header()
+	zk, err := v.trustChain(ctx, signerOf(hdr.Name, hdr.Rrtype))
+	if errors.Is(err, errInsecure) {
+		return dnssecInsecure, nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return dnssecBogus, err
+	}
+
+	if len(sigs) == 0 && hdr.Rrtype == dns.TypeCNAME && isSynthesized(resp.Answer, hdr.Name) {
+		// The CNAME records synthesized from DNAME aren't signed, but the
+		// DNAME itself is validated.
+		return dnssecSecure, nil
+	}
+
+	sig, err := v.verifyRRset(set, sigs, zk)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return dnssecBogus, err
+	}
+
+	if int(sig.Labels) < dns.CountLabel(hdr.Name) {
+		// The records are expanded from a wildcard, so the name itself must
+		// not exist.
+		err = v.verifyWildcardExpansion(resp.Ns, zk, hdr.Name, sig.Labels)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return dnssecBogus, err
+		}
+	}
+
+	return dnssecSecure, nil
+}
+
+// validateDenial checks the denial of existence of the records of qtype for
+// name in resp.
+func (v *dnssecValidator) validateDenial(
+	ctx context.Context,
+	resp *dns.Msg,
+	name string,
+	qtype uint16,
+) (st dnssecStatus, err error) {
+	zk, err := v.trustChain(ctx, signerOf(name, qtype))
+	if errors.Is(err, errInsecure) {
+		return dnssecInsecure, nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return dnssecBogus, err
+	}
+
+	den, err := v.verifyDenial(resp, zk, name, qtype)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return dnssecBogus, err
+	}
+
+	if den.optOut {
+		// The name may belong to an unsigned delegation.
+		return dnssecInsecure, nil
+	}
+
+	return dnssecSecure, nil
+}
+
+// signerOf returns the name which the zone signing the records of rrtype owned
+// by name encloses.  The DS records are signed by the parent zone.
+func signerOf(name string, rrtype uint16) (encloser string) {
+	if rrtype != dns.TypeDS || name == "." {
+		return name
+	}
+
+	i, _ := dns.NextLabel(name, 0)
+
+	return dns.Fqdn(name[i:])
+}
+
+// answerTarget follows the CNAME chain starting at the name of q within sets
+// and returns its target.  answered is true if sets contain the records of the
+// requested type for target.
+func answerTarget(sets [][]dns.RR, q dns.Question) (target string, answered bool) {
+	target = q.Name
+
+	// Limit the number of steps to not loop infinitely.
+	for range len(sets) + 1 {
+		var next string
+		for _, set := range sets {
+			hdr := set[0].Header()
+			if !strings.EqualFold(hdr.Name, target) {
+				continue
+			}
+
+			if hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				return target, true
+			} else if cname, ok := set[0].(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		target = next
+	}
+
+	return target, false
+}
+
+// isSynthesized returns true if the CNAME owned by name may be synthesized
+// from a DNAME record within answer, see RFC 6672.
+func isSynthesized(answer []dns.RR, name string) (ok bool) {
+	for _, rr := range answer {
+		dname, isDNAME := rr.(*dns.DNAME)
+		if isDNAME && !strings.EqualFold(dname.Hdr.Name, name) && dns.IsSubDomain(dname.Hdr.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitRRsets groups the records of section into RRsets and separates the
+// signatures.
+func splitRRsets(section []dns.RR) (sets [][]dns.RR, sigs []*dns.RRSIG) {
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+
+			continue
+		}
+
+		hdr := rr.Header()
+		i := 0
+		for ; i < len(sets); i++ {
+			setHdr := sets[i][0].Header()
+			if setHdr.Rrtype == hdr.Rrtype &&
+				setHdr.Class == hdr.Class &&
+				strings.EqualFold(setHdr.Name, hdr.Name) {
+				break
+			}
+		}
+
+		if i == len(sets) {
+			sets = append(sets, nil)
+		}
+
+		sets[i] = append(sets[i], rr)
+	}
+
+	return sets, sigs
+}
+
+// sigsForRRset returns the signatures from sigs covering set.
+func sigsForRRset(sigs []*dns.RRSIG, set []dns.RR) (res []*dns.RRSIG) {
+	hdr := set[0].Header()
+	for _, sig := range sigs {
+		if sig.TypeCovered == hdr.Rrtype && strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			res = append(res, sig)
+		}
+	}
+
+	return res
+}
+
+// verifyRRset checks that at least one of sigs is a valid signature of set
+// made by the keys of zk and returns it.
+func (v *dnssecValidator) verifyRRset(
+	set []dns.RR,
+	sigs []*dns.RRSIG,
+	zk *zoneKeys,
+) (sig *dns.RRSIG, err error) {
+	hdr := set[0].Header()
+	if len(sigs) == 0 {
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeRRSIGsMissing,
+			"%s of %q in signed zone %q",
+			dns.TypeToString[hdr.Rrtype],
+			hdr.Name,
+			zk.zone,
+		)
+	}
+
+	for _, sig = range sigs {
+		err = v.verifySig(hdr.Name, set, sig, zk)
+		if err == nil {
+			return sig, nil
+		}
+	}
+
+	return nil, err
+}
+
+// verifySig checks if sig is a valid signature of set owned by name made by
+// the keys of zk.
+func (v *dnssecValidator) verifySig(
+	name string,
+	set []dns.RR,
+	sig *dns.RRSIG,
+	zk *zoneKeys,
+) (err error) {
+	if !strings.EqualFold(sig.SignerName, zk.zone) {
+		return newDNSSECError(
+			dns.ExtendedErrorCodeDNSBogus,
+			"signer %q of %q isn't the enclosing zone %q",
+			sig.SignerName,
+			name,
+			zk.zone,
+		)
+	}
+
+	if int(sig.Labels) > dns.CountLabel(name) {
+		return newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "labels of signature of %q", name)
+	}
+
+	now := v.now()
+	if !sig.ValidityPeriod(now) {
+		code := dns.ExtendedErrorCodeSignatureExpired
+		if now.Before(time.Unix(int64(sig.Inception), 0)) {
+			code = dns.ExtendedErrorCodeSignatureNotYetValid
+		}
+
+		return newDNSSECError(code, "signature of %q", name)
+	}
+
+	for _, key := range zk.keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm {
+			err = sig.Verify(key, set)
+			if err != nil {
+				return newDNSSECError(dns.ExtendedErrorCodeDNSBogus, "verifying %q: %w", name, err)
+			}
+
+			return nil
+		}
+	}
+
+	return newDNSSECError(
+		dns.ExtendedErrorCodeDNSKEYMissing,
+		"no key %d in zone %q",
+		sig.KeyTag,
+		sig.SignerName,
+	)
+}
+
+// trustChain returns the state of the chain of trust at name, building it
+// down from the trust anchors through each of the ancestors of name.  It
+// returns errInsecure if name belongs to an insecure zone.
+func (v *dnssecValidator) trustChain(ctx context.Context, name string) (zk *zoneKeys, err error) {
+	name = dns.CanonicalName(name)
+
+	// names are name and its ancestors, from the deepest to the root.
+	names := make([]string, 0, dns.CountLabel(name)+1)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		names = append(names, name[off:])
+	}
+
+	if name != "." {
+		names = append(names, ".")
+	}
+
+	i := 0
+	for ; i < len(names); i++ {
+		zk = v.cached(names[i])
+		if zk != nil {
+			break
+		}
+	}
+
+	if zk == nil {
+		i = len(names) - 1
+		zk, err = v.rootKeys(ctx)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	for i--; i >= 0 && zk.keys != nil && !zk.leaf; i-- {
+		zk, err = v.descend(ctx, zk, names[i])
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+	}
+
+	if zk.keys == nil {
+		return nil, errInsecure
+	}
+
+	return zk, nil
+}
+
+// cached returns the cached state of the chain of trust at name, if it hasn't
+// expired yet.
+func (v *dnssecValidator) cached(name string) (zk *zoneKeys) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	zk = v.zones[name]
+	if zk == nil || !v.now().Before(zk.expire) {
+		return nil
+	}
+
+	return zk
+}
+
+// rootKeys returns the state of the chain of trust at the root zone, which
+// keys are validated with the trust anchors.
+func (v *dnssecValidator) rootKeys(ctx context.Context) (zk *zoneKeys, err error) {
+	keys, ttl, err := v.lookupDNSKEY(ctx, ".", v.anchors)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	zk = &zoneKeys{
+		expire: v.now().Add(ttl),
+		zone:   ".",
+		keys:   keys,
+	}
+	v.store(".", zk)
+
+	return zk, nil
+}
+
+// descend returns the state of the chain of trust at name, which is a child of
+// the name parent is the state at.  It looks up the DS records of name, which
+// are either signed by the zone of parent, or denied by it.
+func (v *dnssecValidator) descend(
+	ctx context.Context,
+	parent *zoneKeys,
+	name string,
+) (zk *zoneKeys, err error) {
+	resp, err := v.query(ctx, name, dns.TypeDS)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	zk, ttl, err := v.descendResp(ctx, parent, name, resp)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	zk.expire = v.now().Add(min(ttl, dnssecKeysMaxTTL))
+	if zk.keys == nil {
+		zk.expire = v.now().Add(dnssecInsecureTTL)
+	}
+
+	// The state can't outlive the keys it's built with.
+	if zk.expire.After(parent.expire) {
+		zk.expire = parent.expire
+	}
+
+	v.store(name, zk)
+
+	return zk, nil
+}
+
+// descendResp returns the state of the chain of trust at name using resp to
+// the request of its DS records.  ttl is the time the state is valid for.
+func (v *dnssecValidator) descendResp(
+	ctx context.Context,
+	parent *zoneKeys,
+	name string,
+	resp *dns.Msg,
+) (zk *zoneKeys, ttl time.Duration, err error) {
+	sets, sigs := splitRRsets(resp.Answer)
+	for _, set := range sets {
+		hdr := set[0].Header()
+		if !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+
+		switch hdr.Rrtype {
+		case dns.TypeDS:
+			return v.delegation(ctx, parent, name, set, sigsForRRset(sigs, set))
+		case dns.TypeCNAME:
+			// An alias can't be a zone cut.
+			_, err = v.verifyRRset(set, sigsForRRset(sigs, set), parent)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			return &zoneKeys{zone: parent.zone, keys: parent.keys}, rrsetTTL(set), nil
+		}
+	}
+
+	den, err := v.verifyDenial(resp, parent, name, dns.TypeDS)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case den.optOut, slices.Contains(den.types, dns.TypeNS):
+		// An unsigned delegation.
+		return &zoneKeys{}, 0, nil
+	default:
+		return &zoneKeys{
+			zone: parent.zone,
+			keys: parent.keys,
+			leaf: den.leaf,
+		}, den.ttl, nil
+	}
+}
+
+// delegation returns the state of the chain of trust at name, which is a
+// signed delegation with the DS records from set signed by sigs.
+func (v *dnssecValidator) delegation(
+	ctx context.Context,
+	parent *zoneKeys,
+	name string,
+	set []dns.RR,
+	sigs []*dns.RRSIG,
+) (zk *zoneKeys, ttl time.Duration, err error) {
+	_, err = v.verifyRRset(set, sigs, parent)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ds := make([]*dns.DS, 0, len(set))
+	for _, rr := range set {
+		ds = append(ds, rr.(*dns.DS))
+	}
+
+	if !slices.ContainsFunc(ds, isSupportedDS) {
+		// The zone is treated as unsigned, see RFC 4035, Section 5.2.
+		return &zoneKeys{}, 0, nil
+	}
+
+	keys, keysTTL, err := v.lookupDNSKEY(ctx, name, ds)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &zoneKeys{zone: name, keys: keys}, min(rrsetTTL(set), keysTTL), nil
+}
+
+// isSupportedDS returns true if both the algorithm and the digest type of ds
+// are supported.
+func isSupportedDS(ds *dns.DS) (ok bool) {
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		// Go on.
+	default:
+		return false
+	}
+
+	switch ds.Algorithm {
+	case
+		dns.RSASHA1,
+		dns.RSASHA1NSEC3SHA1,
+		dns.RSASHA256,
+		dns.RSASHA512,
+		dns.ECDSAP256SHA256,
+		dns.ECDSAP384SHA384,
+		dns.ED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// rrsetTTL returns the minimum TTL of the records of set.
+func rrsetTTL(set []dns.RR) (ttl time.Duration) {
+	ttl = dnssecKeysMaxTTL
+	for _, rr := range set {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+
+	return ttl
+}
+
+// store saves the state of the chain of trust at name.
+func (v *dnssecValidator) store(name string, zk *zoneKeys) {
+	now := v.now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.zones) >= dnssecMaxZones {
+		for n, cached := range v.zones {
+			if !now.Before(cached.expire) {
+				delete(v.zones, n)
+			}
+		}
+
+		if len(v.zones) >= dnssecMaxZones {
+			clear(v.zones)
+		}
+	}
+
+	v.zones[name] = zk
+}
+
+// query requests the records of qtype for name with DNSSEC records.
+func (v *dnssecValidator) query(
+	ctx context.Context,
+	name string,
+	qtype uint16,
+) (resp *dns.Msg, err error) {
+	req := (&dns.Msg{}).SetQuestion(name, qtype)
+	req.SetEdns0(defaultUDPBufSize, true)
+	req.CheckingDisabled = true
+
+	resp, err = v.exchange(ctx, req)
+	if err != nil {
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeNoReachableAuthority,
+			"requesting %s for %q: %w",
+			dns.TypeToString[qtype],
+			name,
+			err,
+		)
+	}
+
+	return resp, nil
+}
+
+// lookupDNSKEY returns the keys of zone, which are signed by a key matching
+// one of ds.  ttl is the minimum TTL of the keys.
+func (v *dnssecValidator) lookupDNSKEY(
+	ctx context.Context,
+	zone string,
+	ds []*dns.DS,
+) (keys []*dns.DNSKEY, ttl time.Duration, err error) {
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, 0, err
+	}
+
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	ttl = dnssecKeysMaxTTL
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			set = append(set, rr)
+			ttl = min(ttl, time.Duration(rr.Hdr.Ttl)*time.Second)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	now := v.now()
+	for _, key := range keys {
+		if !matchesDS(key, ds) {
+			continue
+		}
+
+		for _, sig := range sigs {
+			if sig.KeyTag == key.KeyTag() &&
+				sig.ValidityPeriod(now) &&
+				sig.Verify(key, set) == nil {
+				return keys, ttl, nil
+			}
+		}
+	}
+
+	return nil, 0, newDNSSECError(
+		dns.ExtendedErrorCodeDNSKEYMissing,
+		"no valid key matching ds in zone %q",
+		zone,
+	)
+}
+
+// matchesDS returns true if key matches any of ds.
+func matchesDS(key *dns.DNSKEY, ds []*dns.DS) (ok bool) {
+	tag := key.KeyTag()
+	for _, d := range ds {
+		if d.KeyTag != tag || d.Algorithm != key.Algorithm {
+			continue
+		}
+
+		keyDS := key.ToDS(d.DigestType)
+		if keyDS != nil && strings.EqualFold(keyDS.Digest, d.Digest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exchangeDNSSEC sends the request for the DNSSEC records to the upstreams
+// configured for its name.
+func (p *Proxy) exchangeDNSSEC(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	getUpstreams := (*UpstreamConfig).getUpstreamsForDomain
+	if req.Question[0].Qtype == dns.TypeDS {
+		getUpstreams = (*UpstreamConfig).getUpstreamsForDS
+	}
+
+	ups := getUpstreams(p.live.Load().upstreams, req.Question[0].Name)
+	if len(ups) == 0 {
+		return nil, fmt.Errorf("no upstreams for %q", req.Question[0].Name)
+	}
+
+	resp, _, err = p.exchangeUpstreams(ctx, req, ups)
+
+	return resp, err
+}
+
+// validateDNSSEC validates resp for the request from d and returns the
+// response to use instead.  It sets the AD bit of the secure responses and
+// replaces the bogus ones with SERVFAIL responses, setting bogus to true.  resp
+// must be the one received from the upstream, since the records synthesized
+// locally aren't signed.  It returns resp as is if the validation is disabled,
+// resp is nil, or the request has the CD bit set.
+func (p *Proxy) validateDNSSEC(
+	ctx context.Context,
+	d *DNSContext,
+	resp *dns.Msg,
+) (validated *dns.Msg, bogus bool) {
+	if p.dnssec == nil || resp == nil || d.Req.CheckingDisabled {
+		return resp, false
+	}
+
+	st, err := p.dnssec.validate(ctx, resp)
+	switch st {
+	case dnssecSecure:
+		resp.AuthenticatedData = true
+	case dnssecBogus:
+		p.logger.Debug("dnssec validation failed", slogutil.KeyError, err)
+
+		validated = p.messages.NewMsgSERVFAIL(d.Req)
+
+		var dErr *dnssecError
+		if errors.As(err, &dErr) {
+			d.ede = &dns.EDNS0_EDE{
+				InfoCode:  dErr.code,
+				ExtraText: dErr.err.Error(),
+			}
+		}
+
+		return validated, true
+	default:
+		resp.AuthenticatedData = false
+	}
+
+	return resp, false
+}
@@ -0,0 +1,763 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSignedZone is a DNSSEC-signed zone for tests.
+type testSignedZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// newTestSignedZone generates a new key for the zone with the given name.
+func newTestSignedZone(tb testing.TB, name string) (z *testSignedZone) {
+	tb.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(tb, err)
+
+	signer, ok := priv.(crypto.Signer)
+	require.True(tb, ok)
+
+	return &testSignedZone{
+		key:  key,
+		priv: signer,
+	}
+}
+
+// sign returns the signature of rrs valid within the given period relative to
+// the current time.
+func (z *testSignedZone) sign(tb testing.TB, from, to time.Duration, rrs ...dns.RR) (sig *dns.RRSIG) {
+	tb.Helper()
+
+	hdr := rrs[0].Header()
+	now := time.Now()
+	sig = &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   hdr.Name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    hdr.Ttl,
+		},
+		TypeCovered: hdr.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(hdr.Name)),
+		OrigTtl:     hdr.Ttl,
+		Inception:   uint32(now.Add(from).Unix()),
+		Expiration:  uint32(now.Add(to).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.key.Hdr.Name,
+	}
+
+	require.NoError(tb, sig.Sign(z.priv, rrs))
+
+	return sig
+}
+
+// signValid is like sign but returns the signature valid for an hour around
+// the current time.
+func (z *testSignedZone) signValid(tb testing.TB, rrs ...dns.RR) (sig *dns.RRSIG) {
+	tb.Helper()
+
+	return z.sign(tb, -time.Hour, time.Hour, rrs...)
+}
+
+// testDNSSECHierarchy is a signed root zone with a single signed delegation.
+type testDNSSECHierarchy struct {
+	root *testSignedZone
+	zone *testSignedZone
+
+	// answers maps the keys returned by testDNSSECKey to the answer sections
+	// of the responses.
+	answers map[string][]dns.RR
+
+	// authority maps the keys returned by testDNSSECKey to the authority
+	// sections of the responses.
+	authority map[string][]dns.RR
+
+	// rcodes maps the keys returned by testDNSSECKey to the response codes of
+	// the responses.
+	rcodes map[string]int
+}
+
+// newTestDNSSECHierarchy returns a hierarchy with the signed zone of the given
+// name delegated from the signed root zone.
+func newTestDNSSECHierarchy(tb testing.TB, zoneName string) (h *testDNSSECHierarchy) {
+	tb.Helper()
+
+	root := newTestSignedZone(tb, ".")
+	zone := newTestSignedZone(tb, zoneName)
+
+	ds := zone.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = defaultTestTTL
+
+	return &testDNSSECHierarchy{
+		root: root,
+		zone: zone,
+		answers: map[string][]dns.RR{
+			testDNSSECKey(".", dns.TypeDNSKEY): {
+				root.key,
+				root.signValid(tb, root.key),
+			},
+			testDNSSECKey(zoneName, dns.TypeDNSKEY): {
+				zone.key,
+				zone.signValid(tb, zone.key),
+			},
+			testDNSSECKey(zoneName, dns.TypeDS): {
+				ds,
+				root.signValid(tb, ds),
+			},
+		},
+		authority: map[string][]dns.RR{},
+		rcodes:    map[string]int{},
+	}
+}
+
+// testDNSSECKey returns the key for the maps of testDNSSECHierarchy.
+func testDNSSECKey(name string, qtype uint16) (key string) {
+	return strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+}
+
+// newNSEC returns the NSEC record owned by owner and pointing to next with the
+// given types, along with its signature made by z.
+func (z *testSignedZone) newNSEC(
+	tb testing.TB,
+	owner string,
+	next string,
+	types ...uint16,
+) (rrs []dns.RR) {
+	tb.Helper()
+
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+
+	return []dns.RR{nsec, z.signValid(tb, nsec)}
+}
+
+// exchange implements the exchanging function for *dnssecValidator.
+func (h *testDNSSECHierarchy) exchange(
+	_ context.Context,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	q := req.Question[0]
+	key := testDNSSECKey(q.Name, q.Qtype)
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = h.answers[key]
+	resp.Ns = h.authority[key]
+	resp.Rcode = h.rcodes[key]
+
+	return resp, nil
+}
+
+// newValidator returns a new validator trusting the root zone of h.
+func (h *testDNSSECHierarchy) newValidator() (v *dnssecValidator) {
+	v = newDNSSECValidator(h.exchange)
+	v.anchors = []*dns.DS{h.root.key.ToDS(dns.SHA256)}
+
+	return v
+}
+
+func TestDNSSECValidator_validate(t *testing.T) {
+	const (
+		zoneName = "example."
+		host     = "www.example."
+		noneHost = "none.example."
+		wildHost = "wild.example."
+	)
+
+	h := newTestDNSSECHierarchy(t, zoneName)
+	unsigned := newTestSignedZone(t, "unsigned.")
+	stripped := newTestSignedZone(t, "stripped.")
+
+	hostNSEC := h.zone.newNSEC(t, host, zoneName, dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+	apexNSEC := h.zone.newNSEC(
+		t,
+		zoneName,
+		host,
+		dns.TypeNS,
+		dns.TypeSOA,
+		dns.TypeRRSIG,
+		dns.TypeNSEC,
+		dns.TypeDNSKEY,
+	)
+
+	h.authority[testDNSSECKey(host, dns.TypeDS)] = hostNSEC
+	h.authority[testDNSSECKey(noneHost, dns.TypeDS)] = apexNSEC
+	h.rcodes[testDNSSECKey(noneHost, dns.TypeDS)] = dns.RcodeNameError
+	h.authority[testDNSSECKey(wildHost, dns.TypeDS)] = apexNSEC
+	h.rcodes[testDNSSECKey(wildHost, dns.TypeDS)] = dns.RcodeNameError
+	h.authority[testDNSSECKey("unsigned.", dns.TypeDS)] = h.root.newNSEC(
+		t,
+		"unsigned.",
+		".",
+		dns.TypeNS,
+		dns.TypeRRSIG,
+		dns.TypeNSEC,
+	)
+
+	a := newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	forged := newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{4, 3, 2, 1})
+	unsignedA := newRR(t, "www.unsigned.", dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	strippedA := newRR(t, "www.stripped.", dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+
+	// Sign the wildcard and expand it.
+	wildcardA := newRR(t, "*."+zoneName, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	wildSig := h.zone.signValid(t, wildcardA)
+	wildSig.Hdr.Name = wildHost
+	wildA := newRR(t, wildHost, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+
+	testCases := []struct {
+		answer   []dns.RR
+		ns       []dns.RR
+		name     string
+		qname    string
+		qtype    uint16
+		rcode    int
+		wantSt   dnssecStatus
+		wantCode uint16
+	}{{
+		answer: []dns.RR{a, h.zone.signValid(t, a)},
+		name:   "secure",
+		qname:  host,
+		qtype:  dns.TypeA,
+		wantSt: dnssecSecure,
+	}, {
+		answer:   []dns.RR{a},
+		name:     "stripped_signatures",
+		qname:    host,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeRRSIGsMissing,
+	}, {
+		answer: []dns.RR{unsignedA, unsigned.signValid(t, unsignedA)},
+		name:   "insecure_delegation",
+		qname:  "www.unsigned.",
+		qtype:  dns.TypeA,
+		wantSt: dnssecInsecure,
+	}, {
+		answer:   []dns.RR{strippedA},
+		name:     "stripped_ds",
+		qname:    "www.stripped.",
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeNSECMissing,
+	}, {
+		answer:   []dns.RR{strippedA, stripped.signValid(t, strippedA)},
+		name:     "unproven_ds",
+		qname:    "www.stripped.",
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeNSECMissing,
+	}, {
+		answer:   []dns.RR{forged, h.zone.signValid(t, a)},
+		name:     "forged",
+		qname:    host,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeDNSBogus,
+	}, {
+		answer:   []dns.RR{a, h.zone.sign(t, -2*time.Hour, -time.Hour, a)},
+		name:     "expired",
+		qname:    host,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeSignatureExpired,
+	}, {
+		answer:   []dns.RR{a, h.zone.sign(t, time.Hour, 2*time.Hour, a)},
+		name:     "not_yet_valid",
+		qname:    host,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeSignatureNotYetValid,
+	}, {
+		answer:   []dns.RR{a, newTestSignedZone(t, zoneName).signValid(t, a)},
+		name:     "unknown_key",
+		qname:    host,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeDNSKEYMissing,
+	}, {
+		ns:     hostNSEC,
+		name:   "nodata",
+		qname:  host,
+		qtype:  dns.TypeAAAA,
+		wantSt: dnssecSecure,
+	}, {
+		name:     "nodata_stripped",
+		qname:    host,
+		qtype:    dns.TypeAAAA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeNSECMissing,
+	}, {
+		ns:       hostNSEC,
+		name:     "nodata_existing",
+		qname:    host,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeDNSBogus,
+	}, {
+		ns:     apexNSEC,
+		name:   "nxdomain",
+		qname:  noneHost,
+		qtype:  dns.TypeA,
+		rcode:  dns.RcodeNameError,
+		wantSt: dnssecSecure,
+	}, {
+		ns:       apexNSEC,
+		name:     "nxdomain_noerror",
+		qname:    noneHost,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeDNSBogus,
+	}, {
+		ns:       hostNSEC,
+		name:     "nxdomain_uncovered",
+		qname:    noneHost,
+		qtype:    dns.TypeA,
+		rcode:    dns.RcodeNameError,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeNSECMissing,
+	}, {
+		answer: []dns.RR{wildA, wildSig},
+		ns:     apexNSEC,
+		name:   "wildcard",
+		qname:  wildHost,
+		qtype:  dns.TypeA,
+		wantSt: dnssecSecure,
+	}, {
+		answer:   []dns.RR{wildA, wildSig},
+		name:     "wildcard_unproven",
+		qname:    wildHost,
+		qtype:    dns.TypeA,
+		wantSt:   dnssecBogus,
+		wantCode: dns.ExtendedErrorCodeNSECMissing,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := h.newValidator()
+			resp := (&dns.Msg{}).SetQuestion(tc.qname, tc.qtype)
+			resp.Rcode = tc.rcode
+			resp.Answer = tc.answer
+			resp.Ns = tc.ns
+
+			st, err := v.validate(context.Background(), resp)
+			assert.Equal(t, tc.wantSt, st)
+
+			if tc.wantCode == 0 {
+				require.NoError(t, err)
+
+				return
+			}
+
+			var dErr *dnssecError
+			require.ErrorAs(t, err, &dErr)
+
+			assert.Equal(t, tc.wantCode, dErr.code)
+		})
+	}
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	t.Parallel()
+
+	const (
+		zoneName = "example."
+		host     = "www.example."
+	)
+
+	// newNSEC3s returns the chain of NSEC3 records of the zone containing the
+	// names with the given types.
+	newNSEC3s := func(flags uint8, names map[string][]uint16) (nsec3s []*dns.NSEC3) {
+		hashes := make([]string, 0, len(names))
+		types := map[string][]uint16{}
+		for name, ts := range names {
+			hash := dns.HashName(name, dns.SHA1, 0, "")
+			hashes = append(hashes, hash)
+			types[hash] = ts
+		}
+
+		slices.Sort(hashes)
+
+		for i, hash := range hashes {
+			nsec3s = append(nsec3s, &dns.NSEC3{
+				Hdr: dns.RR_Header{
+					Name:   strings.ToLower(hash) + "." + zoneName,
+					Rrtype: dns.TypeNSEC3,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTestTTL,
+				},
+				Hash:       dns.SHA1,
+				Flags:      flags,
+				NextDomain: hashes[(i+1)%len(hashes)],
+				HashLength: 20,
+				TypeBitMap: types[hash],
+			})
+		}
+
+		return nsec3s
+	}
+
+	names := map[string][]uint16{
+		zoneName: {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		host:     {dns.TypeA, dns.TypeRRSIG},
+	}
+
+	testCases := []struct {
+		want       *denial
+		nsec3s     []*dns.NSEC3
+		name       string
+		qname      string
+		qtype      uint16
+		wantErrMsg string
+	}{{
+		want:       &denial{types: names[host]},
+		nsec3s:     newNSEC3s(0, names),
+		name:       "nodata",
+		qname:      host,
+		qtype:      dns.TypeAAAA,
+		wantErrMsg: "",
+	}, {
+		want:       &denial{nxdomain: true, leaf: true},
+		nsec3s:     newNSEC3s(0, names),
+		name:       "nxdomain",
+		qname:      "none.example.",
+		qtype:      dns.TypeA,
+		wantErrMsg: "",
+	}, {
+		want:       &denial{nxdomain: true, leaf: true, optOut: true},
+		nsec3s:     newNSEC3s(nsec3OptOut, names),
+		name:       "opt_out",
+		qname:      "unsigned.example.",
+		qtype:      dns.TypeDS,
+		wantErrMsg: "",
+	}, {
+		want:   nil,
+		nsec3s: newNSEC3s(0, names),
+		name:   "existing",
+		qname:  host,
+		qtype:  dns.TypeA,
+		wantErrMsg: `dnssec: DNSSEC Bogus: ` +
+			`denial proves A exists for "www.example."`,
+	}, {
+		want: nil,
+		nsec3s: newNSEC3s(0, map[string][]uint16{
+			host: names[host],
+		}),
+		name:  "no_closest_encloser",
+		qname: "none.example.",
+		qtype: dns.TypeA,
+		wantErrMsg: `dnssec: NSEC Missing: ` +
+			`no closest encloser proof for "none.example."`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			den, err := nsec3Denial(tc.nsec3s, zoneName, tc.qname, tc.qtype)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, den)
+		})
+	}
+}
+
+func TestProxy_Resolve_dnssecValidation(t *testing.T) {
+	const (
+		zoneName     = "example."
+		secureHost   = "secure.example."
+		bogusHost    = "bogus.example."
+		strippedHost = "stripped.example."
+	)
+
+	h := newTestDNSSECHierarchy(t, zoneName)
+	for _, host := range []string{secureHost, bogusHost, strippedHost} {
+		h.authority[testDNSSECKey(host, dns.TypeDS)] = h.zone.newNSEC(
+			t,
+			host,
+			zoneName,
+			dns.TypeA,
+			dns.TypeRRSIG,
+			dns.TypeNSEC,
+		)
+	}
+
+	secureA := newRR(t, secureHost, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	h.answers[testDNSSECKey(secureHost, dns.TypeA)] = []dns.RR{
+		secureA,
+		h.zone.signValid(t, secureA),
+	}
+
+	// Sign the original record but respond with the forged one.
+	bogusA := newRR(t, bogusHost, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	bogusSig := h.zone.signValid(t, bogusA)
+	forgedA := newRR(t, bogusHost, dns.TypeA, defaultTestTTL, net.IP{4, 3, 2, 1})
+	h.answers[testDNSSECKey(bogusHost, dns.TypeA)] = []dns.RR{forgedA, bogusSig}
+
+	// Respond without the signature.
+	strippedA := newRR(t, strippedHost, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})
+	h.answers[testDNSSECKey(strippedHost, dns.TypeA)] = []dns.RR{strippedA}
+
+	// The responses don't have OPT records, but the extended errors should be
+	// added anyway.
+	u := &dnsproxytest.Upstream{
+		OnExchange: h.exchange,
+		OnAddress:  func() (addr string) { return "" },
+		OnClose:    func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         defaultCacheSize,
+		EnableDNSSECValidation: true,
+	})
+	p.dnssec.anchors = []*dns.DS{h.root.key.ToDS(dns.SHA256)}
+	servicetest.RequireRun(t, p, testTimeout)
+
+	newCtx := func(host string) (d *DNSContext) {
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		req.SetEdns0(defaultUDPBufSize, true)
+
+		return p.newDNSContext(ProtoUDP, req, netip.MustParseAddrPort("1.2.3.4:53"))
+	}
+
+	t.Run("secure", func(t *testing.T) {
+		// The second request is served from the cache and should retain the
+		// validation status.
+		for range 2 {
+			d := newCtx(secureHost)
+			require.NoError(t, p.Resolve(context.Background(), d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+			assert.True(t, d.Res.AuthenticatedData)
+		}
+	})
+
+	testCases := []struct {
+		name     string
+		host     string
+		wantCode uint16
+	}{{
+		name:     "bogus",
+		host:     bogusHost,
+		wantCode: dns.ExtendedErrorCodeDNSBogus,
+	}, {
+		name:     "stripped",
+		host:     strippedHost,
+		wantCode: dns.ExtendedErrorCodeRRSIGsMissing,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The failures shouldn't be cached without the extended errors.
+			for range 2 {
+				d := newCtx(tc.host)
+				require.NoError(t, p.Resolve(context.Background(), d))
+				require.NotNil(t, d.Res)
+
+				assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+
+				o := d.Res.IsEdns0()
+				require.NotNil(t, o)
+				require.Len(t, o.Option, 1)
+
+				ede, ok := o.Option[0].(*dns.EDNS0_EDE)
+				require.True(t, ok)
+
+				assert.Equal(t, tc.wantCode, ede.InfoCode)
+			}
+		})
+	}
+}
+
+func TestProxy_ReplyFromUpstream_dnssecLocalResponses(t *testing.T) {
+	const (
+		zoneName     = "example."
+		dns64Host    = "dns64.example."
+		forgedHost   = "forged.example."
+		rebindHost   = "rebind.example."
+		bogusNXHost  = "bogusnx.example."
+		strippedHost = "stripped.example."
+	)
+
+	h := newTestDNSSECHierarchy(t, zoneName)
+
+	hosts := []string{dns64Host, forgedHost, rebindHost, bogusNXHost, strippedHost}
+	for _, host := range hosts {
+		nsec := h.zone.newNSEC(t, host, zoneName, dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+		h.authority[testDNSSECKey(host, dns.TypeDS)] = nsec
+		h.authority[testDNSSECKey(host, dns.TypeAAAA)] = nsec
+	}
+
+	addSigned := func(host string, ip net.IP) {
+		a := newRR(t, host, dns.TypeA, defaultTestTTL, ip)
+		h.answers[testDNSSECKey(host, dns.TypeA)] = []dns.RR{a, h.zone.signValid(t, a)}
+	}
+
+	addSigned(dns64Host, net.IP{1, 2, 3, 4})
+	addSigned(rebindHost, net.IP{192, 168, 0, 1})
+	addSigned(bogusNXHost, net.IP{198, 51, 100, 1})
+
+	// Sign the original record but respond with the forged one.
+	forgedA := newRR(t, forgedHost, dns.TypeA, defaultTestTTL, net.IP{4, 3, 2, 1})
+	forgedSig := h.zone.signValid(t, newRR(t, forgedHost, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4}))
+	h.answers[testDNSSECKey(forgedHost, dns.TypeA)] = []dns.RR{forgedA, forgedSig}
+
+	// Respond without the signature.
+	strippedA := newRR(t, strippedHost, dns.TypeA, defaultTestTTL, net.IP{192, 168, 0, 2})
+	h.answers[testDNSSECKey(strippedHost, dns.TypeA)] = []dns.RR{strippedA}
+
+	u := &dnsproxytest.Upstream{
+		OnExchange: h.exchange,
+		OnAddress:  func() (addr string) { return "upstream" },
+		OnClose:    func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		BogusNXDomain:          []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+		RebindProtection: &RebindProtectionConfig{
+			Enabled: true,
+		},
+		UseDNS64:               true,
+		EnableDNSSECValidation: true,
+	})
+	p.dnssec.anchors = []*dns.DS{h.root.key.ToDS(dns.SHA256)}
+
+	testCases := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		wantRcode int
+		wantAns   int
+		wantAD    bool
+		wantCode  uint16
+	}{{
+		name:      "dns64",
+		host:      dns64Host,
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   1,
+		wantAD:    true,
+		wantCode:  0,
+	}, {
+		name:      "dns64_forged",
+		host:      forgedHost,
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   0,
+		wantAD:    true,
+		wantCode:  0,
+	}, {
+		name:      "rebind",
+		host:      rebindHost,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantAns:   0,
+		wantAD:    false,
+		wantCode:  dns.ExtendedErrorCodeBlocked,
+	}, {
+		name:      "bogus_nxdomain",
+		host:      bogusNXHost,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantAns:   0,
+		wantAD:    false,
+		wantCode:  0,
+	}, {
+		name:      "bogus_rebind",
+		host:      strippedHost,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeServerFailure,
+		wantAns:   0,
+		wantAD:    false,
+		wantCode:  dns.ExtendedErrorCodeRRSIGsMissing,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion(tc.host, tc.qtype),
+				Addr: netip.MustParseAddrPort("1.2.3.4:53"),
+			}
+
+			_, err := p.replyFromUpstream(context.Background(), d)
+			require.NoError(t, err)
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			assert.Equal(t, tc.wantAD, d.Res.AuthenticatedData)
+
+			var answers []dns.RR
+			for _, rr := range d.Res.Answer {
+				if rr.Header().Rrtype == tc.qtype {
+					answers = append(answers, rr)
+				}
+			}
+
+			assert.Len(t, answers, tc.wantAns)
+
+			if tc.wantCode == 0 {
+				assert.Nil(t, d.ede)
+
+				return
+			}
+
+			require.NotNil(t, d.ede)
+			assert.Equal(t, tc.wantCode, d.ede.InfoCode)
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// denial is the validated denial of existence of the records of a type for a
+// name, see RFC 4035 and RFC 5155.
+type denial struct {
+	// types are the types of the records existing for the name.  It's empty if
+	// the name doesn't exist.
+	types []uint16
+
+	// ttl is the time the denial is valid for.
+	ttl time.Duration
+
+	// nxdomain is true if the name doesn't exist.
+	nxdomain bool
+
+	// leaf is true if there are no names below the name.
+	leaf bool
+
+	// optOut is true if the name is only covered by an opt-out NSEC3 record,
+	// so that it may be an unsigned delegation.
+	optOut bool
+}
+
+// nsec3OptOut is the opt-out flag of NSEC3 records, see RFC 5155.
+const nsec3OptOut = 1
+
+// verifyDenial checks the denial of existence of the records of qtype for name
+// within the authority section of resp.  The NSEC and NSEC3 records must be
+// signed by the keys of zk.
+func (v *dnssecValidator) verifyDenial(
+	resp *dns.Msg,
+	zk *zoneKeys,
+	name string,
+	qtype uint16,
+) (den *denial, err error) {
+	nsecs, nsec3s, ttl, err := v.denialRecords(resp.Ns, zk)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	switch {
+	case len(nsecs) > 0:
+		den, err = nsecDenial(nsecs, name, qtype)
+	case len(nsec3s) > 0:
+		den, err = nsec3Denial(nsec3s, zk.zone, name, qtype)
+	default:
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeNSECMissing,
+			"no denial of %s for %q in signed zone %q",
+			dns.TypeToString[qtype],
+			name,
+			zk.zone,
+		)
+	}
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	isNXDomain := resp.Rcode == dns.RcodeNameError
+	if isNXDomain != den.nxdomain && !den.optOut {
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeDNSBogus,
+			"%s contradicts denial for %q",
+			dns.RcodeToString[resp.Rcode],
+			name,
+		)
+	}
+
+	den.ttl = ttl
+
+	return den, nil
+}
+
+// denialRecords returns the NSEC and NSEC3 records of the zone of zk from
+// section, which are validated with its keys.  ttl is the minimum TTL of the
+// records.
+func (v *dnssecValidator) denialRecords(
+	section []dns.RR,
+	zk *zoneKeys,
+) (nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, ttl time.Duration, err error) {
+	ttl = dnssecKeysMaxTTL
+	sets, sigs := splitRRsets(section)
+	for _, set := range sets {
+		hdr := set[0].Header()
+		if (hdr.Rrtype != dns.TypeNSEC && hdr.Rrtype != dns.TypeNSEC3) ||
+			!dns.IsSubDomain(zk.zone, hdr.Name) {
+			continue
+		}
+
+		setSigs := sigsForRRset(sigs, set)
+		if len(setSigs) > 0 && !slices.ContainsFunc(setSigs, func(sig *dns.RRSIG) (ok bool) {
+			return strings.EqualFold(sig.SignerName, zk.zone)
+		}) {
+			// The records of another zone, e.g. the one of the previous
+			// target within a CNAME chain.
+			continue
+		}
+
+		_, err = v.verifyRRset(set, setSigs, zk)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		ttl = min(ttl, rrsetTTL(set))
+		for _, rr := range set {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+
+	return nsecs, nsec3s, ttl, nil
+}
+
+// verifyNoData checks that types don't contain qtype for name, nor a CNAME
+// which would be followed instead.
+func verifyNoData(types []uint16, name string, qtype uint16) (err error) {
+	if slices.Contains(types, qtype) ||
+		(qtype != dns.TypeCNAME && slices.Contains(types, dns.TypeCNAME)) {
+		return newDNSSECError(
+			dns.ExtendedErrorCodeDNSBogus,
+			"denial proves %s exists for %q",
+			dns.TypeToString[qtype],
+			name,
+		)
+	}
+
+	return nil
+}
+
+// nsecDenial checks the denial of existence of the records of qtype for name
+// by nsecs, see RFC 4035, Section 5.4.
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16) (den *denial, err error) {
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			err = verifyNoData(n.TypeBitMap, name, qtype)
+			if err != nil {
+				return nil, err
+			}
+
+			return &denial{types: n.TypeBitMap}, nil
+		}
+	}
+
+	cover := coveringNSEC(nsecs, name)
+	if cover == nil {
+		return nil, newDNSSECError(dns.ExtendedErrorCodeNSECMissing, "no nsec covering %q", name)
+	}
+
+	if isDelegationNSEC(cover) && dns.IsSubDomain(cover.Hdr.Name, name) {
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeDNSBogus,
+			"nsec of delegation %q covers %q",
+			cover.Hdr.Name,
+			name,
+		)
+	}
+
+	if dns.IsSubDomain(name, cover.NextDomain) {
+		// An empty non-terminal.
+		return &denial{}, nil
+	}
+
+	// The closest encloser is the longest common ancestor of name with the
+	// names around it.
+	ce := commonAncestor(name, cover.Hdr.Name)
+	if nextCE := commonAncestor(name, cover.NextDomain); dns.CountLabel(nextCE) > dns.CountLabel(ce) {
+		ce = nextCE
+	}
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, wildcard) {
+			// The response is synthesized from the wildcard which doesn't have
+			// the records of qtype.
+			err = verifyNoData(n.TypeBitMap, wildcard, qtype)
+			if err != nil {
+				return nil, err
+			}
+
+			return &denial{types: n.TypeBitMap, leaf: true}, nil
+		}
+	}
+
+	if coveringNSEC(nsecs, wildcard) == nil {
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeNSECMissing,
+			"no nsec covering wildcard %q",
+			wildcard,
+		)
+	}
+
+	return &denial{nxdomain: true, leaf: true}, nil
+}
+
+// isDelegationNSEC returns true if n is owned by an unsigned delegation.
+func isDelegationNSEC(n *dns.NSEC) (ok bool) {
+	return slices.Contains(n.TypeBitMap, dns.TypeNS) && !slices.Contains(n.TypeBitMap, dns.TypeSOA)
+}
+
+// coveringNSEC returns the record from nsecs which proves that name doesn't
+// exist, if any.
+func coveringNSEC(nsecs []*dns.NSEC, name string) (cover *dns.NSEC) {
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsecCovers returns true if name is between the owner name and the next name
+// of n in the canonical order, see RFC 4034, Section 6.1.
+func nsecCovers(n *dns.NSEC, name string) (ok bool) {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+
+	// The last NSEC of the zone points to its apex.
+	return canonicalCompare(name, next) < 0 || canonicalCompare(next, owner) <= 0
+}
+
+// canonicalCompare compares the domain names a and b in the canonical order,
+// see RFC 4034, Section 6.1.
+func canonicalCompare(a, b string) (res int) {
+	aLabels := dns.SplitDomainName(strings.ToLower(a))
+	bLabels := dns.SplitDomainName(strings.ToLower(b))
+
+	i, j := len(aLabels)-1, len(bLabels)-1
+	for ; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if res = strings.Compare(aLabels[i], bLabels[j]); res != 0 {
+			return res
+		}
+	}
+
+	return cmp.Compare(len(aLabels), len(bLabels))
+}
+
+// commonAncestor returns the longest common ancestor of the domain names a and
+// b.
+func commonAncestor(a, b string) (ancestor string) {
+	n := dns.CompareDomainName(a, b)
+	labels := dns.SplitDomainName(a)
+
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// nsec3Denial checks the denial of existence of the records of qtype for name
+// by nsec3s from zone, see RFC 5155, Section 8.
+func nsec3Denial(
+	nsec3s []*dns.NSEC3,
+	zone string,
+	name string,
+	qtype uint16,
+) (den *denial, err error) {
+	nsec3s = slices.DeleteFunc(nsec3s, func(n *dns.NSEC3) (unsupported bool) {
+		return n.Hash != dns.SHA1
+	})
+
+	if n := matchingNSEC3(nsec3s, name); n != nil {
+		err = verifyNoData(n.TypeBitMap, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+
+		return &denial{types: n.TypeBitMap}, nil
+	}
+
+	ce, nextCloser, err := closestEncloser(nsec3s, zone, name)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	cover := coveringNSEC3(nsec3s, nextCloser)
+	if cover == nil {
+		return nil, newDNSSECError(
+			dns.ExtendedErrorCodeNSECMissing,
+			"no nsec3 covering next closer name %q",
+			nextCloser,
+		)
+	}
+
+	optOut := cover.Flags&nsec3OptOut != 0
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	if n := matchingNSEC3(nsec3s, wildcard); n != nil {
+		err = verifyNoData(n.TypeBitMap, wildcard, qtype)
+		if err != nil {
+			return nil, err
+		}
+
+		return &denial{types: n.TypeBitMap, leaf: true, optOut: optOut}, nil
+	}
+
+	if coveringNSEC3(nsec3s, wildcard) != nil {
+		return &denial{nxdomain: true, leaf: true, optOut: optOut}, nil
+	}
+
+	if optOut {
+		// The unsigned delegations don't need the wildcard proof, see RFC
+		// 5155, Section 8.6.
+		return &denial{optOut: true}, nil
+	}
+
+	return nil, newDNSSECError(
+		dns.ExtendedErrorCodeNSECMissing,
+		"no nsec3 covering wildcard %q",
+		wildcard,
+	)
+}
+
+// closestEncloser returns the closest encloser of name proven by nsec3s from
+// zone and the next closer name, see RFC 5155, Section 8.3.
+func closestEncloser(
+	nsec3s []*dns.NSEC3,
+	zone string,
+	name string,
+) (ce, nextCloser string, err error) {
+	nextCloser = name
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		ce = name[off:]
+		if !dns.IsSubDomain(zone, ce) {
+			break
+		}
+
+		if n := matchingNSEC3(nsec3s, ce); n != nil {
+			isDelegation := slices.Contains(n.TypeBitMap, dns.TypeNS) &&
+				!slices.Contains(n.TypeBitMap, dns.TypeSOA)
+			if isDelegation || slices.Contains(n.TypeBitMap, dns.TypeDNAME) {
+				return "", "", newDNSSECError(
+					dns.ExtendedErrorCodeDNSBogus,
+					"closest encloser %q of %q is a delegation",
+					ce,
+					name,
+				)
+			}
+
+			return ce, nextCloser, nil
+		}
+
+		nextCloser = ce
+	}
+
+	if n := matchingNSEC3(nsec3s, zone); n != nil && dns.IsSubDomain(zone, name) {
+		// The apex is the closest encloser, which isn't reached by the loop
+		// above for the root zone.
+		return dns.Fqdn(zone), nextCloser, nil
+	}
+
+	return "", "", newDNSSECError(
+		dns.ExtendedErrorCodeNSECMissing,
+		"no closest encloser proof for %q",
+		name,
+	)
+}
+
+// matchingNSEC3 returns the record from nsec3s matching name, if any.
+func matchingNSEC3(nsec3s []*dns.NSEC3, name string) (match *dns.NSEC3) {
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// coveringNSEC3 returns the record from nsec3s which proves that name doesn't
+// exist, if any.
+func coveringNSEC3(nsec3s []*dns.NSEC3, name string) (cover *dns.NSEC3) {
+	for _, n := range nsec3s {
+		// [dns.NSEC3.Cover] also reports the matching names as covered.
+		if n.Cover(name) && !n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// verifyWildcardExpansion checks that the records owned by name, which are
+// signed with the given number of labels, are expanded from a wildcard, i.e.
+// the name itself doesn't exist in the zone of zk, see RFC 4035, Section
+// 5.3.4.
+func (v *dnssecValidator) verifyWildcardExpansion(
+	section []dns.RR,
+	zk *zoneKeys,
+	name string,
+	labels uint8,
+) (err error) {
+	nsecs, nsec3s, _, err := v.denialRecords(section, zk)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if cover := coveringNSEC(nsecs, name); cover != nil {
+		return nil
+	}
+
+	// The next closer name is the one label longer than the source of
+	// synthesis.
+	idx := dns.Split(name)
+	nextCloser := name[idx[len(idx)-int(labels)-1]:]
+	if coveringNSEC3(nsec3s, nextCloser) != nil {
+		return nil
+	}
+
+	return newDNSSECError(
+		dns.ExtendedErrorCodeNSECMissing,
+		"no proof of wildcard expansion for %q",
+		name,
+	)
+}
@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+// DomainRefreshPolicy is the proactive refresh policy of the cache entries for
+// the domain names matching a [DomainPolicy].
+type DomainRefreshPolicy string
+
+const (
+	// DomainRefreshDefault makes the entries refreshed according to the
+	// cooldown mechanism, see [Config.CacheProactiveCooldownPeriod].
+	DomainRefreshDefault DomainRefreshPolicy = ""
+
+	// DomainRefreshPinned makes the entries always refreshed regardless of the
+	// cooldown mechanism.
+	DomainRefreshPinned DomainRefreshPolicy = "pinned"
+
+	// DomainRefreshExcluded makes the entries never refreshed.
+	DomainRefreshExcluded DomainRefreshPolicy = "excluded"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*DomainRefreshPolicy)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *DomainRefreshPolicy.
+func (rp *DomainRefreshPolicy) UnmarshalText(b []byte) (err error) {
+	switch pol := DomainRefreshPolicy(b); pol {
+	case
+		DomainRefreshDefault,
+		DomainRefreshPinned,
+		DomainRefreshExcluded:
+		*rp = pol
+	default:
+		return fmt.Errorf(
+			"invalid refresh policy %q, supported: %q, %q, %q",
+			b,
+			DomainRefreshDefault,
+			DomainRefreshPinned,
+			DomainRefreshExcluded,
+		)
+	}
+
+	return nil
+}
+
+// DomainPolicyAction is the action taken for the requests for the domain names
+// matching a [DomainPolicy].
+type DomainPolicyAction string
+
+const (
+	// DomainPolicyActionResolve makes the requests resolved as usual.
+	DomainPolicyActionResolve DomainPolicyAction = ""
+
+	// DomainPolicyActionBlock makes the requests answered with NXDOMAIN without
+	// querying the upstreams.
+	DomainPolicyActionBlock DomainPolicyAction = "block"
+
+	// DomainPolicyActionRefuse makes the requests answered with REFUSED without
+	// querying the upstreams.
+	DomainPolicyActionRefuse DomainPolicyAction = "refuse"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*DomainPolicyAction)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *DomainPolicyAction.
+func (a *DomainPolicyAction) UnmarshalText(b []byte) (err error) {
+	switch act := DomainPolicyAction(b); act {
+	case
+		DomainPolicyActionResolve,
+		DomainPolicyActionBlock,
+		DomainPolicyActionRefuse:
+		*a = act
+	default:
+		return fmt.Errorf(
+			"invalid domain policy action %q, supported: %q, %q, %q",
+			b,
+			DomainPolicyActionResolve,
+			DomainPolicyActionBlock,
+			DomainPolicyActionRefuse,
+		)
+	}
+
+	return nil
+}
+
+// DomainPolicy is the set of settings for the requests for the domain names
+// matching its patterns.  The zero values of the fields keep the global
+// settings, so that a policy only overrides what it sets.
+type DomainPolicy struct {
+	// Upstreams, if not nil, are used to resolve the matching requests instead
+	// of [Config.UpstreamConfig].  The proxy closes them on shutdown.
+	Upstreams *UpstreamConfig
+
+	// Name is the name of the policy used in the logs and the traces.  It's
+	// optional.
+	Name string
+
+	// Refresh is the proactive refresh policy of the matching cache entries.
+	Refresh DomainRefreshPolicy
+
+	// Action is the action taken for the matching requests.
+	Action DomainPolicyAction
+
+	// Patterns are the patterns of the domain names the policy applies to.  A
+	// pattern like "example.com" matches the domain name itself and all its
+	// subdomains, while "*.example.com" only matches the subdomains.  It must
+	// not be empty.
+	Patterns []string
+
+	// CacheMinTTL, if positive, overrides [Config.CacheMinTTL] for the
+	// matching responses.
+	CacheMinTTL uint32
+
+	// CacheMaxTTL, if positive, overrides [Config.CacheMaxTTL] for the
+	// matching responses.
+	CacheMaxTTL uint32
+
+	// RefreshMinAnswers, if positive, overrides
+	// [Config.CacheProactiveRefreshMinAnswers] for the matching cache entries.
+	RefreshMinAnswers uint
+
+	// CacheBypass makes the matching requests neither looked up in nor stored
+	// into the cache.
+	CacheBypass bool
+
+	// RequireEncrypted makes the matching requests only resolved with the
+	// encrypted upstreams, e.g. DNS-over-TLS or DNS-over-HTTPS ones.  The
+	// private upstreams aren't affected.
+	RequireEncrypted bool
+}
+
+// validate returns an error if pol is invalid.  pol must not be nil.
+func (pol *DomainPolicy) validate() (err error) {
+	errs := []error{
+		validate.NotEmptySlice("Patterns", pol.Patterns),
+	}
+
+	for i, p := range pol.Patterns {
+		err = validate.NotEmpty(fmt.Sprintf("Patterns: at index %d", i), strings.TrimPrefix(p, "*."))
+		errs = append(errs, err)
+	}
+
+	if pol.Upstreams != nil {
+		err = pol.Upstreams.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Upstreams: %w", err))
+		}
+	}
+
+	if pol.CacheMinTTL > 0 && pol.CacheMaxTTL > 0 {
+		errs = append(errs, validate.NoLessThan("CacheMaxTTL", pol.CacheMaxTTL, pol.CacheMinTTL))
+	}
+
+	var rp DomainRefreshPolicy
+	if rp.UnmarshalText([]byte(pol.Refresh)) != nil {
+		errs = append(errs, fmt.Errorf("Refresh: %w: %q", errors.ErrBadEnumValue, pol.Refresh))
+	}
+
+	var act DomainPolicyAction
+	if act.UnmarshalText([]byte(pol.Action)) != nil {
+		errs = append(errs, fmt.Errorf("Action: %w: %q", errors.ErrBadEnumValue, pol.Action))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateDomainPolicies returns an error if any of c.DomainPolicies is
+// invalid.
+func (c *Config) validateDomainPolicies() (err error) {
+	var errs []error
+	for i, pol := range c.DomainPolicies {
+		if pol == nil {
+			errs = append(errs, fmt.Errorf("at index %d: %w", i, errors.ErrNoValue))
+
+			continue
+		}
+
+		err = pol.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// domainPolicyTable is the ordered table of the domain policies.  The nil
+// *domainPolicyTable matches nothing.
+type domainPolicyTable struct {
+	// policies are the policies in the order of matching.
+	policies []*DomainPolicy
+
+	// patterns are the parsed patterns of the policies with the same index.
+	patterns []*zonePatterns
+}
+
+// newDomainPolicyTable returns the table of policies followed by the ones for
+// the excluded and pinned zones, see [Config.CacheProactiveExcludedZones] and
+// [Config.CacheProactivePinnedZones].  It returns nil if there are no policies.
+func newDomainPolicyTable(policies []*DomainPolicy, excluded, pinned []string) (t *domainPolicyTable) {
+	policies = slices.Clip(policies)
+	if len(excluded) > 0 {
+		policies = append(policies, &DomainPolicy{
+			Name:     "excluded zones",
+			Refresh:  DomainRefreshExcluded,
+			Patterns: excluded,
+		})
+	}
+
+	if len(pinned) > 0 {
+		policies = append(policies, &DomainPolicy{
+			Name:     "pinned zones",
+			Refresh:  DomainRefreshPinned,
+			Patterns: pinned,
+		})
+	}
+
+	if len(policies) == 0 {
+		return nil
+	}
+
+	t = &domainPolicyTable{
+		policies: policies,
+		patterns: make([]*zonePatterns, 0, len(policies)),
+	}
+
+	for _, pol := range policies {
+		t.patterns = append(t.patterns, newZonePatterns(pol.Patterns))
+	}
+
+	return t
+}
+
+// match returns the first policy matching name or nil if there is none.
+func (t *domainPolicyTable) match(name string) (pol *DomainPolicy) {
+	if t == nil {
+		return nil
+	}
+
+	for i, zp := range t.patterns {
+		if zp.match(name) {
+			return t.policies[i]
+		}
+	}
+
+	return nil
+}
+
+// matchQuestion returns the first policy matching the requested domain of m or
+// nil if there is none.
+func (t *domainPolicyTable) matchQuestion(m *dns.Msg) (pol *DomainPolicy) {
+	if t == nil || len(m.Question) == 0 {
+		return nil
+	}
+
+	return t.match(m.Question[0].Name)
+}
+
+// refreshPatterns returns the normalized patterns of the policies with the
+// refresh policy rp.
+func (t *domainPolicyTable) refreshPatterns(rp DomainRefreshPolicy) (patterns []string) {
+	if t == nil {
+		return nil
+	}
+
+	for i, pol := range t.policies {
+		if pol.Refresh == rp {
+			patterns = append(patterns, t.patterns[i].patterns()...)
+		}
+	}
+
+	return patterns
+}
+
+// upstreamConfigs returns the upstream configurations of the policies of t.
+func (t *domainPolicyTable) upstreamConfigs() (confs []*UpstreamConfig) {
+	if t == nil {
+		return nil
+	}
+
+	for _, pol := range t.policies {
+		if pol.Upstreams != nil {
+			confs = append(confs, pol.Upstreams)
+		}
+	}
+
+	return confs
+}
+
+// refreshPolicy returns the refresh policy of pol.  pol may be nil.
+func (pol *DomainPolicy) refreshPolicy() (rp DomainRefreshPolicy) {
+	if pol == nil {
+		return DomainRefreshDefault
+	}
+
+	return pol.Refresh
+}
+
+// bypassesCache returns true if the requests matching pol shouldn't use the
+// cache.  pol may be nil.
+func (pol *DomainPolicy) bypassesCache() (ok bool) {
+	return pol != nil && pol.CacheBypass
+}
+
+// ttlOverrides returns the TTL overrides of pol, falling back to minTTL and
+// maxTTL.  pol may be nil.
+func (pol *DomainPolicy) ttlOverrides(minTTL, maxTTL uint32) (polMin, polMax uint32) {
+	if pol == nil {
+		return minTTL, maxTTL
+	}
+
+	polMin, polMax = minTTL, maxTTL
+	if pol.CacheMinTTL > 0 {
+		polMin = pol.CacheMinTTL
+	}
+
+	if pol.CacheMaxTTL > 0 {
+		polMax = pol.CacheMaxTTL
+	}
+
+	return polMin, polMax
+}
+
+// MatchDomainPolicy returns the first policy from [Config.DomainPolicies]
+// matching name, which is applied to the requests for it.  It returns nil if
+// there is none.  The policies derived from the other pattern-list options,
+// like [Config.CacheProactivePinnedZones], are also returned.
+func (p *Proxy) MatchDomainPolicy(name string) (pol *DomainPolicy) {
+	return p.live.Load().policies.match(name)
+}
+
+// domainPolicy returns the policy for the request of d, if any.
+func (p *Proxy) domainPolicy(d *DNSContext) (pol *DomainPolicy) {
+	live := p.live.Load()
+	if live == nil {
+		// Shouldn't happen for a proxy created with [New], but the one
+		// constructed manually may still serve the requests from cache.
+		return nil
+	}
+
+	return live.policies.matchQuestion(d.Req)
+}
+
+// policyResponse returns the response to the request of d according to the
+// action of pol or nil if the request should be resolved.  pol may be nil.
+func (p *Proxy) policyResponse(d *DNSContext, pol *DomainPolicy) (resp *dns.Msg) {
+	if pol == nil {
+		return nil
+	}
+
+	switch pol.Action {
+	case DomainPolicyActionBlock:
+		resp = p.messages.NewMsgNXDOMAIN(d.Req)
+		d.ede = &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: "domain policy " + pol.Name,
+		}
+	case DomainPolicyActionRefuse:
+		resp = (&dns.Msg{}).SetRcode(d.Req, dns.RcodeRefused)
+		d.ede = &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeProhibited,
+			ExtraText: "domain policy " + pol.Name,
+		}
+	default:
+		return nil
+	}
+
+	p.logger.Debug("request filtered by domain policy", "policy", pol.Name, "action", pol.Action)
+	d.addTracef(StageRequestHandler, "domain policy %q: %s", pol.Name, pol.Action)
+
+	return resp
+}
+
+// filterEncrypted returns the upstreams from ups using the encrypted protocols.
+func filterEncrypted(ups []upstream.Upstream) (filtered []upstream.Upstream) {
+	for _, u := range ups {
+		if isEncrypted(u) {
+			filtered = append(filtered, u)
+		}
+	}
+
+	return filtered
+}
+
+// isEncrypted returns true if u uses an encrypted protocol, which is deduced
+// from the scheme of its address.
+func isEncrypted(u upstream.Upstream) (ok bool) {
+	scheme, _, found := strings.Cut(u.Address(), "://")
+
+	return found && scheme != "udp" && scheme != "tcp"
+}
+
+// refreshPolicy returns the refresh policy for the requested domain of m.
+func (s *cacheSettings) refreshPolicy(m *dns.Msg) (rp DomainRefreshPolicy) {
+	return s.policies.matchQuestion(m).refreshPolicy()
+}
+
+// ttlOverrides returns the minimum and the maximum TTL for the response m.
+func (s *cacheSettings) ttlOverrides(m *dns.Msg) (minTTL, maxTTL uint32) {
+	return s.policies.matchQuestion(m).ttlOverrides(s.cacheMinTTL, s.cacheMaxTTL)
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainPolicyTable_match(t *testing.T) {
+	t.Parallel()
+
+	first := &DomainPolicy{
+		Name:     "first",
+		Patterns: []string{"*.example.org"},
+	}
+	second := &DomainPolicy{
+		Name:     "second",
+		Patterns: []string{"example.org"},
+		Refresh:  DomainRefreshExcluded,
+	}
+
+	tbl := newDomainPolicyTable(
+		[]*DomainPolicy{first, second},
+		[]string{"example.net"},
+		[]string{"example.com"},
+	)
+
+	assert.Same(t, first, tbl.match("www.example.org."))
+	assert.Same(t, second, tbl.match("Example.Org"))
+	assert.Nil(t, tbl.match("example.info"))
+
+	assert.Equal(t, DomainRefreshExcluded, tbl.match("a.example.net").refreshPolicy())
+	assert.Equal(t, DomainRefreshPinned, tbl.match("a.example.com").refreshPolicy())
+	assert.Equal(t, DomainRefreshDefault, tbl.match("example.info").refreshPolicy())
+
+	assert.Equal(t, []string{"example.org", "example.net"}, tbl.refreshPatterns(DomainRefreshExcluded))
+	assert.Nil(t, (*domainPolicyTable)(nil).match("example.org"))
+}
+
+// newAddrUpstream returns an upstream with addr responding with an A record of
+// ip and counting the requests in queries.
+func newAddrUpstream(
+	tb testing.TB,
+	addr string,
+	ip net.IP,
+	queries *atomic.Uint32,
+) (u *dnsproxytest.Upstream) {
+	tb.Helper()
+
+	return &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			queries.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(tb, req.Question[0].Name, dns.TypeA, 10, ip)}
+
+			return resp, nil
+		},
+		OnAddress: func() (a string) { return addr },
+		OnClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_Resolve_domainPolicies(t *testing.T) {
+	generalIP := net.IP{192, 0, 2, 1}
+	policyIP := net.IP{192, 0, 2, 2}
+	encryptedIP := net.IP{192, 0, 2, 3}
+
+	var generalQueries, policyQueries, encryptedQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", generalIP, &generalQueries)
+	policyUps := newAddrUpstream(t, "tcp://192.0.2.54:53", policyIP, &policyQueries)
+	encrypted := newAddrUpstream(t, "tls://dns.example", encryptedIP, &encryptedQueries)
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{general, encrypted}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		DomainPolicies: []*DomainPolicy{{
+			Name:     "blocked",
+			Action:   DomainPolicyActionBlock,
+			Patterns: []string{"blocked.example"},
+		}, {
+			Name:     "refused",
+			Action:   DomainPolicyActionRefuse,
+			Patterns: []string{"refused.example"},
+		}, {
+			Upstreams:   &UpstreamConfig{Upstreams: []upstream.Upstream{policyUps}},
+			Name:        "routed",
+			Patterns:    []string{"routed.example"},
+			CacheMinTTL: 600,
+		}, {
+			Name:        "bypass",
+			Patterns:    []string{"bypass.example"},
+			CacheBypass: true,
+		}, {
+			Name:             "encrypted",
+			Patterns:         []string{"private.example"},
+			RequireEncrypted: true,
+		}},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T, host string) (resp *dns.Msg) {
+		t.Helper()
+
+		d := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Addr: netip.MustParseAddrPort("192.0.2.100:53"),
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+
+		return d.Res
+	}
+
+	t.Run("action", func(t *testing.T) {
+		assert.Equal(t, dns.RcodeNameError, resolve(t, "www.blocked.example.").Rcode)
+		assert.Equal(t, dns.RcodeRefused, resolve(t, "refused.example.").Rcode)
+	})
+
+	t.Run("routing", func(t *testing.T) {
+		for range 2 {
+			resp := resolve(t, "routed.example.")
+			require.Len(t, resp.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, policyIP, a.A.To4())
+			assert.Equal(t, uint32(600), a.Hdr.Ttl)
+		}
+
+		// The second response is served from cache.
+		assert.Equal(t, uint32(1), policyQueries.Load())
+	})
+
+	t.Run("bypass", func(t *testing.T) {
+		generalQueries.Store(0)
+		encryptedQueries.Store(0)
+
+		for range 2 {
+			resolve(t, "bypass.example.")
+		}
+
+		assert.Equal(t, uint32(2), generalQueries.Load()+encryptedQueries.Load())
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		generalQueries.Store(0)
+
+		for _, host := range []string{"a.private.example.", "b.private.example."} {
+			resp := resolve(t, host)
+			require.Len(t, resp.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, encryptedIP, a.A.To4())
+		}
+
+		assert.Zero(t, generalQueries.Load())
+	})
+
+	assert.Same(t, p.DomainPolicies[2], p.MatchDomainPolicy("www.routed.example."))
+}
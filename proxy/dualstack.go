@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// siblingQtype returns the type of the addresses of the other family than the
+// ones requested with qtype.  ok is false if qtype is neither A nor AAAA.
+func siblingQtype(qtype uint16) (sibling uint16, ok bool) {
+	switch qtype {
+	case dns.TypeA:
+		return dns.TypeAAAA, true
+	case dns.TypeAAAA:
+		return dns.TypeA, true
+	default:
+		return dns.TypeNone, false
+	}
+}
+
+// prefetchDualStack resolves and caches the addresses of the other family than
+// the ones requested in d in the background, unless those are already cached,
+// see [Config.CachePrefetchDualStack].  The prefetching is suspended under the
+// memory pressure.  d must have a single question and the cache must be
+// enabled.
+func (p *Proxy) prefetchDualStack(d *DNSContext) {
+	q := d.Req.Question[0]
+	sibling, ok := siblingQtype(q.Qtype)
+	if !p.CachePrefetchDualStack || !ok || q.Qclass != dns.ClassINET || p.memPressure.isActive() {
+		return
+	}
+
+	if d.clientCache != nil {
+		// The prefetched response would be resolved and cached for the other
+		// clients.
+		return
+	}
+
+	req := d.Req.Copy()
+	req.Question[0].Qtype = sibling
+	addDO(req)
+
+	// TODO(e.burkov):  Check the subnet cache as well, the responses to the
+	// requests with ECS are prefetched even if cached now.
+	key := msgToKey(req)
+	if p.cacheForContext(d).hasEntry(key) {
+		return
+	}
+
+	dctx := &DNSContext{
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		ReqECS:               cloneIPNet(d.ReqECS),
+		IsPrivateClient:      d.IsPrivateClient,
+		Req:                  req,
+	}
+
+	d.addTracef(StageCache, "prefetching %s", dns.TypeToString[sibling])
+
+	go p.shortFlighter.resolveOnce(p.runContext(), dctx, key, p.logger)
+}
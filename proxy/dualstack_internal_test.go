@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_prefetchDualStack(t *testing.T) {
+	const name = "example.org."
+
+	var mu sync.Mutex
+	queries := map[uint16]int{}
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			queries[q.Qtype]++
+
+			resp = (&dns.Msg{}).SetReply(req)
+			switch q.Qtype {
+			case dns.TypeA:
+				resp.Answer = []dns.RR{newRR(t, q.Name, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+			case dns.TypeAAAA:
+				resp.Answer = []dns.RR{newRR(t, q.Name, dns.TypeAAAA, defaultTestTTL, net.ParseIP("2001:db8::1"))}
+			default:
+				// Go on.
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		CachePrefetchDualStack: true,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(qtype uint16) {
+		d := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(name, qtype),
+			Addr: netip.MustParseAddrPort("1.2.3.4:53"),
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.Len(t, d.Res.Answer, 1)
+	}
+
+	resolve(dns.TypeA)
+
+	aaaaReq := (&dns.Msg{}).SetQuestion(name, dns.TypeAAAA)
+	addDO(aaaaReq)
+	require.Eventually(t, func() (ok bool) {
+		return p.cache.hasEntry(msgToKey(aaaaReq))
+	}, testTimeout, testTimeout/100)
+
+	// The prefetched response is served from cache, and the cached A records
+	// aren't prefetched again.
+	resolve(dns.TypeAAAA)
+	resolve(dns.TypeA)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, map[uint16]int{dns.TypeA: 1, dns.TypeAAAA: 1}, queries)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// upstreamErrorEDE returns the Extended DNS Error describing the failure of the
+// exchange with the upstreams, see RFC 8914.  It returns nil if err isn't a
+// network error, e.g. if there were no upstreams to exchange with.
+func upstreamErrorEDE(err error) (ede *dns.EDNS0_EDE) {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNoReachableAuthority,
+			ExtraText: "upstream timeout",
+		}
+	case netErr != nil:
+		return &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNetworkError,
+			ExtraText: "upstream network error",
+		}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamErrorEDE(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		err      error
+		name     string
+		wantCode uint16
+		wantNil  bool
+	}{{
+		err:     nil,
+		name:    "nil",
+		wantNil: true,
+	}, {
+		err:      context.DeadlineExceeded,
+		name:     "context_deadline",
+		wantCode: dns.ExtendedErrorCodeNoReachableAuthority,
+	}, {
+		err:      fmt.Errorf("reading: %w", os.ErrDeadlineExceeded),
+		name:     "io_deadline",
+		wantCode: dns.ExtendedErrorCodeNoReachableAuthority,
+	}, {
+		err:      &net.OpError{Op: "dial", Err: os.ErrPermission},
+		name:     "network",
+		wantCode: dns.ExtendedErrorCodeNetworkError,
+	}, {
+		err:     assert.AnError,
+		name:    "other",
+		wantNil: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ede := upstreamErrorEDE(tc.err)
+			if tc.wantNil {
+				assert.Nil(t, ede)
+
+				return
+			}
+
+			require.NotNil(t, ede)
+			assert.Equal(t, tc.wantCode, ede.InfoCode)
+		})
+	}
+}
+
+// respEDE returns the extended DNS error of resp, if any.
+func respEDE(resp *dns.Msg) (ede *dns.EDNS0_EDE) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+
+	return nil
+}
+
+func TestProxy_Resolve_extendedErrors(t *testing.T) {
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			if req.Question[0].Name == "timeout.example." {
+				return nil, fmt.Errorf("exchanging: %w", os.ErrDeadlineExceeded)
+			}
+
+			return nil, assert.AnError
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         slogutil.NewDiscardLogger(),
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		DomainPolicies: []*DomainPolicy{{
+			Name:     "blocked",
+			Action:   DomainPolicyActionBlock,
+			Patterns: []string{"blocked.example"},
+		}, {
+			Name:     "refused",
+			Action:   DomainPolicyActionRefuse,
+			Patterns: []string{"refused.example"},
+		}},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T, host string, edns bool) (resp *dns.Msg) {
+		t.Helper()
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+
+		d := &DNSContext{
+			Req:  req,
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+		_ = p.Resolve(context.Background(), d)
+		require.NotNil(t, d.Res)
+
+		return d.Res
+	}
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantRcode int
+		wantCode  uint16
+	}{{
+		name:      "timeout",
+		host:      "timeout.example.",
+		wantRcode: dns.RcodeServerFailure,
+		wantCode:  dns.ExtendedErrorCodeNoReachableAuthority,
+	}, {
+		name:      "blocked",
+		host:      "blocked.example.",
+		wantRcode: dns.RcodeNameError,
+		wantCode:  dns.ExtendedErrorCodeBlocked,
+	}, {
+		name:      "refused",
+		host:      "refused.example.",
+		wantRcode: dns.RcodeRefused,
+		wantCode:  dns.ExtendedErrorCodeProhibited,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := resolve(t, tc.host, true)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			ede := respEDE(resp)
+			require.NotNil(t, ede)
+			assert.Equal(t, tc.wantCode, ede.InfoCode)
+
+			// The requests without EDNS get no extended errors.
+			resp = resolve(t, tc.host, false)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Nil(t, resp.IsEdns0())
+		})
+	}
+
+	t.Run("unknown_error", func(t *testing.T) {
+		resp := resolve(t, "error.example.", true)
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+		assert.Nil(t, resp.IsEdns0())
+	})
+}
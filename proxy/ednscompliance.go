@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"slices"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// EDNSComplianceConfig is the configuration of handling the EDNS(0) OPT
+// records of the requests, see RFC 6891.  Without it, the OPT records are
+// forwarded to upstreams as sent by clients.
+type EDNSComplianceConfig struct {
+	// RespondBadVersion makes the proxy respond to the requests with EDNS
+	// version greater than 0 with BADVERS instead of resolving them, see RFC
+	// 6891 Section 6.1.3.
+	RespondBadVersion bool
+
+	// ClearUnknownFlags makes the proxy clear the unassigned flags of the OPT
+	// records, the Z bits, before resolving the requests, since the unknown
+	// flags must be ignored, see RFC 6891 Section 6.1.4.
+	ClearUnknownFlags bool
+
+	// AllowedOptions are the codes of the EDNS(0) options, e.g.
+	// [dns.EDNS0SUBNET], which are forwarded from the clients to the upstreams
+	// and back.  If not empty, the other options are stripped from the
+	// requests before resolving them and from the responses before writing
+	// them.  The options the proxy adds itself, e.g. the Extended DNS Errors,
+	// aren't affected.
+	AllowedOptions []uint16
+
+	// DeniedOptions are the codes of the EDNS(0) options, e.g.
+	// [dns.EDNS0COOKIE], which are stripped the same way as the ones missing
+	// from AllowedOptions.  It takes precedence over AllowedOptions.
+	DeniedOptions []uint16
+}
+
+// EDNSComplianceStatistics contains the numbers of the requests handled due to
+// [EDNSComplianceConfig].
+type EDNSComplianceStatistics struct {
+	// BadVersion is the number of requests responded with BADVERS.
+	BadVersion uint64
+
+	// UnknownFlags is the number of requests which unknown EDNS flags have
+	// been cleared.
+	UnknownFlags uint64
+
+	// StrippedOptions is the number of EDNS(0) options stripped from the
+	// requests and the responses.
+	StrippedOptions uint64
+}
+
+// ednsCounters is the concurrency-safe storage of the data for
+// [EDNSComplianceStatistics].
+type ednsCounters struct {
+	badVersion      atomic.Uint64
+	unknownFlags    atomic.Uint64
+	strippedOptions atomic.Uint64
+}
+
+// EDNSComplianceStatistics returns the numbers of the requests handled due to
+// [Config.EDNSCompliance] since p has been created.
+func (p *Proxy) EDNSComplianceStatistics() (s *EDNSComplianceStatistics) {
+	return &EDNSComplianceStatistics{
+		BadVersion:      p.ednsHandled.badVersion.Load(),
+		UnknownFlags:    p.ednsHandled.unknownFlags.Load(),
+		StrippedOptions: p.ednsHandled.strippedOptions.Load(),
+	}
+}
+
+// isBadEDNSVersion returns true if req has an OPT record of unsupported
+// version and p is configured to respond to those with BADVERS.
+func (p *Proxy) isBadEDNSVersion(req *dns.Msg) (ok bool) {
+	if p.EDNSCompliance == nil || !p.EDNSCompliance.RespondBadVersion {
+		return false
+	}
+
+	opt := req.IsEdns0()
+
+	return opt != nil && opt.Version() > 0
+}
+
+// newMsgBADVERS returns a BADVERS response for req, which must have an OPT
+// record.
+func (p *Proxy) newMsgBADVERS(req *dns.Msg) (resp *dns.Msg) {
+	p.ednsHandled.badVersion.Add(1)
+
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeBadVers)
+	resp.RecursionAvailable = true
+
+	// The response must contain an OPT record of the highest supported
+	// version, which also carries the upper bits of the extended RCODE.
+	resp.SetEdns0(req.IsEdns0().UDPSize(), false)
+
+	return resp
+}
+
+// clearUnknownEDNSFlags clears the unassigned flags of the OPT record of req if
+// p is configured to do so.
+func (p *Proxy) clearUnknownEDNSFlags(req *dns.Msg) {
+	if p.EDNSCompliance == nil || !p.EDNSCompliance.ClearUnknownFlags {
+		return
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil || opt.Z() == 0 {
+		return
+	}
+
+	opt.SetZ(0)
+	p.ednsHandled.unknownFlags.Add(1)
+}
+
+// isForwarded returns true if the EDNS(0) option with code should be forwarded
+// in accordance with c.
+func (c *EDNSComplianceConfig) isForwarded(code uint16) (ok bool) {
+	if slices.Contains(c.DeniedOptions, code) {
+		return false
+	}
+
+	return len(c.AllowedOptions) == 0 || slices.Contains(c.AllowedOptions, code)
+}
+
+// filterEDNSOptions strips the EDNS(0) options of msg, which may be a request
+// or a response, not forwarded in accordance with [EDNSComplianceConfig].  msg
+// must not be shared, since it's modified in place.  msg may be nil.
+func (p *Proxy) filterEDNSOptions(msg *dns.Msg) {
+	c := p.EDNSCompliance
+	if c == nil || (len(c.AllowedOptions) == 0 && len(c.DeniedOptions) == 0) || msg == nil {
+		return
+	}
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	n := len(opt.Option)
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) (del bool) {
+		return !c.isForwarded(o.Option())
+	})
+
+	if stripped := n - len(opt.Option); stripped > 0 {
+		p.ednsHandled.strippedOptions.Add(uint64(stripped))
+	}
+}
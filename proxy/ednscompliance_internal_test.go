@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEDNSRequest returns a new request with an OPT record of the specified
+// version and Z flags.
+func newEDNSRequest(version uint8, z uint16) (req *dns.Msg) {
+	req = (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+
+	opt := req.IsEdns0()
+	opt.SetVersion(version)
+	opt.SetZ(z)
+
+	return req
+}
+
+func TestProxy_validateRequest_badVersion(t *testing.T) {
+	p := &Proxy{
+		Config: Config{EDNSCompliance: &EDNSComplianceConfig{RespondBadVersion: true}},
+		logger: slogutil.NewDiscardLogger(),
+	}
+	p.initLoggers()
+
+	d := &DNSContext{
+		Proto: ProtoUDP,
+		Req:   newEDNSRequest(1, 0),
+	}
+
+	resp := p.validateRequest(d)
+	require.NotNil(t, resp)
+
+	// Make sure the extended RCODE survives packing.
+	packed, err := resp.Pack()
+	require.NoError(t, err)
+
+	unpacked := &dns.Msg{}
+	require.NoError(t, unpacked.Unpack(packed))
+
+	assert.Equal(t, dns.RcodeBadVers, unpacked.Rcode)
+
+	opt := unpacked.IsEdns0()
+	require.NotNil(t, opt)
+
+	assert.Zero(t, opt.Version())
+	assert.Equal(t, &EDNSComplianceStatistics{BadVersion: 1}, p.EDNSComplianceStatistics())
+
+	p.EDNSCompliance = nil
+	assert.False(t, p.isBadEDNSVersion(d.Req))
+}
+
+func TestProxy_clearUnknownEDNSFlags(t *testing.T) {
+	p := &Proxy{
+		Config: Config{EDNSCompliance: &EDNSComplianceConfig{ClearUnknownFlags: true}},
+	}
+
+	req := newEDNSRequest(0, 0x1234)
+	p.clearUnknownEDNSFlags(req)
+
+	opt := req.IsEdns0()
+	assert.Zero(t, opt.Z())
+	assert.True(t, opt.Do())
+
+	// The requests without unknown flags aren't counted.
+	p.clearUnknownEDNSFlags(newEDNSRequest(0, 0))
+	p.clearUnknownEDNSFlags((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+
+	assert.Equal(t, &EDNSComplianceStatistics{UnknownFlags: 1}, p.EDNSComplianceStatistics())
+
+	p.EDNSCompliance = nil
+	req = newEDNSRequest(0, 0x1234)
+	p.clearUnknownEDNSFlags(req)
+
+	assert.Equal(t, uint16(0x1234), req.IsEdns0().Z())
+}
+
+func TestProxy_filterEDNSOptions(t *testing.T) {
+	newMsg := func() (m *dns.Msg) {
+		m = newEDNSRequest(0, 0)
+		opt := m.IsEdns0()
+		opt.Option = []dns.EDNS0{
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, Address: net.IP{192, 0, 2, 0}},
+			&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+			&dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte{1}},
+		}
+
+		return m
+	}
+
+	codes := func(m *dns.Msg) (res []uint16) {
+		for _, o := range m.IsEdns0().Option {
+			res = append(res, o.Option())
+		}
+
+		return res
+	}
+
+	testCases := []struct {
+		conf *EDNSComplianceConfig
+		name string
+		want []uint16
+	}{{
+		conf: nil,
+		name: "no_config",
+		want: []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0LOCALSTART},
+	}, {
+		conf: &EDNSComplianceConfig{
+			DeniedOptions: []uint16{dns.EDNS0COOKIE},
+		},
+		name: "denied",
+		want: []uint16{dns.EDNS0SUBNET, dns.EDNS0LOCALSTART},
+	}, {
+		conf: &EDNSComplianceConfig{
+			AllowedOptions: []uint16{dns.EDNS0SUBNET},
+		},
+		name: "allowed",
+		want: []uint16{dns.EDNS0SUBNET},
+	}, {
+		conf: &EDNSComplianceConfig{
+			AllowedOptions: []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE},
+			DeniedOptions:  []uint16{dns.EDNS0COOKIE},
+		},
+		name: "both",
+		want: []uint16{dns.EDNS0SUBNET},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{
+				Config: Config{EDNSCompliance: tc.conf},
+			}
+
+			msg := newMsg()
+			p.filterEDNSOptions(msg)
+
+			assert.Equal(t, tc.want, codes(msg))
+
+			wantStripped := uint64(3 - len(tc.want))
+			assert.Equal(t, wantStripped, p.EDNSComplianceStatistics().StrippedOptions)
+		})
+	}
+
+	t.Run("no_opt", func(t *testing.T) {
+		p := &Proxy{
+			Config: Config{EDNSCompliance: &EDNSComplianceConfig{
+				DeniedOptions: []uint16{dns.EDNS0COOKIE},
+			}},
+		}
+
+		p.filterEDNSOptions(nil)
+		p.filterEDNSOptions((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+
+		assert.Zero(t, p.EDNSComplianceStatistics().StrippedOptions)
+	})
+}
@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"cmp"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// redactedSecret replaces the secrets within [EffectiveConfig].  It's the same
+// as the one used by [url.URL.Redacted].
+const redactedSecret = "xxxxx"
+
+// EffectiveConfig is the runtime configuration of [Proxy] after applying the
+// defaults and the reloads, see [Proxy.EffectiveConfig].  The secrets, i.e. the
+// passwords and the tokens, are replaced with "xxxxx".  It's meant to be
+// serialized, e.g. with encoding/json, to verify the behavior of the proxy.
+type EffectiveConfig struct {
+	// Upstreams are the general upstreams, see [Config.UpstreamConfig].  It's
+	// nil in the cache replica mode without upstreams.
+	Upstreams *EffectiveUpstreamConfig `json:"upstreams,omitempty"`
+
+	// PrivateRDNSUpstreams are the upstreams for the private reverse DNS
+	// lookups, see [Config.PrivateRDNSUpstreamConfig].
+	PrivateRDNSUpstreams *EffectiveUpstreamConfig `json:"private_rdns_upstreams,omitempty"`
+
+	// Fallbacks are the fallback upstreams, see [Config.Fallbacks].
+	Fallbacks *EffectiveUpstreamConfig `json:"fallbacks,omitempty"`
+
+	// CacheProactiveRefreshUpstreams are the upstreams for the proactive cache
+	// refreshes, see [Config.CacheProactiveRefreshUpstreams].
+	CacheProactiveRefreshUpstreams *EffectiveUpstreamConfig `json:"cache_proactive_refresh_upstreams,omitempty"`
+
+	// Cache is the configuration of the cache.  It's nil if the cache is
+	// disabled.
+	Cache *EffectiveCacheConfig `json:"cache,omitempty"`
+
+	// Ratelimit is the configuration of the rate limiting.  It's nil if the
+	// rate limiting is disabled.
+	Ratelimit *EffectiveRatelimitConfig `json:"ratelimit,omitempty"`
+
+	// ListenAddrs are the addresses the proxy listens on, keyed by the
+	// protocol.  They are only known while the proxy is running.
+	ListenAddrs map[Proto][]string `json:"listen_addrs,omitempty"`
+
+	// CacheReplicas are the URLs the cache snapshots are pushed to, see
+	// [CacheReplicationConfig.Replicas], with the passwords redacted.
+	CacheReplicas []string `json:"cache_replicas,omitempty"`
+
+	// UpstreamMode is the upstream mode, see [Config.UpstreamMode].
+	UpstreamMode UpstreamMode `json:"upstream_mode"`
+
+	// HTTPSUserinfo is the userinfo required from the DNS-over-HTTPS clients,
+	// see [Config.Userinfo], with the password redacted.
+	HTTPSUserinfo string `json:"https_userinfo,omitempty"`
+
+	// HTTPSServerName is the Server header of the DNS-over-HTTPS responses,
+	// see [Config.HTTPSServerName].
+	HTTPSServerName string `json:"https_server_name,omitempty"`
+
+	// DNSCryptProviderName is the DNSCrypt provider name, see
+	// [Config.DNSCryptProviderName].
+	DNSCryptProviderName string `json:"dnscrypt_provider_name,omitempty"`
+
+	// CacheReplicationToken is the redacted token sent to the cache replicas,
+	// if any.
+	CacheReplicationToken string `json:"cache_replication_token,omitempty"`
+
+	// CacheReplicaListenAddr is the address the cache snapshots are received
+	// on in the cache replica mode, see [CacheReplicaConfig.ListenAddr].
+	CacheReplicaListenAddr string `json:"cache_replica_listen_addr,omitempty"`
+
+	// CacheReplicaToken is the redacted token required from the primary in the
+	// cache replica mode, if any.
+	CacheReplicaToken string `json:"cache_replica_token,omitempty"`
+
+	// MaxGoroutines is the maximum number of the requests processed at the
+	// same time, see [Config.MaxGoroutines].  Zero means no limit.
+	MaxGoroutines uint `json:"max_goroutines"`
+
+	// EnableDNSSECValidation is true if the responses are validated with
+	// DNSSEC, see [Config.EnableDNSSECValidation].
+	EnableDNSSECValidation bool `json:"enable_dnssec_validation"`
+
+	// EnableEDNSClientSubnet is true if the EDNS Client Subnet option is sent,
+	// see [Config.EnableEDNSClientSubnet].
+	EnableEDNSClientSubnet bool `json:"enable_edns_client_subnet"`
+
+	// RefuseAny is true if the requests of type ANY are refused, see
+	// [Config.RefuseAny].
+	RefuseAny bool `json:"refuse_any"`
+
+	// RequireClientAuth is true if the clients of the encrypted protocols are
+	// required to authenticate, see [Config.RequireClientAuth].
+	RequireClientAuth bool `json:"require_client_auth"`
+
+	// HTTP3 is true if DNS-over-HTTP/3 is served, see [Config.HTTP3].
+	HTTP3 bool `json:"http3"`
+
+	// UseDNS64 is true if DNS64 is enabled, see [Config.UseDNS64].
+	UseDNS64 bool `json:"use_dns64"`
+
+	// UsePrivateRDNS is true if the private reverse DNS lookups are resolved
+	// with the private upstreams, see [Config.UsePrivateRDNS].
+	UsePrivateRDNS bool `json:"use_private_rdns"`
+}
+
+// EffectiveUpstreamConfig is the set of upstreams within [EffectiveConfig].
+// The upstreams are represented by their addresses with the passwords
+// redacted.
+type EffectiveUpstreamConfig struct {
+	// DomainReservedUpstreams maps the domains to the upstreams, see
+	// [UpstreamConfig.DomainReservedUpstreams].
+	DomainReservedUpstreams map[string][]string `json:"domain_reserved_upstreams,omitempty"`
+
+	// SpecifiedDomainUpstreams maps the specific domain names to the
+	// upstreams, see [UpstreamConfig.SpecifiedDomainUpstreams].
+	SpecifiedDomainUpstreams map[string][]string `json:"specified_domain_upstreams,omitempty"`
+
+	// Upstreams are the default upstreams, see [UpstreamConfig.Upstreams].
+	Upstreams []string `json:"upstreams"`
+}
+
+// EffectiveCacheConfig is the configuration of the cache within
+// [EffectiveConfig].
+type EffectiveCacheConfig struct {
+	// EvictionPolicy is the eviction policy, see [Config.CacheEvictionPolicy].
+	EvictionPolicy CacheEvictionPolicy `json:"eviction_policy"`
+
+	// PinnedZones are the zones always refreshed proactively, see
+	// [Config.CacheProactivePinnedZones] and [DomainRefreshPinned].
+	PinnedZones []string `json:"pinned_zones,omitempty"`
+
+	// ExcludedZones are the zones never refreshed proactively, see
+	// [Config.CacheProactiveExcludedZones] and [DomainRefreshExcluded].
+	ExcludedZones []string `json:"excluded_zones,omitempty"`
+
+	// FilePath is the path to the persistent cache file, see
+	// [Config.CacheFilePath].
+	FilePath string `json:"file_path,omitempty"`
+
+	// SizeBytes is the size of the cache in bytes.
+	SizeBytes int `json:"size_bytes"`
+
+	// MaxEntries is the maximum number of the cached responses, see
+	// [Config.CacheMaxEntries].  Zero means no limit.
+	MaxEntries int `json:"max_entries"`
+
+	// Shards is the number of shards of the cache, see [Config.CacheShards].
+	Shards int `json:"shards"`
+
+	// OptimisticAnswerTTL is the TTL of the expired responses, see
+	// [Config.CacheOptimisticAnswerTTL].
+	OptimisticAnswerTTL timeutil.Duration `json:"optimistic_answer_ttl"`
+
+	// OptimisticMaxAge is the maximum age of the expired responses, see
+	// [Config.CacheOptimisticMaxAge].
+	OptimisticMaxAge timeutil.Duration `json:"optimistic_max_age"`
+
+	// ProactiveRefreshTime is the time before the expiration of an entry when
+	// it's refreshed, see [Config.CacheProactiveRefreshTime].
+	ProactiveRefreshTime timeutil.Duration `json:"proactive_refresh_time"`
+
+	// ProactiveCooldownPeriod is the period the requests are counted within,
+	// see [Config.CacheProactiveCooldownPeriod].
+	ProactiveCooldownPeriod timeutil.Duration `json:"proactive_cooldown_period"`
+
+	// ProactiveCooldownThreshold is the minimum number of the requests within
+	// ProactiveCooldownPeriod for an entry to be refreshed, see
+	// [Config.CacheProactiveCooldownThreshold].
+	ProactiveCooldownThreshold int `json:"proactive_cooldown_threshold"`
+
+	// MinTTL is the minimum TTL of the responses, see [Config.CacheMinTTL].
+	MinTTL uint32 `json:"min_ttl"`
+
+	// MaxTTL is the maximum TTL of the responses, see [Config.CacheMaxTTL].
+	MaxTTL uint32 `json:"max_ttl"`
+
+	// Optimistic is true if the expired responses are served, see
+	// [Config.CacheOptimistic].
+	Optimistic bool `json:"optimistic"`
+
+	// PerClient is true if the responses are cached per client policy, see
+	// [Config.CachePerClient].
+	PerClient bool `json:"per_client"`
+
+	// ProactiveAdaptive is true if the refreshes are tuned per entry, see
+	// [Config.CacheProactiveAdaptive].
+	ProactiveAdaptive bool `json:"proactive_adaptive"`
+
+	// WithECS is true if the responses are cached per client subnet.
+	WithECS bool `json:"with_ecs"`
+}
+
+// EffectiveRatelimitConfig is the configuration of the rate limiting within
+// [EffectiveConfig].
+type EffectiveRatelimitConfig struct {
+	// Policy is the policy of handling the limited requests, see
+	// [Config.RatelimitPolicy].
+	Policy RatelimitPolicy `json:"policy"`
+
+	// Whitelist are the addresses not limited, see
+	// [Config.RatelimitWhitelist].
+	Whitelist []string `json:"whitelist,omitempty"`
+
+	// WhitelistSubnets are the subnets not limited, see
+	// [Config.RatelimitWhitelistSubnets].
+	WhitelistSubnets []string `json:"whitelist_subnets,omitempty"`
+
+	// RPS is the number of requests per second allowed, see
+	// [Config.Ratelimit].
+	RPS int `json:"rps"`
+
+	// SubnetLenIPv4 is the length of the IPv4 subnets the clients are limited
+	// within, see [Config.RatelimitSubnetLenIPv4].
+	SubnetLenIPv4 int `json:"subnet_len_ipv4"`
+
+	// SubnetLenIPv6 is the length of the IPv6 subnets the clients are limited
+	// within, see [Config.RatelimitSubnetLenIPv6].
+	SubnetLenIPv6 int `json:"subnet_len_ipv6"`
+}
+
+// EffectiveConfig returns the current runtime configuration of p with the
+// secrets redacted.  Unlike the embedded [Config], it reflects the defaults
+// applied by [New] and the settings changed by [Proxy.Reload].  It's safe for
+// concurrent use.
+func (p *Proxy) EffectiveConfig() (c *EffectiveConfig) {
+	live := p.live.Load()
+
+	c = &EffectiveConfig{
+		Upstreams:                      newEffectiveUpstreamConfig(live.upstreams),
+		PrivateRDNSUpstreams:           newEffectiveUpstreamConfig(live.private),
+		Fallbacks:                      newEffectiveUpstreamConfig(live.fallbacks),
+		CacheProactiveRefreshUpstreams: newEffectiveUpstreamConfig(p.CacheProactiveRefreshUpstreams),
+		Cache:                          p.effectiveCacheConfig(),
+		Ratelimit:                      p.effectiveRatelimitConfig(),
+		ListenAddrs:                    p.effectiveListenAddrs(),
+		UpstreamMode:                   p.UpstreamMode,
+		HTTPSServerName:                p.HTTPSServerName,
+		DNSCryptProviderName:           p.DNSCryptProviderName,
+		MaxGoroutines:                  p.MaxGoroutines,
+		EnableDNSSECValidation:         p.EnableDNSSECValidation,
+		EnableEDNSClientSubnet:         p.EnableEDNSClientSubnet,
+		RefuseAny:                      p.RefuseAny,
+		RequireClientAuth:              p.RequireClientAuth,
+		HTTP3:                          p.HTTP3,
+		UseDNS64:                       p.UseDNS64,
+		UsePrivateRDNS:                 p.UsePrivateRDNS,
+	}
+
+	if ui := p.Userinfo; ui != nil {
+		c.HTTPSUserinfo = ui.Username()
+		if _, ok := ui.Password(); ok {
+			c.HTTPSUserinfo += ":" + redactedSecret
+		}
+	}
+
+	if r := p.CacheReplication; r != nil {
+		for _, u := range r.Replicas {
+			c.CacheReplicas = append(c.CacheReplicas, u.Redacted())
+		}
+
+		c.CacheReplicationToken = redactSecret(r.Token)
+	}
+
+	if r := p.CacheReplica; r != nil {
+		c.CacheReplicaListenAddr = r.ListenAddr.String()
+		c.CacheReplicaToken = redactSecret(r.Token)
+	}
+
+	return c
+}
+
+// newEffectiveUpstreamConfig returns the representation of uc within
+// [EffectiveConfig].  It returns nil if uc is nil.
+func newEffectiveUpstreamConfig(uc *UpstreamConfig) (c *EffectiveUpstreamConfig) {
+	if uc == nil {
+		return nil
+	}
+
+	return &EffectiveUpstreamConfig{
+		DomainReservedUpstreams:  upstreamAddrsMap(uc.DomainReservedUpstreams),
+		SpecifiedDomainUpstreams: upstreamAddrsMap(uc.SpecifiedDomainUpstreams),
+		Upstreams:                upstreamAddrs(uc.Upstreams),
+	}
+}
+
+// upstreamAddrsMap returns the redacted addresses of the upstreams from m with
+// the same keys.  It returns nil if m is empty.
+func upstreamAddrsMap(m map[string][]upstream.Upstream) (addrs map[string][]string) {
+	if len(m) == 0 {
+		return nil
+	}
+
+	addrs = make(map[string][]string, len(m))
+	for domain, ups := range m {
+		addrs[domain] = upstreamAddrs(ups)
+	}
+
+	return addrs
+}
+
+// upstreamAddrs returns the redacted addresses of ups.
+func upstreamAddrs(ups []upstream.Upstream) (addrs []string) {
+	addrs = make([]string, 0, len(ups))
+	for _, u := range ups {
+		addrs = append(addrs, redactAddress(u.Address()))
+	}
+
+	return addrs
+}
+
+// redactAddress returns addr with the password of the URL redacted, if any.
+func redactAddress(addr string) (redacted string) {
+	if !strings.Contains(addr, "@") {
+		return addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		// Don't risk showing the secret.
+		return redactedSecret
+	}
+
+	return u.Redacted()
+}
+
+// redactSecret returns [redactedSecret] if secret isn't empty.
+func redactSecret(secret string) (redacted string) {
+	if secret == "" {
+		return ""
+	}
+
+	return redactedSecret
+}
+
+// effectiveCacheConfig returns the current configuration of the cache within
+// [EffectiveConfig].  It returns nil if the cache is disabled.
+func (p *Proxy) effectiveCacheConfig() (c *EffectiveCacheConfig) {
+	if p.cache == nil {
+		return nil
+	}
+
+	s := p.cache.settings.Load()
+
+	size := defaultCacheSize
+	if p.CacheSizeBytes > 0 {
+		size = p.CacheSizeBytes
+	}
+
+	return &EffectiveCacheConfig{
+		EvictionPolicy:             cmp.Or(p.CacheEvictionPolicy, CacheEvictionPolicyLRU),
+		PinnedZones:                s.policies.refreshPatterns(DomainRefreshPinned),
+		ExcludedZones:              s.policies.refreshPatterns(DomainRefreshExcluded),
+		FilePath:                   p.CacheFilePath,
+		SizeBytes:                  size,
+		MaxEntries:                 p.CacheMaxEntries,
+		Shards:                     int(p.cache.shards),
+		OptimisticAnswerTTL:        timeutil.Duration(p.cache.optimisticTTL),
+		OptimisticMaxAge:           timeutil.Duration(p.cache.optimisticMaxAge),
+		ProactiveRefreshTime:       timeutil.Duration(s.proactiveRefreshTime),
+		ProactiveCooldownPeriod:    timeutil.Duration(s.cooldownPeriod),
+		ProactiveCooldownThreshold: s.cooldownThreshold,
+		MinTTL:                     s.cacheMinTTL,
+		MaxTTL:                     s.cacheMaxTTL,
+		Optimistic:                 p.cache.optimistic,
+		PerClient:                  p.CachePerClient,
+		ProactiveAdaptive:          s.adaptive,
+		WithECS:                    p.cache.itemsWithSubnet != nil,
+	}
+}
+
+// effectiveRatelimitConfig returns the configuration of the rate limiting
+// within [EffectiveConfig].  It returns nil if the rate limiting is disabled.
+func (p *Proxy) effectiveRatelimitConfig() (c *EffectiveRatelimitConfig) {
+	if p.Ratelimit <= 0 {
+		return nil
+	}
+
+	c = &EffectiveRatelimitConfig{
+		Policy:        p.RatelimitPolicy,
+		RPS:           p.Ratelimit,
+		SubnetLenIPv4: p.RatelimitSubnetLenIPv4,
+		SubnetLenIPv6: p.RatelimitSubnetLenIPv6,
+	}
+
+	for _, addr := range p.RatelimitWhitelist {
+		c.Whitelist = append(c.Whitelist, addr.String())
+	}
+
+	for _, pref := range p.RatelimitWhitelistSubnets {
+		c.WhitelistSubnets = append(c.WhitelistSubnets, pref.String())
+	}
+
+	return c
+}
+
+// effectiveListenAddrs returns the addresses p listens on within
+// [EffectiveConfig].  It returns nil if p isn't running.
+func (p *Proxy) effectiveListenAddrs() (addrs map[Proto][]string) {
+	protos := []Proto{ProtoUDP, ProtoTCP, ProtoTLS, ProtoHTTPS, ProtoQUIC, ProtoDNSCrypt}
+	for _, proto := range protos {
+		for _, addr := range p.Addrs(proto) {
+			if addrs == nil {
+				addrs = map[Proto][]string{}
+			}
+
+			addrs[proto] = append(addrs[proto], addr.String())
+		}
+	}
+
+	return addrs
+}
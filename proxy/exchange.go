@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"cmp"
+	"context"
 	"fmt"
+	"math/rand/v2"
+	"slices"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -13,28 +17,41 @@ import (
 
 // exchangeUpstreams resolves req using the given upstreams.  It returns the DNS
 // response, the upstream that successfully resolved the request, and the error
-// if any.
+// if any.  The upstreams aren't tried anymore once ctx is done.
 func (p *Proxy) exchangeUpstreams(
+	ctx context.Context,
 	req *dns.Msg,
 	ups []upstream.Upstream,
 ) (resp *dns.Msg, u upstream.Upstream, err error) {
 	switch p.UpstreamMode {
 	case UpstreamModeParallel:
-		return upstream.ExchangeParallel(ups, req)
+		return upstream.ExchangeParallel(ctx, ups, req)
+	case UpstreamModeFastest:
+		return p.exchangeFastest(ctx, req, ups)
 	case UpstreamModeFastestAddr:
 		switch req.Question[0].Qtype {
 		case dns.TypeA, dns.TypeAAAA:
-			return p.fastestAddr.ExchangeFastest(req, ups)
+			return p.fastestAddr.ExchangeFastest(ctx, req, ups)
 		default:
 			// Go on to the load-balancing mode.
 		}
+	case UpstreamModeRace:
+		if len(p.RaceQueryTypes) == 0 || slices.Contains(p.RaceQueryTypes, req.Question[0].Qtype) {
+			return upstream.ExchangeRace(ctx, ups, req)
+		}
+
+		// Go on to the load-balancing mode.
 	default:
 		// Go on to the load-balancing mode.
 	}
 
+	if p.UpstreamRetry != nil {
+		return p.exchangeRetrying(ctx, req, ups, p.loadBalanceOrder(ups))
+	}
+
 	if len(ups) == 1 {
 		u = ups[0]
-		resp, _, err = p.exchange(u, req)
+		resp, _, err = p.exchange(ctx, u, req)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -50,11 +67,14 @@ func (p *Proxy) exchangeUpstreams(
 		u = ups[i]
 
 		var elapsed time.Duration
-		resp, elapsed, err = p.exchange(u, req)
+		resp, elapsed, err = p.exchange(ctx, u, req)
 		if err == nil {
 			p.updateRTT(u.Address(), elapsed)
 
 			return resp, u, nil
+		} else if ctx.Err() != nil {
+			// Don't penalize the upstream for the aborted exchange.
+			return nil, nil, err
 		}
 
 		errs = append(errs, err)
@@ -69,15 +89,113 @@ func (p *Proxy) exchangeUpstreams(
 	return nil, nil, err
 }
 
+// loadBalanceOrder returns the indexes of ups in the order they should be tried
+// in the load-balancing mode.
+func (p *Proxy) loadBalanceOrder(ups []upstream.Upstream) (order []int) {
+	if len(ups) == 1 {
+		return []int{0}
+	}
+
+	order = make([]int, 0, len(ups))
+	w := sampleuv.NewWeighted(p.calcWeights(ups), p.randSrc)
+	for i, ok := w.Take(); ok; i, ok = w.Take() {
+		order = append(order, i)
+	}
+
+	return order
+}
+
+// exchangeFastest resolves req using the upstream with the lowest EWMA of the
+// response time, falling back to the others in the order of their EWMA.  The
+// upstreams without measurements are tried first, and for about one in
+// [fastestProbeRate] requests a random other upstream is tried first to
+// refresh its measurement.
+func (p *Proxy) exchangeFastest(
+	ctx context.Context,
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	order := p.fastestOrder(ups)
+	if p.UpstreamRetry != nil {
+		return p.exchangeRetrying(ctx, req, ups, order)
+	}
+
+	var errs []error
+	for _, i := range order {
+		u = ups[i]
+
+		var elapsed time.Duration
+		resp, elapsed, err = p.exchange(ctx, u, req)
+		if err == nil {
+			p.updateRTT(u.Address(), elapsed)
+
+			return resp, u, nil
+		} else if ctx.Err() != nil {
+			// Don't penalize the upstream for the aborted exchange.
+			return nil, nil, err
+		}
+
+		errs = append(errs, err)
+
+		// TODO(e.burkov):  Use the actual configured timeout.
+		p.updateRTT(u.Address(), defaultTimeout)
+	}
+
+	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
+
+	return nil, nil, err
+}
+
+// fastestProbeRate is the number of requests in the fastest upstream mode, per
+// which a random upstream other than the fastest one is tried first.
+const fastestProbeRate = 20
+
+// fastestOrder returns the indexes of ups in the order they should be tried in
+// the fastest upstream mode.
+func (p *Proxy) fastestOrder(ups []upstream.Upstream) (order []int) {
+	order = make([]int, len(ups))
+	ewmas := make([]float64, len(ups))
+
+	p.rttLock.Lock()
+	for i, u := range ups {
+		order[i] = i
+		ewmas[i] = p.upstreamRTTStats[u.Address()].ewma
+	}
+	p.rttLock.Unlock()
+
+	// The upstreams without measurements have zero EWMA, so they go first.
+	slices.SortStableFunc(order, func(a, b int) (res int) {
+		return cmp.Compare(ewmas[a], ewmas[b])
+	})
+
+	if len(order) > 1 && p.randIntN(fastestProbeRate) == 0 {
+		i := 1 + p.randIntN(len(order)-1)
+		order[0], order[i] = order[i], order[0]
+	}
+
+	return order
+}
+
+// randIntN returns a pseudo-random number in [0, n) using p.randSrc, if set,
+// or the global source.  n must be positive.
+func (p *Proxy) randIntN(n int) (r int) {
+	if p.randSrc == nil {
+		return rand.IntN(n)
+	}
+
+	return rand.New(p.randSrc).IntN(n)
+}
+
 // exchange returns the result of the DNS request exchange with the given
 // upstream and the elapsed time in milliseconds.  It uses the given clock to
 // measure the request duration.
 func (p *Proxy) exchange(
+	ctx context.Context,
 	u upstream.Upstream,
 	req *dns.Msg,
 ) (resp *dns.Msg, dur time.Duration, err error) {
 	startTime := p.time.Now()
-	resp, err = u.Exchange(req)
+	resp, err = u.Exchange(ctx, req)
 
 	// Don't use [time.Since] because it uses [time.Now].
 	dur = p.time.Now().Sub(startTime)
@@ -85,7 +203,7 @@ func (p *Proxy) exchange(
 	addr := u.Address()
 	q := &req.Question[0]
 	if err != nil {
-		p.logger.Error(
+		p.upstreamLogger.Error(
 			"exchange failed",
 			"upstream", addr,
 			"question", q,
@@ -93,7 +211,7 @@ func (p *Proxy) exchange(
 			slogutil.KeyError, err,
 		)
 	} else {
-		p.logger.Debug(
+		p.upstreamLogger.Debug(
 			"exchange successfully finished",
 			"upstream", addr,
 			"question", q,
@@ -114,13 +232,30 @@ type upstreamRTTStats struct {
 	// reqNum is the number of requests to the upstream.  The float64 type is
 	// used since to avoid unnecessary type conversions.
 	reqNum float64
+
+	// ewma is the exponentially weighted moving average of the round-trip
+	// times in microseconds, see [rttEWMAWeight].
+	ewma float64
 }
 
+// rttEWMAWeight is the weight of the latest round-trip time in
+// [upstreamRTTStats.ewma].  The greater it is, the faster the average follows
+// the changes of the round-trip time.
+const rttEWMAWeight = 0.3
+
 // update returns updated stats after adding given RTT.
 func (stats upstreamRTTStats) update(rtt time.Duration) (updated upstreamRTTStats) {
+	us := float64(rtt.Microseconds())
+
+	ewma := us
+	if stats.reqNum > 0 {
+		ewma = rttEWMAWeight*us + (1-rttEWMAWeight)*stats.ewma
+	}
+
 	return upstreamRTTStats{
-		rttSum: stats.rttSum + float64(rtt.Microseconds()),
+		rttSum: stats.rttSum + us,
 		reqNum: stats.reqNum + 1,
+		ewma:   ewma,
 	}
 }
 
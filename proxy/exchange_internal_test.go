@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"context"
 	"math/rand/v2"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,11 +15,12 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
-	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // newUpstreamWithErrorRate returns an [upstream.Upstream] that responds with an
@@ -26,7 +30,7 @@ func newUpstreamWithErrorRate(rate uint, name string) (u upstream.Upstream) {
 	var n uint
 
 	return &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			n++
 			if n%rate == 0 {
 				return nil, assert.AnError
@@ -35,7 +39,7 @@ func newUpstreamWithErrorRate(rate uint, name string) (u upstream.Upstream) {
 			return (&dns.Msg{}).SetReply(req), nil
 		},
 		OnAddress: func() (addr string) { return name },
-		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { return nil },
 	}
 }
 
@@ -53,10 +57,10 @@ type measuredUpstream struct {
 var _ upstream.Upstream = measuredUpstream{}
 
 // Exchange implements the [upstream.Upstream] interface for measuredUpstream.
-func (u measuredUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+func (u measuredUpstream) Exchange(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 	u.stats[u.Address()]++
 
-	return u.Upstream.Exchange(req)
+	return u.Upstream.Exchange(context.Background(), req)
 }
 
 func TestProxy_Exchange_loadBalance(t *testing.T) {
@@ -89,55 +93,55 @@ func TestProxy_Exchange_loadBalance(t *testing.T) {
 	}
 
 	fastUps := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			currentNow = zeroTime.Add(testRTT / 100)
 
 			return (&dns.Msg{}).SetReply(req), nil
 		},
 		OnAddress: func() (addr string) { return "fast" },
-		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { return nil },
 	}
 	slowerUps := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			currentNow = zeroTime.Add(testRTT / 10)
 
 			return (&dns.Msg{}).SetReply(req), nil
 		},
 		OnAddress: func() (addr string) { return "slower" },
-		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { return nil },
 	}
 	slowestUps := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			currentNow = zeroTime.Add(testRTT / 2)
 
 			return (&dns.Msg{}).SetReply(req), nil
 		},
 		OnAddress: func() (addr string) { return "slowest" },
-		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { return nil },
 	}
 
 	err1Ups := &dnsproxytest.Upstream{
-		OnExchange: func(_ *dns.Msg) (r *dns.Msg, err error) { return nil, assert.AnError },
+		OnExchange: func(_ context.Context, _ *dns.Msg) (r *dns.Msg, err error) { return nil, assert.AnError },
 		OnAddress:  func() (addr string) { return "error1" },
-		OnClose:    func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:    func() (_ error) { return nil },
 	}
 	err2Ups := &dnsproxytest.Upstream{
-		OnExchange: func(_ *dns.Msg) (r *dns.Msg, err error) { return nil, assert.AnError },
+		OnExchange: func(_ context.Context, _ *dns.Msg) (r *dns.Msg, err error) { return nil, assert.AnError },
 		OnAddress:  func() (addr string) { return "error2" },
-		OnClose:    func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:    func() (_ error) { return nil },
 	}
 
 	singleError := &sync.Once{}
 	// fastestUps responds with an error on the first request.
 	fastestUps := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			singleError.Do(func() { err = assert.AnError })
 			currentNow = zeroTime.Add(testRTT / 200)
 
 			return (&dns.Msg{}).SetReply(req), err
 		},
 		OnAddress: func() (addr string) { return "fastest" },
-		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { return nil },
 	}
 
 	each200 := newUpstreamWithErrorRate(200, "each_200")
@@ -222,14 +226,308 @@ func TestProxy_Exchange_loadBalance(t *testing.T) {
 		p.time = tc.clock
 		p.randSrc = randSrc
 
+		servicetest.RequireRun(t, p, testTimeout)
+
 		wantStat := tc.wantStat
 
 		t.Run(tc.name, func(t *testing.T) {
 			for range requestsNum {
-				_ = p.Resolve(&DNSContext{Req: req, Addr: cli})
+				_ = p.Resolve(context.Background(), &DNSContext{Req: req, Addr: cli})
 			}
 
 			assert.Equal(t, wantStat, stats)
 		})
 	}
 }
+
+func TestProxy_Exchange_fastest(t *testing.T) {
+	const requestsNum = 1_000
+
+	// The clock returns the time the exchange has finished at once after the
+	// exchange and the zero time otherwise.
+	zeroTime := time.Unix(0, 0)
+	currentNow := zeroTime
+	clock := &faketime.Clock{
+		OnNow: func() (now time.Time) {
+			now, currentNow = currentNow, zeroTime
+
+			return now
+		},
+	}
+
+	newUps := func(addr string, rtt *time.Duration) (u upstream.Upstream) {
+		return &dnsproxytest.Upstream{
+			OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+				currentNow = zeroTime.Add(*rtt)
+
+				return (&dns.Msg{}).SetReply(req), nil
+			},
+			OnAddress: func() (a string) { return addr },
+			OnClose:   func() (_ error) { return nil },
+		}
+	}
+
+	rttA, rttB, rttC := 10*time.Millisecond, 50*time.Millisecond, 100*time.Millisecond
+
+	stats := map[string]int64{}
+	ups := []upstream.Upstream{
+		measuredUpstream{Upstream: newUps("a", &rttA), stats: stats},
+		measuredUpstream{Upstream: newUps("b", &rttB), stats: stats},
+		measuredUpstream{Upstream: newUps("c", &rttC), stats: stats},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: ups},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		UpstreamMode:           UpstreamModeFastest,
+	})
+	p.time = clock
+
+	// Make the test deterministic.
+	p.randSrc = rand.New(rand.NewPCG(42, 42))
+
+	req := newTestMessage()
+	for range requestsNum {
+		_, _, err := p.exchangeUpstreams(context.Background(), req, ups)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, map[string]int64{
+		"a": 956,
+		"b": 20,
+		"c": 24,
+	}, stats)
+
+	// Make the fastest upstream the slowest one.
+	rttA = time.Second
+	clear(stats)
+	for range requestsNum {
+		_, _, err := p.exchangeUpstreams(context.Background(), req, ups)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, map[string]int64{
+		"a": 25,
+		"b": 948,
+		"c": 27,
+	}, stats)
+}
+
+func TestProxy_exchangeRetrying(t *testing.T) {
+	t.Parallel()
+
+	// newUps returns an upstream failing with errs in turn and responding with
+	// rcode afterwards.
+	newUps := func(addr string, rcode int, errs ...error) (u upstream.Upstream) {
+		return &dnsproxytest.Upstream{
+			OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+				if len(errs) > 0 {
+					err, errs = errs[0], errs[1:]
+
+					return nil, err
+				}
+
+				return (&dns.Msg{}).SetRcode(req, rcode), nil
+			},
+			OnAddress: func() (a string) { return addr },
+			OnClose:   func() (_ error) { return nil },
+		}
+	}
+
+	testCases := []struct {
+		conf      *UpstreamRetryConfig
+		errs      []error
+		wantStats map[string]int64
+		name      string
+		rcode     int
+		wantRcode int
+		wantErr   bool
+	}{{
+		conf:      &UpstreamRetryConfig{MaxRetries: 2},
+		errs:      []error{os.ErrDeadlineExceeded},
+		wantStats: map[string]int64{"a": 1},
+		name:      "no_retry_on_timeout",
+		rcode:     dns.RcodeSuccess,
+		wantErr:   true,
+	}, {
+		conf:      &UpstreamRetryConfig{MaxRetries: 2, RetryOnTimeout: true},
+		errs:      []error{os.ErrDeadlineExceeded, os.ErrDeadlineExceeded},
+		wantStats: map[string]int64{"a": 3},
+		name:      "retry_on_timeout",
+		rcode:     dns.RcodeSuccess,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		conf:      &UpstreamRetryConfig{MaxRetries: 2, RetryOnTimeout: true},
+		errs:      []error{assert.AnError},
+		wantStats: map[string]int64{"a": 1},
+		name:      "no_retry_on_error",
+		rcode:     dns.RcodeSuccess,
+		wantErr:   true,
+	}, {
+		conf:      &UpstreamRetryConfig{MaxRetries: 1, RetryOnError: true},
+		errs:      []error{assert.AnError, assert.AnError},
+		wantStats: map[string]int64{"a": 2},
+		name:      "retries_exhausted",
+		rcode:     dns.RcodeSuccess,
+		wantErr:   true,
+	}, {
+		conf: &UpstreamRetryConfig{
+			MaxRetries:     2,
+			RetryOnError:   true,
+			SwitchUpstream: true,
+		},
+		errs:      []error{assert.AnError},
+		wantStats: map[string]int64{"a": 1, "b": 1},
+		name:      "switch_upstream",
+		rcode:     dns.RcodeSuccess,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		conf: &UpstreamRetryConfig{
+			Rcodes:     []int{dns.RcodeServerFailure},
+			MaxRetries: 1,
+		},
+		wantStats: map[string]int64{"a": 2},
+		name:      "retry_rcode",
+		rcode:     dns.RcodeServerFailure,
+		wantRcode: dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			stats := map[string]int64{}
+			ups := []upstream.Upstream{
+				measuredUpstream{Upstream: newUps("a", tc.rcode, tc.errs...), stats: stats},
+				measuredUpstream{Upstream: newUps("b", dns.RcodeSuccess), stats: stats},
+			}
+
+			p := mustNew(t, &Config{
+				Logger:                 slogutil.NewDiscardLogger(),
+				UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig:         &UpstreamConfig{Upstreams: ups},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				UpstreamRetry:          tc.conf,
+			})
+
+			resp, _, err := p.exchangeRetrying(context.Background(), newTestMessage(), ups, []int{0, 1})
+			assert.Equal(t, tc.wantStats, stats)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+		})
+	}
+
+	t.Run("try_timeout", func(t *testing.T) {
+		t.Parallel()
+
+		unblock := make(chan struct{})
+		t.Cleanup(func() { close(unblock) })
+
+		ups := &dnsproxytest.Upstream{
+			OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+				<-unblock
+
+				return (&dns.Msg{}).SetReply(req), nil
+			},
+			OnAddress: func() (a string) { return "blocked" },
+			OnClose:   func() (_ error) { return nil },
+		}
+
+		p := mustNew(t, &Config{
+			Logger:                 slogutil.NewDiscardLogger(),
+			UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			UpstreamRetry: &UpstreamRetryConfig{
+				MaxRetries:     1,
+				TryTimeout:     10 * time.Millisecond,
+				RetryOnTimeout: true,
+			},
+		})
+
+		_, _, err := p.exchangeRetrying(context.Background(), newTestMessage(), []upstream.Upstream{ups}, []int{0})
+		assert.ErrorIs(t, err, errTryTimeout)
+	})
+}
+
+func TestProxy_exchangeUpstreams_race(t *testing.T) {
+	t.Parallel()
+
+	var queries atomic.Int64
+	filtering := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			queries.Add(1)
+
+			return (&dns.Msg{}).SetRcode(req, dns.RcodeNameError), nil
+		},
+		OnAddress: func() (a string) { return "filtering" },
+		OnClose:   func() (_ error) { return nil },
+	}
+
+	answering := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			queries.Add(1)
+
+			// Respond later than the filtering upstream.
+			time.Sleep(50 * time.Millisecond)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, req.Question[0].Name, dns.TypeA, 10, net.IP{192, 0, 2, 1})}
+
+			return resp, nil
+		},
+		OnAddress: func() (a string) { return "answering" },
+		OnClose:   func() (_ error) { return nil },
+	}
+
+	ups := []upstream.Upstream{filtering, answering}
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: ups},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		UpstreamMode:           UpstreamModeRace,
+		RaceQueryTypes:         []uint16{dns.TypeA},
+	})
+
+	t.Run("raced", func(t *testing.T) {
+		queries.Store(0)
+
+		resp, u, err := p.exchangeUpstreams(context.Background(), newTestMessage(), ups)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, answering, u)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, int64(2), queries.Load())
+	})
+
+	t.Run("load_balanced", func(t *testing.T) {
+		queries.Store(0)
+
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeTXT)
+		_, _, err := p.exchangeUpstreams(context.Background(), req, ups)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(1), queries.Load())
+	})
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// fileFormat is the versioned format of a persistent file, e.g. the cache file
+// or the client statistics file.  Each such file starts with a header:
+//
+//	magic   [4]byte  identifies the kind of the file
+//	version uint16   big-endian format version
+//
+// The header is followed by the records of the layout written by
+// [writeCacheRecord] until EOF.  The meaning of the records depends on the kind
+// of the file.
+//
+// Records of unknown kinds are skipped, so that new kinds may be added without
+// changing the version.  Incompatible changes of the existing records must
+// increase the version and add a migration from the previous version, so that
+// the files written by the previous versions of the package are loaded on
+// startup.  Files of unsupported newer versions are never overwritten but moved
+// aside.
+type fileFormat struct {
+	// migrations maps the format versions to the migrations converting the
+	// records of that version into the ones of the next version.
+	migrations map[uint16]fileMigration
+
+	// magic identifies the kind of the file.  It must be 4 bytes long.
+	magic string
+
+	// version is the current version of the format.  It must be positive.
+	version uint16
+}
+
+// fileMigration converts the records of a persistent file from one version to
+// the next one.  body is the file contents following the header.
+type fileMigration func(body []byte) (migrated []byte, err error)
+
+// headerLen returns the length of the header of the files of f in bytes.
+func (f *fileFormat) headerLen() (n int) {
+	return len(f.magic) + 2
+}
+
+// header returns the header of the files of the current version of f.
+func (f *fileFormat) header() (hdr []byte) {
+	return binary.BigEndian.AppendUint16([]byte(f.magic), f.version)
+}
+
+// fileVersion returns the version from the header of data.  ok is false if
+// data doesn't start with the header of f.
+func (f *fileFormat) fileVersion(data []byte) (ver uint16, ok bool) {
+	if len(data) < f.headerLen() || string(data[:len(f.magic)]) != f.magic {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint16(data[len(f.magic):]), true
+}
+
+// migrate validates the header of data and returns its records in the format
+// of the current version.
+func (f *fileFormat) migrate(data []byte) (body []byte, err error) {
+	ver, ok := f.fileVersion(data)
+	if !ok {
+		return nil, errCacheFileFormat
+	}
+
+	if ver == 0 || ver > f.version {
+		return nil, fmt.Errorf("%w: unsupported version %d", errors.ErrOutOfRange, ver)
+	}
+
+	body = data[f.headerLen():]
+	for ; ver < f.version; ver++ {
+		m, has := f.migrations[ver]
+		if !has {
+			return nil, fmt.Errorf("no migration from version %d", ver)
+		}
+
+		body, err = m(body)
+		if err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %w", ver, err)
+		}
+	}
+
+	return body, nil
+}
+
+// backupPath returns the path to move the unsupported file at path aside to.
+// data is the beginning of the file contents.
+func (f *fileFormat) backupPath(path string, data []byte) (bakPath string) {
+	ver, ok := f.fileVersion(data)
+	if !ok {
+		return path + ".bak"
+	}
+
+	return fmt.Sprintf("%s.v%d.bak", path, ver)
+}
+
+// backupNewer moves the file at path aside if it has a version newer than the
+// supported one, so that downgrading doesn't discard operator data.
+func (f *fileFormat) backupNewer(path string) (err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, f.headerLen())
+	_, err = io.ReadFull(file, hdr)
+	err = errors.WithDeferred(err, file.Close())
+	if err != nil {
+		// Not a file of any known version, so overwrite it.
+		return nil
+	}
+
+	ver, ok := f.fileVersion(hdr)
+	if !ok || ver <= f.version {
+		return nil
+	}
+
+	return os.Rename(path, f.backupPath(path, hdr))
+}
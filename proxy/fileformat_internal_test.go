@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFileMagic is the magic of the files of the test format.
+const testFileMagic = "DPXT"
+
+// newTestFileFormat returns the format of version 3 with the migrations
+// appending the number of the version migrated to to the records.
+func newTestFileFormat() (f *fileFormat) {
+	return &fileFormat{
+		migrations: map[uint16]fileMigration{
+			1: func(body []byte) (migrated []byte, err error) {
+				return append(body, '2'), nil
+			},
+			2: func(body []byte) (migrated []byte, err error) {
+				if bytes.Contains(body, []byte("bad")) {
+					return nil, errors.Error("bad record")
+				}
+
+				return append(body, '3'), nil
+			},
+		},
+		magic:   testFileMagic,
+		version: 3,
+	}
+}
+
+// newTestFileData returns the contents of the file of version ver with body.
+func newTestFileData(ver uint16, body string) (data []byte) {
+	return append(binary.BigEndian.AppendUint16([]byte(testFileMagic), ver), body...)
+}
+
+func TestFileFormat_migrate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		data       []byte
+		want       string
+		wantErrMsg string
+	}{{
+		name:       "current",
+		data:       newTestFileData(3, "records"),
+		want:       "records",
+		wantErrMsg: "",
+	}, {
+		name:       "previous",
+		data:       newTestFileData(2, "records"),
+		want:       "records3",
+		wantErrMsg: "",
+	}, {
+		name:       "first",
+		data:       newTestFileData(1, "records"),
+		want:       "records23",
+		wantErrMsg: "",
+	}, {
+		name:       "failed_migration",
+		data:       newTestFileData(1, "bad"),
+		want:       "",
+		wantErrMsg: "migrating from version 2: bad record",
+	}, {
+		name:       "newer",
+		data:       newTestFileData(4, "records"),
+		want:       "",
+		wantErrMsg: "out of range: unsupported version 4",
+	}, {
+		name:       "zero",
+		data:       newTestFileData(0, "records"),
+		want:       "",
+		wantErrMsg: "out of range: unsupported version 0",
+	}, {
+		name:       "other_magic",
+		data:       append([]byte(cacheFileMagic), 0, 1),
+		want:       "",
+		wantErrMsg: errCacheFileFormat.Error(),
+	}, {
+		name:       "short",
+		data:       []byte(testFileMagic),
+		want:       "",
+		wantErrMsg: errCacheFileFormat.Error(),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := newTestFileFormat().migrate(tc.data)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, string(body))
+		})
+	}
+
+	t.Run("no_migration", func(t *testing.T) {
+		t.Parallel()
+
+		f := newTestFileFormat()
+		delete(f.migrations, 1)
+
+		_, err := f.migrate(newTestFileData(1, "records"))
+		testutil.AssertErrorMsg(t, "no migration from version 1", err)
+	})
+}
+
+func TestFileFormat_backupNewer(t *testing.T) {
+	t.Parallel()
+
+	f := newTestFileFormat()
+
+	testCases := []struct {
+		name       string
+		data       []byte
+		wantBackup string
+	}{{
+		name:       "newer",
+		data:       newTestFileData(4, "records"),
+		wantBackup: "file.bin.v4.bak",
+	}, {
+		name:       "current",
+		data:       newTestFileData(3, "records"),
+		wantBackup: "",
+	}, {
+		name:       "previous",
+		data:       newTestFileData(1, "records"),
+		wantBackup: "",
+	}, {
+		name:       "unknown",
+		data:       []byte("unknown"),
+		wantBackup: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "file.bin")
+			require.NoError(t, os.WriteFile(path, tc.data, 0o600))
+
+			require.NoError(t, f.backupNewer(path))
+
+			if tc.wantBackup == "" {
+				assert.FileExists(t, path)
+
+				return
+			}
+
+			assert.NoFileExists(t, path)
+
+			data, err := os.ReadFile(filepath.Join(dir, tc.wantBackup))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.data, data)
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		t.Parallel()
+
+		require.NoError(t, f.backupNewer(filepath.Join(t.TempDir(), "file.bin")))
+	})
+}
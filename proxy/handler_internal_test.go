@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"sync"
 	"testing"
@@ -26,13 +27,13 @@ func TestFilteringHandler(t *testing.T) {
 		TrustedProxies:         defaultTrustedProxies,
 		RatelimitSubnetLenIPv4: 24,
 		RatelimitSubnetLenIPv6: 64,
-		RequestHandler: func(p *Proxy, d *DNSContext) error {
+		RequestHandler: func(ctx context.Context, p *Proxy, d *DNSContext) error {
 			m.Lock()
 			defer m.Unlock()
 
 			if !blockResponse {
 				// Use the default Resolve method if response is not blocked
-				return p.Resolve(d)
+				return p.Resolve(ctx, d)
 			}
 
 			resp := dns.Msg{}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/AdguardTeam/golibs/service"
+)
+
+// Resolver resolves DNS requests.  It's implemented by [*Proxy] and is intended
+// to be used by the code which needs to resolve requests but doesn't need the
+// rest of the proxy, e.g. to be replaced with a mock in tests.
+type Resolver interface {
+	// Resolve resolves the request from dctx and stores the response in it.
+	// The semantics are the same as of [Proxy.Resolve].  dctx must not be nil.
+	Resolve(ctx context.Context, dctx *DNSContext) (err error)
+}
+
+// type check
+var _ Resolver = (*Proxy)(nil)
+
+// Statistics provides the statistics gathered by a DNS server since its
+// creation.  It's implemented by [*Proxy].
+type Statistics interface {
+	// Stats returns the statistics gathered so far, see [Proxy.Stats].  s must
+	// not be nil.
+	Stats() (s *Stats)
+}
+
+// type check
+var _ Statistics = (*Proxy)(nil)
+
+// Server is a DNS server which may be started, shut down, and used to resolve
+// requests directly.  It's implemented by [*Proxy], so that the projects using
+// it could depend on the interface and replace the proxy with another
+// implementation, e.g. a mock in tests.
+//
+// TODO(e.burkov):  Consider adding the methods for reloading the
+// configuration and clearing the cache.
+type Server interface {
+	service.Interface
+	Resolver
+	Statistics
+}
+
+// type check
+var _ Server = (*Proxy)(nil)
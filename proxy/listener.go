@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// ListenerConfig is the configuration of a single listener, see
+// [Config.Listeners].
+type ListenerConfig struct {
+	// TLSConfig is the TLS configuration of the listener.  It's only used with
+	// [ProtoTLS], [ProtoHTTPS], and [ProtoQUIC].  If nil, [Config.TLSConfig]
+	// is used.
+	TLSConfig *tls.Config
+
+	// ClientPolicy is the name of the policy from [Config.ClientPolicies]
+	// applied to all the requests received by the listener regardless of the
+	// client address.  If empty, the policy is matched by the client address
+	// as usual.
+	ClientPolicy string
+
+	// Addr is the address to listen on.  It must be valid.
+	Addr netip.AddrPort
+
+	// Proto is the protocol of the listener.  It must be one of [ProtoUDP],
+	// [ProtoTCP], [ProtoTLS], [ProtoHTTPS], and [ProtoQUIC].
+	Proto Proto
+}
+
+// validate returns an error if lc is invalid.  defaultTLS is
+// [Config.TLSConfig].  policies are the names of [Config.ClientPolicies].  lc
+// must not be nil.
+func (lc *ListenerConfig) validate(defaultTLS *tls.Config, policies []string) (err error) {
+	var errs []error
+	if !lc.Addr.IsValid() {
+		errs = append(errs, fmt.Errorf("Addr: %w", errors.ErrNoValue))
+	}
+
+	switch lc.Proto {
+	case ProtoUDP, ProtoTCP:
+		// Go on.
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		if lc.TLSConfig == nil && defaultTLS == nil {
+			errs = append(errs, fmt.Errorf("TLSConfig: %w", errors.ErrNoValue))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Proto: %w: %q", errors.ErrBadEnumValue, lc.Proto))
+	}
+
+	if lc.ClientPolicy != "" && !slices.Contains(policies, lc.ClientPolicy) {
+		errs = append(errs, fmt.Errorf("ClientPolicy: no policy named %q", lc.ClientPolicy))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateListeners returns an error if any of c.Listeners is invalid.
+func (c *Config) validateListeners() (err error) {
+	var policies []string
+	for _, pol := range c.ClientPolicies {
+		if pol != nil {
+			policies = append(policies, pol.Name)
+		}
+	}
+
+	var errs []error
+	for i, lc := range c.Listeners {
+		if lc == nil {
+			errs = append(errs, fmt.Errorf("at index %d: %w", i, errors.ErrNoValue))
+
+			continue
+		}
+
+		err = lc.validate(c.TLSConfig, policies)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// boundListener is a listener from [Config.Listeners] bound to the actual
+// address.
+type boundListener struct {
+	// conf is the configuration of the listener.  It's never nil.
+	conf *ListenerConfig
+
+	// addr is the address the listener actually listens on, which differs from
+	// the configured one if the port was chosen by the OS.
+	addr netip.AddrPort
+}
+
+// initListeners starts listening on the addresses of [Config.Listeners].  It
+// must be called after the listeners of the other settings are initialized.
+func (p *Proxy) initListeners(ctx context.Context) (err error) {
+	p.boundListeners = nil
+
+	for i, lc := range p.Listeners {
+		tlsConf := lc.TLSConfig
+		if tlsConf == nil {
+			tlsConf = p.TLSConfig
+		}
+
+		var laddr net.Addr
+		switch lc.Proto {
+		case ProtoUDP:
+			laddr, err = p.addUDPListener(ctx, net.UDPAddrFromAddrPort(lc.Addr))
+		case ProtoTCP:
+			laddr, err = p.addTCPListener(ctx, net.TCPAddrFromAddrPort(lc.Addr))
+		case ProtoTLS:
+			laddr, err = p.addTLSListener(ctx, net.TCPAddrFromAddrPort(lc.Addr), tlsConf)
+		case ProtoHTTPS:
+			laddr, err = p.addHTTPSListener(ctx, net.TCPAddrFromAddrPort(lc.Addr), tlsConf)
+		case ProtoQUIC:
+			laddr, err = p.addQUICListener(ctx, net.UDPAddrFromAddrPort(lc.Addr), tlsConf)
+		default:
+			// Should never happen, since the configuration is validated.
+			panic(fmt.Errorf("listener at index %d: proto: %w: %q", i, errors.ErrBadEnumValue, lc.Proto))
+		}
+
+		if err != nil {
+			return fmt.Errorf("listener at index %d: %w", i, err)
+		}
+
+		addr := netutil.NetAddrToAddrPort(laddr)
+		p.boundListeners = append(p.boundListeners, &boundListener{
+			conf: lc,
+			addr: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()),
+		})
+	}
+
+	return nil
+}
+
+// addTCPListener starts listening for plain DNS-over-TCP on addr and returns
+// the address it actually listens on.
+func (p *Proxy) addTCPListener(ctx context.Context, addr *net.TCPAddr) (laddr net.Addr, err error) {
+	ln, err := p.listenTCP(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on tcp addr %s: %w", addr, err)
+	}
+
+	p.tcpListen = append(p.tcpListen, ln)
+
+	return ln.Addr(), nil
+}
+
+// listenerConfig returns the configuration of the listener from
+// [Config.Listeners] which has received the request of d.  It returns nil if
+// the request hasn't been received by any of them.
+func (p *Proxy) listenerConfig(d *DNSContext) (lc *ListenerConfig) {
+	if len(p.boundListeners) == 0 {
+		return nil
+	}
+
+	local := localAddr(d)
+	if !local.IsValid() {
+		return nil
+	}
+
+	for _, bl := range p.boundListeners {
+		if bl.conf.Proto != d.Proto || bl.addr.Port() != local.Port() {
+			continue
+		}
+
+		if ip := bl.addr.Addr(); ip.IsUnspecified() || ip == local.Addr() {
+			return bl.conf
+		}
+	}
+
+	return nil
+}
+
+// localAddr returns the local address of the connection the request of d has
+// been received over, if known.
+func localAddr(d *DNSContext) (addr netip.AddrPort) {
+	var laddr net.Addr
+	switch {
+	case d.Conn != nil:
+		laddr = d.Conn.LocalAddr()
+	case d.QUICConnection != nil:
+		laddr = d.QUICConnection.LocalAddr()
+	case d.HTTPRequest != nil:
+		laddr, _ = d.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	}
+
+	if laddr == nil {
+		return netip.AddrPort{}
+	}
+
+	addr = netutil.NetAddrToAddrPort(laddr)
+
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Listeners(t *testing.T) {
+	generalIP := net.IP{192, 0, 2, 1}
+	corpIP := net.IP{192, 0, 2, 2}
+
+	var generalQueries, corpQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", generalIP, &generalQueries)
+	corp := newAddrUpstream(t, "tls://dns.corp.example", corpIP, &corpQueries)
+
+	p := mustNew(t, &Config{
+		Logger:         slogutil.NewDiscardLogger(),
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{general}},
+		TrustedProxies: defaultTrustedProxies,
+		ClientPolicies: []*ClientPolicy{{
+			Upstreams: &UpstreamConfig{Upstreams: []upstream.Upstream{corp}},
+			Name:      "corp",
+			Networks:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		}},
+		Listeners: []*ListenerConfig{{
+			ClientPolicy: "corp",
+			Addr:         localhostAnyPort,
+			Proto:        ProtoUDP,
+		}, {
+			ClientPolicy: "corp",
+			Addr:         localhostAnyPort,
+			Proto:        ProtoTCP,
+		}},
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	udpAddrs := p.Addrs(ProtoUDP)
+	require.Len(t, udpAddrs, 2)
+
+	tcpAddrs := p.Addrs(ProtoTCP)
+	require.Len(t, tcpAddrs, 1)
+
+	testCases := []struct {
+		addr   net.Addr
+		wantIP net.IP
+		name   string
+		net    string
+	}{{
+		addr:   udpAddrs[0],
+		wantIP: generalIP,
+		name:   "general_udp",
+		net:    "udp",
+	}, {
+		addr:   udpAddrs[1],
+		wantIP: corpIP,
+		name:   "tagged_udp",
+		net:    "udp",
+	}, {
+		addr:   tcpAddrs[0],
+		wantIP: corpIP,
+		name:   "tagged_tcp",
+		net:    "tcp",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &dns.Client{Net: tc.net, Timeout: testTimeout}
+			req := (&dns.Msg{}).SetQuestion(tc.name+".example.", dns.TypeA)
+
+			resp, _, err := c.Exchange(req, tc.addr.String())
+			require.NoError(t, err)
+			require.Len(t, resp.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+			assert.Equal(t, tc.wantIP.To4(), a.A.To4())
+		})
+	}
+}
+
+func TestConfig_validateListeners(t *testing.T) {
+	t.Parallel()
+
+	var queries atomic.Uint32
+	ups := newAddrUpstream(t, "192.0.2.53:53", net.IP{192, 0, 2, 1}, &queries)
+	policies := []*ClientPolicy{{
+		Upstreams: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		Name:      "corp",
+		Networks:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}}
+
+	testCases := []struct {
+		tlsConf   *tls.Config
+		listener  *ListenerConfig
+		name      string
+		wantErrIs error
+	}{{
+		tlsConf: nil,
+		listener: &ListenerConfig{
+			ClientPolicy: "corp",
+			Addr:         localhostAnyPort,
+			Proto:        ProtoUDP,
+		},
+		name:      "valid",
+		wantErrIs: nil,
+	}, {
+		tlsConf: &tls.Config{},
+		listener: &ListenerConfig{
+			Addr:  localhostAnyPort,
+			Proto: ProtoTLS,
+		},
+		name:      "default_tls",
+		wantErrIs: nil,
+	}, {
+		tlsConf: nil,
+		listener: &ListenerConfig{
+			Addr:  localhostAnyPort,
+			Proto: ProtoQUIC,
+		},
+		name:      "no_tls",
+		wantErrIs: errors.ErrNoValue,
+	}, {
+		tlsConf: nil,
+		listener: &ListenerConfig{
+			Addr:  localhostAnyPort,
+			Proto: ProtoDNSCrypt,
+		},
+		name:      "bad_proto",
+		wantErrIs: errors.ErrBadEnumValue,
+	}, {
+		tlsConf: nil,
+		listener: &ListenerConfig{
+			Proto: ProtoUDP,
+		},
+		name:      "no_addr",
+		wantErrIs: errors.ErrNoValue,
+	}, {
+		tlsConf:   nil,
+		listener:  nil,
+		name:      "nil",
+		wantErrIs: errors.ErrNoValue,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Config{
+				TLSConfig:      tc.tlsConf,
+				ClientPolicies: policies,
+				Listeners:      []*ListenerConfig{tc.listener},
+			}
+
+			err := c.validateListeners()
+			if tc.wantErrIs == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.wantErrIs)
+			}
+		})
+	}
+
+	t.Run("unknown_policy", func(t *testing.T) {
+		t.Parallel()
+
+		c := &Config{
+			Listeners: []*ListenerConfig{{
+				ClientPolicy: "unknown",
+				Addr:         localhostAnyPort,
+				Proto:        ProtoTCP,
+			}},
+		}
+
+		assert.Error(t, c.validateListeners())
+	})
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// KeySubsystem is the key of the log attribute containing the [LogSubsystem]
+// the message is logged by.
+const KeySubsystem = "subsystem"
+
+// LogSubsystem is a part of the proxy which logs may have their own level, see
+// [Config.LogLevels].
+type LogSubsystem string
+
+// Log subsystems.
+const (
+	// LogSubsystemCache logs the lookups and the storage of the responses in
+	// the cache, including the cache file and the replication.
+	LogSubsystemCache LogSubsystem = "cache"
+
+	// LogSubsystemRefresher logs the proactive refreshes of the cached
+	// responses.
+	LogSubsystemRefresher LogSubsystem = "refresher"
+
+	// LogSubsystemUpstream logs the exchanges with the upstreams.
+	LogSubsystemUpstream LogSubsystem = "upstream"
+
+	// LogSubsystemServer logs the listeners and the handling of the particular
+	// requests.
+	LogSubsystemServer LogSubsystem = "server"
+)
+
+// logSubsystems are all the valid [LogSubsystem] values.
+var logSubsystems = []LogSubsystem{
+	LogSubsystemCache,
+	LogSubsystemRefresher,
+	LogSubsystemUpstream,
+	LogSubsystemServer,
+}
+
+// ParseLogSubsystemLevel parses the level of a subsystem in the
+// "subsystem=level" format, e.g. "refresher=debug".  The level is parsed with
+// [slog.Level.UnmarshalText].
+func ParseLogSubsystemLevel(s string) (sub LogSubsystem, lvl slog.Level, err error) {
+	subStr, lvlStr, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("%q: %w: want subsystem=level", s, errors.ErrBadEnumValue)
+	}
+
+	sub = LogSubsystem(subStr)
+	if !slices.Contains(logSubsystems, sub) {
+		return "", 0, fmt.Errorf("subsystem: %w: %q", errors.ErrBadEnumValue, subStr)
+	}
+
+	err = lvl.UnmarshalText([]byte(lvlStr))
+	if err != nil {
+		return "", 0, fmt.Errorf("level: %w", err)
+	}
+
+	return sub, lvl, nil
+}
+
+// SubsystemLogger returns the logger for the subsystem sub derived from l.  Its
+// messages have the [KeySubsystem] attribute, and if levels contain sub, the
+// corresponding minimum level, which may also be lower than the one of l.  l
+// must not be nil.
+func SubsystemLogger(
+	l *slog.Logger,
+	sub LogSubsystem,
+	levels map[LogSubsystem]slog.Level,
+) (subLogger *slog.Logger) {
+	h := l.Handler()
+	if lvl, ok := levels[sub]; ok {
+		h = slogutil.NewLevelHandler(lvl, h)
+	}
+
+	return slog.New(h).With(KeySubsystem, string(sub))
+}
+
+// validateLogLevels returns an error if levels contain the unknown subsystems.
+func validateLogLevels(levels map[LogSubsystem]slog.Level) (err error) {
+	var errs []error
+	for _, sub := range slices.Sorted(maps.Keys(levels)) {
+		if !slices.Contains(logSubsystems, sub) {
+			errs = append(errs, fmt.Errorf("%w: %q", errors.ErrBadEnumValue, sub))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// initLoggers sets the loggers of the subsystems derived from [Proxy.logger]
+// according to [Config.LogLevels].
+func (p *Proxy) initLoggers() {
+	p.cacheLogger = SubsystemLogger(p.logger, LogSubsystemCache, p.LogLevels)
+	p.refreshLogger = SubsystemLogger(p.logger, LogSubsystemRefresher, p.LogLevels)
+	p.upstreamLogger = SubsystemLogger(p.logger, LogSubsystemUpstream, p.LogLevels)
+	p.serverLogger = SubsystemLogger(p.logger, LogSubsystemServer, p.LogLevels)
+}
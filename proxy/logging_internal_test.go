@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogSubsystemLevel(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+		wantSub    LogSubsystem
+		wantLvl    slog.Level
+	}{{
+		name:       "success",
+		in:         "refresher=debug",
+		wantErrMsg: "",
+		wantSub:    LogSubsystemRefresher,
+		wantLvl:    slog.LevelDebug,
+	}, {
+		name:       "upper_case_level",
+		in:         "server=WARN",
+		wantErrMsg: "",
+		wantSub:    LogSubsystemServer,
+		wantLvl:    slog.LevelWarn,
+	}, {
+		name:       "no_level",
+		in:         "cache",
+		wantErrMsg: `"cache": bad enum value: want subsystem=level`,
+		wantSub:    "",
+		wantLvl:    0,
+	}, {
+		name:       "bad_subsystem",
+		in:         "dns=info",
+		wantErrMsg: `subsystem: bad enum value: "dns"`,
+		wantSub:    "",
+		wantLvl:    0,
+	}, {
+		name:       "bad_level",
+		in:         "upstream=verbose",
+		wantErrMsg: `level: slog: level string "verbose": unknown name`,
+		wantSub:    "",
+		wantLvl:    0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, lvl, err := ParseLogSubsystemLevel(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantSub, sub)
+			assert.Equal(t, tc.wantLvl, lvl)
+		})
+	}
+}
+
+func TestSubsystemLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(_ []string, a slog.Attr) (res slog.Attr) {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+
+			return a
+		},
+	}))
+
+	levels := map[LogSubsystem]slog.Level{
+		LogSubsystemRefresher: slog.LevelDebug,
+		LogSubsystemServer:    slog.LevelError,
+	}
+
+	SubsystemLogger(l, LogSubsystemRefresher, levels).Debug("refreshed")
+	SubsystemLogger(l, LogSubsystemServer, levels).Info("handled")
+	SubsystemLogger(l, LogSubsystemCache, levels).Debug("cached")
+	SubsystemLogger(l, LogSubsystemCache, levels).Info("stored")
+
+	want := "level=DEBUG msg=refreshed subsystem=refresher\n" +
+		"level=INFO msg=stored subsystem=cache\n"
+	assert.Equal(t, want, buf.String())
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	err := validateLogLevels(map[LogSubsystem]slog.Level{
+		LogSubsystemCache: slog.LevelDebug,
+		"dns":             slog.LevelDebug,
+	})
+	assert.ErrorIs(t, err, errors.ErrBadEnumValue)
+
+	assert.NoError(t, validateLogLevels(nil))
+}
@@ -31,6 +31,7 @@ func TestLookupNetIP(t *testing.T) {
 
 	p, err := New(conf)
 	require.NoError(t, err)
+	mustStartLocal(t, p)
 
 	// Now let's try doing some lookups.
 	addrs, err := p.LookupNetIP(context.Background(), "", "dns.google")
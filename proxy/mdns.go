@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+// Default values for [MDNSConfig].
+const (
+	defaultMDNSTimeout   = 1 * time.Second
+	defaultMDNSCacheTTL  = 10 * time.Second
+	defaultMDNSCacheSize = 1000
+)
+
+// mdnsDomain is the domain resolved with the multicast DNS, see RFC 6762.
+const mdnsDomain = "local."
+
+// mdnsIPv4Addr is the IPv4 multicast address of the multicast DNS responders.
+//
+// TODO(e.burkov):  Also query ff02::fb on the IPv6-only networks.
+var mdnsIPv4Addr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// cacheFlushBit is the bit of the class of the multicast DNS records telling
+// the cached records of the RRset should be replaced, see RFC 6762 Section
+// 10.2.
+const cacheFlushBit = 1 << 15
+
+// MDNSConfig is the configuration of resolving the names within the "local."
+// domain with the multicast DNS queries on the LAN instead of the upstreams.
+// The answers are cached separately from the general cache.
+type MDNSConfig struct {
+	// Timeout is the time to wait for the response.  If zero, the default of 1
+	// second is used.
+	Timeout time.Duration
+
+	// CacheTTL is the maximum time to cache the answers for, the TTLs of the
+	// answers are capped by it as well.  If zero, the default of 10 seconds is
+	// used.
+	CacheTTL time.Duration
+
+	// CacheSize is the maximum number of the cached answers.  If zero, the
+	// default of 1000 is used.
+	CacheSize int
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *MDNSConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	return errors.Join(
+		validate.NotNegative("Timeout", c.Timeout),
+		validate.NotNegative("CacheTTL", c.CacheTTL),
+		validate.NotNegative("CacheSize", c.CacheSize),
+	)
+}
+
+// mdnsExchangeFunc sends req to the multicast DNS responders and returns the
+// first response.
+type mdnsExchangeFunc func(req *dns.Msg, timeout time.Duration) (resp *dns.Msg, err error)
+
+// mdnsResolver resolves the "local." names with the multicast DNS.  A nil
+// *mdnsResolver resolves nothing.
+type mdnsResolver struct {
+	// exchange sends the queries, it's [exchangeMDNS] unless replaced in
+	// tests.
+	exchange mdnsExchangeFunc
+
+	// cache contains the *mdnsCacheItem values by [mdnsCacheKey].
+	cache gcache.Cache
+
+	// logger is used to log the failed queries.
+	logger *slog.Logger
+
+	// timeout is the time to wait for the response.
+	timeout time.Duration
+
+	// cacheTTL is the maximum time to cache the answers for.
+	cacheTTL time.Duration
+}
+
+// mdnsCacheKey is the key of a cached multicast DNS answer.
+type mdnsCacheKey struct {
+	// name is the lowercased requested name.
+	name string
+
+	// qtype is the requested type.
+	qtype uint16
+}
+
+// mdnsCacheItem is a cached multicast DNS answer.
+type mdnsCacheItem struct {
+	// stored is the time the answer has been cached.
+	stored time.Time
+
+	// answer are the answer records.
+	answer []dns.RR
+}
+
+// newMDNSResolver returns a new *mdnsResolver configured with conf.  It returns
+// nil if conf is nil.
+func newMDNSResolver(conf *MDNSConfig, logger *slog.Logger) (r *mdnsResolver) {
+	if conf == nil {
+		return nil
+	}
+
+	return &mdnsResolver{
+		exchange: exchangeMDNS,
+		cache:    gcache.New(cmp.Or(conf.CacheSize, defaultMDNSCacheSize)).LRU().Build(),
+		logger:   logger,
+		timeout:  cmp.Or(conf.Timeout, defaultMDNSTimeout),
+		cacheTTL: cmp.Or(conf.CacheTTL, defaultMDNSCacheTTL),
+	}
+}
+
+// isMDNSName returns true if name is within the "local." domain.
+func isMDNSName(name string) (ok bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	return name != mdnsDomain && dns.IsSubDomain(mdnsDomain, name)
+}
+
+// resolve returns the response to req resolved with the multicast DNS or nil
+// if req isn't for a "local." name.  req must have a single question.
+func (r *mdnsResolver) resolve(req *dns.Msg) (resp *dns.Msg, cached bool) {
+	q := req.Question[0]
+	if r == nil || !isMDNSName(q.Name) {
+		return nil, false
+	}
+
+	key := mdnsCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+	answer, ok := r.get(key)
+	if !ok {
+		answer = r.query(q)
+		if len(answer) > 0 {
+			// Don't cache the absence of the answers, since the devices may
+			// appear on the network at any moment.
+			r.set(key, answer)
+		}
+	}
+
+	if len(answer) == 0 {
+		resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	} else {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.Answer = answer
+	}
+
+	resp.RecursionAvailable = true
+
+	return resp, ok
+}
+
+// query sends the multicast DNS query for q and returns the answer records
+// from the response.  It returns nil if there is no response.
+func (r *mdnsResolver) query(q dns.Question) (answer []dns.RR) {
+	// The multicast DNS queries must not have the RD bit set, see RFC 6762
+	// Section 18.6.
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id: dns.Id(),
+		},
+		Question: []dns.Question{q},
+	}
+
+	resp, err := r.exchange(req, r.timeout)
+	if err != nil {
+		r.logger.Debug("querying mdns", "name", q.Name, slogutil.KeyError, err)
+
+		return nil
+	}
+
+	maxTTL := uint32(r.cacheTTL.Seconds())
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		hdr.Class &^= cacheFlushBit
+		hdr.Ttl = min(hdr.Ttl, maxTTL)
+	}
+
+	return resp.Answer
+}
+
+// get returns the copy of the cached answer for key with the TTLs decreased by
+// the time passed since it's been cached.
+func (r *mdnsResolver) get(key mdnsCacheKey) (answer []dns.RR, ok bool) {
+	val, err := r.cache.Get(key)
+	if err != nil {
+		return nil, false
+	}
+
+	// Don't check the type, since only the *mdnsCacheItem values are stored.
+	item := val.(*mdnsCacheItem)
+	elapsed := uint32(time.Since(item.stored).Seconds())
+	for _, rr := range item.answer {
+		rr = dns.Copy(rr)
+		hdr := rr.Header()
+		hdr.Ttl -= min(hdr.Ttl, elapsed)
+		answer = append(answer, rr)
+	}
+
+	return answer, true
+}
+
+// set caches answer for key for the minimum TTL of its records.
+func (r *mdnsResolver) set(key mdnsCacheKey, answer []dns.RR) {
+	ttl := answer[0].Header().Ttl
+	for _, rr := range answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	item := &mdnsCacheItem{
+		stored: time.Now(),
+		answer: answer,
+	}
+
+	// Don't check the error, since it's only returned by the loader functions.
+	_ = r.cache.SetWithExpire(key, item, time.Duration(ttl)*time.Second)
+}
+
+// exchangeMDNS is the default [mdnsExchangeFunc].  It sends req from an
+// ephemeral port, which makes the responders reply with the unicast legacy
+// responses, see RFC 6762 Section 6.7.
+func exchangeMDNS(req *dns.Msg, timeout time.Duration) (resp *dns.Msg, err error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing request: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("listening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = conn.WriteToUDP(b, mdnsIPv4Addr)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		var n int
+		n, _, err = conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+
+		resp = &dns.Msg{}
+		if resp.Unpack(buf[:n]) == nil && resp.Response && resp.Id == req.Id {
+			return resp, nil
+		}
+
+		// Skip the malformed and unrelated messages.
+	}
+}
+
+// mdnsResponse returns the response to the request of d resolved with the
+// multicast DNS, see [Config.MDNS], or nil if it should be resolved as usual.
+func (p *Proxy) mdnsResponse(d *DNSContext) (resp *dns.Msg) {
+	resp, cached := p.mdns.resolve(d.Req)
+	if resp == nil {
+		return nil
+	}
+
+	d.addTracef(StageRequestHandler, "mdns: %d answers, cached: %t", len(resp.Answer), cached)
+
+	return resp
+}
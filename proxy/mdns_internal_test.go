@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_mdns(t *testing.T) {
+	const (
+		deviceName = "printer.local."
+		missing    = "missing.local."
+	)
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		MDNS: &MDNSConfig{
+			CacheTTL: 5 * time.Second,
+		},
+	})
+
+	var queries []string
+	p.mdns.exchange = func(req *dns.Msg, _ time.Duration) (resp *dns.Msg, err error) {
+		q := req.Question[0]
+		queries = append(queries, q.Name)
+
+		require.False(t, req.RecursionDesired)
+
+		if q.Name != deviceName {
+			return nil, errors.Error("timeout")
+		}
+
+		resp = (&dns.Msg{}).SetReply(req)
+		rr := newRR(t, q.Name, dns.TypeA, 120, net.IP{192, 168, 1, 10})
+		rr.Header().Class |= cacheFlushBit
+		resp.Answer = []dns.RR{rr}
+
+		return resp, nil
+	}
+
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T, host string) (resp *dns.Msg) {
+		t.Helper()
+
+		d := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Addr: netip.MustParseAddrPort("192.168.1.100:53"),
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+
+		return d.Res
+	}
+
+	for range 2 {
+		resp := resolve(t, deviceName)
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		require.Len(t, resp.Answer, 1)
+
+		hdr := resp.Answer[0].Header()
+		assert.Equal(t, uint16(dns.ClassINET), hdr.Class)
+		assert.LessOrEqual(t, hdr.Ttl, uint32(5))
+	}
+
+	for range 2 {
+		assert.Equal(t, dns.RcodeNameError, resolve(t, missing).Rcode)
+	}
+
+	// The answers are cached, while their absence isn't.
+	assert.Equal(t, []string{deviceName, missing, missing}, queries)
+}
+
+func TestIsMDNSName(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isMDNSName("host.local."))
+	assert.True(t, isMDNSName("Host.Local"))
+	assert.False(t, isMDNSName("local."))
+	assert.False(t, isMDNSName("host.local.example."))
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+const (
+	// DefaultMemoryPressureHighWatermark is the default value for
+	// [MemoryPressureConfig.HighWatermark].
+	DefaultMemoryPressureHighWatermark = 0.9
+
+	// DefaultMemoryPressureLowWatermark is the default value for
+	// [MemoryPressureConfig.LowWatermark].
+	DefaultMemoryPressureLowWatermark = 0.75
+
+	// DefaultMemoryPressureCacheShrinkFactor is the default value for
+	// [MemoryPressureConfig.CacheShrinkFactor].
+	DefaultMemoryPressureCacheShrinkFactor = 0.5
+
+	// DefaultMemoryPressureCheckInterval is the default value for
+	// [MemoryPressureConfig.CheckInterval].
+	DefaultMemoryPressureCheckInterval = 5 * time.Second
+)
+
+// MemoryPressureConfig is the configuration of the graceful degradation of the
+// cache while the memory used by the process nears the limit.  Under the
+// pressure, the cache is shrunk, the prefetching of the dual-stack addresses is
+// suspended, and the proactive refreshes are suppressed.  The normal operation
+// is restored once the pressure is over.
+type MemoryPressureConfig struct {
+	// OnStateChange, if not nil, is called each time the memory pressure
+	// begins or ends.
+	OnStateChange func(ctx context.Context, e *MemoryPressureEvent)
+
+	// Limit is the memory limit in bytes.  If zero, the memory limit of the
+	// cgroup of the process is used, and then the soft memory limit of the Go
+	// runtime, see [debug.SetMemoryLimit].  If there is none, the memory
+	// pressure is never detected.
+	Limit uint64
+
+	// HighWatermark is the fraction of Limit the memory used by the Go runtime
+	// should reach for the pressure to begin.  Zero means
+	// [DefaultMemoryPressureHighWatermark].
+	HighWatermark float64
+
+	// LowWatermark is the fraction of Limit the memory used by the Go runtime
+	// should fall below for the pressure to end.  It must be less than
+	// HighWatermark.  Zero means [DefaultMemoryPressureLowWatermark].
+	LowWatermark float64
+
+	// CacheShrinkFactor is the fraction of [Config.CacheSizeBytes] the cache is
+	// shrunk to under the pressure.  Zero means
+	// [DefaultMemoryPressureCacheShrinkFactor].
+	CacheShrinkFactor float64
+
+	// CheckInterval is the interval between the checks of the used memory.
+	// Zero means [DefaultMemoryPressureCheckInterval].
+	CheckInterval time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *MemoryPressureConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	high := cmp.Or(c.HighWatermark, DefaultMemoryPressureHighWatermark)
+	low := cmp.Or(c.LowWatermark, DefaultMemoryPressureLowWatermark)
+
+	errs := []error{
+		validate.InRange("HighWatermark", c.HighWatermark, 0, 1),
+		validate.InRange("CacheShrinkFactor", c.CacheShrinkFactor, 0, 1),
+		validate.NotNegative("CheckInterval", c.CheckInterval),
+	}
+
+	if err = validate.NotNegative("LowWatermark", c.LowWatermark); err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = append(errs, validate.LessThan("LowWatermark", low, high))
+	}
+
+	return errors.Join(errs...)
+}
+
+// MemoryPressureEvent is a transition of the memory pressure state.
+type MemoryPressureEvent struct {
+	// Used is the memory used by the Go runtime in bytes at the moment of the
+	// transition.
+	Used uint64
+
+	// Limit is the memory limit in bytes, see [MemoryPressureConfig.Limit].
+	Limit uint64
+
+	// IsActive is true if the pressure has begun and false if it has ended.
+	IsActive bool
+}
+
+// memoryPressure detects the memory pressure.  A nil *memoryPressure is valid
+// and never detects the pressure.
+type memoryPressure struct {
+	// onStateChange is called with each transition, if not nil.
+	onStateChange func(ctx context.Context, e *MemoryPressureEvent)
+
+	// usage returns the memory used by the process in bytes.
+	usage func() (used uint64)
+
+	// active is true while the pressure lasts.
+	active *atomic.Bool
+
+	// cancel stops the checks, it's nil if they aren't started.
+	cancel context.CancelFunc
+
+	// stopped is closed when the checks are stopped.
+	stopped chan struct{}
+
+	// limit is the memory limit in bytes, it's always positive.
+	limit uint64
+
+	// high is the used memory in bytes starting the pressure.
+	high uint64
+
+	// low is the used memory in bytes below which the pressure ends.
+	low uint64
+
+	// cacheSize is the maximum size of the cache in bytes under the pressure.
+	cacheSize uint
+
+	// normalCacheSize is the maximum size of the cache in bytes without the
+	// pressure.
+	normalCacheSize uint
+
+	// interval is the interval between the checks.
+	interval time.Duration
+}
+
+// newMemoryPressure returns a new *memoryPressure configured with conf.
+// cacheSize is the configured size of the cache.  It returns nil if conf is nil
+// or there is no memory limit.
+func newMemoryPressure(
+	conf *MemoryPressureConfig,
+	cacheSize int,
+	logger *slog.Logger,
+) (m *memoryPressure) {
+	if conf == nil {
+		return nil
+	}
+
+	limit := conf.Limit
+	if limit == 0 {
+		limit = systemMemoryLimit()
+	}
+
+	if limit == 0 {
+		logger.Warn("memory pressure detection disabled; no memory limit found")
+
+		return nil
+	}
+
+	normalSize := uint(defaultCacheSize)
+	if cacheSize > 0 {
+		normalSize = uint(cacheSize)
+	}
+
+	high := cmp.Or(conf.HighWatermark, DefaultMemoryPressureHighWatermark)
+	low := cmp.Or(conf.LowWatermark, DefaultMemoryPressureLowWatermark)
+	shrink := cmp.Or(conf.CacheShrinkFactor, DefaultMemoryPressureCacheShrinkFactor)
+
+	return &memoryPressure{
+		onStateChange:   conf.OnStateChange,
+		usage:           runtimeMemoryUsage,
+		active:          &atomic.Bool{},
+		limit:           limit,
+		high:            uint64(float64(limit) * high),
+		low:             uint64(float64(limit) * low),
+		cacheSize:       max(1, uint(float64(normalSize)*shrink)),
+		normalCacheSize: normalSize,
+		interval:        cmp.Or(conf.CheckInterval, DefaultMemoryPressureCheckInterval),
+	}
+}
+
+// isActive returns true if the memory pressure lasts.
+func (m *memoryPressure) isActive() (ok bool) {
+	return m != nil && m.active.Load()
+}
+
+// cgroupMemoryLimitFiles are the files containing the memory limit of the
+// cgroup of the process for cgroup v2 and v1 respectively.
+var cgroupMemoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// maxCgroupMemoryLimit is the limit above which the cgroup v1 memory limit is
+// considered unset, since it's reported as a huge number rounded to the page
+// size.
+const maxCgroupMemoryLimit = 1 << 62
+
+// systemMemoryLimit returns the memory limit of the cgroup of the process or,
+// if there is none, the soft memory limit of the Go runtime.  It returns zero if
+// there is neither.
+func systemMemoryLimit() (limit uint64) {
+	for _, name := range cgroupMemoryLimitFiles {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+
+		limit, err = strconv.ParseUint(string(bytes.TrimSpace(data)), 10, 64)
+		if err == nil && limit > 0 && limit < maxCgroupMemoryLimit {
+			return limit
+		}
+	}
+
+	// A negative value doesn't change the limit and only returns it.
+	if goLimit := debug.SetMemoryLimit(-1); goLimit != math.MaxInt64 {
+		return uint64(goLimit)
+	}
+
+	return 0
+}
+
+// runtimeMemoryUsage returns the memory mapped by the Go runtime and not
+// released back to the system in bytes.
+func runtimeMemoryUsage() (used uint64) {
+	samples := []metrics.Sample{{
+		Name: "/memory/classes/total:bytes",
+	}, {
+		Name: "/memory/classes/heap/released:bytes",
+	}}
+	metrics.Read(samples)
+
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// startMemoryPressure starts checking the memory pressure periodically.  It
+// does nothing if the detection is disabled.
+func (p *Proxy) startMemoryPressure() {
+	m := p.memPressure
+	if m == nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(context.Background())
+	m.stopped = make(chan struct{})
+
+	go p.memoryPressureLoop(ctx, m)
+}
+
+// memoryPressureLoop checks the memory pressure periodically until ctx is
+// canceled.
+func (p *Proxy) memoryPressureLoop(ctx context.Context, m *memoryPressure) {
+	defer close(m.stopped)
+	defer slogutil.RecoverAndLog(ctx, p.logger)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkMemoryPressure(ctx, m)
+		}
+	}
+}
+
+// checkMemoryPressure degrades the cache if the memory pressure has begun and
+// restores it if the pressure has ended.  m must not be nil.
+func (p *Proxy) checkMemoryPressure(ctx context.Context, m *memoryPressure) {
+	used := m.usage()
+
+	active := m.active.Load()
+	switch {
+	case !active && used >= m.high:
+		m.active.Store(true)
+		p.cache.setMaxSize(m.cacheSize)
+		p.logger.WarnContext(
+			ctx,
+			"memory pressure detected; cache degraded",
+			"used", used,
+			"limit", m.limit,
+			"cache_size", m.cacheSize,
+		)
+	case active && used < m.low:
+		m.active.Store(false)
+		p.cache.setMaxSize(m.normalCacheSize)
+		p.logger.InfoContext(ctx, "memory pressure is over; cache restored", "used", used)
+	default:
+		return
+	}
+
+	if m.onStateChange != nil {
+		m.onStateChange(ctx, &MemoryPressureEvent{
+			Used:     used,
+			Limit:    m.limit,
+			IsActive: !active,
+		})
+	}
+}
+
+// stopMemoryPressure stops checking the memory pressure.  It does nothing if
+// the checks aren't started.
+func (p *Proxy) stopMemoryPressure() {
+	m := p.memPressure
+	if m == nil || m.cancel == nil {
+		return
+	}
+
+	m.cancel()
+	<-m.stopped
+
+	m.cancel = nil
+}
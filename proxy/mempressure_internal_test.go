@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_checkMemoryPressure(t *testing.T) {
+	const (
+		limit     = 1000
+		cacheSize = 4096
+	)
+
+	var events []*MemoryPressureEvent
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         cacheSize,
+		MemoryPressure: &MemoryPressureConfig{
+			OnStateChange: func(_ context.Context, e *MemoryPressureEvent) {
+				events = append(events, e)
+			},
+			Limit: limit,
+		},
+	})
+
+	m := p.memPressure
+	require.NotNil(t, m)
+
+	used := &atomic.Uint64{}
+	m.usage = used.Load
+
+	for i := range 100 {
+		host := fmt.Sprintf("host-%d.example.", i)
+		resp := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		resp.Response = true
+		resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{192, 0, 2, 1})}
+
+		p.cache.set(resp, upstreamWithAddr, slogutil.NewDiscardLogger())
+	}
+
+	require.Greater(t, p.cache.items.Stats().Size, cacheSize/2)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	used.Store(limit * 8 / 10)
+	p.checkMemoryPressure(ctx, m)
+	assert.False(t, m.isActive())
+	assert.Empty(t, events)
+
+	used.Store(limit * 95 / 100)
+	p.checkMemoryPressure(ctx, m)
+	assert.True(t, m.isActive())
+	assert.LessOrEqual(t, p.cache.items.Stats().Size, cacheSize/2)
+
+	// The pressure lasts until the usage falls below the low watermark.
+	used.Store(limit * 8 / 10)
+	p.checkMemoryPressure(ctx, m)
+	assert.True(t, m.isActive())
+
+	used.Store(limit / 2)
+	p.checkMemoryPressure(ctx, m)
+	assert.False(t, m.isActive())
+
+	assert.Equal(t, []*MemoryPressureEvent{{
+		Used:     limit * 95 / 100,
+		Limit:    limit,
+		IsActive: true,
+	}, {
+		Used:     limit / 2,
+		Limit:    limit,
+		IsActive: false,
+	}}, events)
+}
+
+func TestMemoryPressureConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		conf       *MemoryPressureConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &MemoryPressureConfig{},
+		name:       "defaults",
+		wantErrMsg: "",
+	}, {
+		conf: &MemoryPressureConfig{
+			HighWatermark: 0.5,
+		},
+		name:       "low_not_less",
+		wantErrMsg: "LowWatermark: out of range: must be less than 0.5, got 0.75",
+	}, {
+		conf: &MemoryPressureConfig{
+			HighWatermark:     1.5,
+			CacheShrinkFactor: -1,
+		},
+		name: "bad",
+		wantErrMsg: "HighWatermark: out of range: must be no greater than 1, got 1.5\n" +
+			"CacheShrinkFactor: out of range: must be no less than 0, got -1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
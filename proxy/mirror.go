@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+// MirrorConfig is the configuration of mirroring the sampled requests along
+// with their responses to an analysis sink.
+type MirrorConfig struct {
+	// Sink receives the mirrored queries.  It must not be nil.
+	Sink MirrorSink
+
+	// Zones are the patterns of the domain names, e.g. "example.org" or
+	// "*.example.org", the requests for which are always mirrored regardless
+	// of Rate.
+	Zones []string
+
+	// Rate is the share of the rest of the requests to mirror, from 0 to 1,
+	// e.g. 0.01 mirrors about one percent of them.
+	Rate float64
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *MirrorConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	return errors.Join(
+		validate.NotNilInterface("Sink", c.Sink),
+		validate.InRange("Rate", c.Rate, 0, 1),
+	)
+}
+
+// MirrorSink is the destination of the mirrored queries, e.g. a capture file.
+type MirrorSink interface {
+	// Mirror handles q.  It's called after the response is sent to the
+	// client, so it should return quickly to release the request handling
+	// goroutine.  It must be safe for concurrent use and must not modify q.
+	Mirror(q *MirroredQuery) (err error)
+}
+
+// MirrorSinkFunc is a function implementing [MirrorSink].
+type MirrorSinkFunc func(q *MirroredQuery) (err error)
+
+// type check
+var _ MirrorSink = MirrorSinkFunc(nil)
+
+// Mirror implements the [MirrorSink] interface for MirrorSinkFunc.
+func (f MirrorSinkFunc) Mirror(q *MirroredQuery) (err error) {
+	return f(q)
+}
+
+// MirroredQuery is a request along with its response passed to a
+// [MirrorSink].
+type MirroredQuery struct {
+	// QueryTime is the time the request has been received.
+	QueryTime time.Time
+
+	// ResponseTime is the time the response has been sent.
+	ResponseTime time.Time
+
+	// Req is the request message.
+	Req *dns.Msg
+
+	// Res is the response message.  It's nil if no response has been sent.
+	Res *dns.Msg
+
+	// Upstream is the address of the upstream that resolved the request.  It's
+	// empty if the response isn't received from an upstream, e.g. taken from
+	// cache.
+	Upstream string
+
+	// Proto is the protocol of the request.
+	Proto Proto
+
+	// Client is the address of the client.
+	Client netip.AddrPort
+
+	// Local is the address the request has been received on.  It's not valid
+	// if it's unknown.
+	Local netip.Addr
+}
+
+// mirror samples the requests and passes them to the sink.  A nil *mirror is
+// valid and mirrors nothing.
+type mirror struct {
+	// sink receives the sampled requests.
+	sink MirrorSink
+
+	// logger is used to log the errors of the sink.
+	logger *slog.Logger
+
+	// zones are the patterns for the domain names to always mirror.
+	zones *zonePatterns
+
+	// rate is the share of the rest of the requests to mirror.
+	rate float64
+}
+
+// newMirror returns a new *mirror configured with conf.  It returns nil if conf
+// is nil.
+func newMirror(conf *MirrorConfig, logger *slog.Logger) (m *mirror) {
+	if conf == nil {
+		return nil
+	}
+
+	return &mirror{
+		sink:   conf.Sink,
+		logger: logger,
+		zones:  newZonePatterns(conf.Zones),
+		rate:   conf.Rate,
+	}
+}
+
+// sampled returns true if the request should be mirrored.
+func (m *mirror) sampled(req *dns.Msg) (ok bool) {
+	return m.zones.matchQuestion(req) || (m.rate > 0 && rand.Float64() < m.rate)
+}
+
+// record passes d to the sink if it's sampled.  start is the time the request
+// has been received.
+func (m *mirror) record(d *DNSContext, start, end time.Time) {
+	if m == nil || !m.sampled(d.Req) {
+		return
+	}
+
+	q := &MirroredQuery{
+		QueryTime:    start,
+		ResponseTime: end,
+		Req:          d.Req,
+		Res:          d.Res,
+		Proto:        d.Proto,
+		Client:       d.Addr,
+		Local:        d.localIP,
+	}
+
+	if d.Upstream != nil {
+		q.Upstream = d.Upstream.Address()
+	}
+
+	if !q.Local.IsValid() && d.Conn != nil {
+		q.Local = netutil.NetAddrToAddrPort(d.Conn.LocalAddr()).Addr()
+	}
+
+	err := m.sink.Mirror(q)
+	if err != nil {
+		m.logger.Debug("mirroring query", "addr", d.Addr, slogutil.KeyError, err)
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// newMirrorQuery returns a new *MirroredQuery with a request for name from the
+// client and a response for it.
+func newMirrorQuery(t *testing.T, name, client string) (q *MirroredQuery) {
+	t.Helper()
+
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+	res := (&dns.Msg{}).SetReply(req)
+	res.Answer = []dns.RR{newRR(t, name, dns.TypeA, 60, net.IP{192, 0, 2, 1})}
+
+	now := time.Unix(1_700_000_000, 123_456_000)
+
+	return &MirroredQuery{
+		QueryTime:    now,
+		ResponseTime: now.Add(time.Millisecond),
+		Req:          req,
+		Res:          res,
+		Proto:        ProtoUDP,
+		Client:       netip.MustParseAddrPort(client),
+	}
+}
+
+func TestMirror_record(t *testing.T) {
+	var got []string
+	m := newMirror(&MirrorConfig{
+		Sink: MirrorSinkFunc(func(q *MirroredQuery) (err error) {
+			got = append(got, q.Req.Question[0].Name)
+
+			return nil
+		}),
+		Zones: []string{"*.example.org"},
+	}, slogutil.NewDiscardLogger())
+
+	for _, name := range []string{"example.org.", "www.example.org.", "example.net."} {
+		q := newMirrorQuery(t, name, "192.0.2.2:12345")
+		m.record(&DNSContext{
+			Req:   q.Req,
+			Res:   q.Res,
+			Proto: q.Proto,
+			Addr:  q.Client,
+		}, q.QueryTime, q.ResponseTime)
+	}
+
+	assert.Equal(t, []string{"www.example.org."}, got)
+
+	m.zones, m.rate = nil, 1
+	m.record(&DNSContext{Req: (&dns.Msg{}).SetQuestion("example.net.", dns.TypeA)}, time.Time{}, time.Time{})
+	assert.Equal(t, []string{"www.example.org.", "example.net."}, got)
+
+	// Shouldn't panic.
+	(*mirror)(nil).record(&DNSContext{}, time.Time{}, time.Time{})
+}
+
+func TestPCAPMirrorSink(t *testing.T) {
+	testCases := []struct {
+		name      string
+		client    string
+		ipHdrLen  int
+		ipVersion byte
+	}{{
+		name:      "ipv4",
+		client:    "192.0.2.2:12345",
+		ipHdrLen:  ipv4HeaderLen,
+		ipVersion: 4,
+	}, {
+		name:      "ipv6",
+		client:    "[2001:db8::2]:12345",
+		ipHdrLen:  ipv6HeaderLen,
+		ipVersion: 6,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			s, err := NewPCAPMirrorSink(buf)
+			require.NoError(t, err)
+
+			q := newMirrorQuery(t, "example.org.", tc.client)
+			require.NoError(t, s.Mirror(q))
+
+			data := buf.Bytes()
+			require.Greater(t, len(data), pcapHeaderLen)
+
+			assert.Equal(t, pcapMagic, binary.LittleEndian.Uint32(data))
+			assert.Equal(t, pcapLinkTypeRaw, binary.LittleEndian.Uint32(data[20:]))
+
+			data = data[pcapHeaderLen:]
+			for _, want := range []*dns.Msg{q.Req, q.Res} {
+				require.Greater(t, len(data), 16)
+
+				assert.Equal(t, uint32(q.QueryTime.Unix()), binary.LittleEndian.Uint32(data))
+
+				pktLen := int(binary.LittleEndian.Uint32(data[8:]))
+				pkt := data[16 : 16+pktLen]
+				data = data[16+pktLen:]
+
+				assert.Equal(t, tc.ipVersion, pkt[0]>>4)
+				if tc.ipVersion == 4 {
+					// The checksum of a valid header sums to all ones.
+					assert.Equal(t, uint16(0xffff), fold(checksum(0, pkt[:ipv4HeaderLen])))
+				}
+
+				msg := &dns.Msg{}
+				require.NoError(t, msg.Unpack(pkt[tc.ipHdrLen+udpHeaderLen:]))
+
+				assert.Equal(t, want.Id, msg.Id)
+				assert.Equal(t, want.Response, msg.Response)
+			}
+
+			assert.Empty(t, data)
+		})
+	}
+}
+
+func TestDnstapMirrorSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s, err := NewDnstapMirrorSink(buf, "test", "")
+	require.NoError(t, err)
+
+	q := newMirrorQuery(t, "example.org.", "192.0.2.2:12345")
+	require.NoError(t, s.Mirror(q))
+	require.NoError(t, s.Close())
+
+	data := buf.Bytes()
+	start := appendControlFrame(nil, fstrmControlStart, fstrmContentType)
+	require.True(t, bytes.HasPrefix(data, start))
+
+	data = data[len(start):]
+
+	var types []uint64
+	for range 2 {
+		require.Greater(t, len(data), 4)
+
+		frameLen := int(binary.BigEndian.Uint32(data))
+		require.NotZero(t, frameLen)
+
+		types = append(types, dnstapMessageType(t, data[4:4+frameLen]))
+		data = data[4+frameLen:]
+	}
+
+	assert.Equal(t, []uint64{msgTypeClientQuery, msgTypeClientResponse}, types)
+	assert.Equal(t, appendControlFrame(nil, fstrmControlStop, ""), data)
+}
+
+// dnstapMessageType returns the type of the Message within the encoded Dnstap
+// message.
+func dnstapMessageType(t *testing.T, data []byte) (typ uint64) {
+	t.Helper()
+
+	msg := fieldValue(t, data, dnstapFieldMessage)
+	require.NotNil(t, msg)
+
+	v, n := protowire.ConsumeVarint(fieldValue(t, msg, msgFieldType))
+	require.Positive(t, n)
+
+	return v
+}
+
+// fieldValue returns the raw value of the field num of the encoded message.
+func fieldValue(t *testing.T, data []byte, num protowire.Number) (v []byte) {
+	t.Helper()
+
+	for len(data) > 0 {
+		fieldNum, fieldType, n := protowire.ConsumeTag(data)
+		require.Positive(t, n)
+
+		data = data[n:]
+		n = protowire.ConsumeFieldValue(fieldNum, fieldType, data)
+		require.Positive(t, n)
+
+		if fieldNum == num {
+			if fieldType == protowire.BytesType {
+				v, _ = protowire.ConsumeBytes(data)
+
+				return v
+			}
+
+			return data[:n]
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
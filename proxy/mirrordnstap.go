@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Constants of the Frame Streams protocol, see
+// https://farsightsec.github.io/fstrm.
+const (
+	// fstrmContentType is the content type of the dnstap frames.
+	fstrmContentType = "protobuf:dnstap.Dnstap"
+
+	// fstrmControlStart is the type of the control frame starting the stream.
+	fstrmControlStart uint32 = 0x02
+
+	// fstrmControlStop is the type of the control frame ending the stream.
+	fstrmControlStop uint32 = 0x03
+
+	// fstrmFieldContentType is the type of the content type field of the
+	// control frames.
+	fstrmFieldContentType uint32 = 0x01
+)
+
+// Field numbers and values of the dnstap messages, see
+// https://github.com/dnstap/dnstap.pb/blob/master/dnstap.proto.
+const (
+	dnstapFieldIdentity protowire.Number = 1
+	dnstapFieldVersion  protowire.Number = 2
+	dnstapFieldMessage  protowire.Number = 14
+	dnstapFieldType     protowire.Number = 15
+
+	// dnstapTypeMessage is the type of the dnstap messages containing a
+	// Message.
+	dnstapTypeMessage = 1
+
+	msgFieldType             protowire.Number = 1
+	msgFieldSocketFamily     protowire.Number = 2
+	msgFieldSocketProtocol   protowire.Number = 3
+	msgFieldQueryAddress     protowire.Number = 4
+	msgFieldResponseAddress  protowire.Number = 5
+	msgFieldQueryPort        protowire.Number = 6
+	msgFieldQueryTimeSec     protowire.Number = 8
+	msgFieldQueryTimeNsec    protowire.Number = 9
+	msgFieldQueryMessage     protowire.Number = 10
+	msgFieldResponseTimeSec  protowire.Number = 12
+	msgFieldResponseTimeNsec protowire.Number = 13
+	msgFieldResponseMessage  protowire.Number = 14
+
+	msgTypeClientQuery    = 5
+	msgTypeClientResponse = 6
+
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+)
+
+// dnstapSocketProtocols maps the protocols of the requests to the values of
+// the SocketProtocol enumeration of dnstap.
+//
+// TODO(e.burkov):  Distinguish DNSCrypt over TCP.
+var dnstapSocketProtocols = map[Proto]uint64{
+	ProtoUDP:      1,
+	ProtoTCP:      2,
+	ProtoTLS:      3,
+	ProtoHTTPS:    4,
+	ProtoDNSCrypt: 5,
+	ProtoQUIC:     7,
+}
+
+// DnstapMirrorSink is a [MirrorSink] writing the mirrored queries as a
+// unidirectional Frame Streams of dnstap messages, e.g. into a file for
+// reading with the dnstap tools.  Each query is written as a CLIENT_QUERY and,
+// if responded, a CLIENT_RESPONSE message.
+type DnstapMirrorSink struct {
+	// mu protects w.
+	mu *sync.Mutex
+
+	// w is the destination of the frames.
+	w io.Writer
+
+	// identity is the name of the server put into the messages.
+	identity string
+
+	// version is the version of the server put into the messages.
+	version string
+}
+
+// NewDnstapMirrorSink writes the start of the stream to w and returns a new
+// *DnstapMirrorSink writing the messages into it.  identity and version are
+// put into the messages, if not empty.  w must not be nil.
+func NewDnstapMirrorSink(w io.Writer, identity, version string) (s *DnstapMirrorSink, err error) {
+	_, err = w.Write(appendControlFrame(nil, fstrmControlStart, fstrmContentType))
+	if err != nil {
+		return nil, fmt.Errorf("writing dnstap stream start: %w", err)
+	}
+
+	return &DnstapMirrorSink{
+		mu:       &sync.Mutex{},
+		w:        w,
+		identity: identity,
+		version:  version,
+	}, nil
+}
+
+// type check
+var _ MirrorSink = (*DnstapMirrorSink)(nil)
+
+// Mirror implements the [MirrorSink] interface for *DnstapMirrorSink.
+func (s *DnstapMirrorSink) Mirror(q *MirroredQuery) (err error) {
+	req, err := q.Req.Pack()
+	if err != nil {
+		return fmt.Errorf("packing request: %w", err)
+	}
+
+	buf := appendDataFrame(nil, s.appendDnstap(nil, msgTypeClientQuery, q, req, nil))
+
+	if q.Res != nil {
+		var res []byte
+		res, err = q.Res.Pack()
+		if err != nil {
+			return fmt.Errorf("packing response: %w", err)
+		}
+
+		buf = appendDataFrame(buf, s.appendDnstap(nil, msgTypeClientResponse, q, nil, res))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(buf)
+
+	return err
+}
+
+// Close writes the end of the stream.  It doesn't close the underlying writer.
+func (s *DnstapMirrorSink) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(appendControlFrame(nil, fstrmControlStop, ""))
+	if err != nil {
+		return fmt.Errorf("writing dnstap stream stop: %w", err)
+	}
+
+	return nil
+}
+
+// appendDnstap appends the encoded dnstap message of type typ about q to b.
+// reqData and resData are the packed messages to include, if any.
+func (s *DnstapMirrorSink) appendDnstap(
+	b []byte,
+	typ uint64,
+	q *MirroredQuery,
+	reqData []byte,
+	resData []byte,
+) (res []byte) {
+	if s.identity != "" {
+		b = protowire.AppendTag(b, dnstapFieldIdentity, protowire.BytesType)
+		b = protowire.AppendString(b, s.identity)
+	}
+
+	if s.version != "" {
+		b = protowire.AppendTag(b, dnstapFieldVersion, protowire.BytesType)
+		b = protowire.AppendString(b, s.version)
+	}
+
+	b = protowire.AppendTag(b, dnstapFieldMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendDnstapMessage(nil, typ, q, reqData, resData))
+
+	b = protowire.AppendTag(b, dnstapFieldType, protowire.VarintType)
+
+	return protowire.AppendVarint(b, dnstapTypeMessage)
+}
+
+// appendDnstapMessage appends the encoded Message of type typ about q to b.
+// reqData and resData are the packed messages to include, if any.
+func appendDnstapMessage(
+	b []byte,
+	typ uint64,
+	q *MirroredQuery,
+	reqData []byte,
+	resData []byte,
+) (res []byte) {
+	b = appendVarintField(b, msgFieldType, typ)
+
+	client := q.Client.Addr().Unmap()
+	if client.IsValid() {
+		family := uint64(socketFamilyINET)
+		if client.Is6() {
+			family = socketFamilyINET6
+		}
+
+		b = appendVarintField(b, msgFieldSocketFamily, family)
+	}
+
+	if proto, ok := dnstapSocketProtocols[q.Proto]; ok {
+		b = appendVarintField(b, msgFieldSocketProtocol, proto)
+	}
+
+	if client.IsValid() {
+		b = appendBytesField(b, msgFieldQueryAddress, client.AsSlice())
+		b = appendVarintField(b, msgFieldQueryPort, uint64(q.Client.Port()))
+	}
+
+	if local := q.Local.Unmap(); local.IsValid() && local.Is4() == client.Is4() {
+		b = appendBytesField(b, msgFieldResponseAddress, local.AsSlice())
+	}
+
+	b = appendTimeFields(b, msgFieldQueryTimeSec, msgFieldQueryTimeNsec, q.QueryTime)
+	if reqData != nil {
+		b = appendBytesField(b, msgFieldQueryMessage, reqData)
+	}
+
+	if resData != nil {
+		b = appendTimeFields(b, msgFieldResponseTimeSec, msgFieldResponseTimeNsec, q.ResponseTime)
+		b = appendBytesField(b, msgFieldResponseMessage, resData)
+	}
+
+	return b
+}
+
+// appendVarintField appends the varint field num with value v to b.
+func appendVarintField(b []byte, num protowire.Number, v uint64) (res []byte) {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
+
+// appendBytesField appends the length-delimited field num with value v to b.
+func appendBytesField(b []byte, num protowire.Number, v []byte) (res []byte) {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, v)
+}
+
+// appendTimeFields appends t as the seconds field secNum and the nanoseconds
+// field nsecNum to b.
+func appendTimeFields(b []byte, secNum, nsecNum protowire.Number, t time.Time) (res []byte) {
+	b = appendVarintField(b, secNum, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecNum, protowire.Fixed32Type)
+
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
+
+// appendDataFrame appends the Frame Streams data frame containing data to b.
+func appendDataFrame(b, data []byte) (res []byte) {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+
+	return append(b, data...)
+}
+
+// appendControlFrame appends the Frame Streams control frame of type typ to b.
+// contentType is included, if not empty.
+func appendControlFrame(b []byte, typ uint32, contentType string) (res []byte) {
+	frameLen := 4
+	if contentType != "" {
+		frameLen += 8 + len(contentType)
+	}
+
+	// The control frames start with the zero escape sequence.
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(frameLen))
+	b = binary.BigEndian.AppendUint32(b, typ)
+	if contentType != "" {
+		b = binary.BigEndian.AppendUint32(b, fstrmFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+
+	return b
+}
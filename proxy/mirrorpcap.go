@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// PCAPMirrorSink is a [MirrorSink] writing the mirrored queries in the libpcap
+// file format, which is understood by most of the traffic analyzers.  The
+// messages are written as plain DNS over UDP between the client and port 53 of
+// the local address regardless of the actual protocol of the request, so that
+// the analyzers decode them.
+type PCAPMirrorSink struct {
+	// mu protects w.
+	mu *sync.Mutex
+
+	// w is the destination of the packets.
+	w io.Writer
+}
+
+// NewPCAPMirrorSink writes the file header to w and returns a new
+// *PCAPMirrorSink writing the packets into it.  w must not be nil.
+func NewPCAPMirrorSink(w io.Writer) (s *PCAPMirrorSink, err error) {
+	_, err = w.Write(appendPCAPHeader(nil))
+	if err != nil {
+		return nil, fmt.Errorf("writing pcap header: %w", err)
+	}
+
+	return &PCAPMirrorSink{
+		mu: &sync.Mutex{},
+		w:  w,
+	}, nil
+}
+
+// type check
+var _ MirrorSink = (*PCAPMirrorSink)(nil)
+
+// Mirror implements the [MirrorSink] interface for *PCAPMirrorSink.
+func (s *PCAPMirrorSink) Mirror(q *MirroredQuery) (err error) {
+	client, server := pcapEndpoints(q.Client, q.Local)
+
+	req, err := q.Req.Pack()
+	if err != nil {
+		return fmt.Errorf("packing request: %w", err)
+	}
+
+	buf, err := appendPCAPRecord(nil, q.QueryTime, client, server, req, 0)
+	if err != nil {
+		return fmt.Errorf("writing request: %w", err)
+	}
+
+	if q.Res != nil {
+		var res []byte
+		res, err = q.Res.Pack()
+		if err != nil {
+			return fmt.Errorf("packing response: %w", err)
+		}
+
+		buf, err = appendPCAPRecord(buf, q.ResponseTime, server, client, res, 0)
+		if err != nil {
+			return fmt.Errorf("writing response: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(buf)
+
+	return err
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+// NetworkChangeConfig is the configuration of reacting to the changes of the
+// host network, see [Proxy.HandleNetworkChange].
+type NetworkChangeConfig struct {
+	// RefreshPause is the period of time after a network change during which
+	// the proactive cache refreshes are postponed, so that they don't fail
+	// while the network settles.  Zero disables pausing.
+	RefreshPause time.Duration
+
+	// FlushSubnetCache, if true, makes the entries cached for specific client
+	// subnets removed on a network change, since the upstreams may see the
+	// proxy from another network now.
+	FlushSubnetCache bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *NetworkChangeConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	return validate.NotNegative("RefreshPause", c.RefreshPause)
+}
+
+// HandleNetworkChange reacts to a change of the host network, e.g. an interface
+// going up or down or the default route changing, in accordance with
+// [Config.NetworkChange].  The upstreams are replaced with the ones of c just
+// like [Proxy.Reload] does, so c should contain the newly created upstreams to
+// have them bootstrapped and dialed again from the new network.  c must not be
+// nil.
+func (p *Proxy) HandleNetworkChange(ctx context.Context, c *Config) (err error) {
+	p.logger.InfoContext(ctx, "handling network change")
+
+	if nc := p.NetworkChange; nc != nil && p.cache != nil {
+		if nc.RefreshPause > 0 {
+			p.cache.pauseRefresh(nc.RefreshPause)
+		}
+
+		if nc.FlushSubnetCache {
+			p.cache.clearItemsWithSubnet()
+		}
+	}
+
+	return p.Reload(ctx, c)
+}
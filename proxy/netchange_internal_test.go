@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_HandleNetworkChange(t *testing.T) {
+	prevUps, _, prevCloses := newReloadTestUpstream(t, net.IP{192, 0, 2, 1})
+	nextUps, _, nextCloses := newReloadTestUpstream(t, net.IP{192, 0, 2, 2})
+
+	newConf := func(u upstream.Upstream) (c *Config) {
+		return &Config{
+			Logger:                 slogutil.NewDiscardLogger(),
+			UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			CacheEnabled:           true,
+			CacheSizeBytes:         testCacheSize,
+			EnableEDNSClientSubnet: true,
+			NetworkChange: &NetworkChangeConfig{
+				RefreshPause:     time.Hour,
+				FlushSubnetCache: true,
+			},
+		}
+	}
+
+	p := mustNew(t, newConf(prevUps))
+
+	reply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, "example.com.", dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+	}).SetQuestion("example.com.", dns.TypeA)
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	subnet := &net.IPNet{IP: net.IP{192, 0, 2, 0}, Mask: net.CIDRMask(24, 32)}
+
+	l := slogutil.NewDiscardLogger()
+	p.cache.set(reply, upstreamWithAddr, l)
+	p.cache.setWithSubnet(reply, upstreamWithAddr, subnet, l)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	err := p.HandleNetworkChange(ctx, newConf(nextUps))
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), prevCloses.Load())
+	assert.Zero(t, nextCloses.Load())
+	assert.Same(t, nextUps, p.live.Load().upstreams.Upstreams[0])
+
+	ci, _, _ := p.cache.get(req)
+	assert.NotNil(t, ci)
+
+	ci, _, _ = p.cache.getWithSubnet(req, subnet)
+	assert.Nil(t, ci)
+
+	assert.Greater(t, p.cache.refreshPausedUntil.Load(), time.Now().UnixNano())
+}
+
+func TestCache_pauseRefresh(t *testing.T) {
+	var resolved atomic.Int32
+
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+			resolved.Add(1)
+
+			return true, nil
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	reply := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, "example.com.", dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+	}).SetQuestion("example.com.", dns.TypeA)
+	c.set(reply, upstreamWithAddr, slogutil.NewDiscardLogger())
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	keyStr := string(msgToKey(req))
+
+	c.pauseRefresh(time.Hour)
+	c.refreshEntry(keyStr, req)
+	assert.Zero(t, resolved.Load())
+
+	// The refresh is retried after the pause.
+	val, ok := c.refreshTimers.Load(keyStr)
+	require.True(t, ok)
+
+	entry := testutil.RequireTypeAssert[*refreshTimerEntry](t, val)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entry.at, time.Minute)
+
+	c.pauseRefresh(0)
+	c.refreshEntry(keyStr, req)
+	assert.Equal(t, int32(1), resolved.Load())
+}
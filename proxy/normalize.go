@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// originalRequest contains the properties of the request changed by
+// [normalizeRequest].
+type originalRequest struct {
+	// name is the original question name.
+	name string
+
+	// recursionDesired is the original RD flag.
+	recursionDesired bool
+}
+
+// normalizeRequest makes req the same for all the queries differing only in
+// the bits irrelevant for the upstreams, i.e. the RD flag and the case of the
+// question name.  Such queries are already considered identical by the cache
+// and the pending requests tracking, so that the upstreams get a single
+// canonical query for them.  req must have a question.  The returned value
+// should be used to restore the request and the response.
+func normalizeRequest(req *dns.Msg) (orig originalRequest) {
+	q := &req.Question[0]
+	orig = originalRequest{
+		name:             q.Name,
+		recursionDesired: req.RecursionDesired,
+	}
+
+	q.Name = strings.ToLower(q.Name)
+	req.RecursionDesired = true
+
+	return orig
+}
+
+// restore reverts the changes made by [normalizeRequest] to req and makes resp,
+// if any, match it.
+func (orig originalRequest) restore(req, resp *dns.Msg) {
+	req.Question[0].Name = orig.name
+	req.RecursionDesired = orig.recursionDesired
+
+	if resp == nil {
+		return
+	}
+
+	resp.RecursionDesired = orig.recursionDesired
+	if len(resp.Question) > 0 && strings.EqualFold(resp.Question[0].Name, orig.name) {
+		// Keep the case of the question from the client, since some of them
+		// use it to mitigate the spoofing, see
+		// https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00.
+		resp.Question[0].Name = orig.name
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"log/slog"
 	"sync"
 	"testing"
@@ -20,7 +21,10 @@ type testCachingResolver struct {
 
 // replyFromUpstream implements the cachingResolver interface for
 // *testCachingResolver.
-func (tcr *testCachingResolver) replyFromUpstream(dctx *DNSContext) (ok bool, err error) {
+func (tcr *testCachingResolver) replyFromUpstream(
+	_ context.Context,
+	dctx *DNSContext,
+) (ok bool, err error) {
 	return tcr.onReplyFromUpstream(dctx)
 }
 
@@ -29,6 +33,11 @@ func (tcr *testCachingResolver) cacheResp(dctx *DNSContext) {
 	tcr.onCacheResp(dctx)
 }
 
+// runContext implements the cachingResolver interface for *testCachingResolver.
+func (tcr *testCachingResolver) runContext() (ctx context.Context) {
+	return context.Background()
+}
+
 func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 	in, out := make(chan unit), make(chan unit)
 	var timesResolved, timesSet int
@@ -53,7 +62,7 @@ func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 	sameKey := []byte{1, 2, 3}
 
 	// Start the primary goroutine.
-	go s.resolveOnce(nil, sameKey, slogutil.NewDiscardLogger())
+	go s.resolveOnce(context.Background(), nil, sameKey, slogutil.NewDiscardLogger())
 	// Block until the primary goroutine reaches the resolve function.
 	<-out
 
@@ -65,7 +74,7 @@ func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 		go func() {
 			defer wg.Done()
 
-			s.resolveOnce(nil, sameKey, slogutil.NewDiscardLogger())
+			s.resolveOnce(context.Background(), nil, sameKey, slogutil.NewDiscardLogger())
 		}()
 	}
 
@@ -97,7 +106,7 @@ func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
 			onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return true, rErr },
 			onCacheResp:         func(_ *DNSContext) { cached = true },
 		})
-		s.resolveOnce(nil, key, l)
+		s.resolveOnce(context.Background(), nil, key, l)
 
 		assert.True(t, cached)
 		assert.Contains(t, logOutput.String(), rErr.Error())
@@ -109,7 +118,7 @@ func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
 			onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
 			onCacheResp:         func(_ *DNSContext) { cached = true },
 		})
-		s.resolveOnce(nil, key, slogutil.NewDiscardLogger())
+		s.resolveOnce(context.Background(), nil, key, slogutil.NewDiscardLogger())
 
 		assert.False(t, cached)
 	})
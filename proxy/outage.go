@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"cmp"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/AdguardTeam/golibs/validate"
+)
+
+const (
+	// DefaultCacheOutageFailureThreshold is the default value for
+	// [CacheOutageConfig.FailureThreshold].
+	DefaultCacheOutageFailureThreshold uint = 5
+
+	// DefaultCacheOutageWindow is the default value for
+	// [CacheOutageConfig.Window].
+	DefaultCacheOutageWindow = 30 * time.Second
+)
+
+// CacheOutageConfig is the configuration of serving the cached entries longer
+// while the upstreams are unavailable.
+type CacheOutageConfig struct {
+	// TTLMultiplier is the factor the lifetime of the cached entries expiring
+	// during an outage is multiplied by, e.g. 2 makes the entry with TTL of 60
+	// seconds served as fresh for up to 60 more seconds.  Stretched entries
+	// aren't refreshed, and the proactive refreshes are suppressed while the
+	// outage lasts.  It must not be less than 1.
+	TTLMultiplier float64
+
+	// FailureThreshold is the number of consecutive failed upstream exchanges
+	// to consider the upstreams unavailable.  Zero means
+	// [DefaultCacheOutageFailureThreshold].
+	FailureThreshold uint
+
+	// Window is the period of time since the latest failed exchange after
+	// which the outage is considered over even if no exchange has succeeded
+	// since, so that the suppressed refreshes probe the upstreams again.  Zero
+	// means [DefaultCacheOutageWindow].
+	Window time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *CacheOutageConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	return errors.Join(
+		validate.NoLessThan("TTLMultiplier", c.TTLMultiplier, 1),
+		validate.NotNegative("Window", c.Window),
+	)
+}
+
+// outageDetector detects the upstream outages by the consecutive failed
+// exchanges.  A nil *outageDetector is valid and never detects an outage.
+type outageDetector struct {
+	// clock is used to get the time of the exchanges.
+	clock timeutil.Clock
+
+	// logger is used to log the beginning and the end of outages.
+	logger *slog.Logger
+
+	// lastFailure is the Unix time in nanoseconds of the latest failed
+	// exchange.
+	lastFailure *atomic.Int64
+
+	// failures is the number of consecutive failed exchanges.
+	failures *atomic.Uint64
+
+	// ttlMultiplier is the factor the lifetime of the entries expiring during
+	// an outage is multiplied by.
+	ttlMultiplier float64
+
+	// threshold is the number of consecutive failures which starts an outage.
+	threshold uint64
+
+	// window is the duration of the outage since the latest failure.
+	window time.Duration
+}
+
+// newOutageDetector returns a new *outageDetector configured with conf.  It
+// returns nil if conf is nil.
+func newOutageDetector(
+	conf *CacheOutageConfig,
+	clock timeutil.Clock,
+	logger *slog.Logger,
+) (d *outageDetector) {
+	if conf == nil {
+		return nil
+	}
+
+	return &outageDetector{
+		clock:         clock,
+		logger:        logger,
+		lastFailure:   &atomic.Int64{},
+		failures:      &atomic.Uint64{},
+		ttlMultiplier: conf.TTLMultiplier,
+		threshold:     uint64(cmp.Or(conf.FailureThreshold, DefaultCacheOutageFailureThreshold)),
+		window:        cmp.Or(conf.Window, DefaultCacheOutageWindow),
+	}
+}
+
+// record registers the result of an upstream exchange.  err is the error of
+// the exchange.
+func (d *outageDetector) record(err error) {
+	if d == nil {
+		return
+	}
+
+	if err == nil {
+		if d.failures.Swap(0) >= d.threshold {
+			d.logger.Info("upstream outage is over")
+		}
+
+		return
+	}
+
+	d.lastFailure.Store(d.clock.Now().UnixNano())
+	if d.failures.Add(1) == d.threshold {
+		d.logger.Warn("upstream outage detected", "failures", d.threshold)
+	}
+}
+
+// isActive returns true if the upstreams are considered unavailable.
+func (d *outageDetector) isActive() (ok bool) {
+	if d == nil || d.failures.Load() < d.threshold {
+		return false
+	}
+
+	last := time.Unix(0, d.lastFailure.Load())
+
+	return d.clock.Now().Sub(last) < d.window
+}
+
+// stretch returns the expiration time of the entry with the given expiration
+// time and TTL stretched for an outage.  d must not be nil.
+func (d *outageDetector) stretch(expire time.Time, ttl uint32) (stretched time.Time) {
+	extra := time.Duration(float64(ttl) * (d.ttlMultiplier - 1) * float64(time.Second))
+
+	return expire.Add(extra)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutageDetector(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := &faketime.Clock{
+		OnNow: func() (n time.Time) { return now },
+	}
+
+	d := newOutageDetector(&CacheOutageConfig{
+		TTLMultiplier:    2,
+		FailureThreshold: 2,
+		Window:           10 * time.Second,
+	}, clock, slogutil.NewDiscardLogger())
+
+	errExchange := errors.New("exchange failed")
+
+	d.record(errExchange)
+	assert.False(t, d.isActive())
+
+	d.record(errExchange)
+	assert.True(t, d.isActive())
+
+	now = now.Add(10 * time.Second)
+	assert.False(t, d.isActive())
+
+	// The failures are still counted after the window passes.
+	d.record(errExchange)
+	assert.True(t, d.isActive())
+
+	d.record(nil)
+	assert.False(t, d.isActive())
+
+	assert.False(t, (*outageDetector)(nil).isActive())
+}
+
+func TestCache_outageStretch(t *testing.T) {
+	const (
+		name = "example.org."
+		ttl  = 60
+	)
+
+	now := time.Now()
+	clock := &faketime.Clock{
+		OnNow: func() (n time.Time) { return now },
+	}
+
+	c := newTestCache(t, nil)
+	c.outage = newOutageDetector(&CacheOutageConfig{
+		TTLMultiplier:    2,
+		FailureThreshold: 1,
+	}, clock, slogutil.NewDiscardLogger())
+
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{newRR(t, name, dns.TypeA, ttl, net.IP{192, 0, 2, 1})}
+	c.set(resp, nil, slogutil.NewDiscardLogger())
+
+	// Make the entry expired 10 seconds ago.
+	key := msgToKey(req)
+	data := c.items.Get(key)
+	require.NotNil(t, data)
+
+	binary.BigEndian.PutUint32(data, uint32(now.Unix())-10)
+	c.items.Set(key, data)
+
+	ci, expired, _ := c.get(req)
+	assert.Nil(t, ci)
+	assert.True(t, expired)
+
+	// The entry is deleted from the non-optimistic cache, so store it again.
+	c.items.Set(key, data)
+	c.outage.record(errors.New("exchange failed"))
+
+	ci, expired, _ = c.get(req)
+	require.NotNil(t, ci)
+
+	assert.False(t, expired)
+	require.Len(t, ci.m.Answer, 1)
+	assert.InDelta(t, ttl-10, ci.m.Answer[0].Header().Ttl, 1)
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Constants of the libpcap file format, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcap-04.html.
+const (
+	// pcapMagic is the magic number of the files with the microsecond
+	// timestamps.
+	pcapMagic uint32 = 0xa1b2c3d4
+
+	// pcapSnapLen is the maximum length of the captured packets.
+	pcapSnapLen uint32 = 0xffff
+
+	// pcapLinkTypeRaw is the link type of the packets starting with the IPv4
+	// or IPv6 header.
+	pcapLinkTypeRaw uint32 = 101
+
+	// pcapHeaderLen is the length of the file header.
+	pcapHeaderLen = 24
+)
+
+// Constants of the synthetic packets written into the libpcap files.
+const (
+	// ipv4HeaderLen is the length of the IPv4 header without options.
+	ipv4HeaderLen = 20
+
+	// ipv6HeaderLen is the length of the IPv6 header.
+	ipv6HeaderLen = 40
+
+	// udpHeaderLen is the length of the UDP header.
+	udpHeaderLen = 8
+
+	// protoNumUDP is the IP protocol number of UDP.
+	protoNumUDP = 17
+
+	// pcapHopLimit is the TTL, or the hop limit, of the packets.
+	pcapHopLimit = 64
+
+	// pcapServerPort is the port of the server side of the packets.
+	pcapServerPort = 53
+)
+
+// appendPCAPHeader appends the libpcap file header to b.
+func appendPCAPHeader(b []byte) (res []byte) {
+	b = binary.LittleEndian.AppendUint32(b, pcapMagic)
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint16(b, 4)
+	// The time zone offset and the accuracy of timestamps are always zero.
+	b = binary.LittleEndian.AppendUint64(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, pcapSnapLen)
+
+	return binary.LittleEndian.AppendUint32(b, pcapLinkTypeRaw)
+}
+
+// pcapEndpoints returns the addresses of the packets between the client and
+// the local address, which may be invalid.  The returned addresses are always
+// valid and of the same address family.
+func pcapEndpoints(client netip.AddrPort, local netip.Addr) (c, server netip.AddrPort) {
+	c = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	if !c.Addr().IsValid() {
+		c = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+
+	local = local.Unmap()
+	if !local.IsValid() || local.Is4() != c.Addr().Is4() {
+		local = netip.IPv4Unspecified()
+		if c.Addr().Is6() {
+			local = netip.IPv6Unspecified()
+		}
+	}
+
+	return c, netip.AddrPortFrom(local, pcapServerPort)
+}
+
+// appendPCAPRecord appends the record of the UDP packet from src to dst
+// containing payload to b.  Only the first snapLen bytes of payload are
+// included, unless snapLen is zero.  src and dst must be of the same address
+// family.
+func appendPCAPRecord(
+	b []byte,
+	t time.Time,
+	src netip.AddrPort,
+	dst netip.AddrPort,
+	payload []byte,
+	snapLen int,
+) (res []byte, err error) {
+	ipHdrLen := ipv4HeaderLen
+	if src.Addr().Is6() {
+		ipHdrLen = ipv6HeaderLen
+	}
+
+	udpLen := udpHeaderLen + len(payload)
+	pktLen := ipHdrLen + udpLen
+	if pktLen > int(pcapSnapLen) {
+		return b, fmt.Errorf("message of %d bytes is too large", len(payload))
+	}
+
+	inclLen := pktLen
+	if snapLen > 0 {
+		inclLen = min(pktLen, ipHdrLen+udpHeaderLen+snapLen)
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Unix()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(t.Nanosecond()/int(time.Microsecond)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(inclLen))
+	b = binary.LittleEndian.AppendUint32(b, uint32(pktLen))
+
+	pkt := make([]byte, pktLen)
+	udp := pkt[ipHdrLen:]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+
+	srcIP, dstIP := src.Addr().AsSlice(), dst.Addr().AsSlice()
+	if src.Addr().Is4() {
+		putIPv4Header(pkt, srcIP, dstIP)
+	} else {
+		putIPv6Header(pkt, srcIP, dstIP)
+	}
+
+	// The pseudo-header contains the addresses, the protocol number, and the
+	// length of the UDP datagram.
+	sum := checksum(0, srcIP)
+	sum = checksum(sum, dstIP)
+	sum += protoNumUDP + uint32(udpLen)
+	csum := ^fold(checksum(sum, udp))
+	if csum == 0 {
+		// The zero checksum means no checksum at all, see RFC 768.
+		csum = 0xffff
+	}
+
+	binary.BigEndian.PutUint16(udp[6:], csum)
+
+	return append(b, pkt[:inclLen]...), nil
+}
+
+// putIPv4Header puts the IPv4 header of the UDP packet from src to dst into
+// pkt.
+func putIPv4Header(pkt, src, dst []byte) {
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	// Set the "Don't Fragment" flag.
+	pkt[6] = 0x40
+	pkt[8] = pcapHopLimit
+	pkt[9] = protoNumUDP
+	copy(pkt[12:], src)
+	copy(pkt[16:], dst)
+	binary.BigEndian.PutUint16(pkt[10:], ^fold(checksum(0, pkt[:ipv4HeaderLen])))
+}
+
+// putIPv6Header puts the IPv6 header of the UDP packet from src to dst into
+// pkt.
+func putIPv6Header(pkt, src, dst []byte) {
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-ipv6HeaderLen))
+	pkt[6] = protoNumUDP
+	pkt[7] = pcapHopLimit
+	copy(pkt[8:], src)
+	copy(pkt[24:], dst)
+}
+
+// checksum adds the 16-bit words of data to the ones' complement sum.  The data
+// of odd length is padded with zero.
+func checksum(sum uint32, data []byte) (res uint32) {
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint32(binary.BigEndian.Uint16(data))
+	}
+
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+
+	return sum
+}
+
+// fold folds the carries of sum into the 16-bit ones' complement sum.
+func fold(sum uint32) (res uint16) {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return uint16(sum)
+}
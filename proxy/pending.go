@@ -14,21 +14,48 @@ import (
 //   - [defaultPendingRequests].
 //   - [emptyPendingRequests].
 type pendingRequests interface {
-	// queue is called for each request.  It returns false if there are no
+	// queue is called for each cache miss.  It returns false if there are no
 	// identical requests in progress.  Otherwise it blocks until the first
 	// request is completed and returns the error that occurred during its
-	// resolution.
+	// resolution, or until ctx is done and returns its error.
 	queue(ctx context.Context, dctx *DNSContext) (loaded bool, err error)
 
 	// done must be called after the request is completed, if queue returned
-	// false for it.
+	// false for it.  dctx.Res must not be modified for the particular request
+	// yet, since it's shared with the identical ones.
 	done(ctx context.Context, dctx *DNSContext, err error)
 }
 
 // defaultPendingRequests is a default implementation of the [pendingRequests]
 // interface.  It must be created with [newDefaultPendingRequests].
 type defaultPendingRequests struct {
-	storage *syncutil.Map[string, *pendingRequest]
+	storage *syncutil.Map[pendingKey, *pendingRequest]
+}
+
+// pendingKey is the key of the identical requests in progress.
+type pendingKey struct {
+	// cache is the cache the response is stored in, if it's specific to the
+	// client policy, see [DNSContext.clientCache].
+	cache *cache
+
+	// msg is the cache key of the request.
+	msg string
+}
+
+// newPendingKey returns the key of the request of dctx.
+func newPendingKey(dctx *DNSContext) (k pendingKey) {
+	var key []byte
+	if dctx.ReqECS != nil {
+		ones, _ := dctx.ReqECS.Mask.Size()
+		key = msgToKeyWithSubnet(dctx.Req, dctx.ReqECS.IP, ones)
+	} else {
+		key = msgToKey(dctx.Req)
+	}
+
+	return pendingKey{
+		cache: dctx.clientCache,
+		msg:   string(key),
+	}
 }
 
 // pendingRequest is a structure that stores the query state and result.
@@ -51,7 +78,7 @@ type pendingRequest struct {
 // newDefaultPendingRequests creates a new instance of DefaultPendingRequests.
 func newDefaultPendingRequests() (pr *defaultPendingRequests) {
 	return &defaultPendingRequests{
-		storage: syncutil.NewMap[string, *pendingRequest](),
+		storage: syncutil.NewMap[pendingKey, *pendingRequest](),
 	}
 }
 
@@ -64,24 +91,23 @@ func (pr *defaultPendingRequests) queue(
 	ctx context.Context,
 	dctx *DNSContext,
 ) (loaded bool, err error) {
-	var key []byte
-	if dctx.ReqECS != nil {
-		ones, _ := dctx.ReqECS.Mask.Size()
-		key = msgToKeyWithSubnet(dctx.Req, dctx.ReqECS.IP, ones)
-	} else {
-		key = msgToKey(dctx.Req)
-	}
+	key := newPendingKey(dctx)
 
 	req := &pendingRequest{
 		finish: make(chan struct{}),
 	}
 
-	pending, loaded := pr.storage.LoadOrStore(string(key), req)
+	pending, loaded := pr.storage.LoadOrStore(key, req)
 	if !loaded {
 		return false, nil
 	}
 
-	<-pending.finish
+	select {
+	case <-pending.finish:
+		// Go on.
+	case <-ctx.Done():
+		return true, fmt.Errorf("waiting for identical request: %w", context.Cause(ctx))
+	}
 
 	origDNSCtx := pending.cloneDNSCtx
 
@@ -89,9 +115,16 @@ func (pr *defaultPendingRequests) queue(
 	// each request.
 	dctx.queryStatistics = origDNSCtx.queryStatistics
 	dctx.Upstream = origDNSCtx.Upstream
+	dctx.source = origDNSCtx.source
+	dctx.ede = origDNSCtx.ede
 	if origDNSCtx.Res != nil {
 		// TODO(e.burkov):  Add cloner for DNS messages.
-		dctx.Res = origDNSCtx.Res.Copy().SetReply(dctx.Req)
+		res := origDNSCtx.Res.Copy()
+		rcode := res.Rcode
+
+		// Restore the response code, since [dns.Msg.SetReply] resets it.
+		dctx.Res = res.SetReply(dctx.Req)
+		dctx.Res.Rcode = rcode
 	}
 
 	return loaded, pending.resolveErr
@@ -99,17 +132,11 @@ func (pr *defaultPendingRequests) queue(
 
 // done implements the [pendingRequests] interface for [defaultPendingRequests].
 func (pr *defaultPendingRequests) done(ctx context.Context, dctx *DNSContext, err error) {
-	var key []byte
-	if dctx.ReqECS != nil {
-		ones, _ := dctx.ReqECS.Mask.Size()
-		key = msgToKeyWithSubnet(dctx.Req, dctx.ReqECS.IP, ones)
-	} else {
-		key = msgToKey(dctx.Req)
-	}
+	key := newPendingKey(dctx)
 
-	pending, ok := pr.storage.Load(string(key))
+	pending, ok := pr.storage.Load(key)
 	if !ok {
-		panic(fmt.Errorf("loading pending request: key %x: %w", key, errors.ErrNoValue))
+		panic(fmt.Errorf("loading pending request: key %x: %w", key.msg, errors.ErrNoValue))
 	}
 
 	pending.resolveErr = err
@@ -117,6 +144,8 @@ func (pr *defaultPendingRequests) done(ctx context.Context, dctx *DNSContext, er
 	cloneCtx := &DNSContext{
 		Upstream:        dctx.Upstream,
 		queryStatistics: dctx.queryStatistics,
+		source:          dctx.source,
+		ede:             dctx.ede,
 	}
 
 	if dctx.Res != nil {
@@ -125,7 +154,7 @@ func (pr *defaultPendingRequests) done(ctx context.Context, dctx *DNSContext, er
 
 	pending.cloneDNSCtx = cloneCtx
 
-	pr.storage.Delete(string(key))
+	pr.storage.Delete(key)
 	close(pending.finish)
 }
 
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingRequestsOrDefault(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		conf *PendingRequestsConfig
+		want pendingRequests
+		name string
+	}{{
+		conf: nil,
+		want: emptyPendingRequests{},
+		name: "nil",
+	}, {
+		conf: &PendingRequestsConfig{Enabled: false},
+		want: emptyPendingRequests{},
+		name: "disabled",
+	}, {
+		conf: &PendingRequestsConfig{Enabled: true},
+		want: newDefaultPendingRequests(),
+		name: "enabled",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.IsType(t, tc.want, pendingRequestsOrDefault(tc.conf))
+		})
+	}
+}
+
+func TestDefaultPendingRequests_queue_canceled(t *testing.T) {
+	t.Parallel()
+
+	pr := newDefaultPendingRequests()
+	newDCtx := func() (dctx *DNSContext) {
+		return &DNSContext{
+			Req: (&dns.Msg{}).SetQuestion("pending.example.", dns.TypeA),
+		}
+	}
+
+	first := newDCtx()
+	loaded, err := pr.queue(context.Background(), first)
+	require.NoError(t, err)
+	require.False(t, loaded)
+
+	t.Cleanup(func() { pr.done(context.Background(), first, nil) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	waiting := newDCtx()
+	loaded, err = pr.queue(ctx, waiting)
+	assert.True(t, loaded)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, waiting.Res)
+}
@@ -1,9 +1,11 @@
 package proxy_test
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -81,7 +83,7 @@ func TestPendingRequests(t *testing.T) {
 
 	once := &sync.Once{}
 	u := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			once.Do(func() {
 				resp = (&dns.Msg{}).SetReply(req)
 			})
@@ -112,10 +114,14 @@ func TestPendingRequests(t *testing.T) {
 		PendingRequests: &proxy.PendingRequestsConfig{
 			Enabled: true,
 		},
-		RequestHandler: func(prx *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+		RequestHandler: func(
+			ctx context.Context,
+			prx *proxy.Proxy,
+			dctx *proxy.DNSContext,
+		) (err error) {
 			workloadWG.Done()
 
-			return prx.Resolve(dctx)
+			return prx.Resolve(ctx, dctx)
 		},
 	})
 	require.NoError(t, err)
@@ -154,3 +160,89 @@ func TestPendingRequests(t *testing.T) {
 		assertEqualResponses(t, resp, responses[i+1])
 	}
 }
+
+func TestPendingRequests_rcode(t *testing.T) {
+	t.Parallel()
+
+	const reqsNum = 10
+
+	workloadWG := &sync.WaitGroup{}
+	workloadWG.Add(reqsNum)
+
+	var exchanges atomic.Int32
+	u := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+			workloadWG.Wait()
+
+			return (&dns.Msg{}).SetRcode(req, dns.RcodeNameError), nil
+		},
+		OnAddress: func() (addr string) { return "" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p, err := proxy.New(&proxy.Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         testTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		PendingRequests: &proxy.PendingRequestsConfig{
+			Enabled: true,
+		},
+		RequestHandler: func(
+			ctx context.Context,
+			prx *proxy.Proxy,
+			dctx *proxy.DNSContext,
+		) (err error) {
+			workloadWG.Done()
+
+			return prx.Resolve(ctx, dctx)
+		},
+	})
+	require.NoError(t, err)
+
+	servicetest.RequireRun(t, p, testTimeout)
+
+	addr := p.Addr(proxy.ProtoTCP).String()
+	client := &dns.Client{
+		Net:     string(proxy.ProtoTCP),
+		Timeout: testTimeout,
+	}
+
+	resolveWG := &sync.WaitGroup{}
+	responses := make([]*dns.Msg, reqsNum)
+	errs := make([]error, reqsNum)
+
+	for i := range reqsNum {
+		resolveWG.Add(1)
+
+		req := (&dns.Msg{}).SetQuestion("nonexistent.example.", dns.TypeA)
+		if i%2 == 0 {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+
+		go func() {
+			defer resolveWG.Done()
+
+			reqCtx := testutil.ContextWithTimeout(t, testTimeout)
+			responses[i], _, errs[i] = client.ExchangeContext(reqCtx, req, addr)
+		}()
+	}
+
+	resolveWG.Wait()
+
+	assert.Equal(t, int32(1), exchanges.Load())
+
+	for i, resp := range responses {
+		require.NoError(t, errs[i])
+		require.NotNil(t, resp)
+
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		assert.Equal(t, i%2 == 0, resp.IsEdns0() != nil)
+	}
+}
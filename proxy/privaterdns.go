@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// defaultPrivateRDNSTTL is the default TTL of the locally answered private
+// reverse DNS responses in seconds.
+const defaultPrivateRDNSTTL = 60
+
+// errNotPrivate is returned when an address is expected to be private, see
+// [Config.PrivateSubnets].
+const errNotPrivate errors.Error = "not private"
+
+// PrivateRDNSConfig is the configuration of answering the PTR requests for the
+// private addresses, see [Config.PrivateSubnets], locally.  Those requests are
+// never forwarded to [Config.UpstreamConfig] regardless of it.
+type PrivateRDNSConfig struct {
+	// Hosts maps the private addresses to the hostnames returned for them.  It
+	// takes precedence over [Config.PrivateRDNSUpstreamConfig].  The IPv4
+	// addresses must not be IPv4-mapped IPv6 ones.
+	Hosts map[netip.Addr]string
+
+	// Zone, if not empty, is the local zone to synthesize the hostnames within
+	// for the private addresses missing in Hosts, e.g. "192-168-1-2.lan." for
+	// 192.168.1.2 within "lan".  It's only used when the private upstreams
+	// aren't, see [Config.UsePrivateRDNS].
+	Zone string
+
+	// TTL is the TTL of the local responses in seconds.  If zero, the default
+	// of 60 seconds is used.
+	TTL uint32
+}
+
+// validate returns an error if c is invalid.  private is the set of the
+// private subnets.  c may be nil.
+func (c *PrivateRDNSConfig) validate(private netutil.SubnetSet) (err error) {
+	if c == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, addr := range slices.SortedFunc(maps.Keys(c.Hosts), netip.Addr.Compare) {
+		switch {
+		case addr.Is4In6():
+			errs = append(errs, fmt.Errorf("Hosts: address %s: must be ipv4", addr))
+		case !private.Contains(addr):
+			errs = append(errs, fmt.Errorf("Hosts: address %s: %w", addr, errNotPrivate))
+		}
+
+		err = netutil.ValidateHostname(strings.TrimSuffix(c.Hosts[addr], "."))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Hosts: address %s: %w", addr, err))
+		}
+	}
+
+	if c.Zone != "" {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(c.Zone, "."))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Zone: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// synthPrivateHost returns the hostname for addr within zone, see
+// [PrivateRDNSConfig.Zone].
+func synthPrivateHost(addr netip.Addr, zone string) (host string) {
+	var label string
+	if addr.Is4() {
+		label = strings.ReplaceAll(addr.String(), ".", "-")
+	} else {
+		label = strings.ReplaceAll(addr.StringExpanded(), ":", "-")
+	}
+
+	return dns.Fqdn(label + "." + strings.TrimSuffix(zone, "."))
+}
+
+// privateRDNSResponse returns the local response to the private reverse DNS
+// request of d, see [Config.PrivateRDNS], or nil if it should be resolved as
+// usual.
+func (p *Proxy) privateRDNSResponse(d *DNSContext) (resp *dns.Msg) {
+	c := p.PrivateRDNS
+	pref := d.RequestedPrivateRDNS
+	if c == nil || d.Req.Question[0].Qtype != dns.TypePTR || pref.Bits() != pref.Addr().BitLen() {
+		// Only answer the requests for the whole addresses.
+		return nil
+	}
+
+	addr := pref.Addr()
+	host, ok := c.Hosts[addr]
+	switch {
+	case ok:
+		d.addTracef(StageRequestHandler, "private rdns: host of %s", addr)
+	case c.Zone == "" || p.usesPrivateUpstreams(d):
+		return nil
+	default:
+		host = synthPrivateHost(addr, c.Zone)
+		d.addTracef(StageRequestHandler, "private rdns: synthesized in zone %q", c.Zone)
+	}
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = defaultPrivateRDNSTTL
+	}
+
+	resp = (&dns.Msg{}).SetReply(d.Req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   d.Req.Question[0].Name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ptr: dns.Fqdn(host),
+	}}
+
+	p.logger.Debug("answered private rdns request locally", "addr", addr, "host", host)
+
+	return resp
+}
+
+// usesPrivateUpstreams returns true if the private reverse DNS request of d is
+// resolved with [Config.PrivateRDNSUpstreamConfig].
+func (p *Proxy) usesPrivateUpstreams(d *DNSContext) (ok bool) {
+	return p.UsePrivateRDNS && d.IsPrivateClient && p.live.Load().private != nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_privateRDNS(t *testing.T) {
+	var generalQueries, privateQueries atomic.Uint32
+	general := newAddrUpstream(t, "192.0.2.53:53", net.IP{192, 0, 2, 1}, &generalQueries)
+	private := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			privateQueries.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, req.Question[0].Name, dns.TypePTR, defaultTestTTL, "host.private.")}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "192.168.1.53:53" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, usePrivate bool) (p *Proxy) {
+		t.Helper()
+
+		p = mustNew(t, &Config{
+			Logger:                    slogutil.NewDiscardLogger(),
+			UDPListenAddr:             []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:            &UpstreamConfig{Upstreams: []upstream.Upstream{general}},
+			PrivateRDNSUpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{private}},
+			TrustedProxies:            defaultTrustedProxies,
+			RatelimitSubnetLenIPv4:    24,
+			RatelimitSubnetLenIPv6:    64,
+			UsePrivateRDNS:            usePrivate,
+			PrivateRDNS: &PrivateRDNSConfig{
+				Hosts: map[netip.Addr]string{
+					netip.MustParseAddr("192.168.1.1"): "router.lan",
+				},
+				Zone: "lan.",
+			},
+		})
+		servicetest.RequireRun(t, p, testTimeout)
+
+		return p
+	}
+
+	resolve := func(t *testing.T, p *Proxy, addrStr string) (ptr string) {
+		t.Helper()
+
+		addr := netip.MustParseAddr(addrStr)
+		arpa, err := netutil.IPToReversedAddr(addr.AsSlice())
+		require.NoError(t, err)
+
+		d := &DNSContext{
+			Req:                  (&dns.Msg{}).SetQuestion(dns.Fqdn(arpa), dns.TypePTR),
+			Addr:                 netip.MustParseAddrPort("192.168.1.100:53"),
+			IsPrivateClient:      true,
+			RequestedPrivateRDNS: netip.PrefixFrom(addr, addr.BitLen()),
+		}
+
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+
+		return testutil.RequireTypeAssert[*dns.PTR](t, d.Res.Answer[0]).Ptr
+	}
+
+	t.Run("local", func(t *testing.T) {
+		p := newProxy(t, false)
+
+		assert.Equal(t, "router.lan.", resolve(t, p, "192.168.1.1"))
+		assert.Equal(t, "192-168-1-2.lan.", resolve(t, p, "192.168.1.2"))
+		assert.Equal(
+			t,
+			"fd00-0000-0000-0000-0000-0000-0000-0001.lan.",
+			resolve(t, p, "fd00::1"),
+		)
+
+		assert.Zero(t, generalQueries.Load())
+		assert.Zero(t, privateQueries.Load())
+	})
+
+	t.Run("private_upstreams", func(t *testing.T) {
+		p := newProxy(t, true)
+
+		assert.Equal(t, "router.lan.", resolve(t, p, "192.168.1.1"))
+		assert.Equal(t, "host.private.", resolve(t, p, "192.168.1.2"))
+
+		assert.Zero(t, generalQueries.Load())
+		assert.Equal(t, uint32(1), privateQueries.Load())
+	})
+}
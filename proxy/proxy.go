@@ -27,12 +27,12 @@ import (
 	"github.com/AdguardTeam/golibs/service"
 	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/AdguardTeam/golibs/timeutil"
-	"github.com/AdguardTeam/golibs/validate"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
 	gocache "github.com/patrickmn/go-cache"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -72,6 +72,10 @@ type Proxy struct {
 	// See also: https://github.com/AdguardTeam/AdGuardHome/issues/2242.
 	requestsSema syncutil.Semaphore
 
+	// rebindAllowed are the patterns of the domain names allowed to be resolved
+	// into private addresses.  It's nil if there are none.
+	rebindAllowed *zonePatterns
+
 	// privateNets determines if the requested address and the client address
 	// are private.
 	privateNets netutil.SubnetSet
@@ -98,6 +102,22 @@ type Proxy struct {
 	// logger is used for logging in the proxy service.  It is never nil.
 	logger *slog.Logger
 
+	// cacheLogger is the logger of [LogSubsystemCache].
+	cacheLogger *slog.Logger
+
+	// refreshLogger is the logger of [LogSubsystemRefresher].
+	refreshLogger *slog.Logger
+
+	// upstreamLogger is the logger of [LogSubsystemUpstream].
+	upstreamLogger *slog.Logger
+
+	// serverLogger is the logger of [LogSubsystemServer].
+	serverLogger *slog.Logger
+
+	// tracer creates the spans of the queries.  It's nil if
+	// [Config.TracerProvider] is nil.
+	tracer trace.Tracer
+
 	// ratelimitBuckets is a storage for ratelimiters for individual IPs.
 	ratelimitBuckets *gocache.Cache
 
@@ -113,6 +133,9 @@ type Proxy struct {
 	// repetitions.
 	shortFlighter *optimisticResolver
 
+	// dnssec validates the upstream responses.  It is disabled if nil.
+	dnssec *dnssecValidator
+
 	// recDetector detects recursive requests that may appear when resolving
 	// requests for private addresses.
 	recDetector *recursionDetector
@@ -127,6 +150,15 @@ type Proxy struct {
 	// udpListen are the listened UDP connections.
 	udpListen []*net.UDPConn
 
+	// boundListeners are the listeners of [Config.Listeners] with the
+	// addresses they actually listen on.  The listeners themselves are
+	// contained within the listeners of the corresponding protocols.
+	boundListeners []*boundListener
+
+	// udpReusePortListen are the additional listened UDP connections sharing
+	// the addresses of udpListen, see [Config.UDPSocketsPerAddr].
+	udpReusePortListen []*net.UDPConn
+
 	// tcpListen are the listened TCP connections.
 	tcpListen []net.Listener
 
@@ -155,6 +187,18 @@ type Proxy struct {
 	// httpsServer serves queries received over HTTPS.
 	httpsServer *http.Server
 
+	// replicaServer receives the cache snapshots in the cache replica mode.
+	replicaServer *http.Server
+
+	// replication pushes the cache snapshots to the replicas.  It's nil if
+	// [Config.CacheReplication] is nil or the proxy isn't running.
+	replication *cacheReplication
+
+	// memPressure detects the memory pressure to degrade the cache.  It's nil
+	// if [Config.MemoryPressure] is nil, the cache is disabled, or there is no
+	// memory limit.
+	memPressure *memoryPressure
+
 	// h3Server serves queries received over HTTP/3.
 	h3Server *http3.Server
 
@@ -166,9 +210,19 @@ type Proxy struct {
 
 	// upstreamRTTStats maps the upstream address to its round-trip time
 	// statistics.  It's holds the statistics for all upstreams to perform a
-	// weighted random selection when using the load balancing mode.
+	// weighted random selection when using the load balancing mode and to
+	// select the fastest one when using the fastest mode.
 	upstreamRTTStats map[string]upstreamRTTStats
 
+	// upstreamQueries maps the upstream address to the counter of the queries
+	// sent to it.  It's created on the first query.
+	upstreamQueries map[string]*upstreamQueryCounter
+
+	// refreshWarmup limits the rate of the proactive refresh queries after the
+	// start, see [Config.CacheProactiveWarmupPeriod].  It's nil if the warm-up
+	// is disabled.
+	refreshWarmup *refreshWarmup
+
 	// dns64Prefs is a set of NAT64 prefixes that are used to detect and
 	// construct DNS64 responses.  The DNS64 function is disabled if it is
 	// empty.
@@ -193,6 +247,43 @@ type Proxy struct {
 	// counter counts message contexts created with [Proxy.newDNSContext].
 	counter atomic.Uint64
 
+	// truncated counts the truncated responses sent to clients.
+	truncated truncationCounters
+
+	// ednsHandled counts the requests handled due to [Config.EDNSCompliance].
+	ednsHandled ednsCounters
+
+	// clientStats gathers the statistics of the requests by the client
+	// networks.  It's nil if [Config.ClientStats] is nil.
+	clientStats *clientStats
+
+	// mirror passes the sampled requests to the sink.  It's nil if
+	// [Config.Mirror] is nil.
+	mirror *mirror
+
+	// mdns resolves the "local." names.  It's nil if [Config.MDNS] is nil.
+	mdns *mdnsResolver
+
+	// anomalies captures the anomalous traffic.  It's nil if
+	// [Config.AnomalyCapture] is nil.
+	anomalies *anomalyCapture
+
+	// answerRotator counts the responses for [AnswerOrderRotate].  It's never
+	// nil.
+	answerRotator *answerRotator
+
+	// criticalNames checks the answers for the critical domain names.  It's
+	// nil if [Config.CriticalNames] is nil or has no names.
+	criticalNames *criticalNames
+
+	// rebindAttempts counts the responses replaced due to the DNS rebinding
+	// protection.
+	rebindAttempts atomic.Uint64
+
+	// live contains the settings which may be changed by [Proxy.Reload].  It
+	// never contains nil after the proxy is created.
+	live atomic.Pointer[liveSettings]
+
 	// RWMutex protects the whole proxy.
 	//
 	// TODO(e.burkov):  Find out what exactly it protects and name it properly.
@@ -207,22 +298,56 @@ type Proxy struct {
 	// TODO(e.burkov):  Make it a pointer.
 	rttLock sync.Mutex
 
-	// started indicates if the proxy has been started.
-	started bool
+	// queriesLock protects upstreamQueries.
+	queriesLock sync.Mutex
+
+	// state is the current [proxyState] of the proxy.  It's only changed with
+	// the lock held, but may be read without it.
+	state atomic.Uint32
+
+	// run is the context of the current run of the proxy, see
+	// [Proxy.runContext].  It's nil until the proxy is started.
+	run atomic.Pointer[runContext]
 }
 
-// New creates a new Proxy with the specified configuration.  c must not be nil.
+// proxyState is the state of the [Proxy] lifecycle.  The transitions are:
+//
+//	           Start              Shutdown
+//	created ─────────► running ───────────► stopped
+//	                      ▲                    │
+//	                      └────────────────────┘
+//	                              Start
+//
+// Calling [Proxy.Start] on a running proxy returns an error, and calling
+// [Proxy.Shutdown] on a proxy that isn't running is a no-op.  [Proxy.Resolve]
+// returns [ErrNotRunning] unless the proxy is running.  Shutdown cancels the
+// pending proactive cache refreshes, as well as the resolutions and the
+// refreshes in progress, waiting for the latter to finish, and Start resumes
+// scheduling them.
+type proxyState uint32
+
+// Valid proxyState values.
+const (
+	stateCreated proxyState = iota
+	stateRunning
+	stateStopped
+)
+
+// ErrNotRunning is returned by [Proxy.Resolve] when the proxy hasn't been
+// started yet or has already been shut down.
+const ErrNotRunning errors.Error = "proxy is not running"
+
+// New creates a new Proxy with the specified configuration.  c must not be nil
+// and is validated with [Config.Validate], the problems reported by
+// [Config.Warnings] are logged.
 //
 // TODO(e.burkov):  Cover with tests.
 //
 // TODO(e.burkov):  Add context.
 func New(c *Config) (p *Proxy, err error) {
 	p = &Proxy{
-		Config: *c,
-		privateNets: cmp.Or[netutil.SubnetSet](
-			c.PrivateSubnets,
-			netutil.SubnetSetFunc(netutil.IsLocallyServed),
-		),
+		Config:      *c,
+		privateNets: c.privateSubnets(),
 		beforeRequestHandler: cmp.Or[BeforeRequestHandler](
 			c.BeforeRequestHandler,
 			noopRequestHandler{},
@@ -241,17 +366,64 @@ func New(c *Config) (p *Proxy, err error) {
 		),
 		recDetector:     newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
 		pendingRequests: pendingRequestsOrDefault(c.PendingRequests),
+		rebindAllowed:   c.RebindProtection.allowedDomains(),
 		logger:          loggerOrDefault(c.Logger),
+		tracer:          newTracer(c.TracerProvider),
 	}
 
-	// TODO(e.burkov):  Validate config separately and add the contract to the
-	// New function.
-	err = p.validateConfig()
+	err = c.Validate()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("validating config: %w", err)
 	}
 
+	p.initLoggers()
+
+	for _, w := range c.Warnings() {
+		p.logger.Warn("suspicious configuration", slogutil.KeyError, w)
+	}
+
+	p.logConfigInfo()
+
+	p.live.Store(newLiveSettings(c))
+
+	// Apply the defaults before creating the cache, which uses them.
+	p.CacheOptimisticAnswerTTL = cmp.Or(p.CacheOptimisticAnswerTTL, DefaultOptimisticAnswerTTL)
+	p.CacheOptimisticMaxAge = cmp.Or(p.CacheOptimisticMaxAge, DefaultOptimisticMaxAge)
+
 	p.initCache()
+	p.initClientCaches(&p.Config, p.live.Load(), nil)
+	p.refreshWarmup = newRefreshWarmup(
+		p.time,
+		p.CacheProactiveWarmupPeriod,
+		p.CacheProactiveWarmupRate,
+	)
+
+	if p.cache != nil && p.CacheFilePath != "" {
+		err = p.loadCacheFile(p.CacheFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("loading cache: %w", err)
+		}
+
+		p.loadCacheJournals(p.CacheFilePath)
+	}
+
+	p.clientStats = newClientStats(p.ClientStats, p.time)
+	if cs := p.ClientStats; cs != nil && cs.FilePath != "" {
+		err = p.clientStats.load(cs.FilePath)
+		if err != nil {
+			// Don't fail, since the malformed file is moved aside.
+			p.logger.Warn("loading client statistics", slogutil.KeyError, err)
+		}
+	}
+
+	p.mirror = newMirror(p.Mirror, p.logger)
+	p.mdns = newMDNSResolver(p.MDNS, p.logger)
+	p.answerRotator = &answerRotator{}
+
+	p.anomalies, err = newAnomalyCapture(p.AnomalyCapture, p.time, p.logger)
+	if err != nil {
+		return nil, fmt.Errorf("initializing anomaly capture: %w", err)
+	}
 
 	if p.MaxGoroutines > 0 {
 		p.logger.Info("max goroutines is set", "count", p.MaxGoroutines)
@@ -261,11 +433,19 @@ func New(c *Config) (p *Proxy, err error) {
 		p.requestsSema = syncutil.EmptySemaphore{}
 	}
 
+	if p.EnableDNSSECValidation {
+		p.dnssec = newDNSSECValidator(p.exchangeDNSSEC)
+	}
+
+	p.criticalNames = newCriticalNames(p.CriticalNames)
+
 	p.UpstreamMode = cmp.Or(p.UpstreamMode, UpstreamModeLoadBalance)
 	if p.UpstreamMode == UpstreamModeFastestAddr {
 		p.fastestAddr = fastip.New(&fastip.Config{
 			Logger:          p.Logger,
 			PingWaitTimeout: p.FastestPingTimeout,
+			PingPorts:       p.FastestPingPorts,
+			PingICMP:        p.FastestPingICMP,
 		})
 	}
 
@@ -274,8 +454,7 @@ func New(c *Config) (p *Proxy, err error) {
 		p.bindRetryIvl = bindRetries.Interval
 	}
 
-	p.CacheOptimisticAnswerTTL = cmp.Or(p.CacheOptimisticAnswerTTL, DefaultOptimisticAnswerTTL)
-	p.CacheOptimisticMaxAge = cmp.Or(p.CacheOptimisticMaxAge, DefaultOptimisticMaxAge)
+	p.RatelimitPolicy = cmp.Or(p.RatelimitPolicy, RatelimitPolicyDrop)
 
 	err = p.setupDNS64()
 	if err != nil {
@@ -285,12 +464,13 @@ func New(c *Config) (p *Proxy, err error) {
 	// TODO(e.burkov):  Clone all mutable fields of Config.
 	p.RatelimitWhitelist = slices.Clone(p.RatelimitWhitelist)
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
+	p.RatelimitWhitelistSubnets = slices.Clone(p.RatelimitWhitelistSubnets)
 
 	return p, nil
 }
 
-// pendingRequestsOrDefault returns the pending requests if it's not nil,
-// otherwise it returns the default pending requests.
+// pendingRequestsOrDefault returns the pending requests according to conf.  If
+// conf is nil, the requests aren't tracked.
 func pendingRequestsOrDefault(conf *PendingRequestsConfig) (pr pendingRequests) {
 	if conf != nil && conf.Enabled {
 		return newDefaultPendingRequests()
@@ -309,23 +489,9 @@ func loggerOrDefault(l *slog.Logger) (logger *slog.Logger) {
 	return slog.Default().With(slogutil.KeyPrefix, LogPrefix)
 }
 
-// validateBasicAuth validates the basic-auth mode settings if p.Config.Userinfo
-// is set.
-func (p *Proxy) validateBasicAuth() (err error) {
-	conf := p.Config
-	if conf.Userinfo == nil {
-		return nil
-	}
-
-	return validate.NotEmptySlice("HTTPSListenAddr", conf.HTTPSListenAddr)
-}
-
 // Returns true if proxy is started.  It is safe for concurrent use.
 func (p *Proxy) isStarted() (ok bool) {
-	p.RLock()
-	defer p.RUnlock()
-
-	return p.started
+	return proxyState(p.state.Load()) == stateRunning
 }
 
 // type check
@@ -338,7 +504,7 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 	p.Lock()
 	defer p.Unlock()
 
-	if p.started {
+	if p.isStarted() {
 		return errors.Error("server has been already started")
 	}
 
@@ -348,6 +514,16 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 		return err
 	}
 
+	err = p.probeUpstreams(ctx)
+	if err != nil {
+		return fmt.Errorf("probing upstreams: %w", err)
+	}
+
+	err = p.startCacheJournal()
+	if err != nil {
+		return fmt.Errorf("starting cache journal: %w", err)
+	}
+
 	err = p.startListeners(ctx)
 	if err != nil {
 		closeErr := errors.Join(p.closeListeners(nil)...)
@@ -355,9 +531,28 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 		return fmt.Errorf("configuring listeners: %w", errors.WithDeferred(err, closeErr))
 	}
 
-	p.serveListeners()
+	err = p.startCacheReplica(ctx)
+	if err != nil {
+		closeErr := errors.Join(p.closeListeners(nil)...)
+
+		return errors.WithDeferred(err, closeErr)
+	}
+
+	if p.cache != nil {
+		p.cache.resumeProactiveRefresh()
+		p.cache.startRevalidation()
+		p.clientCachesDo((*cache).resumeProactiveRefresh)
+	}
+
+	p.run.Store(newRunContext())
+	p.refreshWarmup.start(p.time.Now())
+	p.startCacheReplication()
+	p.startMemoryPressure()
 
-	p.started = true
+	// Set the state before serving, since the serving loops check it.
+	p.state.Store(uint32(stateRunning))
+
+	p.serveListeners()
 
 	return nil
 }
@@ -390,31 +585,42 @@ func (p *Proxy) Shutdown(ctx context.Context) (err error) {
 	p.Lock()
 	defer p.Unlock()
 
-	if !p.started {
-		// TODO(a.garipov): Consider returning err.
-		p.logger.WarnContext(ctx, "dns proxy server is not started")
+	if !p.isStarted() {
+		p.logger.DebugContext(ctx, "dns proxy server is not running")
 
 		return nil
 	}
 
-	// Stop proactive cache refresh.
-	if p.cache != nil {
-		p.cache.stopProactiveRefresh()
-	}
+	// Reject the requests arriving since now and abort the ones in progress.
+	p.state.Store(uint32(stateStopped))
+	p.run.Load().cancel()
 
 	errs := p.closeListeners(nil)
+	errs = append(errs, p.stopCacheReplica())
+	p.stopCacheReplication()
+	p.stopMemoryPressure()
 
-	for _, u := range []*UpstreamConfig{
-		p.UpstreamConfig,
-		p.PrivateRDNSUpstreamConfig,
-		p.Fallbacks,
-	} {
-		if u != nil {
-			errs = closeAll(errs, u)
+	if p.cache != nil {
+		// Save the cache before stopping the refresh, since the latter drops
+		// the request statistics.
+		if p.CacheFilePath != "" {
+			errs = append(errs, p.persistCache())
 		}
+
+		p.cache.stopProactiveRefresh()
+		p.clientCachesDo((*cache).stopProactiveRefresh)
 	}
 
-	p.started = false
+	if cs := p.ClientStats; cs != nil && cs.FilePath != "" {
+		errs = append(errs, p.clientStats.save(cs.FilePath))
+	}
+
+	errs = append(errs, p.anomalies.close())
+
+	errs = closeAll(errs, p.live.Load().configs()...)
+	if p.CacheProactiveRefreshUpstreams != nil {
+		errs = closeAll(errs, p.CacheProactiveRefreshUpstreams)
+	}
 
 	p.logger.InfoContext(ctx, "stopped dns proxy server")
 
@@ -438,6 +644,9 @@ func (p *Proxy) closeListeners(errs []error) (res []error) {
 	res = closeAll(res, p.udpListen...)
 	p.udpListen = nil
 
+	res = closeAll(res, p.udpReusePortListen...)
+	p.udpReusePortListen = nil
+
 	res = closeAll(res, p.tlsListen...)
 	p.tlsListen = nil
 
@@ -556,20 +765,43 @@ func (p *Proxy) Addr(proto Proto) (addr net.Addr) {
 }
 
 // selectUpstreams returns the upstreams to use for the specified host.  It
-// firstly considers custom upstreams if those aren't empty and then the
-// configured ones.  The returned slice may be empty or nil.
+// firstly considers custom upstreams if those aren't empty, then the ones of the
+// client policy and the domain policy, and then the configured ones.  The
+// returned slice may be empty or nil.
 func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, isPrivate bool) {
+	pol := p.domainPolicy(d)
+
+	upstreams, isPrivate = p.routeRequest(d, pol)
+	if isPrivate || pol == nil || !pol.RequireEncrypted {
+		return upstreams, isPrivate
+	}
+
+	upstreams = filterEncrypted(upstreams)
+	d.addTracef(StageRouting, "domain policy %q: encrypted upstreams: %d", pol.Name, len(upstreams))
+
+	return upstreams, false
+}
+
+// routeRequest returns the upstreams to use for the request of d according to
+// the routing rules, see [Proxy.selectUpstreams].  pol is the domain policy for
+// the request, if any.
+func (p *Proxy) routeRequest(
+	d *DNSContext,
+	pol *DomainPolicy,
+) (upstreams []upstream.Upstream, isPrivate bool) {
 	q := d.Req.Question[0]
 	host := q.Name
 
 	if d.RequestedPrivateRDNS != (netip.Prefix{}) || p.shouldStripDNS64(d.Req) {
 		// Use private upstreams.
-		private := p.PrivateRDNSUpstreamConfig
+		private := p.live.Load().private
 		if p.UsePrivateRDNS && d.IsPrivateClient && private != nil {
 			// This may only be a PTR, SOA, and NS request.
 			upstreams = private.getUpstreamsForDomain(host)
 		}
 
+		d.addTracef(StageRouting, "private upstreams: %d", len(upstreams))
+
 		return upstreams, true
 	}
 
@@ -578,23 +810,64 @@ func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, i
 		getUpstreams = (*UpstreamConfig).getUpstreamsForDS
 	}
 
+	if refresh := p.CacheProactiveRefreshUpstreams; d.isRefresh && refresh != nil {
+		upstreams = getUpstreams(refresh, host)
+		if len(upstreams) > 0 {
+			d.addTracef(StageRouting, "proactive refresh upstreams: %d", len(upstreams))
+
+			return upstreams, false
+		}
+	}
+
 	if custom := d.CustomUpstreamConfig; custom != nil {
 		// Try to use custom.
 		upstreams = getUpstreams(custom.upstream, host)
 		if len(upstreams) > 0 {
+			d.addTracef(StageRouting, "custom upstreams: %d", len(upstreams))
+
+			return upstreams, false
+		}
+	}
+
+	if client := p.clientPolicy(d); client != nil {
+		upstreams = getUpstreams(client.Upstreams, host)
+		if len(upstreams) > 0 {
+			d.addTracef(StageRouting, "client policy %q upstreams: %d", client.Name, len(upstreams))
+
+			return upstreams, false
+		}
+	}
+
+	if pol != nil && pol.Upstreams != nil {
+		upstreams = getUpstreams(pol.Upstreams, host)
+		if len(upstreams) > 0 {
+			d.addTracef(StageRouting, "domain policy %q upstreams: %d", pol.Name, len(upstreams))
+
 			return upstreams, false
 		}
 	}
 
 	// Use configured.
-	return getUpstreams(p.UpstreamConfig, host), false
+	upstreams = getUpstreams(p.live.Load().upstreams, host)
+	d.addTracef(StageRouting, "general upstreams: %d", len(upstreams))
+
+	return upstreams, false
 }
 
 // replyFromUpstream tries to resolve the request via configured upstream
-// servers.  It returns true if the response actually came from an upstream.
-func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
+// servers.  It returns true if the response actually came from an upstream and
+// hasn't failed the DNSSEC validation, so that the failures aren't cached
+// without their extended errors.  The exchanges are aborted once ctx is done.
+func (p *Proxy) replyFromUpstream(ctx context.Context, d *DNSContext) (ok bool, err error) {
 	req := d.Req
 
+	if p.CacheReplica != nil {
+		d.addTrace(StageUpstream, "cache replica")
+		d.Res = p.messages.NewMsgSERVFAIL(req)
+
+		return false, errCacheReplicaMiss
+	}
+
 	upstreams, isPrivate := p.selectUpstreams(d)
 	if len(upstreams) == 0 {
 		d.Res = p.messages.NewMsgNXDOMAIN(req)
@@ -606,62 +879,156 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		p.recDetector.add(d.Req)
 	}
 
+	if p.dnssec != nil {
+		// Request the signatures to validate them.
+		addDO(req)
+	}
+
+	if p.NormalizeUpstreamRequests && len(req.Question) > 0 {
+		orig := normalizeRequest(req)
+		defer func() { orig.restore(req, d.Res) }()
+	}
+
+	if d.isRefresh {
+		ctx = upstream.WithBackground(ctx)
+	}
+
 	src := "upstream"
-	wrapped := upstreamsWithStats(upstreams)
+	wrapped := p.upstreamsWithStats(upstreams, d.isRefresh)
 
 	// Perform the DNS request.
-	resp, u, err := p.exchangeUpstreams(req, wrapped)
-	if dns64Ups := p.performDNS64(req, resp, wrapped); dns64Ups != nil {
-		u = dns64Ups
-	} else if p.isBogusNXDomain(resp) {
-		p.logger.Debug("response contains bogus-nxdomain ip")
-		resp = p.messages.NewMsgNXDOMAIN(req)
+	resp, u, err := p.exchangeUpstreams(ctx, req, wrapped)
+	d.traceExchange(StageUpstream, u, err)
+	if err == nil && isMismatched(req, resp) {
+		p.anomalies.captureResponse(anomalyMismatch, u, resp)
+	}
+
+	// Validate the response as received, since the records synthesized
+	// locally aren't signed.
+	unvalidated := resp
+	resp, bogus := p.validateDNSSEC(ctx, d, resp)
+	if !bogus {
+		resp, u = p.rewriteUpstreamResp(ctx, d, resp, u, wrapped, isPrivate)
 	}
 
 	var wrappedFallbacks []upstream.Upstream
-	if err != nil && !isPrivate && p.Fallbacks != nil {
+	if fallbacks := p.live.Load().fallbacks; err != nil && !isPrivate && fallbacks != nil {
 		p.logger.Debug("using fallback", slogutil.KeyError, err)
 
 		src = "fallback"
 
 		// upstreams mustn't appear empty since they have been validated when
 		// creating proxy.
-		upstreams = p.Fallbacks.getUpstreamsForDomain(req.Question[0].Name)
+		upstreams = fallbacks.getUpstreamsForDomain(req.Question[0].Name)
 
-		wrappedFallbacks = upstreamsWithStats(upstreams)
-		resp, u, err = upstream.ExchangeParallel(wrappedFallbacks, req)
+		wrappedFallbacks = p.upstreamsWithStats(upstreams, d.isRefresh)
+		resp, u, err = upstream.ExchangeParallel(ctx, wrappedFallbacks, req)
+		d.traceExchange(StageFallback, u, err)
+
+		unvalidated = resp
+		resp, bogus = p.validateDNSSEC(ctx, d, resp)
 	}
 
 	if err != nil {
-		p.logger.Debug("resolving err", "src", src, slogutil.KeyError, err)
+		p.logger.Debug(
+			"resolving err",
+			"src", src,
+			"refresh", d.isRefresh,
+			slogutil.KeyError, err,
+		)
 	}
 
 	if resp != nil {
-		p.logger.Debug("resolved", "upstream", u.Address(), "src", src)
+		p.logger.Debug("resolved", "upstream", u.Address(), "src", src, "refresh", d.isRefresh)
+	}
+
+	if p.cache != nil {
+		p.cache.outage.record(err)
 	}
 
 	unwrapped, stats := collectQueryStats(p.UpstreamMode, u, wrapped, wrappedFallbacks)
 	d.queryStatistics = stats
 
-	ctx := context.TODO()
-	p.handleExchangeResult(ctx, d, req, resp, unwrapped)
+	orig := resp
+	if bogus {
+		orig = unvalidated
+	}
+
+	if resp != nil {
+		resp = p.checkCriticalName(ctx, d, u, orig, resp)
+	}
+
+	p.sanitize(ctx, d, req, resp)
+
+	if p.StripECH && resp != nil && stripECH(resp) {
+		d.addTrace(StageResponse, "ech stripped")
+	}
+
+	p.handleExchangeResult(ctx, d, req, resp, unwrapped, err)
+
+	return resp != nil && !bogus, err
+}
+
+// rewriteUpstreamResp applies the local rewrites to resp received from u for
+// the request from d and returns the response to use instead along with the
+// upstream that has resolved it.  upstreams are the ones to use for the DNS64
+// requests.  isPrivate is true if the request is for a private address.
+func (p *Proxy) rewriteUpstreamResp(
+	ctx context.Context,
+	d *DNSContext,
+	resp *dns.Msg,
+	u upstream.Upstream,
+	upstreams []upstream.Upstream,
+	isPrivate bool,
+) (rewritten *dns.Msg, resolver upstream.Upstream) {
+	req := d.Req
+	if dns64Ups := p.performDNS64(ctx, req, resp, upstreams); dns64Ups != nil {
+		d.addTrace(StageResponse, "dns64 synthesized")
+
+		return resp, dns64Ups
+	}
+
+	if p.isBogusNXDomain(resp) {
+		p.logger.Debug("response contains bogus-nxdomain ip")
+		d.addTrace(StageResponse, "bogus nxdomain")
+
+		return p.messages.NewMsgNXDOMAIN(req), u
+	}
 
-	return resp != nil, err
+	if !isPrivate && p.isRebinding(resp) {
+		p.logger.Debug("response contains private ip", "req_question", req.Question[0].Name)
+		d.addTrace(StageResponse, "dns rebinding blocked")
+		p.rebindAttempts.Add(1)
+		p.anomalies.captureResponse(anomalyRebinding, u, resp)
+		d.ede = &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeBlocked,
+			ExtraText: "dns rebinding protection",
+		}
+
+		return p.messages.NewMsgNXDOMAIN(req), u
+	}
+
+	return resp, u
 }
 
 // handleExchangeResult handles the result after the upstream exchange.  It sets
 // resp and the upstream that has resolved the request in d.  If resp is nil, it
-// generates a server failure response.  req must not be nil.
+// generates a server failure response with the extended error describing
+// exchErr, if any.  req must not be nil.
 func (p *Proxy) handleExchangeResult(
 	ctx context.Context,
 	d *DNSContext,
 	req *dns.Msg,
 	resp *dns.Msg,
 	u upstream.Upstream,
+	exchErr error,
 ) {
 	if resp == nil {
 		d.Res = p.messages.NewMsgSERVFAIL(req)
-		d.hasEDNS0 = false
+
+		// Only keep the OPT RR of the request to carry the extended error.
+		d.ede = upstreamErrorEDE(exchErr)
+		d.hasEDNS0 = d.hasEDNS0 && d.ede != nil
 
 		return
 	}
@@ -698,44 +1065,116 @@ const defaultUDPBufSize = 2048
 
 // Resolve is the default resolving method used by the DNS proxy to query
 // upstream servers.  It expects dctx is filled with the request, the client's
-//
-// TODO(e.burkov):  Add [context.Context].
-func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
-	ctx := context.Background()
+// address, and the protocol.  It returns [ErrNotRunning] if p isn't running.
+// The upstream exchanges are aborted once ctx is done, unless the response is
+// shared with the identical requests.
+func (p *Proxy) Resolve(ctx context.Context, dctx *DNSContext) (err error) {
+	if !p.isStarted() {
+		return ErrNotRunning
+	}
+
+	ctx, span := p.startResolveSpan(ctx, dctx)
+	defer func() {
+		span.SetAttributes(attrCacheHit.Bool(dctx.cacheHit))
+		endSpan(span, dctx.Res, err)
+	}()
+
+	if resp := p.localResponse(dctx); resp != nil {
+		dctx.Res = resp
+		p.completeResponse(dctx, nil)
+
+		return nil
+	}
 
 	if p.EnableEDNSClientSubnet {
 		dctx.processECS(p.EDNSAddr, p.logger)
 	}
 
 	dctx.calcFlagsAndSize()
+	dctx.clientCache = p.clientCache(dctx)
+
+	// pendingDone is true once the identical requests are released.
+	var pendingDone bool
 
 	cacheWorks := p.cacheWorks(dctx)
 	if cacheWorks {
+		_, cacheSpan := startSpan(ctx, p.tracer, SpanCacheLookup)
+		hit := p.replyFromCache(dctx)
+		cacheSpan.SetAttributes(attrCacheHit.Bool(hit))
+		cacheSpan.End()
+
+		if hit {
+			dctx.addTrace(StageCache, "hit")
+			dctx.cacheHit = true
+
+			// Complete the response from cache.
+			dctx.scrub()
+			p.truncate(dctx)
+
+			return nil
+		}
+
 		// Only add pending requests if the cache is enabled, since this is a
-		// mitigation against cache poisoning.
+		// mitigation against cache poisoning.  The concurrent identical cache
+		// misses are coalesced into a single upstream exchange this way.
 		//
 		// TODO(e.burkov):  Consider tracking all requests.
+		dctx.addTrace(StageCache, "miss")
+
 		var loaded bool
 		loaded, err = p.pendingRequests.queue(ctx, dctx)
 		if loaded {
+			dctx.addTrace(StagePending, "shared the response of identical request")
+			p.completeResponse(dctx, err)
+
 			return err
 		}
-		defer func() { p.pendingRequests.done(ctx, dctx, err) }()
 
-		if p.replyFromCache(dctx) {
-			// Complete the response from cache.
-			dctx.scrub()
+		// Release the identical requests even if resolving this one panics.
+		// Normally, they're released below, before the response is modified
+		// for this particular request.
+		defer func() {
+			if !pendingDone {
+				p.pendingRequests.done(ctx, dctx, err)
+			}
+		}()
 
-			return nil
-		}
+		p.prefetchDualStack(dctx)
 
 		// On cache miss request for DNSSEC from the upstream to cache it
 		// afterwards.
 		addDO(dctx.Req)
 	}
 
+	exchCtx := ctx
+	if cacheWorks {
+		// Don't let the client of this request abort the exchange, since the
+		// identical requests may be waiting for its response.  It's still
+		// aborted on shutdown.
+		var cancel context.CancelFunc
+		exchCtx, cancel = p.queryContext(context.WithoutCancel(ctx))
+		defer cancel()
+	}
+
+	// Remember it, since it's reset for the SERVFAIL response to the failed
+	// exchange.
+	hasEDNS0 := dctx.hasEDNS0
+
 	var ok bool
-	ok, err = p.replyFromUpstream(dctx)
+	ok, err = p.replyFromUpstream(exchCtx, dctx)
+	if ok {
+		p.setSource(dctx, ResponseSourceUpstream)
+	}
+
+	failed := err != nil || dctx.Res == nil || dctx.Res.Rcode == dns.RcodeServerFailure
+	if cacheWorks && failed && p.replyStale(dctx) {
+		p.logger.Debug("replying with stale cached response", slogutil.KeyError, err)
+		dctx.addTrace(StageCache, "stale")
+		dctx.hasEDNS0 = hasEDNS0
+
+		// Don't replace the stale response with the failed one.
+		ok, err = false, nil
+	}
 
 	// Don't cache the responses having CD flag, just like Dnsmasq does.  It
 	// prevents the cache from being poisoned with unvalidated answers which may
@@ -747,6 +1186,22 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 		p.cacheResp(dctx)
 	}
 
+	if cacheWorks {
+		// Share the response before it's modified for this particular request,
+		// since the waiting ones may differ in DO and AD bits as well as in the
+		// protocol.
+		p.pendingRequests.done(ctx, dctx, err)
+		pendingDone = true
+	}
+
+	p.completeResponse(dctx, err)
+
+	return err
+}
+
+// completeResponse prepares the upstream response in dctx to be written and
+// calls the response handler, if any.
+func (p *Proxy) completeResponse(dctx *DNSContext, err error) {
 	// It is possible that the response is nil if the upstream hasn't been
 	// chosen.
 	if dctx.Res != nil {
@@ -755,12 +1210,25 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 
 	// Complete the response.
 	dctx.scrub()
+	p.truncate(dctx)
 
 	if p.ResponseHandler != nil {
 		p.ResponseHandler(dctx, err)
 	}
+}
 
-	return err
+// localResponse returns the response to the request of d made without querying
+// the upstreams and the cache, or nil if there is none.
+func (p *Proxy) localResponse(d *DNSContext) (resp *dns.Msg) {
+	if resp = p.policyResponse(d, p.domainPolicy(d)); resp != nil {
+		return resp
+	}
+
+	if resp = p.privateRDNSResponse(d); resp != nil {
+		return resp
+	}
+
+	return p.mdnsResponse(d)
 }
 
 // cacheWorks returns true if the cache works for the given context.  If not, it
@@ -787,11 +1255,18 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 		// disabled since only validated responses are cached and those may be
 		// not the desired result for user specifying CD flag.
 		reason = "dnssec check disabled"
+	case dctx.clientCache == nil && p.routesByClientPolicy(dctx):
+		// Just like for the custom upstreams, don't share the responses of
+		// the client policy upstreams with the other clients.
+		reason = "client policy cache is not configured"
+	case p.domainPolicy(dctx).bypassesCache():
+		reason = "bypassed by domain policy"
 	default:
 		return true
 	}
 
 	p.logger.Debug("not caching", "reason", reason)
+	dctx.addTracef(StageCache, "skipped: %s", reason)
 
 	return false
 }
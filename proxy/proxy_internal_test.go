@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -72,6 +73,15 @@ func mustNew(tb testing.TB, conf *Config) (p *Proxy) {
 	return p
 }
 
+// mustStartLocal starts p listening on a random local UDP port, since p can't
+// be started without listen addresses, and shuts it down on cleanup.
+func mustStartLocal(tb testing.TB, p *Proxy) {
+	tb.Helper()
+
+	p.UDPListenAddr = []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)}
+	servicetest.RequireRun(tb, p, testTimeout)
+}
+
 // sendTestMessages sends [testMessagesCount] DNS requests to the specified
 // connection and checks the responses.
 func sendTestMessages(tb testing.TB, conn *dns.Conn) {
@@ -195,7 +205,7 @@ type testUpstream struct {
 var _ upstream.Upstream = (*testUpstream)(nil)
 
 // Exchange implements the upstream.Upstream interface for *testUpstream.
-func (u *testUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+func (u *testUpstream) Exchange(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 	resp = &dns.Msg{}
 	resp.SetReply(m)
 
@@ -269,6 +279,19 @@ func newTestUpstreamConfig(
 	return upsConf
 }
 
+// newTestStaticUpstreamConfig returns a new UpstreamConfig with a single local
+// upstream answering each request with an A record of 8.8.8.8, so that the
+// responses are suitable for [requireResponse] without network access.
+func newTestStaticUpstreamConfig(tb testing.TB) (u *UpstreamConfig) {
+	tb.Helper()
+
+	return &UpstreamConfig{
+		Upstreams: []upstream.Upstream{&testUpstream{
+			ans: []dns.RR{newRR(tb, "google-public-dns-a.google.com.", dns.TypeA, 60, net.IP{8, 8, 8, 8})},
+		}},
+	}
+}
+
 // mustStartDefaultProxy starts a new proxy with default settings and returns
 // it.  It fails the test on error.
 func mustStartDefaultProxy(tb testing.TB) (p *Proxy) {
@@ -464,7 +487,7 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 	}
 
 	u := &dnsproxytest.Upstream{
-		OnExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 			resp = (&dns.Msg{}).SetReply(m)
 
 			q := m.Question[0]
@@ -507,6 +530,7 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 		CacheEnabled:           true,
 		CacheSizeBytes:         defaultCacheSize,
 	})
+	servicetest.RequireRun(t, p, testTimeout)
 
 	testCases := []struct {
 		wantAns dns.RR
@@ -553,7 +577,7 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Cleanup(p.cache.items.Clear)
 
-			err := p.Resolve(dctx)
+			err := p.Resolve(context.Background(), dctx)
 			require.NoError(t, err)
 
 			res := dctx.Res
@@ -994,7 +1018,7 @@ func TestProxy_ReplyFromUpstream_badResponse(t *testing.T) {
 	dnsProxy := mustStartDefaultProxy(t)
 
 	u := &dnsproxytest.Upstream{
-		OnExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 			resp = (&dns.Msg{}).SetReply(m)
 			resp.Answer = append(resp.Answer, &dns.A{
 				Hdr: dns.RR_Header{
@@ -1026,7 +1050,7 @@ func TestProxy_ReplyFromUpstream_badResponse(t *testing.T) {
 
 	var err error
 	require.NotPanics(t, func() {
-		err = dnsProxy.Resolve(d)
+		err = dnsProxy.Resolve(context.Background(), d)
 	})
 	require.NoError(t, err)
 
@@ -1059,7 +1083,7 @@ func TestExchangeCustomUpstreamConfig(t *testing.T) {
 		Addr: netip.MustParseAddrPort("1.2.3.0:1234"),
 	}
 
-	err := prx.Resolve(&d)
+	err := prx.Resolve(context.Background(), &d)
 	require.NoError(t, err)
 
 	assert.Equal(t, ansIP, firstIP(d.Res))
@@ -1082,7 +1106,7 @@ func TestExchangeCustomUpstreamConfigCache(t *testing.T) {
 	var count int
 
 	ansIP := net.IP{4, 3, 2, 1}
-	exchangeFunc := func(m *dns.Msg) (resp *dns.Msg, err error) {
+	exchangeFunc := func(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 		resp = &dns.Msg{}
 		resp.SetReply(m)
 		resp.Answer = append(resp.Answer, &dns.A{
@@ -1118,13 +1142,13 @@ func TestExchangeCustomUpstreamConfigCache(t *testing.T) {
 		Addr:                 netip.MustParseAddrPort("1.2.3.0:1234"),
 	}
 
-	err := prx.Resolve(&d)
+	err := prx.Resolve(context.Background(), &d)
 	require.NoError(t, err)
 
 	require.Equal(t, 1, count)
 	assert.Equal(t, ansIP, firstIP(d.Res))
 
-	err = prx.Resolve(&d)
+	err = prx.Resolve(context.Background(), &d)
 	require.NoError(t, err)
 
 	assert.Equal(t, 1, count)
@@ -1132,7 +1156,7 @@ func TestExchangeCustomUpstreamConfigCache(t *testing.T) {
 
 	customUpstreamConfig.ClearCache()
 
-	err = prx.Resolve(&d)
+	err = prx.Resolve(context.Background(), &d)
 	require.NoError(t, err)
 
 	assert.Equal(t, 2, count)
@@ -1217,7 +1241,7 @@ func TestECSProxy(t *testing.T) {
 			Addr: netip.MustParseAddrPort("1.2.3.0:1234"),
 		}
 
-		err := prx.Resolve(&d)
+		err := prx.Resolve(context.Background(), &d)
 		require.NoError(t, err)
 
 		assert.Equal(t, net.IP{4, 3, 2, 1}, firstIP(d.Res))
@@ -1231,7 +1255,7 @@ func TestECSProxy(t *testing.T) {
 		}
 		u.ans, u.ecsIP, u.ecsReqIP = nil, nil, nil
 
-		require.NoError(t, prx.Resolve(d))
+		require.NoError(t, prx.Resolve(context.Background(), d))
 
 		assert.Equal(t, ip4321, firstIP(d.Res))
 		assert.Nil(t, u.ecsReqIP)
@@ -1248,7 +1272,7 @@ func TestECSProxy(t *testing.T) {
 		}}
 		u.ecsIP = ip2230
 
-		err := prx.Resolve(&d)
+		err := prx.Resolve(context.Background(), &d)
 		require.NoError(t, err)
 
 		assert.Equal(t, ip4322, firstIP(d.Res))
@@ -1266,7 +1290,7 @@ func TestECSProxy(t *testing.T) {
 		}}
 		u.ecsIP, u.ecsReqIP = nil, nil
 
-		err := prx.Resolve(&d)
+		err := prx.Resolve(context.Background(), &d)
 		require.NoError(t, err)
 
 		assert.Equal(t, ip4323, firstIP(d.Res))
@@ -1280,7 +1304,7 @@ func TestECSProxy(t *testing.T) {
 		}
 		u.ans, u.ecsIP, u.ecsReqIP = nil, nil, nil
 
-		err := prx.Resolve(&d)
+		err := prx.Resolve(context.Background(), &d)
 		require.NoError(t, err)
 
 		assert.Equal(t, ip4323, firstIP(d.Res))
@@ -1323,7 +1347,7 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 		Req:  newHostTestMessage("host"),
 		Addr: netip.MustParseAddrPort("1.2.3.0:1234"),
 	}
-	err := prx.Resolve(&d)
+	err := prx.Resolve(context.Background(), &d)
 	require.NoError(t, err)
 
 	// get from cache - check min TTL
@@ -1349,7 +1373,7 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 		A: net.IP{4, 3, 2, 1},
 	}}
 	u.ecsIP = clientIP
-	err = prx.Resolve(&d)
+	err = prx.Resolve(context.Background(), &d)
 	require.NoError(t, err)
 
 	// get from cache - check max TTL
@@ -1405,8 +1429,13 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 		logger:          slogutil.NewDiscardLogger(),
 		pendingRequests: newDefaultPendingRequests(),
 	}
+	p.initLoggers()
 
 	p.initCache()
+
+	// Emulate the started proxy, since it has no listeners.
+	p.state.Store(uint32(stateRunning))
+
 	out, in := make(chan unit), make(chan unit)
 	p.shortFlighter.cr = &testCachingResolver{
 		onReplyFromUpstream: func(dctx *DNSContext) (ok bool, err error) {
@@ -1437,14 +1466,14 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	data := (&cacheItem{
 		m: buildResp(req, 0),
 		u: testUpsAddr,
-	}).pack()
+	}).pack(time.Now())
 	items := glcache.New(glcache.Config{
 		EnableLRU: true,
 	})
 	items.Set(key, data)
 	p.cache.items = items
 
-	err := p.Resolve(firstCtx)
+	err := p.Resolve(context.Background(), firstCtx)
 	require.NoError(t, err)
 	require.Len(t, firstCtx.Res.Answer, 1)
 
@@ -1453,7 +1482,7 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	// Wait for optimisticResolver to reach the tested function.
 	<-out
 
-	err = p.Resolve(secondCtx)
+	err = p.Resolve(context.Background(), secondCtx)
 	require.NoError(t, err)
 	require.Len(t, secondCtx.Res.Answer, 1)
 
@@ -1496,14 +1525,14 @@ func TestProxy_HandleDNSRequest_private(t *testing.T) {
 	nxdomainResp.Rcode = dns.RcodeNameError
 
 	generalUps := &dnsproxytest.Upstream{
-		OnExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 			return externalResp.Copy(), nil
 		},
 		OnAddress: func() (addr string) { return "general" },
 		OnClose:   func() (err error) { return nil },
 	}
 	privateUps := &dnsproxytest.Upstream{
-		OnExchange: func(m *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, m *dns.Msg) (resp *dns.Msg, err error) {
 			return privateResp.Copy(), nil
 		},
 		OnAddress: func() (addr string) { return "private" },
@@ -1564,8 +1593,130 @@ func TestProxy_HandleDNSRequest_private(t *testing.T) {
 
 			dctx := p.newDNSContext(ProtoUDP, tc.req, tc.cliAddr)
 
-			require.NoError(t, p.handleDNSRequest(dctx))
+			require.NoError(t, p.handleDNSRequest(context.Background(), dctx))
 			assert.Equal(t, tc.want, dctx.Res)
 		})
 	}
 }
+
+func TestProxy_ReplyFromUpstream_refreshUpstreams(t *testing.T) {
+	const host = "example.org."
+
+	var (
+		generalIP = net.IP{1, 2, 3, 4}
+		refreshIP = net.IP{4, 3, 2, 1}
+	)
+
+	newUps := func(ip net.IP) (u upstream.Upstream) {
+		return &dnsproxytest.Upstream{
+			OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+				resp = (&dns.Msg{}).SetReply(req)
+				resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, ip)}
+
+				return resp, nil
+			},
+			OnAddress: func() (addr string) { return ip.String() },
+			OnClose:   func() (err error) { return nil },
+		}
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         slogutil.NewDiscardLogger(),
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:  []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{newUps(generalIP)}},
+		CacheProactiveRefreshUpstreams: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newUps(refreshIP)},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	testCases := []struct {
+		want      net.IP
+		name      string
+		isRefresh bool
+	}{{
+		want:      generalIP,
+		name:      "general",
+		isRefresh: false,
+	}, {
+		want:      refreshIP,
+		name:      "refresh",
+		isRefresh: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req:       (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+				isRefresh: tc.isRefresh,
+			}
+
+			ok, err := p.replyFromUpstream(context.Background(), d)
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			require.Len(t, d.Res.Answer, 1)
+			a := testutil.RequireTypeAssert[*dns.A](t, d.Res.Answer[0])
+
+			assert.Equal(t, tc.want, a.A.To4())
+		})
+	}
+}
+
+func TestProxy_ReplyFromUpstream_normalize(t *testing.T) {
+	const host = "example.org."
+
+	var reqs []*dns.Msg
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			reqs = append(reqs, req.Copy())
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                    slogutil.NewDiscardLogger(),
+		UDPListenAddr:             []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:             []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:            &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:            defaultTrustedProxies,
+		RatelimitSubnetLenIPv4:    24,
+		RatelimitSubnetLenIPv6:    64,
+		NormalizeUpstreamRequests: true,
+	})
+
+	for _, name := range []string{"ExAmPle.ORG.", host} {
+		req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+		req.RecursionDesired = false
+
+		d := &DNSContext{Req: req}
+
+		ok, err := p.replyFromUpstream(context.Background(), d)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// The client's request and its view of the response are kept.
+		assert.Equal(t, name, d.Req.Question[0].Name)
+		assert.False(t, d.Req.RecursionDesired)
+
+		require.Len(t, d.Res.Question, 1)
+		assert.Equal(t, name, d.Res.Question[0].Name)
+		assert.False(t, d.Res.RecursionDesired)
+	}
+
+	require.Len(t, reqs, 2)
+
+	for _, req := range reqs {
+		assert.Equal(t, host, req.Question[0].Name)
+		assert.True(t, req.RecursionDesired)
+	}
+}
@@ -1,7 +1,9 @@
 package proxy_test
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"testing"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -42,7 +44,7 @@ func isCachedWithCustomConfig(
 		Req:                  (&dns.Msg{}).SetQuestion(fqdn, dns.TypeA),
 	}
 
-	err := p.Resolve(d)
+	err := p.Resolve(context.Background(), d)
 	require.NoError(tb, err)
 
 	qs := d.QueryStatistics()
@@ -61,7 +63,7 @@ func TestProxy_Resolve_cache(t *testing.T) {
 		OnAddress: func() (addr string) { return "stub" },
 		OnClose:   func() (err error) { return nil },
 	}
-	ups.OnExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+	ups.OnExchange = func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 		resp = (&dns.Msg{}).SetReply(req)
 		resp.Answer = append(resp.Answer, &dns.A{
 			Hdr: dns.RR_Header{
@@ -151,7 +153,7 @@ func TestProxy_Start_closeOnFail(t *testing.T) {
 	tcpAddr := testutil.RequireTypeAssert[*net.TCPAddr](t, l.Addr())
 
 	ups := &dnsproxytest.Upstream{
-		OnExchange: func(m *dns.Msg) (_ *dns.Msg, _ error) { panic(testutil.UnexpectedCall(m)) },
+		OnExchange: func(_ context.Context, m *dns.Msg) (_ *dns.Msg, _ error) { panic(testutil.UnexpectedCall(m)) },
 		OnAddress:  func() (_ string) { panic(testutil.UnexpectedCall()) },
 		OnClose:    func() (_ error) { panic(testutil.UnexpectedCall()) },
 	}
@@ -182,3 +184,112 @@ func TestProxy_Start_closeOnFail(t *testing.T) {
 		servicetest.RequireRun(t, p, testTimeout)
 	}))
 }
+
+func TestProxy_lifecycle(t *testing.T) {
+	t.Parallel()
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		OnAddress: func() (addr string) { return "stub" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p, err := proxy.New(&proxy.Config{
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		CacheEnabled:   true,
+	})
+	require.NoError(t, err)
+
+	resolve := func() (err error) {
+		return p.Resolve(context.Background(), &proxy.DNSContext{
+			Req: (&dns.Msg{}).SetQuestion("example.test.", dns.TypeA),
+		})
+	}
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+
+	require.True(t, t.Run("created", func(t *testing.T) {
+		assert.ErrorIs(t, resolve(), proxy.ErrNotRunning)
+		assert.NoError(t, p.Shutdown(ctx))
+	}))
+
+	require.True(t, t.Run("running", func(t *testing.T) {
+		require.NoError(t, p.Start(ctx))
+
+		assert.NoError(t, resolve())
+		assert.Error(t, p.Start(ctx))
+	}))
+
+	require.True(t, t.Run("stopped", func(t *testing.T) {
+		require.NoError(t, p.Shutdown(ctx))
+
+		assert.ErrorIs(t, resolve(), proxy.ErrNotRunning)
+		assert.NoError(t, p.Shutdown(ctx))
+	}))
+
+	require.True(t, t.Run("restarted", func(t *testing.T) {
+		servicetest.RequireRun(t, p, testTimeout)
+
+		assert.NoError(t, resolve())
+	}))
+}
+
+func TestProxy_Shutdown_refresh(t *testing.T) {
+	t.Parallel()
+
+	refreshing := make(chan struct{})
+	var exchanged atomic.Bool
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			if exchanged.Swap(true) {
+				// Block the refresh until it's canceled.
+				close(refreshing)
+				<-ctx.Done()
+
+				return nil, ctx.Err()
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    2,
+				},
+				A: net.IP{192, 0, 2, 1},
+			}}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "stub" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p, err := proxy.New(&proxy.Config{
+		UDPListenAddr:                   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:                  &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		CacheEnabled:                    true,
+		CacheOptimistic:                 true,
+		CacheProactiveRefreshTime:       1900,
+		CacheProactiveCooldownThreshold: -1,
+	})
+	require.NoError(t, err)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	require.NoError(t, p.Start(ctx))
+
+	err = p.Resolve(ctx, &proxy.DNSContext{
+		Req: (&dns.Msg{}).SetQuestion("example.test.", dns.TypeA),
+	})
+	require.NoError(t, err)
+
+	testutil.RequireReceive(t, refreshing, testTimeout)
+	require.NoError(t, p.Shutdown(ctx))
+
+	// The refresh in progress is canceled and waited for.
+	assert.Zero(t, p.RefresherState().Running)
+}
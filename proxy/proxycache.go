@@ -3,6 +3,8 @@ package proxy
 import (
 	"net"
 	"slices"
+
+	"github.com/miekg/dns"
 )
 
 // cacheForContext returns cache object for the given context.
@@ -11,6 +13,10 @@ func (p *Proxy) cacheForContext(d *DNSContext) (c *cache) {
 		return d.CustomUpstreamConfig.cache
 	}
 
+	if d.clientCache != nil {
+		return d.clientCache
+	}
+
 	return p.cache
 }
 
@@ -40,13 +46,32 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 	d.Res = ci.m
 	d.queryStatistics = cachedQueryStatistics(ci.u)
 
-	p.logger.Debug(
+	switch {
+	case dctxCache.optimistic && expired:
+		p.setSource(d, ResponseSourceOptimistic)
+		d.ede = &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeStaleAnswer,
+			ExtraText: "optimistic cache",
+		}
+	case dctxCache.isPrefetched(key):
+		p.setSource(d, ResponseSourceProactive)
+	default:
+		p.setSource(d, ResponseSourceCache)
+	}
+
+	p.cacheLogger.Debug(
 		"replying from cache",
 		"source", cacheSource,
 		"ecs_enabled", p.Config.EnableEDNSClientSubnet,
 	)
 
 	if dctxCache.optimistic && expired {
+		if dctxCache.isBackingOff(key) {
+			p.cacheLogger.Debug("not resolving expired entry; refresh is backing off")
+
+			return hit
+		}
+
 		// Build a reduced clone of the current context to avoid data race.
 		minCtxClone := &DNSContext{
 			// It is only read inside the optimistic resolver.
@@ -59,7 +84,7 @@ func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 			addDO(minCtxClone.Req)
 		}
 
-		go p.shortFlighter.resolveOnce(minCtxClone, key, p.logger)
+		go p.shortFlighter.resolveOnce(p.runContext(), minCtxClone, key, p.refreshLogger)
 	}
 
 	return hit
@@ -80,10 +105,16 @@ func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 // cacheResp stores the response from d in general or subnet cache.  In case the
 // cache is present in d, it's used first.
 func (p *Proxy) cacheResp(d *DNSContext) {
+	if p.CacheAdmissionHandler != nil && !p.CacheAdmissionHandler(d.Res, d) {
+		p.cacheLogger.Debug("not caching response; rejected by admission handler")
+
+		return
+	}
+
 	dctxCache := p.cacheForContext(d)
 
 	if !p.EnableEDNSClientSubnet {
-		dctxCache.set(d.Res, d.Upstream, p.logger)
+		dctxCache.set(d.Res, d.Upstream, p.cacheLogger)
 
 		return
 	}
@@ -102,7 +133,7 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 		// TODO(a.meshkov):  The whole response MUST be dropped if ECS in it
 		// doesn't correspond.
 		if !ecs.IP.Mask(ecs.Mask).Equal(d.ReqECS.IP.Mask(d.ReqECS.Mask)) || ones != reqOnes {
-			p.logger.Debug(
+			p.cacheLogger.Debug(
 				"not caching response; subnet mismatch",
 				"ecs", ecs,
 				"req_ecs", d.ReqECS,
@@ -121,15 +152,15 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 			ecs.IP = ecs.IP.Mask(ecs.Mask)
 		}
 
-		p.logger.Debug("caching response", "ecs", ecs)
+		p.cacheLogger.Debug("caching response", "ecs", ecs)
 
-		dctxCache.setWithSubnet(d.Res, d.Upstream, ecs, p.logger)
+		dctxCache.setWithSubnet(d.Res, d.Upstream, ecs, p.cacheLogger)
 	case d.ReqECS != nil:
 		// Cache the response for all subnets since the server doesn't support
 		// EDNS Client Subnet option.
-		dctxCache.setWithSubnet(d.Res, d.Upstream, &net.IPNet{IP: nil, Mask: nil}, p.logger)
+		dctxCache.setWithSubnet(d.Res, d.Upstream, &net.IPNet{IP: nil, Mask: nil}, p.cacheLogger)
 	default:
-		dctxCache.set(d.Res, d.Upstream, p.logger)
+		dctxCache.set(d.Res, d.Upstream, p.cacheLogger)
 	}
 }
 
@@ -141,5 +172,24 @@ func (p *Proxy) ClearCache() {
 
 	p.cache.clearItems()
 	p.cache.clearItemsWithSubnet()
-	p.logger.Debug("cache cleared")
+
+	p.clientCachesDo(func(c *cache) {
+		c.clearItems()
+		c.clearItemsWithSubnet()
+	})
+
+	p.cacheLogger.Debug("cache cleared")
+}
+
+// clientCachesDo calls f for each cache of the client policies, see
+// [Config.CachePerClient].
+func (p *Proxy) clientCachesDo(f func(c *cache)) {
+	live := p.live.Load()
+	if live == nil {
+		return
+	}
+
+	for _, c := range live.clientCaches {
+		f(c)
+	}
 }
@@ -0,0 +1,414 @@
+package proxytest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// Qname is a single question of the distribution replayed by [RunLoad].
+type Qname struct {
+	// Name is the fully-qualified domain name.
+	Name string
+
+	// Type is the type of the question.
+	Type uint16
+
+	// Weight is the relative frequency of the question within the
+	// distribution.  It must be positive.
+	Weight uint
+}
+
+// ReadQnames reads the distribution of questions from r.  Each non-empty line
+// not starting with "#" has the form:
+//
+//	name [type [weight]]
+//
+// The type is A and the weight is 1 by default, e.g.:
+//
+//	example.com
+//	example.com AAAA 10
+func ReadQnames(r io.Reader) (qnames []*Qname, err error) {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var q *Qname
+		q, err = parseQname(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		qnames = append(qnames, q)
+	}
+
+	return qnames, s.Err()
+}
+
+// parseQname parses a single line of the distribution, see [ReadQnames].
+func parseQname(line string) (q *Qname, err error) {
+	fields := strings.Fields(line)
+	if len(fields) > 3 {
+		return nil, fmt.Errorf("want at most 3 fields, got %d", len(fields))
+	}
+
+	q = &Qname{
+		Name:   dns.Fqdn(fields[0]),
+		Type:   dns.TypeA,
+		Weight: 1,
+	}
+
+	if len(fields) > 1 {
+		var ok bool
+		q.Type, ok = dns.StringToType[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("bad type %q", fields[1])
+		}
+	}
+
+	if len(fields) > 2 {
+		var w uint64
+		w, err = strconv.ParseUint(fields[2], 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("bad weight: %w", err)
+		} else if w == 0 {
+			return nil, errors.Error("weight must be positive")
+		}
+
+		q.Weight = uint(w)
+	}
+
+	return q, nil
+}
+
+// LoadConfig is the configuration of [RunLoad].
+type LoadConfig struct {
+	// Qnames is the distribution of the questions to send.  It must not be
+	// empty.
+	Qnames []*Qname
+
+	// Proto is the protocol of the listener to send the requests to.  It must
+	// be either [proxy.ProtoUDP] or [proxy.ProtoTCP].
+	Proto proxy.Proto
+
+	// Requests is the total number of requests to send.  It must be positive.
+	Requests int
+
+	// Concurrency is the number of the clients sending the requests at the
+	// same time, each over its own connection.  If not positive, a single
+	// client is used.
+	Concurrency int
+
+	// Timeout is the timeout of a single exchange.  If not positive, [Timeout]
+	// is used.
+	Timeout time.Duration
+
+	// Seed is the seed for choosing the questions from Qnames, so that the
+	// sequences of the questions are reproducible.
+	Seed uint64
+}
+
+// LoadReport is the result of [RunLoad].
+type LoadReport struct {
+	// Duration is the total time of sending all the requests.
+	Duration time.Duration
+
+	// P50 is the median latency of the successful exchanges.
+	P50 time.Duration
+
+	// P95 is the 95th percentile of the latency of the successful exchanges.
+	P95 time.Duration
+
+	// P99 is the 99th percentile of the latency of the successful exchanges.
+	P99 time.Duration
+
+	// Requests is the number of requests sent.
+	Requests int
+
+	// Errors is the number of the failed exchanges.
+	Errors int
+
+	// CacheHits is the number of the requests responded from the cache.  It's
+	// only counted if the proxy collects the client statistics, see
+	// [proxy.Config.ClientStats].
+	CacheHits uint64
+
+	// HitRate is the ratio of CacheHits to Requests.
+	HitRate float64
+
+	// AllocsPerRequest is the number of heap allocations per request.  Since
+	// the proxy usually runs within the same process, the allocations of the
+	// clients are included.
+	AllocsPerRequest float64
+
+	// BytesPerRequest is the number of heap bytes allocated per request, see
+	// AllocsPerRequest.
+	BytesPerRequest float64
+}
+
+// String implements the [fmt.Stringer] interface for *LoadReport.
+func (r *LoadReport) String() (s string) {
+	return fmt.Sprintf(
+		"requests=%d errors=%d duration=%s p50=%s p95=%s p99=%s hit_rate=%.3f "+
+			"allocs/req=%.1f bytes/req=%.1f",
+		r.Requests,
+		r.Errors,
+		r.Duration,
+		r.P50,
+		r.P95,
+		r.P99,
+		r.HitRate,
+		r.AllocsPerRequest,
+		r.BytesPerRequest,
+	)
+}
+
+// validate returns an error if conf is invalid.
+func (conf *LoadConfig) validate() (err error) {
+	switch {
+	case len(conf.Qnames) == 0:
+		return errors.Error("no qnames")
+	case conf.Requests <= 0:
+		return fmt.Errorf("requests: %w", errors.ErrNotPositive)
+	case conf.Proto != proxy.ProtoUDP && conf.Proto != proxy.ProtoTCP:
+		return fmt.Errorf("proto: %w: %q", errors.ErrBadEnumValue, conf.Proto)
+	}
+
+	for i, q := range conf.Qnames {
+		if q.Weight == 0 {
+			return fmt.Errorf("qnames: at index %d: weight: %w", i, errors.ErrNotPositive)
+		}
+	}
+
+	return nil
+}
+
+// RunLoad sends conf.Requests requests with the questions chosen from
+// conf.Qnames according to their weights to the running proxy p and reports
+// the results.  The failed exchanges are counted and don't stop the run.  It
+// returns an error if conf is invalid, p has no listener for conf.Proto, or
+// ctx is canceled.  conf must not be nil.
+func RunLoad(ctx context.Context, p *proxy.Proxy, conf *LoadConfig) (r *LoadReport, err error) {
+	err = conf.validate()
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	addr := p.Addr(conf.Proto)
+	if addr == nil {
+		return nil, fmt.Errorf("no %s listener", conf.Proto)
+	}
+
+	workers := min(max(conf.Concurrency, 1), conf.Requests)
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = Timeout
+	}
+
+	cli := &dns.Client{
+		Net:     string(conf.Proto),
+		Timeout: timeout,
+	}
+
+	hitsBefore := cacheHits(p)
+
+	var msBefore, msAfter runtime.MemStats
+	runtime.ReadMemStats(&msBefore)
+
+	results := make([]*loadResult, workers)
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+	for i := range workers {
+		n := conf.Requests / workers
+		if i < conf.Requests%workers {
+			n++
+		}
+
+		w := &loadWorker{
+			cli:    cli,
+			addr:   addr.String(),
+			picker: newQnamePicker(conf.Qnames, conf.Seed+uint64(i)),
+			res: &loadResult{
+				latencies: make([]time.Duration, 0, n),
+			},
+		}
+		results[i] = w.res
+
+		wg.Go(func() { w.run(ctx, n) })
+	}
+
+	wg.Wait()
+	dur := time.Since(start)
+
+	runtime.ReadMemStats(&msAfter)
+
+	err = ctx.Err()
+	if err != nil {
+		return nil, fmt.Errorf("running load: %w", err)
+	}
+
+	r = newLoadReport(results, dur)
+	r.CacheHits = cacheHits(p) - hitsBefore
+	r.HitRate = float64(r.CacheHits) / float64(r.Requests)
+	r.AllocsPerRequest = float64(msAfter.Mallocs-msBefore.Mallocs) / float64(r.Requests)
+	r.BytesPerRequest = float64(msAfter.TotalAlloc-msBefore.TotalAlloc) / float64(r.Requests)
+
+	return r, nil
+}
+
+// cacheHits returns the total number of the requests responded from the cache
+// of p according to its client statistics.
+func cacheHits(p *proxy.Proxy) (n uint64) {
+	for _, s := range p.ClientStatistics() {
+		n += s.CacheHits
+	}
+
+	return n
+}
+
+// newLoadReport returns the report aggregating results of the workers which
+// ran for dur.
+func newLoadReport(results []*loadResult, dur time.Duration) (r *LoadReport) {
+	r = &LoadReport{
+		Duration: dur,
+	}
+
+	var latencies []time.Duration
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		r.Errors += res.errors
+	}
+
+	r.Requests = len(latencies) + r.Errors
+
+	slices.Sort(latencies)
+	r.P50 = percentile(latencies, 50)
+	r.P95 = percentile(latencies, 95)
+	r.P99 = percentile(latencies, 99)
+
+	return r
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank
+// method.  It returns zero if sorted is empty.
+func percentile(sorted []time.Duration, p int) (d time.Duration) {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	// Round up to get the nearest rank.
+	rank := (p*len(sorted) + 99) / 100
+
+	return sorted[max(rank, 1)-1]
+}
+
+// loadResult is the result of a single [loadWorker].
+type loadResult struct {
+	// latencies are the durations of the successful exchanges.
+	latencies []time.Duration
+
+	// errors is the number of the failed exchanges.
+	errors int
+}
+
+// loadWorker sends the requests over a single connection.
+type loadWorker struct {
+	cli    *dns.Client
+	picker *qnamePicker
+	res    *loadResult
+	addr   string
+}
+
+// run sends n requests.  The connection is re-established after the failed
+// exchanges.
+func (w *loadWorker) run(ctx context.Context, n int) {
+	var conn *dns.Conn
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	for range n {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var err error
+		if conn == nil {
+			conn, err = w.cli.DialContext(ctx, w.addr)
+			if err != nil {
+				w.res.errors++
+
+				continue
+			}
+		}
+
+		q := w.picker.pick()
+		req := (&dns.Msg{}).SetQuestion(q.Name, q.Type)
+
+		start := time.Now()
+		_, _, err = w.cli.ExchangeWithConnContext(ctx, req, conn)
+		if err != nil {
+			w.res.errors++
+			_ = conn.Close()
+			conn = nil
+
+			continue
+		}
+
+		w.res.latencies = append(w.res.latencies, time.Since(start))
+	}
+}
+
+// qnamePicker chooses the questions according to their weights.  It's not
+// safe for concurrent use.
+type qnamePicker struct {
+	rng *rand.Rand
+
+	qnames []*Qname
+
+	// cumWeights are the cumulative weights of qnames.
+	cumWeights []uint
+}
+
+// newQnamePicker returns a new *qnamePicker for non-empty qnames with positive
+// weights.
+func newQnamePicker(qnames []*Qname, seed uint64) (p *qnamePicker) {
+	p = &qnamePicker{
+		rng:        rand.New(rand.NewPCG(seed, seed)),
+		qnames:     qnames,
+		cumWeights: make([]uint, len(qnames)),
+	}
+
+	var sum uint
+	for i, q := range qnames {
+		sum += q.Weight
+		p.cumWeights[i] = sum
+	}
+
+	return p
+}
+
+// pick returns a random question.
+func (p *qnamePicker) pick() (q *Qname) {
+	n := p.rng.UintN(p.cumWeights[len(p.cumWeights)-1])
+	i, _ := slices.BinarySearch(p.cumWeights, n+1)
+
+	return p.qnames[i]
+}
@@ -0,0 +1,141 @@
+package proxytest_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxy/proxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadQnames(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		want       []*proxytest.Qname
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want: []*proxytest.Qname{{
+			Name:   "example.com.",
+			Type:   dns.TypeA,
+			Weight: 1,
+		}, {
+			Name:   "example.org.",
+			Type:   dns.TypeAAAA,
+			Weight: 10,
+		}},
+		name:       "success",
+		in:         "# comment\nexample.com\n\nexample.org. aaaa 10\n",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "bad_type",
+		in:         "example.com BAD",
+		wantErrMsg: `line 1: bad type "BAD"`,
+	}, {
+		want:       nil,
+		name:       "zero_weight",
+		in:         "example.com\nexample.org A 0",
+		wantErrMsg: "line 2: weight must be positive",
+	}, {
+		want:       nil,
+		name:       "too_many_fields",
+		in:         "example.com A 1 2",
+		wantErrMsg: "line 1: want at most 3 fields, got 4",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			qnames, err := proxytest.ReadQnames(strings.NewReader(tc.in))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, qnames)
+		})
+	}
+}
+
+func TestRunLoad(t *testing.T) {
+	t.Parallel()
+
+	const requestsNum = 200
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 0, 2, 1},
+			})
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "stub" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	h := proxytest.NewHarness(t, &proxy.Config{
+		Logger:         slogutil.NewDiscardLogger(),
+		UpstreamConfig: &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: netutil.SliceSubnetSet{},
+		CacheEnabled:   true,
+		ClientStats:    &proxy.ClientStatisticsConfig{},
+	}, proxy.ProtoUDP, proxy.ProtoTCP)
+
+	qnames := []*proxytest.Qname{{
+		Name:   "hot.example.",
+		Type:   dns.TypeA,
+		Weight: 9,
+	}, {
+		Name:   "cold.example.",
+		Type:   dns.TypeA,
+		Weight: 1,
+	}}
+
+	for _, proto := range []proxy.Proto{proxy.ProtoUDP, proxy.ProtoTCP} {
+		t.Run(string(proto), func(t *testing.T) {
+			ctx := testutil.ContextWithTimeout(t, proxytest.Timeout)
+			r, err := proxytest.RunLoad(ctx, h.Proxy, &proxytest.LoadConfig{
+				Qnames:      qnames,
+				Proto:       proto,
+				Requests:    requestsNum,
+				Concurrency: 4,
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, requestsNum, r.Requests)
+			assert.Zero(t, r.Errors)
+			assert.Positive(t, r.HitRate)
+			assert.LessOrEqual(t, r.P50, r.P95)
+			assert.LessOrEqual(t, r.P95, r.P99)
+			assert.Positive(t, r.AllocsPerRequest)
+		})
+	}
+
+	t.Run("bad_config", func(t *testing.T) {
+		_, err := proxytest.RunLoad(context.Background(), h.Proxy, &proxytest.LoadConfig{
+			Qnames:   qnames,
+			Proto:    proxy.ProtoHTTPS,
+			Requests: requestsNum,
+		})
+		testutil.AssertErrorMsg(t, `load config: proto: bad enum value: "https"`, err)
+	})
+}
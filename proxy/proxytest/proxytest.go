@@ -0,0 +1,298 @@
+// Package proxytest contains helpers for testing the DNS proxy and the code
+// using it.
+package proxytest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// ServerName is the name of the server in the certificate generated for
+	// the encrypted listeners.
+	ServerName = "proxytest.example"
+
+	// Timeout is the timeout used for starting the proxy and for the
+	// exchanges.
+	Timeout = 1 * time.Second
+)
+
+// localhostAnyPort is a localhost address with an arbitrary port.
+var localhostAnyPort = netip.AddrPortFrom(netutil.IPv4Localhost(), 0)
+
+// DefaultProtos are the protocols the [Harness] listens on by default.
+var DefaultProtos = []proxy.Proto{
+	proxy.ProtoUDP,
+	proxy.ProtoTCP,
+	proxy.ProtoTLS,
+	proxy.ProtoHTTPS,
+}
+
+// Harness is a running proxy listening on ephemeral localhost ports with the
+// clients for each of its listeners.
+type Harness struct {
+	// Proxy is the running proxy.
+	Proxy *proxy.Proxy
+
+	// tlsConf is the client TLS configuration trusting the proxy certificate.
+	tlsConf *tls.Config
+
+	// httpClient is the DNS-over-HTTPS client, if the corresponding listener
+	// is configured.
+	httpClient *http.Client
+}
+
+// NewHarness creates a new proxy based on conf, starts it and registers its
+// shutdown in tb's cleanup.  The listen addresses of conf are replaced with the
+// ones for protos, [DefaultProtos] are used if protos is empty.  If conf has no
+// TLS configuration, the one with a self-signed certificate for [ServerName]
+// is used, otherwise the clients don't verify the server certificate.  conf
+// must not be nil and is not modified.
+func NewHarness(tb testing.TB, conf *proxy.Config, protos ...proxy.Proto) (h *Harness) {
+	tb.Helper()
+
+	if len(protos) == 0 {
+		protos = DefaultProtos
+	}
+
+	c := *conf
+	c.UDPListenAddr, c.TCPListenAddr, c.TLSListenAddr, c.HTTPSListenAddr = nil, nil, nil, nil
+
+	udpAddr := net.UDPAddrFromAddrPort(localhostAnyPort)
+	tcpAddr := net.TCPAddrFromAddrPort(localhostAnyPort)
+	for _, proto := range protos {
+		switch proto {
+		case proxy.ProtoUDP:
+			c.UDPListenAddr = []*net.UDPAddr{udpAddr}
+		case proxy.ProtoTCP:
+			c.TCPListenAddr = []*net.TCPAddr{tcpAddr}
+		case proxy.ProtoTLS:
+			c.TLSListenAddr = []*net.TCPAddr{tcpAddr}
+		case proxy.ProtoHTTPS:
+			c.HTTPSListenAddr = []*net.TCPAddr{tcpAddr}
+		default:
+			tb.Fatalf("proxytest: unsupported protocol %q", proto)
+		}
+	}
+
+	h = &Harness{}
+
+	needsTLS := slices.Contains(protos, proxy.ProtoTLS) || slices.Contains(protos, proxy.ProtoHTTPS)
+	if needsTLS && c.TLSConfig == nil {
+		c.TLSConfig, h.tlsConf = NewTLSConfigs(tb)
+	} else if c.TLSConfig != nil {
+		h.tlsConf = &tls.Config{
+			ServerName:         ServerName,
+			InsecureSkipVerify: true,
+		}
+	}
+
+	p, err := proxy.New(&c)
+	require.NoError(tb, err)
+
+	servicetest.RequireRun(tb, p, Timeout)
+
+	h.Proxy = p
+
+	if slices.Contains(protos, proxy.ProtoHTTPS) {
+		h.httpClient = h.newHTTPClient()
+	}
+
+	return h
+}
+
+// NewTLSConfigs returns the server TLS configuration with a new self-signed
+// certificate for [ServerName] and the client TLS configuration trusting it.
+func NewTLSConfigs(tb testing.TB) (srvConf, cliConf *tls.Config) {
+	tb.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(tb, err)
+
+	notBefore := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"AdGuard Tests"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{ServerName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(tb, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(tb, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	srvConf = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+			Leaf:        cert,
+		}},
+		ServerName: ServerName,
+	}
+	cliConf = &tls.Config{
+		ServerName: ServerName,
+		RootCAs:    roots,
+	}
+
+	return srvConf, cliConf
+}
+
+// newHTTPClient returns a new DNS-over-HTTPS client for the HTTPS listener of
+// h.Proxy.
+func (h *Harness) newHTTPClient() (c *http.Client) {
+	addr := h.Proxy.Addr(proxy.ProtoHTTPS).String()
+	dialer := &net.Dialer{
+		Timeout: Timeout,
+	}
+
+	tlsConf := h.tlsConf.Clone()
+	tlsConf.NextProtos = []string{"h2", "http/1.1"}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:    tlsConf,
+			DisableCompression: true,
+			ForceAttemptHTTP2:  true,
+			DialContext: func(ctx context.Context, network, _ string) (conn net.Conn, err error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		Timeout: Timeout,
+	}
+}
+
+// Addr returns the address of the listener for proto.  It's nil if there is no
+// such listener.
+func (h *Harness) Addr(proto proxy.Proto) (addr net.Addr) {
+	return h.Proxy.Addr(proto)
+}
+
+// ExchangeUDP sends req to the plain DNS UDP listener and returns the response.
+func (h *Harness) ExchangeUDP(tb testing.TB, req *dns.Msg) (resp *dns.Msg) {
+	tb.Helper()
+
+	return h.exchangeConn(tb, "udp", proxy.ProtoUDP, nil, req)
+}
+
+// ExchangeTCP sends req to the plain DNS TCP listener and returns the response.
+func (h *Harness) ExchangeTCP(tb testing.TB, req *dns.Msg) (resp *dns.Msg) {
+	tb.Helper()
+
+	return h.exchangeConn(tb, "tcp", proxy.ProtoTCP, nil, req)
+}
+
+// ExchangeTLS sends req to the DNS-over-TLS listener and returns the response.
+func (h *Harness) ExchangeTLS(tb testing.TB, req *dns.Msg) (resp *dns.Msg) {
+	tb.Helper()
+
+	return h.exchangeConn(tb, "tcp-tls", proxy.ProtoTLS, h.tlsConf, req)
+}
+
+// exchangeConn sends req to the listener for proto using the client for net.
+func (h *Harness) exchangeConn(
+	tb testing.TB,
+	network string,
+	proto proxy.Proto,
+	tlsConf *tls.Config,
+	req *dns.Msg,
+) (resp *dns.Msg) {
+	tb.Helper()
+
+	addr := h.Proxy.Addr(proto)
+	require.NotNilf(tb, addr, "proxytest: no %s listener", proto)
+
+	cli := &dns.Client{
+		Net:       network,
+		TLSConfig: tlsConf,
+		Timeout:   Timeout,
+	}
+
+	resp, _, err := cli.Exchange(req, addr.String())
+	require.NoError(tb, err)
+
+	return resp
+}
+
+// ExchangeHTTPS sends req to the DNS-over-HTTPS listener using the POST method
+// and returns the response.
+func (h *Harness) ExchangeHTTPS(tb testing.TB, req *dns.Msg) (resp *dns.Msg) {
+	tb.Helper()
+
+	require.NotNil(tb, h.httpClient, "proxytest: no https listener")
+
+	packed, err := req.Pack()
+	require.NoError(tb, err)
+
+	u := fmt.Sprintf("https://%s/dns-query", ServerName)
+	httpReq, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(packed))
+	require.NoError(tb, err)
+
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	httpResp, err := h.httpClient.Do(httpReq)
+	require.NoError(tb, err)
+	testutil.CleanupAndRequireSuccess(tb, httpResp.Body.Close)
+
+	require.Equal(tb, http.StatusOK, httpResp.StatusCode)
+
+	body, err := io.ReadAll(httpResp.Body)
+	require.NoError(tb, err)
+
+	resp = &dns.Msg{}
+	require.NoError(tb, resp.Unpack(body))
+
+	return resp
+}
+
+// Exchange sends req to the listener for proto and returns the response.
+func (h *Harness) Exchange(tb testing.TB, proto proxy.Proto, req *dns.Msg) (resp *dns.Msg) {
+	tb.Helper()
+
+	switch proto {
+	case proxy.ProtoUDP:
+		return h.ExchangeUDP(tb, req)
+	case proxy.ProtoTCP:
+		return h.ExchangeTCP(tb, req)
+	case proxy.ProtoTLS:
+		return h.ExchangeTLS(tb, req)
+	case proxy.ProtoHTTPS:
+		return h.ExchangeHTTPS(tb, req)
+	default:
+		tb.Fatalf("proxytest: unsupported protocol %q", proto)
+
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package proxytest
+
+import (
+	"context"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+)
+
+// Server is a mock [proxy.Server] implementation for tests.
+type Server struct {
+	OnStart    func(ctx context.Context) (err error)
+	OnShutdown func(ctx context.Context) (err error)
+	OnResolve  func(ctx context.Context, dctx *proxy.DNSContext) (err error)
+	OnStats    func() (s *proxy.Stats)
+}
+
+// NewServer returns a new *Server with all its methods set to panic.
+func NewServer() (s *Server) {
+	return &Server{
+		OnStart: func(ctx context.Context) (err error) {
+			panic(testutil.UnexpectedCall(ctx))
+		},
+		OnShutdown: func(ctx context.Context) (err error) {
+			panic(testutil.UnexpectedCall(ctx))
+		},
+		OnResolve: func(ctx context.Context, dctx *proxy.DNSContext) (err error) {
+			panic(testutil.UnexpectedCall(ctx, dctx))
+		},
+		OnStats: func() (s *proxy.Stats) {
+			panic(testutil.UnexpectedCall())
+		},
+	}
+}
+
+// type check
+var _ proxy.Server = (*Server)(nil)
+
+// Start implements the [proxy.Server] interface for *Server.
+func (s *Server) Start(ctx context.Context) (err error) {
+	return s.OnStart(ctx)
+}
+
+// Shutdown implements the [proxy.Server] interface for *Server.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	return s.OnShutdown(ctx)
+}
+
+// Resolve implements the [proxy.Server] interface for *Server.
+func (s *Server) Resolve(ctx context.Context, dctx *proxy.DNSContext) (err error) {
+	return s.OnResolve(ctx, dctx)
+}
+
+// Stats implements the [proxy.Server] interface for *Server.
+func (s *Server) Stats() (stats *proxy.Stats) {
+	return s.OnStats()
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+)
+
+// runContext is the context of a single run of the [Proxy], i.e. the time from
+// [Proxy.Start] to [Proxy.Shutdown].
+type runContext struct {
+	// ctx is the parent context of all the resolutions within the run,
+	// including the background ones.
+	ctx context.Context
+
+	// cancel cancels ctx.
+	cancel context.CancelFunc
+}
+
+// newRunContext returns a new *runContext.
+func newRunContext() (rc *runContext) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &runContext{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// runContext returns the context canceled once p is shut down.  It's used for
+// the resolutions not bound to any client, e.g. the proactive cache refreshes.
+// It returns [context.Background] if p has never been started.
+func (p *Proxy) runContext() (ctx context.Context) {
+	rc := p.run.Load()
+	if rc == nil {
+		return context.Background()
+	}
+
+	return rc.ctx
+}
+
+// queryContext returns the context for resolving a single request received
+// within parent, e.g. the context of the client's connection.  ctx is canceled
+// either when parent is or when p is shut down.  cancel must be called once the
+// request is resolved.
+func (p *Proxy) queryContext(parent context.Context) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancelCtx := context.WithCancel(parent)
+	stop := context.AfterFunc(p.runContext(), cancelCtx)
+
+	return ctx, func() {
+		stop()
+		cancelCtx()
+	}
+}
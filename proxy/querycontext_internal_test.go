@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_cancel(t *testing.T) {
+	// started receives a value once the exchange is started.
+	started := make(chan unit, 1)
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			if req.Question[0].Qtype == dns.TypeA {
+				started <- unit{}
+			}
+
+			<-ctx.Done()
+
+			return nil, ctx.Err()
+		},
+		OnAddress: func() (addr string) { return "192.0.2.53:53" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	newProxy := func(t *testing.T, cacheEnabled bool) (p *Proxy) {
+		t.Helper()
+
+		p = mustNew(t, &Config{
+			Logger:                 slogutil.NewDiscardLogger(),
+			UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			CacheEnabled:           cacheEnabled,
+		})
+		servicetest.RequireRun(t, p, testTimeout)
+
+		return p
+	}
+
+	resolveAsync := func(ctx context.Context, p *Proxy) (errCh chan error) {
+		errCh = make(chan error, 1)
+		go func() {
+			errCh <- p.Resolve(ctx, &DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+				Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+			})
+		}()
+
+		return errCh
+	}
+
+	t.Run("client", func(t *testing.T) {
+		p := newProxy(t, false)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := resolveAsync(ctx, p)
+
+		testutil.RequireReceive(t, started, testTimeout)
+		cancel()
+
+		err, _ := testutil.RequireReceive(t, errCh, testTimeout)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		p := newProxy(t, true)
+
+		// The client's cancellation doesn't affect the requests which may be
+		// shared with the identical ones.
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := resolveAsync(ctx, p)
+
+		testutil.RequireReceive(t, started, testTimeout)
+		cancel()
+		require.Empty(t, errCh)
+
+		require.NoError(t, p.Shutdown(testutil.ContextWithTimeout(t, testTimeout)))
+
+		err, _ := testutil.RequireReceive(t, errCh, testTimeout)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"encoding"
 	"fmt"
 	"net/netip"
 	"slices"
@@ -11,6 +12,52 @@ import (
 	gocache "github.com/patrickmn/go-cache"
 )
 
+// RatelimitPolicy is an enumeration of the actions performed on requests that
+// exceed the configured ratelimit.
+type RatelimitPolicy string
+
+const (
+	// RatelimitPolicyDrop makes the proxy silently drop the ratelimited
+	// requests.  It's the default policy.
+	RatelimitPolicyDrop RatelimitPolicy = "drop"
+
+	// RatelimitPolicyServFail makes the proxy respond to the ratelimited
+	// requests with SERVFAIL.
+	RatelimitPolicyServFail RatelimitPolicy = "servfail"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*RatelimitPolicy)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *RatelimitPolicy.
+func (rp *RatelimitPolicy) UnmarshalText(b []byte) (err error) {
+	switch pol := RatelimitPolicy(b); pol {
+	case
+		RatelimitPolicyDrop,
+		RatelimitPolicyServFail:
+		*rp = pol
+	default:
+		return fmt.Errorf(
+			"invalid ratelimit policy %q, supported: %q, %q",
+			b,
+			RatelimitPolicyDrop,
+			RatelimitPolicyServFail,
+		)
+	}
+
+	return nil
+}
+
+// type check
+var _ encoding.TextMarshaler = RatelimitPolicy("")
+
+// MarshalText implements [encoding.TextMarshaler] interface for
+// RatelimitPolicy.
+func (rp RatelimitPolicy) MarshalText() (text []byte, err error) {
+	return []byte(rp), nil
+}
+
 func (p *Proxy) limiterForIP(ip string) interface{} {
 	p.ratelimitLock.Lock()
 	defer p.ratelimitLock.Unlock()
@@ -28,6 +75,25 @@ func (p *Proxy) limiterForIP(ip string) interface{} {
 	return value
 }
 
+// isRatelimitExempt returns true if addr is excluded from rate limiting either
+// by [Config.RatelimitWhitelist] or by [Config.RatelimitWhitelistSubnets].
+// addr must be unmapped.
+func (p *Proxy) isRatelimitExempt(addr netip.Addr) (ok bool) {
+	// Already sorted by [Proxy.Init].
+	_, ok = slices.BinarySearchFunc(p.RatelimitWhitelist, addr, netip.Addr.Compare)
+	if ok {
+		return true
+	}
+
+	for _, pref := range p.RatelimitWhitelistSubnets {
+		if pref.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
 	if p.Ratelimit <= 0 {
 		// The ratelimit is disabled.
@@ -35,9 +101,7 @@ func (p *Proxy) isRatelimited(addr netip.Addr) (ok bool) {
 	}
 
 	addr = addr.Unmap()
-	// Already sorted by [Proxy.Init].
-	_, ok = slices.BinarySearchFunc(p.RatelimitWhitelist, addr, netip.Addr.Compare)
-	if ok {
+	if p.isRatelimitExempt(addr) {
 		return false
 	}
 
@@ -8,6 +8,8 @@ import (
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRatelimitingProxy(t *testing.T) {
@@ -93,3 +95,79 @@ func TestWhitelist(t *testing.T) {
 		t.Fatal("Second request must have been allowed due to whitelist")
 	}
 }
+
+func TestWhitelistSubnets(t *testing.T) {
+	p := Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitWhitelistSubnets = []netip.Prefix{
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+
+	testCases := []struct {
+		addr        netip.Addr
+		name        string
+		wantLimited bool
+	}{{
+		addr:        netip.MustParseAddr("192.168.1.1"),
+		name:        "whitelisted",
+		wantLimited: false,
+	}, {
+		addr:        netip.MustParseAddr("::ffff:192.168.1.2"),
+		name:        "whitelisted_mapped",
+		wantLimited: false,
+	}, {
+		addr:        netip.MustParseAddr("10.0.0.1"),
+		name:        "not_whitelisted",
+		wantLimited: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.False(t, p.isRatelimited(tc.addr))
+			assert.Equal(t, tc.wantLimited, p.isRatelimited(tc.addr))
+		})
+	}
+}
+
+func TestRatelimitingProxy_servFail(t *testing.T) {
+	dnsProxy := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestStaticUpstreamConfig(t),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		Ratelimit:              1,
+		RatelimitPolicy:        RatelimitPolicyServFail,
+	})
+
+	servicetest.RequireRun(t, dnsProxy, testTimeout)
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	client := &dns.Client{
+		Net:     string(ProtoUDP),
+		Timeout: testTimeout,
+	}
+
+	req := newTestMessage()
+	r, _, err := client.Exchange(req, addr.String())
+	require.NoError(t, err)
+
+	requireResponse(t, req, r)
+
+	req = newTestMessage()
+	r, _, err = client.Exchange(req, addr.String())
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+}
+
+func TestRatelimitPolicy_UnmarshalText(t *testing.T) {
+	var rp RatelimitPolicy
+
+	require.NoError(t, rp.UnmarshalText([]byte("servfail")))
+	assert.Equal(t, RatelimitPolicyServFail, rp)
+
+	assert.Error(t, rp.UnmarshalText([]byte("bad")))
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// RebindProtectionConfig is the configuration of the DNS rebinding protection.
+type RebindProtectionConfig struct {
+	// AllowedDomains are the patterns of the domain names, responses for which
+	// may contain private addresses, e.g. the split-DNS names.  The pattern
+	// "*.example.org" only matches the subdomains of "example.org", while
+	// "example.org" matches the domain itself as well.
+	AllowedDomains []string
+
+	// Enabled defines if the upstream responses resolving the names to the
+	// addresses from [Config.PrivateSubnets] are replaced with NXDOMAIN ones.
+	Enabled bool
+}
+
+// rebindProtectionEnabled returns true if the DNS rebinding protection is
+// enabled in c.  c may be nil.
+func (c *RebindProtectionConfig) rebindProtectionEnabled() (ok bool) {
+	return c != nil && c.Enabled
+}
+
+// allowedDomains returns the patterns of the domain names allowed to be resolved
+// into private addresses.  c may be nil.
+func (c *RebindProtectionConfig) allowedDomains() (zp *zonePatterns) {
+	if !c.rebindProtectionEnabled() {
+		return nil
+	}
+
+	return newZonePatterns(c.AllowedDomains)
+}
+
+// isRebinding returns true if m is a response for a domain name not allowed by
+// p's rebind protection configuration and contains at least a single private
+// IP address in the Answer section.  The unspecified addresses are commonly
+// used by the blocking upstreams, so those are not considered private.
+func (p *Proxy) isRebinding(m *dns.Msg) (ok bool) {
+	if m == nil || !p.RebindProtection.rebindProtectionEnabled() || len(m.Question) == 0 {
+		return false
+	} else if qt := m.Question[0].Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
+		return false
+	} else if p.rebindAllowed.matchQuestion(m) {
+		return false
+	}
+
+	for _, rr := range m.Answer {
+		ip := proxyutil.IPFromRR(rr).Unmap()
+		if ip.IsValid() && !ip.IsUnspecified() && p.privateNets.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RebindAttempts returns the number of upstream responses replaced due to the
+// DNS rebinding protection since p has been created.
+func (p *Proxy) RebindAttempts() (n uint64) {
+	return p.rebindAttempts.Load()
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_ReplyFromUpstream_rebind(t *testing.T) {
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+
+			var ip net.IP
+			switch q.Name {
+			case "public.example.":
+				ip = net.IP{1, 2, 3, 4}
+			case "blocked.example.":
+				ip = net.IPv4zero
+			default:
+				ip = net.IP{192, 168, 0, 1}
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, q.Name, dns.TypeA, defaultTestTTL, ip)}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		RebindProtection: &RebindProtectionConfig{
+			AllowedDomains: []string{"*.corp.example"},
+			Enabled:        true,
+		},
+	})
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantRcode int
+	}{{
+		name:      "public",
+		host:      "public.example.",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "private",
+		host:      "rebind.example.",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "unspecified",
+		host:      "blocked.example.",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "allowed",
+		host:      "host.corp.example.",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "allowed_apex",
+		host:      "corp.example.",
+		wantRcode: dns.RcodeNameError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req: (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA),
+			}
+
+			_, err := p.replyFromUpstream(context.Background(), d)
+			require.NoError(t, err)
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+		})
+	}
+
+	assert.Equal(t, uint64(2), p.RebindAttempts())
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// RefresherState is the overall state of the proactive cache refresh.  It's
+// intended for debugging, e.g. to find the refreshes which never finish.  See
+// [Proxy.RefreshSchedule] for the state of the particular entries.
+type RefresherState struct {
+	// PausedUntil is the time until which the refreshes are postponed, e.g.
+	// after a network change.  It's zero if they aren't.
+	PausedUntil time.Time
+
+	// Running is the number of the refreshes started and not yet finished,
+	// including the ones waiting due to
+	// [Config.CacheProactiveRefreshMaxConcurrent].
+	Running int64
+
+	// InFlight is the number of the refreshes being performed at the moment.
+	InFlight int64
+
+	// Scheduled is the number of the entries the refresh is scheduled for.
+	Scheduled int
+
+	// Failing is the number of the entries which last refresh has failed.
+	Failing int
+
+	// Rejected is the number of the refresh results rejected as drastically
+	// worse than the cached responses, see [Config.CacheProactiveRefreshGuard].
+	Rejected uint64
+
+	// Deferred is the number of the refreshes deferred due to
+	// [Config.CacheProactiveMaxRefreshQPS].
+	Deferred uint64
+
+	// Stopped is true if the refreshes are stopped, e.g. since the proxy is
+	// shut down.
+	Stopped bool
+
+	// Outage is true if the refreshes are suppressed due to an upstream outage,
+	// see [Config.CacheOutage].
+	Outage bool
+
+	// MemoryPressure is true if the refreshes are suppressed due to the memory
+	// pressure, see [Config.MemoryPressure].
+	MemoryPressure bool
+}
+
+// RefresherState returns the overall state of the proactive cache refresh.  It
+// returns nil if the cache is disabled.
+func (p *Proxy) RefresherState() (s *RefresherState) {
+	if p.cache == nil {
+		return nil
+	}
+
+	return p.cache.refresherState()
+}
+
+// refresherState returns the overall state of the proactive refresh of c.
+func (c *cache) refresherState() (s *RefresherState) {
+	s = &RefresherState{
+		Running:        c.refreshesRunning.Load(),
+		InFlight:       c.refreshesInFlight.Load(),
+		Scheduled:      syncMapLen(c.refreshTimers),
+		Failing:        syncMapLen(c.refreshFailures),
+		Rejected:       c.rejectedRefreshes.Load(),
+		Deferred:       c.deferredRefreshes.Load(),
+		Stopped:        c.refreshStopped.Load(),
+		Outage:         c.outage.isActive(),
+		MemoryPressure: c.memPressure.isActive(),
+	}
+
+	if until := time.Unix(0, c.refreshPausedUntil.Load()); c.clock.Now().Before(until) {
+		s.PausedUntil = until
+	}
+
+	return s
+}
+
+// syncMapLen returns the number of entries in m.
+func syncMapLen(m *sync.Map) (n int) {
+	m.Range(func(_, _ any) (cont bool) {
+		n++
+
+		return true
+	})
+
+	return n
+}
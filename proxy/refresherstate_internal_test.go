@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_RefresherState(t *testing.T) {
+	const host = "refreshing.example."
+
+	c := newCache(&cacheConfig{
+		size:               testCacheSize,
+		optimistic:         true,
+		refreshConcurrency: 1,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+
+	unblock := make(chan unit)
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+			<-unblock
+
+			return false, nil
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	p := &Proxy{cache: c}
+
+	s := p.RefresherState()
+	require.NotNil(t, s)
+
+	assert.Zero(t, s.Running)
+	assert.Zero(t, s.InFlight)
+	assert.True(t, s.PausedUntil.IsZero())
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	keyStr := string(msgToKey(req))
+
+	wg := &sync.WaitGroup{}
+	for range 2 {
+		wg.Go(func() { c.refreshEntry(keyStr, req) })
+	}
+
+	// Only a single refresh is performed at a time, the other one waits.
+	require.Eventually(t, func() (ok bool) {
+		s = p.RefresherState()
+
+		return s.Running == 2 && s.InFlight == 1
+	}, testTimeout, time.Millisecond)
+
+	close(unblock)
+	wg.Wait()
+
+	c.pauseRefresh(time.Hour)
+
+	s = p.RefresherState()
+	assert.Zero(t, s.Running)
+	assert.Zero(t, s.InFlight)
+	assert.False(t, s.Stopped)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), s.PausedUntil, time.Minute)
+
+	c.stopProactiveRefresh()
+	assert.True(t, p.RefresherState().Stopped)
+
+	assert.Nil(t, (&Proxy{}).RefresherState())
+}
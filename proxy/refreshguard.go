@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// defaultRefreshMinAnswers is the default minimum number of answer records of
+// a refresh result, see [Config.CacheProactiveRefreshMinAnswers].
+const defaultRefreshMinAnswers = 1
+
+// errRefreshRejected is returned for the proactive refreshes which results are
+// rejected due to [Config.CacheProactiveRefreshGuard].
+const errRefreshRejected errors.Error = "refresh result is worse than cached response"
+
+// isWorseRefresh returns true if newResp received for refreshing the cached
+// oldResp should be rejected, i.e. it's unsuccessful while oldResp is
+// successful, or it has fewer answer records than required while oldResp
+// doesn't.  oldResp may be nil, newResp must not be nil.
+func (c *cache) isWorseRefresh(oldResp, newResp *dns.Msg) (ok bool) {
+	if !c.refreshGuard || oldResp == nil || oldResp.Rcode != dns.RcodeSuccess {
+		return false
+	} else if newResp.Rcode != dns.RcodeSuccess {
+		return true
+	}
+
+	minAnswers := c.refreshMinAnswers
+	if pol := c.settings.Load().policies.matchQuestion(oldResp); pol != nil && pol.RefreshMinAnswers > 0 {
+		minAnswers = pol.RefreshMinAnswers
+	}
+
+	return len(newResp.Answer) < min(len(oldResp.Answer), int(minAnswers))
+}
+
+// RejectedRefreshes returns the number of the proactive refresh results
+// rejected due to [Config.CacheProactiveRefreshGuard] since p has been created.
+// The cached responses are kept in those cases.
+func (p *Proxy) RejectedRefreshes() (n uint64) {
+	if p.cache == nil {
+		return 0
+	}
+
+	return p.cache.rejectedRefreshes.Load()
+}
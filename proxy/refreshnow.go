@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// ErrCacheDisabled is returned by [Proxy.RefreshNow] when the cache is
+// disabled.
+const ErrCacheDisabled errors.Error = "cache is disabled"
+
+// errNotCacheable is returned by [Proxy.RefreshNow] and passed to
+// [Config.OnCacheRefresh] when the upstream response can't be cached or is a
+// failure.
+const errNotCacheable errors.Error = "response is not cacheable"
+
+// RefreshNow resolves the request for name of type qtype via the upstreams used
+// for the proactive refresh and caches the response, regardless of the
+// cooldown, see [Config.CacheProactiveCooldownThreshold].  It returns once the
+// cache is updated, so that the names could be pre-warmed before the traffic is
+// shifted to p, including the ones not cached yet.  The scheduled refresh of
+// the entry, if any, is kept.  It returns [ErrNotRunning] if p isn't running
+// and [ErrCacheDisabled] if the cache is disabled.  Both waiting for the other
+// refreshes and the upstream exchange are aborted once ctx is done.
+func (p *Proxy) RefreshNow(ctx context.Context, name string, qtype uint16) (err error) {
+	if !p.isStarted() {
+		return ErrNotRunning
+	} else if p.cache == nil {
+		return ErrCacheDisabled
+	}
+
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(name), qtype)
+	addDO(req)
+
+	err = p.cache.refreshSema.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for refresh: %w", err)
+	}
+	defer p.cache.refreshSema.Release()
+
+	dctx := &DNSContext{
+		Req:       req,
+		isRefresh: true,
+	}
+
+	ok, err := p.replyFromUpstream(ctx, dctx)
+	if err != nil {
+		return fmt.Errorf("refreshing %s: %w", req.Question[0].Name, err)
+	}
+
+	// Don't replace the cached entry with a failure, as opposed to the
+	// scheduled refreshes, since the caller is able to retry.
+	res := dctx.Res
+	if !ok || res.Rcode == dns.RcodeServerFailure || cacheTTL(res, p.refreshLogger) == 0 {
+		return fmt.Errorf("refreshing %s: %w", req.Question[0].Name, errNotCacheable)
+	}
+
+	p.cacheResp(dctx)
+
+	keyStr := string(msgToKey(req))
+	p.cache.refreshFailures.Delete(keyStr)
+	p.cache.prefetched.Store(keyStr, unit{})
+
+	p.refreshLogger.Debug("refreshed cache entry on demand", "domain", req.Question[0].Name)
+
+	return nil
+}
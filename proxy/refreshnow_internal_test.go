@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_RefreshNow(t *testing.T) {
+	const name = "example.org"
+
+	var lastOctet atomic.Uint32
+	var fail atomic.Bool
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			if fail.Load() {
+				resp.Rcode = dns.RcodeServerFailure
+
+				return resp, nil
+			}
+
+			ip := net.IP{1, 2, 3, byte(lastOctet.Add(1))}
+			resp.Answer = []dns.RR{newRR(t, req.Question[0].Name, dns.TypeA, defaultTestTTL, ip)}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	newConf := func(cacheEnabled bool) (conf *Config) {
+		return &Config{
+			Logger:                          slogutil.NewDiscardLogger(),
+			UDPListenAddr:                   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:                  &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+			TrustedProxies:                  defaultTrustedProxies,
+			RatelimitSubnetLenIPv4:          24,
+			RatelimitSubnetLenIPv6:          64,
+			CacheEnabled:                    cacheEnabled,
+			CacheSizeBytes:                  testCacheSize,
+			CacheOptimistic:                 true,
+			CacheProactiveCooldownThreshold: 100,
+		}
+	}
+
+	t.Run("not_running", func(t *testing.T) {
+		p := mustNew(t, newConf(true))
+
+		assert.ErrorIs(t, p.RefreshNow(context.Background(), name, dns.TypeA), ErrNotRunning)
+	})
+
+	t.Run("cache_disabled", func(t *testing.T) {
+		p := mustNew(t, newConf(false))
+		servicetest.RequireRun(t, p, testTimeout)
+
+		assert.ErrorIs(t, p.RefreshNow(context.Background(), name, dns.TypeA), ErrCacheDisabled)
+	})
+
+	p := mustNew(t, newConf(true))
+	servicetest.RequireRun(t, p, testTimeout)
+
+	req := (&dns.Msg{}).SetQuestion(name+".", dns.TypeA)
+	requireCachedIP := func(t *testing.T, want net.IP) {
+		t.Helper()
+
+		ci, _, _ := p.cache.get(req)
+		require.NotNil(t, ci)
+		require.Len(t, ci.m.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, ci.m.Answer[0])
+		assert.Equal(t, want, a.A.To4())
+	}
+
+	// The entry isn't cached yet.
+	require.NoError(t, p.RefreshNow(context.Background(), name, dns.TypeA))
+	requireCachedIP(t, net.IP{1, 2, 3, 1})
+
+	require.NoError(t, p.RefreshNow(context.Background(), name, dns.TypeA))
+	requireCachedIP(t, net.IP{1, 2, 3, 2})
+	assert.True(t, p.cache.isPrefetched(msgToKey(req)))
+
+	fail.Store(true)
+	err := p.RefreshNow(context.Background(), name, dns.TypeA)
+	assert.ErrorIs(t, err, errNotCacheable)
+
+	// The failure doesn't replace the cached entry.
+	requireCachedIP(t, net.IP{1, 2, 3, 2})
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// refreshRateLimiter is the token bucket limiting the rate of the proactive
+// refreshes of the whole cache, see [Config.CacheProactiveMaxRefreshQPS].  The
+// bucket holds at most a second worth of tokens, so the refreshes due at the
+// same time may be performed in bursts of that size.
+type refreshRateLimiter struct {
+	// clock is used to get the current time.
+	clock timeutil.Clock
+
+	// mu protects tokens and last.
+	mu *sync.Mutex
+
+	// last is the time tokens have been last updated at.
+	last time.Time
+
+	// tokens is the number of the refreshes allowed at last.  It's negative
+	// when the tokens are reserved in advance, see [refreshRateLimiter.reserve].
+	tokens float64
+
+	// qps is the number of tokens added per second, which is also the capacity
+	// of the bucket.
+	qps float64
+}
+
+// newRefreshRateLimiter returns a new limiter allowing qps refreshes per
+// second.  It returns nil if qps isn't positive, which disables the limit.
+func newRefreshRateLimiter(clock timeutil.Clock, qps int) (l *refreshRateLimiter) {
+	if qps <= 0 {
+		return nil
+	}
+
+	return &refreshRateLimiter{
+		clock:  clock,
+		mu:     &sync.Mutex{},
+		last:   clock.Now(),
+		tokens: float64(qps),
+		qps:    float64(qps),
+	}
+}
+
+// reserve takes a token for a refresh from l and returns the time at which the
+// refresh may be performed.  If the bucket is empty, the token is reserved in
+// advance, so that the deferred refreshes are spread evenly instead of
+// competing for each new token.  l may be nil.
+func (l *refreshRateLimiter) reserve() (at time.Time) {
+	if l == nil {
+		return time.Time{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(l.qps, l.tokens+elapsed.Seconds()*l.qps)
+		l.last = now
+	}
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return now
+	}
+
+	return now.Add(time.Duration(-l.tokens / l.qps * float64(time.Second)))
+}
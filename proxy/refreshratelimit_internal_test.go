@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshRateLimiter_reserve(t *testing.T) {
+	startTime := time.Unix(0, 0)
+	currentNow := startTime
+	clock := &faketime.Clock{
+		OnNow: func() (now time.Time) { return currentNow },
+	}
+
+	require.Nil(t, newRefreshRateLimiter(clock, 0))
+	assert.True(t, (*refreshRateLimiter)(nil).reserve().IsZero())
+
+	l := newRefreshRateLimiter(clock, 2)
+	require.NotNil(t, l)
+
+	// The burst is allowed right away, the rest is spread evenly.
+	assert.Equal(t, startTime, l.reserve())
+	assert.Equal(t, startTime, l.reserve())
+	assert.Equal(t, startTime.Add(500*time.Millisecond), l.reserve())
+	assert.Equal(t, startTime.Add(time.Second), l.reserve())
+
+	// The reserved tokens are accounted for.
+	currentNow = startTime.Add(time.Second)
+	assert.Equal(t, startTime.Add(1500*time.Millisecond), l.reserve())
+
+	// The bucket doesn't hold more than a second worth of tokens.
+	currentNow = startTime.Add(time.Hour)
+	assert.Equal(t, currentNow, l.reserve())
+	assert.Equal(t, currentNow, l.reserve())
+	assert.Equal(t, currentNow.Add(500*time.Millisecond), l.reserve())
+}
+
+func TestCache_refreshRateLimit(t *testing.T) {
+	const qps = 2
+
+	startTime := time.Unix(0, 0)
+	clock := &scenarioClock{
+		mu:  &sync.Mutex{},
+		now: startTime,
+	}
+
+	c := newCache(&cacheConfig{
+		size:          testCacheSize,
+		maxRefreshQPS: qps,
+		clock:         clock,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	t.Cleanup(c.stopProactiveRefresh)
+
+	var refreshedAt []time.Time
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(d *DNSContext) (ok bool, err error) {
+			refreshedAt = append(refreshedAt, clock.Now())
+			d.Res = (&dns.Msg{}).SetReply(d.Req)
+
+			return true, nil
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+
+	const n = 5
+
+	l := slogutil.NewDiscardLogger()
+	for i := range n {
+		host := fmt.Sprintf("host-%d.example.", i)
+		resp := (&dns.Msg{
+			MsgHdr: dns.MsgHdr{Response: true},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, 3600, net.IP{192, 0, 2, 1})},
+		}).SetQuestion(host, dns.TypeA)
+		c.set(resp, upstreamWithAddr, l)
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		c.refreshEntry(string(msgToKey(req)), req)
+	}
+
+	require.Len(t, refreshedAt, qps)
+	assert.Equal(t, uint64(n-qps), c.refresherState().Deferred)
+
+	clock.advance(startTime.Add(time.Minute))
+
+	assert.Equal(t, []time.Time{
+		startTime,
+		startTime,
+		startTime.Add(500 * time.Millisecond),
+		startTime.Add(time.Second),
+		startTime.Add(1500 * time.Millisecond),
+	}, refreshedAt)
+
+	// The deferred refreshes don't take the tokens again.
+	assert.Equal(t, uint64(n-qps), c.refresherState().Deferred)
+}
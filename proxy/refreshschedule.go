@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RefreshScheduleEntry is the state of the proactive refresh of a single cache
+// entry.  It's intended for debugging.
+type RefreshScheduleEntry struct {
+	// NextRefresh is the time the next refresh is scheduled at.  It's zero if
+	// the refresh isn't scheduled.
+	NextRefresh time.Time
+
+	// Key is the hexadecimal representation of the cache key.
+	Key string
+
+	// Domain is the requested domain name.  It's empty if the entry is neither
+	// scheduled nor cached anymore.
+	Domain string
+
+	// Requests is the number of requests for the entry within the cooldown
+	// period.  It's capped by [Config.CacheProactiveCooldownThreshold].
+	Requests int
+
+	// Failures is the number of consecutive failed refreshes of the entry.
+	Failures uint
+
+	// QType is the requested type.  It's [dns.TypeNone] if Domain is empty.
+	QType uint16
+
+	// Scheduled is true if the refresh of the entry is scheduled.
+	Scheduled bool
+
+	// Eligible is true if the entry has enough requests within the cooldown
+	// period to be refreshed, see [Config.CacheProactiveCooldownThreshold], or
+	// it's pinned, and it isn't excluded.
+	Eligible bool
+
+	// Pinned is true if the domain policy of the entry is
+	// [DomainRefreshPinned], e.g. it matches
+	// [Config.CacheProactivePinnedZones].
+	Pinned bool
+
+	// Excluded is true if the domain policy of the entry is
+	// [DomainRefreshExcluded], e.g. it matches
+	// [Config.CacheProactiveExcludedZones].
+	Excluded bool
+}
+
+// RefreshSchedule returns the proactive refresh state of the cache entries
+// which are either scheduled for refresh or have been requested within the
+// cooldown period, sorted by key.  It returns nil if the cache is disabled.
+func (p *Proxy) RefreshSchedule() (entries []*RefreshScheduleEntry) {
+	if p.cache == nil {
+		return nil
+	}
+
+	return p.cache.refreshSchedule()
+}
+
+// refreshSchedule returns the proactive refresh state of the entries of c.
+func (c *cache) refreshSchedule() (entries []*RefreshScheduleEntry) {
+	conf := c.settings.Load()
+
+	byKey := map[string]*RefreshScheduleEntry{}
+	entryFor := func(keyStr string) (e *RefreshScheduleEntry) {
+		e = byKey[keyStr]
+		if e == nil {
+			e = &RefreshScheduleEntry{
+				Key: hex.EncodeToString([]byte(keyStr)),
+			}
+			byKey[keyStr] = e
+		}
+
+		return e
+	}
+
+	c.refreshTimers.Range(func(k, v any) (cont bool) {
+		e := entryFor(k.(string))
+		if te, ok := v.(*refreshTimerEntry); ok {
+			e.NextRefresh = te.at
+			e.Scheduled = true
+			if len(te.msg.Question) > 0 {
+				e.Domain, e.QType = te.msg.Question[0].Name, te.msg.Question[0].Qtype
+			}
+		}
+
+		return true
+	})
+
+	var keys []string
+	c.requestStats.rangeStats(func(k string, _ *requestStat) (cont bool) {
+		keys = append(keys, k)
+
+		return true
+	})
+
+	for _, keyStr := range keys {
+		if n, ok := c.requestCount(keyStr); ok && n > 0 {
+			e := entryFor(keyStr)
+			e.Requests = n
+		}
+	}
+
+	for keyStr, e := range byKey {
+		if e.Domain == "" {
+			e.Domain, e.QType = c.cachedQuestion([]byte(keyStr))
+		}
+
+		if e.Domain != "" {
+			rp := conf.policies.match(e.Domain).refreshPolicy()
+			e.Pinned = rp == DomainRefreshPinned
+			e.Excluded = rp == DomainRefreshExcluded
+		}
+
+		e.Eligible = !e.Excluded && (e.Pinned || c.shouldProactiveRefresh([]byte(keyStr)))
+
+		if v, ok := c.refreshFailures.Load(keyStr); ok {
+			b := v.(*refreshBackoff)
+			b.mu.Lock()
+			e.Failures = b.failures
+			b.mu.Unlock()
+		}
+
+		entries = append(entries, e)
+	}
+
+	slices.SortFunc(entries, func(a, b *RefreshScheduleEntry) (res int) {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return entries
+}
+
+// cachedQuestion returns the question of the cached response for key, if any.
+func (c *cache) cachedQuestion(key []byte) (name string, qtype uint16) {
+	data := c.items.Get(key)
+
+	if data == nil && c.itemsWithSubnet != nil {
+		c.itemsWithSubnetLock.RLock()
+		data = c.itemsWithSubnet.Get(key)
+		c.itemsWithSubnetLock.RUnlock()
+	}
+
+	return packedQuestion(data)
+}
+
+// packedQuestion returns the question of the response within the packed cache
+// item data, if it's valid.
+func packedQuestion(data []byte) (name string, qtype uint16) {
+	if len(data) < minPackedLen {
+		return "", dns.TypeNone
+	}
+
+	l := int(binary.BigEndian.Uint16(data[expTimeSz:]))
+	msgData := data[expTimeSz+packedMsgLenSz:]
+	if l > len(msgData) {
+		return "", dns.TypeNone
+	}
+
+	m := msgPool.Get()
+	defer putMsg(m)
+
+	if m.Unpack(msgData[:l]) != nil || len(m.Question) == 0 {
+		return "", dns.TypeNone
+	}
+
+	return m.Question[0].Name, m.Question[0].Qtype
+}
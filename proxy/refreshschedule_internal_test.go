@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_RefreshSchedule(t *testing.T) {
+	const (
+		hotHost  = "hot.example."
+		coldHost = "cold.example."
+	)
+
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+		cooldownPeriod:       time.Hour,
+		cooldownThreshold:    2,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
+		onCacheResp:         func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	p := &Proxy{cache: c}
+
+	newReply := func(host string) (m *dns.Msg) {
+		return (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+		}).SetQuestion(host, dns.TypeA)
+	}
+
+	// Request the hot host twice to reach the threshold.
+	c.set(newReply(hotHost), upstreamWithAddr, c.logger)
+	c.set(newReply(hotHost), upstreamWithAddr, c.logger)
+	c.set(newReply(coldHost), upstreamWithAddr, c.logger)
+
+	entries := p.RefreshSchedule()
+	require.Len(t, entries, 2)
+
+	byDomain := map[string]*RefreshScheduleEntry{}
+	for _, e := range entries {
+		byDomain[e.Domain] = e
+	}
+
+	hot := byDomain[hotHost]
+	require.NotNil(t, hot)
+
+	hotKey := msgToKey((&dns.Msg{}).SetQuestion(hotHost, dns.TypeA))
+	assert.Equal(t, hex.EncodeToString(hotKey), hot.Key)
+	assert.Equal(t, dns.TypeA, hot.QType)
+	assert.Equal(t, 2, hot.Requests)
+	assert.True(t, hot.Eligible)
+	assert.True(t, hot.Scheduled)
+	assert.WithinDuration(t, time.Now().Add(time.Hour-time.Second), hot.NextRefresh, time.Minute)
+
+	cold := byDomain[coldHost]
+	require.NotNil(t, cold)
+
+	assert.Equal(t, 1, cold.Requests)
+	assert.False(t, cold.Eligible)
+	assert.False(t, cold.Scheduled)
+	assert.True(t, cold.NextRefresh.IsZero())
+
+	assert.Nil(t, (&Proxy{}).RefreshSchedule())
+}
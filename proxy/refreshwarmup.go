@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	rate "github.com/beefsack/go-rate"
+)
+
+// defaultWarmupRate is the default number of proactive refresh queries per
+// second sent to each upstream during the warm-up, see
+// [Config.CacheProactiveWarmupRate].
+const defaultWarmupRate = 10
+
+// refreshWarmup limits the rate of the proactive refresh queries sent to each
+// upstream during the period after the start of the proxy, so that the entries
+// loaded from the cache file aren't revalidated all at once.
+type refreshWarmup struct {
+	// clock is used to get the current time.
+	clock timeutil.Clock
+
+	// mu protects limiters and end.
+	mu *sync.Mutex
+
+	// limiters maps the upstream address to its rate limiter.  It's reset
+	// on each start.
+	limiters map[string]*rate.RateLimiter
+
+	// end is the time the warm-up ends at.  It's zero until the first start.
+	end time.Time
+
+	// period is the duration of the warm-up.
+	period time.Duration
+
+	// interval is the interval during which at most limit queries are sent to
+	// an upstream.
+	interval time.Duration
+
+	// limit is the number of queries allowed within interval.
+	limit int
+}
+
+// newRefreshWarmup returns a new warm-up limiter for the proactive refresh
+// queries.  It returns nil if period isn't positive, which disables the warm-up.
+func newRefreshWarmup(clock timeutil.Clock, period time.Duration, limit int) (w *refreshWarmup) {
+	if period <= 0 {
+		return nil
+	}
+
+	if limit <= 0 {
+		limit = defaultWarmupRate
+	}
+
+	return &refreshWarmup{
+		clock:    clock,
+		mu:       &sync.Mutex{},
+		limiters: map[string]*rate.RateLimiter{},
+		period:   period,
+		interval: time.Second,
+		limit:    limit,
+	}
+}
+
+// start begins the warm-up at now.  w may be nil.
+func (w *refreshWarmup) start(now time.Time) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.end = now.Add(w.period)
+	clear(w.limiters)
+}
+
+// wait blocks until the proactive refresh query may be sent to the upstream
+// with addr.  It returns immediately if the warm-up is over.  w may be nil.
+func (w *refreshWarmup) wait(addr string) {
+	if w == nil {
+		return
+	}
+
+	lim := w.limiter(addr)
+	if lim != nil {
+		lim.Wait()
+	}
+}
+
+// limiter returns the rate limiter for the upstream with addr, or nil if the
+// warm-up is over.
+func (w *refreshWarmup) limiter(addr string) (lim *rate.RateLimiter) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.clock.Now().Before(w.end) {
+		return nil
+	}
+
+	lim, ok := w.limiters[addr]
+	if !ok {
+		lim = rate.New(w.limit, w.interval)
+		w.limiters[addr] = lim
+	}
+
+	return lim
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil/faketime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshWarmup(t *testing.T) {
+	const (
+		period   = time.Minute
+		interval = 100 * time.Millisecond
+		limit    = 2
+		addr     = "upstream"
+	)
+
+	startTime := time.Unix(0, 0)
+	currentNow := startTime
+	clock := &faketime.Clock{
+		OnNow: func() (now time.Time) { return currentNow },
+	}
+
+	require.Nil(t, newRefreshWarmup(clock, 0, limit))
+
+	w := newRefreshWarmup(clock, period, limit)
+	require.NotNil(t, w)
+
+	w.interval = interval
+
+	// waitAll waits for n queries to addr and returns the time spent.
+	waitAll := func(n int) (elapsed time.Duration) {
+		start := time.Now()
+		for range n {
+			w.wait(addr)
+		}
+
+		return time.Since(start)
+	}
+
+	t.Run("not_started", func(t *testing.T) {
+		assert.Less(t, waitAll(limit+1), interval)
+	})
+
+	w.start(startTime)
+
+	t.Run("limited", func(t *testing.T) {
+		assert.GreaterOrEqual(t, waitAll(limit+1), interval/2)
+	})
+
+	t.Run("other_upstream", func(t *testing.T) {
+		start := time.Now()
+		for range limit {
+			w.wait("other")
+		}
+
+		assert.Less(t, time.Since(start), interval)
+	})
+
+	currentNow = startTime.Add(period)
+
+	t.Run("over", func(t *testing.T) {
+		assert.Less(t, waitAll(limit+1), interval)
+	})
+}
+
+func TestProxy_upstreamsWithStats_warmup(t *testing.T) {
+	p := &Proxy{
+		refreshWarmup: newRefreshWarmup(&faketime.Clock{}, time.Minute, 1),
+	}
+
+	ups := []upstream.Upstream{&testUpstream{}}
+
+	wrapped := p.upstreamsWithStats(ups, false)
+	require.Len(t, wrapped, 1)
+
+	assert.Nil(t, wrapped[0].(*upstreamWithStats).warmup)
+
+	wrapped = p.upstreamsWithStats(ups, true)
+	require.Len(t, wrapped, 1)
+
+	assert.Same(t, p.refreshWarmup, wrapped[0].(*upstreamWithStats).warmup)
+}
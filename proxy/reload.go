@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// liveSettings are the settings of [Proxy] which may be changed while it's
+// running, see [Proxy.Reload].
+type liveSettings struct {
+	// upstreams is the general set of upstreams, see [Config.UpstreamConfig].
+	// It's never nil.
+	upstreams *UpstreamConfig
+
+	// private is the set of upstreams for private reverse DNS lookups, see
+	// [Config.PrivateRDNSUpstreamConfig].
+	private *UpstreamConfig
+
+	// fallbacks is the set of fallback upstreams, see [Config.Fallbacks].
+	fallbacks *UpstreamConfig
+
+	// policies are the policies for the domain names, see
+	// [Config.DomainPolicies].  It's nil if there are none.
+	policies *domainPolicyTable
+
+	// clients are the policies for the clients, see [Config.ClientPolicies].
+	clients []*ClientPolicy
+
+	// clientCaches are the caches of clients by the names of their policies,
+	// see [Config.CachePerClient].  It's nil if the responses to all the
+	// clients are cached together.
+	clientCaches map[string]*cache
+
+	// cacheMinTTL is the minimum TTL of the responses, see
+	// [Config.CacheMinTTL].
+	cacheMinTTL uint32
+
+	// cacheMaxTTL is the maximum TTL of the responses, see
+	// [Config.CacheMaxTTL].
+	cacheMaxTTL uint32
+}
+
+// newLiveSettings returns the live settings from the corresponding fields of
+// c.
+func newLiveSettings(c *Config) (s *liveSettings) {
+	policies := newDomainPolicyTable(
+		c.DomainPolicies,
+		c.CacheProactiveExcludedZones,
+		c.CacheProactivePinnedZones,
+	)
+
+	return &liveSettings{
+		upstreams:   c.UpstreamConfig,
+		private:     c.PrivateRDNSUpstreamConfig,
+		fallbacks:   c.Fallbacks,
+		policies:    policies,
+		clients:     c.ClientPolicies,
+		cacheMinTTL: c.CacheMinTTL,
+		cacheMaxTTL: c.CacheMaxTTL,
+	}
+}
+
+// Reload applies the following fields of c to p without restarting it and
+// dropping the cache:
+//   - [Config.UpstreamConfig];
+//   - [Config.PrivateRDNSUpstreamConfig];
+//   - [Config.Fallbacks];
+//   - [Config.CacheMinTTL] and [Config.CacheMaxTTL];
+//   - [Config.CacheProactiveRefreshTime];
+//   - [Config.CacheProactiveCooldownPeriod];
+//   - [Config.CacheProactiveCooldownThreshold];
+//   - [Config.CacheProactiveAdaptive];
+//   - [Config.CacheProactivePinnedZones];
+//   - [Config.CacheProactiveExcludedZones];
+//   - [Config.DomainPolicies];
+//   - [Config.ClientPolicies].
+//
+// The rest of the fields are ignored, and the embedded [Config] of p isn't
+// changed.  c is validated with [Config.Validate] and p is left unchanged if
+// it's invalid, which is the only case of returning an error.  The previous
+// upstreams not used by c are closed, so that the requests being resolved with
+// them may fail.  The already scheduled proactive
+// refreshes aren't rescheduled, but the ones of the domain names excluded by c
+// are dropped once due.  c must not be nil.
+func (p *Proxy) Reload(ctx context.Context, c *Config) (err error) {
+	err = c.Validate()
+	if err != nil {
+		return fmt.Errorf("validating config: %w", err)
+	}
+
+	for _, w := range c.Warnings() {
+		p.logger.WarnContext(ctx, "suspicious configuration", slogutil.KeyError, w)
+	}
+
+	// Don't let the previous upstreams be closed twice by the concurrent
+	// [Proxy.Shutdown].
+	p.Lock()
+	defer p.Unlock()
+
+	next := newLiveSettings(c)
+	p.initClientCaches(c, next, p.live.Load())
+	prev := p.live.Swap(next)
+
+	if p.cache != nil {
+		p.cache.setSettings(c.newCacheConfig())
+	}
+
+	p.logger.InfoContext(ctx, "reloaded configuration")
+
+	err = closeUnused(prev.configs(), next.configs())
+	if err != nil {
+		// Don't return the error, since c is applied anyway.
+		p.logger.WarnContext(ctx, "closing previous upstreams", slogutil.KeyError, err)
+	}
+
+	return nil
+}
+
+// configs returns the non-nil upstream configurations of s.
+func (s *liveSettings) configs() (confs []*UpstreamConfig) {
+	all := append([]*UpstreamConfig{s.upstreams, s.private, s.fallbacks}, s.policies.upstreamConfigs()...)
+	all = append(all, clientPolicyConfigs(s.clients)...)
+	for _, u := range all {
+		if u != nil && !slices.Contains(confs, u) {
+			confs = append(confs, u)
+		}
+	}
+
+	return confs
+}
+
+// closeUnused closes the upstream configurations from prev missing in next.
+func closeUnused(prev, next []*UpstreamConfig) (err error) {
+	var errs []error
+	for _, u := range prev {
+		if !slices.Contains(next, u) {
+			errs = closeAll(errs, u)
+		}
+	}
+
+	return errors.Join(errs...)
+}
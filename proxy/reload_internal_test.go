@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReloadTestUpstream returns a new upstream answering with ip and counting
+// the exchanges and closes.
+func newReloadTestUpstream(
+	t *testing.T,
+	ip net.IP,
+) (u *dnsproxytest.Upstream, exchanges, closes *atomic.Int32) {
+	t.Helper()
+
+	exchanges, closes = &atomic.Int32{}, &atomic.Int32{}
+
+	return &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, req.Question[0].Name, dns.TypeA, defaultTestTTL, ip)}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return ip.String() },
+		OnClose: func() (err error) {
+			closes.Add(1)
+
+			return nil
+		},
+	}, exchanges, closes
+}
+
+func TestProxy_Reload(t *testing.T) {
+	const newMinTTL = 3600
+
+	prevUps, prevExchanges, prevCloses := newReloadTestUpstream(t, net.IP{192, 0, 2, 1})
+	nextUps, nextExchanges, nextCloses := newReloadTestUpstream(t, net.IP{192, 0, 2, 2})
+
+	conf := &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{prevUps}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+	}
+
+	p := mustNew(t, conf)
+
+	// Make sure the reloaded upstreams are closed on shutdown, which is
+	// performed by the cleanup registered later.
+	t.Cleanup(func() { assert.Equal(t, int32(1), nextCloses.Load()) })
+	servicetest.RequireRun(t, p, testTimeout)
+
+	cliAddr := netip.MustParseAddrPort("192.0.2.3:53")
+	resolve := func(t *testing.T, name string) (resp *dns.Msg) {
+		t.Helper()
+
+		d := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion(name, dns.TypeA), cliAddr)
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+
+		return d.Res
+	}
+
+	resolve(t, "cached.example.")
+	require.Equal(t, int32(1), prevExchanges.Load())
+
+	t.Run("invalid", func(t *testing.T) {
+		invalid := *conf
+		invalid.UpstreamConfig = nil
+
+		err := p.Reload(testutil.ContextWithTimeout(t, testTimeout), &invalid)
+		require.Error(t, err)
+
+		resolve(t, "invalid.example.")
+		assert.Equal(t, int32(2), prevExchanges.Load())
+		assert.Zero(t, prevCloses.Load())
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		next := *conf
+		next.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{nextUps}}
+		next.CacheMinTTL = newMinTTL
+
+		err := p.Reload(testutil.ContextWithTimeout(t, testTimeout), &next)
+		require.NoError(t, err)
+
+		assert.Equal(t, int32(1), prevCloses.Load())
+
+		// The cache is kept.
+		resolve(t, "cached.example.")
+		assert.Zero(t, nextExchanges.Load())
+
+		resp := resolve(t, "next.example.")
+		assert.Equal(t, int32(1), nextExchanges.Load())
+
+		a := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0])
+		assert.Equal(t, net.IP{192, 0, 2, 2}, a.A.To4())
+		assert.Equal(t, uint32(newMinTTL), a.Hdr.Ttl)
+	})
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	// requestStatsShards is the number of shards of [requestStatsStore].
+	requestStatsShards = 16
+
+	// defaultRequestStatsMaxEntries is the default maximum number of the
+	// request statistics entries kept by [requestStatsStore].
+	defaultRequestStatsMaxEntries = 100_000
+
+	// maxRequestStatsGCInterval is the maximum interval between the sweeps of
+	// the expired request statistics.
+	maxRequestStatsGCInterval = time.Minute
+)
+
+// requestStatsStore is the sharded storage of the request statistics of the
+// cache entries.  Each shard is bounded and evicts the least recently used
+// entries.  The expired entries are also removed in the background, see
+// [requestStatsStore.startGC].
+type requestStatsStore struct {
+	// seed is used to choose the shard for a key.
+	seed maphash.Seed
+
+	// shards are the independently locked parts of the storage.
+	shards [requestStatsShards]*requestStatsShard
+
+	// gcMu protects gcTimer.
+	gcMu *sync.Mutex
+
+	// gcTimer is the timer of the next sweep.  It's nil if the background
+	// sweeping is stopped.
+	gcTimer *time.Timer
+}
+
+// requestStatsShard is a single bounded LRU part of [requestStatsStore].
+type requestStatsShard struct {
+	// mu protects items and lru.
+	mu *sync.Mutex
+
+	// items maps the keys to the elements of lru.
+	items map[string]*list.Element
+
+	// lru contains the *requestStatsEntry values ordered from the most
+	// recently used to the least recently used.
+	lru *list.List
+
+	// maxEntries is the maximum number of entries in the shard.
+	maxEntries int
+}
+
+// requestStatsEntry is an element of [requestStatsShard.lru].
+type requestStatsEntry struct {
+	stat *requestStat
+	key  string
+}
+
+// newRequestStatsStore returns a new properly initialized *requestStatsStore
+// keeping up to maxEntries entries.  If maxEntries is not positive,
+// [defaultRequestStatsMaxEntries] is used.
+func newRequestStatsStore(maxEntries int) (s *requestStatsStore) {
+	if maxEntries <= 0 {
+		maxEntries = defaultRequestStatsMaxEntries
+	}
+
+	s = &requestStatsStore{
+		seed: maphash.MakeSeed(),
+		gcMu: &sync.Mutex{},
+	}
+
+	perShard := max(1, (maxEntries+requestStatsShards-1)/requestStatsShards)
+	for i := range s.shards {
+		s.shards[i] = &requestStatsShard{
+			mu:         &sync.Mutex{},
+			items:      map[string]*list.Element{},
+			lru:        list.New(),
+			maxEntries: perShard,
+		}
+	}
+
+	return s
+}
+
+// shard returns the shard for key.
+func (s *requestStatsStore) shard(key string) (sh *requestStatsShard) {
+	return s.shards[maphash.String(s.seed, key)%requestStatsShards]
+}
+
+// load returns the statistics for key, if any, and marks it as recently used.
+func (s *requestStatsStore) load(key string) (stat *requestStat, ok bool) {
+	sh := s.shard(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	el, ok := sh.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	sh.lru.MoveToFront(el)
+
+	return el.Value.(*requestStatsEntry).stat, true
+}
+
+// loadOrStore returns the statistics for key, storing the one created by
+// newStat if there is none.
+func (s *requestStatsStore) loadOrStore(
+	key string,
+	newStat func() (stat *requestStat),
+) (stat *requestStat) {
+	sh := s.shard(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if el, ok := sh.items[key]; ok {
+		sh.lru.MoveToFront(el)
+
+		return el.Value.(*requestStatsEntry).stat
+	}
+
+	stat = newStat()
+	sh.storeLocked(key, stat)
+
+	return stat
+}
+
+// store sets the statistics for key.
+func (s *requestStatsStore) store(key string, stat *requestStat) {
+	sh := s.shard(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if el, ok := sh.items[key]; ok {
+		el.Value.(*requestStatsEntry).stat = stat
+		sh.lru.MoveToFront(el)
+
+		return
+	}
+
+	sh.storeLocked(key, stat)
+}
+
+// storeLocked adds the new entry to sh evicting the least recently used one if
+// necessary.  sh.mu must be locked.
+func (sh *requestStatsShard) storeLocked(key string, stat *requestStat) {
+	sh.items[key] = sh.lru.PushFront(&requestStatsEntry{
+		stat: stat,
+		key:  key,
+	})
+
+	for sh.lru.Len() > sh.maxEntries {
+		oldest := sh.lru.Back()
+		sh.lru.Remove(oldest)
+		delete(sh.items, oldest.Value.(*requestStatsEntry).key)
+	}
+}
+
+// rangeStats calls f for each entry until it returns false.  The order is
+// unspecified.  f must not use s.
+func (s *requestStatsStore) rangeStats(f func(key string, stat *requestStat) (cont bool)) {
+	for _, sh := range s.shards {
+		if !sh.rangeStats(f) {
+			return
+		}
+	}
+}
+
+// rangeStats calls f for each entry of sh until it returns false.
+func (sh *requestStatsShard) rangeStats(f func(key string, stat *requestStat) (cont bool)) (cont bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for el := sh.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*requestStatsEntry)
+		if !f(e.key, e.stat) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestStatsEntryOverhead is the approximate number of bytes used by each
+// entry of [requestStatsStore] in addition to its key and timestamps: the
+// entry, the statistics, the list element, and the map slot.
+const requestStatsEntryOverhead = unsafe.Sizeof(requestStatsEntry{}) +
+	unsafe.Sizeof(requestStat{}) +
+	unsafe.Sizeof(list.Element{}) +
+	unsafe.Sizeof("") + unsafe.Sizeof(&list.Element{}) + 1
+
+// memoryUsage returns the approximate number of bytes used by the entries of
+// s.
+func (s *requestStatsStore) memoryUsage() (n uint64) {
+	const timestampSize = uint64(unsafe.Sizeof(time.Time{}))
+
+	s.rangeStats(func(key string, stat *requestStat) (cont bool) {
+		stat.mu.Lock()
+		tsNum := uint64(cap(stat.timestamps))
+		stat.mu.Unlock()
+
+		n += uint64(len(key)) + tsNum*timestampSize + uint64(requestStatsEntryOverhead)
+
+		return true
+	})
+
+	return n
+}
+
+// len returns the total number of entries.
+func (s *requestStatsStore) len() (n int) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		n += sh.lru.Len()
+		sh.mu.Unlock()
+	}
+
+	return n
+}
+
+// clear removes all the entries.
+func (s *requestStatsStore) clear() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		clear(sh.items)
+		sh.lru.Init()
+		sh.mu.Unlock()
+	}
+}
+
+// sweep removes the entries without any requests since cutoff.
+func (s *requestStatsStore) sweep(cutoff time.Time) {
+	for _, sh := range s.shards {
+		sh.sweep(cutoff)
+	}
+}
+
+// sweep removes the entries of sh without any requests since cutoff.
+func (sh *requestStatsShard) sweep(cutoff time.Time) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for el := sh.lru.Front(); el != nil; {
+		next := el.Next()
+
+		e := el.Value.(*requestStatsEntry)
+		if e.stat.isExpired(cutoff) {
+			sh.lru.Remove(el)
+			delete(sh.items, e.key)
+		}
+
+		el = next
+	}
+}
+
+// isExpired returns true if stat has no requests since cutoff.
+func (stat *requestStat) isExpired(cutoff time.Time) (ok bool) {
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+
+	n := len(stat.timestamps)
+
+	return n == 0 || !stat.timestamps[n-1].After(cutoff)
+}
+
+// startGC starts removing the entries without requests within period in the
+// background.  It does nothing if it's already started.
+func (s *requestStatsStore) startGC(period time.Duration) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	if s.gcTimer != nil || period <= 0 {
+		return
+	}
+
+	interval := min(period, maxRequestStatsGCInterval)
+
+	var gc func()
+	gc = func() {
+		s.sweep(time.Now().Add(-period))
+
+		s.gcMu.Lock()
+		defer s.gcMu.Unlock()
+
+		if s.gcTimer != nil {
+			s.gcTimer.Reset(interval)
+		}
+	}
+
+	s.gcTimer = time.AfterFunc(interval, gc)
+}
+
+// stopGC stops removing the expired entries in the background.  It's safe to
+// call it multiple times.
+func (s *requestStatsStore) stopGC() {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	if s.gcTimer != nil {
+		s.gcTimer.Stop()
+		s.gcTimer = nil
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRequestStat returns a new *requestStat with a single request at ts.
+func newTestRequestStat(ts time.Time) (stat *requestStat) {
+	return &requestStat{
+		timestamps: []time.Time{ts},
+	}
+}
+
+func TestRequestStatsStore_bounded(t *testing.T) {
+	// Keep two entries per shard.
+	const maxEntries = 2 * requestStatsShards
+
+	s := newRequestStatsStore(maxEntries)
+	now := time.Now()
+
+	for i := range 10 * maxEntries {
+		s.store(fmt.Sprintf("key%d", i), newTestRequestStat(now))
+	}
+
+	assert.Equal(t, maxEntries, s.len())
+
+	// Find two more keys within the shard of the hot one.
+	const hotKey = "hot"
+	sh := s.shard(hotKey)
+
+	var sameShard []string
+	for i := 0; len(sameShard) < 2; i++ {
+		if k := fmt.Sprintf("other%d", i); s.shard(k) == sh {
+			sameShard = append(sameShard, k)
+		}
+	}
+
+	s.store(hotKey, newTestRequestStat(now))
+	s.store(sameShard[0], newTestRequestStat(now))
+
+	// Use the hot key, so that the other one is evicted first.
+	_, ok := s.load(hotKey)
+	require.True(t, ok)
+
+	s.store(sameShard[1], newTestRequestStat(now))
+
+	_, ok = s.load(hotKey)
+	assert.True(t, ok)
+
+	_, ok = s.load(sameShard[0])
+	assert.False(t, ok)
+}
+
+func TestRequestStatsStore_sweep(t *testing.T) {
+	s := newRequestStatsStore(0)
+	now := time.Now()
+
+	s.store("fresh", newTestRequestStat(now))
+	s.store("stale", newTestRequestStat(now.Add(-time.Hour)))
+	s.store("empty", &requestStat{})
+
+	s.sweep(now.Add(-time.Minute))
+
+	_, ok := s.load("fresh")
+	assert.True(t, ok)
+
+	_, ok = s.load("stale")
+	assert.False(t, ok)
+
+	_, ok = s.load("empty")
+	assert.False(t, ok)
+}
+
+func TestRequestStatsStore_gc(t *testing.T) {
+	const period = 10 * time.Millisecond
+
+	s := newRequestStatsStore(0)
+	s.startGC(period)
+
+	// Starting twice must not schedule another sweep.
+	s.startGC(period)
+	t.Cleanup(s.stopGC)
+
+	s.store("stale", newTestRequestStat(time.Now().Add(-time.Hour)))
+
+	assert.Eventually(t, func() (ok bool) {
+		return s.len() == 0
+	}, testTimeout, period)
+
+	// Stopping twice must not panic.
+	s.stopGC()
+	s.stopGC()
+}
+
+func TestCache_recordRequest_bounded(t *testing.T) {
+	const threshold = 3
+
+	c := newCache(&cacheConfig{
+		size:              testCacheSize,
+		cooldownPeriod:    time.Hour,
+		cooldownThreshold: threshold,
+	})
+
+	key := msgToKey((&dns.Msg{}).SetQuestion("example.com.", dns.TypeA))
+	for range 10 * threshold {
+		c.recordRequest(key, false)
+	}
+
+	stat, ok := c.requestStats.load(string(key))
+	require.True(t, ok)
+
+	assert.Len(t, stat.timestamps, threshold)
+	assert.True(t, c.shouldProactiveRefresh(key))
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import "github.com/miekg/dns"
+
+// ResponseSource describes how the proxy has obtained the response.
+type ResponseSource string
+
+// Valid ResponseSource values.
+const (
+	// ResponseSourceUpstream means that the response has been received from
+	// the upstream for this request.
+	ResponseSourceUpstream ResponseSource = "upstream"
+
+	// ResponseSourceCache means that the response has been served from the
+	// cache and is still fresh.
+	ResponseSourceCache ResponseSource = "cache"
+
+	// ResponseSourceOptimistic means that the expired response has been served
+	// from the cache and is being refreshed.
+	ResponseSourceOptimistic ResponseSource = "optimistic"
+
+	// ResponseSourceProactive means that the response has been served from the
+	// cache and has been stored there by the proactive refresh.
+	ResponseSourceProactive ResponseSource = "proactive"
+
+	// ResponseSourceStale means that the expired response has been served
+	// from the cache since resolving the request has failed, see
+	// [Config.CacheStaleIfErrorMaxAge].
+	ResponseSourceStale ResponseSource = "stale"
+)
+
+// EDNSCodeResponseSource is the code of the EDNS0 option from the local and
+// experimental use range, which data is the [ResponseSource] of the response,
+// see [Config.AnnotateResponseSource].
+const EDNSCodeResponseSource uint16 = 65001
+
+// setSource sets the source of the response in d, if the annotation is
+// enabled.
+func (p *Proxy) setSource(d *DNSContext, src ResponseSource) {
+	if p.AnnotateResponseSource {
+		d.source = src
+	}
+}
+
+// newSourceOption returns the EDNS0 option containing src.
+func newSourceOption(src ResponseSource) (opt *dns.EDNS0_LOCAL) {
+	return &dns.EDNS0_LOCAL{
+		Code: EDNSCodeResponseSource,
+		Data: []byte(src),
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// responseSource returns the source annotated in resp, if any.
+func responseSource(tb testing.TB, resp *dns.Msg) (src ResponseSource) {
+	tb.Helper()
+
+	o := resp.IsEdns0()
+	require.NotNil(tb, o)
+
+	for _, opt := range o.Option {
+		if local, ok := opt.(*dns.EDNS0_LOCAL); ok && local.Code == EDNSCodeResponseSource {
+			return ResponseSource(local.Data)
+		}
+	}
+
+	return ""
+}
+
+func TestProxy_Resolve_responseSource(t *testing.T) {
+	const host = "example.org."
+
+	u := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         defaultCacheSize,
+		AnnotateResponseSource: true,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T) (src ResponseSource) {
+		t.Helper()
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		req.SetEdns0(defaultUDPBufSize, false)
+
+		d := p.newDNSContext(ProtoUDP, req, netip.MustParseAddrPort("1.2.3.4:53"))
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.NotNil(t, d.Res)
+
+		return responseSource(t, d.Res)
+	}
+
+	assert.Equal(t, ResponseSourceUpstream, resolve(t))
+	assert.Equal(t, ResponseSourceCache, resolve(t))
+
+	key := msgToKey((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+	p.cache.prefetched.Store(string(key), struct{}{})
+
+	assert.Equal(t, ResponseSourceProactive, resolve(t))
+}
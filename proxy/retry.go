@@ -30,7 +30,7 @@ func (p *Proxy) bindWithRetry(ctx context.Context, bindFunc func() (err error))
 		return nil
 	}
 
-	p.logger.WarnContext(ctx, "binding", "attempt", 1, slogutil.KeyError, err)
+	p.serverLogger.WarnContext(ctx, "binding", "attempt", 1, slogutil.KeyError, err)
 
 	for attempt := uint(1); attempt <= p.bindRetryCount; attempt++ {
 		time.Sleep(p.bindRetryIvl)
@@ -40,7 +40,7 @@ func (p *Proxy) bindWithRetry(ctx context.Context, bindFunc func() (err error))
 			return nil
 		}
 
-		p.logger.WarnContext(ctx, "binding", "attempt", attempt+1, slogutil.KeyError, retryErr)
+		p.serverLogger.WarnContext(ctx, "binding", "attempt", attempt+1, slogutil.KeyError, retryErr)
 	}
 
 	return err
@@ -80,6 +80,7 @@ func TestWithRetry(t *testing.T) {
 		bindRetryCount: 1,
 		bindRetryIvl:   0,
 	}
+	p.initLoggers()
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
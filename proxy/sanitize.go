@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/miekg/dns"
+)
+
+// sanitizeResponse removes the records not related to the question of req from
+// resp, see [Config.SanitizeResponses].  The records of the answer section are
+// kept if their owner names are the name of the question or the ones it's
+// redirected to by the CNAME and DNAME records.  The records of the authority
+// section are kept if they're in the bailiwick of those names, and the
+// additional addresses are kept if they're referred to by the kept records.
+// The signatures are only kept along with the records they cover.  It returns
+// the number of the removed records.  req must have a single question,
+// resp must not be nil.
+func sanitizeResponse(req, resp *dns.Msg) (removed int) {
+	q := req.Question[0]
+	names := chainNames(q.Name, resp.Answer)
+
+	resp.Answer, removed = filterRRs(resp.Answer, func(rr dns.RR) (ok bool) {
+		return isSolicitedAnswer(rr, q.Qtype, names)
+	})
+
+	zones := responseZones(names, resp.Answer, resp.Ns)
+
+	var n int
+	resp.Ns, n = filterRRs(resp.Ns, func(rr dns.RR) (ok bool) {
+		return isInBailiwick(rr, names, zones)
+	})
+	removed += n
+
+	targets := referredNames(names, resp.Answer, resp.Ns)
+	resp.Extra, n = filterRRs(resp.Extra, func(rr dns.RR) (ok bool) {
+		return isReferredAdditional(rr, targets)
+	})
+
+	return removed + n
+}
+
+// chainNames returns the set of the canonical name qname and the names it's
+// redirected to by the CNAME and DNAME records of answer.
+func chainNames(qname string, answer []dns.RR) (names *container.MapSet[string]) {
+	names = container.NewMapSet(dns.CanonicalName(qname))
+
+	// Follow the records regardless of their order, since it's not mandated.
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range answer {
+			for _, target := range redirectTargets(rr, names) {
+				if !names.Has(target) {
+					names.Add(target)
+					grown = true
+				}
+			}
+		}
+	}
+
+	return names
+}
+
+// redirectTargets returns the canonical names the names from names are
+// redirected to by rr, if it's a CNAME or DNAME record.
+func redirectTargets(rr dns.RR, names *container.MapSet[string]) (targets []string) {
+	owner := dns.CanonicalName(rr.Header().Name)
+
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		if names.Has(owner) {
+			return []string{dns.CanonicalName(rr.Target)}
+		}
+	case *dns.DNAME:
+		for name := range names.Range {
+			if name != owner && dns.IsSubDomain(owner, name) {
+				prefix := name[:len(name)-len(owner)]
+				targets = append(targets, dns.CanonicalName(prefix+rr.Target))
+			}
+		}
+	}
+
+	return targets
+}
+
+// isSolicitedAnswer returns true if rr answers the question with qtype for any
+// of names.
+func isSolicitedAnswer(rr dns.RR, qtype uint16, names *container.MapSet[string]) (ok bool) {
+	hdr := rr.Header()
+	owner := dns.CanonicalName(hdr.Name)
+
+	switch hdr.Rrtype {
+	case dns.TypeDNAME:
+		return len(redirectTargets(rr, names)) > 0
+	case dns.TypeCNAME:
+		return names.Has(owner)
+	default:
+		return names.Has(owner) && (hdr.Rrtype == qtype || qtype == dns.TypeANY)
+	}
+}
+
+// responseZones returns the canonical names of the zones the response with the
+// answer and authority sections belongs to, which are the signers of answer and
+// the owners of the SOA, NS, and DS records of authority in the bailiwick of
+// names.
+func responseZones(names *container.MapSet[string], answer, authority []dns.RR) (zones *container.MapSet[string]) {
+	zones = container.NewMapSet[string]()
+	for _, rr := range answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			zones.Add(dns.CanonicalName(sig.SignerName))
+		}
+	}
+
+	for _, rr := range authority {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS, dns.TypeDS:
+			if owner := dns.CanonicalName(rr.Header().Name); isAncestorOfAny(owner, names) {
+				zones.Add(owner)
+			}
+		}
+	}
+
+	return zones
+}
+
+// isInBailiwick returns true if rr from the authority section belongs to the
+// zones of names, see [responseZones].
+func isInBailiwick(rr dns.RR, names, zones *container.MapSet[string]) (ok bool) {
+	hdr := rr.Header()
+	owner := dns.CanonicalName(hdr.Name)
+
+	switch hdr.Rrtype {
+	case dns.TypeSOA, dns.TypeNS, dns.TypeDS:
+		return isAncestorOfAny(owner, names)
+	case dns.TypeNSEC, dns.TypeNSEC3:
+		// The signers of the answer are among the zones, so that the proofs of
+		// the wildcard expansion are kept as well.
+		return isSubdomainOfAny(owner, zones)
+	default:
+		return false
+	}
+}
+
+// isAncestorOfAny returns true if owner is equal to or an ancestor of any of
+// names.
+func isAncestorOfAny(owner string, names *container.MapSet[string]) (ok bool) {
+	for name := range names.Range {
+		if dns.IsSubDomain(owner, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSubdomainOfAny returns true if owner is equal to or a subdomain of any of
+// zones.
+func isSubdomainOfAny(owner string, zones *container.MapSet[string]) (ok bool) {
+	for zone := range zones.Range {
+		if dns.IsSubDomain(zone, owner) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// referredNames returns the canonical names the addresses of which may be in
+// the additional section, which are names themselves and the targets of the NS,
+// MX, SRV, SVCB, and HTTPS records from sections.
+func referredNames(names *container.MapSet[string], sections ...[]dns.RR) (targets *container.MapSet[string]) {
+	targets = names.Clone()
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			var target string
+			switch rr := rr.(type) {
+			case *dns.NS:
+				target = rr.Ns
+			case *dns.MX:
+				target = rr.Mx
+			case *dns.SRV:
+				target = rr.Target
+			default:
+				svcb, ok := svcbOf(rr)
+				if !ok {
+					continue
+				}
+
+				target = svcb.Target
+				if target == "." {
+					target = svcb.Hdr.Name
+				}
+			}
+
+			targets.Add(dns.CanonicalName(target))
+		}
+	}
+
+	return targets
+}
+
+// isReferredAdditional returns true if rr from the additional section should be
+// kept, i.e. it's an address of any of targets or a pseudo-record.
+func isReferredAdditional(rr dns.RR, targets *container.MapSet[string]) (ok bool) {
+	hdr := rr.Header()
+
+	switch hdr.Rrtype {
+	case dns.TypeOPT, dns.TypeTSIG:
+		return true
+	case dns.TypeA, dns.TypeAAAA:
+		return targets.Has(dns.CanonicalName(hdr.Name))
+	default:
+		return false
+	}
+}
+
+// rrsetKey is the key of a resource record set within a section.
+type rrsetKey struct {
+	// name is the canonical owner name.
+	name string
+
+	// rrtype is the type of the records.
+	rrtype uint16
+}
+
+// filterRRs removes the records for which keep returns false from rrs and
+// returns the number of the removed ones.  The RRSIG records are kept if the
+// records they cover are, keep isn't called for them.
+func filterRRs(rrs []dns.RR, keep func(rr dns.RR) (ok bool)) (filtered []dns.RR, removed int) {
+	kept := container.NewMapSet[rrsetKey]()
+	for _, rr := range rrs {
+		if hdr := rr.Header(); hdr.Rrtype != dns.TypeRRSIG && keep(rr) {
+			kept.Add(rrsetKey{name: dns.CanonicalName(hdr.Name), rrtype: hdr.Rrtype})
+		}
+	}
+
+	l := len(rrs)
+	filtered = slices.DeleteFunc(rrs, func(rr dns.RR) (del bool) {
+		k := rrsetKey{name: dns.CanonicalName(rr.Header().Name), rrtype: rr.Header().Rrtype}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k.rrtype = sig.TypeCovered
+		}
+
+		return !kept.Has(k)
+	})
+
+	return filtered, l - len(filtered)
+}
+
+// sanitize removes the records unrelated to the question of req from resp, if
+// configured.  resp may be nil.
+func (p *Proxy) sanitize(ctx context.Context, d *DNSContext, req, resp *dns.Msg) {
+	if !p.SanitizeResponses || resp == nil || len(req.Question) != 1 {
+		return
+	}
+
+	n := sanitizeResponse(req, resp)
+	if n == 0 {
+		return
+	}
+
+	d.addTracef(StageResponse, "sanitized: %d records removed", n)
+	p.logger.DebugContext(
+		ctx,
+		"removed unrelated records",
+		"domain", req.Question[0].Name,
+		"count", n,
+	)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeResponse(t *testing.T) {
+	const (
+		name    = "www.example.org."
+		cdnName = "edge.cdn.example."
+	)
+
+	ip := net.IP{192, 0, 2, 1}
+
+	ans := newRR(t, name, dns.TypeA, defaultTestTTL, ip)
+	cname := newRR(t, name, dns.TypeCNAME, defaultTestTTL, cdnName)
+	cdnAns := newRR(t, cdnName, dns.TypeA, defaultTestTTL, ip)
+	unsolicited := newRR(t, "bank.example.", dns.TypeA, defaultTestTTL, ip)
+	wrongType := newRR(t, name, dns.TypeAAAA, defaultTestTTL, net.ParseIP("2001:db8::1"))
+
+	soa := newRR(t, "example.org.", dns.TypeSOA, defaultTestTTL, nil)
+	foreignSOA := newRR(t, "example.net.", dns.TypeSOA, defaultTestTTL, nil)
+
+	ns := &dns.NS{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET},
+		Ns:  "ns1.example.org.",
+	}
+	foreignNS := &dns.NS{
+		Hdr: dns.RR_Header{Name: "bank.example.", Rrtype: dns.TypeNS, Class: dns.ClassINET},
+		Ns:  "ns.attacker.example.",
+	}
+
+	glue := newRR(t, "ns1.example.org.", dns.TypeA, defaultTestTTL, ip)
+	foreignGlue := newRR(t, "ns.attacker.example.", dns.TypeA, defaultTestTTL, ip)
+
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+		TypeCovered: dns.TypeA,
+		SignerName:  "example.org.",
+	}
+	foreignSig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "bank.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+		TypeCovered: dns.TypeA,
+		SignerName:  "example.",
+	}
+
+	dname := &dns.DNAME{
+		Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET},
+		Target: "example.net.",
+	}
+	dnameAns := newRR(t, "www.example.net.", dns.TypeA, defaultTestTTL, ip)
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+
+	testCases := []struct {
+		ans         []dns.RR
+		ns          []dns.RR
+		extra       []dns.RR
+		wantAns     []dns.RR
+		wantNs      []dns.RR
+		wantExtra   []dns.RR
+		name        string
+		wantRemoved int
+	}{{
+		ans:         []dns.RR{ans, sig},
+		ns:          []dns.RR{ns},
+		extra:       []dns.RR{glue, opt},
+		wantAns:     []dns.RR{ans, sig},
+		wantNs:      []dns.RR{ns},
+		wantExtra:   []dns.RR{glue, opt},
+		name:        "clean",
+		wantRemoved: 0,
+	}, {
+		ans:         []dns.RR{ans, unsolicited, foreignSig, wrongType},
+		ns:          nil,
+		extra:       nil,
+		wantAns:     []dns.RR{ans},
+		wantNs:      nil,
+		wantExtra:   nil,
+		name:        "unsolicited_answer",
+		wantRemoved: 3,
+	}, {
+		ans:         []dns.RR{cdnAns, cname},
+		ns:          nil,
+		extra:       nil,
+		wantAns:     []dns.RR{cdnAns, cname},
+		wantNs:      nil,
+		wantExtra:   nil,
+		name:        "cname_chain",
+		wantRemoved: 0,
+	}, {
+		ans:         []dns.RR{dname, dnameAns},
+		ns:          nil,
+		extra:       nil,
+		wantAns:     []dns.RR{dname, dnameAns},
+		wantNs:      nil,
+		wantExtra:   nil,
+		name:        "dname",
+		wantRemoved: 0,
+	}, {
+		ans:         nil,
+		ns:          []dns.RR{soa, foreignSOA, foreignNS},
+		extra:       []dns.RR{foreignGlue, opt},
+		wantAns:     nil,
+		wantNs:      []dns.RR{soa},
+		wantExtra:   []dns.RR{opt},
+		name:        "out_of_bailiwick",
+		wantRemoved: 3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = append([]dns.RR(nil), tc.ans...)
+			resp.Ns = append([]dns.RR(nil), tc.ns...)
+			resp.Extra = append([]dns.RR(nil), tc.extra...)
+
+			assert.Equal(t, tc.wantRemoved, sanitizeResponse(req, resp))
+			assert.Equal(t, tc.wantAns, nilIfEmpty(resp.Answer))
+			assert.Equal(t, tc.wantNs, nilIfEmpty(resp.Ns))
+			assert.Equal(t, tc.wantExtra, nilIfEmpty(resp.Extra))
+		})
+	}
+}
+
+// nilIfEmpty returns nil if rrs is empty and rrs otherwise.
+func nilIfEmpty(rrs []dns.RR) (res []dns.RR) {
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	return rrs
+}
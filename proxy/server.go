@@ -45,6 +45,11 @@ func (p *Proxy) startListeners(ctx context.Context) (err error) {
 		return err
 	}
 
+	err = p.initListeners(ctx)
+	if err != nil {
+		return err
+	}
+
 	err = p.initDNSCryptListeners(ctx)
 	if err != nil {
 		return err
@@ -59,6 +64,10 @@ func (p *Proxy) serveListeners() {
 		go p.udpPacketLoop(l, p.requestsSema)
 	}
 
+	for _, l := range p.udpReusePortListen {
+		go p.udpPacketLoop(l, p.requestsSema)
+	}
+
 	for _, l := range p.tcpListen {
 		go p.tcpPacketLoop(l, ProtoTCP, p.requestsSema)
 	}
@@ -67,12 +76,16 @@ func (p *Proxy) serveListeners() {
 		go p.tcpPacketLoop(l, ProtoTLS, p.requestsSema)
 	}
 
+	// Don't refer to the fields from the goroutines, since they are reset on
+	// shutdown, which may happen before the goroutines start.
+	httpsSrv, h3Srv := p.httpsServer, p.h3Server
+
 	for _, l := range p.httpsListen {
-		go func(l net.Listener) { _ = p.httpsServer.Serve(l) }(l)
+		go func(l net.Listener) { _ = httpsSrv.Serve(l) }(l)
 	}
 
 	for _, l := range p.h3Listen {
-		go func(l *quic.EarlyListener) { _ = p.h3Server.ServeListener(l) }(l)
+		go func(l *quic.EarlyListener) { _ = h3Srv.ServeListener(l) }(l)
 	}
 
 	for _, l := range p.quicListen {
@@ -91,12 +104,13 @@ func (p *Proxy) serveListeners() {
 // handleDNSRequest processes the context.  The only error it returns is the one
 // from the [RequestHandler], or [Resolve] if the [RequestHandler] is not set.
 // d is left without a response as the documentation to [BeforeRequestHandler]
-// says, and if it's ratelimited.
-func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
+// says, and if it's ratelimited.  ctx is passed to the request handler.
+func (p *Proxy) handleDNSRequest(ctx context.Context, d *DNSContext) (err error) {
+	start := p.time.Now()
 	p.logDNSMessage(d.Req)
 
 	if d.Req.Response {
-		p.logger.Debug("dropping incoming response packet", "addr", d.Addr)
+		p.serverLogger.Debug("dropping incoming response packet", "addr", d.Addr)
 
 		return nil
 	}
@@ -113,24 +127,47 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 	// TODO(e.burkov):  Investigate if written above true and move to UDP server
 	// implementation?
 	if d.Proto == ProtoUDP && p.isRatelimited(ip) {
-		p.logger.Debug("ratelimited based on ip only", "addr", d.Addr)
+		p.serverLogger.Debug("ratelimited based on ip only", "addr", d.Addr, "policy", p.RatelimitPolicy)
+		d.addTracef(StageRatelimit, "ratelimited: policy %s", p.RatelimitPolicy)
+		p.anomalies.captureMsg(anomalyRatelimited, d.Addr, d.localIP, d.Req)
+
+		if p.RatelimitPolicy == RatelimitPolicyServFail {
+			d.Res = p.messages.NewMsgSERVFAIL(d.Req)
+			p.respond(d)
+		}
 
-		// Don't reply to ratelimited clients.
+		// Don't reply to ratelimited clients unless the policy says so.
 		return nil
+	} else if d.Proto == ProtoUDP && p.Ratelimit > 0 {
+		d.addTrace(StageRatelimit, "passed")
 	}
 
 	d.Res = p.validateRequest(d)
 	if d.Res == nil {
+		d.addTrace(StageValidation, "passed")
+		p.clearUnknownEDNSFlags(d.Req)
+		p.filterEDNSOptions(d.Req)
+
 		if p.RequestHandler != nil {
-			err = errors.Annotate(p.RequestHandler(p, d), "using request handler: %w")
+			d.addTrace(StageRequestHandler, "custom")
+			err = errors.Annotate(p.RequestHandler(ctx, p, d), "using request handler: %w")
 		} else {
-			err = errors.Annotate(p.Resolve(d), "using default request handler: %w")
+			d.addTrace(StageRequestHandler, "default")
+			err = errors.Annotate(p.Resolve(ctx, d), "using default request handler: %w")
 		}
 	}
 
+	p.orderAnswers(d)
+	p.filterEDNSOptions(d.Res)
+
 	p.logDNSMessage(d.Res)
 	p.respond(d)
 
+	if d.trace == nil {
+		p.clientStats.record(d, err)
+		p.mirror.record(d, start, p.time.Now())
+	}
+
 	return err
 }
 
@@ -139,26 +176,52 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 func (p *Proxy) validateRequest(d *DNSContext) (resp *dns.Msg) {
 	switch {
 	case len(d.Req.Question) != 1:
-		p.logger.Debug("invalid number of questions", "req_questions_len", len(d.Req.Question))
+		p.serverLogger.Debug("invalid number of questions", "req_questions_len", len(d.Req.Question))
+		d.addTrace(StageValidation, "invalid number of questions")
 
 		// TODO(e.burkov):  Probably, FORMERR would be a better choice here.
 		// Check out RFC.
 		return p.messages.NewMsgSERVFAIL(d.Req)
+	case p.isUnauthenticated(d):
+		p.serverLogger.Debug("client is not authenticated", "addr", d.Addr, "proto", d.Proto)
+		d.addTrace(StageValidation, "client not authenticated")
+
+		return (&dns.Msg{}).SetRcode(d.Req, dns.RcodeRefused)
 	case p.RefuseAny && d.Req.Question[0].Qtype == dns.TypeANY:
 		// Refuse requests of type ANY (anti-DDOS measure).
-		p.logger.Debug("refusing dns type any request")
+		p.serverLogger.Debug("refusing dns type any request")
+		d.addTrace(StageValidation, "refused type any")
 
 		return p.messages.NewMsgNOTIMPLEMENTED(d.Req)
+	case p.shouldAnswerANY(d):
+		// Answer requests of type ANY minimally (anti-amplification measure).
+		p.serverLogger.Debug("answering dns type any request with hinfo")
+		d.addTrace(StageValidation, "answered type any with hinfo")
+
+		return p.newMsgHINFO(d.Req)
+	case p.shouldTruncateANY(d):
+		// Make the client retry over TCP (anti-amplification measure).
+		p.serverLogger.Debug("truncating dns type any request")
+		d.addTrace(StageValidation, "truncated type any")
+
+		return p.newMsgTruncatedANY(d.Req)
+	case p.isBadEDNSVersion(d.Req):
+		p.serverLogger.Debug("unsupported edns version", "version", d.Req.IsEdns0().Version())
+		d.addTrace(StageValidation, "bad edns version")
+
+		return p.newMsgBADVERS(d.Req)
 	case p.recDetector.check(d.Req):
-		p.logger.Debug("recursion detected", "req_question", d.Req.Question[0].Name)
+		p.serverLogger.Debug("recursion detected", "req_question", d.Req.Question[0].Name)
+		d.addTrace(StageValidation, "recursion detected")
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
-	case d.isForbiddenARPA(p.privateNets, p.logger):
-		p.logger.Debug(
+	case d.isForbiddenARPA(p.privateNets, p.serverLogger):
+		p.serverLogger.Debug(
 			"private arpa domain is requested",
 			"addr", d.Addr,
 			"arpa", d.Req.Question[0].Name,
 		)
+		d.addTrace(StageValidation, "private arpa requested by public client")
 
 		return p.messages.NewMsgNXDOMAIN(d.Req)
 	default:
@@ -200,6 +263,11 @@ func (dctx *DNSContext) isForbiddenARPA(privateNets netutil.SubnetSet, l *slog.L
 
 // respond writes the specified response to the client (or does nothing if d.Res is empty)
 func (p *Proxy) respond(d *DNSContext) {
+	if d.trace != nil {
+		// The response is returned by [Proxy.Trace].
+		return
+	}
+
 	// d.Conn can be nil in the case of a DoH request.
 	if d.Conn != nil {
 		_ = d.Conn.SetWriteDeadline(time.Now().Add(defaultTimeout))
@@ -225,7 +293,7 @@ func (p *Proxy) respond(d *DNSContext) {
 	}
 
 	if err != nil {
-		logWithNonCrit(err, "responding request", d.Proto, p.logger)
+		logWithNonCrit(err, "responding request", d.Proto, p.serverLogger)
 	}
 }
 
@@ -243,10 +311,12 @@ func (p *Proxy) setMinMaxTTL(ctx context.Context, r *dns.Msg) {
 		Value: r.Ns,
 	}}
 
+	live := p.live.Load()
+	minTTL, maxTTL := live.policies.matchQuestion(r).ttlOverrides(live.cacheMinTTL, live.cacheMaxTTL)
 	for _, rrSet := range rrSets {
 		for _, rr := range rrSet.Value {
 			original := rr.Header().Ttl
-			overridden := respectTTLOverrides(original, p.CacheMinTTL, p.CacheMaxTTL)
+			overridden := respectTTLOverrides(original, minTTL, maxTTL)
 
 			if original == overridden {
 				continue
@@ -254,7 +324,7 @@ func (p *Proxy) setMinMaxTTL(ctx context.Context, r *dns.Msg) {
 
 			optslog.Trace3(
 				ctx,
-				p.logger,
+				p.serverLogger,
 				"ttl overwritten",
 				"section", rrSet.Key,
 				"old", original,
@@ -278,7 +348,7 @@ func (p *Proxy) logDNSMessage(m *dns.Msg) {
 		msg = "in"
 	}
 
-	slogutil.PrintLines(context.TODO(), p.logger, slog.LevelDebug, msg, m.String())
+	slogutil.PrintLines(context.TODO(), p.serverLogger, slog.LevelDebug, msg, m.String())
 }
 
 // logWithNonCrit logs the error on the appropriate level depending on whether
@@ -23,7 +23,7 @@ func (p *Proxy) initDNSCryptListeners(ctx context.Context) (err error) {
 		return errors.Error("invalid dnscrypt configuration: no certificate or provider name")
 	}
 
-	p.logger.InfoContext(ctx, "initializing dnscrypt", "provider", p.DNSCryptProviderName)
+	p.serverLogger.InfoContext(ctx, "initializing dnscrypt", "provider", p.DNSCryptProviderName)
 	p.dnsCryptServer = &dnscrypt.Server{
 		ProviderName: p.DNSCryptProviderName,
 		ResolverCert: p.DNSCryptResolverCert,
@@ -31,7 +31,7 @@ func (p *Proxy) initDNSCryptListeners(ctx context.Context) (err error) {
 			proxy:   p,
 			reqSema: p.requestsSema,
 		},
-		Logger: p.logger,
+		Logger: p.serverLogger,
 	}
 
 	for _, addr := range p.DNSCryptUDPListenAddr {
@@ -62,7 +62,7 @@ func (p *Proxy) listenDNSCryptUDP(
 	addr *net.UDPAddr,
 ) (conn *net.UDPConn, err error) {
 	addrStr := addr.String()
-	p.logger.InfoContext(ctx, "creating dnscrypt udp server socket", "addr", addrStr)
+	p.serverLogger.InfoContext(ctx, "creating dnscrypt udp server socket", "addr", addrStr)
 
 	err = p.bindWithRetry(ctx, func() (listenErr error) {
 		conn, listenErr = net.ListenUDP(bootstrap.NetworkUDP, addr)
@@ -73,7 +73,7 @@ func (p *Proxy) listenDNSCryptUDP(
 		return nil, fmt.Errorf("listening to udp socket: %w", err)
 	}
 
-	p.logger.InfoContext(ctx, "listening for dnscrypt messages on udp", "addr", conn.LocalAddr())
+	p.serverLogger.InfoContext(ctx, "listening for dnscrypt messages on udp", "addr", conn.LocalAddr())
 
 	return conn, nil
 }
@@ -84,7 +84,7 @@ func (p *Proxy) listenDNSCryptTCP(
 	addr *net.TCPAddr,
 ) (conn *net.TCPListener, err error) {
 	addrStr := addr.String()
-	p.logger.InfoContext(ctx, "creating dnscrypt tcp server socket", "addr", addrStr)
+	p.serverLogger.InfoContext(ctx, "creating dnscrypt tcp server socket", "addr", addrStr)
 
 	err = p.bindWithRetry(ctx, func() (listenErr error) {
 		conn, listenErr = net.ListenTCP(bootstrap.NetworkTCP, addr)
@@ -95,7 +95,7 @@ func (p *Proxy) listenDNSCryptTCP(
 		return nil, fmt.Errorf("listening to tcp socket: %w", err)
 	}
 
-	p.logger.InfoContext(ctx, "listening for dnscrypt messages on tcp", "addr", conn.Addr())
+	p.serverLogger.InfoContext(ctx, "listening for dnscrypt messages on tcp", "addr", conn.Addr())
 
 	return conn, nil
 }
@@ -122,7 +122,7 @@ func (h *dnsCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, req *dns.Msg) (er
 	}
 	defer h.reqSema.Release()
 
-	return h.proxy.handleDNSRequest(d)
+	return h.proxy.handleDNSRequest(h.proxy.runContext(), d)
 }
 
 // Writes a response to the UDP client
@@ -28,6 +28,7 @@ import (
 func (p *Proxy) listenHTTP(
 	ctx context.Context,
 	addr *net.TCPAddr,
+	tlsConf *tls.Config,
 ) (ln net.Listener, tcpAddr *net.TCPAddr, err error) {
 	var tcpListen *net.TCPListener
 	err = p.bindWithRetry(ctx, func() (listenErr error) {
@@ -45,9 +46,9 @@ func (p *Proxy) listenHTTP(
 		return nil, nil, fmt.Errorf("bad listener address type: %T", laddr)
 	}
 
-	p.logger.InfoContext(ctx, "listening to https", "addr", tcpAddr)
+	p.serverLogger.InfoContext(ctx, "listening to https", "addr", tcpAddr)
 
-	tlsConfig := p.TLSConfig.Clone()
+	tlsConfig := tlsConf.Clone()
 	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
 
 	tlsListen := tls.NewListener(tcpListen, tlsConfig)
@@ -60,15 +61,16 @@ func (p *Proxy) listenHTTP(
 func (p *Proxy) listenH3(
 	ctx context.Context,
 	addr *net.UDPAddr,
+	tlsConf *tls.Config,
 ) (ln *quic.EarlyListener, err error) {
-	tlsConfig := p.TLSConfig.Clone()
+	tlsConfig := tlsConf.Clone()
 	tlsConfig.NextProtos = []string{"h3"}
 	quicListen, err := quic.ListenAddrEarly(addr.String(), tlsConfig, newServerQUICConfig())
 	if err != nil {
 		return nil, fmt.Errorf("quic listener: %w", err)
 	}
 
-	p.logger.InfoContext(ctx, "listening to h3", "addr", quicListen.Addr())
+	p.serverLogger.InfoContext(ctx, "listening to h3", "addr", quicListen.Addr())
 
 	return quicListen, nil
 }
@@ -88,31 +90,47 @@ func (p *Proxy) initHTTPSListeners(ctx context.Context) (err error) {
 	}
 
 	for _, addr := range p.HTTPSListenAddr {
-		p.logger.InfoContext(ctx, "creating an https server")
-
-		ln, tcpAddr, lErr := p.listenHTTP(ctx, addr)
-		if lErr != nil {
-			return fmt.Errorf("failed to start HTTPS server on %s: %w", addr, lErr)
+		_, err = p.addHTTPSListener(ctx, addr, p.TLSConfig)
+		if err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// addHTTPSListener starts listening for DNS-over-HTTPS on addr using tlsConf,
+// as well as for HTTP/3 if enabled, and returns the address it actually
+// listens on.  The HTTPS servers must be initialized.
+func (p *Proxy) addHTTPSListener(
+	ctx context.Context,
+	addr *net.TCPAddr,
+	tlsConf *tls.Config,
+) (laddr net.Addr, err error) {
+	p.serverLogger.InfoContext(ctx, "creating an https server")
 
-		p.httpsListen = append(p.httpsListen, ln)
+	ln, tcpAddr, err := p.listenHTTP(ctx, addr, tlsConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HTTPS server on %s: %w", addr, err)
+	}
 
-		if p.HTTP3 {
-			// HTTP/3 server listens to the same pair IP:port as the one HTTP/2
-			// server listens to.
-			udpAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port}
+	p.httpsListen = append(p.httpsListen, ln)
 
-			var quicListen *quic.EarlyListener
-			quicListen, err = p.listenH3(ctx, udpAddr)
-			if err != nil {
-				return fmt.Errorf("failed to start HTTP/3 server on %s: %w", udpAddr, err)
-			}
+	if p.HTTP3 {
+		// HTTP/3 server listens to the same pair IP:port as the one HTTP/2
+		// server listens to.
+		udpAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port}
 
-			p.h3Listen = append(p.h3Listen, quicListen)
+		var quicListen *quic.EarlyListener
+		quicListen, err = p.listenH3(ctx, udpAddr, tlsConf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start HTTP/3 server on %s: %w", udpAddr, err)
 		}
+
+		p.h3Listen = append(p.h3Listen, quicListen)
 	}
 
-	return nil
+	return tcpAddr, nil
 }
 
 // newDoHReq returns new DNS request parsed from the given HTTP request.  In
@@ -177,18 +195,18 @@ func newDoHReq(r *http.Request, l *slog.Logger) (req *dns.Msg, statusCode int) {
 //     "application/dns-message",
 //   - http.StatusMethodNotAllowed if request method is not GET or POST.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.logger.Debug("incoming https request", "url", r.URL)
+	p.serverLogger.Debug("incoming https request", "url", r.URL)
 
-	raddr, prx, err := remoteAddr(r, p.logger)
+	raddr, prx, err := remoteAddr(r, p.serverLogger)
 	if err != nil {
-		p.logger.Debug("getting real ip", slogutil.KeyError, err)
+		p.serverLogger.Debug("getting real ip", slogutil.KeyError, err)
 	}
 
-	if !p.checkBasicAuth(w, r, raddr) {
+	if !p.checkBasicAuth(w, r, raddr) || !p.checkClientAuth(w, r) {
 		return
 	}
 
-	req, statusCode := newDoHReq(r, p.logger)
+	req, statusCode := newDoHReq(r, p.serverLogger)
 	if req == nil {
 		http.Error(w, http.StatusText(statusCode), statusCode)
 
@@ -196,10 +214,10 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if prx.IsValid() {
-		p.logger.Debug("request came from proxy server", "addr", prx)
+		p.serverLogger.Debug("request came from proxy server", "addr", prx)
 
 		if !p.TrustedProxies.Contains(prx.Addr()) {
-			p.logger.Debug("proxy is not trusted, using original remote addr", "addr", prx)
+			p.serverLogger.Debug("proxy is not trusted, using original remote addr", "addr", prx)
 
 			// So the address of the proxy itself is used, as the remote address
 			// parsed from headers cannot be trusted.
@@ -213,9 +231,13 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d.HTTPRequest = r
 	d.HTTPResponseWriter = w
 
-	err = p.handleDNSRequest(d)
+	// The request context is canceled once the client's connection is closed.
+	ctx, cancel := p.queryContext(r.Context())
+	defer cancel()
+
+	err = p.handleDNSRequest(ctx, d)
 	if err != nil {
-		p.logger.Debug("handling dns request", "proto", d.Proto, slogutil.KeyError, err)
+		p.serverLogger.Debug("handling dns request", "proto", d.Proto, slogutil.KeyError, err)
 	}
 }
 
@@ -237,7 +259,7 @@ func (p *Proxy) checkBasicAuth(
 		return true
 	}
 
-	p.logger.Error("basic auth failed", "user", user, "raddr", raddr)
+	p.serverLogger.Error("basic auth failed", "user", user, "raddr", raddr)
 
 	h := w.Header()
 	h.Set(httphdr.WWWAuthenticate, `Basic realm="DNS", charset="UTF-8"`)
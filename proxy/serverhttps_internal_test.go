@@ -90,10 +90,10 @@ func TestProxy_trustedProxies(t *testing.T) {
 		})
 
 		var gotAddr netip.Addr
-		dnsProxy.RequestHandler = func(_ *Proxy, d *DNSContext) (err error) {
+		dnsProxy.RequestHandler = func(ctx context.Context, _ *Proxy, d *DNSContext) (err error) {
 			gotAddr = d.Addr.Addr()
 
-			return dnsProxy.Resolve(d)
+			return dnsProxy.Resolve(ctx, d)
 		}
 
 		client := createTestHTTPClient(dnsProxy, caPem, false)
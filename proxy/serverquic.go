@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -65,29 +66,42 @@ const (
 // initQUICListeners creates QUIC listeners for the DoQ server.
 func (p *Proxy) initQUICListeners(ctx context.Context) (err error) {
 	for _, a := range p.QUICListenAddr {
-		var conn *net.UDPConn
-		var ln *quic.EarlyListener
-		var tr *quic.Transport
-		conn, ln, tr, err = p.listenQUIC(ctx, a)
+		_, err = p.addQUICListener(ctx, a, p.TLSConfig)
 		if err != nil {
-			return fmt.Errorf("listening on quic addr %s: %w", a, err)
+			return err
 		}
-
-		p.quicConns = append(p.quicConns, conn)
-		p.quicTransports = append(p.quicTransports, tr)
-		p.quicListen = append(p.quicListen, ln)
 	}
 
 	return nil
 }
 
+// addQUICListener starts listening for DNS-over-QUIC on a using tlsConf and
+// returns the address it actually listens on.
+func (p *Proxy) addQUICListener(
+	ctx context.Context,
+	a *net.UDPAddr,
+	tlsConf *tls.Config,
+) (laddr net.Addr, err error) {
+	conn, ln, tr, err := p.listenQUIC(ctx, a, tlsConf)
+	if err != nil {
+		return nil, fmt.Errorf("listening on quic addr %s: %w", a, err)
+	}
+
+	p.quicConns = append(p.quicConns, conn)
+	p.quicTransports = append(p.quicTransports, tr)
+	p.quicListen = append(p.quicListen, ln)
+
+	return ln.Addr(), nil
+}
+
 // listenQUIC returns a new UDP connection listening on addr, the QUIC listener
 // utilizing it, and the associated QUIC transport.
 func (p *Proxy) listenQUIC(
 	ctx context.Context,
 	addr *net.UDPAddr,
+	tlsConf *tls.Config,
 ) (conn *net.UDPConn, l *quic.EarlyListener, tr *quic.Transport, err error) {
-	p.logger.InfoContext(ctx, "creating quic listener", "addr", addr)
+	p.serverLogger.InfoContext(ctx, "creating quic listener", "addr", addr)
 
 	err = p.bindWithRetry(ctx, func() (listenErr error) {
 		conn, listenErr = net.ListenUDP(bootstrap.NetworkUDP, addr)
@@ -104,7 +118,7 @@ func (p *Proxy) listenQUIC(
 		VerifySourceAddress: v.requiresValidation,
 	}
 
-	tlsConfig := p.TLSConfig.Clone()
+	tlsConfig := tlsConf.Clone()
 	tlsConfig.NextProtos = compatProtoDQ
 	l, err = tr.ListenEarly(
 		tlsConfig,
@@ -114,7 +128,7 @@ func (p *Proxy) listenQUIC(
 		return nil, nil, nil, fmt.Errorf("listening early: %w", err)
 	}
 
-	p.logger.InfoContext(ctx, "listening quic", "addr", l.Addr())
+	p.serverLogger.InfoContext(ctx, "listening quic", "addr", l.Addr())
 
 	return conn, l, tr, nil
 }
@@ -123,20 +137,20 @@ func (p *Proxy) listenQUIC(
 //
 // See also the comment on Proxy.requestsSema.
 func (p *Proxy) quicPacketLoop(l *quic.EarlyListener, reqSema syncutil.Semaphore) {
-	p.logger.Info("entering dns-over-quic listener loop", "addr", l.Addr())
+	p.serverLogger.Info("entering dns-over-quic listener loop", "addr", l.Addr())
 
 	for {
 		ctx := context.Background()
 		conn, err := l.Accept(ctx)
 		if err != nil {
-			logQUICError(ctx, "accepting quic conn", err, p.logger)
+			logQUICError(ctx, "accepting quic conn", err, p.serverLogger)
 
 			break
 		}
 
 		err = reqSema.Acquire(ctx)
 		if err != nil {
-			p.logger.ErrorContext(
+			p.serverLogger.ErrorContext(
 				ctx,
 				"acquiring semaphore",
 				"proto", ProtoQUIC,
@@ -182,20 +196,20 @@ func (p *Proxy) handleQUICConnection(conn *quic.Conn, reqSema syncutil.Semaphore
 		// bidirectional stream.
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
-			logQUICError(ctx, "accepting quic stream", err, p.logger)
+			logQUICError(ctx, "accepting quic stream", err, p.serverLogger)
 
 			// Close the connection to make sure resources are freed.
-			closeQUICConn(conn, DoQCodeNoError, p.logger)
+			closeQUICConn(conn, DoQCodeNoError, p.serverLogger)
 
 			return
 		}
 
 		err = reqSema.Acquire(ctx)
 		if err != nil {
-			p.logger.ErrorContext(ctx, "acquiring semaphore", slogutil.KeyError, err)
+			p.serverLogger.ErrorContext(ctx, "acquiring semaphore", slogutil.KeyError, err)
 
 			// Close the connection to make sure resources are freed.
-			closeQUICConn(conn, DoQCodeNoError, p.logger)
+			closeQUICConn(conn, DoQCodeNoError, p.serverLogger)
 
 			return
 		}
@@ -232,7 +246,7 @@ func (p *Proxy) handleQUICStream(ctx context.Context, stream *quic.Stream, conn
 	// just a signal that there will be no data to read anymore from this
 	// stream.
 	if (err != nil && err != io.EOF) || n < minDNSPacketSize {
-		logShortQUICRead(ctx, err, p.logger)
+		logShortQUICRead(ctx, err, p.serverLogger)
 
 		return
 	}
@@ -255,18 +269,18 @@ func (p *Proxy) handleQUICStream(ctx context.Context, stream *quic.Stream, conn
 	}
 
 	if err != nil {
-		p.logger.ErrorContext(ctx, "unpacking quic packet", slogutil.KeyError, err)
-		closeQUICConn(conn, DoQCodeProtocolError, p.logger)
+		p.serverLogger.ErrorContext(ctx, "unpacking quic packet", slogutil.KeyError, err)
+		closeQUICConn(conn, DoQCodeProtocolError, p.serverLogger)
 
 		return
 	}
 
-	if !validQUICMsg(req, p.logger) {
+	if !validQUICMsg(req, p.serverLogger) {
 		// If a peer encounters such an error condition, it is considered a
 		// fatal error. It SHOULD forcibly abort the connection using QUIC's
 		// CONNECTION_CLOSE mechanism and SHOULD use the DoQ error code
 		// DOQ_PROTOCOL_ERROR.
-		closeQUICConn(conn, DoQCodeProtocolError, p.logger)
+		closeQUICConn(conn, DoQCodeProtocolError, p.serverLogger)
 
 		return
 	}
@@ -276,9 +290,14 @@ func (p *Proxy) handleQUICStream(ctx context.Context, stream *quic.Stream, conn
 	d.QUICConnection = conn
 	d.DoQVersion = doqVersion
 
-	err = p.handleDNSRequest(d)
+	// The stream context is canceled once the client cancels the stream or
+	// closes the connection.
+	reqCtx, cancel := p.queryContext(stream.Context())
+	defer cancel()
+
+	err = p.handleDNSRequest(reqCtx, d)
 	if err != nil {
-		p.logger.DebugContext(
+		p.serverLogger.DebugContext(
 			ctx,
 			"error handling dns request",
 			"proto", d.Proto,
@@ -293,7 +312,7 @@ func (p *Proxy) respondQUIC(d *DNSContext) error {
 
 	if resp == nil {
 		// If no response has been written, close the QUIC connection now.
-		closeQUICConn(d.QUICConnection, DoQCodeInternalError, p.logger)
+		closeQUICConn(d.QUICConnection, DoQCodeInternalError, p.serverLogger)
 
 		return errors.Error("no response to write")
 	}
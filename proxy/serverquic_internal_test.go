@@ -96,7 +96,7 @@ func TestQuicProxy_largePackets(t *testing.T) {
 		RatelimitSubnetLenIPv4: 24,
 		RatelimitSubnetLenIPv6: 64,
 		// Make sure the request does not go to any real upstream.
-		RequestHandler: func(_ *Proxy, d *DNSContext) (err error) {
+		RequestHandler: func(_ context.Context, _ *Proxy, d *DNSContext) (err error) {
 			resp := &dns.Msg{}
 			resp.SetReply(d.Req)
 			resp.Answer = []dns.RR{&dns.A{
@@ -36,9 +36,9 @@ func (p *Proxy) initTCPListeners(ctx context.Context) (err error) {
 // listenTCP returns a new TCP listener listening on addr.
 func (p *Proxy) listenTCP(ctx context.Context, addr *net.TCPAddr) (ln *net.TCPListener, err error) {
 	addrStr := addr.String()
-	p.logger.InfoContext(ctx, "creating tcp server socket", "addr", addrStr)
+	p.serverLogger.InfoContext(ctx, "creating tcp server socket", "addr", addrStr)
 
-	conf := proxynetutil.ListenConfig(p.logger)
+	conf := proxynetutil.ListenConfig(p.serverLogger)
 
 	var listener net.Listener
 	err = p.bindWithRetry(ctx, func() (listenErr error) {
@@ -58,7 +58,7 @@ func (p *Proxy) listenTCP(ctx context.Context, addr *net.TCPAddr) (ln *net.TCPLi
 		return nil, fmt.Errorf("bad listener type: %T", listener)
 	}
 
-	p.logger.InfoContext(ctx, "listening to tcp", "addr", ln.Addr())
+	p.serverLogger.InfoContext(ctx, "listening to tcp", "addr", ln.Addr())
 
 	return ln, nil
 }
@@ -66,25 +66,40 @@ func (p *Proxy) listenTCP(ctx context.Context, addr *net.TCPAddr) (ln *net.TCPLi
 // initTLSListeners initializes TLS listeners with configured addresses.
 func (p *Proxy) initTLSListeners(ctx context.Context) (err error) {
 	for _, addr := range p.TLSListenAddr {
-		p.logger.InfoContext(ctx, "creating tls server socket", "addr", addr)
-
-		var tcpListen *net.TCPListener
-		err = p.bindWithRetry(ctx, func() (listenErr error) {
-			tcpListen, listenErr = net.ListenTCP("tcp", addr)
-
-			return listenErr
-		})
+		_, err = p.addTLSListener(ctx, addr, p.TLSConfig)
 		if err != nil {
-			return fmt.Errorf("listening on tls addr %s: %w", addr, err)
+			return err
 		}
+	}
 
-		l := tls.NewListener(tcpListen, p.TLSConfig)
-		p.tlsListen = append(p.tlsListen, l)
+	return nil
+}
 
-		p.logger.InfoContext(ctx, "listening to tls", "addr", l.Addr())
+// addTLSListener starts listening for DNS-over-TLS on addr using tlsConf and
+// returns the address it actually listens on.
+func (p *Proxy) addTLSListener(
+	ctx context.Context,
+	addr *net.TCPAddr,
+	tlsConf *tls.Config,
+) (laddr net.Addr, err error) {
+	p.serverLogger.InfoContext(ctx, "creating tls server socket", "addr", addr)
+
+	var tcpListen *net.TCPListener
+	err = p.bindWithRetry(ctx, func() (listenErr error) {
+		tcpListen, listenErr = net.ListenTCP("tcp", addr)
+
+		return listenErr
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listening on tls addr %s: %w", addr, err)
 	}
 
-	return nil
+	l := tls.NewListener(tcpListen, tlsConf)
+	p.tlsListen = append(p.tlsListen, l)
+
+	p.serverLogger.InfoContext(ctx, "listening to tls", "addr", l.Addr())
+
+	return l.Addr(), nil
 }
 
 // tcpPacketLoop listens for incoming TCP packets.  proto must be either
@@ -92,15 +107,15 @@ func (p *Proxy) initTLSListeners(ctx context.Context) (err error) {
 //
 // See also the comment on Proxy.requestsSema.
 func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Semaphore) {
-	p.logger.Info("entering listener loop", "proto", proto, "addr", l.Addr())
+	p.serverLogger.Info("entering listener loop", "proto", proto, "addr", l.Addr())
 
 	for {
 		clientConn, err := l.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				p.logger.Debug("tcp connection closed", "addr", l.Addr())
+				p.serverLogger.Debug("tcp connection closed", "addr", l.Addr())
 			} else {
-				p.logger.Error("reading from tcp", slogutil.KeyError, err)
+				p.serverLogger.Error("reading from tcp", slogutil.KeyError, err)
 			}
 
 			break
@@ -109,7 +124,7 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Sema
 		// TODO(d.kolyshev): Pass and use context from above.
 		err = reqSema.Acquire(context.Background())
 		if err != nil {
-			p.logger.Error("acquiring semaphore", "proto", ProtoTCP, slogutil.KeyError, err)
+			p.serverLogger.Error("acquiring semaphore", "proto", ProtoTCP, slogutil.KeyError, err)
 
 			break
 		}
@@ -121,25 +136,32 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto Proto, reqSema syncutil.Sema
 // handleTCPConnection starts a loop that handles an incoming TCP connection.
 // proto must be either [ProtoTCP] or [ProtoTLS].
 func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto, reqSema syncutil.Semaphore) {
-	defer slogutil.RecoverAndLog(context.TODO(), p.logger)
+	defer slogutil.RecoverAndLog(context.TODO(), p.serverLogger)
 	defer reqSema.Release()
 	defer func() {
 		err := conn.Close()
 		if err != nil {
-			logWithNonCrit(err, "closing conn", ProtoTCP, p.logger)
+			logWithNonCrit(err, "closing conn", ProtoTCP, p.serverLogger)
 		}
 	}()
 
-	p.logger.Debug("handling new request", "proto", proto, "raddr", conn.RemoteAddr())
+	p.serverLogger.Debug("handling new request", "proto", proto, "raddr", conn.RemoteAddr())
+
+	ctx, cancel := p.queryContext(context.Background())
+	defer cancel()
+
+	// The same buffer is used to read all the requests of the connection.
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
 
 	for p.isStarted() {
 		err := conn.SetDeadline(time.Now().Add(defaultTimeout))
 		if err != nil {
 			// Consider deadline errors non-critical.
-			logWithNonCrit(err, "setting deadline", ProtoTCP, p.logger)
+			logWithNonCrit(err, "setting deadline", ProtoTCP, p.serverLogger)
 		}
 
-		req := p.readDNSReq(conn)
+		req := p.readDNSReq(conn, *bufPtr)
 		if req == nil {
 			return
 		}
@@ -147,19 +169,20 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto Proto, reqSema syncutil
 		d := p.newDNSContext(proto, req, netutil.NetAddrToAddrPort(conn.RemoteAddr()))
 		d.Conn = conn
 
-		err = p.handleDNSRequest(d)
+		err = p.handleDNSRequest(ctx, d)
 		if err != nil {
-			logWithNonCrit(err, "handling request", ProtoTCP, p.logger)
+			logWithNonCrit(err, "handling request", ProtoTCP, p.serverLogger)
 		}
 	}
 }
 
 // readDNSReq returns DNS request message from the given connection or nil if
-// it failed to read it.  Properly logs the error if it happened.
-func (p *Proxy) readDNSReq(conn net.Conn) (req *dns.Msg) {
-	packet, err := readPrefixed(conn)
+// it failed to read it.  buf is used to read the message, it must be at least
+// 2 + [dns.MaxMsgSize] bytes long.  Properly logs the error if it happened.
+func (p *Proxy) readDNSReq(conn net.Conn, buf []byte) (req *dns.Msg) {
+	packet, err := readPrefixed(conn, buf)
 	if err != nil {
-		logWithNonCrit(err, "reading msg", ProtoTCP, p.logger)
+		logWithNonCrit(err, "reading msg", ProtoTCP, p.serverLogger)
 
 		return nil
 	}
@@ -167,7 +190,13 @@ func (p *Proxy) readDNSReq(conn net.Conn) (req *dns.Msg) {
 	req = &dns.Msg{}
 	err = req.Unpack(packet)
 	if err != nil {
-		p.logger.Error("handling tcp; unpacking msg", slogutil.KeyError, err)
+		p.serverLogger.Error("handling tcp; unpacking msg", slogutil.KeyError, err)
+		p.anomalies.captureRequest(
+			anomalyMalformed,
+			netutil.NetAddrToAddrPort(conn.RemoteAddr()),
+			netutil.NetAddrToAddrPort(conn.LocalAddr()).Addr(),
+			packet,
+		)
 
 		return nil
 	}
@@ -179,9 +208,10 @@ func (p *Proxy) readDNSReq(conn net.Conn) (req *dns.Msg) {
 const errTooLarge errors.Error = "dns message is too large"
 
 // readPrefixed reads a DNS message with a 2-byte prefix containing message
-// length from conn.
-func readPrefixed(conn net.Conn) (b []byte, err error) {
-	l := make([]byte, 2)
+// length from conn into buf, which must be at least 2 + [dns.MaxMsgSize] bytes
+// long.  b is a subslice of buf.
+func readPrefixed(conn net.Conn, buf []byte) (b []byte, err error) {
+	l := buf[:2]
 	_, err = conn.Read(l)
 	if err != nil {
 		return nil, fmt.Errorf("reading len: %w", err)
@@ -192,7 +222,7 @@ func readPrefixed(conn net.Conn) (b []byte, err error) {
 		return nil, errTooLarge
 	}
 
-	b = make([]byte, packetLen)
+	b = buf[:packetLen]
 	_, err = io.ReadFull(conn, b)
 	if err != nil {
 		return nil, fmt.Errorf("reading msg: %w", err)
@@ -211,7 +241,10 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 		return conn.Close()
 	}
 
-	bytes, err := resp.Pack()
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	bytes, err := resp.PackBuffer(*bufPtr)
 	if err != nil {
 		return fmt.Errorf("packing message: %w", err)
 	}
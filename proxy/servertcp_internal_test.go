@@ -9,6 +9,7 @@ import (
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -50,3 +51,27 @@ func TestTlsProxy(t *testing.T) {
 
 	sendTestMessages(t, conn)
 }
+
+func TestReadPrefixed(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	msgs := [][]byte{[]byte("first message"), []byte("second")}
+	go func() {
+		for _, m := range msgs {
+			_ = writePrefixed(m, client)
+		}
+	}()
+
+	// The same buffer is reused for all the messages.
+	buf := make([]byte, 2+dns.MaxMsgSize)
+	for _, want := range msgs {
+		got, err := readPrefixed(server, buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, want, got)
+	}
+}
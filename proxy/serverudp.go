@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+	"runtime"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
@@ -19,24 +20,58 @@ import (
 // initUDPListeners initializes UDP listeners with configured addresses.
 func (p *Proxy) initUDPListeners(ctx context.Context) (err error) {
 	for _, a := range p.UDPListenAddr {
-		var pc *net.UDPConn
-		pc, sErr := p.listenUDP(ctx, a)
-		if sErr != nil {
-			return fmt.Errorf("listening on udp addr %s: %w", a, sErr)
+		_, err = p.addUDPListener(ctx, a)
+		if err != nil {
+			return err
 		}
-
-		p.udpListen = append(p.udpListen, pc)
 	}
 
 	return nil
 }
 
+// addUDPListener opens [Config.UDPSocketsPerAddr] UDP sockets listening on a
+// and returns the address they actually listen on.
+func (p *Proxy) addUDPListener(ctx context.Context, a *net.UDPAddr) (laddr net.Addr, err error) {
+	pc, err := p.listenUDP(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("listening on udp addr %s: %w", a, err)
+	}
+
+	p.udpListen = append(p.udpListen, pc)
+
+	// Use the actual address, since the port might have been chosen by the OS.
+	udpAddr := pc.LocalAddr().(*net.UDPAddr)
+	for i := 1; i < p.udpSocketsNum(); i++ {
+		pc, err = p.listenUDP(ctx, udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("listening on udp addr %s: socket %d: %w", a, i, err)
+		}
+
+		p.udpReusePortListen = append(p.udpReusePortListen, pc)
+	}
+
+	return udpAddr, nil
+}
+
+// udpSocketsNum returns the number of UDP sockets to open for each of the
+// configured addresses.
+func (c *Config) udpSocketsNum() (n int) {
+	switch n = c.UDPSocketsPerAddr; {
+	case n < 0:
+		return runtime.GOMAXPROCS(0)
+	case n == 0:
+		return 1
+	default:
+		return n
+	}
+}
+
 // listenUDP returns a new UDP connection listening on addr.
 func (p *Proxy) listenUDP(ctx context.Context, addr *net.UDPAddr) (conn *net.UDPConn, err error) {
 	addrStr := addr.String()
-	p.logger.InfoContext(ctx, "creating udp server socket", "addr", addrStr)
+	p.serverLogger.InfoContext(ctx, "creating udp server socket", "addr", addrStr)
 
-	conf := proxynetutil.ListenConfig(p.logger)
+	conf := proxynetutil.ListenConfig(p.serverLogger)
 
 	var packetConn net.PacketConn
 	err = p.bindWithRetry(ctx, func() (listenErr error) {
@@ -74,7 +109,7 @@ func (p *Proxy) listenUDP(ctx context.Context, addr *net.UDPAddr) (conn *net.UDP
 		return nil, fmt.Errorf("setting udp opts: %w", err)
 	}
 
-	p.logger.InfoContext(ctx, "listening to udp", "addr", conn.LocalAddr())
+	p.serverLogger.InfoContext(ctx, "listening to udp", "addr", conn.LocalAddr())
 
 	return conn, nil
 }
@@ -83,35 +118,35 @@ func (p *Proxy) listenUDP(ctx context.Context, addr *net.UDPAddr) (conn *net.UDP
 //
 // See also the comment on Proxy.requestsSema.
 func (p *Proxy) udpPacketLoop(conn *net.UDPConn, reqSema syncutil.Semaphore) {
-	p.logger.Info("entering udp listener loop", "addr", conn.LocalAddr())
+	p.serverLogger.Info("entering udp listener loop", "addr", conn.LocalAddr())
 
-	b := make([]byte, dns.MaxMsgSize)
 	for p.isStarted() {
-		n, localIP, remoteAddr, err := proxynetutil.UDPRead(conn, b, p.udpOOBSize)
+		// Read into a buffer from the pool, since its contents must sustain
+		// until the packet is unpacked in a separate goroutine.  It's returned
+		// to the pool right after that, see [Proxy.udpHandlePacket].
+		bufPtr := p.bytesPool.Get()
+		n, localIP, remoteAddr, err := proxynetutil.UDPRead(conn, *bufPtr, p.udpOOBSize)
 		// The documentation says to handle the packet even if err occurs.
 		if n > 0 {
-			// Make a copy of all bytes because ReadFrom() will overwrite the
-			// contents of b on the next call.  We need that contents to sustain
-			// the call because we're handling them in goroutines.
-			packet := make([]byte, n)
-			copy(packet, b)
-
 			// TODO(d.kolyshev): Pass and use context from above.
 			sErr := reqSema.Acquire(context.Background())
 			if sErr != nil {
-				p.logger.Error("acquiring semaphore", "proto", ProtoUDP, slogutil.KeyError, sErr)
+				p.bytesPool.Put(bufPtr)
+				p.serverLogger.Error("acquiring semaphore", "proto", ProtoUDP, slogutil.KeyError, sErr)
 
 				break
 			}
 			go func() {
 				defer reqSema.Release()
 
-				p.udpHandlePacket(packet, localIP, remoteAddr, conn)
+				p.udpHandlePacket(bufPtr, n, localIP, remoteAddr, conn)
 			}()
+		} else {
+			p.bytesPool.Put(bufPtr)
 		}
 
 		if err != nil {
-			logUDPConnError(err, conn, p.logger)
+			logUDPConnError(err, conn, p.serverLogger)
 
 			break
 		}
@@ -127,20 +162,35 @@ func logUDPConnError(err error, conn *net.UDPConn, l *slog.Logger) {
 	}
 }
 
-// udpHandlePacket processes the incoming UDP packet and sends a DNS response
+// udpHandlePacket processes the incoming UDP packet, which is the first n bytes
+// of the buffer from [Proxy.bytesPool], and sends a DNS response.  The buffer is
+// returned to the pool once the packet is unpacked.
 func (p *Proxy) udpHandlePacket(
-	packet []byte,
+	bufPtr *[]byte,
+	n int,
 	localIP netip.Addr,
 	remoteAddr *net.UDPAddr,
 	conn *net.UDPConn,
 ) {
-	p.logger.Debug("handling new udp packet", "raddr", remoteAddr)
+	p.serverLogger.Debug("handling new udp packet", "raddr", remoteAddr)
 
+	packet := (*bufPtr)[:n]
 	req := &dns.Msg{}
 	err := req.Unpack(packet)
 	if err != nil {
-		p.logger.Error("unpacking udp packet", slogutil.KeyError, err)
+		p.serverLogger.Error("unpacking udp packet", slogutil.KeyError, err)
+		p.anomalies.captureRequest(
+			anomalyMalformed,
+			netutil.NetAddrToAddrPort(remoteAddr),
+			localIP,
+			packet,
+		)
+	}
 
+	// The unpacked request doesn't refer to the buffer, so don't hold it for
+	// the handling, which may take as long as the upstream exchange.
+	p.bytesPool.Put(bufPtr)
+	if err != nil {
 		return
 	}
 
@@ -148,9 +198,9 @@ func (p *Proxy) udpHandlePacket(
 	d.Conn = conn
 	d.localIP = localIP
 
-	err = p.handleDNSRequest(d)
+	err = p.handleDNSRequest(p.runContext(), d)
 	if err != nil {
-		p.logger.Debug("handling dns request", "proto", d.Proto, slogutil.KeyError, err)
+		p.serverLogger.Debug("handling dns request", "proto", d.Proto, slogutil.KeyError, err)
 	}
 }
 
@@ -163,7 +213,10 @@ func (p *Proxy) respondUDP(d *DNSContext) error {
 		return nil
 	}
 
-	bytes, err := resp.Pack()
+	bufPtr := p.bytesPool.Get()
+	defer p.bytesPool.Put(bufPtr)
+
+	bytes, err := resp.PackBuffer(*bufPtr)
 	if err != nil {
 		return fmt.Errorf("packing message: %w", err)
 	}
@@ -1,9 +1,19 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,3 +27,154 @@ func TestUdpProxy(t *testing.T) {
 
 	sendTestMessages(t, conn)
 }
+
+// mustStartUDPProxy starts a new proxy listening on UDP with socketsNum
+// sockets and answering the requests with an empty response without any
+// network exchanges.
+func mustStartUDPProxy(tb testing.TB, socketsNum int) (p *Proxy) {
+	tb.Helper()
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p = mustNew(tb, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		UDPSocketsPerAddr:      socketsNum,
+	})
+
+	servicetest.RequireRun(tb, p, testTimeout)
+
+	return p
+}
+
+func TestProxy_UDPSocketsPerAddr(t *testing.T) {
+	const socketsNum = 4
+
+	p := mustStartUDPProxy(t, socketsNum)
+
+	addr := p.Addr(ProtoUDP)
+	require.Len(t, p.udpReusePortListen, socketsNum-1)
+	require.Len(t, p.Addrs(ProtoUDP), 1)
+
+	for _, conn := range p.udpReusePortListen {
+		assert.Equal(t, addr.String(), conn.LocalAddr().String())
+	}
+
+	// Use different source ports, so that the requests are likely to be
+	// distributed between the sockets.
+	for range socketsNum {
+		conn, err := dns.Dial("udp", addr.String())
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+		err = conn.WriteMsg((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+		require.NoError(t, err)
+
+		var resp *dns.Msg
+		resp, err = conn.ReadMsg()
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	}
+}
+
+func TestProxy_udpPacketLoop_pooledBuffers(t *testing.T) {
+	const (
+		clientsNum  = 8
+		requestsNum = 32
+	)
+
+	p := mustStartUDPProxy(t, 1)
+	addr := p.Addr(ProtoUDP).String()
+
+	// The buffers of the concurrently handled requests must not be shared.
+	wg := &sync.WaitGroup{}
+	for c := range clientsNum {
+		wg.Go(func() {
+			conn, err := dns.Dial("udp", addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+
+			for i := range requestsNum {
+				name := fmt.Sprintf("client-%d-request-%d.example.", c, i)
+				err = conn.WriteMsg((&dns.Msg{}).SetQuestion(name, dns.TypeA))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				var resp *dns.Msg
+				resp, err = conn.ReadMsg()
+				if !assert.NoError(t, err) || !assert.Len(t, resp.Question, 1) {
+					return
+				}
+
+				assert.Equal(t, name, resp.Question[0].Name)
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkProxy_UDPSocketsPerAddr(b *testing.B) {
+	benchCases := []struct {
+		name       string
+		socketsNum int
+	}{{
+		name:       "single",
+		socketsNum: 1,
+	}, {
+		name:       "per_cpu",
+		socketsNum: -1,
+	}}
+
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			p := mustStartUDPProxy(b, bc.socketsNum)
+			addr := p.Addr(ProtoUDP).String()
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := dns.Dial("udp", addr)
+				require.NoError(b, err)
+
+				defer func() { _ = conn.Close() }()
+
+				req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+				for pb.Next() {
+					err = conn.WriteMsg(req)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					_, err = conn.ReadMsg()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+
+	// Most recent results, note that with a single CPU both cases use a single
+	// socket, so the gain is only expected on multi-core machines:
+	//
+	//	goos: linux
+	//	goarch: amd64
+	//	pkg: github.com/AdguardTeam/dnsproxy/proxy
+	//	cpu: Intel(R) Xeon(R) Processor
+	//	BenchmarkProxy_UDPSocketsPerAddr/single         	  151706	     15141 ns/op	    5172 B/op	      82 allocs/op
+	//	BenchmarkProxy_UDPSocketsPerAddr/per_cpu        	  122509	     20444 ns/op	    5181 B/op	      82 allocs/op
+}
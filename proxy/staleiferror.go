@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultStaleAnswerTTL is the default TTL of the stale responses, see
+// [Config.CacheStaleIfErrorAnswerTTL] and RFC 8767 Section 4.
+const defaultStaleAnswerTTL = 30 * time.Second
+
+// keepsStale returns true if the packed expired item data should be kept to be
+// served when resolving fails, see [Config.CacheStaleIfErrorMaxAge].
+func (c *cache) keepsStale(data []byte) (ok bool) {
+	if c.staleMaxAge <= 0 || len(data) < minPackedLen {
+		return false
+	}
+
+	expire := packedExpire(data)
+	now := c.clock.Now()
+
+	return now.After(expire) && !now.After(expire.Add(c.staleMaxAge))
+}
+
+// getStale returns the expired item cached for req to be served when resolving
+// it fails, or nil if there is none.
+//
+// TODO(e.burkov):  Support the items cached for the client subnets.
+func (c *cache) getStale(req *dns.Msg) (ci *cacheItem) {
+	if !canLookUpInCache(c.items, req) {
+		return nil
+	}
+
+	key := msgToKey(req)
+
+	data := c.items.Get(key)
+	if data == nil || !c.keepsStale(data) {
+		return nil
+	}
+
+	m, u := unpackMsg(data)
+	if m == nil {
+		return nil
+	}
+
+	defer putMsg(m)
+
+	return newCacheItem(req, m, u, uint32(c.staleTTL.Seconds()))
+}
+
+// replyStale sets the expired cached response for the failed request of d, if
+// there is one, and returns true if it's been set.
+func (p *Proxy) replyStale(d *DNSContext) (ok bool) {
+	dctxCache := p.cacheForContext(d)
+	if dctxCache.staleMaxAge <= 0 || (p.EnableEDNSClientSubnet && d.ReqECS != nil) {
+		return false
+	}
+
+	ci := dctxCache.getStale(d.Req)
+	if ci == nil {
+		return false
+	}
+
+	d.Res = ci.m
+	d.queryStatistics = cachedQueryStatistics(ci.u)
+	d.ede = &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeStaleAnswer,
+		ExtraText: "resolving failed",
+	}
+	p.setSource(d, ResponseSourceStale)
+
+	return true
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_staleIfError(t *testing.T) {
+	const host = "example.org."
+
+	var upsErr error
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			if upsErr != nil {
+				return nil, upsErr
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, 60, net.IP{192, 0, 2, 1})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "192.0.2.53:53" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                  slogutil.NewDiscardLogger(),
+		UDPListenAddr:           []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:          &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:          defaultTrustedProxies,
+		RatelimitSubnetLenIPv4:  24,
+		RatelimitSubnetLenIPv6:  64,
+		CacheEnabled:            true,
+		CacheStaleIfErrorMaxAge: time.Hour,
+		AnnotateResponseSource:  true,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T) (resp *dns.Msg, err error) {
+		t.Helper()
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		d := &DNSContext{
+			Req:  req,
+			Addr: netip.MustParseAddrPort("192.0.2.1:53"),
+		}
+		err = p.Resolve(context.Background(), d)
+		require.NotNil(t, d.Res)
+
+		return d.Res, err
+	}
+
+	// expireBy makes the cached entry expired d ago.
+	expireBy := func(t *testing.T, d time.Duration) {
+		t.Helper()
+
+		key := msgToKey((&dns.Msg{}).SetQuestion(host, dns.TypeA))
+		data := p.cache.items.Get(key)
+		require.NotNil(t, data)
+
+		binary.BigEndian.PutUint32(data, uint32(time.Now().Add(-d).Unix()))
+		p.cache.items.Set(key, data)
+	}
+
+	resp, err := resolve(t)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	upsErr = errors.Error("upstream unreachable")
+	expireBy(t, 10*time.Second)
+
+	resp, err = resolve(t)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+
+	assert.Equal(t, uint32(defaultStaleAnswerTTL.Seconds()), resp.Answer[0].Header().Ttl)
+
+	opt := resp.IsEdns0()
+	require.NotNil(t, opt)
+
+	var ede *dns.EDNS0_EDE
+	var src ResponseSource
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_EDE:
+			ede = o
+		case *dns.EDNS0_LOCAL:
+			src = ResponseSource(o.Data)
+		}
+	}
+
+	require.NotNil(t, ede)
+	assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, ede.InfoCode)
+	assert.Equal(t, ResponseSourceStale, src)
+
+	// The entries expired for longer than the maximum age aren't served.
+	expireBy(t, 2*time.Hour)
+
+	resp, err = resolve(t)
+	assert.ErrorIs(t, err, upsErr)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+}
+
+func TestCache_keepsStale(t *testing.T) {
+	const name = "example.org."
+
+	c := newCache(&cacheConfig{
+		size:        testCacheSize,
+		staleMaxAge: time.Minute,
+		staleTTL:    defaultStaleAnswerTTL,
+	})
+
+	req := (&dns.Msg{}).SetQuestion(name, dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{newRR(t, name, dns.TypeA, 60, net.IP{192, 0, 2, 1})}
+	c.set(resp, nil, slogutil.NewDiscardLogger())
+
+	key := msgToKey(req)
+	data := c.items.Get(key)
+	require.NotNil(t, data)
+
+	assert.Nil(t, c.getStale(req))
+
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Unix())-10)
+	c.items.Set(key, data)
+
+	// The expired entry isn't served as usual, but is kept.
+	ci, expired, _ := c.get(req)
+	assert.Nil(t, ci)
+	assert.True(t, expired)
+
+	ci = c.getStale(req)
+	require.NotNil(t, ci)
+	require.Len(t, ci.m.Answer, 1)
+
+	a := testutil.RequireTypeAssert[*dns.A](t, ci.m.Answer[0])
+	assert.Equal(t, net.IP{192, 0, 2, 1}, a.A.To4())
+	assert.Equal(t, uint32(defaultStaleAnswerTTL.Seconds()), a.Hdr.Ttl)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// DefaultStartupProbeDomain is the default value for
+// [StartupProbeConfig.Domain].
+const DefaultStartupProbeDomain = "example.org"
+
+// StartupProbeMode defines how [Proxy.Start] handles the upstreams failing the
+// startup probe.
+type StartupProbeMode string
+
+const (
+	// StartupProbeModeStrict makes [Proxy.Start] fail if any of the upstreams
+	// fails the probe, which suits the servers, where a misconfiguration
+	// should be noticed right away.
+	StartupProbeModeStrict StartupProbeMode = "strict"
+
+	// StartupProbeModeResilient makes [Proxy.Start] log the upstreams failing
+	// the probe and start anyway, which suits the edge devices, where the
+	// network may be unavailable at startup.
+	StartupProbeModeResilient StartupProbeMode = "resilient"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*StartupProbeMode)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *StartupProbeMode.
+func (m *StartupProbeMode) UnmarshalText(b []byte) (err error) {
+	switch mode := StartupProbeMode(b); mode {
+	case StartupProbeModeStrict, StartupProbeModeResilient:
+		*m = mode
+	default:
+		return fmt.Errorf(
+			"invalid startup probe mode %q, supported: %q, %q",
+			b,
+			StartupProbeModeStrict,
+			StartupProbeModeResilient,
+		)
+	}
+
+	return nil
+}
+
+// type check
+var _ encoding.TextMarshaler = StartupProbeMode("")
+
+// MarshalText implements [encoding.TextMarshaler] interface for
+// StartupProbeMode.
+func (m StartupProbeMode) MarshalText() (text []byte, err error) {
+	return []byte(m), nil
+}
+
+// StartupProbeConfig is the configuration of verifying the upstreams with a
+// probe query on [Proxy.Start], so that a misconfigured upstream is discovered
+// before the first query of a client.
+type StartupProbeConfig struct {
+	// Mode defines how the upstreams failing the probe are handled.  It must
+	// be either [StartupProbeModeStrict] or [StartupProbeModeResilient].
+	Mode StartupProbeMode
+
+	// Domain is the domain name to query the A records of.  Any response is
+	// considered a success, since the probe only checks that the upstream is
+	// reachable.  If empty, [DefaultStartupProbeDomain] is used.
+	Domain string
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *StartupProbeConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	var errs []error
+	switch c.Mode {
+	case StartupProbeModeStrict, StartupProbeModeResilient:
+		// Go on.
+	default:
+		errs = append(errs, fmt.Errorf("Mode: %w: %q", errors.ErrBadEnumValue, c.Mode))
+	}
+
+	if c.Domain != "" {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(c.Domain, "."))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Domain: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// probeUpstreams sends the probe query to each of the configured upstreams, as
+// configured by [Config.StartupProbe].  It only returns an error in
+// [StartupProbeModeStrict].
+func (p *Proxy) probeUpstreams(ctx context.Context) (err error) {
+	c := p.StartupProbe
+	if c == nil {
+		return nil
+	}
+
+	var ups []upstream.Upstream
+	for _, uc := range p.live.Load().configs() {
+		for _, u := range uc.all() {
+			// The same upstream may be used in several configurations.
+			if !slices.Contains(ups, u) {
+				ups = append(ups, u)
+			}
+		}
+	}
+
+	domain := dns.Fqdn(c.Domain)
+	if c.Domain == "" {
+		domain = dns.Fqdn(DefaultStartupProbeDomain)
+	}
+
+	p.logger.InfoContext(ctx, "probing upstreams", "count", len(ups), "domain", domain)
+
+	errs := make([]error, len(ups))
+	wg := &sync.WaitGroup{}
+	for i, u := range ups {
+		wg.Go(func() {
+			defer slogutil.RecoverAndLog(ctx, p.logger)
+
+			req := (&dns.Msg{}).SetQuestion(domain, dns.TypeA)
+			_, errs[i] = u.Exchange(ctx, req)
+		})
+	}
+
+	wg.Wait()
+
+	var failed []error
+	for i, probeErr := range errs {
+		addr := ups[i].Address()
+		if probeErr == nil {
+			p.logger.DebugContext(ctx, "upstream probe succeeded", "upstream", addr)
+
+			continue
+		}
+
+		p.logger.WarnContext(ctx, "upstream probe failed", "upstream", addr, slogutil.KeyError, probeErr)
+		failed = append(failed, fmt.Errorf("upstream %s: %w", addr, probeErr))
+	}
+
+	if c.Mode == StartupProbeModeStrict {
+		return errors.Join(failed...)
+	}
+
+	return nil
+}
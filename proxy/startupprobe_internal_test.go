@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Start_startupProbe(t *testing.T) {
+	t.Parallel()
+
+	const (
+		probeDomain = "probe.example."
+
+		goodAddr = "good.example"
+		badAddr  = "bad.example"
+	)
+
+	newUps := func(addr string, probeErr error) (u upstream.Upstream) {
+		return &dnsproxytest.Upstream{
+			OnAddress: func() (a string) { return addr },
+			OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+				require.Equal(testutil.PanicT{}, probeDomain, req.Question[0].Name)
+
+				if probeErr != nil {
+					return nil, probeErr
+				}
+
+				return (&dns.Msg{}).SetReply(req), nil
+			},
+			OnClose: func() (err error) { return nil },
+		}
+	}
+
+	good := newUps(goodAddr, nil)
+	bad := newUps(badAddr, errors.Error("no such host"))
+
+	testCases := []struct {
+		probe      *StartupProbeConfig
+		name       string
+		wantErrMsg string
+		upstreams  []upstream.Upstream
+	}{{
+		probe:      nil,
+		name:       "disabled",
+		wantErrMsg: "",
+		upstreams:  []upstream.Upstream{good, bad},
+	}, {
+		probe: &StartupProbeConfig{
+			Mode:   StartupProbeModeStrict,
+			Domain: probeDomain,
+		},
+		name:       "strict_success",
+		wantErrMsg: "",
+		upstreams:  []upstream.Upstream{good},
+	}, {
+		probe: &StartupProbeConfig{
+			Mode:   StartupProbeModeStrict,
+			Domain: probeDomain,
+		},
+		name:       "strict_failure",
+		wantErrMsg: "probing upstreams: upstream " + badAddr + ": no such host",
+		upstreams:  []upstream.Upstream{good, bad},
+	}, {
+		probe: &StartupProbeConfig{
+			Mode:   StartupProbeModeResilient,
+			Domain: probeDomain,
+		},
+		name:       "resilient_failure",
+		wantErrMsg: "",
+		upstreams:  []upstream.Upstream{good, bad},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := mustNew(t, &Config{
+				Logger:                 slogutil.NewDiscardLogger(),
+				UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig:         &UpstreamConfig{Upstreams: tc.upstreams},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				StartupProbe:           tc.probe,
+			})
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			err := p.Start(ctx)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if err != nil {
+				return
+			}
+
+			testutil.CleanupAndRequireSuccess(t, func() (err error) {
+				return p.Shutdown(context.Background())
+			})
+		})
+	}
+}
+
+func TestStartupProbeConfig_validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		conf       *StartupProbeConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &StartupProbeConfig{Mode: StartupProbeModeResilient},
+		name:       "default_domain",
+		wantErrMsg: "",
+	}, {
+		conf:       &StartupProbeConfig{Mode: "lenient"},
+		name:       "bad_mode",
+		wantErrMsg: `Mode: bad enum value: "lenient"`,
+	}, {
+		conf: &StartupProbeConfig{
+			Mode:   StartupProbeModeStrict,
+			Domain: "bad domain",
+		},
+		name: "bad_domain",
+		wantErrMsg: `Domain: bad domain name "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+
+	var mode StartupProbeMode
+	assert.Error(t, mode.UnmarshalText([]byte("lenient")))
+	assert.NoError(t, mode.UnmarshalText([]byte("strict")))
+	assert.Equal(t, StartupProbeModeStrict, mode)
+}
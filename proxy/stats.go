@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // upstreamWithStats is a wrapper around the [upstream.Upstream] interface that
@@ -17,6 +22,37 @@ type upstreamWithStats struct {
 	// err is the DNS lookup error, if any.
 	err error
 
+	// queries counts the exchanges with upstream.  It may be nil.
+	queries *atomic.Uint64
+
+	// metadataCounter counts the metadata provided by upstream.  It may be nil.
+	metadataCounter *upstreamMetadataCounter
+
+	// metadata is the metadata of the response of upstream, if any.
+	metadata *UpstreamMetadata
+
+	// refusals counts the refusals of upstream.  It may be nil.
+	refusals *upstreamRefusalCounter
+
+	// exchanges counts the results and the latencies of the exchanges with
+	// upstream.  It may be nil.
+	exchanges *upstreamExchangeCounter
+
+	// warmup delays the exchanges with upstream during the warm-up of the
+	// proactive refresh.  It may be nil.
+	warmup *refreshWarmup
+
+	// tracer creates the spans of the exchanges.  It may be nil.
+	tracer trace.Tracer
+
+	// timeouts limits the durations of the exchanges with upstream.  It may be
+	// nil.
+	timeouts *UpstreamTimeoutConfig
+
+	// refusalAction is the action taken on the refusals of upstream, see
+	// [Config.UpstreamRefusal].
+	refusalAction UpstreamRefusalAction
+
 	// queryDuration is the duration of the successful DNS lookup.
 	queryDuration time.Duration
 }
@@ -25,11 +61,31 @@ type upstreamWithStats struct {
 var _ upstream.Upstream = (*upstreamWithStats)(nil)
 
 // Exchange implements the [upstream.Upstream] for *upstreamWithStats.
-func (u *upstreamWithStats) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+func (u *upstreamWithStats) Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	u.warmup.wait(u.upstream.Address())
+
+	ctx, cancel := u.timeouts.withUpstreamTimeout(ctx, u.upstream.Address(), req)
+	defer cancel()
+
+	if u.queries != nil {
+		u.queries.Add(1)
+	}
+
+	ctx, span := u.startExchangeSpan(ctx, req)
+	defer func() { endSpan(span, resp, err) }()
+
 	start := time.Now()
-	resp, err = u.upstream.Exchange(req)
-	u.err = err
+	resp, err = u.upstream.Exchange(ctx, req)
 	u.queryDuration = time.Since(start)
+	u.exchanges.record(u.queryDuration, err)
+	u.metadata = newUpstreamMetadata(resp)
+	u.metadataCounter.record(u.metadata)
+
+	if err == nil {
+		resp, err = u.handleRefusal(req, resp)
+	}
+
+	u.err = err
 
 	return resp, err
 }
@@ -46,15 +102,190 @@ func (u *upstreamWithStats) Close() (err error) {
 
 // upstreamsWithStats takes a list of upstreams, wraps each upstream with
 // [upstreamWithStats] to gather statistics, and returns the wrapped upstreams.
-func upstreamsWithStats(upstreams []upstream.Upstream) (wrapped []upstream.Upstream) {
+// isRefresh tells if the upstreams are used for the proactive cache refresh,
+// so that the exchanges are limited during the warm-up.
+func (p *Proxy) upstreamsWithStats(
+	upstreams []upstream.Upstream,
+	isRefresh bool,
+) (wrapped []upstream.Upstream) {
+	var warmup *refreshWarmup
+	if isRefresh {
+		warmup = p.refreshWarmup
+	}
+
 	wrapped = make([]upstream.Upstream, 0, len(upstreams))
 	for _, u := range upstreams {
-		wrapped = append(wrapped, &upstreamWithStats{upstream: u})
+		c := p.queryCounter(u.Address())
+		queries := &c.user
+		if isRefresh {
+			queries = &c.refresh
+		}
+
+		wrapped = append(wrapped, &upstreamWithStats{
+			upstream:        u,
+			queries:         queries,
+			metadataCounter: &c.metadata,
+			refusals:        &c.refusals,
+			exchanges:       &c.exchanges,
+			warmup:          warmup,
+			tracer:          p.tracer,
+			timeouts:        p.UpstreamTimeouts,
+			refusalAction:   p.UpstreamRefusal,
+		})
 	}
 
 	return wrapped
 }
 
+// upstreamQueryCounter counts the queries sent to a single upstream.
+type upstreamQueryCounter struct {
+	// user counts the queries made to resolve the clients' requests.
+	user atomic.Uint64
+
+	// refresh counts the queries made by the proactive cache refresh.
+	refresh atomic.Uint64
+
+	// metadata counts the metadata provided by the upstream in its responses
+	// to the queries of both kinds.
+	metadata upstreamMetadataCounter
+
+	// refusals counts the refusals of the upstream in its responses to the
+	// queries of both kinds.
+	refusals upstreamRefusalCounter
+
+	// exchanges counts the results and the latencies of the exchanges of both
+	// kinds.
+	exchanges upstreamExchangeCounter
+}
+
+// queryCounter returns the counters of the upstream with addr, creating them if
+// necessary.
+func (p *Proxy) queryCounter(addr string) (counter *upstreamQueryCounter) {
+	p.queriesLock.Lock()
+	defer p.queriesLock.Unlock()
+
+	if p.upstreamQueries == nil {
+		p.upstreamQueries = map[string]*upstreamQueryCounter{}
+	}
+
+	counter, ok := p.upstreamQueries[addr]
+	if !ok {
+		counter = &upstreamQueryCounter{}
+		p.upstreamQueries[addr] = counter
+	}
+
+	return counter
+}
+
+// UpstreamQueryStatistics contains the numbers of queries sent to an upstream.
+type UpstreamQueryStatistics struct {
+	// Address is the address of the upstream.
+	Address string
+
+	// User is the number of queries made to resolve the clients' requests.
+	User uint64
+
+	// Refresh is the number of queries made by the proactive cache refresh.
+	Refresh uint64
+
+	// Refused is the number of responses with REFUSED, see
+	// [Config.UpstreamRefusal].
+	Refused uint64
+
+	// NotImplemented is the number of responses with NOTIMP, see
+	// [Config.UpstreamRefusal].
+	NotImplemented uint64
+}
+
+// UpstreamQueryStatistics returns the numbers of queries sent to each of the
+// upstreams used since p has been created, sorted by address.  The queries made
+// by the proactive cache refresh are counted separately, so that the load
+// caused by clients can be told apart.
+func (p *Proxy) UpstreamQueryStatistics() (stats []*UpstreamQueryStatistics) {
+	p.queriesLock.Lock()
+	defer p.queriesLock.Unlock()
+
+	stats = make([]*UpstreamQueryStatistics, 0, len(p.upstreamQueries))
+	for addr, c := range p.upstreamQueries {
+		stats = append(stats, &UpstreamQueryStatistics{
+			Address:        addr,
+			User:           c.user.Load(),
+			Refresh:        c.refresh.Load(),
+			Refused:        c.refusals.refused.Load(),
+			NotImplemented: c.refusals.notImplemented.Load(),
+		})
+	}
+
+	slices.SortFunc(stats, func(a, b *UpstreamQueryStatistics) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return stats
+}
+
+// Stats is the statistics gathered by a DNS server since its creation.  New
+// fields may be added to it, so that extending the statistics doesn't break the
+// implementations of [Statistics].
+type Stats struct {
+	// EDNSCompliance contains the numbers of the requests handled due to
+	// [Config.EDNSCompliance], see [Proxy.EDNSComplianceStatistics].
+	EDNSCompliance *EDNSComplianceStatistics
+
+	// Truncation contains the numbers of the truncated responses, see
+	// [Proxy.TruncationStatistics].
+	Truncation *TruncationStatistics
+
+	// Clients contains the statistics of the requests by the networks of the
+	// clients, see [Proxy.ClientStatistics].
+	Clients []*ClientStatistics
+
+	// CriticalNames contains the numbers of the upstream answers violating the
+	// constraints of the critical domain names, see
+	// [Proxy.CriticalNameStatistics].
+	CriticalNames []*CriticalNameStatistics
+
+	// RefreshSchedule contains the proactive refresh state of the cache
+	// entries, see [Proxy.RefreshSchedule].
+	RefreshSchedule []*RefreshScheduleEntry
+
+	// UpstreamMetadata contains the numbers of the responses with the metadata
+	// from each of the upstreams, see [Proxy.UpstreamMetadataStatistics].
+	UpstreamMetadata []*UpstreamMetadataStatistics
+
+	// UpstreamQueries contains the numbers of queries sent to each of the
+	// upstreams, see [Proxy.UpstreamQueryStatistics].
+	UpstreamQueries []*UpstreamQueryStatistics
+
+	// Upstreams contains the statistics of the exchanges with each of the
+	// upstreams, see [Proxy.UpstreamStats].
+	Upstreams []*UpstreamStats
+
+	// Zones contains the cache statistics by registered domain, see
+	// [Proxy.ZoneStatistics].
+	Zones []*ZoneStatistics
+
+	// RebindAttempts is the number of upstream responses replaced due to the
+	// DNS rebinding protection, see [Proxy.RebindAttempts].
+	RebindAttempts uint64
+}
+
+// Stats returns all the statistics gathered since p has been created.  Each
+// field is filled by the corresponding method of p.
+func (p *Proxy) Stats() (s *Stats) {
+	return &Stats{
+		EDNSCompliance:   p.EDNSComplianceStatistics(),
+		Truncation:       p.TruncationStatistics(),
+		Clients:          p.ClientStatistics(),
+		CriticalNames:    p.CriticalNameStatistics(),
+		RefreshSchedule:  p.RefreshSchedule(),
+		UpstreamMetadata: p.UpstreamMetadataStatistics(),
+		UpstreamQueries:  p.UpstreamQueryStatistics(),
+		Upstreams:        p.UpstreamStats(),
+		Zones:            p.ZoneStatistics(),
+		RebindAttempts:   p.RebindAttempts(),
+	}
+}
+
 // QueryStatistics contains the DNS query statistics for both the upstream and
 // fallback DNS servers.
 //
@@ -151,13 +382,33 @@ type UpstreamStatistics struct {
 	// contain one.
 	Address string
 
+	// Metadata is the metadata provided by the upstream in its response, if
+	// any.
+	Metadata *UpstreamMetadata
+
 	// QueryDuration is the duration of the successful DNS lookup.
 	QueryDuration time.Duration
 
+	// streams counts the requests in flight per connection of the upstream.
+	// It's nil if the upstream doesn't multiplex requests over connections.
+	streams upstream.StreamCounter
+
 	// IsCached indicates whether the response was served from a cache.
 	IsCached bool
 }
 
+// Streams returns the number of requests currently in flight for each
+// connection of the upstream.  The numbers are only read when it's called, so
+// they may change since the DNS lookup.  It returns nil if the upstream doesn't
+// multiplex requests over connections, see [upstream.StreamCounter].
+func (s *UpstreamStatistics) Streams() (counts map[string]int) {
+	if s.streams == nil {
+		return nil
+	}
+
+	return s.streams.Streams()
+}
+
 // collectUpstreamStats gathers the upstream statistics from the list of wrapped
 // upstreams.  upstreams must be of type *upstreamWithStats.
 func collectUpstreamStats(upstreams ...upstream.Upstream) (stats []*UpstreamStatistics) {
@@ -170,11 +421,20 @@ func collectUpstreamStats(upstreams ...upstream.Upstream) (stats []*UpstreamStat
 			panic(fmt.Errorf("unexpected type %T", u))
 		}
 
-		stats = append(stats, &UpstreamStatistics{
+		st := &UpstreamStatistics{
 			Error:         w.err,
 			Address:       w.Address(),
+			Metadata:      w.metadata,
 			QueryDuration: w.queryDuration,
-		})
+		}
+
+		// Don't read the counts until the statistics are requested, since
+		// copying them on each exchange is wasteful.
+		if sc, isCounter := w.upstream.(upstream.StreamCounter); isCounter {
+			st.streams = sc
+		}
+
+		stats = append(stats, st)
 	}
 
 	return stats
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_UpstreamQueryStatistics(t *testing.T) {
+	const upsAddr = "upstream"
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				newRR(t, req.Question[0].Name, dns.TypeA, defaultTestTTL, net.IP{192, 0, 2, 1}),
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return upsAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	assert.Empty(t, p.UpstreamQueryStatistics())
+
+	cliAddr := netip.MustParseAddrPort("192.0.2.2:53")
+	for _, name := range []string{"first.example.", "second.example."} {
+		d := p.newDNSContext(ProtoUDP, (&dns.Msg{}).SetQuestion(name, dns.TypeA), cliAddr)
+		require.NoError(t, p.Resolve(context.Background(), d))
+	}
+
+	refresh := &DNSContext{
+		Req:       (&dns.Msg{}).SetQuestion("first.example.", dns.TypeA),
+		isRefresh: true,
+	}
+	ok, err := p.replyFromUpstream(context.Background(), refresh)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Equal(t, []*UpstreamQueryStatistics{{
+		Address: upsAddr,
+		User:    2,
+		Refresh: 1,
+	}}, p.UpstreamQueryStatistics())
+
+	stats := p.Stats()
+	assert.Equal(t, p.UpstreamQueryStatistics(), stats.UpstreamQueries)
+
+	require.Len(t, stats.Upstreams, 1)
+	assert.Equal(t, upsAddr, stats.Upstreams[0].Address)
+	assert.Equal(t, uint64(3), stats.Upstreams[0].Queries)
+}
@@ -1,6 +1,7 @@
 package proxy_test
 
 import (
+	"context"
 	"net"
 	"net/netip"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,7 +35,7 @@ func TestCollectQueryStats(t *testing.T) {
 	)
 
 	ups := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			return (&dns.Msg{}).SetReply(req), nil
 		},
 		OnAddress: func() (addr string) { return "upstream" },
@@ -41,7 +43,7 @@ func TestCollectQueryStats(t *testing.T) {
 	}
 
 	failUps := &dnsproxytest.Upstream{
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			return nil, errors.Error("exchange error")
 		},
 		OnAddress: func() (addr string) { return "fail.upstream" },
@@ -218,9 +220,11 @@ func TestCollectQueryStats(t *testing.T) {
 			p, err := proxy.New(conf)
 			require.NoError(t, err)
 
+			servicetest.RequireRun(t, p, testTimeout)
+
 			d := &proxy.DNSContext{Req: testReq}
 
-			err = p.Resolve(d)
+			err = p.Resolve(context.Background(), d)
 			tc.wantErr(t, err)
 
 			stats := d.QueryStatistics()
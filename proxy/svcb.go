@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// isSVCBType returns true if qtype is the type of service binding records,
+// i.e. SVCB or HTTPS, see RFC 9460.
+func isSVCBType(qtype uint16) (ok bool) {
+	return qtype == dns.TypeSVCB || qtype == dns.TypeHTTPS
+}
+
+// hasAnsOfType returns true if the answer section of m contains at least one
+// RR of type rrType.
+func hasAnsOfType(m *dns.Msg, rrType uint16) (ok bool) {
+	return slices.ContainsFunc(m.Answer, func(rr dns.RR) (found bool) {
+		return rr.Header().Rrtype == rrType
+	})
+}
+
+// svcbOf returns the SVCB data of rr if it's an SVCB or an HTTPS record.
+func svcbOf(rr dns.RR) (svcb *dns.SVCB, ok bool) {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr, true
+	case *dns.HTTPS:
+		return &rr.SVCB, true
+	default:
+		return nil, false
+	}
+}
+
+// stripECH removes the ECH configurations from all the SVCB and HTTPS records
+// of m, so that clients don't try to use Encrypted Client Hello, see RFC 9460
+// Section 14.3.1.  It returns true if anything has been removed.  Note that it
+// invalidates the DNSSEC signatures of the modified records.  m must not be
+// nil.
+func stripECH(m *dns.Msg) (stripped bool) {
+	for _, rrs := range [...][]dns.RR{m.Answer, m.Extra} {
+		for _, rr := range rrs {
+			svcb, ok := svcbOf(rr)
+			if !ok {
+				continue
+			}
+
+			l := len(svcb.Value)
+			svcb.Value = slices.DeleteFunc(svcb.Value, func(kv dns.SVCBKeyValue) (ok bool) {
+				return kv.Key() == dns.SVCB_ECHCONFIG
+			})
+			stripped = stripped || len(svcb.Value) < l
+		}
+	}
+
+	return stripped
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSVCBRR returns a new SVCB record for name with the ECH configuration and
+// the IPv4 hint.
+func newSVCBRR(name string) (rr *dns.SVCB) {
+	return &dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSVCB,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Priority: 1,
+		Target:   ".",
+		Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h2", "h3"}},
+			&dns.SVCBECHConfig{ECH: []byte{1, 2, 3, 4}},
+			&dns.SVCBIPv4Hint{Hint: []net.IP{{1, 2, 3, 4}}},
+		},
+	}
+}
+
+// newHTTPSRR returns a new HTTPS record for name with the same data as
+// [newSVCBRR].
+func newHTTPSRR(name string) (rr *dns.HTTPS) {
+	rr = &dns.HTTPS{SVCB: *newSVCBRR(name)}
+	rr.Hdr.Rrtype = dns.TypeHTTPS
+
+	return rr
+}
+
+func TestCacheTTL_svcb(t *testing.T) {
+	const name = "example.org."
+
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "org.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Ns:   "ns.org.",
+		Mbox: "hostmaster.org.",
+	}
+
+	cname := &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    defaultTestTTL,
+		},
+		Target: "cdn.example.",
+	}
+
+	testCases := []struct {
+		ans     []dns.RR
+		ns      []dns.RR
+		name    string
+		qtype   uint16
+		wantTTL uint32
+	}{{
+		ans:     []dns.RR{newHTTPSRR(name)},
+		ns:      nil,
+		name:    "https",
+		qtype:   dns.TypeHTTPS,
+		wantTTL: defaultTestTTL,
+	}, {
+		ans:     []dns.RR{newSVCBRR(name)},
+		ns:      nil,
+		name:    "svcb",
+		qtype:   dns.TypeSVCB,
+		wantTTL: defaultTestTTL,
+	}, {
+		ans:     nil,
+		ns:      []dns.RR{soa},
+		name:    "nodata_soa",
+		qtype:   dns.TypeHTTPS,
+		wantTTL: defaultTestTTL,
+	}, {
+		ans:     []dns.RR{cname},
+		ns:      nil,
+		name:    "cname_only",
+		qtype:   dns.TypeHTTPS,
+		wantTTL: 0,
+	}, {
+		ans:     []dns.RR{cname},
+		ns:      nil,
+		name:    "cname_only_txt",
+		qtype:   dns.TypeTXT,
+		wantTTL: defaultTestTTL,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := (&dns.Msg{}).SetQuestion(name, tc.qtype)
+			m.Response = true
+			m.Answer = tc.ans
+			m.Ns = tc.ns
+
+			assert.Equal(t, tc.wantTTL, cacheTTL(m, slogutil.NewDiscardLogger()))
+		})
+	}
+}
+
+func TestStripECH(t *testing.T) {
+	const name = "example.org."
+
+	m := (&dns.Msg{}).SetQuestion(name, dns.TypeHTTPS)
+	m.Answer = []dns.RR{newHTTPSRR(name)}
+	m.Extra = []dns.RR{newSVCBRR(name)}
+
+	require.True(t, stripECH(m))
+
+	for _, rr := range []dns.RR{m.Answer[0], m.Extra[0]} {
+		svcb, ok := svcbOf(rr)
+		require.True(t, ok)
+		require.Len(t, svcb.Value, 2)
+
+		assert.Equal(t, dns.SVCB_ALPN, svcb.Value[0].Key())
+		assert.Equal(t, dns.SVCB_IPV4HINT, svcb.Value[1].Key())
+	}
+
+	assert.False(t, stripECH(m))
+}
+
+func TestProxy_Resolve_stripECH(t *testing.T) {
+	const name = "example.org."
+
+	var queries atomic.Uint32
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			queries.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newHTTPSRR(req.Question[0].Name)}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		StripECH:               true,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	for range 2 {
+		d := &DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion(name, dns.TypeHTTPS),
+			Addr: netip.MustParseAddrPort("1.2.3.4:53"),
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+		require.Len(t, d.Res.Answer, 1)
+
+		https := testutil.RequireTypeAssert[*dns.HTTPS](t, d.Res.Answer[0])
+		assert.Len(t, https.Value, 2)
+	}
+
+	// The second response is served from cache.
+	assert.Equal(t, uint32(1), queries.Load())
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// PipelineStage is a stage of processing a DNS request.
+type PipelineStage string
+
+// Pipeline stages in the order they are passed, see [PipelineStages].
+const (
+	// StageBeforeRequest is the call of [Config.BeforeRequestHandler].
+	StageBeforeRequest PipelineStage = "before_request"
+
+	// StageRatelimit is the rate limiting of UDP requests, see
+	// [Config.Ratelimit].
+	StageRatelimit PipelineStage = "ratelimit"
+
+	// StageValidation is the check of the request itself, e.g. the number of
+	// questions, [Config.RefuseAny], or the recursion detection.
+	StageValidation PipelineStage = "validation"
+
+	// StageRequestHandler is the call of [Config.RequestHandler], which is
+	// expected to handle the local records, rewrites, and blocklists, and to
+	// call [Proxy.Resolve] for the rest of the requests.
+	StageRequestHandler PipelineStage = "request_handler"
+
+	// StageCache is the lookup in the cache.
+	StageCache PipelineStage = "cache"
+
+	// StagePending is the coalescing of the concurrent identical requests, see
+	// [Config.PendingRequests].
+	StagePending PipelineStage = "pending"
+
+	// StageRouting is the selection of upstreams for the request.
+	StageRouting PipelineStage = "routing"
+
+	// StageUpstream is the exchange with the selected upstreams.
+	StageUpstream PipelineStage = "upstream"
+
+	// StageFallback is the exchange with [Config.Fallbacks] after the selected
+	// upstreams fail.
+	StageFallback PipelineStage = "fallback"
+
+	// StageResponse is the post-processing of the upstream response, like
+	// DNS64, bogus NXDOMAIN, and DNS rebinding protection.
+	StageResponse PipelineStage = "response"
+)
+
+// pipelineStages is the order of [PipelineStage]s.
+var pipelineStages = []PipelineStage{
+	StageBeforeRequest,
+	StageRatelimit,
+	StageValidation,
+	StageRequestHandler,
+	StageCache,
+	StagePending,
+	StageRouting,
+	StageUpstream,
+	StageFallback,
+	StageResponse,
+}
+
+// PipelineStages returns the stages of processing a DNS request in the order
+// they are passed.  Each stage may complete the processing with a response, so
+// that the following ones are skipped.  The stages following
+// [StageRequestHandler] are only passed if the request handler calls
+// [Proxy.Resolve].
+func PipelineStages() (stages []PipelineStage) {
+	return slices.Clone(pipelineStages)
+}
+
+// TraceStep is a single decision made while processing a DNS request.
+type TraceStep struct {
+	// Stage is the stage the decision is made on.
+	Stage PipelineStage
+
+	// Decision is the human-readable description of the decision.
+	Decision string
+}
+
+// requestTrace accumulates the decisions made for a traced request.
+type requestTrace struct {
+	steps []TraceStep
+}
+
+// addTrace records the decision made on stage, if dctx is traced.
+func (dctx *DNSContext) addTrace(stage PipelineStage, decision string) {
+	if dctx.trace != nil {
+		dctx.trace.steps = append(dctx.trace.steps, TraceStep{
+			Stage:    stage,
+			Decision: decision,
+		})
+	}
+}
+
+// addTracef is like [DNSContext.addTrace] but formats the decision.
+func (dctx *DNSContext) addTracef(stage PipelineStage, format string, args ...any) {
+	if dctx.trace != nil {
+		dctx.addTrace(stage, fmt.Sprintf(format, args...))
+	}
+}
+
+// traceExchange records the result of the exchange with u on stage, if dctx is
+// traced.
+func (dctx *DNSContext) traceExchange(stage PipelineStage, u upstream.Upstream, err error) {
+	if dctx.trace == nil {
+		return
+	}
+
+	if err != nil {
+		dctx.addTracef(stage, "failed: %s", err)
+	} else {
+		dctx.addTracef(stage, "resolved by %s", u.Address())
+	}
+}
+
+// Trace processes req as if it's received from addr over proto, but returns
+// the response instead of sending it, along with the decisions made on the
+// passed stages, see [PipelineStages].  It's intended for debugging, note that
+// the request is actually resolved, so it affects the cache and the
+// statistics.  req must not be nil.
+func (p *Proxy) Trace(
+	ctx context.Context,
+	req *dns.Msg,
+	addr netip.AddrPort,
+	proto Proto,
+) (resp *dns.Msg, steps []TraceStep, err error) {
+	d := p.newDNSContext(proto, req, addr)
+	d.trace = &requestTrace{}
+
+	err = p.handleDNSRequest(ctx, d)
+
+	return d.Res, d.trace.steps, err
+}
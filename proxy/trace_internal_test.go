@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Trace(t *testing.T) {
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			name := req.Question[0].Name
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, name, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		RefuseAny:              true,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	cliAddr := netip.MustParseAddrPort("192.0.2.1:53")
+
+	testCases := []struct {
+		req       *dns.Msg
+		name      string
+		wantSteps []TraceStep
+	}{{
+		req:  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+		name: "miss",
+		wantSteps: []TraceStep{
+			{Stage: StageBeforeRequest, Decision: "passed"},
+			{Stage: StageValidation, Decision: "passed"},
+			{Stage: StageRequestHandler, Decision: "default"},
+			{Stage: StageCache, Decision: "miss"},
+			{Stage: StageRouting, Decision: "general upstreams: 1"},
+			{Stage: StageUpstream, Decision: "resolved by upstream"},
+		},
+	}, {
+		req:  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+		name: "hit",
+		wantSteps: []TraceStep{
+			{Stage: StageBeforeRequest, Decision: "passed"},
+			{Stage: StageValidation, Decision: "passed"},
+			{Stage: StageRequestHandler, Decision: "default"},
+			{Stage: StageCache, Decision: "hit"},
+		},
+	}, {
+		req:  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeANY),
+		name: "refused",
+		wantSteps: []TraceStep{
+			{Stage: StageBeforeRequest, Decision: "passed"},
+			{Stage: StageValidation, Decision: "refused type any"},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, steps, err := p.Trace(context.Background(), tc.req, cliAddr, ProtoUDP)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantSteps, steps)
+		})
+	}
+}
+
+func TestPipelineStages(t *testing.T) {
+	stages := PipelineStages()
+	require.NotEmpty(t, stages)
+
+	assert.Equal(t, StageBeforeRequest, stages[0])
+	assert.Equal(t, StageResponse, stages[len(stages)-1])
+
+	// Make sure the returned slice is a copy.
+	stages[0] = StageResponse
+	assert.Equal(t, StageBeforeRequest, PipelineStages()[0])
+}
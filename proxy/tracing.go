@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracerName is the name of the OpenTelemetry tracer used by the proxy, see
+// [Config.TracerProvider].
+const TracerName = "github.com/AdguardTeam/dnsproxy/proxy"
+
+// Names of the spans created by the proxy.
+const (
+	// SpanResolve is the name of the span covering [Proxy.Resolve].
+	SpanResolve = "dnsproxy.resolve"
+
+	// SpanCacheLookup is the name of the span covering the lookup of the
+	// response in the cache.
+	SpanCacheLookup = "dnsproxy.cache.lookup"
+
+	// SpanUpstreamExchange is the name of the span covering a single exchange
+	// with an upstream.
+	SpanUpstreamExchange = "dnsproxy.upstream.exchange"
+
+	// SpanCacheRefresh is the name of the span covering the proactive refresh
+	// of a cached response.
+	SpanCacheRefresh = "dnsproxy.cache.refresh"
+)
+
+// Attributes of the spans created by the proxy.
+const (
+	attrQuestionName = attribute.Key("dns.question.name")
+	attrQuestionType = attribute.Key("dns.question.type")
+	attrProto        = attribute.Key("dns.proto")
+	attrRcode        = attribute.Key("dns.response.rcode")
+	attrCacheHit     = attribute.Key("dnsproxy.cache.hit")
+	attrUpstream     = attribute.Key("dnsproxy.upstream")
+)
+
+// newTracer returns the tracer of the proxy from tp.  It returns nil if tp is
+// nil, so that no spans are created at all.
+func newTracer(tp trace.TracerProvider) (t trace.Tracer) {
+	if tp == nil {
+		return nil
+	}
+
+	return tp.Tracer(TracerName)
+}
+
+// startSpan starts the span named name using t.  If t is nil, it returns ctx
+// and a no-op span without allocating.
+func startSpan(
+	ctx context.Context,
+	t trace.Tracer,
+	name string,
+	opts ...trace.SpanStartOption,
+) (spanCtx context.Context, span trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+
+	return t.Start(ctx, name, opts...)
+}
+
+// startResolveSpan starts the span of resolving dctx.  The attributes are only
+// built if the tracing is enabled.
+func (p *Proxy) startResolveSpan(
+	ctx context.Context,
+	dctx *DNSContext,
+) (spanCtx context.Context, span trace.Span) {
+	if p.tracer == nil {
+		return ctx, noop.Span{}
+	}
+
+	attrs := append(questionAttrs(dctx.Req), attrProto.String(string(dctx.Proto)))
+
+	return p.tracer.Start(ctx, SpanResolve, trace.WithAttributes(attrs...))
+}
+
+// startExchangeSpan starts the span of exchanging req with u.  The attributes
+// are only built if the tracing is enabled.
+func (u *upstreamWithStats) startExchangeSpan(
+	ctx context.Context,
+	req *dns.Msg,
+) (spanCtx context.Context, span trace.Span) {
+	if u.tracer == nil {
+		return ctx, noop.Span{}
+	}
+
+	attrs := append(questionAttrs(req), attrUpstream.String(u.upstream.Address()))
+
+	return u.tracer.Start(
+		ctx,
+		SpanUpstreamExchange,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// startRefreshSpan starts the root span of the proactive refresh of the entry
+// for req.  The attributes are only built if the tracing is enabled.
+func (c *cache) startRefreshSpan(
+	ctx context.Context,
+	req *dns.Msg,
+) (spanCtx context.Context, span trace.Span) {
+	if c.tracer == nil {
+		return ctx, noop.Span{}
+	}
+
+	return c.tracer.Start(
+		ctx,
+		SpanCacheRefresh,
+		trace.WithNewRoot(),
+		trace.WithAttributes(questionAttrs(req)...),
+	)
+}
+
+// questionAttrs returns the attributes describing the question of req, if any.
+func questionAttrs(req *dns.Msg) (attrs []attribute.KeyValue) {
+	if req == nil || len(req.Question) == 0 {
+		return nil
+	}
+
+	q := req.Question[0]
+
+	return []attribute.KeyValue{
+		attrQuestionName.String(q.Name),
+		attrQuestionType.String(dns.Type(q.Qtype).String()),
+	}
+}
+
+// endSpan sets the rcode of resp, if any, records err, if any, and ends span.
+func endSpan(span trace.Span, resp *dns.Msg, err error) {
+	if !span.IsRecording() {
+		span.End()
+
+		return
+	}
+
+	if resp != nil {
+		span.SetAttributes(attrRcode.String(dns.RcodeToString[resp.Rcode]))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestTracerProvider returns a tracer provider recording the ended spans to
+// the returned recorder.
+func newTestTracerProvider(tb testing.TB) (
+	tp *sdktrace.TracerProvider,
+	rec *tracetest.SpanRecorder,
+) {
+	tb.Helper()
+
+	rec = tracetest.NewSpanRecorder()
+	tp = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tb.Cleanup(func() { require.NoError(tb, tp.Shutdown(context.Background())) })
+
+	return tp, rec
+}
+
+// spansByName returns the ended spans recorded by rec with the name.
+func spansByName(rec *tracetest.SpanRecorder, name string) (spans []sdktrace.ReadOnlySpan) {
+	for _, s := range rec.Ended() {
+		if s.Name() == name {
+			spans = append(spans, s)
+		}
+	}
+
+	return spans
+}
+
+// spanAttr returns the value of the attribute of s with key.
+func spanAttr(s sdktrace.ReadOnlySpan, key attribute.Key) (v attribute.Value) {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestProxy_Resolve_tracing(t *testing.T) {
+	const host = "traced.example."
+
+	tp, rec := newTestTracerProvider(t)
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return "upstream" },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:         slogutil.NewDiscardLogger(),
+		UDPListenAddr:  []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{ups}},
+		TrustedProxies: defaultTrustedProxies,
+		CacheEnabled:   true,
+		CacheSizeBytes: testCacheSize,
+		TracerProvider: tp,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func() {
+		d := &DNSContext{
+			Proto: ProtoUDP,
+			Req:   (&dns.Msg{}).SetQuestion(host, dns.TypeA),
+			Addr:  netip.MustParseAddrPort("1.2.3.4:53"),
+		}
+		require.NoError(t, p.Resolve(context.Background(), d))
+	}
+
+	// The first request misses the cache and the second one hits it.
+	resolve()
+	resolve()
+
+	resolveSpans := spansByName(rec, SpanResolve)
+	require.Len(t, resolveSpans, 2)
+
+	miss, hit := resolveSpans[0], resolveSpans[1]
+	assert.Equal(t, host, spanAttr(miss, attrQuestionName).AsString())
+	assert.Equal(t, "A", spanAttr(miss, attrQuestionType).AsString())
+	assert.Equal(t, string(ProtoUDP), spanAttr(miss, attrProto).AsString())
+	assert.Equal(t, "NOERROR", spanAttr(miss, attrRcode).AsString())
+	assert.False(t, spanAttr(miss, attrCacheHit).AsBool())
+	assert.True(t, spanAttr(hit, attrCacheHit).AsBool())
+
+	lookupSpans := spansByName(rec, SpanCacheLookup)
+	require.Len(t, lookupSpans, 2)
+
+	for i, s := range lookupSpans {
+		assert.Equal(t, resolveSpans[i].SpanContext().SpanID(), s.Parent().SpanID())
+	}
+
+	exchSpans := spansByName(rec, SpanUpstreamExchange)
+	require.Len(t, exchSpans, 1)
+
+	exch := exchSpans[0]
+	assert.Equal(t, miss.SpanContext().TraceID(), exch.SpanContext().TraceID())
+	assert.Equal(t, "upstream", spanAttr(exch, attrUpstream).AsString())
+	assert.Equal(t, codes.Unset, exch.Status().Code)
+}
+
+func TestCache_refreshEntry_tracing(t *testing.T) {
+	const host = "refreshed.example."
+
+	tp, rec := newTestTracerProvider(t)
+
+	c := newCache(&cacheConfig{
+		size:       testCacheSize,
+		optimistic: true,
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.tracer = newTracer(tp)
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+			return false, assert.AnError
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	c.refreshEntry(string(msgToKey(req)), req)
+
+	spans := spansByName(rec, SpanCacheRefresh)
+	require.Len(t, spans, 1)
+
+	s := spans[0]
+	assert.False(t, s.Parent().IsValid())
+	assert.Equal(t, host, spanAttr(s, attrQuestionName).AsString())
+	assert.Equal(t, codes.Error, s.Status().Code)
+	assert.Equal(t, assert.AnError.Error(), s.Status().Description)
+}
+
+func TestStartSpan_disabled(t *testing.T) {
+	ctx := context.Background()
+	spanCtx, span := startSpan(ctx, nil, SpanResolve)
+
+	assert.Equal(t, ctx, spanCtx)
+	assert.False(t, span.IsRecording())
+	assert.Zero(t, testing.AllocsPerRun(10, func() {
+		_, span = startSpan(ctx, nil, SpanResolve)
+		endSpan(span, nil, nil)
+	}))
+}
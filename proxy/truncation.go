@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// TruncationConfig is the configuration of setting the TC flag in the UDP
+// responses to clients.  Regardless of it, the responses exceeding the buffer
+// size advertised by the client are always truncated.
+type TruncationConfig struct {
+	// MaxUDPSize is the maximum size of UDP responses.  The responses exceeding
+	// it are truncated even if the client advertises a larger buffer.  Zero
+	// means no limit besides the client's buffer size, otherwise it must not be
+	// less than [dns.MinMsgSize].
+	MaxUDPSize uint16
+
+	// ResponseUDPSize, if not zero, is the EDNS UDP payload size advertised to
+	// clients in the OPT records of the responses, see RFC 6891 Section 6.2.5.
+	// Otherwise, the size advertised by the upstream or the client is kept.  It
+	// must not be less than [dns.MinMsgSize].
+	ResponseUDPSize uint16
+
+	// TruncateANY makes proxy respond to all the UDP requests of type ANY with
+	// empty truncated responses, so that the clients retry over TCP.  It has no
+	// effect if [Config.RefuseAny] is true, and for the requests answered
+	// according to [Config.ANYQuery].
+	TruncateANY bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *TruncationConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	var errs []error
+	if c.MaxUDPSize != 0 && c.MaxUDPSize < dns.MinMsgSize {
+		errs = append(errs, fmt.Errorf("max udp size: %d is less than %d", c.MaxUDPSize, dns.MinMsgSize))
+	}
+
+	if c.ResponseUDPSize != 0 && c.ResponseUDPSize < dns.MinMsgSize {
+		errs = append(errs, fmt.Errorf(
+			"response udp size: %d is less than %d",
+			c.ResponseUDPSize,
+			dns.MinMsgSize,
+		))
+	}
+
+	return errors.Join(errs...)
+}
+
+// TruncationStatistics contains the numbers of the responses sent to clients
+// with the TC flag set, by the reason.
+type TruncationStatistics struct {
+	// Responses is the total number of responses sent to clients, including
+	// the truncated ones.
+	Responses uint64
+
+	// ClientBuffer is the number of responses exceeding the buffer size
+	// advertised by the client.
+	ClientBuffer uint64
+
+	// MaxUDPSize is the number of responses exceeding
+	// [TruncationConfig.MaxUDPSize] but not the client's buffer size.
+	MaxUDPSize uint64
+
+	// ANY is the number of responses to the requests of type ANY truncated due
+	// to [TruncationConfig.TruncateANY].
+	ANY uint64
+
+	// Upstream is the number of responses already truncated by the upstream.
+	Upstream uint64
+}
+
+// Truncated returns the total number of the truncated responses.  s must not
+// be nil.
+func (s *TruncationStatistics) Truncated() (n uint64) {
+	return s.ClientBuffer + s.MaxUDPSize + s.ANY + s.Upstream
+}
+
+// Rate returns the share of the truncated responses among all the responses
+// sent to clients, from 0 to 1.  It returns 0 if there were no responses.  s
+// must not be nil.
+func (s *TruncationStatistics) Rate() (r float64) {
+	if s.Responses == 0 {
+		return 0
+	}
+
+	return float64(s.Truncated()) / float64(s.Responses)
+}
+
+// truncationCounters is the concurrency-safe storage of the data for
+// [TruncationStatistics].
+type truncationCounters struct {
+	responses    atomic.Uint64
+	clientBuffer atomic.Uint64
+	maxUDPSize   atomic.Uint64
+	any          atomic.Uint64
+	upstream     atomic.Uint64
+}
+
+// TruncationStatistics returns the numbers of the truncated responses sent to
+// clients since p has been created.
+func (p *Proxy) TruncationStatistics() (s *TruncationStatistics) {
+	return &TruncationStatistics{
+		Responses:    p.truncated.responses.Load(),
+		ClientBuffer: p.truncated.clientBuffer.Load(),
+		MaxUDPSize:   p.truncated.maxUDPSize.Load(),
+		ANY:          p.truncated.any.Load(),
+		Upstream:     p.truncated.upstream.Load(),
+	}
+}
+
+// shouldTruncateANY returns true if d is a UDP request of type ANY and p is
+// configured to truncate those.  d.Req must have a question.
+func (p *Proxy) shouldTruncateANY(d *DNSContext) (ok bool) {
+	return p.Truncation != nil &&
+		p.Truncation.TruncateANY &&
+		d.Proto == ProtoUDP &&
+		d.Req.Question[0].Qtype == dns.TypeANY
+}
+
+// newMsgTruncatedANY returns an empty truncated response for req of type ANY.
+func (p *Proxy) newMsgTruncatedANY(req *dns.Msg) (resp *dns.Msg) {
+	p.truncated.responses.Add(1)
+	p.truncated.any.Add(1)
+
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Truncated = true
+	resp.RecursionAvailable = true
+
+	return resp
+}
+
+// truncate applies the truncation policy of p to dctx.Res, which should be
+// prepared with [DNSContext.scrub] already.  The responses to cache hits and
+// the ones from upstreams are handled the same way.
+func (p *Proxy) truncate(dctx *DNSContext) {
+	res := dctx.Res
+	if res == nil || dctx.Req == nil {
+		return
+	}
+
+	p.truncated.responses.Add(1)
+
+	// Some devices require DNS message compression.
+	defer func() { res.Compress = true }()
+
+	if opt := res.IsEdns0(); opt != nil && p.responseUDPSize() != 0 {
+		opt.SetUDPSize(p.responseUDPSize())
+	}
+
+	if res.Truncated {
+		p.truncated.upstream.Add(1)
+
+		return
+	}
+
+	isUDP := dctx.Proto == ProtoUDP
+	size := dnsSize(isUDP, dctx.Req)
+
+	counter := &p.truncated.clientBuffer
+	if maxSize := p.maxUDPSize(); isUDP && maxSize != 0 && maxSize < size {
+		size = maxSize
+		counter = &p.truncated.maxUDPSize
+	}
+
+	res.Truncate(int(size))
+	if res.Truncated {
+		counter.Add(1)
+	}
+}
+
+// maxUDPSize returns the configured maximum size of UDP responses, if any.
+func (p *Proxy) maxUDPSize() (size uint16) {
+	if p.Truncation == nil {
+		return 0
+	}
+
+	return p.Truncation.MaxUDPSize
+}
+
+// responseUDPSize returns the configured EDNS UDP payload size advertised to
+// clients, if any.
+func (p *Proxy) responseUDPSize() (size uint16) {
+	if p.Truncation == nil {
+		return 0
+	}
+
+	return p.Truncation.ResponseUDPSize
+}
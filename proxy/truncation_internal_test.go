@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_truncate(t *testing.T) {
+	const (
+		host = "example.org."
+
+		// ansNum is the number of answers making the response larger than
+		// [dns.MinMsgSize] but less than [defaultUDPBufSize].
+		ansNum = 64
+	)
+
+	newResp := func(req *dns.Msg) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetReply(req)
+		for i := range ansNum {
+			resp.Answer = append(resp.Answer, newRR(t, host, dns.TypeA, 60, net.IP{1, 2, 3, byte(i)}))
+		}
+
+		return resp
+	}
+
+	testCases := []struct {
+		conf      *TruncationConfig
+		want      *TruncationStatistics
+		name      string
+		proto     Proto
+		edns      bool
+		truncUps  bool
+		wantTrunc bool
+	}{{
+		conf:      nil,
+		want:      &TruncationStatistics{Responses: 1, ClientBuffer: 1},
+		name:      "client_buffer",
+		proto:     ProtoUDP,
+		edns:      false,
+		wantTrunc: true,
+	}, {
+		conf:      nil,
+		want:      &TruncationStatistics{Responses: 1},
+		name:      "fits",
+		proto:     ProtoUDP,
+		edns:      true,
+		wantTrunc: false,
+	}, {
+		conf:      &TruncationConfig{MaxUDPSize: dns.MinMsgSize},
+		want:      &TruncationStatistics{Responses: 1, MaxUDPSize: 1},
+		name:      "max_udp_size",
+		proto:     ProtoUDP,
+		edns:      true,
+		wantTrunc: true,
+	}, {
+		conf:      &TruncationConfig{MaxUDPSize: dns.MinMsgSize},
+		want:      &TruncationStatistics{Responses: 1},
+		name:      "max_udp_size_tcp",
+		proto:     ProtoTCP,
+		edns:      true,
+		wantTrunc: false,
+	}, {
+		conf:      nil,
+		want:      &TruncationStatistics{Responses: 1, Upstream: 1},
+		name:      "upstream",
+		proto:     ProtoTCP,
+		edns:      true,
+		truncUps:  true,
+		wantTrunc: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{Config: Config{Truncation: tc.conf}}
+
+			req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+			if tc.edns {
+				req.SetEdns0(defaultUDPBufSize, false)
+			}
+
+			dctx := &DNSContext{
+				Proto: tc.proto,
+				Req:   req,
+				Res:   newResp(req),
+			}
+			dctx.Res.Truncated = tc.truncUps
+
+			dctx.scrub()
+			p.truncate(dctx)
+
+			assert.Equal(t, tc.wantTrunc, dctx.Res.Truncated)
+			assert.Equal(t, tc.want, p.TruncationStatistics())
+		})
+	}
+}
+
+func TestProxy_validateRequest_truncateANY(t *testing.T) {
+	p := &Proxy{
+		Config: Config{Truncation: &TruncationConfig{TruncateANY: true}},
+		logger: slogutil.NewDiscardLogger(),
+	}
+	p.initLoggers()
+
+	d := &DNSContext{
+		Proto: ProtoUDP,
+		Req:   (&dns.Msg{}).SetQuestion("example.org.", dns.TypeANY),
+	}
+
+	resp := p.validateRequest(d)
+	require.NotNil(t, resp)
+
+	assert.True(t, resp.Truncated)
+	assert.Empty(t, resp.Answer)
+	assert.Equal(t, &TruncationStatistics{Responses: 1, ANY: 1}, p.TruncationStatistics())
+
+	d.Proto = ProtoTCP
+	assert.False(t, p.shouldTruncateANY(d))
+}
+
+func TestTruncationConfig_validate(t *testing.T) {
+	assert.NoError(t, (*TruncationConfig)(nil).validate())
+	assert.NoError(t, (&TruncationConfig{}).validate())
+	assert.NoError(t, (&TruncationConfig{MaxUDPSize: dns.MinMsgSize}).validate())
+	assert.Error(t, (&TruncationConfig{MaxUDPSize: dns.MinMsgSize - 1}).validate())
+	assert.NoError(t, (&TruncationConfig{ResponseUDPSize: dns.MinMsgSize}).validate())
+	assert.Error(t, (&TruncationConfig{ResponseUDPSize: dns.MinMsgSize - 1}).validate())
+}
+
+func TestProxy_truncate_responseUDPSize(t *testing.T) {
+	const udpSize = 1232
+
+	p := &Proxy{Config: Config{Truncation: &TruncationConfig{ResponseUDPSize: udpSize}}}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(defaultUDPBufSize, false)
+
+	res := (&dns.Msg{}).SetReply(req)
+	res.SetEdns0(dns.MaxMsgSize, false)
+
+	dctx := &DNSContext{
+		Proto: ProtoUDP,
+		Req:   req,
+		Res:   res,
+	}
+
+	dctx.scrub()
+	p.truncate(dctx)
+
+	opt := dctx.Res.IsEdns0()
+	require.NotNil(t, opt)
+
+	assert.Equal(t, uint16(udpSize), opt.UDPSize())
+}
+
+func TestTruncationStatistics_Rate(t *testing.T) {
+	assert.Zero(t, (&TruncationStatistics{}).Rate())
+
+	s := &TruncationStatistics{
+		Responses:    8,
+		ClientBuffer: 1,
+		ANY:          1,
+	}
+	assert.Equal(t, uint64(2), s.Truncated())
+	assert.InDelta(t, 0.25, s.Rate(), 1e-9)
+}
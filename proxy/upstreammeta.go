@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamMetadata is the metadata provided by an upstream in the EDNS(0)
+// options of its response, e.g. to tell that the response is blocked by the
+// filtering of the upstream.
+type UpstreamMetadata struct {
+	// ExtendedErrors are the Extended DNS Errors of the response, see RFC 8914.
+	ExtendedErrors []*ExtendedError
+
+	// NSID is the hex-encoded name server identifier of the upstream, see RFC
+	// 5001.  It's empty if the response contains none.
+	NSID string
+
+	// PaddingLen is the number of octets of the EDNS(0) Padding option of the
+	// response, see RFC 7830.  Note that the padding of the responses to the
+	// queries padded in accordance with [upstream.Options.PaddingPolicy] is
+	// stripped by the upstream itself and isn't reported.
+	PaddingLen int
+
+	// IsPadded is true if the response contains the EDNS(0) Padding option.
+	IsPadded bool
+}
+
+// ExtendedError is an Extended DNS Error provided by an upstream, see RFC 8914.
+type ExtendedError struct {
+	// Text is the extra text of the error, if any.
+	Text string
+
+	// Code is the info code of the error, e.g. [dns.ExtendedErrorCodeBlocked].
+	Code uint16
+}
+
+// newUpstreamMetadata returns the metadata from the EDNS(0) options of resp.
+// It returns nil if there is none.  resp may be nil.
+func newUpstreamMetadata(resp *dns.Msg) (m *UpstreamMetadata) {
+	if resp == nil {
+		return nil
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	m = &UpstreamMetadata{}
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_EDE:
+			m.ExtendedErrors = append(m.ExtendedErrors, &ExtendedError{
+				Text: o.ExtraText,
+				Code: o.InfoCode,
+			})
+		case *dns.EDNS0_NSID:
+			m.NSID = o.Nsid
+		case *dns.EDNS0_PADDING:
+			m.IsPadded = true
+			m.PaddingLen += len(o.Padding)
+		default:
+			// Go on.
+		}
+	}
+
+	if len(m.ExtendedErrors) == 0 && m.NSID == "" && !m.IsPadded {
+		return nil
+	}
+
+	return m
+}
+
+// upstreamMetadataCounter counts the metadata provided by a single upstream.
+type upstreamMetadataCounter struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// extendedErrors maps the info codes of the Extended DNS Errors to the
+	// numbers of the responses with them.  It's created on the first error.
+	extendedErrors map[uint16]uint64
+
+	// nsid is the last hex-encoded name server identifier received.
+	nsid string
+
+	// padded is the number of the padded responses.
+	padded uint64
+}
+
+// record counts m.  c and m may be nil.
+func (c *upstreamMetadataCounter) record(m *UpstreamMetadata) {
+	if c == nil || m == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(m.ExtendedErrors) > 0 && c.extendedErrors == nil {
+		c.extendedErrors = map[uint16]uint64{}
+	}
+
+	for _, e := range m.ExtendedErrors {
+		c.extendedErrors[e.Code]++
+	}
+
+	if m.NSID != "" {
+		c.nsid = m.NSID
+	}
+
+	if m.IsPadded {
+		c.padded++
+	}
+}
+
+// UpstreamMetadataStatistics contains the numbers of the responses from an
+// upstream with the metadata, see [UpstreamMetadata].
+type UpstreamMetadataStatistics struct {
+	// ExtendedErrors maps the info codes of the Extended DNS Errors to the
+	// numbers of the responses with them.
+	ExtendedErrors map[uint16]uint64
+
+	// Address is the address of the upstream.
+	Address string
+
+	// NSID is the last hex-encoded name server identifier provided by the
+	// upstream, if any.
+	NSID string
+
+	// PaddedResponses is the number of the padded responses.
+	PaddedResponses uint64
+}
+
+// UpstreamMetadataStatistics returns the numbers of the responses with the
+// metadata from each of the upstreams which have provided any since p has been
+// created, sorted by address.
+func (p *Proxy) UpstreamMetadataStatistics() (stats []*UpstreamMetadataStatistics) {
+	p.queriesLock.Lock()
+	defer p.queriesLock.Unlock()
+
+	stats = make([]*UpstreamMetadataStatistics, 0, len(p.upstreamQueries))
+	for addr, qc := range p.upstreamQueries {
+		c := &qc.metadata
+
+		c.mu.Lock()
+		s := &UpstreamMetadataStatistics{
+			ExtendedErrors:  maps.Clone(c.extendedErrors),
+			Address:         addr,
+			NSID:            c.nsid,
+			PaddedResponses: c.padded,
+		}
+		c.mu.Unlock()
+
+		if len(s.ExtendedErrors) == 0 && s.NSID == "" && s.PaddedResponses == 0 {
+			continue
+		}
+
+		stats = append(stats, s)
+	}
+
+	slices.SortFunc(stats, func(a, b *UpstreamMetadataStatistics) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return stats
+}
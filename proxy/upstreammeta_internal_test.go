@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_upstreamMetadata(t *testing.T) {
+	const (
+		blockedHost = "blocked.example."
+		plainHost   = "plain.example."
+
+		nsid     = "6e73312e6578616d706c65"
+		extraTxt = "blocked by upstream filter"
+	)
+
+	u := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			if req.Question[0].Name == plainHost {
+				return resp, nil
+			}
+
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			opt := resp.IsEdns0()
+			opt.Option = append(
+				opt.Option,
+				&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: extraTxt},
+				&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: nsid},
+				&dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+			)
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return testUpsAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+	servicetest.RequireRun(t, p, testTimeout)
+
+	resolve := func(t *testing.T, host string) (m *UpstreamMetadata) {
+		t.Helper()
+
+		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+		d := p.newDNSContext(ProtoUDP, req, netip.MustParseAddrPort("192.0.2.1:53"))
+		require.NoError(t, p.Resolve(context.Background(), d))
+
+		stats := d.QueryStatistics()
+		require.NotNil(t, stats)
+		require.Len(t, stats.Main(), 1)
+
+		return stats.Main()[0].Metadata
+	}
+
+	assert.Nil(t, resolve(t, plainHost))
+	assert.Empty(t, p.UpstreamMetadataStatistics())
+
+	assert.Equal(t, &UpstreamMetadata{
+		ExtendedErrors: []*ExtendedError{{
+			Text: extraTxt,
+			Code: dns.ExtendedErrorCodeBlocked,
+		}},
+		NSID:       nsid,
+		PaddingLen: 16,
+		IsPadded:   true,
+	}, resolve(t, blockedHost))
+
+	_ = resolve(t, blockedHost)
+
+	assert.Equal(t, []*UpstreamMetadataStatistics{{
+		ExtendedErrors: map[uint16]uint64{
+			dns.ExtendedErrorCodeBlocked: 2,
+		},
+		Address:         testUpsAddr,
+		NSID:            nsid,
+		PaddedResponses: 2,
+	}}, p.UpstreamMetadataStatistics())
+}
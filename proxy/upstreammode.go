@@ -23,6 +23,18 @@ const (
 	// or AAAA requests only with the fastest IP address detected by ICMP
 	// response time or TCP connection time.
 	UpstreamModeFastestAddr UpstreamMode = "fastest_addr"
+
+	// UpstreamModeFastest makes server to query the upstream with the lowest
+	// exponentially weighted moving average of the response time, while still
+	// probing the others occasionally to notice when they become faster.
+	UpstreamModeFastest UpstreamMode = "fastest"
+
+	// UpstreamModeRace makes server to query all configured upstream servers
+	// in parallel and to use the first response with a non-empty answer, so
+	// that the early refusals of the filtering resolvers are ignored, see
+	// [upstream.ExchangeRace].  The requests of the types other than
+	// [Config.RaceQueryTypes] are load-balanced.
+	UpstreamModeRace UpstreamMode = "race"
 )
 
 // type check
@@ -35,15 +47,19 @@ func (m *UpstreamMode) UnmarshalText(b []byte) (err error) {
 	case
 		UpstreamModeLoadBalance,
 		UpstreamModeParallel,
-		UpstreamModeFastestAddr:
+		UpstreamModeFastestAddr,
+		UpstreamModeFastest,
+		UpstreamModeRace:
 		*m = um
 	default:
 		return fmt.Errorf(
-			"invalid upstream mode %q, supported: %q, %q, %q",
+			"invalid upstream mode %q, supported: %q, %q, %q, %q, %q",
 			b,
 			UpstreamModeLoadBalance,
 			UpstreamModeParallel,
 			UpstreamModeFastestAddr,
+			UpstreamModeFastest,
+			UpstreamModeRace,
 		)
 	}
 
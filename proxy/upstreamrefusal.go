@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errUpstreamRefused is returned when an upstream has responded with REFUSED or
+// NOTIMP and [Config.UpstreamRefusal] is [UpstreamRefusalActionRetry].
+const errUpstreamRefused errors.Error = "upstream refused request"
+
+// UpstreamRefusalAction is the action taken when an upstream responds with
+// REFUSED or NOTIMP, see [Config.UpstreamRefusal].
+type UpstreamRefusalAction string
+
+const (
+	// UpstreamRefusalActionPass makes the refusals returned to the clients as
+	// is.  It's the default.
+	UpstreamRefusalActionPass UpstreamRefusalAction = "pass"
+
+	// UpstreamRefusalActionRetry makes the refusals handled as the errors of
+	// the exchange, so that another upstream is tried, if the upstream mode
+	// allows.  If all the upstreams refuse, the clients get SERVFAIL.
+	UpstreamRefusalActionRetry UpstreamRefusalAction = "retry"
+
+	// UpstreamRefusalActionServfail makes the refusals replaced with SERVFAIL.
+	UpstreamRefusalActionServfail UpstreamRefusalAction = "servfail"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*UpstreamRefusalAction)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *UpstreamRefusalAction.
+func (a *UpstreamRefusalAction) UnmarshalText(b []byte) (err error) {
+	switch act := UpstreamRefusalAction(b); act {
+	case
+		UpstreamRefusalActionPass,
+		UpstreamRefusalActionRetry,
+		UpstreamRefusalActionServfail:
+		*a = act
+	default:
+		return fmt.Errorf(
+			"invalid upstream refusal action %q, supported: %q, %q, %q",
+			b,
+			UpstreamRefusalActionPass,
+			UpstreamRefusalActionRetry,
+			UpstreamRefusalActionServfail,
+		)
+	}
+
+	return nil
+}
+
+// validate returns an error if a is invalid.  The empty action is valid.
+func (a UpstreamRefusalAction) validate() (err error) {
+	switch a {
+	case
+		"",
+		UpstreamRefusalActionPass,
+		UpstreamRefusalActionRetry,
+		UpstreamRefusalActionServfail:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errors.ErrBadEnumValue, a)
+	}
+}
+
+// upstreamRefusalCounter counts the refusals of a single upstream.
+type upstreamRefusalCounter struct {
+	// refused counts the responses with REFUSED.
+	refused atomic.Uint64
+
+	// notImplemented counts the responses with NOTIMP.
+	notImplemented atomic.Uint64
+}
+
+// handleRefusal counts resp if it's a refusal and applies the configured
+// action to it.  req must not be nil.
+func (u *upstreamWithStats) handleRefusal(req, resp *dns.Msg) (res *dns.Msg, err error) {
+	if resp == nil {
+		return nil, nil
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeRefused:
+		if u.refusals != nil {
+			u.refusals.refused.Add(1)
+		}
+	case dns.RcodeNotImplemented:
+		if u.refusals != nil {
+			u.refusals.notImplemented.Add(1)
+		}
+	default:
+		return resp, nil
+	}
+
+	switch u.refusalAction {
+	case UpstreamRefusalActionRetry:
+		return nil, fmt.Errorf("%w: %s", errUpstreamRefused, dns.RcodeToString[resp.Rcode])
+	case UpstreamRefusalActionServfail:
+		return (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure), nil
+	default:
+		return resp, nil
+	}
+}
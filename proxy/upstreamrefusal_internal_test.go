@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil/servicetest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRefusingUpstream returns an upstream with addr responding with rcode and
+// counting the queries in n.
+func newRefusingUpstream(addr string, rcode int, n *atomic.Uint32) (u *dnsproxytest.Upstream) {
+	return &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			n.Add(1)
+
+			return (&dns.Msg{}).SetRcode(req, rcode), nil
+		},
+		OnAddress: func() (upsAddr string) { return addr },
+		OnClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_Resolve_upstreamRefusal(t *testing.T) {
+	const (
+		refusingAddr = "refusing"
+		answerAddr   = "answering"
+	)
+
+	answering := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{
+				newRR(t, req.Question[0].Name, dns.TypeA, defaultTestTTL, net.IP{192, 0, 2, 1}),
+			}
+
+			return resp, nil
+		},
+		OnAddress: func() (addr string) { return answerAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	testCases := []struct {
+		name      string
+		action    UpstreamRefusalAction
+		withGood  bool
+		wantRcode int
+	}{{
+		name:      "default",
+		action:    "",
+		withGood:  false,
+		wantRcode: dns.RcodeRefused,
+	}, {
+		name:      "pass",
+		action:    UpstreamRefusalActionPass,
+		withGood:  false,
+		wantRcode: dns.RcodeRefused,
+	}, {
+		name:      "servfail",
+		action:    UpstreamRefusalActionServfail,
+		withGood:  false,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		name:      "retry_all_refuse",
+		action:    UpstreamRefusalActionRetry,
+		withGood:  false,
+		wantRcode: dns.RcodeServerFailure,
+	}, {
+		name:      "retry",
+		action:    UpstreamRefusalActionRetry,
+		withGood:  true,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var refused atomic.Uint32
+			ups := []upstream.Upstream{newRefusingUpstream(refusingAddr, dns.RcodeRefused, &refused)}
+			if tc.withGood {
+				ups = append(ups, answering)
+			}
+
+			p := mustNew(t, &Config{
+				Logger:          slogutil.NewDiscardLogger(),
+				UDPListenAddr:   []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig:  &UpstreamConfig{Upstreams: ups},
+				TrustedProxies:  defaultTrustedProxies,
+				UpstreamRefusal: tc.action,
+			})
+			servicetest.RequireRun(t, p, testTimeout)
+
+			const reqNum = 5
+			cliAddr := netip.MustParseAddrPort("192.0.2.2:53")
+			for range reqNum {
+				req := (&dns.Msg{}).SetQuestion("refused.example.", dns.TypeA)
+				d := p.newDNSContext(ProtoUDP, req, cliAddr)
+				_ = p.Resolve(context.Background(), d)
+
+				require.NotNil(t, d.Res)
+				assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+			}
+
+			stats := p.UpstreamQueryStatistics()
+			require.NotEmpty(t, stats)
+
+			refusingStats := stats[len(stats)-1]
+			require.Equal(t, refusingAddr, refusingStats.Address)
+
+			assert.Equal(t, uint64(refused.Load()), refusingStats.Refused)
+			assert.Zero(t, refusingStats.NotImplemented)
+		})
+	}
+}
+
+func TestUpstreamWithStats_handleRefusal(t *testing.T) {
+	t.Parallel()
+
+	var n atomic.Uint32
+	ups := newRefusingUpstream("notimpl", dns.RcodeNotImplemented, &n)
+
+	counter := &upstreamRefusalCounter{}
+	u := &upstreamWithStats{
+		upstream:      ups,
+		refusals:      counter,
+		refusalAction: UpstreamRefusalActionRetry,
+	}
+
+	req := (&dns.Msg{}).SetQuestion("notimpl.example.", dns.TypeA)
+	resp, err := u.Exchange(context.Background(), req)
+	assert.ErrorIs(t, err, errUpstreamRefused)
+	assert.Nil(t, resp)
+	assert.Equal(t, err, u.err)
+
+	assert.Equal(t, uint64(1), counter.notImplemented.Load())
+	assert.Zero(t, counter.refused.Load())
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+// errTryTimeout is returned when an upstream hasn't responded within
+// [UpstreamRetryConfig.TryTimeout].
+const errTryTimeout errors.Error = "try timeout exceeded"
+
+// UpstreamRetryConfig is the policy of retrying the exchanges with the
+// upstreams in the load-balancing and the fastest upstream modes.  When set,
+// it replaces the default behavior of trying each of the upstreams in turn on
+// an error, so that a single query is sent exactly as many times as the policy
+// allows.  To make the policy the only source of retries, the plain DNS
+// upstreams should be created with [upstream.Options.DisableRetry].
+type UpstreamRetryConfig struct {
+	// Rcodes are the response codes the responses with which are retried, e.g.
+	// [dns.RcodeServerFailure].  The last response is returned after the
+	// retries are exhausted.
+	Rcodes []int
+
+	// MaxRetries is the maximum number of retries after the first try.  Zero
+	// means that each query is only sent once.
+	MaxRetries uint
+
+	// TryTimeout is the maximum duration of a single try.  If zero, only the
+	// timeout of the upstream itself is used.  It must not be negative.
+	TryTimeout time.Duration
+
+	// RetryOnTimeout makes the tries failed with a timeout, including
+	// TryTimeout, retried.
+	RetryOnTimeout bool
+
+	// RetryOnError makes the tries failed with an error other than a timeout
+	// retried.  The refusals are always retried with
+	// [UpstreamRefusalActionRetry].
+	RetryOnError bool
+
+	// SwitchUpstream makes each retry sent to the next upstream in the order
+	// of the mode, if there is one, instead of the same upstream.
+	SwitchUpstream bool
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UpstreamRetryConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	errs := []error{
+		validate.NotNegative("TryTimeout", c.TryTimeout),
+	}
+
+	for i, rcode := range c.Rcodes {
+		if _, ok := dns.RcodeToString[rcode]; !ok {
+			errs = append(errs, fmt.Errorf("Rcodes: at index %d: %w: %d", i, errors.ErrBadEnumValue, rcode))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// shouldRetry returns true if the try resulted in resp and err should be
+// retried in accordance with c.  c must not be nil.
+func (c *UpstreamRetryConfig) shouldRetry(resp *dns.Msg, err error) (ok bool) {
+	switch {
+	case err == nil:
+		return slices.Contains(c.Rcodes, resp.Rcode)
+	case errors.Is(err, errUpstreamRefused):
+		return true
+	case isTryTimeout(err):
+		return c.RetryOnTimeout
+	default:
+		return c.RetryOnError
+	}
+}
+
+// isTryTimeout returns true if err is a timeout error.
+func isTryTimeout(err error) (ok bool) {
+	var netErr net.Error
+	switch {
+	case
+		errors.Is(err, errTryTimeout),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	default:
+		return false
+	}
+}
+
+// exchangeRetrying resolves req using ups tried in order in accordance with
+// [Config.UpstreamRetry], which must not be nil.  order must not be empty.
+func (p *Proxy) exchangeRetrying(
+	ctx context.Context,
+	req *dns.Msg,
+	ups []upstream.Upstream,
+	order []int,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	c := p.UpstreamRetry
+
+	var errs []error
+	next := 0
+	for try := uint(0); ; try++ {
+		u = ups[order[next]]
+
+		var elapsed time.Duration
+		resp, elapsed, err = p.exchangeTry(ctx, u, req, c.TryTimeout)
+		if err == nil {
+			p.updateRTT(u.Address(), elapsed)
+		} else if ctx.Err() != nil {
+			// Don't retry the aborted exchange.
+			return nil, nil, err
+		} else {
+			errs = append(errs, err)
+
+			// TODO(e.burkov):  Use the actual configured timeout.
+			p.updateRTT(u.Address(), defaultTimeout)
+		}
+
+		if try >= c.MaxRetries || !c.shouldRetry(resp, err) {
+			break
+		}
+
+		if c.SwitchUpstream && next < len(order)-1 {
+			next++
+		}
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("exchanging after %d tries: %w", len(errs), errors.Join(errs...))
+	}
+
+	return resp, u, nil
+}
+
+// tryResult is the result of a single exchange with an upstream.
+type tryResult struct {
+	resp *dns.Msg
+	err  error
+	dur  time.Duration
+}
+
+// exchangeTry is like [Proxy.exchange], but returns [errTryTimeout] if u
+// doesn't respond within timeout, in which case the exchange is canceled.  If
+// timeout is zero, it's not limited.
+func (p *Proxy) exchangeTry(
+	ctx context.Context,
+	u upstream.Upstream,
+	req *dns.Msg,
+	timeout time.Duration,
+) (resp *dns.Msg, dur time.Duration, err error) {
+	if timeout == 0 {
+		return p.exchange(ctx, u, req)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resCh := make(chan tryResult, 1)
+	go func() {
+		defer slogutil.RecoverAndLog(context.TODO(), p.upstreamLogger)
+
+		// Copy the request, since it may be still in use by the upstream after
+		// the timeout, when it's sent again.
+		r := tryResult{}
+		r.resp, r.dur, r.err = p.exchange(ctx, u, req.Copy())
+		resCh <- r
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-resCh:
+		return r.resp, r.dur, r.err
+	case <-timer.C:
+		return nil, timeout, fmt.Errorf("upstream %s: %w", u.Address(), errTryTimeout)
+	}
+}
@@ -460,6 +460,31 @@ func (uc *UpstreamConfig) lookupUpstreams(name string) (ups []upstream.Upstream,
 	return ups, true
 }
 
+// all returns the unique upstreams of uc: the general ones first, and then the
+// domain-specific ones sorted by domain.
+func (uc *UpstreamConfig) all() (ups []upstream.Upstream) {
+	appendUnique := func(us []upstream.Upstream) {
+		for _, u := range us {
+			if !slices.Contains(ups, u) {
+				ups = append(ups, u)
+			}
+		}
+	}
+
+	appendUnique(uc.Upstreams)
+
+	for _, specUps := range []map[string][]upstream.Upstream{
+		uc.DomainReservedUpstreams,
+		uc.SpecifiedDomainUpstreams,
+	} {
+		for _, domain := range slices.Sorted(maps.Keys(specUps)) {
+			appendUnique(specUps[domain])
+		}
+	}
+
+	return ups
+}
+
 // Close implements the io.Closer interface for *UpstreamConfig.
 func (uc *UpstreamConfig) Close() (err error) {
 	closeErrs := closeAll(nil, uc.Upstreams...)
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of [latencyHistogram].  The
+// last bucket of the histogram has no upper bound.
+var latencyBounds = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram is the histogram of the durations of the exchanges.
+type latencyHistogram struct {
+	// buckets are the numbers of the durations within each of latencyBounds
+	// and greater than all of them.
+	buckets [len(latencyBounds) + 1]atomic.Uint64
+
+	// sum is the total of the durations in nanoseconds.
+	sum atomic.Int64
+}
+
+// observe records d within h.
+func (h *latencyHistogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(latencyBounds[:], d)
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// snapshot returns the current numbers of the durations within the buckets of
+// h, their total number, and their total duration.
+func (h *latencyHistogram) snapshot() (counts []uint64, total uint64, sum time.Duration) {
+	counts = make([]uint64, len(h.buckets))
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+
+	return counts, total, time.Duration(h.sum.Load())
+}
+
+// latencyQuantile returns the estimated q-quantile of the durations counted in
+// the buckets of [latencyHistogram].  The duration is interpolated linearly
+// within the bucket containing it, and the ones beyond the last bound are
+// estimated as that bound.  total must be the sum of counts.
+func latencyQuantile(counts []uint64, total uint64, q float64) (d time.Duration) {
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+
+	var cum uint64
+	for i, n := range counts {
+		if n == 0 || float64(cum+n) < rank {
+			cum += n
+
+			continue
+		}
+
+		if i == len(latencyBounds) {
+			return latencyBounds[i-1]
+		}
+
+		var lower time.Duration
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+
+		frac := (rank - float64(cum)) / float64(n)
+
+		return lower + time.Duration(frac*float64(latencyBounds[i]-lower))
+	}
+
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// upstreamExchangeCounter counts the results and the latencies of the
+// exchanges with a single upstream.
+type upstreamExchangeCounter struct {
+	// mu protects lastErr and lastErrTime.
+	mu sync.Mutex
+
+	// lastErr is the error of the latest failed exchange, if any.
+	lastErr error
+
+	// lastErrTime is the time of the latest failed exchange.
+	lastErrTime time.Time
+
+	// latency is the histogram of the durations of the successful exchanges.
+	latency latencyHistogram
+
+	// errors is the number of the failed exchanges, including the timed out
+	// ones.
+	errors atomic.Uint64
+
+	// timeouts is the number of the timed out exchanges.
+	timeouts atomic.Uint64
+}
+
+// record counts the exchange which took dur and failed with err, if it's not
+// nil.  c may be nil.
+func (c *upstreamExchangeCounter) record(dur time.Duration, err error) {
+	if c == nil {
+		return
+	}
+
+	if err == nil {
+		c.latency.observe(dur)
+
+		return
+	}
+
+	c.errors.Add(1)
+	if isTryTimeout(err) {
+		c.timeouts.Add(1)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr = err
+	c.lastErrTime = time.Now()
+}
+
+// UpstreamStats contains the statistics of the exchanges with an upstream.
+type UpstreamStats struct {
+	// LastErrorTime is the time of the latest failed exchange.  It's zero if
+	// there were none.
+	LastErrorTime time.Time
+
+	// LastError is the error of the latest failed exchange, if any.
+	LastError error
+
+	// Address is the address of the upstream.
+	Address string
+
+	// Protocol is the protocol of the upstream, i.e. the scheme of its
+	// address, e.g. "tls" or "https", or "udp" for the plain DNS upstreams
+	// without one.
+	Protocol string
+
+	// Queries is the number of queries sent to the upstream, including the
+	// ones made by the proactive cache refresh.
+	Queries uint64
+
+	// Responses is the number of the successful exchanges.
+	Responses uint64
+
+	// Errors is the number of the failed exchanges, including the timed out
+	// ones.
+	Errors uint64
+
+	// Timeouts is the number of the timed out exchanges.
+	Timeouts uint64
+
+	// AverageLatency is the average duration of the successful exchanges.
+	AverageLatency time.Duration
+
+	// LatencyP50 is the estimated median duration of the successful exchanges.
+	LatencyP50 time.Duration
+
+	// LatencyP90 is the estimated 90th percentile of the durations of the
+	// successful exchanges.
+	LatencyP90 time.Duration
+
+	// LatencyP99 is the estimated 99th percentile of the durations of the
+	// successful exchanges.
+	LatencyP99 time.Duration
+}
+
+// UpstreamStats returns the statistics of the exchanges with each of the
+// upstreams used since p has been created, sorted by address.  The percentiles
+// of the latency are estimated from a histogram, so they're approximate.
+func (p *Proxy) UpstreamStats() (stats []*UpstreamStats) {
+	p.queriesLock.Lock()
+	defer p.queriesLock.Unlock()
+
+	stats = make([]*UpstreamStats, 0, len(p.upstreamQueries))
+	for addr, qc := range p.upstreamQueries {
+		stats = append(stats, newUpstreamStats(addr, qc))
+	}
+
+	slices.SortFunc(stats, func(a, b *UpstreamStats) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return stats
+}
+
+// newUpstreamStats returns the statistics of the upstream with addr counted by
+// qc.
+func newUpstreamStats(addr string, qc *upstreamQueryCounter) (s *UpstreamStats) {
+	c := &qc.exchanges
+	counts, total, sum := c.latency.snapshot()
+
+	s = &UpstreamStats{
+		Address:    addr,
+		Protocol:   upstreamProtocol(addr),
+		Queries:    qc.user.Load() + qc.refresh.Load(),
+		Responses:  total,
+		Errors:     c.errors.Load(),
+		Timeouts:   c.timeouts.Load(),
+		LatencyP50: latencyQuantile(counts, total, 0.5),
+		LatencyP90: latencyQuantile(counts, total, 0.9),
+		LatencyP99: latencyQuantile(counts, total, 0.99),
+	}
+
+	if total > 0 {
+		s.AverageLatency = sum / time.Duration(total)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.LastError, s.LastErrorTime = c.lastErr, c.lastErrTime
+
+	return s
+}
+
+// upstreamProtocol returns the protocol of the upstream with addr, see
+// [UpstreamStats.Protocol].
+func upstreamProtocol(addr string) (proto string) {
+	if scheme, _, ok := strings.Cut(addr, "://"); ok {
+		return scheme
+	}
+
+	return "udp"
+}
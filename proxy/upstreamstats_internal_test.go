@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_UpstreamStats(t *testing.T) {
+	const (
+		okAddr      = "tls://ok.example:853"
+		failingAddr = "192.0.2.53:53"
+	)
+
+	const errFailing errors.Error = "failing"
+
+	var failures int
+	ok := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		OnAddress: func() (addr string) { return okAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+	failing := &dnsproxytest.Upstream{
+		OnExchange: func(_ context.Context, _ *dns.Msg) (resp *dns.Msg, err error) {
+			failures++
+			if failures%2 == 0 {
+				return nil, errFailing
+			}
+
+			return nil, os.ErrDeadlineExceeded
+		},
+		OnAddress: func() (addr string) { return failingAddr },
+		OnClose:   func() (err error) { return nil },
+	}
+
+	p := &Proxy{}
+	ups := p.upstreamsWithStats([]upstream.Upstream{ok, failing}, false)
+	refreshUps := p.upstreamsWithStats([]upstream.Upstream{ok}, true)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	for _, u := range append(ups, refreshUps...) {
+		_, _ = u.Exchange(context.Background(), req)
+	}
+	_, _ = ups[1].Exchange(context.Background(), req)
+
+	stats := p.UpstreamStats()
+	require.Len(t, stats, 2)
+
+	failingStats, okStats := stats[0], stats[1]
+
+	assert.Equal(t, okAddr, okStats.Address)
+	assert.Equal(t, "tls", okStats.Protocol)
+	assert.Equal(t, uint64(2), okStats.Queries)
+	assert.Equal(t, uint64(2), okStats.Responses)
+	assert.Zero(t, okStats.Errors)
+	assert.NoError(t, okStats.LastError)
+	assert.True(t, okStats.LastErrorTime.IsZero())
+	assert.LessOrEqual(t, okStats.LatencyP50, okStats.LatencyP99)
+
+	assert.Equal(t, failingAddr, failingStats.Address)
+	assert.Equal(t, "udp", failingStats.Protocol)
+	assert.Equal(t, uint64(2), failingStats.Queries)
+	assert.Zero(t, failingStats.Responses)
+	assert.Equal(t, uint64(2), failingStats.Errors)
+	assert.Equal(t, uint64(1), failingStats.Timeouts)
+	assert.ErrorIs(t, failingStats.LastError, errFailing)
+	assert.False(t, failingStats.LastErrorTime.IsZero())
+	assert.Zero(t, failingStats.AverageLatency)
+}
+
+func TestLatencyQuantile(t *testing.T) {
+	h := &latencyHistogram{}
+	for range 50 {
+		h.observe(3 * time.Millisecond)
+	}
+
+	for range 40 {
+		h.observe(15 * time.Millisecond)
+	}
+
+	for range 10 {
+		h.observe(time.Minute)
+	}
+
+	counts, total, sum := h.snapshot()
+	require.Equal(t, uint64(100), total)
+
+	assert.Equal(t, 50*3*time.Millisecond+40*15*time.Millisecond+10*time.Minute, sum)
+
+	testCases := []struct {
+		name string
+		want time.Duration
+		q    float64
+	}{{
+		name: "median",
+		want: 5 * time.Millisecond,
+		q:    0.5,
+	}, {
+		name: "within_bucket",
+		want: 15 * time.Millisecond,
+		q:    0.7,
+	}, {
+		name: "beyond_bounds",
+		want: latencyBounds[len(latencyBounds)-1],
+		q:    0.99,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, latencyQuantile(counts, total, tc.q))
+		})
+	}
+
+	assert.Zero(t, latencyQuantile(make([]uint64, len(latencyBounds)+1), 0, 0.5))
+}
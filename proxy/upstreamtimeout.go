@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/validate"
+	"github.com/miekg/dns"
+)
+
+// UpstreamTimeoutConfig configures the timeouts of the exchanges with the
+// upstreams per upstream and per query type instead of the single
+// [upstream.Options.Timeout].  The timeouts are applied as the deadlines of the
+// exchanges, so they can't exceed the own timeouts of the upstreams, which
+// should therefore be set to the longest of them.
+type UpstreamTimeoutConfig struct {
+	// Upstreams maps the addresses of the upstreams, as returned by their
+	// Address methods, to the timeouts of the exchanges with them.
+	Upstreams map[string]time.Duration
+
+	// QTypes maps the query types to the timeouts of the exchanges of the
+	// queries of these types, e.g. a longer one for [dns.TypeDNSKEY].  These
+	// take precedence over Upstreams.
+	QTypes map[uint16]time.Duration
+
+	// Default is the timeout of the exchanges with the upstreams missing in
+	// Upstreams of the queries of the types missing in QTypes.  If zero, only
+	// the timeout of the upstream itself is used.
+	Default time.Duration
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *UpstreamTimeoutConfig) validate() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	errs := []error{
+		validate.NotNegative("Default", c.Default),
+	}
+
+	for _, addr := range slices.Sorted(maps.Keys(c.Upstreams)) {
+		errs = append(errs, validate.NotNegative(fmt.Sprintf("Upstreams[%q]", addr), c.Upstreams[addr]))
+	}
+
+	for _, qt := range slices.Sorted(maps.Keys(c.QTypes)) {
+		if _, ok := dns.TypeToString[qt]; !ok {
+			errs = append(errs, fmt.Errorf("QTypes: %w: %d", errors.ErrBadEnumValue, qt))
+
+			continue
+		}
+
+		errs = append(errs, validate.NotNegative(fmt.Sprintf("QTypes[%d]", qt), c.QTypes[qt]))
+	}
+
+	return errors.Join(errs...)
+}
+
+// timeout returns the timeout of the exchange of req with the upstream with
+// addr.  c may be nil.
+func (c *UpstreamTimeoutConfig) timeout(addr string, req *dns.Msg) (timeout time.Duration) {
+	if c == nil {
+		return 0
+	}
+
+	if len(req.Question) > 0 {
+		if timeout, ok := c.QTypes[req.Question[0].Qtype]; ok {
+			return timeout
+		}
+	}
+
+	if timeout, ok := c.Upstreams[addr]; ok {
+		return timeout
+	}
+
+	return c.Default
+}
+
+// withUpstreamTimeout returns the context of the exchange of req with the
+// upstream with addr limited in accordance with c.  cancel must be called once
+// the exchange is finished.  c may be nil.
+func (c *UpstreamTimeoutConfig) withUpstreamTimeout(
+	parent context.Context,
+	addr string,
+	req *dns.Msg,
+) (ctx context.Context, cancel context.CancelFunc) {
+	timeout := c.timeout(addr, req)
+	if timeout == 0 {
+		return parent, func() {}
+	}
+
+	return context.WithTimeout(parent, timeout)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTimeoutConfig_timeout(t *testing.T) {
+	t.Parallel()
+
+	const (
+		slowAddr  = "tls://slow.example:853"
+		otherAddr = "192.0.2.53:53"
+	)
+
+	c := &UpstreamTimeoutConfig{
+		Upstreams: map[string]time.Duration{slowAddr: 5 * time.Second},
+		QTypes:    map[uint16]time.Duration{dns.TypeDNSKEY: 10 * time.Second},
+		Default:   2 * time.Second,
+	}
+
+	testCases := []struct {
+		conf  *UpstreamTimeoutConfig
+		name  string
+		addr  string
+		want  time.Duration
+		qtype uint16
+	}{{
+		conf:  c,
+		name:  "default",
+		addr:  otherAddr,
+		want:  2 * time.Second,
+		qtype: dns.TypeA,
+	}, {
+		conf:  c,
+		name:  "upstream",
+		addr:  slowAddr,
+		want:  5 * time.Second,
+		qtype: dns.TypeA,
+	}, {
+		conf:  c,
+		name:  "qtype",
+		addr:  otherAddr,
+		want:  10 * time.Second,
+		qtype: dns.TypeDNSKEY,
+	}, {
+		conf:  c,
+		name:  "qtype_over_upstream",
+		addr:  slowAddr,
+		want:  10 * time.Second,
+		qtype: dns.TypeDNSKEY,
+	}, {
+		conf:  nil,
+		name:  "nil",
+		addr:  slowAddr,
+		want:  0,
+		qtype: dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := (&dns.Msg{}).SetQuestion("example.org.", tc.qtype)
+			assert.Equal(t, tc.want, tc.conf.timeout(tc.addr, req))
+		})
+	}
+}
+
+func TestProxy_upstreamsWithStats_timeout(t *testing.T) {
+	t.Parallel()
+
+	const (
+		addr    = "192.0.2.53:53"
+		timeout = 10 * time.Millisecond
+	)
+
+	ups := &dnsproxytest.Upstream{
+		OnExchange: func(ctx context.Context, _ *dns.Msg) (resp *dns.Msg, err error) {
+			<-ctx.Done()
+
+			return nil, ctx.Err()
+		},
+		OnAddress: func() (a string) { return addr },
+		OnClose:   func() (_ error) { return nil },
+	}
+
+	p := &Proxy{
+		Config: Config{
+			UpstreamTimeouts: &UpstreamTimeoutConfig{
+				Upstreams: map[string]time.Duration{addr: timeout},
+			},
+		},
+	}
+
+	wrapped := p.upstreamsWithStats([]upstream.Upstream{ups}, false)
+	require.Len(t, wrapped, 1)
+
+	start := time.Now()
+	_, err := wrapped[0].Exchange(context.Background(), newTestMessage())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	stats := p.UpstreamStats()
+	require.Len(t, stats, 1)
+
+	assert.Equal(t, uint64(1), stats[0].Timeouts)
+}
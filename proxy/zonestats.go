@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// ZoneStatistics is the rollup of the proactive refresh state of the cache
+// entries within a single registered domain.  It's intended for debugging.
+type ZoneStatistics struct {
+	// Zone is the registered domain, i.e. eTLD+1, without the trailing dot.
+	Zone string
+
+	// Entries is the number of the cache entries within the zone known to the
+	// proactive refresh.
+	Entries int
+
+	// Requests is the total number of requests for the entries within the
+	// cooldown period.
+	Requests int
+
+	// Scheduled is the number of the entries scheduled for refresh.
+	Scheduled int
+
+	// Failures is the total number of consecutive failed refreshes of the
+	// entries.
+	Failures uint
+
+	// Pinned is true if any of the entries is pinned, see
+	// [Config.CacheProactivePinnedZones].
+	Pinned bool
+}
+
+// ZoneStatistics returns the rollup of [Proxy.RefreshSchedule] by registered
+// domain, sorted by the number of requests in descending order.  The entries
+// with unknown domain names are omitted.  It returns nil if the cache is
+// disabled.
+func (p *Proxy) ZoneStatistics() (stats []*ZoneStatistics) {
+	if p.cache == nil {
+		return nil
+	}
+
+	byZone := map[string]*ZoneStatistics{}
+	for _, e := range p.cache.refreshSchedule() {
+		if e.Domain == "" {
+			continue
+		}
+
+		zone := registeredDomain(e.Domain)
+		zs := byZone[zone]
+		if zs == nil {
+			zs = &ZoneStatistics{
+				Zone: zone,
+			}
+			byZone[zone] = zs
+			stats = append(stats, zs)
+		}
+
+		zs.Entries++
+		zs.Requests += e.Requests
+		zs.Failures += e.Failures
+		zs.Pinned = zs.Pinned || e.Pinned
+		if e.Scheduled {
+			zs.Scheduled++
+		}
+	}
+
+	slices.SortStableFunc(stats, func(a, b *ZoneStatistics) (res int) {
+		if res = b.Requests - a.Requests; res != 0 {
+			return res
+		}
+
+		return strings.Compare(a.Zone, b.Zone)
+	})
+
+	return stats
+}
+
+// normalizeZone returns the lowercased domain name without the trailing dot.
+func normalizeZone(name string) (zone string) {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// registeredDomain returns the registered domain, i.e. eTLD+1, of name.  Only
+// the ICANN section of the public suffix list is respected, since the private
+// one contains the domains like "googleapis.com", which are more useful to see
+// as a whole.  It returns the normalized name itself if it's a public suffix.
+func registeredDomain(name string) (zone string) {
+	name = normalizeZone(name)
+
+	suffix, icann := publicsuffix.PublicSuffix(name)
+	for !icann {
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+
+		suffix, icann = publicsuffix.PublicSuffix(suffix[i+1:])
+	}
+
+	if len(name) <= len(suffix) {
+		return name
+	}
+
+	rest := name[:len(name)-len(suffix)-1]
+
+	return rest[strings.LastIndexByte(rest, '.')+1:] + "." + suffix
+}
+
+// zonePatterns is a set of domain name patterns.  A pattern like "example.com"
+// matches the domain name itself and all its subdomains, while the wildcard
+// pattern like "*.example.com" only matches the subdomains.  The nil
+// *zonePatterns matches nothing.
+type zonePatterns struct {
+	// zones are the normalized domain names matched along with their
+	// subdomains.
+	zones []string
+
+	// wildcards are the normalized domain names which subdomains only are
+	// matched.
+	wildcards []string
+}
+
+// newZonePatterns parses patterns into a new *zonePatterns.  It returns nil if
+// patterns are empty.
+func newZonePatterns(patterns []string) (zp *zonePatterns) {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	zp = &zonePatterns{}
+	for _, p := range patterns {
+		if z, ok := strings.CutPrefix(p, "*."); ok {
+			zp.wildcards = append(zp.wildcards, normalizeZone(z))
+		} else {
+			zp.zones = append(zp.zones, normalizeZone(p))
+		}
+	}
+
+	return zp
+}
+
+// patterns returns the patterns zp has been parsed from in the normalized
+// form, see [newZonePatterns].  It returns nil if zp is nil.
+func (zp *zonePatterns) patterns() (patterns []string) {
+	if zp == nil {
+		return nil
+	}
+
+	patterns = slices.Clone(zp.zones)
+	for _, w := range zp.wildcards {
+		patterns = append(patterns, "*."+w)
+	}
+
+	return patterns
+}
+
+// match returns true if name matches any of the patterns.
+func (zp *zonePatterns) match(name string) (ok bool) {
+	if zp == nil {
+		return false
+	}
+
+	name = normalizeZone(name)
+
+	return slices.ContainsFunc(zp.zones, func(z string) (isSub bool) {
+		return name == z || isSubdomain(name, z)
+	}) || slices.ContainsFunc(zp.wildcards, func(z string) (isSub bool) {
+		return isSubdomain(name, z)
+	})
+}
+
+// matchQuestion returns true if the requested domain of m matches any of the
+// patterns.
+func (zp *zonePatterns) matchQuestion(m *dns.Msg) (ok bool) {
+	return zp != nil && len(m.Question) > 0 && zp.match(m.Question[0].Name)
+}
+
+// isSubdomain returns true if the normalized name is a subdomain of the
+// normalized zone.
+func isSubdomain(name, zone string) (ok bool) {
+	return strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{{
+		name: "subdomain",
+		in:   "storage.googleapis.com.",
+		want: "googleapis.com",
+	}, {
+		name: "registered",
+		in:   "Example.ORG.",
+		want: "example.org",
+	}, {
+		name: "multi_label_suffix",
+		in:   "www.example.co.uk.",
+		want: "example.co.uk",
+	}, {
+		name: "private_suffix",
+		in:   "foo.blogspot.co.uk.",
+		want: "blogspot.co.uk",
+	}, {
+		name: "public_suffix",
+		in:   "com.",
+		want: "com",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, registeredDomain(tc.in))
+		})
+	}
+}
+
+func TestProxy_ZoneStatistics(t *testing.T) {
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+		cooldownPeriod:       time.Hour,
+		cooldownThreshold:    3,
+		pinnedZones:          []string{"GoogleAPIs.com."},
+	})
+	c.logger = slogutil.NewDiscardLogger()
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
+		onCacheResp:         func(_ *DNSContext) {},
+	}
+	t.Cleanup(c.stopProactiveRefresh)
+
+	p := &Proxy{cache: c}
+
+	for _, host := range []string{
+		"storage.googleapis.com.",
+		"maps.googleapis.com.",
+		"fonts.googleapis.com.",
+		"www.example.org.",
+	} {
+		reply := (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, 3600, net.IP{1, 2, 3, 4})},
+		}).SetQuestion(host, dns.TypeA)
+
+		c.set(reply, upstreamWithAddr, c.logger)
+	}
+
+	stats := p.ZoneStatistics()
+	require.Len(t, stats, 2)
+
+	// Each subdomain is cold, but the zone is hot as a whole and pinned, so
+	// its entries are scheduled anyway.
+	assert.Equal(t, &ZoneStatistics{
+		Zone:      "googleapis.com",
+		Entries:   3,
+		Requests:  3,
+		Scheduled: 3,
+		Pinned:    true,
+	}, stats[0])
+
+	assert.Equal(t, &ZoneStatistics{
+		Zone:     "example.org",
+		Entries:  1,
+		Requests: 1,
+	}, stats[1])
+
+	assert.Nil(t, (&Proxy{}).ZoneStatistics())
+}
+
+func TestZonePatterns_match(t *testing.T) {
+	zp := newZonePatterns([]string{"example.org", "*.Example.COM."})
+
+	testCases := []struct {
+		name string
+		in   string
+		want bool
+	}{{
+		name: "zone_apex",
+		in:   "example.org.",
+		want: true,
+	}, {
+		name: "zone_subdomain",
+		in:   "a.b.example.org.",
+		want: true,
+	}, {
+		name: "wildcard_apex",
+		in:   "example.com.",
+		want: false,
+	}, {
+		name: "wildcard_subdomain",
+		in:   "new.example.com.",
+		want: true,
+	}, {
+		name: "suffix_only",
+		in:   "notexample.org.",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, zp.match(tc.in))
+		})
+	}
+
+	assert.False(t, newZonePatterns(nil).match("example.org."))
+}
+
+func TestCache_scheduleRefresh_zones(t *testing.T) {
+	c := newCache(&cacheConfig{
+		size:                 testCacheSize,
+		optimistic:           true,
+		proactiveRefreshTime: time.Second,
+		cooldownPeriod:       time.Hour,
+		cooldownThreshold:    3,
+		pinnedZones:          []string{"*.example.com"},
+		excludedZones:        []string{"private.example.com"},
+	})
+	t.Cleanup(c.stopProactiveRefresh)
+
+	testCases := []struct {
+		name string
+		host string
+		want bool
+	}{{
+		name: "pinned",
+		host: "new.example.com.",
+		want: true,
+	}, {
+		name: "apex",
+		host: "example.com.",
+		want: false,
+	}, {
+		name: "excluded",
+		host: "a.private.example.com.",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			key := msgToKey(req)
+
+			c.scheduleRefresh(key, 3600, req)
+			_, ok := c.refreshTimers.Load(string(key))
+
+			assert.Equal(t, tc.want, ok)
+		})
+	}
+}
+
+func TestCache_executeRefresh_excluded(t *testing.T) {
+	const host = "tracker.example.com."
+
+	startTime := time.Unix(0, 0)
+	clock := &scenarioClock{
+		mu:  &sync.Mutex{},
+		now: startTime,
+	}
+
+	conf := &cacheConfig{
+		size:                 testCacheSize,
+		proactiveRefreshTime: time.Second,
+		cooldownPeriod:       time.Hour,
+		cooldownThreshold:    3,
+		pinnedZones:          []string{"example.com"},
+		clock:                clock,
+	}
+
+	c := newCache(conf)
+	c.logger = slogutil.NewDiscardLogger()
+	t.Cleanup(c.stopProactiveRefresh)
+
+	var refreshes int
+	c.cr = &testCachingResolver{
+		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+			refreshes++
+
+			return false, nil
+		},
+		onCacheResp: func(_ *DNSContext) {},
+	}
+
+	req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	keyStr := string(msgToKey(req))
+
+	c.scheduleRefresh([]byte(keyStr), 60, req)
+	c.refreshFailures.Store(keyStr, &refreshBackoff{})
+
+	// Exclude the domain name after the refresh has been scheduled, e.g. by
+	// reloading the configuration.
+	conf.excludedZones = []string{"tracker.example.com"}
+	c.setSettings(conf)
+
+	clock.advance(startTime.Add(time.Hour))
+
+	assert.Zero(t, refreshes)
+
+	_, ok := c.refreshFailures.Load(keyStr)
+	assert.False(t, ok)
+}
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
@@ -55,10 +56,20 @@ var _ Upstream = (*dnsCrypt)(nil)
 // Address implements the [Upstream] interface for *dnsCrypt.
 func (p *dnsCrypt) Address() string { return p.addr.String() }
 
-// Exchange implements the [Upstream] interface for *dnsCrypt.
-func (p *dnsCrypt) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+// Exchange implements the [Upstream] interface for *dnsCrypt.  Note that the
+// exchange in progress isn't aborted when ctx is canceled, only the retry is.
+//
+// TODO(e.burkov):  Abort the exchange when the DNSCrypt client supports it.
+func (p *dnsCrypt) Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return nil, fmt.Errorf("exchanging with %s: %w", p.addr, err)
+	}
+
 	resp, err = p.exchangeDNSCrypt(req)
-	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
+	if ctx.Err() != nil {
+		return resp, withContextErr(ctx, err)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
 		// If request times out, it is possible that the server configuration
 		// has been changed.  It is safe to assume that the key was rotated, see
 		// https://dnscrypt.pl/2017/02/26/how-key-rotation-is-automated.
@@ -149,7 +149,7 @@ func TestDNSCrypt_Exchange_truncated(t *testing.T) {
 	req := (&dns.Msg{}).SetQuestion("unit-test2.dns.adguard.com.", dns.TypeTXT)
 
 	// Check that response is not truncated (even though it's huge).
-	res, err := u.Exchange(req)
+	res, err := u.Exchange(context.Background(), req)
 	require.NoError(t, err)
 
 	assert.False(t, res.Truncated)
@@ -180,7 +180,7 @@ func TestDNSCrypt_Exchange_deadline(t *testing.T) {
 
 	req := (&dns.Msg{}).SetQuestion("unit-test2.dns.adguard.com.", dns.TypeTXT)
 
-	res, err := u.Exchange(req)
+	res, err := u.Exchange(context.Background(), req)
 	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
 
 	assert.Nil(t, res)
@@ -213,7 +213,7 @@ func TestDNSCrypt_Exchange_dialFail(t *testing.T) {
 		testutil.CleanupAndRequireSuccess(t, u.Close)
 
 		var res *dns.Msg
-		res, err = u.Exchange(req)
+		res, err = u.Exchange(context.Background(), req)
 		require.Error(t, err)
 
 		assert.Nil(t, res)
@@ -235,7 +235,7 @@ func TestDNSCrypt_Exchange_dialFail(t *testing.T) {
 		require.NoError(t, err)
 
 		var res *dns.Msg
-		res, err = u.Exchange(req)
+		res, err = u.Exchange(context.Background(), req)
 		require.ErrorIs(t, err, validationErr)
 
 		assert.Nil(t, res)
@@ -1,16 +1,22 @@
 package upstream
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
 	"net/url"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
@@ -18,6 +24,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/httphdr"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/syncutil"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -42,8 +49,34 @@ const (
 	// dohMaxIdleConns controls the maximum number of connections being idle
 	// at the same time.
 	dohMaxIdleConns = 2
+
+	// h3FallbackDelay is the time HTTP/3 is waited for after HTTP/2 has been
+	// found available, when HTTP/3 is preferred.  It's long enough for the QUIC
+	// handshake to complete on a working network, but doesn't make the fallback
+	// wait for the whole timeout when UDP is silently dropped.
+	h3FallbackDelay = 300 * time.Millisecond
+)
+
+// Values of the HTTP request priority, see RFC 9218.
+const (
+	// hdrPriority is the name of the header containing the priority of the
+	// request.
+	hdrPriority = "Priority"
+
+	// priorityBackground is the priority of the background queries, see
+	// [WithBackground].  It's the lowest urgency, while the interactive queries
+	// have the default one.
+	priorityBackground = "u=7"
 )
 
+// dohPackPool stores the buffers for packing DNS-over-HTTPS requests.
+var dohPackPool = syncutil.NewSlicePool[byte](dns.MinMsgSize)
+
+// dohBodyPool stores the buffers for reading DNS-over-HTTPS response bodies.
+var dohBodyPool = syncutil.NewPool(func() (b *bytes.Buffer) {
+	return bytes.NewBuffer(make([]byte, 0, dns.MinMsgSize))
+})
+
 // dnsOverHTTPS is a struct that implements the Upstream interface for the
 // DNS-over-HTTPS protocol.
 type dnsOverHTTPS struct {
@@ -51,6 +84,9 @@ type dnsOverHTTPS struct {
 	// one.
 	getDialer DialerInitializer
 
+	// bindAddr is the local side of the QUIC connections.  It may be nil.
+	bindAddr *BindAddr
+
 	// addr is the DNS-over-HTTPS server URL.
 	addr *url.URL
 
@@ -78,28 +114,61 @@ type dnsOverHTTPS struct {
 	// transportH2 is an HTTP/2 transport if any.
 	transportH2 *http2.Transport
 
+	// streams counts the requests in flight per connection.
+	streams *streamCounter
+
+	// padding pads the queries, if not nil.
+	padding *padding
+
 	// addrRedacted is the redacted string representation of addr.  It is saved
 	// separately to reduce allocations during logging and error reporting.
 	addrRedacted string
 
 	// timeout is used in HTTP client and for H3 probes.
 	timeout time.Duration
+
+	// pingPeriod is the period of HTTP/2 pings on idle connections.
+	pingPeriod time.Duration
+
+	// preferH3 is true if HTTP/3 should be used whenever QUIC is available,
+	// with HTTP/2 only used as a fallback.
+	preferH3 bool
 }
 
 // newDoH returns the DNS-over-HTTPS Upstream.
 func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 	addPort(addr, defaultPortDoH)
 
+	pad, err := newPadding(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	var httpVersions []HTTPVersion
+	preferH3 := false
 	if addr.Scheme == "h3" {
 		addr.Scheme = "https"
 		httpVersions = []HTTPVersion{HTTPVersion3}
+		if opts.HTTP3Fallback {
+			httpVersions = append(httpVersions, HTTPVersion2)
+			preferH3 = true
+		}
 	} else if httpVersions = opts.HTTPVersions; len(opts.HTTPVersions) == 0 {
 		httpVersions = DefaultHTTPVersions
 	}
 
+	if opts.ProxyURL != nil {
+		// QUIC can't be established through the proxy.
+		httpVersions = slices.DeleteFunc(slices.Clone(httpVersions), func(v HTTPVersion) (ok bool) {
+			return v == HTTPVersion3
+		})
+		if len(httpVersions) == 0 {
+			return nil, errors.Error("http/3 can't be used through proxy")
+		}
+	}
+
 	quicConf := &quic.Config{
-		KeepAlivePeriod: QUICKeepAlivePeriod,
+		KeepAlivePeriod: cmp.Or(opts.KeepAlivePeriod, QUICKeepAlivePeriod),
 		TokenStore:      newQUICTokenStore(),
 	}
 
@@ -109,6 +178,7 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 
 	ups := &dnsOverHTTPS{
 		getDialer:  newDialerInitializer(addr, opts),
+		bindAddr:   opts.BindAddr,
 		addr:       addr,
 		quicConf:   quicConf,
 		quicConfMu: &sync.Mutex{},
@@ -128,9 +198,13 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 			VerifyConnection:      opts.VerifyConnection,
 		},
 		clientMu:     &sync.Mutex{},
+		streams:      newStreamCounter(),
 		logger:       opts.Logger,
+		padding:      pad,
 		addrRedacted: addr.Redacted(),
 		timeout:      opts.Timeout,
+		pingPeriod:   cmp.Or(opts.KeepAlivePeriod, transportDefaultReadIdleTimeout),
+		preferH3:     preferH3,
 	}
 	for _, v := range httpVersions {
 		ups.tlsConf.NextProtos = append(ups.tlsConf.NextProtos, string(v))
@@ -142,7 +216,10 @@ func newDoH(addr *url.URL, opts *Options) (u Upstream, err error) {
 }
 
 // type check
-var _ Upstream = (*dnsOverHTTPS)(nil)
+var (
+	_ Upstream      = (*dnsOverHTTPS)(nil)
+	_ StreamCounter = (*dnsOverHTTPS)(nil)
+)
 
 // Address implements the [Upstream] interface for *dnsOverHTTPS.  The address
 // is redacted: if the original URL of this upstream contains a userinfo with a
@@ -150,7 +227,10 @@ var _ Upstream = (*dnsOverHTTPS)(nil)
 func (p *dnsOverHTTPS) Address() string { return p.addrRedacted }
 
 // Exchange implements the [Upstream] interface for *dnsOverHTTPS.
-func (p *dnsOverHTTPS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsOverHTTPS) Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	req, addedOPT := p.padding.pad(req)
+	defer func() { p.padding.unpad(resp, addedOPT) }()
+
 	// In order to maximize HTTP cache friendliness, DoH clients using media
 	// formats that include the ID field from the DNS message header, such as
 	// "application/dns-message", SHOULD use a DNS ID of 0 in every DNS request.
@@ -174,23 +254,36 @@ func (p *dnsOverHTTPS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	}
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeHTTPS(client, req)
+	resp, err = p.exchangeHTTPS(ctx, client, req)
 
 	// Make up to 2 attempts to re-create the HTTP client and send the request
 	// again.  There are several cases (mostly, with QUIC) where this workaround
 	// is necessary to make HTTP client usable.  We need to make 2 attempts in
 	// the case when the connection was closed (due to inactivity for example)
 	// AND the server refuses to open a 0-RTT connection.
-	for i := 0; isCached && p.shouldRetry(err) && i < 2; i++ {
+	migrated := false
+	for i := 0; isCached && ctx.Err() == nil && p.shouldRetry(err) && i < 2; i++ {
+		if !migrated && p.migrateClient(ctx, client, err) {
+			// Try the same connection on the new path first.
+			migrated = true
+			resp, err = p.exchangeHTTPS(ctx, client, req)
+
+			continue
+		}
+
 		client, err = p.resetClient(err)
 		if err != nil {
 			return nil, fmt.Errorf("failed to reset http client: %w", err)
 		}
 
-		resp, err = p.exchangeHTTPS(client, req)
+		resp, err = p.exchangeHTTPS(ctx, client, req)
 	}
 
-	if err != nil {
+	if err != nil && ctx.Err() != nil {
+		// The request has been aborted by the caller, so the client is still
+		// usable.
+		return nil, withContextErr(ctx, err)
+	} else if err != nil {
 		// If the request failed anyway, make sure we don't use this client.
 		_, resErr := p.resetClient(err)
 
@@ -200,6 +293,13 @@ func (p *dnsOverHTTPS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	return resp, err
 }
 
+// Streams implements the [StreamCounter] interface for *dnsOverHTTPS.  The
+// connections are identified by their local addresses.  Note that the requests
+// sent over HTTP/3 aren't counted.
+func (p *dnsOverHTTPS) Streams() (counts map[string]int) {
+	return p.streams.snapshot()
+}
+
 // Close implements the Upstream interface for *dnsOverHTTPS.
 func (p *dnsOverHTTPS) Close() (err error) {
 	p.clientMu.Lock()
@@ -228,7 +328,11 @@ func (p *dnsOverHTTPS) closeClient(client *http.Client) (err error) {
 }
 
 // exchangeHTTPS logs the request and its result and calls exchangeHTTPSClient.
-func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsOverHTTPS) exchangeHTTPS(
+	ctx context.Context,
+	client *http.Client,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
 	n := networkTCP
 	if isHTTP3(client) {
 		n = networkUDP
@@ -237,20 +341,27 @@ func (p *dnsOverHTTPS) exchangeHTTPS(client *http.Client, req *dns.Msg) (resp *d
 	logBegin(p.logger, p.addrRedacted, n, req)
 	defer func() { logFinish(p.logger, p.addrRedacted, n, err) }()
 
-	return p.exchangeHTTPSClient(client, req)
+	return p.exchangeHTTPSClient(ctx, client, req)
 }
 
 // exchangeHTTPSClient sends the DNS query to a DoH resolver using the specified
 // http.Client instance.
 func (p *dnsOverHTTPS) exchangeHTTPSClient(
+	ctx context.Context,
 	client *http.Client,
 	req *dns.Msg,
 ) (resp *dns.Msg, err error) {
-	buf, err := req.Pack()
+	bufPtr := dohPackPool.Get()
+	defer dohPackPool.Put(bufPtr)
+
+	buf, err := req.PackBuffer(*bufPtr)
 	if err != nil {
 		return nil, fmt.Errorf("packing message: %w", err)
 	}
 
+	// Keep the buffer in case it's been grown.
+	*bufPtr = buf[:0]
+
 	// It appears, that GET requests are more memory-efficient with Golang
 	// implementation of HTTP/2.
 	method := http.MethodGet
@@ -271,7 +382,7 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 		RawQuery: q.Encode(),
 	}
 
-	httpReq, err := http.NewRequest(method, u.String(), nil)
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating http request to %s: %w", p.addrRedacted, err)
 	}
@@ -280,18 +391,42 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(
 	// https://github.com/AdguardTeam/dnsproxy/issues/211.
 	httpReq.Header.Set(httphdr.UserAgent, "")
 	httpReq.Header.Set(httphdr.Accept, "application/dns-message")
+	if isBackground(ctx) {
+		// Let the server prioritize the interactive queries over this one.
+		// Note that x/net/http2 client doesn't send PRIORITY frames, which are
+		// deprecated by RFC 9113 anyway.
+		httpReq.Header.Set(hdrPriority, priorityBackground)
+	}
+
+	var connAddr string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			// The transport may retry the request on another connection.
+			p.streams.release(connAddr)
+			connAddr = info.Conn.LocalAddr().String()
+			p.streams.acquire(connAddr)
+		},
+	}
+	httpReq = httpReq.WithContext(httptrace.WithClientTrace(httpReq.Context(), trace))
 
 	httpResp, err := client.Do(httpReq)
+	defer func() { p.streams.release(connAddr) }()
 	if err != nil {
 		return nil, fmt.Errorf("requesting %s: %w", p.addrRedacted, err)
 	}
 	defer slogutil.CloseAndLog(httpReq.Context(), p.logger, httpResp.Body, slog.LevelDebug)
 
-	body, err := io.ReadAll(httpResp.Body)
+	bodyBuf := dohBodyPool.Get()
+	defer dohBodyPool.Put(bodyBuf)
+
+	bodyBuf.Reset()
+	_, err = bodyBuf.ReadFrom(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
 	if err != nil {
 		return nil, fmt.Errorf("reading %s: %w", p.addrRedacted, err)
 	}
 
+	body := bodyBuf.Bytes()
+
 	if httpResp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf(
 			"expected status %d, got %d from %s",
@@ -343,6 +478,35 @@ func (p *dnsOverHTTPS) shouldRetry(err error) (ok bool) {
 	return false
 }
 
+// migrateClient migrates the HTTP/3 connection of client to a new local socket
+// if exchangeErr is a timeout, which may be caused by a network change.  ok is
+// true if the connection has been migrated.
+func (p *dnsOverHTTPS) migrateClient(
+	ctx context.Context,
+	client *http.Client,
+	exchangeErr error,
+) (ok bool) {
+	var netErr net.Error
+	if !isHTTP3(client) || !errors.As(exchangeErr, &netErr) || !netErr.Timeout() {
+		return false
+	}
+
+	t := cmp.Or(p.timeout, dialTimeout)
+	ctx, cancel := context.WithTimeout(ctx, t)
+	defer cancel()
+
+	err := client.Transport.(*http3Transport).migrate(ctx)
+	if err != nil {
+		p.logger.Debug("migrating quic connection", slogutil.KeyError, err)
+
+		return false
+	}
+
+	p.logger.Debug("migrated quic connection", slogutil.KeyError, exchangeErr)
+
+	return true
+}
+
 // resetClient triggers re-creation of the *http.Client that is used by this
 // upstream.  This method accepts the error that caused resetting client as
 // depending on the error we may also reset the QUIC config.
@@ -468,7 +632,7 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	transport := &http.Transport{
 		TLSClientConfig:    tlsConf,
 		DisableCompression: true,
-		DialContext:        dialContext,
+		DialContext:        p.dialBootstrapped,
 		IdleConnTimeout:    transportDefaultIdleConnTimeout,
 		MaxConnsPerHost:    dohMaxConnsPerHost,
 		MaxIdleConns:       dohMaxIdleConns,
@@ -487,11 +651,23 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 	}
 
 	// Enable HTTP/2 pings on idle connections.
-	p.transportH2.ReadIdleTimeout = transportDefaultReadIdleTimeout
+	p.transportH2.ReadIdleTimeout = p.pingPeriod
 
 	return transport, nil
 }
 
+// dialBootstrapped dials the server using the addresses bootstrapped anew, so
+// that the new connections follow the changes of the server's addresses instead
+// of the ones resolved when the transport was created.
+func (p *dnsOverHTTPS) dialBootstrapped(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	dialContext, err := p.getDialer()
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", p.addrRedacted, err)
+	}
+
+	return dialContext(ctx, network, addr)
+}
+
 // http3Transport is a wrapper over [*http3.Transport] that tries to optimize
 // its behavior.  The main thing that it does is trying to force use a single
 // connection to a host instead of creating a new one all the time.  It also
@@ -499,6 +675,24 @@ func (p *dnsOverHTTPS) createTransport() (t http.RoundTripper, err error) {
 type http3Transport struct {
 	baseTransport *http3.Transport
 
+	// bind is the local side of the new paths of the connection.  It may be
+	// nil.
+	bind *BindAddr
+
+	// conn is the last QUIC connection dialed by baseTransport.  It's nil
+	// until the first one is dialed.  It's protected by migrateMu.
+	conn *quic.Conn
+
+	// migrateErr is the result of the last migration of conn.  It's protected
+	// by migrateMu.
+	migrateErr error
+
+	// migrateMu protects conn and migrateErr, and serializes the migrations.
+	migrateMu *sync.Mutex
+
+	// raddr is the address of the server.
+	raddr netip.AddrPort
+
 	closed bool
 	mu     sync.RWMutex
 }
@@ -539,6 +733,119 @@ func (h *http3Transport) Close() (err error) {
 	return h.baseTransport.Close()
 }
 
+// dial dials a new QUIC connection to the server and remembers it to migrate
+// it later.  Unlike [dialQUIC], it uses non-empty connection IDs, since the
+// packets received on the new paths are routed by them.
+func (h *http3Transport) dial(
+	ctx context.Context,
+	tlsCfg *tls.Config,
+	cfg *quic.Config,
+) (conn *quic.Conn, err error) {
+	tr, err := h.newQUICTransport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err = tr.DialEarly(ctx, net.UDPAddrFromAddrPort(h.raddr), tlsCfg, cfg)
+	if err != nil {
+		return nil, errors.WithDeferred(err, closeQUICTransport(tr))
+	}
+
+	closeOnDone(conn, tr)
+
+	h.migrateMu.Lock()
+	defer h.migrateMu.Unlock()
+
+	h.conn = conn
+
+	return conn, nil
+}
+
+// newQUICTransport returns a QUIC transport over a new local socket.
+func (h *http3Transport) newQUICTransport(ctx context.Context) (tr *quic.Transport, err error) {
+	var pc net.PacketConn
+	if h.bind == nil {
+		network := "udp4"
+		if h.raddr.Addr().Unmap().Is6() {
+			network = "udp6"
+		}
+
+		pc, err = net.ListenUDP(network, nil)
+	} else {
+		pc, err = h.bind.ListenPacket(ctx, h.raddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening socket: %w", err)
+	}
+
+	return &quic.Transport{Conn: pc}, nil
+}
+
+// closeQUICTransport closes tr along with its socket, since the QUIC transport
+// doesn't close the sockets it hasn't opened itself.
+func closeQUICTransport(tr *quic.Transport) (err error) {
+	return errors.WithDeferred(tr.Close(), tr.Conn.Close())
+}
+
+// closeOnDone closes tr once conn is closed.
+func closeOnDone(conn *quic.Conn, tr *quic.Transport) {
+	go func() {
+		<-conn.Context().Done()
+		_ = closeQUICTransport(tr)
+	}()
+}
+
+// migrate moves the current QUIC connection to a new local socket, see RFC
+// 9000, Section 9.  It's used instead of reconnecting when the requests time
+// out, since the old path may be broken by a network change.  If a migration is
+// already in progress, migrate waits for it and returns its result.
+func (h *http3Transport) migrate(ctx context.Context) (err error) {
+	if !h.migrateMu.TryLock() {
+		h.migrateMu.Lock()
+		defer h.migrateMu.Unlock()
+
+		return h.migrateErr
+	}
+	defer h.migrateMu.Unlock()
+
+	h.migrateErr = h.switchPath(ctx)
+
+	return h.migrateErr
+}
+
+// switchPath validates a new path of the current connection and switches to
+// it.  h.migrateMu must be locked.
+func (h *http3Transport) switchPath(ctx context.Context) (err error) {
+	conn := h.conn
+	if conn == nil || conn.Context().Err() != nil {
+		return net.ErrClosed
+	}
+
+	tr, err := h.newQUICTransport(ctx)
+	if err != nil {
+		return err
+	}
+
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("adding path: %w", err), closeQUICTransport(tr))
+	}
+
+	err = path.Probe(ctx)
+	if err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		err = errors.WithDeferred(err, path.Close())
+
+		return errors.WithDeferred(fmt.Errorf("switching path: %w", err), closeQUICTransport(tr))
+	}
+
+	closeOnDone(conn, tr)
+
+	return nil
+}
+
 // createTransportH3 tries to create an HTTP/3 transport for this upstream.  We
 // should be able to fall back to H1/H2 in case if HTTP/3 is unavailable or if
 // it is too slow.  In order to do that, this method will run two probes in
@@ -557,7 +864,17 @@ func (p *dnsOverHTTPS) createTransportH3(
 		return nil, err
 	}
 
-	rt := &http3.Transport{
+	raddr, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing address: %w", err)
+	}
+
+	h := &http3Transport{
+		bind:      p.bindAddr,
+		migrateMu: &sync.Mutex{},
+		raddr:     raddr,
+	}
+	h.baseTransport = &http3.Transport{
 		Dial: func(
 			ctx context.Context,
 
@@ -567,14 +884,14 @@ func (p *dnsOverHTTPS) createTransportH3(
 			tlsCfg *tls.Config,
 			cfg *quic.Config,
 		) (c *quic.Conn, err error) {
-			return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+			return h.dial(ctx, tlsCfg, cfg)
 		},
 		DisableCompression: true,
 		TLSClientConfig:    tlsConfig,
 		QUICConfig:         p.getQUICConfig(),
 	}
 
-	return &http3Transport{baseTransport: rt}, nil
+	return h, nil
 }
 
 // probeH3 runs a test to check whether QUIC is faster than TLS for this
@@ -625,6 +942,10 @@ func (p *dnsOverHTTPS) probeH3(
 	go p.probeQUIC(addr, probeTLSCfg, chQUIC)
 	go p.probeTLS(dialContext, probeTLSCfg, chTLS)
 
+	if p.preferH3 {
+		return p.preferQUIC(addr, chQUIC, chTLS)
+	}
+
 	select {
 	case quicErr := <-chQUIC:
 		if quicErr != nil {
@@ -646,6 +967,49 @@ func (p *dnsOverHTTPS) probeH3(
 	}
 }
 
+// preferQUIC waits for the results of the probes run by probeH3 and returns
+// addr if HTTP/3 should be used.  Unlike the plain race, QUIC wins unless TLS
+// succeeds and QUIC doesn't follow it within h3FallbackDelay.
+func (p *dnsOverHTTPS) preferQUIC(
+	addr string,
+	chQUIC <-chan error,
+	chTLS <-chan error,
+) (resAddr string, err error) {
+	select {
+	case err = <-chQUIC:
+		if err != nil {
+			return "", err
+		}
+
+		return addr, nil
+	case tlsErr := <-chTLS:
+		if tlsErr != nil {
+			// HTTP/2 isn't available either, so wait for QUIC.
+			p.logger.Debug("probing tls", slogutil.KeyError, tlsErr)
+
+			if err = <-chQUIC; err != nil {
+				return "", err
+			}
+
+			return addr, nil
+		}
+	}
+
+	timer := time.NewTimer(h3FallbackDelay)
+	defer timer.Stop()
+
+	select {
+	case err = <-chQUIC:
+		if err != nil {
+			return "", err
+		}
+
+		return addr, nil
+	case <-timer.C:
+		return "", fmt.Errorf("quic is slower than tls by more than %s", h3FallbackDelay)
+	}
+}
+
 // probeQUIC attempts to establish a QUIC connection to the specified address.
 // We run probeQUIC and probeTLS in parallel and see which one is faster.
 func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan error) {
@@ -658,7 +1022,7 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(t))
 	defer cancel()
 
-	conn, err := quic.DialAddrEarly(ctx, addr, tlsConfig, p.getQUICConfig())
+	conn, err := dialQUIC(ctx, p.bindAddr, addr, tlsConfig, p.getQUICConfig())
 	if err != nil {
 		ch <- fmt.Errorf("opening quic connection to %s: %w", p.addrRedacted, err)
 		return
@@ -678,7 +1042,7 @@ func (p *dnsOverHTTPS) probeQUIC(addr string, tlsConfig *tls.Config, ch chan err
 func (p *dnsOverHTTPS) probeTLS(dialContext bootstrap.DialHandler, tlsConfig *tls.Config, ch chan error) {
 	startTime := time.Now()
 
-	conn, err := tlsDial(dialContext, tlsConfig)
+	conn, err := tlsDial(context.Background(), dialContext, tlsConfig)
 	if err != nil {
 		ch <- fmt.Errorf("opening TLS connection: %w", err)
 		return
@@ -721,3 +1085,52 @@ func isHTTP3(client *http.Client) (ok bool) {
 
 	return ok
 }
+
+// streamCounter counts the requests in flight per connection.
+type streamCounter struct {
+	// mu protects counts.
+	mu *sync.Mutex
+
+	// counts maps the local address of a connection to the number of requests
+	// in flight over it.
+	counts map[string]int
+}
+
+// newStreamCounter returns a new properly initialized *streamCounter.
+func newStreamCounter() (c *streamCounter) {
+	return &streamCounter{
+		mu:     &sync.Mutex{},
+		counts: map[string]int{},
+	}
+}
+
+// acquire registers a new request in flight over the connection with addr.
+func (c *streamCounter) acquire(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[addr]++
+}
+
+// release unregisters a request in flight over the connection with addr.  It
+// does nothing if addr is empty.
+func (c *streamCounter) release(addr string) {
+	if addr == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[addr]--; c.counts[addr] <= 0 {
+		delete(c.counts, addr)
+	}
+}
+
+// snapshot returns a copy of the current counts.
+func (c *streamCounter) snapshot() (counts map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return maps.Clone(c.counts)
+}
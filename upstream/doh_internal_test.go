@@ -19,6 +19,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -254,7 +255,7 @@ func TestUpstreamDoH_serverRestart(t *testing.T) {
 			require.False(t, t.Failed())
 
 			t.Run("retry", func(t *testing.T) {
-				_, err := u.Exchange(createTestMessage())
+				_, err := u.Exchange(context.Background(), createTestMessage())
 				require.Error(t, err)
 
 				_ = startDoHServer(t, testDoHServerOptions{
@@ -291,7 +292,7 @@ func TestUpstreamDoH_0RTT(t *testing.T) {
 	req := createTestMessage()
 
 	// Trigger connection to a DoH3 server.
-	resp, err := uh.Exchange(req)
+	resp, err := uh.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, resp)
 
@@ -307,7 +308,7 @@ func TestUpstreamDoH_0RTT(t *testing.T) {
 	}()
 
 	// Trigger second connection.
-	resp, err = uh.Exchange(req)
+	resp, err = uh.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, resp)
 
@@ -322,6 +323,198 @@ func TestUpstreamDoH_0RTT(t *testing.T) {
 	require.True(t, conns[1].is0RTT())
 }
 
+func TestUpstreamDoH_reBootstrap(t *testing.T) {
+	t.Parallel()
+
+	srv := startDoHServer(t, testDoHServerOptions{})
+	srvAddr := netip.MustParseAddrPort(srv.addr)
+
+	var lookups atomic.Int32
+	boot := &testResolver{
+		onLookupNetIP: func(_ context.Context, _, host string) (addrs []netip.Addr, err error) {
+			require.Equal(testutil.PanicT{}, "doh.example", host)
+
+			lookups.Add(1)
+
+			return []netip.Addr{srvAddr.Addr()}, nil
+		},
+	}
+
+	address := fmt.Sprintf("https://doh.example:%d/dns-query", srvAddr.Port())
+	u, err := AddressToUpstream(address, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion11, HTTPVersion2},
+		Bootstrap:          boot,
+		Timeout:            timeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	uh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	req := createTestMessage()
+
+	resp, err := uh.Exchange(context.Background(), req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	client, _, err := uh.getClient()
+	require.NoError(t, err)
+
+	// Drop the connection to make the transport dial a new one.
+	uh.transportH2.CloseIdleConnections()
+	prev := lookups.Load()
+
+	resp, err = uh.Exchange(context.Background(), req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	// The hostname is bootstrapped again for the new connection without
+	// recreating the client.
+	assert.Equal(t, prev+1, lookups.Load())
+
+	next, _, err := uh.getClient()
+	require.NoError(t, err)
+	assert.Same(t, client, next)
+}
+
+func TestUpstreamDoH_http3Fallback(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		wantProtocol     HTTPVersion
+		wantErr          bool
+		http3Enabled     bool
+		dropUDP          bool
+		fallback         bool
+		delayHandshakeH3 time.Duration
+	}{{
+		name:         "http3",
+		wantProtocol: HTTPVersion3,
+		wantErr:      false,
+		http3Enabled: true,
+		fallback:     true,
+	}, {
+		name:             "http3_slower",
+		wantProtocol:     HTTPVersion3,
+		wantErr:          false,
+		http3Enabled:     true,
+		fallback:         true,
+		delayHandshakeH3: 200 * time.Millisecond,
+	}, {
+		name:         "udp_blocked",
+		wantProtocol: HTTPVersion2,
+		wantErr:      false,
+		http3Enabled: false,
+		fallback:     true,
+	}, {
+		name:         "udp_dropped",
+		wantProtocol: HTTPVersion2,
+		wantErr:      false,
+		http3Enabled: false,
+		dropUDP:      true,
+		fallback:     true,
+	}, {
+		name:         "udp_blocked_no_fallback",
+		wantProtocol: "",
+		wantErr:      true,
+		http3Enabled: false,
+		fallback:     false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := startDoHServer(t, testDoHServerOptions{
+				http3Enabled:     tc.http3Enabled,
+				dropUDP:          tc.dropUDP,
+				delayHandshakeH3: tc.delayHandshakeH3,
+			})
+
+			var negotiated atomic.Value
+			address := fmt.Sprintf("h3://%s/dns-query", srv.addr)
+			u, err := AddressToUpstream(address, &Options{
+				Logger:             testLogger,
+				InsecureSkipVerify: true,
+				HTTP3Fallback:      tc.fallback,
+				Timeout:            timeout,
+				VerifyConnection: func(state tls.ConnectionState) (err error) {
+					negotiated.Store(HTTPVersion(state.NegotiatedProtocol))
+
+					return nil
+				},
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			req := createTestMessage()
+			start := time.Now()
+			resp, err := u.Exchange(context.Background(), req)
+			if tc.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			require.Equal(t, tc.wantProtocol, negotiated.Load())
+
+			// The fallback shouldn't wait for the QUIC probe to time out.
+			assert.Less(t, time.Since(start), timeout)
+		})
+	}
+}
+
+func TestUpstreamDoH_migrate(t *testing.T) {
+	t.Parallel()
+
+	remoteAddrs := make(chan string, 2)
+	handler := createDoHHandlerFunc()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+		handler(w, r)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{
+		handler:      mux,
+		http3Enabled: true,
+	})
+
+	u, err := AddressToUpstream("h3://"+srv.addr+"/dns-query", &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		Timeout:            timeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(context.Background(), req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	doh := testutil.RequireTypeAssert[*dnsOverHTTPS](t, u)
+	client, _, err := doh.getClient()
+	require.NoError(t, err)
+
+	h3 := testutil.RequireTypeAssert[*http3Transport](t, client.Transport)
+
+	ctx := testutil.ContextWithTimeout(t, timeout)
+	require.NoError(t, h3.migrate(ctx))
+
+	resp, err = u.Exchange(context.Background(), req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	assert.NotEqual(t, <-remoteAddrs, <-remoteAddrs)
+}
+
 // testDoHServerOptions allows customizing testDoHServer behavior.
 type testDoHServerOptions struct {
 	// handler is an HTTP handler that should be used by the server.  The
@@ -339,6 +532,10 @@ type testDoHServerOptions struct {
 	// http3Enabled is a flag that indicates whether the server should start an
 	// HTTP/3 server.
 	http3Enabled bool
+	// dropUDP is a flag that indicates whether the server should silently drop
+	// the UDP packets instead of serving HTTP/3.  It's ignored if http3Enabled
+	// is true.
+	dropUDP bool
 }
 
 // testDoHServer is an instance of a test DNS-over-HTTPS server.
@@ -467,6 +664,12 @@ func startDoHServer(
 			// TODO(ameshkov): check the error here.
 			_ = serverH3.ServeListener(listenerH3)
 		}()
+	} else if opts.dropUDP {
+		// Occupy the port, but never read from it.
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, conn.Close)
 	}
 
 	s = &testDoHServer{
@@ -538,3 +741,112 @@ func createDoHHandler() (h http.Handler) {
 
 	return mux
 }
+
+func TestUpstreamDoH_Streams(t *testing.T) {
+	t.Parallel()
+
+	const (
+		reqsNum = 3
+		timeout = 5 * time.Second
+	)
+
+	started := make(chan struct{}, reqsNum)
+	release := make(chan struct{})
+	handler := createDoHHandlerFunc()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		handler(w, r)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion2},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	sc := testutil.RequireTypeAssert[StreamCounter](t, u)
+
+	require.Empty(t, sc.Streams())
+
+	errs := make(chan error, reqsNum)
+	for range reqsNum {
+		go func() {
+			_, exchErr := u.Exchange(context.Background(), createTestMessage())
+			errs <- exchErr
+		}()
+	}
+
+	for range reqsNum {
+		testutil.RequireReceive(t, started, timeout)
+	}
+
+	var total int
+	for _, n := range sc.Streams() {
+		total += n
+	}
+	require.Equal(t, reqsNum, total)
+
+	close(release)
+	for range reqsNum {
+		exchErr, _ := testutil.RequireReceive(t, errs, timeout)
+		require.NoError(t, exchErr)
+	}
+
+	require.Empty(t, sc.Streams())
+}
+
+func TestUpstreamDoH_priority(t *testing.T) {
+	t.Parallel()
+
+	priorities := make(chan string, 1)
+	handler := createDoHHandlerFunc()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		priorities <- r.Header.Get(hdrPriority)
+		handler(w, r)
+	})
+
+	srv := startDoHServer(t, testDoHServerOptions{handler: mux})
+
+	address := fmt.Sprintf("https://%s/dns-query", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		HTTPVersions:       []HTTPVersion{HTTPVersion2},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	testCases := []struct {
+		ctx  context.Context
+		name string
+		want string
+	}{{
+		ctx:  context.Background(),
+		name: "interactive",
+		want: "",
+	}, {
+		ctx:  WithBackground(context.Background()),
+		name: "background",
+		want: priorityBackground,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, exchErr := u.Exchange(tc.ctx, createTestMessage())
+			require.NoError(t, exchErr)
+
+			got, _ := testutil.RequireReceive(t, priorities, 5*time.Second)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
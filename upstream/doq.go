@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -30,6 +31,10 @@ const (
 	// connection.
 	QUICCodeInternalError = quic.ApplicationErrorCode(1)
 
+	// QUICCodeRequestCancelled is used to cancel the stream of a query which
+	// response is no longer needed, see RFC 9250 Section 4.3.
+	QUICCodeRequestCancelled = quic.StreamErrorCode(3)
+
 	// QUICKeepAlivePeriod is the value that we pass to *quic.Config and that
 	// controls the period with with keep-alive frames are being sent to the
 	// connection. We set it to 20s as it would be in the quic-go@v0.27.1 with
@@ -59,6 +64,9 @@ type dnsOverQUIC struct {
 	// one.
 	getDialer DialerInitializer
 
+	// bindAddr is the local side of the QUIC connections.  It may be nil.
+	bindAddr *BindAddr
+
 	// addr is the DNS-over-QUIC server URL.
 	addr *url.URL
 
@@ -91,6 +99,9 @@ type dnsOverQUIC struct {
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
+	// padding pads the queries, if not nil.
+	padding *padding
+
 	// timeout is the timeout for the upstream connection.
 	timeout time.Duration
 }
@@ -99,8 +110,13 @@ type dnsOverQUIC struct {
 func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 	addPort(addr, defaultPortDoQ)
 
+	pad, err := newPadding(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	quicConf := &quic.Config{
-		KeepAlivePeriod: QUICKeepAlivePeriod,
+		KeepAlivePeriod: cmp.Or(opts.KeepAlivePeriod, QUICKeepAlivePeriod),
 		TokenStore:      newQUICTokenStore(),
 	}
 
@@ -110,6 +126,7 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 
 	u = &dnsOverQUIC{
 		getDialer:  newDialerInitializer(addr, opts),
+		bindAddr:   opts.BindAddr,
 		addr:       addr,
 		quicConfig: quicConf,
 		tlsConf: &tls.Config{
@@ -132,6 +149,7 @@ func newDoQ(addr *url.URL, opts *Options) (u Upstream, err error) {
 		connMu:       &sync.Mutex{},
 		bytesPoolMu:  &sync.Mutex{},
 		logger:       opts.Logger,
+		padding:      pad,
 		timeout:      opts.Timeout,
 	}
 
@@ -147,7 +165,10 @@ var _ Upstream = (*dnsOverQUIC)(nil)
 func (p *dnsOverQUIC) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverQUIC.
-func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *dnsOverQUIC) Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	req, addedOPT := p.padding.pad(req)
+	defer func() { p.padding.unpad(resp, addedOPT) }()
+
 	// When sending queries over a QUIC connection, the DNS Message ID MUST be
 	// set to 0.  The stream mapping for DoQ allows for unambiguous correlation
 	// of queries and responses, so the Message ID field is not required.
@@ -170,7 +191,12 @@ func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	}
 
 	// Make the first attempt to send the DNS query.
-	resp, err = p.exchangeQUIC(req, conn)
+	resp, err = p.exchangeQUIC(ctx, req, conn)
+	if err != nil && ctx.Err() != nil {
+		// Only the stream has been canceled, so the connection is still
+		// usable.
+		return nil, withContextErr(ctx, err)
+	}
 
 	// Failure to use a cached connection should be handled gracefully as this
 	// connection could have been closed by the server or simply be broken due
@@ -190,10 +216,12 @@ func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 		}
 
 		// Retry sending the request through the new connection.
-		resp, err = p.exchangeQUIC(req, conn)
+		resp, err = p.exchangeQUIC(ctx, req, conn)
 	}
 
-	if err != nil {
+	if err != nil && ctx.Err() != nil {
+		return nil, withContextErr(ctx, err)
+	} else if err != nil {
 		// If we're unable to exchange messages, make sure the connection is
 		// closed and signal about an internal error.
 		p.closeConnWithError(conn, err)
@@ -217,8 +245,13 @@ func (p *dnsOverQUIC) Close() (err error) {
 }
 
 // exchangeQUIC attempts to open a new QUIC stream, send the DNS message
-// through it and return the response it got from the server.
-func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn *quic.Conn) (resp *dns.Msg, err error) {
+// through it and return the response it got from the server.  The stream is
+// canceled once ctx is done.
+func (p *dnsOverQUIC) exchangeQUIC(
+	ctx context.Context,
+	req *dns.Msg,
+	conn *quic.Conn,
+) (resp *dns.Msg, err error) {
 	addr := p.Address()
 
 	logBegin(p.logger, addr, networkUDP, req)
@@ -229,18 +262,27 @@ func (p *dnsOverQUIC) exchangeQUIC(req *dns.Msg, conn *quic.Conn) (resp *dns.Msg
 		return nil, fmt.Errorf("failed to pack DNS message for DoQ: %w", err)
 	}
 
-	stream, err := p.openStream(conn)
+	ctx, cancel := p.withDeadline(ctx)
+	defer cancel()
+
+	stream, err := p.openStream(ctx, conn)
 	if err != nil {
 		return nil, fmt.Errorf("opening stream: %w", err)
 	}
 
-	if p.timeout > 0 {
-		err = stream.SetDeadline(time.Now().Add(p.timeout))
+	if deadline, ok := ctx.Deadline(); ok {
+		err = stream.SetDeadline(deadline)
 		if err != nil {
 			return nil, fmt.Errorf("setting deadline: %w", err)
 		}
 	}
 
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(QUICCodeRequestCancelled)
+		stream.CancelWrite(QUICCodeRequestCancelled)
+	})
+	defer stop()
+
 	_, err = stream.Write(proxyutil.AddPrefix(buf))
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to a QUIC stream: %w", err)
@@ -317,10 +359,7 @@ func (p *dnsOverQUIC) resetQUICConfig() {
 }
 
 // openStream opens a new QUIC stream for the specified connection.
-func (p *dnsOverQUIC) openStream(conn *quic.Conn) (*quic.Stream, error) {
-	ctx, cancel := p.withDeadline(context.Background())
-	defer cancel()
-
+func (p *dnsOverQUIC) openStream(ctx context.Context, conn *quic.Conn) (*quic.Stream, error) {
 	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open a QUIC stream: %w", err)
@@ -360,7 +399,7 @@ func (p *dnsOverQUIC) openConnection() (conn *quic.Conn, err error) {
 	ctx, cancel := p.withDeadline(context.Background())
 	defer cancel()
 
-	conn, err = quic.DialAddrEarly(ctx, addr, p.tlsConf.Clone(), p.getQUICConfig())
+	conn, err = dialQUIC(ctx, p.bindAddr, addr, p.tlsConf.Clone(), p.getQUICConfig())
 	if err != nil {
 		return nil, fmt.Errorf("dialing quic connection to %s: %w", p.addr, err)
 	}
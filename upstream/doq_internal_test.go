@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/netip"
 	"net/url"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -77,6 +78,34 @@ func TestUpstreamDoQ(t *testing.T) {
 	checkRaceCondition(u)
 }
 
+func TestUpstreamDoQ_bindAddr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only linux has the whole 127.0.0.0/8 on the loopback interface")
+	}
+
+	tlsConf, rootCAs := createServerTLSConfig(t, "127.0.0.1")
+	srv := startDoQServer(t, tlsConf, 0)
+
+	bindIP := netip.MustParseAddr("127.0.0.2")
+
+	address := fmt.Sprintf("quic://%s", srv.addr)
+	u, err := AddressToUpstream(address, &Options{
+		Logger:   testLogger,
+		RootCAs:  rootCAs,
+		BindAddr: &BindAddr{IPv4: bindIP},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	checkUpstream(t, u, address)
+
+	uq := testutil.RequireTypeAssert[*dnsOverQUIC](t, u)
+	require.NotNil(t, uq.conn)
+
+	local := testutil.RequireTypeAssert[*net.UDPAddr](t, uq.conn.LocalAddr())
+	assert.Equal(t, bindIP, local.AddrPort().Addr())
+}
+
 func TestUpstream_Exchange_quicServerCloseConn(t *testing.T) {
 	// Use the same tlsConf for all servers to preserve the data necessary for
 	// 0-RTT connections.
@@ -120,7 +149,7 @@ func TestUpstream_Exchange_quicServerCloseConn(t *testing.T) {
 			defer wg.Done()
 
 			req := createTestMessage()
-			_, errExch := u.Exchange(req)
+			_, errExch := u.Exchange(context.Background(), req)
 
 			assert.NoError(t, errExch)
 		}(pt)
@@ -173,7 +202,7 @@ func TestUpstreamDoQ_serverRestart(t *testing.T) {
 	require.False(t, t.Failed())
 
 	t.Run("retry", func(t *testing.T) {
-		_, err := u.Exchange(createTestMessage())
+		_, err := u.Exchange(context.Background(), createTestMessage())
 		require.Error(t, err)
 
 		_ = startDoQServer(t, tlsConf, int(addr.Port()))
@@ -201,7 +230,7 @@ func TestUpstreamDoQ_0RTT(t *testing.T) {
 	req := createTestMessage()
 
 	// Trigger connection to a QUIC server.
-	resp, err := uq.Exchange(req)
+	resp, err := uq.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, resp)
 
@@ -217,7 +246,7 @@ func TestUpstreamDoQ_0RTT(t *testing.T) {
 	}()
 
 	// Trigger second connection.
-	resp, err = uq.Exchange(req)
+	resp, err = uq.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, resp)
 
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
@@ -41,20 +42,50 @@ type dnsOverTLS struct {
 	// logger is used for exchange logging.  It is never nil.
 	logger *slog.Logger
 
-	// conns stores the connections ready for reuse.  Don't use [sync.Pool]
+	// padding pads the queries, if not nil.
+	padding *padding
+
+	// stopKeepAlive stops probing the pooled connections.  It's nil if the
+	// probing is disabled.
+	stopKeepAlive func()
+
+	// conns stores the connections ready for reuse in the order they were put
+	// back, the most recently used one is reused first.  Don't use [sync.Pool]
 	// here, since there is no need to deallocate these connections.
 	//
-	// TODO(e.burkov, ameshkov):  Currently connections just stored in FILO
-	// order, which eventually makes most of them unusable due to timeouts.
-	// This leads to weak performance for all exchanges coming across such
-	// connections.
-	conns []net.Conn
+	// TODO(e.burkov, ameshkov):  Without the idle timeout, the connections at
+	// the bottom eventually become unusable due to the server timeouts, which
+	// leads to weak performance for all exchanges coming across such
+	// connections.  Consider enabling it by default.
+	conns []pooledConn
+
+	// idleTimeout is the maximum time a connection stays in the pool unused.
+	// If zero, the connections aren't closed due to inactivity.
+	idleTimeout time.Duration
+
+	// poolSize is the maximum number of the connections kept in the pool.  If
+	// zero, the number isn't limited.
+	poolSize uint
+}
+
+// pooledConn is a connection in the pool of [dnsOverTLS].
+type pooledConn struct {
+	// conn is the connection ready for reuse.
+	conn net.Conn
+
+	// idleSince is the time the connection was put back into the pool.
+	idleSince time.Time
 }
 
 // newDoT returns the DNS-over-TLS Upstream.
 func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 	addPort(addr, defaultPortDoT)
 
+	pad, err := newPadding(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	tlsUps := &dnsOverTLS{
 		addr:      addr,
 		getDialer: newDialerInitializer(addr, opts),
@@ -73,8 +104,15 @@ func newDoT(addr *url.URL, opts *Options) (ups Upstream, err error) {
 			VerifyPeerCertificate: opts.VerifyServerCertificate,
 			VerifyConnection:      opts.VerifyConnection,
 		},
-		connsMu: &sync.Mutex{},
-		logger:  opts.Logger,
+		connsMu:     &sync.Mutex{},
+		logger:      opts.Logger,
+		idleTimeout: opts.DoTIdleTimeout,
+		poolSize:    opts.DoTPoolSize,
+		padding:     pad,
+	}
+
+	if opts.KeepAlivePeriod > 0 {
+		tlsUps.startKeepAlive(opts.KeepAlivePeriod)
 	}
 
 	runtime.SetFinalizer(tlsUps, (*dnsOverTLS).Close)
@@ -89,19 +127,26 @@ var _ Upstream = (*dnsOverTLS)(nil)
 func (p *dnsOverTLS) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverTLS.
-func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
+func (p *dnsOverTLS) Exchange(ctx context.Context, req *dns.Msg) (reply *dns.Msg, err error) {
+	req, addedOPT := p.padding.pad(req)
+	defer func() { p.padding.unpad(reply, addedOPT) }()
+
 	h, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
 	}
 
-	conn, err := p.conn(h)
+	conn, err := p.conn(ctx, h)
 	if err != nil {
-		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
+		return nil, withContextErr(ctx, fmt.Errorf("getting conn to %s: %w", p.addr, err))
 	}
 
-	reply, err = p.exchangeWithConn(conn, req)
-	if err != nil {
+	reply, err = p.exchangeWithConn(ctx, conn, req)
+	if err != nil && ctx.Err() != nil {
+		// The exchange has been aborted, so the connection is unusable, but
+		// there is no reason to retry.
+		return nil, withContextErr(ctx, errors.WithDeferred(err, conn.Close()))
+	} else if err != nil {
 		// The pooled connection might have been closed already, see
 		// https://github.com/AdguardTeam/dnsproxy/issues/3.  The following
 		// connection from pool may also be malformed, so dial a new one.
@@ -110,19 +155,19 @@ func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
 		p.logger.Debug("dot got bad conn from pool", "addr", p.addr, slogutil.KeyError, err)
 
 		// Retry.
-		conn, err = tlsDial(h, p.tlsConf.Clone())
+		conn, err = tlsDial(ctx, h, p.tlsConf.Clone())
 		if err != nil {
-			return nil, fmt.Errorf(
+			return nil, withContextErr(ctx, fmt.Errorf(
 				"dialing %s: connecting to %s: %w",
 				p.addr,
 				p.tlsConf.ServerName,
 				err,
-			)
+			))
 		}
 
-		reply, err = p.exchangeWithConn(conn, req)
+		reply, err = p.exchangeWithConn(ctx, conn, req)
 		if err != nil {
-			return reply, errors.WithDeferred(err, conn.Close())
+			return reply, withContextErr(ctx, errors.WithDeferred(err, conn.Close()))
 		}
 	}
 
@@ -135,12 +180,16 @@ func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
 func (p *dnsOverTLS) Close() (err error) {
 	runtime.SetFinalizer(p, nil)
 
+	if p.stopKeepAlive != nil {
+		p.stopKeepAlive()
+	}
+
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
 
 	var closeErrs []error
-	for _, conn := range p.conns {
-		closeErr := conn.Close()
+	for _, pc := range p.conns {
+		closeErr := pc.conn.Close()
 		if closeErr != nil && isCriticalTCP(closeErr) {
 			closeErrs = append(closeErrs, closeErr)
 		}
@@ -149,27 +198,43 @@ func (p *dnsOverTLS) Close() (err error) {
 	return errors.Join(closeErrs...)
 }
 
-// conn returns the first available connection from the pool if there is any, or
-// dials a new one otherwise.
-func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
+// conn returns the most recently used connection from the pool if there is
+// any, or dials a new one otherwise.  The dialed connections resume the
+// previous TLS sessions, if possible.
+func (p *dnsOverTLS) conn(
+	ctx context.Context,
+	h bootstrap.DialHandler,
+) (conn net.Conn, err error) {
 	// Dial a new connection outside the lock, if needed.
 	defer func() {
-		if conn == nil {
-			conn, err = tlsDial(h, p.tlsConf.Clone())
-			err = errors.Annotate(err, "connecting to %s: %w", p.tlsConf.ServerName)
+		if conn != nil {
+			return
 		}
+
+		var tlsConn *tls.Conn
+		tlsConn, err = tlsDial(ctx, h, p.tlsConf.Clone())
+		if err != nil {
+			err = fmt.Errorf("connecting to %s: %w", p.tlsConf.ServerName, err)
+
+			return
+		}
+
+		p.logger.Debug(
+			"dot upstream dialed new conn",
+			"raddr", tlsConn.RemoteAddr(),
+			"resumed", tlsConn.ConnectionState().DidResume,
+		)
+
+		conn = tlsConn
 	}()
 
-	p.connsMu.Lock()
-	defer p.connsMu.Unlock()
+	conn, stale := p.takeIdle(time.Now())
+	p.closeIdle(stale, "idle timeout")
 
-	l := len(p.conns)
-	if l == 0 {
+	if conn == nil {
 		return nil, nil
 	}
 
-	p.conns, conn = p.conns[:l-1], p.conns[l-1]
-
 	err = conn.SetDeadline(time.Now().Add(dialTimeout))
 	if err != nil {
 		p.logger.Debug("dot upstream setting deadline to conn from pool", slogutil.KeyError, err)
@@ -184,17 +249,200 @@ func (p *dnsOverTLS) conn(h bootstrap.DialHandler) (conn net.Conn, err error) {
 	return conn, nil
 }
 
-func (p *dnsOverTLS) putBack(conn net.Conn) {
+// takeIdle removes the most recently used connection from the pool and returns
+// it.  It also removes and returns the connections idle for longer than the
+// idle timeout as stale.  conn is nil if there are no connections to reuse.
+func (p *dnsOverTLS) takeIdle(now time.Time) (conn net.Conn, stale []net.Conn) {
 	p.connsMu.Lock()
 	defer p.connsMu.Unlock()
 
-	p.conns = append(p.conns, conn)
+	stale = p.removeStaleLocked(now)
+
+	l := len(p.conns)
+	if l == 0 {
+		return nil, stale
+	}
+
+	conn = p.conns[l-1].conn
+	p.conns = p.conns[:l-1]
+
+	return conn, stale
+}
+
+// putBack returns conn to the pool, closing the least recently used connection
+// if the pool is full.
+func (p *dnsOverTLS) putBack(conn net.Conn) {
+	p.connsMu.Lock()
+	p.conns = append(p.conns, pooledConn{
+		conn:      conn,
+		idleSince: time.Now(),
+	})
+	evicted := p.trimLocked()
+	p.connsMu.Unlock()
+
+	p.closeIdle(evicted, "pool is full")
 }
 
-// exchangeWithConn tries to exchange the query using conn.
-func (p *dnsOverTLS) exchangeWithConn(conn net.Conn, req *dns.Msg) (reply *dns.Msg, err error) {
+// removeStaleLocked removes the connections idle for longer than the idle
+// timeout from the pool and returns them.  p.connsMu must be locked.
+func (p *dnsOverTLS) removeStaleLocked(now time.Time) (stale []net.Conn) {
+	if p.idleTimeout == 0 {
+		return nil
+	}
+
+	// The least recently used connections are at the bottom.
+	n := 0
+	for ; n < len(p.conns) && now.Sub(p.conns[n].idleSince) > p.idleTimeout; n++ {
+		stale = append(stale, p.conns[n].conn)
+	}
+
+	p.conns = slices.Delete(p.conns, 0, n)
+
+	return stale
+}
+
+// trimLocked removes the least recently used connections exceeding the pool
+// size from the pool and returns them.  p.connsMu must be locked.
+func (p *dnsOverTLS) trimLocked() (evicted []net.Conn) {
+	if p.poolSize == 0 || uint(len(p.conns)) <= p.poolSize {
+		return nil
+	}
+
+	n := len(p.conns) - int(p.poolSize)
+	for _, pc := range p.conns[:n] {
+		evicted = append(evicted, pc.conn)
+	}
+
+	p.conns = slices.Delete(p.conns, 0, n)
+
+	return evicted
+}
+
+// closeIdle closes the connections removed from the pool for the reason.
+func (p *dnsOverTLS) closeIdle(conns []net.Conn, reason string) {
+	for _, conn := range conns {
+		err := conn.Close()
+		p.logger.Debug(
+			"dot upstream closed idle conn",
+			"raddr", conn.RemoteAddr(),
+			"reason", reason,
+			slogutil.KeyError, err,
+		)
+	}
+}
+
+// startKeepAlive starts probing the pooled connections every period until p is
+// closed.  Note that the probing goroutine keeps p reachable, so it must be
+// closed explicitly.
+func (p *dnsOverTLS) startKeepAlive(period time.Duration) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	p.stopKeepAlive = sync.OnceFunc(func() {
+		close(done)
+		<-stopped
+	})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.probeIdle()
+			}
+		}
+	}()
+}
+
+// probeIdle sends a keepalive probe over each pooled connection and closes the
+// ones failing it, so that the following exchanges don't wait for the broken
+// connections to time out.
+//
+// The probes don't make the connections count as used, so those are still
+// closed once idle for longer than the idle timeout.
+func (p *dnsOverTLS) probeIdle() {
+	p.connsMu.Lock()
+	stale := p.removeStaleLocked(time.Now())
+	idle := p.conns
+	p.conns = nil
+	p.connsMu.Unlock()
+
+	p.closeIdle(stale, "idle timeout")
+
+	alive := make([]pooledConn, 0, len(idle))
+	for _, pc := range idle {
+		err := p.probe(pc.conn)
+		if err == nil {
+			alive = append(alive, pc)
+
+			continue
+		}
+
+		err = errors.WithDeferred(err, pc.conn.Close())
+		p.logger.Debug("dot keepalive probe failed", "addr", p.addr, slogutil.KeyError, err)
+	}
+
+	p.connsMu.Lock()
+	// Keep the connections put back during the probing on top, since those are
+	// the most recently used ones.
+	p.conns = append(alive, p.conns...)
+	evicted := p.trimLocked()
+	p.connsMu.Unlock()
+
+	p.closeIdle(evicted, "pool is full")
+}
+
+// probe sends a keepalive request over conn.
+func (p *dnsOverTLS) probe(conn net.Conn) (err error) {
+	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = p.exchangeWithConn(context.Background(), conn, newKeepAliveProbe())
+
+	return err
+}
+
+// newKeepAliveProbe returns a new lightweight request to keep the connection
+// alive.  It also asks the server to keep the connection open, see RFC 7828.
+func newKeepAliveProbe() (req *dns.Msg) {
+	req = (&dns.Msg{}).SetQuestion(".", dns.TypeNS)
+	req.SetEdns0(dns.MinMsgSize, false)
+
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	})
+
+	return req
+}
+
+// exchangeWithConn tries to exchange the query using conn.  The exchange is
+// aborted once ctx is done.
+func (p *dnsOverTLS) exchangeWithConn(
+	ctx context.Context,
+	conn net.Conn,
+	req *dns.Msg,
+) (reply *dns.Msg, err error) {
 	addr := p.Address()
 
+	// Don't extend the deadline set when the connection has been obtained.
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(time.Now().Add(dialTimeout)) {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, fmt.Errorf("setting deadline: %w", err)
+		}
+	}
+
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
 	logBegin(p.logger, addr, networkTCP, req)
 	defer func() { logFinish(p.logger, addr, networkTCP, err) }()
 
@@ -217,10 +465,14 @@ func (p *dnsOverTLS) exchangeWithConn(conn net.Conn, req *dns.Msg) (reply *dns.M
 
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own
 // dialContext function to get connection.
-func tlsDial(dialContext bootstrap.DialHandler, conf *tls.Config) (c *tls.Conn, err error) {
+func tlsDial(
+	ctx context.Context,
+	dialContext bootstrap.DialHandler,
+	conf *tls.Config,
+) (c *tls.Conn, err error) {
 	// We're using bootstrapped address instead of what's passed to the
 	// function.
-	rawConn, err := dialContext(context.Background(), networkTCP, "")
+	rawConn, err := dialContext(ctx, networkTCP, "")
 	if err != nil {
 		return nil, err
 	}
@@ -234,7 +486,7 @@ func tlsDial(dialContext bootstrap.DialHandler, conf *tls.Config) (c *tls.Conn,
 		panic(fmt.Errorf("dnsproxy: tls dial: setting deadline: %w", err))
 	}
 
-	err = conn.Handshake()
+	err = conn.HandshakeContext(ctx)
 	if err != nil {
 		return nil, errors.WithDeferred(err, conn.Close())
 	}
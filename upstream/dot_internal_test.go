@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -42,6 +43,43 @@ func TestUpstream_dnsOverTLS(t *testing.T) {
 	}
 }
 
+func TestUpstream_dnsOverTLS_padding(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		packed, err := req.Pack()
+		require.NoError(pt, err)
+		require.Zero(pt, len(packed)%DefaultPaddingBlockSize)
+
+		opt := req.IsEdns0()
+		require.NotNil(pt, opt)
+
+		resp := respondToTestMessage(req)
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_PADDING{Padding: make([]byte, 100)}}
+
+		require.NoError(pt, w.WriteMsg(resp))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		PaddingPolicy:      PaddingPolicyBlock,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	req := createTestMessage()
+	resp, err := u.Exchange(context.Background(), req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	// The OPT resource record added for padding is removed.
+	assert.Nil(t, resp.IsEdns0())
+	assert.Nil(t, req.IsEdns0())
+}
+
 func TestUpstream_dnsOverTLS_race(t *testing.T) {
 	const count = 10
 
@@ -73,7 +111,7 @@ func TestUpstream_dnsOverTLS_race(t *testing.T) {
 			pt := testutil.PanicT{}
 
 			req := createTestMessage()
-			resp, uErr := u.Exchange(req)
+			resp, uErr := u.Exchange(context.Background(), req)
 			require.NoError(pt, uErr)
 			requireResponse(pt, req, resp)
 		}()
@@ -115,24 +153,24 @@ func TestUpstream_dnsOverTLS_poolReconnect(t *testing.T) {
 
 	// Send the first test message.
 	req := createTestMessage()
-	reply, err := u.Exchange(req)
+	reply, err := u.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, reply)
 
 	// Now let's close the pooled connection.
 	require.Len(t, p.conns, 1)
-	conn := p.conns[0]
+	conn := p.conns[0].conn
 	require.NoError(t, conn.Close())
 
 	// Send the second test message.
 	req = createTestMessage()
-	reply, err = u.Exchange(req)
+	reply, err = u.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, reply)
 
 	// Now assert that the number of connections in the pool is not changed.
 	require.Len(t, p.conns, 1)
-	assert.NotSame(t, conn, p.conns[0])
+	assert.NotSame(t, conn, p.conns[0].conn)
 
 	// Check that the session was resumed on the last attempt.
 	assert.True(t, lastState.DidResume)
@@ -157,7 +195,7 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 
 	// Send the first test message.
 	req := createTestMessage()
-	response, err := u.Exchange(req)
+	response, err := u.Exchange(context.Background(), req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -165,16 +203,16 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 
 	// Now let's get connection from the pool and use it again.
 	require.Len(t, p.conns, 1)
-	conn := p.conns[0]
+	conn := p.conns[0].conn
 
 	dialHandler, err := p.getDialer()
 	require.NoError(t, err)
 
-	usedConn, err := p.conn(dialHandler)
+	usedConn, err := p.conn(context.Background(), dialHandler)
 	require.NoError(t, err)
 	require.Same(t, usedConn, conn)
 
-	response, err = p.exchangeWithConn(conn, req)
+	response, err = p.exchangeWithConn(context.Background(), conn, req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -186,13 +224,13 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 
 	// Get connection from the pool and reuse it.
 	require.Len(t, p.conns, 1)
-	conn = p.conns[0]
+	conn = p.conns[0].conn
 
-	usedConn, err = p.conn(dialHandler)
+	usedConn, err = p.conn(context.Background(), dialHandler)
 	require.NoError(t, err)
 	require.Same(t, usedConn, conn)
 
-	response, err = p.exchangeWithConn(usedConn, req)
+	response, err = p.exchangeWithConn(context.Background(), usedConn, req)
 	require.NoError(t, err)
 	requireResponse(t, req, response)
 
@@ -201,11 +239,82 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	require.NoError(t, err)
 
 	// Connection with expired deadLine can't be used.
-	response, err = p.exchangeWithConn(usedConn, req)
+	response, err = p.exchangeWithConn(context.Background(), usedConn, req)
 	require.Error(t, err)
 	require.Nil(t, response)
 }
 
+func TestUpstream_dnsOverTLS_pool(t *testing.T) {
+	const (
+		poolSize = 2
+		count    = 5
+	)
+
+	arrived := make(chan struct{}, count)
+	release := make(chan struct{})
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		testutil.RequireSend(pt, arrived, struct{}{}, timeout)
+		testutil.RequireReceive(pt, release, timeout)
+
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(req)))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             testLogger,
+		InsecureSkipVerify: true,
+		DoTIdleTimeout:     time.Minute,
+		DoTPoolSize:        poolSize,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	p := testutil.RequireTypeAssert[*dnsOverTLS](t, u)
+
+	t.Run("size", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		for range count {
+			wg.Go(func() {
+				pt := testutil.PanicT{}
+
+				req := createTestMessage()
+				resp, uErr := u.Exchange(context.Background(), req)
+				require.NoError(pt, uErr)
+				requireResponse(pt, req, resp)
+			})
+		}
+
+		// Make sure all the exchanges use their own connections.
+		for range count {
+			testutil.RequireReceive(t, arrived, timeout)
+		}
+
+		close(release)
+		wg.Wait()
+
+		assert.Len(t, p.conns, poolSize)
+	})
+
+	t.Run("idle_timeout", func(t *testing.T) {
+		require.Len(t, p.conns, poolSize)
+
+		conn, stale := p.takeIdle(time.Now())
+		require.NotNil(t, conn)
+
+		assert.Empty(t, stale)
+		p.putBack(conn)
+
+		conn, stale = p.takeIdle(time.Now().Add(time.Hour))
+		assert.Nil(t, conn)
+		assert.Len(t, stale, poolSize)
+		assert.Empty(t, p.conns)
+
+		p.closeIdle(stale, "test")
+	})
+}
+
 // testDoTServer is a test DNS-over-TLS server that can be used in unit-tests.
 type testDoTServer struct {
 	// srv is the *dns.Server instance that listens for DoT requests.
@@ -224,6 +333,69 @@ type testDoTServer struct {
 // type check
 var _ io.Closer = (*testDoTServer)(nil)
 
+func TestUpstream_dnsOverTLS_keepAlive(t *testing.T) {
+	const (
+		period  = 10 * time.Millisecond
+		timeout = time.Second
+	)
+
+	probes := make(chan struct{}, 1)
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := respondToTestMessage(req)
+		if req.Question[0].Name == "." {
+			select {
+			case probes <- struct{}{}:
+			default:
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+		}
+
+		require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+
+	t.Run("probe", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			Logger:             testLogger,
+			InsecureSkipVerify: true,
+			KeepAlivePeriod:    period,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		req := createTestMessage()
+		reply, err := u.Exchange(context.Background(), req)
+		require.NoError(t, err)
+		requireResponse(t, req, reply)
+
+		testutil.RequireReceive(t, probes, timeout)
+	})
+
+	t.Run("broken", func(t *testing.T) {
+		u, err := AddressToUpstream(addr, &Options{
+			Logger:             testLogger,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		p := testutil.RequireTypeAssert[*dnsOverTLS](t, u)
+
+		req := createTestMessage()
+		reply, err := u.Exchange(context.Background(), req)
+		require.NoError(t, err)
+		requireResponse(t, req, reply)
+
+		require.Len(t, p.conns, 1)
+		require.NoError(t, p.conns[0].conn.Close())
+
+		p.probeIdle()
+		assert.Empty(t, p.conns)
+	})
+}
+
 // startDoTServer starts *testDoTServer on a random port.
 //
 // TODO(e.burkov):  Also return address?
@@ -300,7 +472,7 @@ func BenchmarkDoTUpstream(b *testing.B) {
 
 		b.RunParallel(func(p *testing.PB) {
 			for p.Next() {
-				_, _ = u.Exchange(<-reqChan)
+				_, _ = u.Exchange(context.Background(), <-reqChan)
 			}
 		})
 	})
@@ -0,0 +1,140 @@
+package upstream
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// PaddingPolicy is the policy of padding the queries sent to the encrypted
+// upstreams with the EDNS(0) Padding option to resist the traffic analysis.
+// See RFC 8467.
+type PaddingPolicy string
+
+const (
+	// PaddingPolicyNone means that the queries aren't padded.
+	PaddingPolicyNone PaddingPolicy = ""
+
+	// PaddingPolicyBlock means that the queries are padded to the closest
+	// multiple of the block size, the Block-Length Padding strategy recommended
+	// by RFC 8467.
+	PaddingPolicyBlock PaddingPolicy = "block"
+
+	// PaddingPolicyRandom means that the queries are padded with a random
+	// number of octets less than the block size, the Random Padding strategy
+	// of RFC 8467.
+	PaddingPolicyRandom PaddingPolicy = "random"
+)
+
+// DefaultPaddingBlockSize is the block size used for padding the queries when
+// none is set.  It's the value recommended by RFC 8467 for the queries.
+const DefaultPaddingBlockSize = 128
+
+// padding pads the queries and strips the padding from the responses.  A nil
+// *padding is valid and does nothing.
+type padding struct {
+	// policy is the padding policy, it's never [PaddingPolicyNone].
+	policy PaddingPolicy
+
+	// blockSize is the block size of the padding, it's always positive.
+	blockSize int
+}
+
+// newPadding returns the padding in accordance with opts.  It returns nil if
+// the queries shouldn't be padded.
+func newPadding(opts *Options) (p *padding, err error) {
+	switch opts.PaddingPolicy {
+	case PaddingPolicyNone:
+		return nil, nil
+	case PaddingPolicyBlock, PaddingPolicyRandom:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("padding policy: %w: %q", errors.ErrBadEnumValue, opts.PaddingPolicy)
+	}
+
+	blockSize := int(opts.PaddingBlockSize)
+	if blockSize == 0 {
+		blockSize = DefaultPaddingBlockSize
+	} else if blockSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf(
+			"padding block size: %w: must be no greater than %d, got %d",
+			errors.ErrOutOfRange,
+			dns.MaxMsgSize,
+			blockSize,
+		)
+	}
+
+	return &padding{
+		policy:    opts.PaddingPolicy,
+		blockSize: blockSize,
+	}, nil
+}
+
+// pad returns the padded copy of req.  addedOPT is true if req has no OPT
+// resource record, so the one has been added to padded and should be removed
+// from the response with [padding.unpad].  If p is nil, padded is req itself.
+// req must not be nil.
+func (p *padding) pad(req *dns.Msg) (padded *dns.Msg, addedOPT bool) {
+	if p == nil {
+		return req, false
+	}
+
+	padded = req.Copy()
+
+	opt := padded.IsEdns0()
+	if opt == nil {
+		addedOPT = true
+		padded.SetEdns0(dns.DefaultMsgSize, false)
+		opt = padded.IsEdns0()
+	} else {
+		opt.Option = slices.DeleteFunc(opt.Option, isPaddingOption)
+	}
+
+	option := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, option)
+
+	// The length includes the header of the empty option.
+	msgLen := padded.Len()
+
+	var padLen int
+	switch p.policy {
+	case PaddingPolicyBlock:
+		padLen = (p.blockSize - msgLen%p.blockSize) % p.blockSize
+	default:
+		padLen = rand.IntN(p.blockSize)
+	}
+
+	padLen = min(padLen, dns.MaxMsgSize-msgLen)
+	option.Padding = make([]byte, max(padLen, 0))
+
+	return padded, addedOPT
+}
+
+// unpad strips the padding from resp, so that it's never cached or returned
+// to the clients.  If addedOPT is true, the OPT resource record is removed from
+// resp completely, see [padding.pad].  If p or resp is nil, it does nothing.
+func (p *padding) unpad(resp *dns.Msg, addedOPT bool) {
+	if p == nil || resp == nil {
+		return
+	}
+
+	if addedOPT {
+		resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) (ok bool) {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+
+		return
+	}
+
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, isPaddingOption)
+	}
+}
+
+// isPaddingOption returns true if o is the EDNS(0) Padding option.
+func isPaddingOption(o dns.EDNS0) (ok bool) {
+	return o.Option() == dns.EDNS0PADDING
+}
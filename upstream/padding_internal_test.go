@@ -0,0 +1,140 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPadding_pad(t *testing.T) {
+	t.Parallel()
+
+	newReq := func(edns bool) (req *dns.Msg) {
+		req = createTestMessage()
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 3)})
+		}
+
+		return req
+	}
+
+	testCases := []struct {
+		name      string
+		policy    PaddingPolicy
+		blockSize uint
+		edns      bool
+	}{{
+		name:      "block_default",
+		policy:    PaddingPolicyBlock,
+		blockSize: 0,
+		edns:      false,
+	}, {
+		name:      "block_edns",
+		policy:    PaddingPolicyBlock,
+		blockSize: 64,
+		edns:      true,
+	}, {
+		name:      "random",
+		policy:    PaddingPolicyRandom,
+		blockSize: 32,
+		edns:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := newPadding(&Options{
+				PaddingPolicy:    tc.policy,
+				PaddingBlockSize: tc.blockSize,
+			})
+			require.NoError(t, err)
+			require.NotNil(t, p)
+
+			req := newReq(tc.edns)
+			origLen := req.Len()
+
+			padded, addedOPT := p.pad(req)
+			assert.Equal(t, !tc.edns, addedOPT)
+			assert.Equal(t, origLen, req.Len(), "original request is modified")
+
+			opt := padded.IsEdns0()
+			require.NotNil(t, opt)
+
+			var paddings []*dns.EDNS0_PADDING
+			for _, o := range opt.Option {
+				if pad, ok := o.(*dns.EDNS0_PADDING); ok {
+					paddings = append(paddings, pad)
+				}
+			}
+			require.Len(t, paddings, 1)
+
+			if tc.policy == PaddingPolicyBlock {
+				assert.Zero(t, padded.Len()%p.blockSize)
+			} else {
+				assert.Less(t, len(paddings[0].Padding), p.blockSize)
+			}
+
+			resp := (&dns.Msg{}).SetReply(padded)
+			resp.Extra = []dns.RR{&dns.OPT{
+				Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+				Option: []dns.EDNS0{
+					&dns.EDNS0_PADDING{Padding: make([]byte, 100)},
+				},
+			}}
+
+			p.unpad(resp, addedOPT)
+			if addedOPT {
+				assert.Nil(t, resp.IsEdns0())
+			} else {
+				require.NotNil(t, resp.IsEdns0())
+				assert.Empty(t, resp.IsEdns0().Option)
+			}
+		})
+	}
+}
+
+func TestNewPadding(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		opts       *Options
+		name       string
+		wantErrMsg string
+		wantNil    bool
+	}{{
+		opts:       &Options{},
+		name:       "none",
+		wantErrMsg: "",
+		wantNil:    true,
+	}, {
+		opts:       &Options{PaddingPolicy: "maximal"},
+		name:       "bad_policy",
+		wantErrMsg: `padding policy: bad enum value: "maximal"`,
+		wantNil:    true,
+	}, {
+		opts: &Options{
+			PaddingPolicy:    PaddingPolicyBlock,
+			PaddingBlockSize: 1 << 17,
+		},
+		name: "bad_block_size",
+		wantErrMsg: "padding block size: out of range: must be no greater than 65535, " +
+			"got 131072",
+		wantNil: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := newPadding(tc.opts)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.wantNil, p == nil)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"slices"
 
@@ -20,18 +21,26 @@ const (
 )
 
 // ExchangeParallel returns the first successful response from one of u.  It
-// returns an error if all upstreams failed to exchange the request.
-func ExchangeParallel(ups []Upstream, req *dns.Msg) (reply *dns.Msg, resolved Upstream, err error) {
+// returns an error if all upstreams failed to exchange the request.  The
+// exchanges still in progress are canceled once it returns.
+func ExchangeParallel(
+	ctx context.Context,
+	ups []Upstream,
+	req *dns.Msg,
+) (reply *dns.Msg, resolved Upstream, err error) {
 	upsNum := len(ups)
 	switch upsNum {
 	case 0:
 		return nil, nil, ErrNoUpstreams
 	case 1:
-		return exchangeSingle(ups[0], req)
+		return exchangeSingle(ctx, ups[0], req)
 	default:
 		// Go on.
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	resCh := make(chan any, upsNum)
 	for _, f := range ups {
 		// Use a copy to prevent data races, as [dns.Client] can modify the DNS
@@ -39,7 +48,7 @@ func ExchangeParallel(ups []Upstream, req *dns.Msg) (reply *dns.Msg, resolved Up
 		//
 		// TODO(s.chzhen):  Consider using buffer pool.
 		copyReq := req.Copy()
-		go exchangeAsync(f, copyReq, resCh)
+		go exchangeAsync(ctx, f, copyReq, resCh)
 	}
 
 	errs := []error{}
@@ -65,13 +74,80 @@ func ExchangeParallel(ups []Upstream, req *dns.Msg) (reply *dns.Msg, resolved Up
 	return nil, nil, errors.Join(errs...)
 }
 
+// ExchangeRace returns the first response from one of ups with a non-empty
+// answer and the NOERROR response code.  The other responses may come from the
+// filtering resolvers, so they're only returned if none of ups answered, in
+// which case the first response with the response code other than SERVFAIL is
+// preferred.  It returns an error if all upstreams failed to exchange the
+// request.  The exchanges still in progress are canceled once it returns.
+func ExchangeRace(
+	ctx context.Context,
+	ups []Upstream,
+	req *dns.Msg,
+) (reply *dns.Msg, resolved Upstream, err error) {
+	upsNum := len(ups)
+	switch upsNum {
+	case 0:
+		return nil, nil, ErrNoUpstreams
+	case 1:
+		return exchangeSingle(ctx, ups[0], req)
+	default:
+		// Go on.
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resCh := make(chan any, upsNum)
+	for _, u := range ups {
+		// Use a copy to prevent data races, as [dns.Client] can modify the DNS
+		// request during the exchange.
+		copyReq := req.Copy()
+		go exchangeAsync(ctx, u, copyReq, resCh)
+	}
+
+	var fallback *ExchangeAllResult
+	errs := []error{}
+	for range ups {
+		var r *ExchangeAllResult
+		r, err = receiveAsyncResult(resCh)
+		switch {
+		case err != nil:
+			if !errors.Is(err, ErrNoReply) {
+				errs = append(errs, err)
+			}
+		case isAnswered(r.Resp):
+			return r.Resp, r.Upstream, nil
+		case fallback == nil, fallback.Resp.Rcode == dns.RcodeServerFailure:
+			fallback = r
+		}
+	}
+
+	if fallback != nil {
+		return fallback.Resp, fallback.Upstream, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, nil, errors.Error("none of upstream servers responded")
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+// isAnswered returns true if resp is a successful response with a non-empty
+// answer.  resp must not be nil.
+func isAnswered(resp *dns.Msg) (ok bool) {
+	return resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0
+}
+
 // exchangeSingle returns a successful response and resolver if a DNS lookup was
 // successful.
 func exchangeSingle(
+	ctx context.Context,
 	ups Upstream,
 	req *dns.Msg,
 ) (resp *dns.Msg, resolved Upstream, err error) {
-	resp, err = ups.Exchange(req)
+	resp, err = ups.Exchange(ctx, req)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -91,14 +167,18 @@ type ExchangeAllResult struct {
 
 // ExchangeAll returns the responses from all of u.  It returns an error only if
 // all upstreams failed to exchange the request.
-func ExchangeAll(ups []Upstream, req *dns.Msg) (res []ExchangeAllResult, err error) {
+func ExchangeAll(
+	ctx context.Context,
+	ups []Upstream,
+	req *dns.Msg,
+) (res []ExchangeAllResult, err error) {
 	upsNum := len(ups)
 	switch upsNum {
 	case 0:
 		return nil, ErrNoUpstreams
 	case 1:
 		var reply *dns.Msg
-		reply, err = ups[0].Exchange(req)
+		reply, err = ups[0].Exchange(ctx, req)
 		if err != nil {
 			return nil, err
 		} else if reply == nil {
@@ -122,7 +202,7 @@ func ExchangeAll(ups []Upstream, req *dns.Msg) (res []ExchangeAllResult, err err
 		//
 		// TODO(s.chzhen):  Consider using buffer pool.
 		copyReq := req.Copy()
-		go exchangeAsync(u, copyReq, resCh)
+		go exchangeAsync(ctx, u, copyReq, resCh)
 	}
 
 	// Wait for all exchanges to finish.
@@ -162,8 +242,8 @@ func receiveAsyncResult(resCh chan any) (res *ExchangeAllResult, err error) {
 
 // exchangeAsync tries to resolve DNS request with one upstream and sends the
 // result to respCh.
-func exchangeAsync(u Upstream, req *dns.Msg, resCh chan any) {
-	reply, err := u.Exchange(req)
+func exchangeAsync(ctx context.Context, u Upstream, req *dns.Msg, resCh chan any) {
+	reply, err := u.Exchange(ctx, req)
 	if err != nil {
 		resCh <- err
 	} else {
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 	"testing"
@@ -34,7 +35,7 @@ func TestExchangeParallel(t *testing.T) {
 
 	req := createTestMessage()
 	start := time.Now()
-	resp, u, err := ExchangeParallel(upstreams, req)
+	resp, u, err := ExchangeParallel(context.Background(), upstreams, req)
 	if err != nil {
 		t.Fatalf("no response from test upstreams: %s", err)
 	}
@@ -57,7 +58,7 @@ func TestExchangeParallelEmpty(t *testing.T) {
 	}
 
 	req := createTestMessage()
-	resp, up, err := ExchangeParallel(ups, req)
+	resp, up, err := ExchangeParallel(context.Background(), ups, req)
 	require.Error(t, err)
 
 	assert.Nil(t, resp)
@@ -77,13 +78,16 @@ type testUpstream struct {
 
 	// sleep is a delay before response.
 	sleep time.Duration
+
+	// rcode is the response code of the response.
+	rcode int
 }
 
 // type check
 var _ Upstream = (*testUpstream)(nil)
 
 // Exchange implements the [Upstream] interface for *testUpstream.
-func (u *testUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+func (u *testUpstream) Exchange(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 	if u.sleep != 0 {
 		time.Sleep(u.sleep)
 	}
@@ -97,7 +101,7 @@ func (u *testUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	}
 
 	resp = &dns.Msg{}
-	resp.SetReply(req)
+	resp.SetRcode(req, u.rcode)
 
 	if u.addr != (netip.Addr{}) {
 		a := dns.A{
@@ -134,7 +138,7 @@ func TestExchangeAll(t *testing.T) {
 	}}
 
 	req := createHostTestMessage("test.org")
-	res, err := ExchangeAll(ups, req)
+	res, err := ExchangeAll(context.Background(), ups, req)
 	require.NoError(t, err)
 	require.Len(t, res, 2)
 
@@ -152,3 +156,72 @@ func TestExchangeAll(t *testing.T) {
 	ip = testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0]).A
 	assert.Equal(t, delayedAnsAddr.AsSlice(), []byte(ip))
 }
+
+func TestExchangeRace(t *testing.T) {
+	ansAddr := netip.MustParseAddr("1.1.1.1")
+
+	testCases := []struct {
+		ups       []Upstream
+		name      string
+		wantRcode int
+		wantAns   bool
+	}{{
+		ups: []Upstream{&testUpstream{
+			addr:  ansAddr,
+			sleep: 100 * time.Millisecond,
+		}, &testUpstream{
+			rcode: dns.RcodeNameError,
+		}, &testUpstream{
+			rcode: dns.RcodeServerFailure,
+		}, &testUpstream{
+			rcode: dns.RcodeSuccess,
+		}},
+		name:      "answer",
+		wantRcode: dns.RcodeSuccess,
+		wantAns:   true,
+	}, {
+		ups: []Upstream{&testUpstream{
+			rcode: dns.RcodeNameError,
+			sleep: 100 * time.Millisecond,
+		}, &testUpstream{
+			rcode: dns.RcodeServerFailure,
+		}, &testUpstream{
+			err: true,
+		}},
+		name:      "no_answer",
+		wantRcode: dns.RcodeNameError,
+		wantAns:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createHostTestMessage("test.org")
+			resp, u, err := ExchangeRace(context.Background(), tc.ups, req)
+			require.NoError(t, err)
+			require.NotNil(t, resp)
+
+			assert.NotNil(t, u)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			if !tc.wantAns {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			require.Len(t, resp.Answer, 1)
+
+			ip := testutil.RequireTypeAssert[*dns.A](t, resp.Answer[0]).A
+			assert.Equal(t, ansAddr.AsSlice(), []byte(ip))
+		})
+	}
+
+	t.Run("all_failed", func(t *testing.T) {
+		ups := []Upstream{&testUpstream{err: true}, &testUpstream{empty: true}}
+		resp, u, err := ExchangeRace(context.Background(), ups, createTestMessage())
+		require.Error(t, err)
+
+		assert.Nil(t, resp)
+		assert.Nil(t, u)
+	})
+}
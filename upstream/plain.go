@@ -2,6 +2,7 @@ package upstream
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"log/slog"
@@ -30,6 +31,10 @@ const (
 )
 
 // plainDNS implements the [Upstream] interface for the regular DNS protocol.
+//
+// Each exchange is performed over a new connection, so that the source port of
+// each UDP query is chosen by the system randomly as long as [BindAddr] doesn't
+// specify one, which it can't.
 type plainDNS struct {
 	// addr is the DNS server URL.  Scheme is always "udp" or "tcp".
 	addr *url.URL
@@ -46,6 +51,18 @@ type plainDNS struct {
 
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
+
+	// disableRetry disables repeating the exchange over a new connection after
+	// a network error.
+	disableRetry bool
+
+	// randomizeQueries makes the UDP queries sent with the randomized case of
+	// the name and the random transaction ID, see [Options.RandomizeQueries].
+	randomizeQueries bool
+
+	// udpSize is the EDNS UDP payload size advertised in the UDP queries, see
+	// [Options.UDPSize].
+	udpSize uint16
 }
 
 // newPlain returns the plain DNS Upstream.  addr.Scheme should be either "udp"
@@ -58,14 +75,21 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 		return nil, fmt.Errorf("unsupported url scheme: %s", addr.Scheme)
 	}
 
+	if opts.UDPSize != 0 && opts.UDPSize < dns.MinMsgSize {
+		return nil, fmt.Errorf("udp size: %d is less than %d", opts.UDPSize, dns.MinMsgSize)
+	}
+
 	addPort(addr, defaultPortPlain)
 
 	return &plainDNS{
-		addr:      addr,
-		logger:    opts.Logger,
-		getDialer: newDialerInitializer(addr, opts),
-		net:       addr.Scheme,
-		timeout:   opts.Timeout,
+		addr:             addr,
+		logger:           opts.Logger,
+		getDialer:        newDialerInitializer(addr, opts),
+		net:              addr.Scheme,
+		timeout:          opts.Timeout,
+		disableRetry:     opts.DisableRetry,
+		randomizeQueries: opts.RandomizeQueries,
+		udpSize:          opts.UDPSize,
 	}, nil
 }
 
@@ -87,6 +111,7 @@ func (p *plainDNS) Address() string {
 // dialExchange performs a DNS exchange with the specified dial handler.
 // network must be either [networkUDP] or [networkTCP].
 func (p *plainDNS) dialExchange(
+	ctx context.Context,
 	network network,
 	dial bootstrap.DialHandler,
 	req *dns.Msg,
@@ -102,31 +127,48 @@ func (p *plainDNS) dialExchange(
 	logBegin(p.logger, addr, network, req)
 	defer func() { logFinish(p.logger, addr, network, err) }()
 
-	ctx := context.Background()
 	conn.Conn, err = dial(ctx, network, "")
 	if err != nil {
-		return nil, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, network, err)
+		return nil, withContextErr(ctx, fmt.Errorf("dialing %s over %s: %w", p.addr.Host, network, err))
 	}
 	defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-	resp, _, err = client.ExchangeWithConn(req, conn)
-	if isExpectedConnErr(err) {
+	resp, err = exchangeWithConn(ctx, client, conn, req)
+	if !p.disableRetry && ctx.Err() == nil && isExpectedConnErr(err) {
 		conn.Conn, err = dial(ctx, network, "")
 		if err != nil {
-			return nil, fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, network, err)
+			err = fmt.Errorf("dialing %s over %s again: %w", p.addr.Host, network, err)
+
+			return nil, withContextErr(ctx, err)
 		}
 		defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-		resp, _, err = client.ExchangeWithConn(req, conn)
+		resp, err = exchangeWithConn(ctx, client, conn, req)
 	}
 
 	if err != nil {
-		return resp, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err)
+		return resp, withContextErr(ctx, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err))
 	}
 
 	return resp, validatePlainResponse(req, resp)
 }
 
+// exchangeWithConn exchanges req over conn using client.  The exchange is
+// aborted once ctx is done.
+func exchangeWithConn(
+	ctx context.Context,
+	client *dns.Client,
+	conn *dns.Conn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	stop := interruptOnDone(ctx, conn.Conn)
+	defer stop()
+
+	resp, _, err = client.ExchangeWithConnContext(ctx, req, conn)
+
+	return resp, err
+}
+
 // isExpectedConnErr returns true if the error is expected.  In this case,
 // we will make a second attempt to process the request.
 func isExpectedConnErr(err error) (is bool) {
@@ -136,7 +178,7 @@ func isExpectedConnErr(err error) (is bool) {
 }
 
 // Exchange implements the [Upstream] interface for *plainDNS.
-func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+func (p *plainDNS) Exchange(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 	dial, err := p.getDialer()
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -145,10 +187,19 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 
 	addr := p.Address()
 
-	resp, err = p.dialExchange(p.net, dial, req)
 	if p.net != networkUDP {
 		// The network is already TCP.
-		return resp, err
+		return p.dialExchange(ctx, p.net, dial, req)
+	}
+
+	udpReq := withUDPSize(req, p.udpSize)
+	if p.randomizeQueries {
+		udpReq = randomizeQuery(udpReq)
+	}
+
+	resp, err = p.dialExchange(ctx, p.net, dial, udpReq)
+	if err == nil && p.randomizeQueries {
+		err = verifyRandomized(udpReq, resp)
 	}
 
 	if resp == nil {
@@ -164,7 +215,7 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 			slogutil.KeyError, err,
 		)
 
-		return p.dialExchange(networkTCP, dial, req)
+		return p.dialExchange(ctx, networkTCP, dial, req)
 	} else if resp.Truncated {
 		// Fallback to TCP on truncated responses.
 		p.logger.Debug(
@@ -173,7 +224,11 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 			"addr", addr,
 		)
 
-		return p.dialExchange(networkTCP, dial, req)
+		return p.dialExchange(ctx, networkTCP, dial, req)
+	}
+
+	if p.randomizeQueries {
+		restoreQuery(req, resp)
 	}
 
 	// There is either no error or the error isn't related to the received
@@ -210,3 +265,78 @@ func validatePlainResponse(req, resp *dns.Msg) (err error) {
 
 	return nil
 }
+
+// randomizeQuery returns a copy of req with the random transaction ID and the
+// name of the question written in the random case, also known as DNS 0x20.
+// req must have exactly one question.
+func randomizeQuery(req *dns.Msg) (randomized *dns.Msg) {
+	randomized = req.Copy()
+	randomized.Id = dns.Id()
+
+	q := &randomized.Question[0]
+	name := []byte(q.Name)
+
+	bits := make([]byte, len(name))
+	_, _ = rand.Read(bits)
+
+	for i, c := range name {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && bits[i]&1 == 1 {
+			// Flip the case of the ASCII letter.
+			name[i] ^= 0x20
+		}
+	}
+
+	q.Name = string(name)
+
+	return randomized
+}
+
+// withUDPSize returns req advertising size as the EDNS UDP payload size.  It
+// returns req itself if size is zero, req has no OPT record, or it already
+// advertises size, otherwise a copy of req is returned.
+func withUDPSize(req *dns.Msg, size uint16) (sized *dns.Msg) {
+	opt := req.IsEdns0()
+	if size == 0 || opt == nil || opt.UDPSize() == size {
+		return req
+	}
+
+	sized = req.Copy()
+	sized.IsEdns0().SetUDPSize(size)
+
+	return sized
+}
+
+// verifyRandomized returns an error if resp doesn't repeat the name of the
+// question from randomized exactly, including the case, which means that resp
+// is either spoofed or received from a server not preserving the case.  Any
+// error returned wraps [errQuestion], so that the query is retried over TCP.
+// resp must be valid, see [validatePlainResponse].
+func verifyRandomized(randomized, resp *dns.Msg) (err error) {
+	if name := resp.Question[0].Name; name != randomized.Question[0].Name {
+		return fmt.Errorf("%w: mismatched name case %q", errQuestion, name)
+	}
+
+	return nil
+}
+
+// restoreQuery sets the transaction ID and the name of the question in resp
+// received for the randomized query back to ones from req, including the owner
+// names of the resource records matching the question.  resp may be nil.
+func restoreQuery(req, resp *dns.Msg) {
+	if resp == nil || len(resp.Question) == 0 {
+		return
+	}
+
+	resp.Id = req.Id
+
+	name, origName := resp.Question[0].Name, req.Question[0].Name
+	resp.Question[0].Name = origName
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Name == name {
+				hdr.Name = origName
+			}
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package upstream
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -38,6 +45,128 @@ func TestUpstream_plainDNS(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_bindAddr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only linux has the whole 127.0.0.0/8 on the loopback interface")
+	}
+
+	bindIP := netip.MustParseAddr("127.0.0.2")
+
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		remote, err := netip.ParseAddrPort(w.RemoteAddr().String())
+		require.NoError(pt, err)
+
+		resp := respondToTestMessage(req)
+		if remote.Addr() != bindIP {
+			resp.Rcode = dns.RcodeRefused
+		}
+
+		require.NoError(pt, w.WriteMsg(resp))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	for _, proto := range []string{"udp", "tcp"} {
+		t.Run(proto, func(t *testing.T) {
+			addr := fmt.Sprintf("%s://127.0.0.1:%d", proto, srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:   testLogger,
+				BindAddr: &BindAddr{IPv4: bindIP},
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			checkUpstream(t, u, addr)
+		})
+	}
+}
+
+// startConnectProxy starts an HTTP CONNECT proxy on localhost tunneling the
+// connections to the requested addresses and returns its URL.  The requested
+// addresses are sent to targets.
+func startConnectProxy(tb testing.TB, targets chan string) (u *url.URL) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	testutil.CleanupAndRequireSuccess(tb, l.Close)
+
+	tunnel := func(c net.Conn) {
+		pt := testutil.PanicT{}
+
+		defer func() { _ = c.Close() }()
+
+		req, rerr := http.ReadRequest(bufio.NewReader(c))
+		require.NoError(pt, rerr)
+		require.Equal(pt, http.MethodConnect, req.Method)
+
+		testutil.RequireSend(pt, targets, req.Host, timeout)
+
+		target, rerr := net.Dial("tcp", req.Host)
+		require.NoError(pt, rerr)
+
+		defer func() { _ = target.Close() }()
+
+		_, rerr = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		require.NoError(pt, rerr)
+
+		go func() { _, _ = io.Copy(target, c) }()
+		_, _ = io.Copy(c, target)
+	}
+
+	go func() {
+		for c, aerr := l.Accept(); !errors.Is(aerr, net.ErrClosed); c, aerr = l.Accept() {
+			require.NoError(testutil.PanicT{}, aerr)
+
+			go tunnel(c)
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestUpstream_plainDNS_proxy(t *testing.T) {
+	srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(req)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	targets := make(chan string, 1)
+	proxyURL := startConnectProxy(t, targets)
+	srvAddr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+
+	t.Run("tcp", func(t *testing.T) {
+		addr := "tcp://" + srvAddr
+		u, err := AddressToUpstream(addr, &Options{
+			Logger:   testLogger,
+			ProxyURL: proxyURL,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		checkUpstream(t, u, addr)
+
+		target, _ := testutil.RequireReceive(t, targets, timeout)
+		assert.Equal(t, srvAddr, target)
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		addr := "udp://" + srvAddr
+		u, err := AddressToUpstream(addr, &Options{
+			Logger:   testLogger,
+			ProxyURL: proxyURL,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, u.Close)
+
+		checkUpstream(t, u, addr)
+
+		// UDP isn't proxied.
+		assert.Empty(t, targets)
+	})
+}
+
 func TestUpstream_plainDNS_badID(t *testing.T) {
 	req := createTestMessage()
 	badIDResp := respondToTestMessage(req)
@@ -57,7 +186,7 @@ func TestUpstream_plainDNS_badID(t *testing.T) {
 	require.NoError(t, err)
 	testutil.CleanupAndRequireSuccess(t, u.Close)
 
-	resp, err := u.Exchange(req)
+	resp, err := u.Exchange(context.Background(), req)
 
 	var netErr net.Error
 	require.ErrorAs(t, err, &netErr)
@@ -66,6 +195,77 @@ func TestUpstream_plainDNS_badID(t *testing.T) {
 	assert.Nil(t, resp)
 }
 
+func TestUpstream_plainDNS_disableRetry(t *testing.T) {
+	testCases := []struct {
+		name         string
+		wantRequests uint32
+		disableRetry bool
+	}{{
+		name:         "enabled",
+		wantRequests: 2,
+		disableRetry: false,
+	}, {
+		name:         "disabled",
+		wantRequests: 1,
+		disableRetry: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var reqNum atomic.Uint32
+			srv := startDNSServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {
+				// Never respond to make the exchange time out.
+				reqNum.Add(1)
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger: testLogger,
+				// Use a shorter timeout to speed up the test.
+				Timeout:      100 * time.Millisecond,
+				DisableRetry: tc.disableRetry,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			_, err = u.Exchange(context.Background(), createTestMessage())
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantRequests, reqNum.Load())
+		})
+	}
+}
+
+func TestUpstream_plainDNS_cancel(t *testing.T) {
+	var reqNum atomic.Uint32
+	srv := startDNSServer(t, func(_ dns.ResponseWriter, _ *dns.Msg) {
+		// Never respond to make the exchange wait for the cancellation.
+		reqNum.Add(1)
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:  testLogger,
+		Timeout: timeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = u.Exchange(ctx, createTestMessage())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.Less(t, time.Since(start), timeout)
+
+	// The canceled exchange isn't retried.
+	assert.Equal(t, uint32(1), reqNum.Load())
+}
+
 func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	req := createTestMessage()
 	goodResp := respondToTestMessage(req)
@@ -132,7 +332,7 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 			require.NoError(t, err)
 			testutil.CleanupAndRequireSuccess(t, u.Close)
 
-			resp, err := u.Exchange(req)
+			resp, err := u.Exchange(context.Background(), req)
 			require.NoError(t, err)
 			requireResponse(t, req, resp)
 
@@ -142,6 +342,145 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_randomizeQueries(t *testing.T) {
+	req := createTestMessage()
+
+	testCases := []struct {
+		name     string
+		lowerUDP bool
+		wantTCP  int
+	}{{
+		name:     "case_preserved",
+		lowerUDP: false,
+		wantTCP:  0,
+	}, {
+		name:     "case_lowered",
+		lowerUDP: true,
+		wantTCP:  1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			udpNames := make(chan string, 1)
+
+			var tcpReqNum atomic.Uint32
+			srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				pt := testutil.PanicT{}
+
+				resp := respondToTestMessage(r)
+				if w.RemoteAddr().Network() == networkUDP {
+					testutil.RequireSend(pt, udpNames, r.Question[0].Name, timeout)
+					if tc.lowerUDP {
+						resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+					}
+				} else {
+					tcpReqNum.Add(1)
+				}
+
+				require.NoError(pt, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:           testLogger,
+				Timeout:          timeout,
+				RandomizeQueries: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			resp, err := u.Exchange(context.Background(), req)
+			require.NoError(t, err)
+			requireResponse(t, req, resp)
+
+			assert.Equal(t, req.Question[0].Name, resp.Question[0].Name)
+			assert.Equal(t, tc.wantTCP, int(tcpReqNum.Load()))
+
+			sent, _ := testutil.RequireReceive(t, udpNames, timeout)
+			assert.True(t, strings.EqualFold(req.Question[0].Name, sent))
+			assert.NotEqual(t, req.Question[0].Name, sent)
+		})
+	}
+}
+
+func TestUpstream_plainDNS_udpSize(t *testing.T) {
+	const udpSize = 1232
+
+	req := createTestMessage()
+	req.SetEdns0(4096, false)
+
+	udpSizes := make(chan uint16, 1)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		opt := r.IsEdns0()
+		require.NotNil(pt, opt)
+
+		testutil.RequireSend(pt, udpSizes, opt.UDPSize(), timeout)
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(r)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:  testLogger,
+		Timeout: timeout,
+		UDPSize: udpSize,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	resp, err := u.Exchange(context.Background(), req)
+	require.NoError(t, err)
+	requireResponse(t, req, resp)
+
+	sent, _ := testutil.RequireReceive(t, udpSizes, timeout)
+	assert.Equal(t, uint16(udpSize), sent)
+
+	// The original request must stay intact.
+	assert.Equal(t, uint16(4096), req.IsEdns0().UDPSize())
+
+	_, err = AddressToUpstream(addr, &Options{
+		Logger:  testLogger,
+		UDPSize: dns.MinMsgSize - 1,
+	})
+	testutil.AssertErrorMsg(t, "udp size: 511 is less than 512", err)
+}
+
+func TestUpstream_plainDNS_sourcePort(t *testing.T) {
+	const reqNum = 10
+
+	ports := make(chan string, reqNum)
+	srv := startDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		_, port, err := net.SplitHostPort(w.RemoteAddr().String())
+		require.NoError(pt, err)
+
+		testutil.RequireSend(pt, ports, port, timeout)
+		require.NoError(pt, w.WriteMsg(respondToTestMessage(r)))
+	})
+	testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger: testLogger,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	uniq := map[string]struct{}{}
+	for range reqNum {
+		checkUpstream(t, u, addr)
+
+		port, _ := testutil.RequireReceive(t, ports, timeout)
+		uniq[port] = struct{}{}
+	}
+
+	assert.Greater(t, len(uniq), 1)
+}
+
 // testDNSServer is a simple DNS server that can be used in unit-tests.
 type testDNSServer struct {
 	udpListener net.PacketConn
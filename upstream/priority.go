@@ -0,0 +1,22 @@
+package upstream
+
+import "context"
+
+// backgroundCtxKey is the key of the context value marking the background
+// queries, see [WithBackground].
+type backgroundCtxKey struct{}
+
+// WithBackground returns a copy of parent marking the queries made with it as
+// the background ones, e.g. the proactive cache refreshes, so that the
+// upstreams able to do that prioritize the interactive queries over them.  The
+// other upstreams ignore the mark.
+func WithBackground(parent context.Context) (ctx context.Context) {
+	return context.WithValue(parent, backgroundCtxKey{}, true)
+}
+
+// isBackground returns true if ctx is marked with [WithBackground].
+func isBackground(ctx context.Context) (ok bool) {
+	ok, _ = ctx.Value(backgroundCtxKey{}).(bool)
+
+	return ok
+}
@@ -3,6 +3,7 @@ package upstream
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"math"
 	"net/netip"
 	"net/url"
@@ -14,6 +15,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/miekg/dns"
 )
 
@@ -154,16 +156,14 @@ type ipResult struct {
 // lookupNetIP performs a DNS lookup of host and returns the result.  network
 // must be either [bootstrap.NetworkIP4], [bootstrap.NetworkIP6], or
 // [bootstrap.NetworkIP].  host must be in a lower-case FQDN form.
-//
-// TODO(e.burkov):  Use context.
 func (r *UpstreamResolver) lookupNetIP(
-	_ context.Context,
+	ctx context.Context,
 	network bootstrap.Network,
 	host string,
 ) (result *ipResult, err error) {
 	switch network {
 	case bootstrap.NetworkIP4, bootstrap.NetworkIP6:
-		return r.request(host, network)
+		return r.request(ctx, host, network)
 	case bootstrap.NetworkIP:
 		// Go on.
 	default:
@@ -171,8 +171,8 @@ func (r *UpstreamResolver) lookupNetIP(
 	}
 
 	resCh := make(chan any, 2)
-	go r.resolveAsync(resCh, host, bootstrap.NetworkIP4)
-	go r.resolveAsync(resCh, host, bootstrap.NetworkIP6)
+	go r.resolveAsync(ctx, resCh, host, bootstrap.NetworkIP4)
+	go r.resolveAsync(ctx, resCh, host, bootstrap.NetworkIP6)
 
 	var errs []error
 	result = &ipResult{}
@@ -199,7 +199,11 @@ func (r *UpstreamResolver) lookupNetIP(
 //
 // TODO(e.burkov):  Consider NS and Extra sections when setting TTL.  Check out
 // what RFCs say about it.
-func (r *UpstreamResolver) request(host string, n bootstrap.Network) (res *ipResult, err error) {
+func (r *UpstreamResolver) request(
+	ctx context.Context,
+	host string,
+	n bootstrap.Network,
+) (res *ipResult, err error) {
 	var qtype uint16
 	switch n {
 	case bootstrap.NetworkIP4:
@@ -224,7 +228,7 @@ func (r *UpstreamResolver) request(host string, n bootstrap.Network) (res *ipRes
 
 	// As per [Upstream.Exchange] documentation, the response is always returned
 	// if no error occurred.
-	resp, err := r.Exchange(req)
+	resp, err := r.Exchange(ctx, req)
 	if err != nil {
 		return res, err
 	}
@@ -251,8 +255,13 @@ func (r *UpstreamResolver) request(host string, n bootstrap.Network) (res *ipRes
 
 // resolveAsync performs a single DNS lookup and sends the result to ch.  It's
 // intended to be used as a goroutine.
-func (r *UpstreamResolver) resolveAsync(resCh chan<- any, host, network string) {
-	res, err := r.request(host, network)
+func (r *UpstreamResolver) resolveAsync(
+	ctx context.Context,
+	resCh chan<- any,
+	host string,
+	network bootstrap.Network,
+) {
+	res, err := r.request(ctx, host, network)
 	if err != nil {
 		resCh <- err
 	} else {
@@ -261,26 +270,81 @@ func (r *UpstreamResolver) resolveAsync(resCh chan<- any, host, network string)
 }
 
 // CachingResolver is a [Resolver] that caches the results of lookups.  It's
-// required to be created with [NewCachingResolver].
+// required to be created with [NewCachingResolver] or
+// [NewCachingResolverWithConfig].
 type CachingResolver struct {
 	// resolver is the underlying resolver to use for lookups.
 	resolver *UpstreamResolver
 
-	// mu protects cache and it's elements.
+	// logger is used to log the background refreshes.
+	logger *slog.Logger
+
+	// mu protects cache, refreshing, and their elements.
 	mu *sync.RWMutex
 
 	// cache is the set of resolved hostnames mapped to cached addresses.
 	//
 	// TODO(e.burkov):  Use expiration cache.
 	cache map[string]*ipResult
+
+	// refreshing is the set of hostnames being refreshed in the background.
+	refreshing map[string]struct{}
+
+	// refreshBefore is the period of time before the cached addresses expire
+	// during which they're refreshed in the background.
+	refreshBefore time.Duration
+
+	// maxStale is the period of time after the cached addresses expire during
+	// which they're used if the hostname can't be resolved.
+	maxStale time.Duration
+}
+
+// CachingResolverConfig is the configuration of a [CachingResolver].
+type CachingResolverConfig struct {
+	// Resolver is the underlying resolver to use for lookups.  It must not be
+	// nil.
+	Resolver *UpstreamResolver
+
+	// Logger is used to log the background refreshes.  If nil, [slog.Default]
+	// is used.
+	Logger *slog.Logger
+
+	// RefreshBefore is the period of time before the cached addresses expire
+	// during which a lookup returns them and resolves the hostname again in the
+	// background, so that the addresses of the upstreams are kept up to date.
+	// Zero disables the proactive refresh.
+	RefreshBefore time.Duration
+
+	// MaxStale is the period of time after the cached addresses expire during
+	// which a lookup returns them if the hostname can't be resolved, so that
+	// the upstreams stay reachable while the bootstrap servers are.  Zero
+	// disables serving the stale addresses.
+	MaxStale time.Duration
 }
 
 // NewCachingResolver creates a new caching resolver that uses r for lookups.
 func NewCachingResolver(r *UpstreamResolver) (cr *CachingResolver) {
+	return NewCachingResolverWithConfig(&CachingResolverConfig{
+		Resolver: r,
+	})
+}
+
+// NewCachingResolverWithConfig creates a new caching resolver with the given
+// configuration.  c must not be nil.
+func NewCachingResolverWithConfig(c *CachingResolverConfig) (cr *CachingResolver) {
+	l := c.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+
 	return &CachingResolver{
-		resolver: r,
-		mu:       &sync.RWMutex{},
-		cache:    map[string]*ipResult{},
+		resolver:      c.Resolver,
+		logger:        l,
+		mu:            &sync.RWMutex{},
+		cache:         map[string]*ipResult{},
+		refreshing:    map[string]struct{}{},
+		refreshBefore: c.RefreshBefore,
+		maxStale:      c.MaxStale,
 	}
 }
 
@@ -299,13 +363,23 @@ func (r *CachingResolver) LookupNetIP(
 	now := time.Now()
 	host = dns.Fqdn(strings.ToLower(host))
 
-	addrs = r.findCached(host, now)
-	if addrs != nil {
-		return slices.Clone(addrs), nil
+	cached := r.findResult(host)
+	if cached != nil && !cached.expire.Before(now) {
+		if cached.expire.Sub(now) < r.refreshBefore {
+			r.refreshAsync(ctx, network, host)
+		}
+
+		return slices.Clone(cached.addrs), nil
 	}
 
 	res, err := r.resolver.lookupNetIP(ctx, network, host)
 	if err != nil {
+		if cached != nil && now.Before(cached.expire.Add(r.maxStale)) {
+			r.logger.DebugContext(ctx, "using stale addresses", "host", host, slogutil.KeyError, err)
+
+			return slices.Clone(cached.addrs), nil
+		}
+
 		return []netip.Addr{}, err
 	}
 
@@ -317,17 +391,23 @@ func (r *CachingResolver) LookupNetIP(
 // findCached returns the cached addresses for host if it's not expired yet, and
 // the corresponding cached result, if any.  It's safe for concurrent use.
 func (r *CachingResolver) findCached(host string, now time.Time) (addrs []netip.Addr) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	res, ok := r.cache[host]
-	if !ok || res.expire.Before(now) {
+	res := r.findResult(host)
+	if res == nil || res.expire.Before(now) {
 		return nil
 	}
 
 	return res.addrs
 }
 
+// findResult returns the cached result for host, if any, regardless of its
+// expiration.  It's safe for concurrent use.
+func (r *CachingResolver) findResult(host string) (res *ipResult) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cache[host]
+}
+
 // setCached sets the result into the address cache for host.  It's safe for
 // concurrent use.
 func (r *CachingResolver) setCached(host string, res *ipResult) {
@@ -336,3 +416,42 @@ func (r *CachingResolver) setCached(host string, res *ipResult) {
 
 	r.cache[host] = res
 }
+
+// refreshAsync resolves host in the background and caches the result, unless
+// it's already being refreshed.  The refresh isn't canceled with ctx, since
+// the lookup it's started by doesn't wait for it.  It's safe for concurrent
+// use.
+func (r *CachingResolver) refreshAsync(ctx context.Context, network bootstrap.Network, host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.refreshing[host]; ok {
+		return
+	}
+
+	r.refreshing[host] = struct{}{}
+
+	go r.refresh(context.WithoutCancel(ctx), network, host)
+}
+
+// refresh resolves host and caches the result.  The cached addresses are kept
+// if the hostname can't be resolved.  It's intended to be used as a goroutine.
+func (r *CachingResolver) refresh(ctx context.Context, network bootstrap.Network, host string) {
+	defer slogutil.RecoverAndLog(ctx, r.logger)
+
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		delete(r.refreshing, host)
+	}()
+
+	res, err := r.resolver.lookupNetIP(ctx, network, host)
+	if err != nil {
+		r.logger.DebugContext(ctx, "refreshing addresses", "host", host, slogutil.KeyError, err)
+
+		return
+	}
+
+	r.setCached(host, res)
+}
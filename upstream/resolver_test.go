@@ -3,6 +3,7 @@ package upstream_test
 import (
 	"context"
 	"net/netip"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/AdguardTeam/dnsproxy/internal/dnsproxytest"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -20,7 +22,7 @@ func TestNewUpstreamResolver(t *testing.T) {
 	ups := &dnsproxytest.Upstream{
 		OnAddress: func() (_ string) { panic(testutil.UnexpectedCall()) },
 		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
-		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 			resp = (&dns.Msg{}).SetReply(req)
 			resp.Answer = []dns.RR{&dns.A{
 				Hdr: dns.RR_Header{
@@ -133,7 +135,7 @@ func TestCachingResolver_staleness(t *testing.T) {
 		fqdn = "test.fully.qualified.name."
 	)
 
-	onExchange := func(req *dns.Msg) (resp *dns.Msg, err error) {
+	onExchange := func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
 		resp = (&dns.Msg{}).SetReply(req)
 
 		hdr := dns.RR_Header{
@@ -207,3 +209,121 @@ func TestCachingResolver_staleness(t *testing.T) {
 		require.Empty(t, cached)
 	})
 }
+
+// newTestCachingResolver returns a caching resolver with c, which resolver is
+// replaced with the upstream responding with the A record holding the address
+// from ip with the given TTL, or with an error if fail is true.  The AAAA
+// requests are responded with no records.
+func newTestCachingResolver(
+	c *upstream.CachingResolverConfig,
+	ip *atomic.Pointer[netip.Addr],
+	fail *atomic.Bool,
+	ttl uint32,
+) (r *upstream.CachingResolver) {
+	ups := &dnsproxytest.Upstream{
+		OnAddress: func() (_ string) { panic(testutil.UnexpectedCall()) },
+		OnClose:   func() (_ error) { panic(testutil.UnexpectedCall()) },
+		OnExchange: func(_ context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+			if fail.Load() {
+				return nil, errors.Error("test error")
+			}
+
+			resp = (&dns.Msg{}).SetReply(req)
+			if q := req.Question[0]; q.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    ttl,
+					},
+					A: ip.Load().AsSlice(),
+				})
+			}
+
+			return resp, nil
+		},
+	}
+
+	c.Resolver = &upstream.UpstreamResolver{Upstream: ups}
+
+	return upstream.NewCachingResolverWithConfig(c)
+}
+
+func TestCachingResolver_refresh(t *testing.T) {
+	const host = "refresh.example."
+
+	oldIP := netip.MustParseAddr("192.0.2.1")
+	ip := &atomic.Pointer[netip.Addr]{}
+	ip.Store(&oldIP)
+
+	r := newTestCachingResolver(&upstream.CachingResolverConfig{
+		Logger:        slogutil.NewDiscardLogger(),
+		RefreshBefore: time.Hour,
+	}, ip, &atomic.Bool{}, 60)
+
+	ctx := testutil.ContextWithTimeout(t, testTimeout)
+	addrs, err := r.LookupNetIP(ctx, bootstrap.NetworkIP, host)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{oldIP}, addrs)
+
+	newIP := netip.MustParseAddr("192.0.2.2")
+	ip.Store(&newIP)
+
+	// The cached addresses are returned while the hostname is refreshed in the
+	// background.
+	assert.EventuallyWithT(t, func(ct *assert.CollectT) {
+		addrs, err = r.LookupNetIP(ctx, bootstrap.NetworkIP, host)
+		require.NoError(ct, err)
+
+		assert.Equal(ct, []netip.Addr{newIP}, addrs)
+	}, testTimeout, testTimeout/10)
+}
+
+func TestCachingResolver_stale(t *testing.T) {
+	const host = "stale.example."
+
+	oldIP := netip.MustParseAddr("192.0.2.1")
+
+	testCases := []struct {
+		wantErr  assert.ErrorAssertionFunc
+		name     string
+		want     []netip.Addr
+		maxStale time.Duration
+	}{{
+		wantErr:  assert.NoError,
+		name:     "stale",
+		want:     []netip.Addr{oldIP},
+		maxStale: time.Hour,
+	}, {
+		wantErr:  assert.Error,
+		name:     "no_stale",
+		want:     []netip.Addr{},
+		maxStale: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip := &atomic.Pointer[netip.Addr]{}
+			ip.Store(&oldIP)
+			fail := &atomic.Bool{}
+
+			// Use zero TTL to make the cached addresses expire immediately.
+			r := newTestCachingResolver(&upstream.CachingResolverConfig{
+				Logger:   slogutil.NewDiscardLogger(),
+				MaxStale: tc.maxStale,
+			}, ip, fail, 0)
+
+			ctx := testutil.ContextWithTimeout(t, testTimeout)
+			_, err := r.LookupNetIP(ctx, bootstrap.NetworkIP, host)
+			require.NoError(t, err)
+
+			fail.Store(true)
+
+			addrs, err := r.LookupNetIP(ctx, bootstrap.NetworkIP, host)
+			tc.wantErr(t, err)
+
+			assert.Equal(t, tc.want, addrs)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -81,7 +82,7 @@ func TestUpstream_bootstrapTimeout(t *testing.T) {
 			req := createTestMessage()
 
 			start := time.Now()
-			_, rErr := u.Exchange(req)
+			_, rErr := u.Exchange(context.Background(), req)
 			elapsed := time.Since(start)
 
 			if rErr == nil {
@@ -542,6 +543,66 @@ func TestAddressToUpstream_StaticResolver(t *testing.T) {
 	}
 }
 
+func TestAddressToUpstream_stampHashes(t *testing.T) {
+	t.Parallel()
+
+	srv := startDoTServer(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		require.NoError(testutil.PanicT{}, w.WriteMsg(respondToTestMessage(m)))
+	})
+
+	cert, err := x509.ParseCertificate(srv.tlsConfig.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+
+	certHash := sha256.Sum256(cert.RawTBSCertificate)
+	addr := netip.AddrPortFrom(netutil.IPv4Localhost(), uint16(srv.port)).String()
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		hashes  [][]byte
+	}{{
+		wantErr: nil,
+		name:    "match",
+		hashes:  [][]byte{make([]byte, sha256.Size), certHash[:]},
+	}, {
+		wantErr: errStampHashMismatch,
+		name:    "mismatch",
+		hashes:  [][]byte{make([]byte, sha256.Size)},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			stamp := (&dnsstamps.ServerStamp{
+				ServerAddrStr: addr,
+				Proto:         dnsstamps.StampProtoTypeTLS,
+				ProviderName:  addr,
+				Hashes:        tc.hashes,
+			}).String()
+
+			bootstrap := &UpstreamResolver{Upstream: nil}
+			opts := &Options{
+				Logger:             testLogger,
+				Bootstrap:          bootstrap,
+				Timeout:            timeout,
+				InsecureSkipVerify: true,
+			}
+
+			u, uErr := AddressToUpstream(stamp, opts)
+			require.NoError(t, uErr)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			// The options of the stamp mustn't leak into the shared ones.
+			assert.Same(t, bootstrap, opts.Bootstrap)
+			assert.Nil(t, opts.VerifyConnection)
+
+			_, exchErr := u.Exchange(context.Background(), createTestMessage())
+			assert.ErrorIs(t, exchErr, tc.wantErr)
+		})
+	}
+}
+
 func TestAddPort(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -607,7 +668,7 @@ func checkUpstream(tb testing.TB, u Upstream, addr string) {
 	tb.Helper()
 
 	req := createTestMessage()
-	reply, err := u.Exchange(req)
+	reply, err := u.Exchange(context.Background(), req)
 	require.NoErrorf(tb, err, "couldn't talk to upstream %s", addr)
 
 	requireResponse(tb, req, reply)
@@ -628,7 +689,7 @@ func checkRaceCondition(u Upstream) {
 		for range reqCount {
 			req := createTestMessage()
 			// Ignore exchange errors here, the point is to check for races.
-			_, _ = u.Exchange(req)
+			_, _ = u.Exchange(context.Background(), req)
 		}
 	}
 
@@ -883,3 +944,20 @@ func (r *headerRecorder) headersWithLock() (res []qlog.PacketHeader) {
 func (*headerRecorder) Close() (err error) {
 	return nil
 }
+
+// testResolver is a [Resolver] implementation for tests.
+type testResolver struct {
+	onLookupNetIP func(ctx context.Context, network, host string) (addrs []netip.Addr, err error)
+}
+
+// type check
+var _ Resolver = (*testResolver)(nil)
+
+// LookupNetIP implements the [Resolver] interface for *testResolver.
+func (r *testResolver) LookupNetIP(
+	ctx context.Context,
+	network string,
+	host string,
+) (addrs []netip.Addr, err error) {
+	return r.onLookupNetIP(ctx, network, host)
+}